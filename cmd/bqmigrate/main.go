@@ -0,0 +1,77 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command bqmigrate copies BigQuery tables that are not partitioned
+// into partitioned ones.
+//
+// Stop everything that writes to the tables before running it: rows
+// written during the migration would be lost, and BigQuery cannot rename
+// a table whose streaming buffer has rows. It is safe to run bqmigrate
+// again after a failure; it resumes where it stopped.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+
+	"golang.org/x/pkgsite-metrics/internal/analysis"
+	"golang.org/x/pkgsite-metrics/internal/bigquery"
+	"golang.org/x/pkgsite-metrics/internal/config"
+	"golang.org/x/pkgsite-metrics/internal/govulncheck"
+)
+
+var dataset = flag.String("dataset", "", "BigQuery dataset (default: GO_ECOSYSTEM_BIGQUERY_DATASET)")
+
+func main() {
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintln(out, "usage:")
+		fmt.Fprintln(out, "bqmigrate [-dataset DATASET] [TABLE ...]")
+		fmt.Fprintf(out, "  migrate the tables (default: %s and %s) to partitioned tables\n",
+			govulncheck.TableName, analysis.TableName)
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+	if err := run(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(ctx context.Context) error {
+	cfg, err := config.Init(ctx)
+	if err != nil {
+		return err
+	}
+	if cfg.ProjectID == "" {
+		return errors.New("missing project ID (GOOGLE_CLOUD_PROJECT environment variable)")
+	}
+	ds := *dataset
+	if ds == "" {
+		ds = cfg.BigQueryDataset
+	}
+	if ds == "" || ds == "disable" {
+		return errors.New("missing dataset (-dataset flag or GO_ECOSYSTEM_BIGQUERY_DATASET environment variable)")
+	}
+	client, err := bigquery.NewClientCreate(ctx, cfg.ProjectID, ds)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	tables := flag.Args()
+	if len(tables) == 0 {
+		tables = []string{govulncheck.TableName, analysis.TableName}
+	}
+	for _, t := range tables {
+		if err := client.MigrateToPartitioned(ctx, t); err != nil {
+			return err
+		}
+		fmt.Printf("%s is partitioned\n", t)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+)
+
+// errTooManyDifferences is returned by compare when more modules differ
+// than -tolerance allows.
+var errTooManyDifferences = errors.New("too many differences")
+
+// doCompare starts a job for each of two analysis binaries on the same
+// sample of modules, waits for them, and compares their results, as the
+// diff command does. It is meant to check that a rewritten analyzer
+// finds the same things.
+func doCompare(ctx context.Context, args []string) error {
+	if len(args) < 2 {
+		return errors.New("wrong number of args: want [-sample F] [-seed S] [-min N] [-tolerance N] [-force] BINARY_OLD BINARY_NEW [ARG1 ARG2 ...]")
+	}
+	if !(sample > 0 && sample <= 1) {
+		return fmt.Errorf("-sample must be greater than 0 and at most 1, got %g", sample)
+	}
+	oldBinary, newBinary, binaryArgs := args[0], args[1], args[2:]
+	// Binaries are uploaded by name, so one would replace the other.
+	if filepath.Base(oldBinary) == filepath.Base(newBinary) {
+		return fmt.Errorf("binaries %s and %s have the same name; rename one", oldBinary, newBinary)
+	}
+	for _, b := range []string{oldBinary, newBinary} {
+		if err := checkStartArgs(b, binaryArgs); err != nil {
+			return err
+		}
+	}
+	if sampleSeed == "" {
+		sampleSeed = strconv.FormatUint(rand.Uint64(), 36)
+	}
+	its, err := identityTokenSource(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Starting %s and %s on a sample of %g of the modules (seed %s).\n",
+		filepath.Base(oldBinary), filepath.Base(newBinary), sample, sampleSeed)
+	var jobIDs [2]string
+	for i, b := range []string{oldBinary, newBinary} {
+		jobID, err := startJob(ctx, its, b, binaryArgs, minImporters)
+		if err != nil {
+			if i > 0 && jobIDs[0] != "" {
+				fmt.Printf("Job %s for %s is still running.\n", jobIDs[0], filepath.Base(oldBinary))
+			}
+			return err
+		}
+		if jobID == "" && !*dryRun {
+			return errors.New("no job ID in response")
+		}
+		jobIDs[i] = jobID
+	}
+	if *dryRun {
+		return nil
+	}
+
+	// Stop waiting on interrupt, but leave the jobs running.
+	wctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+	for _, jobID := range jobIDs {
+		if !*jsonOut {
+			fmt.Printf("Waiting for job %s.\n", jobID)
+		}
+		if _, err := pollJob(wctx, jobID, its); err != nil {
+			if errors.Is(err, context.Canceled) && ctx.Err() == nil {
+				fmt.Printf("Stopped waiting. Compare the jobs later with: ejobs diff %s %s\n", jobIDs[0], jobIDs[1])
+				return nil
+			}
+			return err
+		}
+	}
+
+	d, err := diffJobs(ctx, jobIDs[0], jobIDs[1], its)
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		if err := printJSON(d); err != nil {
+			return err
+		}
+	} else {
+		printDiff(jobIDs[0], jobIDs[1], d)
+		fmt.Println()
+		fmt.Printf("Identical: %d\n", d.NumIdentical)
+		fmt.Printf("Only old:  %d\n", len(d.OnlyInOld))
+		fmt.Printf("Only new:  %d\n", len(d.OnlyInNew))
+		fmt.Printf("Changed:   %d\n", len(d.Changed))
+	}
+	if n := d.numDifferences(); n > tolerance {
+		return fmt.Errorf("%w: %d modules differ, tolerance is %d", errTooManyDifferences, n, tolerance)
+	}
+	return nil
+}
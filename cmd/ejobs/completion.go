@@ -0,0 +1,210 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	"golang.org/x/pkgsite-metrics/internal/jobs"
+)
+
+// The completion command is added in init, because it refers to
+// the commands table.
+func init() {
+	commands = append(commands, command{"completion", "bash | zsh",
+		"print a shell completion script; for example, in .bashrc: source <(ejobs completion bash)",
+		doCompletion, nil})
+}
+
+// argWords are the words that commands take as their first argument,
+// other than job IDs and files.
+var argWords = map[string][]string{
+	"binaries":   {"list", "rm"},
+	"completion": {"bash", "zsh"},
+}
+
+func doCompletion(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("wrong number of args: want bash or zsh")
+	}
+	switch args[0] {
+	case "bash":
+		return bashCompletion.Execute(os.Stdout, completionData())
+	case "zsh":
+		return zshCompletion.Execute(os.Stdout, completionData())
+	case "jobids":
+		// The scripts run "ejobs completion jobids" to complete job IDs.
+		return printJobIDs(ctx)
+	default:
+		return fmt.Errorf("unknown shell %q: want bash or zsh", args[0])
+	}
+}
+
+// printJobIDs prints the IDs of the jobs, one per line.
+func printJobIDs(ctx context.Context) error {
+	ts, err := identityTokenSource(ctx)
+	if err != nil {
+		return err
+	}
+	joblist, err := requestJSON[[]jobs.Job](ctx, "jobs/list", ts)
+	if err != nil || *dryRun {
+		return err
+	}
+	for _, j := range *joblist {
+		fmt.Println(j.ID())
+	}
+	return nil
+}
+
+// completionCommand describes how to complete the words after a command.
+type completionCommand struct {
+	Name   string
+	Desc   string
+	Flags  string // flags, separated by spaces
+	Words  string // words of argWords, separated by spaces
+	JobIDs bool   // whether the command takes job IDs
+}
+
+// completionData returns the data of the completion script templates.
+func completionData() any {
+	var cmds []completionCommand
+	for _, cmd := range commands {
+		cc := completionCommand{
+			Name:   cmd.name,
+			Desc:   cmd.desc,
+			Words:  strings.Join(argWords[cmd.name], " "),
+			JobIDs: strings.Contains(cmd.argdoc, "JOBID"),
+		}
+		if cmd.flagdefs != nil {
+			fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+			cmd.flagdefs(fs)
+			cc.Flags, _ = flagNames(fs)
+		}
+		cmds = append(cmds, cc)
+	}
+	flags, valueFlags := flagNames(flag.CommandLine)
+	return map[string]any{
+		"Commands":   cmds,
+		"Flags":      flags,
+		"ValueFlags": valueFlags,
+	}
+}
+
+// flagNames returns the names of the flags of fs with a leading dash,
+// separated by spaces, and the names of those that take a value,
+// separated by "|" for use in a shell case pattern.
+func flagNames(fs *flag.FlagSet) (all, withValue string) {
+	var names, valueNames []string
+	fs.VisitAll(func(f *flag.Flag) {
+		names = append(names, "-"+f.Name)
+		if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !bf.IsBoolFlag() {
+			valueNames = append(valueNames, "-"+f.Name)
+		}
+	})
+	return strings.Join(names, " "), strings.Join(valueNames, "|")
+}
+
+var completionFuncs = template.FuncMap{
+	// zshItem returns a quoted zsh _describe item, in which a colon
+	// separates the word from its description.
+	"zshItem": func(word, desc string) string {
+		s := strings.ReplaceAll(word, ":", `\:`) + ":" + strings.ReplaceAll(desc, ":", `\:`)
+		return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	},
+}
+
+// The scripts find the command as the first word that is neither a flag
+// nor the value of a common flag. They complete common flags before the
+// command, and the command's flags, its argWords, job IDs or files after it.
+// Job IDs are listed by running ejobs with the same common flags, so that
+// -env and -project are respected.
+
+var bashCompletion = template.Must(template.New("bash").Funcs(completionFuncs).Parse(`# bash completion for ejobs
+_ejobs() {
+	local cur=${COMP_WORDS[COMP_CWORD]}
+	local i cmd=
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		case ${COMP_WORDS[i]} in
+		{{.ValueFlags}}) ((i++)) ;;
+		-*) ;;
+		*) cmd=${COMP_WORDS[i]}; break ;;
+		esac
+	done
+	if [[ -z $cmd ]]; then
+		if [[ $cur == -* ]]; then
+			COMPREPLY=($(compgen -W "{{.Flags}}" -- "$cur"))
+		else
+			COMPREPLY=($(compgen -W "{{range $i, $c := .Commands}}{{if $i}} {{end}}{{$c.Name}}{{end}}" -- "$cur"))
+		fi
+		return
+	fi
+	local flags= words= jobids=
+	case $cmd in
+{{- range .Commands}}
+	{{.Name}}) flags="{{.Flags}}"; words="{{.Words}}"{{if .JobIDs}}; jobids=1{{end}} ;;
+{{- end}}
+	esac
+	if [[ $cur == -* ]]; then
+		COMPREPLY=($(compgen -W "$flags" -- "$cur"))
+	elif [[ -n $words && ${COMP_WORDS[COMP_CWORD-1]} == $cmd ]]; then
+		COMPREPLY=($(compgen -W "$words" -- "$cur"))
+	elif [[ -n $jobids ]]; then
+		COMPREPLY=($(compgen -W "$(ejobs "${COMP_WORDS[@]:1:i-1}" completion jobids 2>/dev/null)" -- "$cur"))
+	else
+		COMPREPLY=($(compgen -f -- "$cur"))
+	fi
+}
+complete -F _ejobs ejobs
+`))
+
+var zshCompletion = template.Must(template.New("zsh").Funcs(completionFuncs).Parse(`#compdef ejobs
+_ejobs() {
+	local -a commands
+	commands=(
+{{- range .Commands}}
+		{{zshItem .Name .Desc}}
+{{- end}}
+	)
+	local i cmd
+	for ((i = 2; i < CURRENT; i++)); do
+		case ${words[i]} in
+		{{.ValueFlags}}) ((i++)) ;;
+		-*) ;;
+		*) cmd=${words[i]}; break ;;
+		esac
+	done
+	if [[ -z $cmd ]]; then
+		if [[ $PREFIX == -* ]]; then
+			compadd -- {{.Flags}}
+		else
+			_describe command commands
+		fi
+		return
+	fi
+	local -a flags argwords
+	local jobids=0
+	case $cmd in
+{{- range .Commands}}
+	{{.Name}}) flags=({{.Flags}}); argwords=({{.Words}}){{if .JobIDs}}; jobids=1{{end}} ;;
+{{- end}}
+	esac
+	if [[ $PREFIX == -* ]]; then
+		compadd -- $flags
+	elif (( $#argwords && CURRENT == i + 1 )); then
+		compadd -- $argwords
+	elif (( jobids )); then
+		compadd -- ${(f)"$(ejobs ${words[2,i-1]} completion jobids 2>/dev/null)"}
+	else
+		_files
+	fi
+}
+compdef _ejobs ejobs
+`))
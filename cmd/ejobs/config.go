@@ -0,0 +1,90 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// defaultProjectID is the GCP project used when none is configured.
+const defaultProjectID = "go-ecosystem"
+
+// config holds settings that identify the GCP project ejobs operates on.
+// It is read from $XDG_CONFIG_HOME/ejobs/config.json (or the platform
+// equivalent), if that file exists. Empty fields get defaults.
+type config struct {
+	// Project is the GCP project ID.
+	// The -project flag overrides it.
+	Project string
+	// ServiceAccount is the email of the service account to impersonate.
+	// Default: impersonate@PROJECT.iam.gserviceaccount.com.
+	ServiceAccount string
+	// BinaryBucket is the GCS bucket holding analysis binaries.
+	// Default: the project ID.
+	BinaryBucket string
+	// EnvBinaryBuckets maps a worker environment, like dev, to the GCS
+	// bucket of its analysis binaries, if that is not BinaryBucket.
+	EnvBinaryBuckets map[string]string
+	// WorkerURLSuffix is the suffix of the worker URL.
+	// The GO_ECOSYSTEM_WORKER_URL_SUFFIX environment variable overrides it.
+	WorkerURLSuffix string
+	// BigQueryDataset is the BigQuery dataset of the worker's results.
+	// The GO_ECOSYSTEM_BIGQUERY_DATASET environment variable overrides it.
+	BigQueryDataset string
+}
+
+// binaryBucket returns the GCS bucket of the analysis binaries of the
+// worker environment env.
+func (c *config) binaryBucket(env string) string {
+	if b := c.EnvBinaryBuckets[env]; b != "" {
+		return b
+	}
+	return c.BinaryBucket
+}
+
+// cfg is the configuration in effect, set by run.
+var cfg config
+
+// loadConfig reads the config file, then applies the -project flag,
+// environment variables and defaults.
+func loadConfig() (config, error) {
+	var c config
+	dir, err := os.UserConfigDir()
+	if err == nil {
+		filename := filepath.Join(dir, "ejobs", "config.json")
+		data, err := os.ReadFile(filename)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return c, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &c); err != nil {
+				return c, fmt.Errorf("%s: %w", filename, err)
+			}
+		}
+	}
+	if *project != "" {
+		c.Project = *project
+	}
+	if c.Project == "" {
+		c.Project = defaultProjectID
+	}
+	if c.ServiceAccount == "" {
+		c.ServiceAccount = fmt.Sprintf("impersonate@%s.iam.gserviceaccount.com", c.Project)
+	}
+	if c.BinaryBucket == "" {
+		c.BinaryBucket = c.Project
+	}
+	if wu := os.Getenv("GO_ECOSYSTEM_WORKER_URL_SUFFIX"); wu != "" {
+		c.WorkerURLSuffix = wu
+	}
+	if ds := os.Getenv("GO_ECOSYSTEM_BIGQUERY_DATASET"); ds != "" {
+		c.BigQueryDataset = ds
+	}
+	return c, nil
+}
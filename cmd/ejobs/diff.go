@@ -0,0 +1,181 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/pkgsite-metrics/internal/analysis"
+)
+
+// A jobDiff describes the differences between the results of two jobs.
+type jobDiff struct {
+	// Modules (as module@version) that have results in only one of the jobs.
+	// These reflect differences in what was scanned, not in the binaries.
+	OnlyInOld []string
+	OnlyInNew []string
+	// Modules with results in both jobs whose results differ.
+	Changed []*moduleDiff
+	// NumIdentical is the number of modules with the same results
+	// in both jobs.
+	NumIdentical int
+}
+
+// numDifferences returns the number of modules whose results differ,
+// including those that have results in only one job.
+func (d *jobDiff) numDifferences() int {
+	return len(d.OnlyInOld) + len(d.OnlyInNew) + len(d.Changed)
+}
+
+// A moduleDiff describes the differences between the results
+// for a single module in two jobs.
+type moduleDiff struct {
+	Module   string // module@version
+	OldError string `json:",omitempty"`
+	NewError string `json:",omitempty"`
+	Added    []*analysis.Diagnostic
+	Removed  []*analysis.Diagnostic
+}
+
+func doDiff(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errors.New("wrong number of args: want JOBID1 JOBID2")
+	}
+	ts, err := identityTokenSource(ctx)
+	if err != nil {
+		return err
+	}
+	d, err := diffJobs(ctx, args[0], args[1], ts)
+	if err != nil || *dryRun {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(d)
+	}
+	printDiff(args[0], args[1], d)
+	return nil
+}
+
+// diffJobs downloads the results of two jobs and compares them.
+// The results of each job are selected by its ID, so two jobs that ran
+// the same binary with the same args have different results.
+// On a dry run, it returns a nil diff.
+func diffJobs(ctx context.Context, oldJobID, newJobID string, ts oauth2.TokenSource) (*jobDiff, error) {
+	var results [2][]*analysis.Result
+	for i, jobID := range []string{oldJobID, newJobID} {
+		rs, err := requestJSON[[]*analysis.Result](ctx, "jobs/results?jobid="+url.QueryEscape(jobID), ts)
+		if err != nil {
+			return nil, err
+		}
+		if rs != nil {
+			results[i] = *rs
+		}
+	}
+	if *dryRun {
+		return nil, nil
+	}
+	return diffResults(results[0], results[1]), nil
+}
+
+// printDiff prints d, the differences between the results of two jobs,
+// one module per line.
+func printDiff(oldJobID, newJobID string, d *jobDiff) {
+	printModules := func(jobID string, mods []string) {
+		if len(mods) == 0 {
+			return
+		}
+		fmt.Printf("%d modules only in %s:\n", len(mods), jobID)
+		for _, m := range mods {
+			fmt.Printf("\t%s\n", m)
+		}
+	}
+	printModules(oldJobID, d.OnlyInOld)
+	printModules(newJobID, d.OnlyInNew)
+	fmt.Printf("%d modules with different results:\n", len(d.Changed))
+	for _, md := range d.Changed {
+		fmt.Printf("%s:\n", md.Module)
+		if md.OldError != md.NewError {
+			fmt.Printf("\terror: %q => %q\n", md.OldError, md.NewError)
+		}
+		for _, diag := range md.Removed {
+			fmt.Printf("\t- %s\n", formatDiagnostic(diag))
+		}
+		for _, diag := range md.Added {
+			fmt.Printf("\t+ %s\n", formatDiagnostic(diag))
+		}
+	}
+}
+
+// diffResults compares two sets of results, matching them by module@version.
+func diffResults(old, new []*analysis.Result) *jobDiff {
+	key := func(r *analysis.Result) string { return r.ModulePath + "@" + r.Version }
+	oldByMod := map[string]*analysis.Result{}
+	for _, r := range old {
+		oldByMod[key(r)] = r
+	}
+	newByMod := map[string]*analysis.Result{}
+	for _, r := range new {
+		newByMod[key(r)] = r
+	}
+
+	d := &jobDiff{OnlyInOld: []string{}, OnlyInNew: []string{}, Changed: []*moduleDiff{}}
+	for m, o := range oldByMod {
+		n, ok := newByMod[m]
+		if !ok {
+			d.OnlyInOld = append(d.OnlyInOld, m)
+			continue
+		}
+		md := &moduleDiff{
+			Module:   m,
+			OldError: o.Error,
+			NewError: n.Error,
+			Removed:  subtractDiagnostics(o.Diagnostics, n.Diagnostics),
+			Added:    subtractDiagnostics(n.Diagnostics, o.Diagnostics),
+		}
+		if md.OldError != md.NewError || len(md.Removed) > 0 || len(md.Added) > 0 {
+			d.Changed = append(d.Changed, md)
+		} else {
+			d.NumIdentical++
+		}
+	}
+	for m := range newByMod {
+		if _, ok := oldByMod[m]; !ok {
+			d.OnlyInNew = append(d.OnlyInNew, m)
+		}
+	}
+	sort.Strings(d.OnlyInOld)
+	sort.Strings(d.OnlyInNew)
+	sort.Slice(d.Changed, func(i, j int) bool { return d.Changed[i].Module < d.Changed[j].Module })
+	return d
+}
+
+// subtractDiagnostics returns the diagnostics in ds1 that are not in ds2.
+func subtractDiagnostics(ds1, ds2 []*analysis.Diagnostic) []*analysis.Diagnostic {
+	in2 := map[string]bool{}
+	for _, d := range ds2 {
+		in2[formatDiagnostic(d)] = true
+	}
+	var res []*analysis.Diagnostic
+	for _, d := range ds1 {
+		if !in2[formatDiagnostic(d)] {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+// formatDiagnostic returns a one-line description of a diagnostic,
+// which also serves to identify it.
+func formatDiagnostic(d *analysis.Diagnostic) string {
+	if d.Error != "" {
+		return fmt.Sprintf("%s: %s: error: %s", d.PackageID, d.AnalyzerName, d.Error)
+	}
+	return fmt.Sprintf("%s: %s: %s: %s", d.Position, d.AnalyzerName, d.Category, d.Message)
+}
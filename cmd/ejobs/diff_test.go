@@ -0,0 +1,58 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/oauth2"
+	"golang.org/x/pkgsite-metrics/internal/analysis"
+)
+
+func TestDiffJobsSameBinary(t *testing.T) {
+	// Both jobs ran the same binary with the same args, so only their
+	// IDs tell their results apart.
+	wv := analysis.WorkVersion{BinaryVersion: "abc", BinaryArgs: "-strict"}
+	results := map[string][]*analysis.Result{
+		"job-1": {
+			{ModulePath: "example.com/a", Version: "v1.0.0", BinaryName: "nilness", WorkVersion: wv},
+			{ModulePath: "example.com/b", Version: "v1.0.0", BinaryName: "nilness", WorkVersion: wv},
+		},
+		"job-2": {
+			{ModulePath: "example.com/a", Version: "v1.0.0", BinaryName: "nilness", WorkVersion: wv, Error: "timeout"},
+			{ModulePath: "example.com/b", Version: "v1.0.0", BinaryName: "nilness", WorkVersion: wv},
+		},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/jobs/results" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(results[r.URL.Query().Get("jobid")])
+	}))
+	defer srv.Close()
+	defer func(u string) { workerURL = u }(workerURL)
+	workerURL = srv.URL
+
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"})
+	d, err := diffJobs(context.Background(), "job-1", "job-2", ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &jobDiff{
+		OnlyInOld:    []string{},
+		OnlyInNew:    []string{},
+		Changed:      []*moduleDiff{{Module: "example.com/a@v1.0.0", NewError: "timeout"}},
+		NumIdentical: 1,
+	}
+	if diff := cmp.Diff(want, d); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
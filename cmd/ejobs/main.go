@@ -7,49 +7,83 @@ package main
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"debug/buildinfo"
+	"debug/elf"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"reflect"
+	"slices"
 	"strings"
 	"text/tabwriter"
 	"time"
 	"unicode"
 
+	"cloud.google.com/go/logging"
+	"cloud.google.com/go/logging/logadmin"
 	"cloud.google.com/go/storage"
+	"golang.org/x/exp/maps"
 	"golang.org/x/oauth2"
 	"golang.org/x/pkgsite-metrics/internal/analysis"
+	"golang.org/x/pkgsite-metrics/internal/bigquery"
 	"golang.org/x/pkgsite-metrics/internal/jobs"
 	"google.golang.org/api/impersonate"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 const (
-	projectID           = "go-ecosystem"
 	uploaderMetadataKey = "uploader"
+	sha256MetadataKey   = "sha256"
+	binariesDir         = "analysis-binaries" // GCS directory of analysis binaries
 )
 
 // Common flags
 var (
-	env    = flag.String("env", "prod", "worker environment (dev or prod)")
-	dryRun = flag.Bool("n", false, "print actions but do not execute them")
+	env     = flag.String("env", "prod", "worker environment (dev or prod)")
+	dryRun  = flag.Bool("n", false, "print actions but do not execute them; start shows the tasks it would enqueue")
+	usePost = flag.Bool("post", false, "send enqueue requests as POST with a JSON body")
+	jsonOut = flag.Bool("json", false, "display output as JSON (show, list, wait, diff, compare and start -n)")
+	project = flag.String("project", "", "GCP project ID (default from config file, or "+defaultProjectID+")")
 )
 
 var (
-	minImporters int           // for start
+	minImporters int           // for start and estimate
+	waitForStart bool          // for start
+	forceStart   bool          // for start
+	allowDynamic bool          // for start
+	priority     string        // for start
+	notifyURL    string        // for start
+	manifestFile string        // for start
+	sample       float64       // for compare
+	sampleSeed   string        // for compare
+	tolerance    int           // for compare
 	waitInterval time.Duration // for wait
+	waitTimeout  time.Duration // for wait
 	force        bool          // for results
 	outfile      string        // for results
+	errorsOnly   bool          // for results
+	forceRemove  bool          // for binaries
+	cancelAll    bool          // for cancel
+	cancelUser   string        // for cancel
+	logSeverity  string        // for logs
+	logLimit     int           // for logs
 )
 
 var commands = []command{
@@ -59,30 +93,89 @@ var commands = []command{
 	{"show", "JOBID...",
 		"display information about jobs in the last 7 days",
 		doShow, nil},
-	{"cancel", "JOBID...",
+	{"cancel", "JOBID... | -all [-user NAME]",
 		"cancel the jobs",
-		doCancel, nil},
-	{"start", "[-min MIN_IMPORTERS] BINARY ARGS...",
+		doCancel,
+		func(fs *flag.FlagSet) {
+			fs.BoolVar(&cancelAll, "all", false, "cancel all unfinished jobs, after confirmation")
+			fs.StringVar(&cancelUser, "user", "", "with -all, only cancel jobs of this user")
+		},
+	},
+	{"start", "[-min MIN_IMPORTERS] [-wait] [-force] [-allow-dynamic] [-priority high|low] [-notify URL] BINARY ARGS... | -manifest FILE",
 		"start a job",
 		doStart,
 		func(fs *flag.FlagSet) {
 			fs.IntVar(&minImporters, "min", -1,
 				"run on modules with at least this many importers (<0: use server default of 10)")
+			fs.BoolVar(&waitForStart, "wait", false, "wait for the job to finish")
+			fs.BoolVar(&forceStart, "force", false, "do not ask for confirmation")
+			fs.BoolVar(&forceStart, "f", false, "shorthand for -force")
+			fs.BoolVar(&allowDynamic, "allow-dynamic", false, "allow a dynamically linked binary")
+			fs.StringVar(&priority, "priority", "", "task queue priority, high or low (default: the default queue)")
+			fs.StringVar(&notifyURL, "notify", "", "https URL to POST the job to when it finishes")
+			fs.StringVar(&manifestFile, "manifest", "", "start a job for each entry of this YAML file, instead of for BINARY")
+		},
+	},
+	{"estimate", "[-min MIN_IMPORTERS]",
+		"report how many modules start would run on",
+		doEstimate,
+		func(fs *flag.FlagSet) {
+			fs.IntVar(&minImporters, "min", -1,
+				"count modules with at least this many importers (<0: use server default of 10)")
 		},
 	},
-	{"wait", "JOBID",
+	{"retry", "JOBID",
+		"start a job that reruns the failed modules of JOBID",
+		doRetry, nil},
+	{"rerun", "JOBID",
+		"start a new job with the same request as JOBID",
+		doRerun, nil},
+	{"wait", "[-i DURATION] [-timeout DURATION] JOBID",
 		"do not exit until JOBID is done",
 		doWait,
 		func(fs *flag.FlagSet) {
-			fs.DurationVar(&waitInterval, "i", 0, "display updates at this interval")
+			fs.DurationVar(&waitInterval, "i", 0, "display updates at this interval (0: when progress changes)")
+			fs.DurationVar(&waitTimeout, "timeout", 0, "give up after this long (0: wait forever)")
 		},
 	},
-	{"results", "[-f] [-o FILE.json] JOBID",
-		"download results as JSON",
+	{"binaries", "[-f] list | rm NAME",
+		"list or remove uploaded analysis binaries",
+		doBinaries,
+		func(fs *flag.FlagSet) {
+			fs.BoolVar(&forceRemove, "f", false, "remove without asking for confirmation")
+		},
+	},
+	{"diff", "JOBID1 JOBID2",
+		"compare the results of two jobs",
+		doDiff, nil},
+	{"logs", "[-severity LEVEL] [-limit N] JOBID",
+		"display worker log entries for a job, most recent first",
+		doLogs,
+		func(fs *flag.FlagSet) {
+			fs.StringVar(&logSeverity, "severity", "", "only display entries at or above this severity (e.g. error)")
+			fs.IntVar(&logLimit, "limit", 100, "maximum number of entries to display")
+		},
+	},
+	{"compare", "[-sample FRACTION] [-seed SEED] [-min MIN_IMPORTERS] [-tolerance N] [-force] BINARY_OLD BINARY_NEW ARGS...",
+		"run two binaries on the same sample of modules and compare their results",
+		doCompare,
+		func(fs *flag.FlagSet) {
+			fs.Float64Var(&sample, "sample", 0.01, "fraction of the modules to run on, between 0 and 1")
+			fs.StringVar(&sampleSeed, "seed", "", "seed that selects the sample (default: random)")
+			fs.IntVar(&minImporters, "min", -1,
+				"run on modules with at least this many importers (<0: use server default of 10)")
+			fs.IntVar(&tolerance, "tolerance", 0, "exit with status 3 if more than this many modules differ")
+			fs.BoolVar(&forceStart, "force", false, "do not ask for confirmation")
+			fs.BoolVar(&forceStart, "f", false, "shorthand for -force")
+		},
+	},
+	{"results", "[-f] [-errors] [-o FILE.json] JOBID",
+		"download results from BigQuery as JSON",
 		doResults,
 		func(fs *flag.FlagSet) {
 			fs.BoolVar(&force, "f", false, "download even if unfinished")
 			fs.StringVar(&outfile, "o", "", "output filename")
+			fs.BoolVar(&errorsOnly, "errors", false, "only output results with errors")
 		},
 	},
 }
@@ -115,36 +208,91 @@ func main() {
 
 	flag.Parse()
 	if err := run(context.Background()); err != nil {
+		if errors.Is(err, errCanceled) {
+			// Use a distinct exit status so scripts can tell
+			// a declined prompt from a failure.
+			os.Exit(1)
+		}
+		if errors.Is(err, errTooManyDifferences) {
+			// Not a usage error.
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(3)
+		}
 		fmt.Fprintf(os.Stderr, "%v\n\n", err)
 		flag.Usage()
 		os.Exit(2)
 	}
 }
 
-var workerURL string
+// workerURL and binaryBucket are the URL of the worker and the bucket
+// of its analysis binaries in the environment in use. See setEnv.
+var workerURL, binaryBucket string
+
+// setEnv makes env the worker environment that requests are sent to
+// and binaries are uploaded for.
+func setEnv(env string) {
+	workerURL = fmt.Sprintf("https://%s-%s", env, cfg.WorkerURLSuffix)
+	binaryBucket = cfg.binaryBucket(env)
+}
+
+// errCanceled is returned when the user declines to proceed.
+var errCanceled = errors.New("canceled")
 
 func run(ctx context.Context) error {
-	wu := os.Getenv("GO_ECOSYSTEM_WORKER_URL_SUFFIX")
-	if wu == "" {
-		return errors.New("need GO_ECOSYSTEM_WORKER_URL_SUFFIX environment variable")
+	var err error
+	cfg, err = loadConfig()
+	if err != nil {
+		return err
+	}
+	cmd, err := lookupCommand(flag.Arg(0))
+	if err != nil {
+		return err
+	}
+	// Completion scripts can be generated without a worker.
+	if cfg.WorkerURLSuffix == "" && cmd.name != "completion" {
+		return errors.New("need GO_ECOSYSTEM_WORKER_URL_SUFFIX environment variable or WorkerURLSuffix in config file")
 	}
-	workerURL = fmt.Sprintf("https://%s-%s", *env, wu)
-	name := flag.Arg(0)
-	for _, cmd := range commands {
+	setEnv(*env)
+	args := flag.Args()[1:]
+	if cmd.flagdefs != nil {
+		fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+		cmd.flagdefs(fs)
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		args = fs.Args()
+	}
+	return cmd.run(ctx, args)
+}
+
+// lookupCommand returns the command with the given name, or the only
+// command whose name starts with it.
+func lookupCommand(name string) (*command, error) {
+	if name == "" {
+		return nil, errors.New("missing command")
+	}
+	var matches []*command
+	for i := range commands {
+		cmd := &commands[i]
 		if cmd.name == name {
-			args := flag.Args()[1:]
-			if cmd.flagdefs != nil {
-				fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
-				cmd.flagdefs(fs)
-				if err := fs.Parse(args); err != nil {
-					return err
-				}
-				args = fs.Args()
-			}
-			return cmd.run(ctx, args)
+			return cmd, nil
+		}
+		if strings.HasPrefix(cmd.name, name) {
+			matches = append(matches, cmd)
 		}
 	}
-	return fmt.Errorf("unknown command %q", name)
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("unknown command %q", name)
+	case 1:
+		return matches[0], nil
+	default:
+		var names []string
+		for _, cmd := range matches {
+			names = append(names, cmd.name)
+		}
+		return nil, fmt.Errorf("ambiguous command %q: could be %s", name, strings.Join(names, ", "))
+	}
 }
 
 func doShow(ctx context.Context, args []string) error {
@@ -168,19 +316,59 @@ func showJob(ctx context.Context, jobID string, ts oauth2.TokenSource) error {
 	if *dryRun {
 		return nil
 	}
+	if *jsonOut {
+		return printJSON(job)
+	}
 	rj := reflect.ValueOf(job).Elem()
 	rt := rj.Type()
 	for i := 0; i < rt.NumField(); i++ {
 		f := rt.Field(i)
-		if f.IsExported() {
+		if f.IsExported() && f.Name != "RecentFailures" && f.Name != "Request" {
 			v := rj.FieldByIndex(f.Index)
+			if m, ok := v.Interface().(map[string]int); ok {
+				// Display counts, largest first.
+				fmt.Printf("%s:\n", f.Name)
+				keys := maps.Keys(m)
+				slices.SortFunc(keys, func(a, b string) int {
+					return cmp.Or(cmp.Compare(m[b], m[a]), cmp.Compare(a, b))
+				})
+				for _, k := range keys {
+					fmt.Printf("\t%s: %d\n", k, m[k])
+				}
+				continue
+			}
 			name, _ := strings.CutPrefix(f.Name, "Num")
 			fmt.Printf("%s: %v\n", name, v.Interface())
 		}
 	}
+	if job.Mode != "" {
+		fmt.Println("Request:")
+		printRequest(&job.Request)
+	}
+	if len(job.RecentFailures) > 0 {
+		fmt.Println("Recent failures:")
+		for _, f := range job.RecentFailures {
+			fmt.Printf("\t%s %s (%s): %s\n",
+				f.Time.In(time.Local).Format(time.DateTime), f.Module, f.Category, f.Message)
+		}
+	}
 	return nil
 }
 
+// printRequest prints the parameters of r that are set, one per line,
+// with the names of their query params.
+func printRequest(r *jobs.Request) {
+	rv := reflect.ValueOf(r).Elem()
+	for _, f := range reflect.VisibleFields(rv.Type()) {
+		v := rv.FieldByIndex(f.Index)
+		// A minimum of zero importers is not the default.
+		if v.IsZero() && f.Name != "Min" {
+			continue
+		}
+		fmt.Printf("\t%s: %v\n", strings.ToLower(f.Name), v.Interface())
+	}
+}
+
 func doList(ctx context.Context, _ []string) error {
 	ts, err := identityTokenSource(ctx)
 	if err != nil {
@@ -195,6 +383,15 @@ func doList(ctx context.Context, _ []string) error {
 	}
 	d7 := -time.Hour * 24 * 7
 	weekBefore := time.Now().Add(d7)
+	if *jsonOut {
+		recent := []jobs.Job{}
+		for _, j := range *joblist {
+			if j.StartedAt.After(weekBefore) {
+				recent = append(recent, j)
+			}
+		}
+		return printJSON(recent)
+	}
 	tw := tabwriter.NewWriter(os.Stdout, 2, 8, 1, ' ', 0)
 	fmt.Fprintf(tw, "ID\tUser\tStart Time\tStarted\tFinished\tTotal\tCanceled\n")
 	for _, j := range *joblist {
@@ -211,63 +408,226 @@ func doList(ctx context.Context, _ []string) error {
 }
 
 func doCancel(ctx context.Context, args []string) error {
+	if cancelAll && len(args) > 0 {
+		return errors.New("cannot use -all with job IDs")
+	}
+	if cancelUser != "" && !cancelAll {
+		return errors.New("-user requires -all")
+	}
 	ts, err := identityTokenSource(ctx)
 	if err != nil {
 		return err
 	}
+	if cancelAll {
+		return cancelAllJobs(ctx, ts)
+	}
 	for _, jobID := range args {
 		url := workerURL + "/jobs/cancel?jobid=" + jobID
 		if *dryRun {
 			fmt.Printf("dryrun: GET %s\n", url)
 			continue
 		}
-		if _, err := httpGet(ctx, url, ts); err != nil {
+		body, err := httpGet(ctx, url, ts)
+		if err != nil {
 			return fmt.Errorf("canceling %q: %w", jobID, err)
 		}
+		fmt.Printf("%s", body)
 	}
 	return nil
 }
 
+// cancelAllJobs cancels all unfinished jobs, or only those of cancelUser if
+// it is set, after asking for confirmation. It keeps going if a cancellation
+// fails, and reports the failures at the end.
+func cancelAllJobs(ctx context.Context, ts oauth2.TokenSource) error {
+	// Listing jobs has no side effects, so do it even on a dry run
+	// in order to display the cancel requests.
+	body, err := httpGet(ctx, workerURL+"/jobs/list", ts)
+	if err != nil {
+		return err
+	}
+	var joblist []jobs.Job
+	if err := json.Unmarshal(body, &joblist); err != nil {
+		return err
+	}
+	var ids []string
+	for _, j := range joblist {
+		if j.Canceled || j.NumFinished() >= j.NumEnqueued {
+			continue
+		}
+		if cancelUser != "" && j.User != cancelUser {
+			continue
+		}
+		ids = append(ids, j.ID())
+	}
+	if len(ids) == 0 {
+		fmt.Println("No unfinished jobs.")
+		return nil
+	}
+	if !*dryRun {
+		fmt.Println("Unfinished jobs:")
+		for _, id := range ids {
+			fmt.Printf("\t%s\n", id)
+		}
+		ok, err := confirm(fmt.Sprintf("Cancel these %d jobs?", len(ids)))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errCanceled
+		}
+	}
+	var errs []error
+	for _, jobID := range ids {
+		url := workerURL + "/jobs/cancel?jobid=" + jobID
+		if *dryRun {
+			fmt.Printf("dryrun: GET %s\n", url)
+			continue
+		}
+		body, err := httpGet(ctx, url, ts)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("canceling %q: %w", jobID, err))
+			continue
+		}
+		fmt.Printf("%s", body)
+	}
+	if *dryRun {
+		return nil
+	}
+	fmt.Printf("Canceled %d of %d jobs.\n", len(ids)-len(errs), len(ids))
+	return errors.Join(errs...)
+}
+
 func doWait(ctx context.Context, args []string) error {
 	if len(args) != 1 {
-		return errors.New("wrong number of args: want [-i DURATION] JOB_ID")
+		return errors.New("wrong number of args: want [-i DURATION] [-timeout DURATION] JOB_ID")
 	}
 	jobID := args[0]
-	sleepInterval := waitInterval
-	displayUpdates := sleepInterval != 0
-	if sleepInterval < time.Second {
-		sleepInterval = time.Second
-	}
 	ts, err := identityTokenSource(ctx)
 	if err != nil {
 		return err
 	}
+	if waitTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, waitTimeout)
+		defer cancel()
+	}
+	err = waitForJob(ctx, jobID, ts)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("job %s did not finish within %s", jobID, waitTimeout)
+	}
+	return err
+}
+
+// waitBackoff is the sequence of intervals between polls of a job.
+// The last interval is repeated.
+var waitBackoff = []time.Duration{
+	time.Second,
+	5 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	3 * time.Minute,
+}
+
+// waitForJob polls the worker until the job with jobID is finished,
+// displaying progress whenever it changes.
+// It returns an error if the job is canceled.
+func waitForJob(ctx context.Context, jobID string, ts oauth2.TokenSource) error {
+	job, err := pollJob(ctx, jobID, ts)
+	if err != nil || *dryRun {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(job)
+	}
+	fmt.Printf("Job %s finished.\n", jobID)
+	return nil
+}
+
+// pollJob polls the worker until the job with jobID is finished, and
+// returns it. Unless -json was given, it displays progress whenever it
+// changes or, if -i was given, at that interval. It returns an error if
+// the job is canceled. On a dry run, it returns a nil job after the
+// first request.
+func pollJob(ctx context.Context, jobID string, ts oauth2.TokenSource) (*jobs.Job, error) {
 	start := time.Now()
-	for {
+	var prev jobs.Job
+	for i := 0; ; i++ {
 		job, err := requestJSON[jobs.Job](ctx, "jobs/describe?jobid="+jobID, ts)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if *dryRun {
+			return nil, nil
+		}
+		if job.Canceled {
+			return nil, fmt.Errorf("job %s was canceled", jobID)
 		}
 		done := job.NumFinished()
 		if done >= job.NumEnqueued {
-			break
+			return job, nil
 		}
-		if displayUpdates {
-			fmt.Printf("%s: %d/%d completed (%d%%)\n",
-				time.Since(start).Round(time.Second), done, job.NumEnqueued, done*100/job.NumEnqueued)
+		changed := done != prev.NumFinished() || job.NumFailed != prev.NumFailed || job.NumErrored != prev.NumErrored
+		if !*jsonOut && (changed || waitInterval > 0) {
+			fmt.Printf("%s: %d/%d done (%d failed, %d errored)\n",
+				time.Since(start).Round(time.Second), done, job.NumEnqueued, job.NumFailed, job.NumErrored)
+		}
+		prev = *job
+		sleep := waitBackoff[min(i, len(waitBackoff)-1)]
+		if waitInterval > 0 {
+			sleep = max(waitInterval, time.Second)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(sleep):
 		}
-		time.Sleep(sleepInterval)
 	}
-	fmt.Printf("Job %s finished.\n", jobID)
-	return nil
 }
 
 func doStart(ctx context.Context, args []string) error {
+	if manifestFile != "" {
+		if len(args) != 0 {
+			return errors.New("wrong number of args: want no args with -manifest")
+		}
+		if waitForStart {
+			return errors.New("-wait is not supported with -manifest")
+		}
+		return startManifest(ctx, manifestFile)
+	}
 	// Validate arguments.
 	if len(args) == 0 {
-		return errors.New("wrong number of args: want [-min N] BINARY [ARG1 ARG2 ...]")
+		return errors.New("wrong number of args: want [-min N] [-wait] [-force] [-allow-dynamic] [-priority P] [-notify URL] BINARY [ARG1 ARG2 ...]")
+	}
+	binaryFile, binaryArgs := args[0], args[1:]
+	if err := checkStartArgs(binaryFile, binaryArgs); err != nil {
+		return err
+	}
+	its, err := identityTokenSource(ctx)
+	if err != nil {
+		return err
+	}
+	jobID, err := startJob(ctx, its, binaryFile, binaryArgs, minImporters)
+	if err != nil || *dryRun || !waitForStart {
+		return err
+	}
+	if jobID == "" {
+		return errors.New("no job ID in response")
+	}
+	// Stop waiting on interrupt, but leave the job running.
+	wctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+	err = waitForJob(wctx, jobID, its)
+	if errors.Is(err, context.Canceled) && ctx.Err() == nil {
+		fmt.Printf("Stopped waiting. Job %s is still running.\n", jobID)
+		return nil
 	}
-	binaryFile := args[0]
+	return err
+}
+
+// checkStartArgs checks that binaryFile can be run in the sandbox,
+// and that its args are supported.
+func checkStartArgs(binaryFile string, binaryArgs []string) error {
 	if fi, err := os.Stat(binaryFile); err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			return fmt.Errorf("%s does not exist", binaryFile)
@@ -275,50 +635,435 @@ func doStart(ctx context.Context, args []string) error {
 		return err
 	} else if fi.IsDir() {
 		return fmt.Errorf("%s is a directory, not a file", binaryFile)
-	} else if err := checkIsLinuxAmd64(binaryFile); err != nil {
+	} else if err := checkBinary(binaryFile); err != nil {
 		return err
 	}
 	// Check args to binary for whitespace, which we don't support.
-	binaryArgs := args[1:]
 	for _, arg := range binaryArgs {
 		if strings.IndexFunc(arg, unicode.IsSpace) >= 0 {
 			return fmt.Errorf("arg %q contains whitespace: not supported", arg)
 		}
 	}
+	return nil
+}
+
+// startJob uploads binaryFile if needed and asks the worker to enqueue
+// tasks that run it with binaryArgs on modules with at least min
+// importers, or the server default if min is negative. It prints the
+// response and returns the ID of the job, or the empty string if the
+// response has none.
+func startJob(ctx context.Context, its oauth2.TokenSource, binaryFile string, binaryArgs []string, min int) (jobID string, err error) {
 	// Copy binary to GCS if it's not already there.
 	if canceled, err := uploadAnalysisBinary(ctx, binaryFile); err != nil {
-		return err
+		return "", err
 	} else if canceled {
+		return "", errCanceled
+	}
+	// Ask the server to enqueue scan tasks. A sampled job does not
+	// duplicate a full one.
+	if !forceStart && sample == 0 {
+		if err := checkDuplicateJob(ctx, its, filepath.Base(binaryFile), strings.Join(binaryArgs, " "), min); err != nil {
+			return "", err
+		}
+	}
+	params := map[string]any{
+		"binary": filepath.Base(binaryFile),
+		"user":   os.Getenv("USER"),
+	}
+	if len(binaryArgs) > 0 {
+		params["args"] = binaryArgs
+	}
+	if min >= 0 {
+		params["min"] = min
+	}
+	if priority != "" {
+		params["priority"] = priority
+	}
+	if notifyURL != "" {
+		params["notify"] = notifyURL
+	}
+	if sample > 0 {
+		params["sample"] = sample
+		params["seed"] = sampleSeed
+	}
+	body, err := enqueue(ctx, params, its)
+	if err != nil {
+		return "", err
+	}
+	if *dryRun {
+		return "", printDryRunResult(body)
+	}
+	return printEnqueueResult(body)
+}
+
+func doEstimate(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return errors.New("wrong number of args: want [-min N]")
+	}
+	ts, err := identityTokenSource(ctx)
+	if err != nil {
+		return err
+	}
+	path := "analysis/estimate"
+	if minImporters >= 0 {
+		path += fmt.Sprintf("?min=%d", minImporters)
+	}
+	est, err := requestJSON[analysis.Estimate](ctx, path, ts)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
 		return nil
 	}
-	// Ask the server to enqueue scan tasks.
-	its, err := identityTokenSource(ctx)
+	fmt.Printf("%d modules would be enqueued, one scan task each.\n", est.NumModules)
+	if len(est.Sample) > 0 {
+		fmt.Println("Sample:")
+		for _, p := range est.Sample {
+			fmt.Printf("\t%s\n", p)
+		}
+	}
+	return nil
+}
+
+func doRetry(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("wrong number of args: want JOB_ID")
+	}
+	jobID := args[0]
+	ts, err := identityTokenSource(ctx)
 	if err != nil {
 		return err
 	}
-	u := fmt.Sprintf("%s/analysis/enqueue?binary=%s&user=%s", workerURL, filepath.Base(binaryFile), os.Getenv("USER"))
-	if len(binaryArgs) > 0 {
-		u += fmt.Sprintf("&args=%s", url.QueryEscape(strings.Join(binaryArgs, " ")))
+	job, err := requestJSON[jobs.Job](ctx, "jobs/describe?jobid="+jobID, ts)
+	if err != nil {
+		return err
 	}
-	if minImporters >= 0 {
-		u += fmt.Sprintf("&min=%d", minImporters)
+	failures, err := requestJSON[[]string](ctx, "jobs/failures?jobid="+jobID, ts)
+	if err != nil {
+		return err
 	}
 	if *dryRun {
-		fmt.Printf("dryrun: GET %s\n", u)
 		return nil
 	}
-	body, err := httpGet(ctx, u, its)
+	if len(*failures) == 0 {
+		fmt.Printf("Job %s has no failed modules.\n", jobID)
+		return nil
+	}
+	fmt.Printf("Retrying %d failed modules of job %s.\n", len(*failures), jobID)
+	params := map[string]any{
+		"binary": job.Binary,
+		"user":   os.Getenv("USER"),
+		"parent": jobID,
+	}
+	if job.BinaryArgs != "" {
+		params["args"] = strings.Fields(job.BinaryArgs)
+	}
+	body, err := enqueue(ctx, params, ts)
+	if err != nil {
+		return err
+	}
+	_, err = printEnqueueResult(body)
+	return err
+}
+
+func doRerun(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("wrong number of args: want JOB_ID")
+	}
+	jobID := args[0]
+	ts, err := identityTokenSource(ctx)
+	if err != nil {
+		return err
+	}
+	// Describing the job changes nothing, so it is done even with -n,
+	// to show the request that would be sent.
+	job, err := getJSON[jobs.Job](ctx, "jobs/describe?jobid="+jobID, ts)
+	if err != nil {
+		return err
+	}
+	req := &job.Request
+	if req.Mode == "" {
+		return fmt.Errorf("job %s has no recorded request: it was started before requests were recorded", jobID)
+	}
+	if req.Mode != "analysis" {
+		return fmt.Errorf("job %s: cannot rerun a job of mode %q", jobID, req.Mode)
+	}
+	if err := checkBinariesOnGCS(ctx, analysis.SplitBinaries(req.Binary)); err != nil {
+		return fmt.Errorf("cannot rerun job %s: %w", jobID, err)
+	}
+	if *dryRun {
+		fmt.Printf("dryrun: rerun job %s\n", jobID)
+		printRerun(job)
+	} else {
+		fmt.Printf("Rerunning job %s.\n", jobID)
+	}
+	body, err := enqueue(ctx, rerunParams(req), ts)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		return printDryRunResult(body)
+	}
+	newID, err := printEnqueueResult(body)
+	if err != nil {
+		return err
+	}
+	if newID == "" {
+		return nil
+	}
+	// The binary may have been uploaded again since the job ran.
+	newJob, err := requestJSON[jobs.Job](ctx, "jobs/describe?jobid="+newID, ts)
+	if err != nil {
+		return err
+	}
+	if newJob.BinaryVersion != job.BinaryVersion {
+		fmt.Printf("Warning: the binary on GCS has changed since job %s ran.\n", jobID)
+	}
+	return nil
+}
+
+// printRerun prints what a rerun of job repeats: its binary and the
+// version it ran, the source of its modules, and its sample.
+func printRerun(job *jobs.Job) {
+	req := &job.Request
+	fmt.Printf("\tbinary: %s, version %s\n", req.Binary, job.BinaryVersion)
+	switch {
+	case req.Parent != "":
+		fmt.Printf("\tmodules: failures of job %s\n", req.Parent)
+	case req.File != "":
+		fmt.Printf("\tmodules: %s\n", req.File)
+	default:
+		fmt.Printf("\tmodules: pkgsite DB, at least %d importers\n", req.Min)
+	}
+	if req.Sampled() {
+		fmt.Printf("\tsample: %g, seed %q\n", req.Sample, req.Seed)
+	}
+}
+
+// rerunParams returns the params of an enqueue request that repeats r,
+// for the current user.
+func rerunParams(r *jobs.Request) map[string]any {
+	params := map[string]any{
+		"binary": r.Binary,
+		"user":   os.Getenv("USER"),
+		"min":    r.Min,
+	}
+	if r.Args != "" {
+		params["args"] = strings.Fields(r.Args)
+	}
+	for k, v := range map[string]string{
+		"file":     r.File,
+		"suffix":   r.Suffix,
+		"parent":   r.Parent,
+		"priority": r.Priority,
+		"notify":   r.Notify,
+		"timeout":  r.Timeout,
+	} {
+		if v != "" {
+			params[k] = v
+		}
+	}
+	if r.Insecure {
+		params["insecure"] = true
+	}
+	if r.SkipInit {
+		params["skipinit"] = true
+	}
+	if r.Sampled() {
+		params["sample"] = r.Sample
+		params["seed"] = r.Seed
+	}
+	return params
+}
+
+// checkBinariesOnGCS returns an error if one of the analysis binaries
+// is not on GCS.
+func checkBinariesOnGCS(ctx context.Context, binaries []string) error {
+	c, err := newStorageClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	bucket := c.Bucket(binaryBucket)
+	for _, b := range binaries {
+		_, err := bucket.Object(path.Join(binariesDir, b)).Attrs(ctx)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return fmt.Errorf("binary %q no longer exists on GCS; upload it again with start", b)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enqueue asks the worker to enqueue analysis tasks with the given params,
+// and returns the response body.
+// Values of params must be strings, ints, floats, bools or string slices.
+// The request is a GET with query params, or a POST with a JSON body if -post
+// was given.
+// With -n, the request is a dry run: the worker describes the tasks it
+// would enqueue, without enqueuing them or creating a job.
+func enqueue(ctx context.Context, params map[string]any, ts oauth2.TokenSource) ([]byte, error) {
+	u := workerURL + "/analysis/enqueue"
+	if *dryRun {
+		params["dryrun"] = true
+	}
+	if *usePost {
+		body, err := json.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+		if *dryRun {
+			fmt.Printf("dryrun: POST %s %s\n", u, body)
+		}
+		return httpPost(ctx, u, body, ts)
+	}
+	q := url.Values{}
+	for k, v := range params {
+		if ss, ok := v.([]string); ok {
+			v = strings.Join(ss, " ")
+		}
+		q.Set(k, fmt.Sprint(v))
+	}
+	u += "?" + q.Encode()
+	if *dryRun {
+		fmt.Printf("dryrun: GET %s\n", u)
+	}
+	return httpGet(ctx, u, ts)
+}
+
+// printDryRunResult prints the response body of a dry run of the
+// analysis/enqueue endpoint. A worker that predates dry runs ignores
+// the dryrun param and responds as it does to an enqueue request;
+// printDryRunResult reports that as an error.
+func printDryRunResult(body []byte) error {
+	var resp jobs.DryRunResponse
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&resp); err != nil {
+		return fmt.Errorf("the worker does not support dry runs, and may have enqueued the tasks; response: %s", bytes.TrimSpace(body))
+	}
+	if *jsonOut {
+		return printJSON(&resp)
+	}
+	fmt.Println(resp.String())
+	return nil
+}
+
+// defaultMinImporters is the worker's default for the min parameter
+// of analysis/enqueue.
+const defaultMinImporters = 10
+
+// checkDuplicateJob looks for an unfinished job with the same binary, args
+// and minimum importers as the one about to be started. If there is one,
+// it asks the user whether to continue.
+func checkDuplicateJob(ctx context.Context, ts oauth2.TokenSource, binary, args string, min int) error {
+	joblist, err := requestJSON[[]jobs.Job](ctx, "jobs/list", ts)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("%s\n", body)
+	if *dryRun {
+		return nil
+	}
+	wantMin := min
+	if wantMin < 0 {
+		wantMin = defaultMinImporters
+	}
+	for _, j := range *joblist {
+		if j.Canceled || j.ParentID != "" || j.NumFinished() >= j.NumEnqueued {
+			continue
+		}
+		if j.Binary == binary && j.BinaryArgs == args && j.Min == wantMin && j.File == "" && !j.Sampled() {
+			ok, err := confirm(fmt.Sprintf("Job %s with the same parameters is still running; start anyway?", j.ID()))
+			if err != nil {
+				return fmt.Errorf("%w; pass -force to start anyway", err)
+			}
+			if !ok {
+				return errCanceled
+			}
+			return nil
+		}
+	}
 	return nil
 }
 
-// checkIsLinuxAmd64 checks if binaryFile is a linux/amd64 Go
-// binary. If not, returns an error with appropriate message.
-// Otherwise, returns nil.
-func checkIsLinuxAmd64(binaryFile string) error {
+// printEnqueueResult prints the response body of the analysis/enqueue
+// endpoint, and returns the ID of the job it reports, or the empty
+// string if it reports none. It returns an error if the worker could
+// not create the job.
+func printEnqueueResult(body []byte) (jobID string, err error) {
+	var resp jobs.EnqueueResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		// An older worker responds with plain text.
+		fmt.Printf("%s\n", body)
+		return parseJobID(string(body))
+	}
+	printEnqueueResponse(&resp)
+	if resp.JobError != "" {
+		return "", fmt.Errorf("could not create job: %s", resp.JobError)
+	}
+	return resp.JobID, nil
+}
+
+// printEnqueueResponse prints a summary of resp, with the commands and
+// the BigQuery query to monitor its job.
+func printEnqueueResponse(resp *jobs.EnqueueResponse) {
+	if resp.Error != "" {
+		fmt.Printf("Enqueued %d of %d tasks on queue %s: %s\n", resp.NumEnqueued, resp.NumTasks, resp.Queue, resp.Error)
+	} else {
+		fmt.Printf("Enqueued %d tasks on queue %s.\n", resp.NumEnqueued, resp.Queue)
+	}
+	if resp.JobError != "" {
+		fmt.Printf("Could not create job: %s\n", resp.JobError)
+		return
+	}
+	if resp.JobID == "" {
+		return
+	}
+	fmt.Printf("Job ID: %s\n", resp.JobID)
+	fmt.Printf("Wait for it:  ejobs wait %s\n", resp.JobID)
+	fmt.Printf("Show it:      ejobs show %s\n", resp.JobID)
+	if resp.ResultsTable != "" {
+		fmt.Printf("Results:      %s\n", bigQueryConsoleURL(resp.ResultsTable))
+		fmt.Printf("Query:        SELECT * FROM `%s` WHERE job_id = %q\n", resp.ResultsTable, resp.JobID)
+	}
+}
+
+// bigQueryConsoleURL returns the URL of the BigQuery console page of table,
+// whose name is PROJECT.DATASET.TABLE. The console has no URL parameter for
+// the text of a query, so the caller should print the query to run there.
+func bigQueryConsoleURL(table string) string {
+	project, dataset, tableName := cfg.Project, "", table
+	if parts := strings.Split(table, "."); len(parts) == 3 {
+		project, dataset, tableName = parts[0], parts[1], parts[2]
+	}
+	u := "https://console.cloud.google.com/bigquery?project=" + url.QueryEscape(project)
+	if dataset != "" {
+		u += fmt.Sprintf("&ws=!1m5!1m4!4m3!1s%s!2s%s!3s%s", project, dataset, tableName)
+	}
+	return u
+}
+
+// parseJobID extracts the job ID from the plain-text response of the
+// analysis/enqueue endpoint, which older workers write.
+func parseJobID(body string) (string, error) {
+	const prefix = "job ID is "
+	i := strings.Index(body, prefix)
+	if i < 0 {
+		return "", fmt.Errorf("no job ID in response %q", body)
+	}
+	return strings.TrimSpace(body[i+len(prefix):]), nil
+}
+
+// rebuildHint tells the user how to build a binary that can run in the sandbox.
+const rebuildHint = "rebuild with CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build"
+
+// checkBinary checks if binaryFile is a linux/amd64 Go binary
+// that is statically linked, as required by the sandbox.
+// Dynamically linked binaries are accepted if -allow-dynamic
+// was given. Binaries built with cgo result in a warning.
+func checkBinary(binaryFile string) error {
 	bin, err := os.Open(binaryFile)
 	if err != nil {
 		return err
@@ -330,17 +1075,38 @@ func checkIsLinuxAmd64(binaryFile string) error {
 		return err
 	}
 
-	var goos, goarch string
+	var goos, goarch, cgo string
 	for _, setting := range bi.Settings {
-		if setting.Key == "GOOS" {
+		switch setting.Key {
+		case "GOOS":
 			goos = setting.Value
-		} else if setting.Key == "GOARCH" {
+		case "GOARCH":
 			goarch = setting.Value
+		case "CGO_ENABLED":
+			cgo = setting.Value
 		}
 	}
 
 	if goos != "linux" || goarch != "amd64" {
-		return fmt.Errorf("binary not built for linux/amd64: GOOS=%s GOARCH=%s", goos, goarch)
+		return fmt.Errorf("binary not built for linux/amd64: GOOS=%s GOARCH=%s; %s", goos, goarch, rebuildHint)
+	}
+
+	ef, err := elf.NewFile(bin)
+	if err != nil {
+		return err
+	}
+	for _, p := range ef.Progs {
+		// Only dynamically linked binaries have an interpreter.
+		if p.Type == elf.PT_INTERP {
+			if !allowDynamic {
+				return fmt.Errorf("binary is dynamically linked and may not run in the sandbox; %s, or pass -allow-dynamic", rebuildHint)
+			}
+			fmt.Println("Warning: binary is dynamically linked.")
+			break
+		}
+	}
+	if cgo == "1" {
+		fmt.Printf("Warning: binary was built with CGO_ENABLED=1; if it fails in the sandbox, %s.\n", rebuildHint)
 	}
 	return nil
 }
@@ -351,29 +1117,25 @@ func checkIsLinuxAmd64(binaryFile string) error {
 // false is returned.
 //
 // As an optimization, it skips the upload if the file on GCS has the
-// same checksum as the local file.
+// same checksum as the local file. With -n, it only reports whether it
+// would upload binaryFile.
 func uploadAnalysisBinary(ctx context.Context, binaryFile string) (canceled bool, err error) {
-	if *dryRun {
-		fmt.Printf("dryrun: upload analysis binary %s\n", binaryFile)
-		return false, nil
-	}
-	const bucketName = projectID
 	binaryName := filepath.Base(binaryFile)
-	objectName := path.Join("analysis-binaries", binaryName)
+	objectName := path.Join(binariesDir, binaryName)
 
-	ts, err := accessTokenSource(ctx)
-	if err != nil {
-		return false, err
-	}
-	c, err := storage.NewClient(ctx, option.WithTokenSource(ts))
+	c, err := newStorageClient(ctx)
 	if err != nil {
 		return false, err
 	}
 	defer c.Close()
-	bucket := c.Bucket(bucketName)
+	bucket := c.Bucket(binaryBucket)
 	object := bucket.Object(objectName)
 	attrs, err := object.Attrs(ctx)
 	if errors.Is(err, storage.ErrObjectNotExist) {
+		if *dryRun {
+			fmt.Printf("dryrun: %s binary does not exist on GCS: would upload it\n", binaryName)
+			return false, nil
+		}
 		fmt.Printf("%s binary does not exist on GCS: uploading\n", binaryName)
 	} else if err != nil {
 		return false, err
@@ -389,6 +1151,12 @@ func uploadAnalysisBinary(ctx context.Context, binaryFile string) (canceled bool
 			fmt.Printf("Binary %q on GCS has the same checksum: not uploading.\n", binaryName)
 			return false, nil
 		}
+		if *dryRun {
+			// The worker hashes the binary on GCS, so the binary
+			// version in the task URLs is not that of binaryFile.
+			fmt.Printf("dryrun: binary %q on GCS differs from %s: would upload it; the tasks below are for the binary on GCS\n", binaryName, binaryFile)
+			return false, nil
+		}
 		// Ask the users if they want to overwrite the existing binary
 		// while providing more info to help them with their decision.
 		updated := attrs.Updated.In(time.Local).Format(time.RFC1123) // use local time zone
@@ -399,28 +1167,135 @@ func uploadAnalysisBinary(ctx context.Context, binaryFile string) (canceled bool
 			fmt.Printf(" by %s", uploader)
 		}
 		fmt.Println(".")
-		fmt.Print("Do you wish to overwrite it? [y/n] ")
-		var response string
-		fmt.Scanln(&response)
-		if r := strings.TrimSpace(response); r != "y" && r != "Y" {
-			// Accept "Y" and "y" as confirmation.
-			fmt.Println("Cancelling.")
-			return true, nil
+		if !forceStart {
+			ok, err := confirm("Do you wish to overwrite it?")
+			if err != nil {
+				return false, fmt.Errorf("%w; pass -force to overwrite it", err)
+			}
+			if !ok {
+				fmt.Println("Cancelling.")
+				return true, nil
+			}
 		}
 	}
 	fmt.Printf("Uploading.\n")
 	if err := copyToGCS(ctx, object, binaryFile); err != nil {
 		return false, err
 	}
+	return false, nil
+}
 
-	// Add the uploader information for better messaging in the future.
-	toUpdate := storage.ObjectAttrsToUpdate{
-		Metadata: map[string]string{uploaderMetadataKey: os.Getenv("USER")},
+// confirm displays the question and reads a y/n answer from stdin.
+// It reports whether the user answered yes.
+// It returns an error if stdin is not a terminal.
+func confirm(question string) (bool, error) {
+	if fi, err := os.Stdin.Stat(); err != nil {
+		return false, err
+	} else if fi.Mode()&os.ModeCharDevice == 0 {
+		return false, fmt.Errorf("cannot ask %q: stdin is not a terminal", question)
 	}
-	// Refetch the object, otherwise attribute uploading won't have effect.
-	object = bucket.Object(objectName)
-	object.Update(ctx, toUpdate) // disregard errors
-	return false, nil
+	fmt.Printf("%s [y/n] ", question)
+	var response string
+	fmt.Scanln(&response)
+	// Accept "Y" and "y" as confirmation.
+	r := strings.TrimSpace(response)
+	return r == "y" || r == "Y", nil
+}
+
+func doBinaries(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing subcommand: want list or rm")
+	}
+	switch sub, args := args[0], args[1:]; sub {
+	case "list":
+		if len(args) != 0 {
+			return errors.New("wrong number of args: want list")
+		}
+		return listBinaries(ctx)
+	case "rm":
+		if len(args) != 1 {
+			return errors.New("wrong number of args: want rm NAME")
+		}
+		return removeBinary(ctx, args[0])
+	default:
+		return fmt.Errorf("unknown binaries subcommand %q: want list or rm", sub)
+	}
+}
+
+// listBinaries displays the analysis binaries on GCS.
+func listBinaries(ctx context.Context) error {
+	if *dryRun {
+		fmt.Printf("dryrun: list gs://%s/%s/\n", binaryBucket, binariesDir)
+		return nil
+	}
+	c, err := newStorageClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	tw := tabwriter.NewWriter(os.Stdout, 2, 8, 1, ' ', 0)
+	fmt.Fprintf(tw, "NAME\tSIZE\tMD5\tUPLOADED\tUPLOADER\n")
+	iter := c.Bucket(binaryBucket).Objects(ctx, &storage.Query{Prefix: binariesDir + "/"})
+	for {
+		attrs, err := iter.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%x\t%s\t%s\n",
+			path.Base(attrs.Name),
+			attrs.Size,
+			attrs.MD5,
+			attrs.Updated.In(time.Local).Format(time.DateTime),
+			attrs.Metadata[uploaderMetadataKey])
+	}
+	return tw.Flush()
+}
+
+// removeBinary deletes the analysis binary with the given name from GCS,
+// asking for confirmation first unless -f was given.
+func removeBinary(ctx context.Context, name string) error {
+	if name != path.Base(name) {
+		return fmt.Errorf("binary name %q contains slashes (must be a basename)", name)
+	}
+	objectName := path.Join(binariesDir, name)
+	if *dryRun {
+		fmt.Printf("dryrun: delete gs://%s/%s\n", binaryBucket, objectName)
+		return nil
+	}
+	c, err := newStorageClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	object := c.Bucket(binaryBucket).Object(objectName)
+	if _, err := object.Attrs(ctx); errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("binary %q does not exist on GCS", name)
+	} else if err != nil {
+		return err
+	}
+	if !forceRemove {
+		ok, err := confirm(fmt.Sprintf("Delete binary %q from GCS?", name))
+		if err != nil {
+			return fmt.Errorf("%w; pass -f to delete it", err)
+		}
+		if !ok {
+			fmt.Println("Cancelling.")
+			return errCanceled
+		}
+	}
+	return object.Delete(ctx)
+}
+
+// newStorageClient returns a GCS client that impersonates the service account.
+func newStorageClient(ctx context.Context) (*storage.Client, error) {
+	ts, err := accessTokenSource(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewClient(ctx, option.WithTokenSource(ts))
 }
 
 // fileMD5 computes the MD5 checksum of the given file.
@@ -437,23 +1312,116 @@ func fileMD5(filename string) ([]byte, error) {
 	return hash.Sum(nil)[:], nil
 }
 
-// copyToLocalFile copies the filename to the GCS object.
+// uploadChunkSize is the size of each request of an upload to GCS.
+const uploadChunkSize = 8 * 1024 * 1024
+
+// copyToGCS copies the filename to the GCS object, displaying progress.
+// The upload is done in chunks, each of which is retried on failure.
+// The object's metadata records the uploader, for better messaging
+// in the future, and the file's SHA-256 hash, for verification.
 func copyToGCS(ctx context.Context, object *storage.ObjectHandle, filename string) error {
 	src, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
 	defer src.Close()
-	dest := object.NewWriter(ctx)
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, src); err != nil {
+		return err
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	// Writes are not idempotent in general, so by default the storage
+	// client doesn't retry them. It is safe here, because each retry
+	// writes the same contents.
+	// Canceling wctx abandons the upload, so that a failed copy
+	// doesn't leave a partial object behind.
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	dest := object.Retryer(storage.WithPolicy(storage.RetryAlways)).NewWriter(wctx)
+	dest.ChunkSize = uploadChunkSize
+	dest.ChunkRetryDeadline = time.Minute
+	dest.ContentType = "application/octet-stream"
+	dest.Metadata = map[string]string{
+		uploaderMetadataKey: os.Getenv("USER"),
+		sha256MetadataKey:   hex.EncodeToString(h.Sum(nil)),
+	}
+	if size := fi.Size(); size > 0 {
+		dest.ProgressFunc = func(n int64) {
+			fmt.Printf("\r%3d%%", n*100/size)
+		}
+	}
 	if _, err := io.Copy(dest, src); err != nil {
+		cancel()
+		dest.Close() // returns the cancellation error; err is the cause
+		return err
+	}
+	if err := dest.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("\r100%%\n")
+	return nil
+}
+
+func doLogs(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("wrong number of args: want [-severity LEVEL] [-limit N] JOB_ID")
+	}
+	jobID := args[0]
+	filter := fmt.Sprintf("labels.jobID=%q", jobID)
+	if logSeverity != "" {
+		filter += " AND severity>=" + strings.ToUpper(logSeverity)
+	}
+	if *dryRun {
+		fmt.Printf("dryrun: read logs of project %s with filter %s\n", cfg.Project, filter)
+		return nil
+	}
+	ts, err := accessTokenSource(ctx)
+	if err != nil {
+		return err
+	}
+	c, err := logadmin.NewClient(ctx, cfg.Project, option.WithTokenSource(ts))
+	if err != nil {
 		return err
 	}
-	return dest.Close()
+	defer c.Close()
+	iter := c.Entries(ctx, logadmin.Filter(filter), logadmin.NewestFirst())
+	for n := 0; n < logLimit; n++ {
+		e, err := iter.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s %-7s %s\n", e.Timestamp.In(time.Local).Format(time.DateTime), e.Severity, logMessage(e))
+	}
+	return nil
+}
+
+// logMessage returns the message of a log entry.
+func logMessage(e *logging.Entry) string {
+	switch p := e.Payload.(type) {
+	case string:
+		return p
+	case *structpb.Struct:
+		// The worker writes JSON log entries; see internal/log.
+		if m, ok := p.Fields["message"]; ok {
+			return m.GetStringValue()
+		}
+	}
+	return fmt.Sprint(e.Payload)
 }
 
 func doResults(ctx context.Context, args []string) (err error) {
 	if len(args) == 0 {
-		return errors.New("wrong number of args: want [-f] [-o FILE.json] JOB_ID")
+		return errors.New("wrong number of args: want [-f] [-errors] [-o FILE.json] JOB_ID")
 	}
 	jobID := args[0]
 	ts, err := identityTokenSource(ctx)
@@ -464,14 +1432,27 @@ func doResults(ctx context.Context, args []string) (err error) {
 	if err != nil {
 		return err
 	}
+	if *dryRun {
+		fmt.Printf("dryrun: read the results of job %s from BigQuery dataset %s\n", jobID, cfg.BigQueryDataset)
+		return nil
+	}
 	done := job.NumFinished()
 	if !force && done < job.NumEnqueued {
 		return fmt.Errorf("job not finished (%d/%d completed); use -f for partial results", done, job.NumEnqueued)
 	}
-	results, err := requestJSON[[]*analysis.Result](ctx, "jobs/results?jobid="+jobID, ts)
+	results, err := readJobResults(ctx, jobID)
 	if err != nil {
 		return err
 	}
+	if errorsOnly {
+		errs := []*analysis.Result{}
+		for _, r := range results {
+			if r.Error != "" {
+				errs = append(errs, r)
+			}
+		}
+		results = errs
+	}
 	out := os.Stdout
 	if outfile != "" {
 		out, err = os.Create(outfile)
@@ -485,15 +1466,52 @@ func doResults(ctx context.Context, args []string) (err error) {
 	return enc.Encode(results)
 }
 
+// readJobResults reads the results of the job with jobID from BigQuery,
+// with the credentials of the impersonated service account.
+func readJobResults(ctx context.Context, jobID string) ([]*analysis.Result, error) {
+	if cfg.BigQueryDataset == "" {
+		return nil, errors.New("need GO_ECOSYSTEM_BIGQUERY_DATASET environment variable or BigQueryDataset in config file")
+	}
+	ts, err := accessTokenSource(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c, err := bigquery.NewClient(ctx, cfg.Project, cfg.BigQueryDataset, option.WithTokenSource(ts))
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	results, err := analysis.ReadJobResults(ctx, c, jobID)
+	if err != nil {
+		return nil, err
+	}
+	if results == nil {
+		results = []*analysis.Result{}
+	}
+	return results, nil
+}
+
+// printJSON writes v to stdout as indented JSON.
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	return enc.Encode(v)
+}
+
 // requestJSON requests the path from the worker, then reads the returned body
 // and unmarshals it as JSON.
 func requestJSON[T any](ctx context.Context, path string, ts oauth2.TokenSource) (*T, error) {
-	url := workerURL + "/" + path
 	if *dryRun {
-		fmt.Printf("GET %s\n", url)
+		fmt.Printf("GET %s\n", workerURL+"/"+path)
 		return nil, nil
 	}
-	body, err := httpGet(ctx, url, ts)
+	return getJSON[T](ctx, path, ts)
+}
+
+// getJSON is like requestJSON, but it makes the request even with -n.
+// Use it only for requests that change nothing.
+func getJSON[T any](ctx context.Context, path string, ts oauth2.TokenSource) (*T, error) {
+	body, err := httpGet(ctx, workerURL+"/"+path, ts)
 	if err != nil {
 		return nil, err
 	}
@@ -504,45 +1522,102 @@ func requestJSON[T any](ctx context.Context, path string, ts oauth2.TokenSource)
 	return &t, nil
 }
 
+// maxHTTPAttempts is the number of times httpDo tries a request.
+const maxHTTPAttempts = 4
+
 // httpGet makes a GET request to the given URL with the given identity token.
-// It reads the body and returns the HTTP response and the body.
-func httpGet(ctx context.Context, url string, ts oauth2.TokenSource) (body []byte, err error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+// It returns the response body.
+func httpGet(ctx context.Context, url string, ts oauth2.TokenSource) ([]byte, error) {
+	return httpDo(ctx, http.MethodGet, url, nil, ts)
+}
+
+// httpPost makes a POST request with the given JSON body to the given URL
+// with the given identity token. It returns the response body.
+func httpPost(ctx context.Context, url string, body []byte, ts oauth2.TokenSource) ([]byte, error) {
+	return httpDo(ctx, http.MethodPost, url, body, ts)
+}
+
+// httpDo makes a request with the given method and body, authorized with a
+// token from ts, and returns the response body.
+// GET requests that fail with connection errors or responses indicating
+// that the server is temporarily unavailable are retried with exponential
+// backoff. Other requests may not be idempotent, so they are retried only
+// if the connection to the server could not be made.
+func httpDo(ctx context.Context, method, url string, reqBody []byte, ts oauth2.TokenSource) (body []byte, err error) {
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		body, retry, err = httpDoOnce(ctx, method, url, reqBody, ts)
+		if err == nil || !retry || ctx.Err() != nil {
+			return body, err
+		}
+		if attempt == maxHTTPAttempts {
+			return nil, fmt.Errorf("after %d attempts: %w", attempt, err)
+		}
+		// Add up to 50% jitter.
+		d := delay + time.Duration(rand.Int63n(int64(delay/2)))
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(d):
+		}
+		delay *= 2
+	}
+}
+
+// httpDoOnce makes a single attempt at a request.
+// It reports whether a failed request should be retried.
+func httpDoOnce(ctx context.Context, method, url string, reqBody []byte, ts oauth2.TokenSource) (body []byte, retry bool, err error) {
+	var r io.Reader
+	if reqBody != nil {
+		r = bytes.NewReader(reqBody)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, r)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
+	if reqBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
 	token, err := ts.Token()
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	token.SetAuthHeader(req)
+	idempotent := method == http.MethodGet
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return nil, err
+		// A request whose connection could not be made never reached
+		// the server. Any other may have.
+		var opErr *net.OpError
+		return nil, idempotent || (errors.As(err, &opErr) && opErr.Op == "dial"), err
 	}
 	defer res.Body.Close()
 	body, err = io.ReadAll(res.Body)
 	if err != nil {
-		return nil, fmt.Errorf("reading body (%s): %v", res.Status, err)
+		return nil, idempotent, fmt.Errorf("reading body (%s): %v", res.Status, err)
 	}
 	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("%s: %s", res.Status, body)
+		switch res.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			retry = idempotent
+		}
+		return nil, retry, fmt.Errorf("%s: %s", res.Status, body)
 	}
-	return body, nil
+	return body, false, nil
 }
 
-var serviceAccountEmail = fmt.Sprintf("impersonate@%s.iam.gserviceaccount.com", projectID)
-
 func accessTokenSource(ctx context.Context) (oauth2.TokenSource, error) {
 	return impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
-		TargetPrincipal: serviceAccountEmail,
+		TargetPrincipal: cfg.ServiceAccount,
 		Scopes:          []string{"https://www.googleapis.com/auth/cloud-platform"},
 	})
 }
 
 func identityTokenSource(ctx context.Context) (oauth2.TokenSource, error) {
 	return impersonate.IDTokenSource(ctx, impersonate.IDTokenConfig{
-		TargetPrincipal: serviceAccountEmail,
+		TargetPrincipal: cfg.ServiceAccount,
 		Audience:        workerURL,
 		IncludeEmail:    true,
 	})
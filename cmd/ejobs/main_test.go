@@ -0,0 +1,26 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestPrintDryRunResult(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		body    string
+		wantErr bool
+	}{
+		{"dry run", `{"NumTasks":{"analysis":2},"MinImporters":{"analysis":10},"TaskURLs":["/analysis/scan/a@v1.0.0","/analysis/scan/b@v1.0.0"]}`, false},
+		{"no tasks", `{"NumTasks":null,"TaskURLs":null}`, false},
+		// Older workers ignore dryrun and enqueue the tasks.
+		{"enqueued", `{"JobID":"j","NumTasks":2,"NumEnqueued":2,"Queue":"q"}`, true},
+		{"plain text", "enqueued 2 analysis tasks successfully, job ID is j", true},
+	} {
+		err := printDryRunResult([]byte(test.body))
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got %v, want error %t", test.name, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"gopkg.in/yaml.v3"
+)
+
+// A manifestEntry describes one job to start with start -manifest.
+// A manifest is a YAML list of entries, for example:
+//
+//	# suite.yaml
+//	- binary: bin/nilness
+//	  args: [-strict]
+//	  min: 100
+//	- binary: bin/printf
+//	  env: dev
+type manifestEntry struct {
+	// Binary is the path of the analysis binary. A relative path is
+	// relative to the directory of the manifest.
+	Binary string
+	Args   []string
+	// Min is the minimum number of importers of the modules to run on.
+	// If it is not set, the -min flag is used.
+	Min *int
+	// Env is the worker environment. If it is empty, the -env flag is
+	// used. The job's binary is uploaded to the binary bucket of Env.
+	Env string
+}
+
+func (e *manifestEntry) String() string {
+	return strings.Join(append([]string{filepath.Base(e.Binary)}, e.Args...), " ")
+}
+
+// readManifest reads the manifest in filename and checks its entries,
+// including their binaries.
+func readManifest(filename string) ([]*manifestEntry, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	var entries []*manifestEntry
+	if err := dec.Decode(&entries); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s: no entries", filename)
+	}
+	for i, e := range entries {
+		if e.Binary == "" {
+			return nil, fmt.Errorf("%s: entry %d: missing binary", filename, i+1)
+		}
+		if !filepath.IsAbs(e.Binary) {
+			e.Binary = filepath.Join(filepath.Dir(filename), e.Binary)
+		}
+		if e.Env == "" {
+			e.Env = *env
+		}
+		if err := checkStartArgs(e.Binary, e.Args); err != nil {
+			return nil, fmt.Errorf("%s: entry %d: %w", filename, i+1, err)
+		}
+	}
+	return entries, nil
+}
+
+// startManifest starts a job for each entry of the manifest in filename,
+// in order. It checks all the entries before starting any. If starting
+// an entry fails, it stops, and reports which entries were started and
+// which were not.
+func startManifest(ctx context.Context, filename string) error {
+	entries, err := readManifest(filename)
+	if err != nil {
+		return err
+	}
+	// The requests and uploads of each entry go to its environment.
+	defer setEnv(*env)
+	// ID tokens are for the worker of an environment.
+	tokenSources := map[string]oauth2.TokenSource{}
+	var jobIDs []string
+	for _, e := range entries {
+		fmt.Printf("Starting %s in %s:\n", e, e.Env)
+		min := minImporters
+		if e.Min != nil {
+			min = *e.Min
+		}
+		setEnv(e.Env)
+		var serr error
+		its := tokenSources[e.Env]
+		if its == nil {
+			its, serr = identityTokenSource(ctx)
+			tokenSources[e.Env] = its
+		}
+		var jobID string
+		if serr == nil {
+			jobID, serr = startJob(ctx, its, e.Binary, e.Args, min)
+		}
+		if serr != nil {
+			err = fmt.Errorf("%s: %w", e, serr)
+			break
+		}
+		jobIDs = append(jobIDs, jobID)
+	}
+	if *dryRun {
+		return err
+	}
+	fmt.Println()
+	if len(jobIDs) > 0 {
+		fmt.Println("Started:")
+		for i, id := range jobIDs {
+			if id == "" {
+				id = "(no job ID)"
+			}
+			fmt.Printf("\t%s: %s\n", entries[i], id)
+		}
+	}
+	if err != nil {
+		fmt.Println("Not started:")
+		for _, e := range entries[len(jobIDs):] {
+			fmt.Printf("\t%s\n", e)
+		}
+		if errors.Is(err, errCanceled) {
+			return err
+		}
+		return fmt.Errorf("started %d of %d jobs: %w", len(jobIDs), len(entries), err)
+	}
+	return nil
+}
@@ -13,6 +13,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -81,11 +82,11 @@ func runComparison(binary *buildbinary.BinaryInfo, govulncheckPath, modulePath,
 		return nil, binary.Error
 	}
 
-	srcResp, err := govulncheck.RunGovulncheckCmd(govulncheckPath, govulncheck.FlagSource, binary.ImportPath, modulePath, vulndbPath)
+	srcResp, err := govulncheck.RunGovulncheckCmd(context.Background(), os.Stderr, govulncheckPath, govulncheck.FlagSource, "", []string{binary.ImportPath}, modulePath, vulndbPath)
 	if err != nil {
 		return nil, err
 	}
-	binResp, err := govulncheck.RunGovulncheckCmd(govulncheckPath, govulncheck.FlagBinary, binary.BinaryPath, modulePath, vulndbPath)
+	binResp, err := govulncheck.RunGovulncheckCmd(context.Background(), os.Stderr, govulncheckPath, govulncheck.FlagBinary, "", []string{binary.BinaryPath}, modulePath, vulndbPath)
 	if err != nil {
 		return nil, err
 	}
@@ -95,6 +96,11 @@ func runComparison(binary *buildbinary.BinaryInfo, govulncheckPath, modulePath,
 		BinaryResults: *binResp,
 	}
 	pair.BinaryResults.Stats.BuildTime = binary.BuildTime
+	if md, err := govulncheck.ReadBinaryMetadata(binary.BinaryPath); err != nil {
+		pair.BinaryMetadataError = err.Error()
+	} else {
+		pair.BinaryMetadata = md
+	}
 	return pair, nil
 }
 
@@ -12,12 +12,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"strings"
 
 	"golang.org/x/pkgsite-metrics/internal/govulncheck"
 )
@@ -28,22 +30,35 @@ import (
 //   - govulncheck mode
 //   - input module or binary to analyze
 //   - full path to the vulnerability database
+//
+// An optional fifth input is the govulncheck scan level, and an optional
+// sixth is a comma-separated list of package patterns to scan instead of ./... .
 func main() {
 	flag.Parse()
-	run(os.Stdout, flag.Args())
+	run(os.Stdout, os.Stderr, flag.Args())
 }
 
-func run(w io.Writer, args []string) {
+// run writes the result as JSON to w, and govulncheck's progress
+// messages to stderr. Nothing else is written to w.
+func run(w, stderr io.Writer, args []string) {
 
 	fail := func(err error) {
 		fmt.Fprintf(w, `{"Error": %q}`, err)
 		fmt.Fprintln(w)
 	}
 
-	if len(args) != 4 {
-		fail(errors.New("need four args: govulncheck path, mode, input module dir or binary, full path to vuln db"))
+	if len(args) < 4 || len(args) > 6 {
+		fail(errors.New("need four args: govulncheck path, mode, input module dir or binary, full path to vuln db; optionally scan level and package patterns"))
 		return
 	}
+	scanLevel := ""
+	if len(args) >= 5 {
+		scanLevel = args[4]
+	}
+	patterns := []string{govulncheck.DefaultPackagePattern}
+	if len(args) == 6 && args[5] != "" {
+		patterns = strings.Split(args[5], ",")
+	}
 
 	modeFlag := args[1]
 	if modeFlag == govulncheck.FlagBinary {
@@ -51,7 +66,7 @@ func run(w io.Writer, args []string) {
 		return
 	}
 
-	resp, err := runGovulncheck(args[0], modeFlag, args[2], args[3])
+	resp, err := runGovulncheck(stderr, args[0], modeFlag, scanLevel, patterns, args[2], args[3])
 	if err != nil {
 		fail(err)
 		return
@@ -63,9 +78,9 @@ func run(w io.Writer, args []string) {
 	}
 
 	w.Write(b)
-	fmt.Println()
+	fmt.Fprintln(w)
 }
 
-func runGovulncheck(govulncheckPath, modeFlag, filePath, vulnDBDir string) (*govulncheck.AnalysisResponse, error) {
-	return govulncheck.RunGovulncheckCmd(govulncheckPath, modeFlag, "./...", filePath, vulnDBDir)
+func runGovulncheck(progress io.Writer, govulncheckPath, modeFlag, scanLevel string, patterns []string, filePath, vulnDBDir string) (*govulncheck.AnalysisResponse, error) {
+	return govulncheck.RunGovulncheckCmd(context.Background(), progress, govulncheckPath, modeFlag, scanLevel, patterns, filePath, vulnDBDir)
 }
@@ -6,6 +6,8 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"io"
 	"path/filepath"
 	"runtime"
 	"strings"
@@ -50,10 +52,13 @@ func Test(t *testing.T) {
 	}
 
 	t.Run("source", func(t *testing.T) {
-		resp, err := runTest([]string{govulncheckPath, govulncheck.FlagSource, module, vulndb})
+		resp, stderr, err := runTest(t, []string{govulncheckPath, govulncheck.FlagSource, module, vulndb})
 		if err != nil {
 			t.Fatal(err)
 		}
+		if stderr == "" {
+			t.Error("no progress messages on stderr")
+		}
 
 		checkVuln(t, resp.Findings)
 		if resp.Stats.ScanSeconds <= 0 {
@@ -62,6 +67,9 @@ func Test(t *testing.T) {
 		if resp.Stats.ScanMemory <= 0 {
 			t.Errorf("got %d; want >0 scan memory", resp.Stats.ScanMemory)
 		}
+		if resp.Stats.PackagesLoaded <= 0 || resp.Stats.ModulesInGraph <= 0 || resp.Stats.VulnDBEntries <= 0 {
+			t.Errorf("got %+v; want >0 packages, modules and vulndb entries", resp.Stats)
+		}
 	})
 
 	// Errors
@@ -99,7 +107,7 @@ func Test(t *testing.T) {
 		},
 	} {
 		t.Run(test.name, func(t *testing.T) {
-			_, err := runTest(test.args)
+			_, _, err := runTest(t, test.args)
 			if err == nil {
 				t.Fatal("got nil, want error")
 			}
@@ -110,8 +118,32 @@ func Test(t *testing.T) {
 	}
 }
 
-func runTest(args []string) (*govulncheck.AnalysisResponse, error) {
-	var buf bytes.Buffer
-	run(&buf, args)
-	return govulncheck.UnmarshalAnalysisResponse(buf.Bytes())
+func TestUsageError(t *testing.T) {
+	_, stderr, err := runTest(t, []string{"a", "b"})
+	if err == nil || !strings.Contains(err.Error(), "need four args") {
+		t.Errorf("got %v, want usage error", err)
+	}
+	if stderr != "" {
+		t.Errorf("got stderr %q, want none", stderr)
+	}
+}
+
+// runTest runs the program with args, and returns its unmarshaled
+// standard output and its standard error.
+// It fails t if standard output is not a single JSON value, since
+// the worker parses it as one.
+func runTest(t *testing.T, args []string) (*govulncheck.AnalysisResponse, string, error) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	run(&stdout, &stderr, args)
+	dec := json.NewDecoder(bytes.NewReader(stdout.Bytes()))
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		t.Fatalf("stdout is not JSON: %v\n%s", err, stdout.Bytes())
+	}
+	if err := dec.Decode(&v); err != io.EOF {
+		t.Fatalf("stdout has more than one JSON value (err = %v):\n%s", err, stdout.Bytes())
+	}
+	resp, err := govulncheck.UnmarshalAnalysisResponse(stdout.Bytes())
+	return resp, stderr.String(), err
 }
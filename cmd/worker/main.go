@@ -27,6 +27,9 @@ var (
 	port     = flag.String("port", config.GetEnv("PORT", "8080"), "port to listen to")
 	dataset  = flag.String("dataset", "", "dataset (overrides GO_ECOSYSTEM_BIGQUERY_DATASET env var); use 'disable' for no BQ")
 	insecure = flag.Bool("insecure", false, "bypass sandbox in order to compare with old code")
+	local    = flag.Bool("local-queue", false, "use an in-memory queue that dispatches tasks to this worker")
+
+	validateOnly = flag.Bool("validate-only", false, "check the configuration and the cloud resources it names, then exit")
 	// flag used in call to safehtml/template.TrustedSourceFromFlag
 	_ = flag.String("static", "static", "path to folder containing static files served")
 )
@@ -37,6 +40,8 @@ func main() {
 		fmt.Fprintln(out, "usage:")
 		fmt.Fprintln(out, "worker FLAGS")
 		fmt.Fprintln(out, "  run as a server, listening at the PORT env var")
+		fmt.Fprintln(out, "worker -validate-only FLAGS")
+		fmt.Fprintln(out, "  check the configuration and exit; the exit status is 1 if it is invalid")
 		flag.PrintDefaults()
 	}
 
@@ -49,6 +54,14 @@ func main() {
 		h = log.NewLineHandler(os.Stderr)
 	}
 	slog.SetDefault(slog.New(h))
+	if *validateOnly {
+		if _, err := loadConfig(ctx); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("configuration is valid")
+		return
+	}
 	if err := runServer(ctx); err != nil {
 		log.Error(ctx, "failed to start the server", err)
 		// Give the log message a chance to be captured (?).
@@ -57,17 +70,31 @@ func main() {
 	}
 }
 
-func runServer(ctx context.Context) error {
+// loadConfig returns the configuration from the environment and flags,
+// after checking it with Config.Validate.
+func loadConfig(ctx context.Context) (*config.Config, error) {
 	cfg, err := config.Init(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	cfg.LocalQueueWorkers = *workers
+	cfg.LocalQueue = *local
 	cfg.DevMode = *devMode
 	if *dataset != "" {
 		cfg.BigQueryDataset = *dataset
 	}
 	cfg.Insecure = *insecure
+	if err := cfg.Validate(ctx); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func runServer(ctx context.Context) error {
+	cfg, err := loadConfig(ctx)
+	if err != nil {
+		return err
+	}
 	cfg.Dump(os.Stdout)
 	log.Infof(ctx, "config: project=%s, dataset=%s", cfg.ProjectID, cfg.BigQueryDataset)
 
@@ -75,20 +102,30 @@ func runServer(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	go monitor(ctx, s)
-
 	addr := ":" + *port
+	hs := &http.Server{Addr: addr, BaseContext: s.BaseContext}
+	stopped := make(chan struct{})
+	go monitor(ctx, s, hs, cfg.ShutdownGracePeriod, stopped)
+
 	log.Infof(ctx, "Listening on addr http://localhost%s", addr)
-	return fmt.Errorf("listening: %v", http.ListenAndServe(addr, nil))
+	if err := hs.ListenAndServe(); err != http.ErrServerClosed {
+		return fmt.Errorf("listening: %v", err)
+	}
+	// Wait for the shutdown to finish before exiting.
+	<-stopped
+	return nil
 }
 
 // monitor measures details of server execution from
 // the moment is starts listening to the moment it
-// gets a SIGTERM signal.
-func monitor(ctx context.Context, s *worker.Server) {
+// gets a SIGTERM signal. Then it shuts down the server
+// gracefully and closes stopped.
+func monitor(ctx context.Context, s *worker.Server, hs *http.Server, grace time.Duration, stopped chan struct{}) {
+	defer close(stopped)
 	start := time.Now()
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGTERM)
 	<-signals
 	log.Infof(ctx, "server stopped listening after: %v\n%s", time.Since(start), s.Info())
+	log.Infof(ctx, "%s", s.Shutdown(ctx, hs, grace))
 }
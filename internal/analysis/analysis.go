@@ -9,9 +9,11 @@ package analysis
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -26,28 +28,86 @@ import (
 type ScanRequest struct {
 	scan.ModuleURLPath
 	ScanParams
+
+	// Attempt is the Cloud Tasks attempt that delivered the request,
+	// or nil if it was not delivered by Cloud Tasks. It is not part
+	// of the task.
+	Attempt *queue.TaskAttempt
 }
 
 type ScanParams struct {
-	Binary        string // name of analysis binary to run
-	BinaryVersion string // hex-encoded binary hash
+	Binary        string // comma-separated names of analysis binaries to run
+	BinaryVersion string // comma-separated hex-encoded binary hashes, in the order of Binary
 	Args          string // command-line arguments to binary; split on whitespace
 	ImportedBy    int    // imported-by count of module in path
 	Insecure      bool   // if true, run outside sandbox
 	Serve         bool   // serve results back to client instead of writing them to BigQuery
 	JobID         string // ID of job, if non-empty
 	SkipInit      bool   // if true, do not initialize non-module Go projects
+	Timeout       string // maximum duration of each binary run; if empty, use the configured default
+}
+
+// EstimateParams are the parameters of the analysis/estimate endpoint.
+type EstimateParams struct {
+	Min  int    // minimum import-by count for a module to be included
+	File string // path to file containing modules, local or gs://BUCKET/OBJECT; if missing, use DB
+}
+
+// An Estimate describes the modules that analysis/enqueue would
+// select for the same parameters.
+type Estimate struct {
+	NumModules int      // number of modules, each of which is one scan task
+	Sample     []string // paths of some of the modules
+}
+
+// TestParams are the parameters of the analysis/test endpoint.
+type TestParams struct {
+	Binary   string // name of the analysis binary to run
+	Args     string // command-line arguments to binary; split on whitespace
+	Insecure bool   // if true, run outside sandbox
+	SkipInit bool   // if true, do not initialize non-module Go projects
+}
+
+// ValidateParams are the parameters of the analysis/validate endpoint.
+type ValidateParams struct {
+	Binary   string // name of the analysis binary to run
+	Args     string // command-line arguments to binary; split on whitespace
+	Module   string // module to run the binary on; if empty, a default
+	Version  string // version of Module; required if Module is provided
+	Insecure bool   // if true, run outside sandbox
+}
+
+// A Validation is the result of running an analysis binary on a
+// single module, to check its output before enqueuing a job.
+type Validation struct {
+	Module         string
+	Version        string
+	Binary         string
+	BinaryVersion  string // hex-encoded hash of the binary
+	Valid          bool   // the binary ran and its output had the expected form
+	Error          string `json:",omitempty"`
+	ErrorCategory  string `json:",omitempty"`
+	NumDiagnostics int
 }
 
 type EnqueueParams struct {
-	Binary   string // name of analysis binary to run
+	Binary   string // comma-separated names of analysis binaries to run
 	Args     string // command-line arguments to binary; split on whitespace
 	Insecure bool   // if true, run outside sandbox
 	Min      int    // minimum import-by count for a module to be included
-	File     string // path to file containing modules; if missing, use DB
+	File     string // path to file containing modules, local or gs://BUCKET/OBJECT; if missing, use DB
 	Suffix   string // appended to task queue IDs to generate unique tasks
 	User     string // user initiating enqueue
 	SkipInit bool   // if true, do not initialize non-module Go projects
+	Parent   string // if non-empty, retry the modules that failed in this job
+	Priority string // "high" or "low" to use the queue for that priority
+	Notify   string // https URL to POST the job to when it finishes
+	Timeout  string // passed to each scan request
+	DryRun   bool   // if true, report the tasks instead of enqueuing them
+	// If Sample is between 0 and 1, only that fraction of the modules
+	// is enqueued, as selected by scan.SampleModules with Seed.
+	Sample float64
+	Seed   string
 }
 
 // Request implements queue.Task so it can be put on a TaskQueue.
@@ -74,6 +134,7 @@ func ParseScanRequest(r *http.Request, prefix string) (*ScanRequest, error) {
 	return &ScanRequest{
 		ModuleURLPath: mp,
 		ScanParams:    ap,
+		Attempt:       queue.TaskAttemptOf(r),
 	}, nil
 }
 
@@ -127,6 +188,62 @@ func (de *DiagnosticsOrError) UnmarshalJSON(data []byte) error {
 	return json.Unmarshal(data, &de.Error)
 }
 
+// ParseJSONTree parses the output of an analysis binary run with -json,
+// and checks that it has the expected form:
+//   - package IDs and analyzer names are non-empty;
+//   - each analyzer has either diagnostics or a non-empty error;
+//   - each diagnostic has a message, and a position that is either
+//     empty or of the form file:line:col.
+func ParseJSONTree(data []byte) (JSONTree, error) {
+	var tree JSONTree
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil, err
+	}
+	if tree == nil {
+		return nil, errors.New("output is not a JSON object")
+	}
+	for pkgID, amap := range tree {
+		if pkgID == "" {
+			return nil, errors.New("empty package ID")
+		}
+		for aName, de := range amap {
+			if aName == "" {
+				return nil, fmt.Errorf("package %s: empty analyzer name", pkgID)
+			}
+			if de.Error != nil {
+				if de.Error.Err == "" {
+					return nil, fmt.Errorf("package %s, analyzer %s: neither diagnostics nor error", pkgID, aName)
+				}
+				continue
+			}
+			for i, d := range de.Diagnostics {
+				if d.Message == "" {
+					return nil, fmt.Errorf("package %s, analyzer %s, diagnostic %d: missing message", pkgID, aName, i)
+				}
+				if d.Posn != "" && !validPosition(d.Posn) {
+					return nil, fmt.Errorf("package %s, analyzer %s, diagnostic %d: bad position %q", pkgID, aName, i, d.Posn)
+				}
+			}
+		}
+	}
+	return tree, nil
+}
+
+// validPosition reports whether pos has the form file:line:col.
+func validPosition(pos string) bool {
+	for range 2 {
+		i := strings.LastIndexByte(pos, ':')
+		if i < 0 {
+			return false
+		}
+		if n, err := strconv.Atoi(pos[i+1:]); err != nil || n < 0 {
+			return false
+		}
+		pos = pos[:i]
+	}
+	return pos != ""
+}
+
 // Definitions for BigQuery.
 
 const TableName = "analysis"
@@ -155,6 +272,35 @@ type Result struct {
 	WorkVersion          // InferSchema flattens embedded fields
 
 	Diagnostics []*Diagnostic `bigquery:"diagnostic"`
+
+	// If the row was too large to upload, DiagnosticsTruncated is true,
+	// Diagnostics holds only the first NumDiagnostics, and the complete
+	// row is at FullResultsPath, if it could be saved.
+	DiagnosticsTruncated bq.NullBool   `bigquery:"diagnostics_truncated"`
+	NumDiagnostics       bq.NullInt64  `bigquery:"num_diagnostics"`
+	FullResultsPath      bq.NullString `bigquery:"full_results_path"`
+
+	// JobID is the ID of the job that requested the scan, if any.
+	JobID bq.NullString `bigquery:"job_id"`
+
+	// The wall-clock and CPU time taken by the analysis binary.
+	// They are null for rows written before they were recorded.
+	ScanSeconds    bq.NullFloat64 `bigquery:"scan_seconds"`
+	ScanCPUSeconds bq.NullFloat64 `bigquery:"scan_cpu_seconds"`
+
+	// InstanceID is the ID of the Cloud Run instance that wrote the row.
+	InstanceID bq.NullString `bigquery:"instance_id"`
+	// TaskRetryCount and TaskExecutionCount describe the Cloud Tasks
+	// attempt that requested the scan. See queue.TaskAttempt. They are
+	// null if the scan was not requested by Cloud Tasks.
+	TaskRetryCount     bq.NullInt64 `bigquery:"task_retry_count"`
+	TaskExecutionCount bq.NullInt64 `bigquery:"task_execution_count"`
+
+	// BinaryMetadata describes how the binary was built, like its
+	// GOFLAGS or build tags. It is the JSON object of the optional
+	// sidecar object <binary>.meta.json next to the binary in the
+	// binaries bucket, or null if there is none.
+	BinaryMetadata bq.NullString `bigquery:"binary_metadata"`
 }
 
 func (r *Result) AddError(err error) {
@@ -204,6 +350,10 @@ func init() {
 	}
 	SchemaVersion = bigquery.SchemaVersion(s)
 	bigquery.AddTable(TableName, s)
+	bigquery.SetTableLayout(TableName, bigquery.TableLayout{
+		PartitionField: "created_at",
+		ClusterFields:  []string{"module_path"},
+	})
 }
 
 // WorkVersionKey is the key for a WorkVersion.
@@ -274,16 +424,68 @@ func JSONTreeToDiagnostics(jsonTree JSONTree) []*Diagnostic {
 	return diags
 }
 
-func ReadResults(ctx context.Context, c *bigquery.Client, binaryName, binaryVersion, binaryArgs string) (_ []*Result, err error) {
-	defer derrors.Wrap(&err, "ReadResults")
-	q := bigquery.PartitionQuery{
-		From:        c.FullTableName(TableName),
-		PartitionOn: "module_path, version",
-		Where: fmt.Sprintf("binary_name='%s' AND binary_version='%s' AND binary_args='%s'",
-			binaryName, binaryVersion, binaryArgs),
-		OrderBy: "created_at DESC",
+// SplitBinaries splits the comma-separated list of binary names or
+// hashes of the Binary and BinaryVersion params.
+func SplitBinaries(list string) []string {
+	if list == "" {
+		return nil
 	}
-	iter, err := c.Query(ctx, q.String())
+	return strings.Split(list, ",")
+}
+
+// jobResultsQuery returns a query for the most recent result of each
+// module version and binary in the given analysis table, among the
+// results of the job with the ID given by the @job_id parameter.
+func jobResultsQuery(table string) string {
+	latest := bigquery.PartitionQuery{
+		From:        "`" + table + "`",
+		PartitionOn: "module_path, version, binary_name",
+		Where:       "job_id = @job_id",
+		OrderBy:     "created_at DESC",
+	}
+	return fmt.Sprintf(`
+		SELECT *
+		FROM (%s)
+		ORDER BY module_path, version, binary_name
+	`, latest)
+}
+
+// ReadJobResults returns the most recent result of each module version
+// and binary of the job with jobID. It reads all the pages of the
+// query's results.
+func ReadJobResults(ctx context.Context, c *bigquery.Client, jobID string) (_ []*Result, err error) {
+	defer derrors.Wrap(&err, "ReadJobResults(%q)", jobID)
+	iter, err := c.QueryWithParams(ctx, jobResultsQuery(c.FullTableName(TableName)), []bq.QueryParameter{{Name: "job_id", Value: jobID}})
+	if err != nil {
+		return nil, err
+	}
+	return bigquery.All[Result](iter)
+}
+
+// jobFailuresQuery returns a query for the module versions whose most
+// recent result in the given analysis table, among the results of the
+// job with the ID given by the @job_id parameter, has an error.
+func jobFailuresQuery(table string) string {
+	latest := bigquery.PartitionQuery{
+		From:        "`" + table + "`",
+		PartitionOn: "module_path, version, binary_name",
+		Where:       "job_id = @job_id",
+		OrderBy:     "created_at DESC",
+	}
+	return fmt.Sprintf(`
+		SELECT DISTINCT module_path, version
+		FROM (%s)
+		WHERE error != ''
+		ORDER BY module_path, version
+	`, latest)
+}
+
+// ReadJobFailures returns the module versions whose most recent result
+// for the job with jobID has an error. Only the ModulePath and Version
+// fields of the results are set.
+func ReadJobFailures(ctx context.Context, c *bigquery.Client, jobID string) (_ []*Result, err error) {
+	defer derrors.Wrap(&err, "ReadJobFailures(%q)", jobID)
+	iter, err := c.QueryWithParams(ctx, jobFailuresQuery(c.FullTableName(TableName)), []bq.QueryParameter{{Name: "job_id", Value: jobID}})
 	if err != nil {
 		return nil, err
 	}
@@ -5,11 +5,26 @@
 package analysis
 
 import (
+	"regexp"
+	"strings"
 	"testing"
 
+	bq "cloud.google.com/go/bigquery"
 	"github.com/google/go-cmp/cmp"
+	"golang.org/x/pkgsite-metrics/internal/bigquery"
 )
 
+func TestTableMetadata(t *testing.T) {
+	got := bigquery.TableMetadata(TableName)
+	want := &bq.TimePartitioning{Type: bq.DayPartitioningType, Field: "created_at"}
+	if diff := cmp.Diff(want, got.TimePartitioning); diff != "" {
+		t.Errorf("partitioning mismatch (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(&bq.Clustering{Fields: []string{"module_path"}}, got.Clustering); diff != "" {
+		t.Errorf("clustering mismatch (-want, +got):\n%s", diff)
+	}
+}
+
 func TestJSONTreeToDiagnostics(t *testing.T) {
 	in := JSONTree{
 		"pkg1": {
@@ -40,3 +55,74 @@ func TestJSONTreeToDiagnostics(t *testing.T) {
 		t.Errorf("mismatch (-want, +got)\n%s", diff)
 	}
 }
+
+func TestParseJSONTree(t *testing.T) {
+	for _, test := range []struct {
+		in      string
+		wantErr bool
+	}{
+		{`{}`, false},
+		{`{"p": {"a": [{"posn": "f.go:1:2", "message": "m"}]}}`, false},
+		{`{"p": {"a": [{"message": "no position"}]}}`, false},
+		{`{"p": {"a": {"error": "failed"}}}`, false},
+		{``, true},
+		{`null`, true},
+		{`[1, 2]`, true},
+		{`{"p": {"a": [{"posn": "f.go:1:2"}]}}`, true},
+		{`{"p": {"a": [{"posn": "f.go", "message": "m"}]}}`, true},
+		{`{"p": {"a": [{"posn": "f.go:x:2", "message": "m"}]}}`, true},
+		{`{"p": {"a": {}}}`, true},
+		{`{"": {"a": {"error": "failed"}}}`, true},
+		{`{"p": {"": {"error": "failed"}}}`, true},
+	} {
+		_, err := ParseJSONTree([]byte(test.in))
+		if got := err != nil; got != test.wantErr {
+			t.Errorf("%s: got error %v, want error: %t", test.in, err, test.wantErr)
+		}
+	}
+}
+
+func TestJobSummaryQuery(t *testing.T) {
+	q := jobSummaryQuery("p.d.analysis")
+	// Every field of JobSummary that isn't set from the job record
+	// must be a column of the query.
+	fromJob := map[string]bool{
+		"created_at":       true,
+		"job_id":           true,
+		"started_at":       true,
+		"num_tasks":        true,
+		"num_failed_tasks": true,
+	}
+	for _, f := range bigquery.TableSchema(JobSummaryTableName) {
+		if !fromJob[f.Name] && !regexp.MustCompile(`\bAS `+f.Name+`\b`).MatchString(q) {
+			t.Errorf("query has no column %s", f.Name)
+		}
+	}
+	if !strings.Contains(strings.Join(strings.Fields(q), " "), "FROM `p.d.analysis` WHERE job_id = @job_id") {
+		t.Errorf("query does not select the job's rows:\n%s", q)
+	}
+}
+
+func TestJobResultsQuery(t *testing.T) {
+	q := strings.Join(strings.Fields(jobResultsQuery("p.d.analysis")), " ")
+	// Rows are selected by job, not by binary and args, which other
+	// jobs may share.
+	if !strings.Contains(q, "FROM `p.d.analysis` WHERE job_id = @job_id") {
+		t.Errorf("query does not select the job's rows:\n%s", q)
+	}
+	if strings.Contains(q, "binary_args") {
+		t.Errorf("query selects rows by binary args:\n%s", q)
+	}
+}
+
+func TestJobFailuresQuery(t *testing.T) {
+	q := strings.Join(strings.Fields(jobFailuresQuery("p.d.analysis")), " ")
+	// Only the job's own results are ranked, so a later result of
+	// another job for the same module cannot hide or add a failure.
+	if !strings.Contains(q, "FROM `p.d.analysis` WHERE job_id = @job_id") {
+		t.Errorf("query does not select the job's rows:\n%s", q)
+	}
+	if !strings.Contains(q, "WHERE error != ''") {
+		t.Errorf("query does not select failures:\n%s", q)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analysis
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	bq "cloud.google.com/go/bigquery"
+	"golang.org/x/pkgsite-metrics/internal/bigquery"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+)
+
+// JobSummaryTableName is the table that holds a summary of each
+// finished job.
+const JobSummaryTableName = "job_summaries"
+
+// JobSummary is a row in the BigQuery job summary table. It aggregates
+// the results of a job, which are the most recent results in the
+// analysis table with the job's ID.
+type JobSummary struct {
+	CreatedAt time.Time `bigquery:"created_at"`
+	JobID     string    `bigquery:"job_id"`
+	// From the job record.
+	StartedAt      time.Time `bigquery:"started_at"`
+	NumTasks       int       `bigquery:"num_tasks"`        // tasks enqueued
+	NumFailedTasks int       `bigquery:"num_failed_tasks"` // tasks that failed without a result
+	// Aggregated from the job's results.
+	NumResults      int              `bigquery:"num_results"`
+	NumErrors       int              `bigquery:"num_errors"` // results with an error
+	ErrorCategories []*CategoryCount `bigquery:"error_categories"`
+	// The total number of diagnostics, and the number of module versions
+	// with at least one.
+	NumDiagnostics            int `bigquery:"num_diagnostics"`
+	NumModulesWithDiagnostics int `bigquery:"num_modules_with_diagnostics"`
+	// Approximate percentiles of the time taken by the analysis binary,
+	// and the total CPU time it used. They are null if no result
+	// records them.
+	P50ScanSeconds      bq.NullFloat64 `bigquery:"p50_scan_seconds"`
+	P95ScanSeconds      bq.NullFloat64 `bigquery:"p95_scan_seconds"`
+	TotalScanCPUSeconds bq.NullFloat64 `bigquery:"total_scan_cpu_seconds"`
+	// The work version of the job's most recent result.
+	WorkVersion
+}
+
+// A CategoryCount is the number of results with an error category.
+type CategoryCount struct {
+	Category string `bigquery:"category"`
+	Count    int    `bigquery:"count"`
+}
+
+func (s *JobSummary) SetUploadTime(t time.Time) { s.CreatedAt = t }
+
+func init() {
+	s, err := bigquery.InferSchema(JobSummary{})
+	if err != nil {
+		panic(err)
+	}
+	bigquery.AddTable(JobSummaryTableName, s)
+}
+
+// jobSummaryQuery returns a query that aggregates the most recent
+// result of each module version and binary in the given analysis table
+// with the job ID given by the @job_id parameter.
+// Its columns are the aggregated fields of JobSummary.
+func jobSummaryQuery(table string) string {
+	latest := bigquery.PartitionQuery{
+		From:        "`" + table + "`",
+		PartitionOn: "module_path, version, binary_name",
+		Where:       "job_id = @job_id",
+		OrderBy:     "created_at DESC",
+	}
+	// ndiags counts the diagnostics of a result, including those
+	// left out of a truncated row.
+	const qf = `
+		WITH latest AS (%s),
+		results AS (
+			SELECT *, COALESCE(num_diagnostics, ARRAY_LENGTH(diagnostic), 0) AS ndiags
+			FROM latest
+		)
+		SELECT
+			COUNT(*) AS num_results,
+			COUNTIF(error != '') AS num_errors,
+			ARRAY(
+				SELECT AS STRUCT error_category AS category, COUNT(*) AS count
+				FROM latest
+				WHERE error_category != ''
+				GROUP BY error_category
+				ORDER BY error_category
+			) AS error_categories,
+			IFNULL(SUM(ndiags), 0) AS num_diagnostics,
+			COUNT(DISTINCT IF(ndiags > 0, CONCAT(module_path, '@', version), NULL)) AS num_modules_with_diagnostics,
+			APPROX_QUANTILES(scan_seconds, 100)[SAFE_OFFSET(50)] AS p50_scan_seconds,
+			APPROX_QUANTILES(scan_seconds, 100)[SAFE_OFFSET(95)] AS p95_scan_seconds,
+			SUM(scan_cpu_seconds) AS total_scan_cpu_seconds,
+			%s
+		FROM results
+	`
+	return fmt.Sprintf(qf, latest.String(), latestColumns("created_at",
+		"binary_version", "binary_args", "worker_version", "schema_version"))
+}
+
+// latestColumns returns select expressions for the value of each of the
+// string columns in the row with the greatest value of orderBy, or the
+// empty string if there are no rows.
+func latestColumns(orderBy string, cols ...string) string {
+	var exprs []string
+	for _, col := range cols {
+		exprs = append(exprs, fmt.Sprintf("IFNULL(ARRAY_AGG(%[1]s ORDER BY %[2]s DESC LIMIT 1)[SAFE_OFFSET(0)], '') AS %[1]s", col, orderBy))
+	}
+	return strings.Join(exprs, ",\n")
+}
+
+// ReadJobSummary aggregates the results of the job with the given ID.
+// The fields of the returned JobSummary that come from the job record
+// are not set.
+func ReadJobSummary(ctx context.Context, c *bigquery.Client, jobID string) (_ *JobSummary, err error) {
+	defer derrors.Wrap(&err, "ReadJobSummary(%q)", jobID)
+	iter, err := c.QueryWithParams(ctx, jobSummaryQuery(c.FullTableName(TableName)), []bq.QueryParameter{{Name: "job_id", Value: jobID}})
+	if err != nil {
+		return nil, err
+	}
+	var sum *JobSummary
+	err = bigquery.ForEachRow(iter, func(s *JobSummary) bool {
+		// An aggregate query has exactly one row.
+		sum = s
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sum == nil {
+		return nil, fmt.Errorf("no summary row")
+	}
+	sum.JobID = jobID
+	return sum, nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bigquery
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/log"
+)
+
+// A BatchUploader collects rows for each table and uploads them together,
+// to make fewer insert requests than uploading each row on its own.
+// A table's rows are uploaded when there are enough of them, when a
+// timer fires, or when Flush is called.
+type BatchUploader struct {
+	put     func(ctx context.Context, tableID string, rows []Row) error
+	maxRows int
+
+	mu        sync.Mutex
+	pending   map[string]*Batch // by table ID
+	uploading map[*Batch]bool   // batches being uploaded
+}
+
+// A Batch is a set of rows that are uploaded to a table together.
+type Batch struct {
+	tableID string
+	rows    []Row
+	done    chan struct{} // closed after the upload
+	err     error         // result of the upload; set before done is closed
+}
+
+// An Added is the set of rows added to a batch by one call to Add.
+type Added struct {
+	batch      *Batch
+	start, end int // the rows are batch.rows[start:end]
+}
+
+// NewBatchUploader returns a BatchUploader that uploads to sink in batches
+// of about maxRows rows, and uploads any pending rows every interval
+// until ctx is done.
+func NewBatchUploader(ctx context.Context, sink Sink, maxRows int, interval time.Duration) *BatchUploader {
+	return newBatchUploader(ctx, sink.UploadRows, maxRows, interval)
+}
+
+func newBatchUploader(ctx context.Context, put func(context.Context, string, []Row) error, maxRows int, interval time.Duration) *BatchUploader {
+	u := &BatchUploader{
+		put:       put,
+		maxRows:   maxRows,
+		pending:   map[string]*Batch{},
+		uploading: map[*Batch]bool{},
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := u.Flush(ctx); err != nil {
+					log.Errorf(ctx, err, "BatchUploader: periodic flush")
+				}
+			}
+		}
+	}()
+	return u
+}
+
+// Add adds rows to the next batch for the table.
+// If the batch is full, Add starts uploading it.
+// Call Added.Wait to learn whether the rows were uploaded.
+func (u *BatchUploader) Add(tableID string, rows ...Row) *Added {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	b := u.pending[tableID]
+	if b == nil {
+		b = &Batch{tableID: tableID, done: make(chan struct{})}
+		u.pending[tableID] = b
+	}
+	a := &Added{batch: b, start: len(b.rows)}
+	b.rows = append(b.rows, rows...)
+	a.end = len(b.rows)
+	if len(b.rows) >= u.maxRows {
+		delete(u.pending, tableID)
+		u.uploading[b] = true
+		// Don't tie the upload to any one caller's context.
+		go u.upload(context.Background(), b)
+	}
+	return a
+}
+
+// Flush uploads all pending rows and waits for them and for any uploads
+// already in progress. It returns the errors of the uploads that failed.
+func (u *BatchUploader) Flush(ctx context.Context) (err error) {
+	defer derrors.Wrap(&err, "BatchUploader.Flush")
+	u.mu.Lock()
+	pending := u.pending
+	u.pending = map[string]*Batch{}
+	var batches []*Batch
+	for b := range u.uploading {
+		batches = append(batches, b)
+	}
+	for _, b := range pending {
+		u.uploading[b] = true
+		batches = append(batches, b)
+	}
+	u.mu.Unlock()
+
+	for _, b := range pending {
+		go u.upload(ctx, b)
+	}
+	var errs []error
+	for _, b := range batches {
+		<-b.done
+		errs = append(errs, b.err)
+	}
+	return errors.Join(errs...)
+}
+
+func (u *BatchUploader) upload(ctx context.Context, b *Batch) {
+	b.err = u.put(ctx, b.tableID, b.rows)
+	u.mu.Lock()
+	delete(u.uploading, b)
+	u.mu.Unlock()
+	close(b.done)
+}
+
+// Wait waits until the rows of a have been uploaded with the rest of
+// their batch, and returns the error from the upload. If only some of
+// the rows of the batch were not uploaded, Wait returns nil if none of
+// them were among a's rows, and otherwise a *PartialUploadError whose
+// indexes are those of a's rows that were not uploaded. If ctx is done
+// first, Wait returns ctx.Err(), and the rows will still be uploaded
+// later.
+func (a *Added) Wait(ctx context.Context) error {
+	b := a.batch
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-b.done:
+	}
+	var perr *PartialUploadError
+	if !errors.As(b.err, &perr) {
+		return b.err
+	}
+	var failed []int
+	for _, i := range perr.Failed {
+		if i >= a.start && i < a.end {
+			failed = append(failed, i-a.start)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return &PartialUploadError{Failed: failed, Err: perr.Err}
+}
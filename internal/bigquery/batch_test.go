@@ -0,0 +1,227 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bigquery
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	bq "cloud.google.com/go/bigquery"
+	"github.com/google/go-cmp/cmp"
+)
+
+type testRow struct{ n int }
+
+func (*testRow) SetUploadTime(time.Time) {}
+
+// fakeInserter records the batches put to each table.
+type fakeInserter struct {
+	mu      sync.Mutex
+	batches map[string][][]int // table to row numbers of each batch
+	fail    string             // table to fail uploads to
+}
+
+func (f *fakeInserter) put(ctx context.Context, tableID string, rows []Row) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if tableID == f.fail {
+		return errors.New("insert failed")
+	}
+	var ns []int
+	for _, r := range rows {
+		ns = append(ns, r.(*testRow).n)
+	}
+	if f.batches == nil {
+		f.batches = map[string][][]int{}
+	}
+	f.batches[tableID] = append(f.batches[tableID], ns)
+	return nil
+}
+
+func (f *fakeInserter) get() map[string][][]int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.batches
+}
+
+func TestBatchUploader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f := &fakeInserter{fail: "bad"}
+	// An hour is too long for the timer to fire during the test.
+	u := newBatchUploader(ctx, f.put, 3, time.Hour)
+
+	// A full batch is uploaded without a flush.
+	b1 := u.Add("t1", &testRow{1}, &testRow{2})
+	b2 := u.Add("t1", &testRow{3})
+	if b1.batch != b2.batch {
+		t.Fatal("rows added together are in different batches")
+	}
+	if err := b1.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Partial batches wait for a flush.
+	b3 := u.Add("t1", &testRow{4})
+	b4 := u.Add("t2", &testRow{5})
+	bBad := u.Add("bad", &testRow{6})
+	wctx, wcancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer wcancel()
+	if err := b3.Wait(wctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("before flush: got %v, want DeadlineExceeded", err)
+	}
+	// As at server shutdown.
+	if err := u.Flush(ctx); err == nil {
+		t.Error("Flush: got nil, want error for table bad")
+	}
+	for _, b := range []*Added{b3, b4} {
+		if err := b.Wait(ctx); err != nil {
+			t.Errorf("%s: %v", b.batch.tableID, err)
+		}
+	}
+	// A failed upload is reported to the caller, so it can retry the rows.
+	if err := bBad.Wait(ctx); err == nil {
+		t.Error("bad: got nil, want error")
+	}
+
+	want := map[string][][]int{
+		"t1": {{1, 2, 3}, {4}},
+		"t2": {{5}},
+	}
+	if diff := cmp.Diff(want, f.get()); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+
+	// Nothing is left to flush.
+	if err := u.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, f.get()); diff != "" {
+		t.Errorf("after second flush: mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestBatchUploaderInterval(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f := &fakeInserter{}
+	u := newBatchUploader(ctx, f.put, 100, time.Millisecond)
+	var batches []*Added
+	for i := range 3 {
+		batches = append(batches, u.Add("t", &testRow{i}))
+	}
+	for _, b := range batches {
+		if err := b.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The timer may have fired between the adds.
+	var got []int
+	for _, ns := range f.get()["t"] {
+		got = append(got, ns...)
+	}
+	sort.Ints(got)
+	if diff := cmp.Diff([]int{0, 1, 2}, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestBatchUploaderPartialFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Rows with negative numbers are rejected.
+	put := func(_ context.Context, _ string, rows []Row) error {
+		var failed []int
+		for i, r := range rows {
+			if r.(*testRow).n < 0 {
+				failed = append(failed, i)
+			}
+		}
+		if len(failed) == 0 {
+			return nil
+		}
+		return &PartialUploadError{Failed: failed, Err: errors.New("bad rows")}
+	}
+	u := newBatchUploader(ctx, put, 100, time.Hour)
+	a1 := u.Add("t", &testRow{1}, &testRow{2})
+	a2 := u.Add("t", &testRow{3}, &testRow{-4}, &testRow{5}, &testRow{-6})
+	if err := u.Flush(ctx); err == nil {
+		t.Fatal("Flush: got nil, want error")
+	}
+	// Only the failed rows of each caller are reported to it,
+	// by their index among its rows.
+	if err := a1.Wait(ctx); err != nil {
+		t.Errorf("a1: %v", err)
+	}
+	var perr *PartialUploadError
+	if err := a2.Wait(ctx); !errors.As(err, &perr) {
+		t.Fatalf("a2: got %v, want a PartialUploadError", err)
+	}
+	if diff := cmp.Diff([]int{1, 3}, perr.Failed); diff != "" {
+		t.Errorf("a2: mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestBatchUploaderFlushWaits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	release := make(chan struct{})
+	var uploaded atomic.Bool
+	put := func(context.Context, string, []Row) error {
+		<-release
+		uploaded.Store(true)
+		return nil
+	}
+	u := newBatchUploader(ctx, put, 1, time.Hour)
+	// A full batch starts uploading at once.
+	u.Add("t", &testRow{1})
+	flushed := make(chan error)
+	go func() { flushed <- u.Flush(ctx) }()
+	select {
+	case <-flushed:
+		t.Fatal("Flush returned before the upload in progress finished")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	if err := <-flushed; err != nil {
+		t.Fatal(err)
+	}
+	if !uploaded.Load() {
+		t.Error("Flush returned before the upload finished")
+	}
+}
+
+func TestUploadError(t *testing.T) {
+	putErr := bq.PutMultiError{{RowIndex: 1}, {RowIndex: 0}}
+	for _, test := range []struct {
+		name          string
+		err           error
+		start, end, n int
+		wantFailed    []int
+		wantPartial   bool
+	}{
+		{"first insert fails", errors.New("x"), 0, 2, 4, nil, false},
+		{"later insert fails", errors.New("x"), 2, 4, 6, []int{2, 3, 4, 5}, true},
+		{"some rows rejected", putErr, 2, 4, 5, []int{2, 3, 4}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := uploadError(test.err, test.start, test.end, test.n)
+			var perr *PartialUploadError
+			if got := errors.As(err, &perr); got != test.wantPartial {
+				t.Fatalf("got %v, want partial: %t", err, test.wantPartial)
+			}
+			if perr != nil {
+				if diff := cmp.Diff(test.wantFailed, perr.Failed); diff != "" {
+					t.Errorf("mismatch (-want, +got):\n%s", diff)
+				}
+			}
+		})
+	}
+}
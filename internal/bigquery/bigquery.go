@@ -23,6 +23,7 @@ import (
 	"golang.org/x/pkgsite-metrics/internal/derrors"
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 )
 
 // Client is a client for connecting to BigQuery.
@@ -41,9 +42,16 @@ func NewClientCreate(ctx context.Context, projectID, datasetID string) (_ *Clien
 	return newClient(ctx, projectID, datasetID)
 }
 
-func newClient(ctx context.Context, projectID, datasetID string) (_ *Client, err error) {
+// NewClient creates a new client for connecting to BigQuery, referring
+// to a single existing dataset. The options are passed to the
+// underlying BigQuery client.
+func NewClient(ctx context.Context, projectID, datasetID string, opts ...option.ClientOption) (*Client, error) {
+	return newClient(ctx, projectID, datasetID, opts...)
+}
+
+func newClient(ctx context.Context, projectID, datasetID string, opts ...option.ClientOption) (_ *Client, err error) {
 	defer derrors.Wrap(&err, "New(ctx, %q, %q)", projectID, datasetID)
-	client, err := bq.NewClient(ctx, projectID)
+	client, err := bq.NewClient(ctx, projectID, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -143,39 +151,44 @@ func (c *Client) FullTableName(tableID string) string {
 	return fmt.Sprintf("%s.%s.%s", c.dataset.ProjectID, c.dataset.DatasetID, tableID)
 }
 
-// CreateOrUpdateTable creates a table if it does not exist, or updates it if it does.
+// CreateOrUpdateTable creates a table if it does not exist, or adds any
+// missing columns to it if it does.
 // It returns true if it created the table.
+// A new table is partitioned and clustered according to its layout
+// (see SetTableLayout). If an existing table should be partitioned but
+// isn't, CreateOrUpdateTable still adds the missing columns, and then
+// returns an error wrapping ErrNotPartitioned.
 func (c *Client) CreateOrUpdateTable(ctx context.Context, tableID string) (created bool, err error) {
 	defer derrors.Wrap(&err, "CreateOrUpdateTable(%q)", tableID)
-	schema := TableSchema(tableID)
-	if schema == nil {
+	want := TableMetadata(tableID)
+	if want == nil {
 		return false, fmt.Errorf("no schema registered for table %q", tableID)
 	}
+	schema := want.Schema
 
 	meta, err := c.Table(tableID).Metadata(ctx) // check if the table already exists
 	if err != nil {
 		if !isNotFoundError(err) {
 			return false, err
 		}
-		return true, c.Table(tableID).Create(ctx, &bq.TableMetadata{Schema: schema})
+		return true, c.Table(tableID).Create(ctx, want)
 	}
-
-	if SchemaVersion(schema) == SchemaVersion(meta.Schema) {
-		// The schemas are the same, so we don't need to do anything. In fact, any
-		// update, even an idempotent one, will result in table patching that counts
-		// towards quota limits for table metadata updates.
-		return false, nil
+	if SchemaVersion(schema) != SchemaVersion(meta.Schema) {
+		// Only add columns: BigQuery doesn't allow removing or changing
+		// them. Use CheckSchema to find such differences.
+		// If the schemas are the same, don't update the table at all:
+		// any update, even an idempotent one, will result in table
+		// patching that counts towards quota limits for table metadata
+		// updates.
+		if _, err := c.addColumns(ctx, tableID, meta, schema); err != nil {
+			return false, err
+		}
 	}
-
-	_, err = c.Table(tableID).Update(ctx, bq.TableMetadataToUpdate{Schema: schema}, meta.ETag)
-	// There is a race condition if multiple threads of control call this function concurrently:
-	// The table may have changed since Metadata was called above. This error is harmless: it
-	// just means that someone else updated the table before us. Ignore it.
-	if isAlreadyExistsError(err) || isRaceChangeError(err) {
-		// check already-exists error for sanity and in case of races
-		return false, nil
+	if want.TimePartitioning != nil && meta.TimePartitioning == nil {
+		return false, fmt.Errorf("%w: want partitioning on %s; migrate the table with MigrateToPartitioned",
+			ErrNotPartitioned, want.TimePartitioning.Field)
 	}
-	return false, err
+	return false, nil
 }
 
 // A Row is something that can be uploaded to BigQuery.
@@ -196,6 +209,8 @@ func (c *Client) Upload(ctx context.Context, tableID string, row Row) (err error
 // The chunkSize parameter limits the number of rows sent in a single request; this may
 // be necessary to avoid reaching the maximum size of a request.
 // If chunkSize is <= 0, all rows will be sent in one request.
+// If some of the rows may have been inserted, the error is a
+// *PartialUploadError that says which were not.
 func UploadMany[T Row](ctx context.Context, client *Client, tableID string, rows []T, chunkSize int) (err error) {
 	defer derrors.Wrap(&err, "UploadMany(%q), %d rows, chunkSize=%d", tableID, len(rows), chunkSize)
 
@@ -207,7 +222,10 @@ func UploadMany[T Row](ctx context.Context, client *Client, tableID string, rows
 
 	ins := client.Table(tableID).Inserter()
 	if chunkSize <= 0 {
-		return ins.Put(ctx, rows)
+		if err := ins.Put(ctx, rows); err != nil {
+			return uploadError(err, 0, len(rows), len(rows))
+		}
+		return nil
 	}
 	start := 0
 	for start < len(rows) {
@@ -223,7 +241,7 @@ func UploadMany[T Row](ctx context.Context, client *Client, tableID string, rows
 				end = start + (end-start)/2
 				continue
 			} else {
-				return err
+				return uploadError(err, start, end, len(rows))
 			}
 		}
 		start = end
@@ -231,6 +249,45 @@ func UploadMany[T Row](ctx context.Context, client *Client, tableID string, rows
 	return nil
 }
 
+// A PartialUploadError is returned by an upload of which some rows
+// may have been stored. Only the rows listed in Failed were not.
+type PartialUploadError struct {
+	Failed []int // indexes of the rows that were not stored, in increasing order
+	Err    error
+}
+
+func (e *PartialUploadError) Error() string {
+	return fmt.Sprintf("%d rows not uploaded: %v", len(e.Failed), e.Err)
+}
+
+func (e *PartialUploadError) Unwrap() error { return e.Err }
+
+// uploadError returns the error for a failed insert of rows[start:end]
+// out of n rows, after the rows before start were inserted. BigQuery
+// reports the rows it rejected in a PutMultiError. Any other error means
+// that none of the insert's rows were stored.
+func uploadError(err error, start, end, n int) error {
+	var failed []int
+	var perr bq.PutMultiError
+	if errors.As(err, &perr) {
+		for _, re := range perr {
+			failed = append(failed, start+re.RowIndex)
+		}
+		sort.Ints(failed)
+	} else if start == 0 {
+		return err
+	} else {
+		for i := start; i < end; i++ {
+			failed = append(failed, i)
+		}
+	}
+	// The rows after this insert were never sent.
+	for i := end; i < n; i++ {
+		failed = append(failed, i)
+	}
+	return &PartialUploadError{Failed: failed, Err: err}
+}
+
 // ForEachRow calls f for each row in the given iterator.
 // It returns as soon as f returns false.
 func ForEachRow[T any](iter *bq.RowIterator, f func(*T) bool) error {
@@ -267,6 +324,13 @@ func (c *Client) Query(ctx context.Context, q string) (*bq.RowIterator, error) {
 	return c.client.Query(q).Read(ctx)
 }
 
+// QueryWithParams is like Query, but sets the named parameters of q.
+func (c *Client) QueryWithParams(ctx context.Context, q string, params []bq.QueryParameter) (*bq.RowIterator, error) {
+	query := c.client.Query(q)
+	query.Parameters = params
+	return query.Read(ctx)
+}
+
 // NullFloat constructs a bq.NullFloat64
 func NullFloat(f float64) bq.NullFloat64 {
 	return bq.NullFloat64{Float64: f, Valid: true}
@@ -282,6 +346,11 @@ func NullInt(i int) bq.NullInt64 {
 	return bq.NullInt64{Int64: int64(i), Valid: true}
 }
 
+// NullBool constructs a bq.NullBool.
+func NullBool(b bool) bq.NullBool {
+	return bq.NullBool{Bool: b, Valid: true}
+}
+
 // NullTime constructs a bq.NullTime.
 func NullTime(t time.Time) bq.NullTime {
 	return bq.NullTime{Time: civil.TimeOf(t), Valid: true}
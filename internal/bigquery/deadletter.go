@@ -0,0 +1,183 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bigquery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/uuid"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/log"
+	"google.golang.org/api/iterator"
+)
+
+// deadLetterDir is the directory in the dead-letter bucket that holds
+// rows that could not be uploaded.
+const deadLetterDir = "failed-rows"
+
+// A DeadLetter saves rows that could not be uploaded to BigQuery as JSON
+// objects in GCS, so they can be uploaded later with Replay instead of
+// being lost. Each row is saved as failed-rows/TABLE/DATE/UUID.json.
+type DeadLetter struct {
+	store deadLetterStore
+}
+
+// deadLetterStore is the subset of GCS operations that DeadLetter uses.
+type deadLetterStore interface {
+	write(ctx context.Context, name string, data []byte) error
+	read(ctx context.Context, name string) ([]byte, error)
+	list(ctx context.Context, prefix string) ([]string, error)
+	delete(ctx context.Context, name string) error
+}
+
+// NewDeadLetter returns a DeadLetter that saves rows to bucket.
+func NewDeadLetter(bucket *storage.BucketHandle) *DeadLetter {
+	return &DeadLetter{store: &gcsStore{bucket}}
+}
+
+// Save saves rows, which could not be uploaded to the table, in GCS.
+// It returns the names of the objects it wrote.
+func (d *DeadLetter) Save(ctx context.Context, tableID string, rows []Row) (names []string, err error) {
+	defer derrors.Wrap(&err, "DeadLetter.Save(%q, %d rows)", tableID, len(rows))
+	dir := path.Join(deadLetterDir, tableID, time.Now().UTC().Format(time.DateOnly))
+	for _, row := range rows {
+		data, err := json.Marshal(row)
+		if err != nil {
+			return names, err
+		}
+		name := path.Join(dir, uuid.NewString()+".json")
+		if err := d.store.write(ctx, name, data); err != nil {
+			return names, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// ReplayStats describes the result of a Replay.
+type ReplayStats struct {
+	NumUploaded int      // rows uploaded and deleted from GCS
+	NumFailed   int      // rows that still could not be uploaded
+	Failed      []string // names of the objects of some of the failed rows
+}
+
+// maxReplayFailures is the maximum number of failed object names
+// that Replay reports.
+const maxReplayFailures = 20
+
+// Replay tries again to upload the saved rows to sink for the given table,
+// or for all tables if tableID is empty, deleting the objects of the rows
+// that are uploaded. The newRow function returns a pointer to a row
+// of the table's type, to decode a saved row into; it returns nil for
+// a table it doesn't know about, whose rows are left alone.
+func (d *DeadLetter) Replay(ctx context.Context, sink Sink, tableID string, newRow func(tableID string) Row) (_ *ReplayStats, err error) {
+	defer derrors.Wrap(&err, "DeadLetter.Replay(%q)", tableID)
+	upload := func(ctx context.Context, tableID string, row Row) error {
+		return sink.UploadRows(ctx, tableID, []Row{row})
+	}
+	return d.replay(ctx, upload, tableID, newRow)
+}
+
+func (d *DeadLetter) replay(ctx context.Context, upload func(context.Context, string, Row) error, tableID string, newRow func(string) Row) (*ReplayStats, error) {
+	prefix := deadLetterDir + "/"
+	if tableID != "" {
+		prefix += tableID + "/"
+	}
+	names, err := d.store.list(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	stats := &ReplayStats{}
+	for _, name := range names {
+		// name is failed-rows/TABLE/DATE/UUID.json.
+		table, _, _ := strings.Cut(strings.TrimPrefix(name, deadLetterDir+"/"), "/")
+		row := newRow(table)
+		if row == nil {
+			log.Warnf(ctx, "dead letter %s: unknown table %q", name, table)
+			continue
+		}
+		err := d.replayRow(ctx, upload, name, table, row)
+		if err != nil {
+			log.Errorf(ctx, err, "replaying dead letter %s", name)
+			stats.NumFailed++
+			if len(stats.Failed) < maxReplayFailures {
+				stats.Failed = append(stats.Failed, name)
+			}
+			continue
+		}
+		stats.NumUploaded++
+	}
+	return stats, nil
+}
+
+// replayRow uploads the row in the object with the given name to table,
+// decoding it into row, and deletes the object if the upload succeeds.
+func (d *DeadLetter) replayRow(ctx context.Context, upload func(context.Context, string, Row) error, name, table string, row Row) error {
+	data, err := d.store.read(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, row); err != nil {
+		return err
+	}
+	if err := upload(ctx, table, row); err != nil {
+		return err
+	}
+	return d.store.delete(ctx, name)
+}
+
+// gcsStore implements deadLetterStore with a GCS bucket.
+type gcsStore struct {
+	bucket *storage.BucketHandle
+}
+
+func (s *gcsStore) write(ctx context.Context, name string, data []byte) error {
+	w := s.bucket.Object(name).NewWriter(ctx)
+	w.ContentType = "application/json"
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (s *gcsStore) read(ctx context.Context, name string) ([]byte, error) {
+	r, err := s.bucket.Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func (s *gcsStore) list(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	it := s.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, attrs.Name)
+	}
+}
+
+func (s *gcsStore) delete(ctx context.Context, name string) error {
+	err := s.bucket.Object(name).Delete(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil
+	}
+	return err
+}
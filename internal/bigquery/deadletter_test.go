@@ -0,0 +1,134 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bigquery
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// memStore is an in-memory deadLetterStore.
+type memStore map[string][]byte
+
+func (m memStore) write(_ context.Context, name string, data []byte) error {
+	m[name] = data
+	return nil
+}
+
+func (m memStore) read(_ context.Context, name string) ([]byte, error) {
+	data, ok := m[name]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return data, nil
+}
+
+func (m memStore) list(_ context.Context, prefix string) ([]string, error) {
+	var names []string
+	for n := range m {
+		if strings.HasPrefix(n, prefix) {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m memStore) delete(_ context.Context, name string) error {
+	delete(m, name)
+	return nil
+}
+
+type deadRow struct {
+	N        int
+	Uploaded time.Time
+}
+
+func (r *deadRow) SetUploadTime(t time.Time) { r.Uploaded = t }
+
+func TestDeadLetter(t *testing.T) {
+	ctx := context.Background()
+	store := memStore{}
+	d := &DeadLetter{store: store}
+
+	names, err := d.Save(ctx, "t1", []Row{&deadRow{N: 1}, &deadRow{N: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Save(ctx, "t2", []Row{&deadRow{N: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Save(ctx, "unknown", []Row{&deadRow{N: 4}}); err != nil {
+		t.Fatal(err)
+	}
+	nameRE := regexp.MustCompile(`^failed-rows/t1/\d{4}-\d\d-\d\d/[-0-9a-f]{36}\.json$`)
+	for _, n := range names {
+		if !nameRE.MatchString(n) {
+			t.Errorf("bad object name %q", n)
+		}
+	}
+	if len(store) != 4 {
+		t.Fatalf("got %d objects, want 4", len(store))
+	}
+
+	newRow := func(table string) Row {
+		if table == "unknown" {
+			return nil
+		}
+		return &deadRow{}
+	}
+	// Uploads of row 2 fail.
+	var uploaded []int
+	upload := func(_ context.Context, table string, row Row) error {
+		r := row.(*deadRow)
+		if r.N == 2 {
+			return errors.New("upload failed")
+		}
+		uploaded = append(uploaded, r.N)
+		return nil
+	}
+
+	// Replay only one table.
+	stats, err := d.replay(ctx, upload, "t2", newRow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&ReplayStats{NumUploaded: 1}); !cmp.Equal(stats, want) {
+		t.Errorf("t2: got %+v, want %+v", stats, want)
+	}
+
+	// Replay all tables.
+	stats, err = d.replay(ctx, upload, "", newRow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NumUploaded != 1 || stats.NumFailed != 1 || len(stats.Failed) != 1 {
+		t.Errorf("all: got %+v, want 1 uploaded and 1 failed", stats)
+	}
+	sort.Ints(uploaded)
+	if diff := cmp.Diff([]int{1, 3}, uploaded); diff != "" {
+		t.Errorf("uploaded mismatch (-want, +got):\n%s", diff)
+	}
+	// The failed row and the row of the unknown table remain.
+	var got []string
+	for n := range store {
+		table, _, _ := strings.Cut(strings.TrimPrefix(n, deadLetterDir+"/"), "/")
+		got = append(got, table)
+	}
+	sort.Strings(got)
+	if diff := cmp.Diff([]string{"t1", "unknown"}, got); diff != "" {
+		t.Errorf("remaining mismatch (-want, +got):\n%s", diff)
+	}
+	if stats.Failed[0] != names[0] && stats.Failed[0] != names[1] {
+		t.Errorf("failed object %q is not one of %v", stats.Failed[0], names)
+	}
+}
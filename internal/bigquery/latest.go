@@ -0,0 +1,102 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bigquery
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	bq "cloud.google.com/go/bigquery"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+)
+
+// Filters select the rows that ReadLatestPerModule considers.
+// Empty fields select all rows. Each non-empty field names a column
+// that the table must have.
+type Filters struct {
+	ModulePath    string // value of the module_path column
+	Version       string // value of the version column
+	ScanMode      string // value of the scan_mode column
+	JobID         string // value of the job_id column
+	ErrorCategory string // value of the error_category column
+}
+
+// latestQuery returns a query for the most recent row, by created_at,
+// of each module version in the table that matches f, and the query's
+// parameters.
+func latestQuery(c *Client, tableID string, f Filters) (string, []bq.QueryParameter, error) {
+	schema := TableSchema(tableID)
+	if schema == nil {
+		return "", nil, fmt.Errorf("no schema registered for table %q", tableID)
+	}
+	var (
+		conds  []string
+		params []bq.QueryParameter
+	)
+	for _, cv := range []struct{ col, val string }{
+		{"module_path", f.ModulePath},
+		{"version", f.Version},
+		{"scan_mode", f.ScanMode},
+		{"job_id", f.JobID},
+		{"error_category", f.ErrorCategory},
+	} {
+		if cv.val == "" {
+			continue
+		}
+		if !hasColumn(schema, cv.col) {
+			return "", nil, fmt.Errorf("%w: table %q has no column %q", derrors.InvalidArgument, tableID, cv.col)
+		}
+		conds = append(conds, fmt.Sprintf("%s = @%s", cv.col, cv.col))
+		params = append(params, bq.QueryParameter{Name: cv.col, Value: cv.val})
+	}
+	q := PartitionQuery{
+		From:        "`" + c.FullTableName(tableID) + "`",
+		PartitionOn: "module_path, version",
+		OrderBy:     "created_at DESC",
+		Where:       strings.Join(conds, " AND "),
+	}
+	return q.String(), params, nil
+}
+
+func hasColumn(schema bq.Schema, name string) bool {
+	for _, f := range schema {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ForEachLatestPerModule calls fn on the most recent row of each module
+// version in the table that matches f, decoded into a T, which should be
+// the table's row type. It streams the rows, so it can be used for large
+// result sets. It returns as soon as fn returns false.
+func ForEachLatestPerModule[T any](ctx context.Context, c *Client, tableID string, f Filters, fn func(*T) bool) (err error) {
+	defer derrors.Wrap(&err, "ForEachLatestPerModule(%q, %+v)", tableID, f)
+	q, params, err := latestQuery(c, tableID, f)
+	if err != nil {
+		return err
+	}
+	iter, err := c.QueryWithParams(ctx, q, params)
+	if err != nil {
+		return err
+	}
+	return ForEachRow(iter, fn)
+}
+
+// ReadLatestPerModule returns the most recent row of each module version
+// in the table that matches f. See ForEachLatestPerModule.
+func ReadLatestPerModule[T any](ctx context.Context, c *Client, tableID string, f Filters) ([]*T, error) {
+	var rows []*T
+	err := ForEachLatestPerModule(ctx, c, tableID, f, func(r *T) bool {
+		rows = append(rows, r)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
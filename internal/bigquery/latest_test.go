@@ -0,0 +1,75 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bigquery
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	bq "cloud.google.com/go/bigquery"
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+)
+
+func TestLatestQuery(t *testing.T) {
+	AddTable("test_latest", bq.Schema{
+		{Name: "created_at", Type: bq.TimestampFieldType},
+		{Name: "module_path", Type: bq.StringFieldType},
+		{Name: "version", Type: bq.StringFieldType},
+		{Name: "scan_mode", Type: bq.StringFieldType},
+		{Name: "error_category", Type: bq.StringFieldType},
+	})
+	c := &Client{dataset: &bq.Dataset{ProjectID: "p", DatasetID: "d"}}
+	clean := func(s string) string {
+		return strings.Join(strings.Fields(s), " ")
+	}
+
+	q, params, err := latestQuery(c, "test_latest", Filters{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "SELECT * EXCEPT (rownum) FROM ( SELECT *, ROW_NUMBER() OVER ( PARTITION BY module_path, version ORDER BY created_at DESC ) AS rownum FROM `p.d.test_latest` ) WHERE rownum = 1"
+	if got := clean(q); got != want {
+		t.Errorf("no filters:\ngot  %s\nwant %s", got, want)
+	}
+	if len(params) != 0 {
+		t.Errorf("no filters: got params %v", params)
+	}
+
+	q, params, err = latestQuery(c, "test_latest", Filters{ScanMode: "BINARY", ErrorCategory: "MISC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := clean(q), "FROM `p.d.test_latest` WHERE scan_mode = @scan_mode AND error_category = @error_category )"; !strings.Contains(got, want) {
+		t.Errorf("filters:\ngot  %s\nwant it to contain %s", got, want)
+	}
+	wantParams := []bq.QueryParameter{
+		{Name: "scan_mode", Value: "BINARY"},
+		{Name: "error_category", Value: "MISC"},
+	}
+	if diff := cmp.Diff(wantParams, params); diff != "" {
+		t.Errorf("params mismatch (-want, +got):\n%s", diff)
+	}
+
+	q, params, err = latestQuery(c, "test_latest", Filters{ModulePath: "example.com/m", Version: "v1.0.0", ScanMode: "BINARY"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := clean(q), "WHERE module_path = @module_path AND version = @version AND scan_mode = @scan_mode )"; !strings.Contains(got, want) {
+		t.Errorf("module filters:\ngot  %s\nwant it to contain %s", got, want)
+	}
+	if len(params) != 3 {
+		t.Errorf("module filters: got params %v, want 3", params)
+	}
+
+	// The table has no job_id column.
+	if _, _, err := latestQuery(c, "test_latest", Filters{JobID: "j"}); !errors.Is(err, derrors.InvalidArgument) {
+		t.Errorf("job ID: got %v, want InvalidArgument", err)
+	}
+	if _, _, err := latestQuery(c, "test_none", Filters{}); err == nil {
+		t.Error("unknown table: got nil, want error")
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bigquery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	bq "cloud.google.com/go/bigquery"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/log"
+)
+
+// A TableLayout describes how BigQuery stores the rows of a table,
+// so that queries that filter on those columns read less data.
+type TableLayout struct {
+	// PartitionField is the top-level TIMESTAMP column on which the
+	// table is partitioned by day. If empty, the table is not partitioned.
+	PartitionField string
+	// ClusterFields are the top-level columns on which the table is
+	// clustered, most significant first. There can be at most four.
+	ClusterFields []string
+}
+
+var layouts = map[string]TableLayout{} // guarded by tableMu
+
+// SetTableLayout records the layout of a table, which must have been
+// added with AddTable. It panics if the layout names columns that
+// are not in the table's schema.
+func SetTableLayout(tableID string, l TableLayout) {
+	tableMu.Lock()
+	defer tableMu.Unlock()
+	schema := tables[tableID]
+	if schema == nil {
+		panic(fmt.Sprintf("SetTableLayout(%q): no schema", tableID))
+	}
+	if l.PartitionField != "" && !hasColumn(schema, l.PartitionField) {
+		panic(fmt.Sprintf("SetTableLayout(%q): no column %q", tableID, l.PartitionField))
+	}
+	if len(l.ClusterFields) > 4 {
+		panic(fmt.Sprintf("SetTableLayout(%q): more than four cluster fields", tableID))
+	}
+	for _, f := range l.ClusterFields {
+		if !hasColumn(schema, f) {
+			panic(fmt.Sprintf("SetTableLayout(%q): no column %q", tableID, f))
+		}
+	}
+	layouts[tableID] = l
+}
+
+// TableMetadata returns the metadata with which CreateOrUpdateTable
+// creates the given table: its schema and layout. It returns nil if no
+// schema has been added for the table.
+func TableMetadata(tableID string) *bq.TableMetadata {
+	tableMu.Lock()
+	defer tableMu.Unlock()
+	schema := tables[tableID]
+	if schema == nil {
+		return nil
+	}
+	meta := &bq.TableMetadata{Schema: schema}
+	l := layouts[tableID]
+	if l.PartitionField != "" {
+		meta.TimePartitioning = &bq.TimePartitioning{
+			Type:  bq.DayPartitioningType,
+			Field: l.PartitionField,
+		}
+	}
+	if len(l.ClusterFields) > 0 {
+		meta.Clustering = &bq.Clustering{Fields: l.ClusterFields}
+	}
+	return meta
+}
+
+// ErrNotPartitioned is returned by CreateOrUpdateTable for an existing
+// table that should be partitioned but isn't. BigQuery cannot partition
+// an existing table; use MigrateToPartitioned (via cmd/bqmigrate) to
+// copy it into a partitioned one.
+var ErrNotPartitioned = errors.New("table is not partitioned")
+
+// MigrateToPartitioned replaces the unpartitioned table with a copy
+// that is partitioned and clustered according to its layout. The old
+// table is kept, renamed to TABLE_unpartitioned_YYYYMMDD.
+//
+// Nothing may write to the table during the migration: rows inserted
+// while it is being copied would be left in the old table. The table
+// cannot be renamed while it has rows in its streaming buffer, so
+// MigrateToPartitioned fails if there are any; it can be retried after
+// BigQuery has flushed them, which may take up to 90 minutes.
+//
+// The copy is made in TABLE_partitioned. If the migration fails, calling
+// MigrateToPartitioned again resumes it from the step that failed.
+func (c *Client) MigrateToPartitioned(ctx context.Context, tableID string) (err error) {
+	defer derrors.Wrap(&err, "MigrateToPartitioned(%q)", tableID)
+	meta := TableMetadata(tableID)
+	if meta == nil {
+		return fmt.Errorf("no schema registered for table %q", tableID)
+	}
+	if meta.TimePartitioning == nil {
+		return fmt.Errorf("no partitioning for table %q", tableID)
+	}
+	newID := tableID + "_partitioned"
+	old, err := c.tableMetadata(ctx, tableID)
+	if err != nil {
+		return err
+	}
+	cp, err := c.tableMetadata(ctx, newID)
+	if err != nil {
+		return err
+	}
+	steps, err := migrationSteps(tableID, old, cp)
+	if err != nil {
+		return err
+	}
+	if len(steps) == 0 {
+		log.Infof(ctx, "MigrateToPartitioned: table %s is already partitioned", tableID)
+		return nil
+	}
+	var cols []string
+	if old != nil {
+		cols = copyColumns(old.Schema, meta.Schema)
+	}
+	now := time.Now()
+	for _, step := range steps {
+		if step == createStep {
+			log.Infof(ctx, "MigrateToPartitioned: creating %s", newID)
+			if err := c.Table(newID).Create(ctx, meta); err != nil {
+				return err
+			}
+			continue
+		}
+		q := migrationQuery(c, step, tableID, newID, cols, now)
+		log.Infof(ctx, "MigrateToPartitioned: %s", q)
+		if err := c.exec(ctx, q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tableMetadata returns the metadata of the table, or nil if it
+// does not exist.
+func (c *Client) tableMetadata(ctx context.Context, tableID string) (*bq.TableMetadata, error) {
+	meta, err := c.Table(tableID).Metadata(ctx)
+	if isNotFoundError(err) {
+		return nil, nil
+	}
+	return meta, err
+}
+
+// A migrationStep is a step of MigrateToPartitioned.
+type migrationStep int
+
+const (
+	createStep    migrationStep = iota // create the partitioned copy
+	copyStep                           // copy the rows to it
+	renameOldStep                      // rename the old table out of the way
+	renameNewStep                      // rename the copy to the table's name
+)
+
+// migrationSteps returns the steps that remain to migrate the table,
+// given the metadata of the table and of its partitioned copy, each nil
+// if the table does not exist. The copy is a single statement, so the
+// copy has all the rows if it has any.
+func migrationSteps(tableID string, old, cp *bq.TableMetadata) ([]migrationStep, error) {
+	switch {
+	case old == nil && cp == nil:
+		return nil, fmt.Errorf("table %q does not exist", tableID)
+	case old == nil:
+		// The old table was renamed, but the copy was not.
+		return []migrationStep{renameNewStep}, nil
+	case old.TimePartitioning != nil:
+		if cp != nil {
+			return nil, fmt.Errorf("table %q is partitioned, but %s_partitioned also exists", tableID, tableID)
+		}
+		return nil, nil
+	case old.StreamingBuffer != nil:
+		return nil, fmt.Errorf("table %q has rows in its streaming buffer; stop writing to it and retry when they have been flushed", tableID)
+	}
+	var steps []migrationStep
+	if cp == nil {
+		steps = append(steps, createStep, copyStep)
+	} else if cp.NumRows == 0 {
+		steps = append(steps, copyStep)
+	}
+	return append(steps, renameOldStep, renameNewStep), nil
+}
+
+// copyColumns returns the names of the top-level columns of the from
+// schema that are also in the to schema.
+func copyColumns(from, to bq.Schema) []string {
+	inTo := map[string]bool{}
+	for _, f := range to {
+		inTo[f.Name] = true
+	}
+	var cols []string
+	for _, f := range from {
+		if inTo[f.Name] {
+			cols = append(cols, f.Name)
+		}
+	}
+	return cols
+}
+
+// migrationQuery returns the statement for step, other than createStep,
+// of the migration of the table to the partitioned table newID. The copy
+// step copies the columns cols.
+func migrationQuery(c *Client, step migrationStep, tableID, newID string, cols []string, now time.Time) string {
+	switch step {
+	case copyStep:
+		colList := strings.Join(cols, ", ")
+		return fmt.Sprintf("INSERT INTO `%s` (%s) SELECT %s FROM `%s`",
+			c.FullTableName(newID), colList, colList, c.FullTableName(tableID))
+	case renameOldStep:
+		return fmt.Sprintf("ALTER TABLE `%s` RENAME TO %s_unpartitioned_%s",
+			c.FullTableName(tableID), tableID, now.Format("20060102"))
+	case renameNewStep:
+		return fmt.Sprintf("ALTER TABLE `%s` RENAME TO %s", c.FullTableName(newID), tableID)
+	default:
+		panic(fmt.Sprintf("bad migration step %d", step))
+	}
+}
+
+// exec runs the query q and waits for it to finish.
+func (c *Client) exec(ctx context.Context, q string) error {
+	job, err := c.client.Query(q).Run(ctx)
+	if err != nil {
+		return err
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
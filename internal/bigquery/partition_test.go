@@ -0,0 +1,116 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bigquery
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	bq "cloud.google.com/go/bigquery"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTableMetadata(t *testing.T) {
+	schema := bq.Schema{
+		{Name: "created_at", Type: bq.TimestampFieldType},
+		{Name: "module_path", Type: bq.StringFieldType},
+		{Name: "n", Type: bq.IntegerFieldType},
+	}
+	AddTable("test_plain", schema)
+	AddTable("test_partitioned", schema)
+	SetTableLayout("test_partitioned", TableLayout{
+		PartitionField: "created_at",
+		ClusterFields:  []string{"module_path"},
+	})
+
+	if got := TableMetadata("test_none"); got != nil {
+		t.Errorf("no schema: got %+v, want nil", got)
+	}
+	if diff := cmp.Diff(&bq.TableMetadata{Schema: schema}, TableMetadata("test_plain")); diff != "" {
+		t.Errorf("plain: mismatch (-want, +got):\n%s", diff)
+	}
+	want := &bq.TableMetadata{
+		Schema: schema,
+		TimePartitioning: &bq.TimePartitioning{
+			Type:  bq.DayPartitioningType,
+			Field: "created_at",
+		},
+		Clustering: &bq.Clustering{Fields: []string{"module_path"}},
+	}
+	if diff := cmp.Diff(want, TableMetadata("test_partitioned")); diff != "" {
+		t.Errorf("partitioned: mismatch (-want, +got):\n%s", diff)
+	}
+
+	for _, l := range []TableLayout{
+		{PartitionField: "nope"},
+		{ClusterFields: []string{"n", "nope"}},
+		{ClusterFields: []string{"n", "n", "n", "n", "n"}},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%+v: no panic", l)
+				}
+			}()
+			SetTableLayout("test_plain", l)
+		}()
+	}
+}
+
+func TestMigrationQueries(t *testing.T) {
+	c := &Client{dataset: &bq.Dataset{ProjectID: "p", DatasetID: "d"}}
+	from := bq.Schema{{Name: "a"}, {Name: "removed"}, {Name: "b"}}
+	to := bq.Schema{{Name: "b"}, {Name: "a"}, {Name: "added"}}
+	cols := copyColumns(from, to)
+	now := time.Date(2023, 4, 5, 0, 0, 0, 0, time.UTC)
+	var got []string
+	for _, step := range []migrationStep{copyStep, renameOldStep, renameNewStep} {
+		got = append(got, migrationQuery(c, step, "t", "t_partitioned", cols, now))
+	}
+	want := []string{
+		"INSERT INTO `p.d.t_partitioned` (a, b) SELECT a, b FROM `p.d.t`",
+		"ALTER TABLE `p.d.t` RENAME TO t_unpartitioned_20230405",
+		"ALTER TABLE `p.d.t_partitioned` RENAME TO t",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestMigrationSteps(t *testing.T) {
+	var (
+		partitioned   = &bq.TableMetadata{TimePartitioning: &bq.TimePartitioning{Field: "created_at"}}
+		unpartitioned = &bq.TableMetadata{NumRows: 10}
+		streaming     = &bq.TableMetadata{StreamingBuffer: &bq.StreamingBuffer{EstimatedRows: 1}}
+		emptyCopy     = &bq.TableMetadata{TimePartitioning: partitioned.TimePartitioning}
+		fullCopy      = &bq.TableMetadata{TimePartitioning: partitioned.TimePartitioning, NumRows: 10}
+	)
+	for _, test := range []struct {
+		name    string
+		old, cp *bq.TableMetadata
+		want    []migrationStep // nil for done
+		wantErr bool
+	}{
+		{"start", unpartitioned, nil, []migrationStep{createStep, copyStep, renameOldStep, renameNewStep}, false},
+		{"created", unpartitioned, emptyCopy, []migrationStep{copyStep, renameOldStep, renameNewStep}, false},
+		{"copied", unpartitioned, fullCopy, []migrationStep{renameOldStep, renameNewStep}, false},
+		{"renamed old", nil, fullCopy, []migrationStep{renameNewStep}, false},
+		{"done", partitioned, nil, nil, false},
+		{"streaming", streaming, nil, nil, true},
+		{"missing", nil, nil, nil, true},
+		{"both partitioned", partitioned, fullCopy, nil, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := migrationSteps("t", test.old, test.cp)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error: %t", err, test.wantErr)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
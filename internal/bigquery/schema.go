@@ -0,0 +1,171 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bigquery
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	bq "cloud.google.com/go/bigquery"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+)
+
+// A SchemaDiff describes how the schema of a table differs from the
+// schema inferred from the Go struct for its rows. Nested fields are
+// named by their dotted paths, like "vulns.id".
+type SchemaDiff struct {
+	Added   []string // in the struct but not the table; uploads fail
+	Removed []string // in the table but not the struct
+	Retyped []string // with a different type or repetition
+}
+
+// Empty reports whether d describes no differences.
+func (d *SchemaDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Retyped) == 0
+}
+
+func (d *SchemaDiff) String() string {
+	var parts []string
+	add := func(what string, names []string) {
+		if len(names) > 0 {
+			parts = append(parts, fmt.Sprintf("%s: %s", what, strings.Join(names, ", ")))
+		}
+	}
+	add("added", d.Added)
+	add("removed", d.Removed)
+	add("retyped", d.Retyped)
+	if len(parts) == 0 {
+		return "no differences"
+	}
+	return strings.Join(parts, "; ")
+}
+
+// CheckSchema compares the schema of the table with the one inferred
+// from row, a struct or struct pointer, and returns the differences.
+func (c *Client) CheckSchema(ctx context.Context, tableID string, row any) (_ *SchemaDiff, err error) {
+	defer derrors.Wrap(&err, "CheckSchema(%q)", tableID)
+	want, err := bq.InferSchema(row)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := c.Table(tableID).Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d := &SchemaDiff{}
+	diffSchemas(d, "", want, meta.Schema)
+	return d, nil
+}
+
+// diffSchemas adds to d the differences between the struct schema want
+// and the table schema got, prefixing field names with prefix.
+func diffSchemas(d *SchemaDiff, prefix string, want, got bq.Schema) {
+	gotFields := map[string]*bq.FieldSchema{}
+	for _, f := range got {
+		gotFields[f.Name] = f
+	}
+	wantFields := map[string]bool{}
+	for _, w := range want {
+		wantFields[w.Name] = true
+		name := prefix + w.Name
+		g, ok := gotFields[w.Name]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, name)
+		case w.Type != g.Type || w.Repeated != g.Repeated:
+			d.Retyped = append(d.Retyped, name)
+		case w.Type == bq.RecordFieldType:
+			diffSchemas(d, name+".", w.Schema, g.Schema)
+		}
+	}
+	for _, g := range got {
+		if !wantFields[g.Name] {
+			d.Removed = append(d.Removed, prefix+g.Name)
+		}
+	}
+}
+
+// UpdateSchema adds the columns of the schema inferred from row, a struct
+// or struct pointer, that the table lacks. BigQuery only allows nullable
+// columns to be added to an existing table, so the new columns are nullable
+// even if the struct would make them required. It does not remove or change
+// columns. It returns the names of the added columns.
+func (c *Client) UpdateSchema(ctx context.Context, tableID string, row any) (added []string, err error) {
+	defer derrors.Wrap(&err, "UpdateSchema(%q)", tableID)
+	want, err := bq.InferSchema(row)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := c.Table(tableID).Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.addColumns(ctx, tableID, meta, want)
+}
+
+// addColumns adds the columns of want that the table, whose current
+// metadata is meta, lacks.
+func (c *Client) addColumns(ctx context.Context, tableID string, meta *bq.TableMetadata, want bq.Schema) ([]string, error) {
+	merged, added := addMissingFields("", meta.Schema, want)
+	if len(added) == 0 {
+		return nil, nil
+	}
+	_, err := c.Table(tableID).Update(ctx, bq.TableMetadataToUpdate{Schema: merged}, meta.ETag)
+	// There is a race condition if multiple threads of control call this function concurrently:
+	// The table may have changed since its metadata was read. This error is harmless: it
+	// just means that someone else updated the table before us. Ignore it.
+	if isAlreadyExistsError(err) || isRaceChangeError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return added, nil
+}
+
+// addMissingFields returns a copy of got with the fields of want that it
+// lacks added as nullable fields, and the names of those fields.
+func addMissingFields(prefix string, got, want bq.Schema) (bq.Schema, []string) {
+	var added []string
+	merged := make(bq.Schema, 0, len(got))
+	gotFields := map[string]bool{}
+	wantFields := map[string]*bq.FieldSchema{}
+	for _, w := range want {
+		wantFields[w.Name] = w
+	}
+	for _, g := range got {
+		gotFields[g.Name] = true
+		w := wantFields[g.Name]
+		if w != nil && g.Type == bq.RecordFieldType && w.Type == bq.RecordFieldType {
+			f := *g
+			var a []string
+			f.Schema, a = addMissingFields(prefix+g.Name+".", g.Schema, w.Schema)
+			added = append(added, a...)
+			g = &f
+		}
+		merged = append(merged, g)
+	}
+	for _, w := range want {
+		if !gotFields[w.Name] {
+			merged = append(merged, nullable(w))
+			added = append(added, prefix+w.Name)
+		}
+	}
+	return merged, added
+}
+
+// nullable returns a copy of f, and of its nested fields, that is not required.
+func nullable(f *bq.FieldSchema) *bq.FieldSchema {
+	f2 := *f
+	f2.Required = false
+	if f.Schema != nil {
+		f2.Schema = make(bq.Schema, len(f.Schema))
+		for i, g := range f.Schema {
+			f2.Schema[i] = nullable(g)
+		}
+	}
+	return &f2
+}
@@ -0,0 +1,89 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bigquery
+
+import (
+	"testing"
+
+	bq "cloud.google.com/go/bigquery"
+	"github.com/google/go-cmp/cmp"
+)
+
+type oldRow struct {
+	Path    string `bigquery:"path"`
+	Count   int    `bigquery:"count"`
+	Dropped string `bigquery:"dropped"`
+	Items   []struct {
+		ID string `bigquery:"id"`
+	} `bigquery:"items"`
+}
+
+type newRow struct {
+	Path  string  `bigquery:"path"`
+	Count float64 `bigquery:"count"`
+	Added string  `bigquery:"added"`
+	Items []struct {
+		ID   string `bigquery:"id"`
+		Note string `bigquery:"note"`
+	} `bigquery:"items"`
+}
+
+func inferSchema(t *testing.T, row any) bq.Schema {
+	t.Helper()
+	s, err := bq.InferSchema(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestDiffSchemas(t *testing.T) {
+	d := &SchemaDiff{}
+	diffSchemas(d, "", inferSchema(t, newRow{}), inferSchema(t, oldRow{}))
+	want := &SchemaDiff{
+		Added:   []string{"added", "items.note"},
+		Removed: []string{"dropped"},
+		Retyped: []string{"count"},
+	}
+	if diff := cmp.Diff(want, d); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+	if got, want := d.String(), "added: added, items.note; removed: dropped; retyped: count"; got != want {
+		t.Errorf("String: got %q, want %q", got, want)
+	}
+
+	d = &SchemaDiff{}
+	diffSchemas(d, "", inferSchema(t, oldRow{}), inferSchema(t, oldRow{}))
+	if !d.Empty() {
+		t.Errorf("same schema: got %s", d)
+	}
+}
+
+func TestAddMissingFields(t *testing.T) {
+	got, added := addMissingFields("", inferSchema(t, oldRow{}), inferSchema(t, newRow{}))
+	if diff := cmp.Diff([]string{"items.note", "added"}, added); diff != "" {
+		t.Errorf("added mismatch (-want, +got):\n%s", diff)
+	}
+	// Existing columns are unchanged, even if the struct's differ, and
+	// new columns are nullable.
+	want := bq.Schema{
+		{Name: "path", Type: bq.StringFieldType, Required: true},
+		{Name: "count", Type: bq.IntegerFieldType, Required: true},
+		{Name: "dropped", Type: bq.StringFieldType, Required: true},
+		{Name: "items", Type: bq.RecordFieldType, Repeated: true, Schema: bq.Schema{
+			{Name: "id", Type: bq.StringFieldType, Required: true},
+			{Name: "note", Type: bq.StringFieldType},
+		}},
+		{Name: "added", Type: bq.StringFieldType},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("schema mismatch (-want, +got):\n%s", diff)
+	}
+
+	// Nothing is missing.
+	if _, added := addMissingFields("", inferSchema(t, newRow{}), inferSchema(t, newRow{})); len(added) != 0 {
+		t.Errorf("same schema: got %v added", added)
+	}
+}
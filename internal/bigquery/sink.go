@@ -0,0 +1,126 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bigquery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+)
+
+// A Sink stores rows for tables. A Client is a Sink that uploads them
+// to BigQuery.
+type Sink interface {
+	// UploadRows stores rows in the table with the given ID,
+	// setting their upload time. If it fails after storing some of
+	// the rows, the error is a *PartialUploadError. After any other
+	// error, none of the rows were stored.
+	UploadRows(ctx context.Context, tableID string, rows []Row) error
+}
+
+// maxUploadChunk is the number of rows that UploadRows sends in each
+// request. BigQuery recommends at most 500.
+const maxUploadChunk = 500
+
+// UploadRows uploads rows to the table.
+func (c *Client) UploadRows(ctx context.Context, tableID string, rows []Row) error {
+	return UploadMany(ctx, c, tableID, rows, maxUploadChunk)
+}
+
+// NewSink returns the Sink described by spec. If spec is of the form
+// "file:DIR", it returns a FileSink writing to DIR. Otherwise it returns
+// client, which may be nil.
+func NewSink(spec string, client *Client) (Sink, error) {
+	if dir, ok := strings.CutPrefix(spec, "file:"); ok {
+		if dir == "" {
+			return nil, fmt.Errorf("%q: missing directory", spec)
+		}
+		return NewFileSink(dir)
+	}
+	if spec != "" && spec != "bigquery" {
+		return nil, fmt.Errorf(`bad sink %q: want "bigquery" or "file:DIR"`, spec)
+	}
+	if client == nil {
+		return nil, nil
+	}
+	return client, nil
+}
+
+// A FileSink stores rows as JSON lines in local files, one per table,
+// for running without BigQuery.
+type FileSink struct {
+	dir string
+
+	mu sync.Mutex // serializes writes
+}
+
+// NewFileSink returns a FileSink that appends the rows for each table
+// to the file TABLE.jsonl in dir, creating dir if necessary.
+func NewFileSink(dir string) (*FileSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileSink{dir: dir}, nil
+}
+
+// UploadRows appends rows to the file for the table.
+func (s *FileSink) UploadRows(ctx context.Context, tableID string, rows []Row) (err error) {
+	defer derrors.Wrap(&err, "FileSink.UploadRows(%q, %d rows)", tableID, len(rows))
+	var data []byte
+	now := time.Now()
+	for _, r := range rows {
+		r.SetUploadTime(now)
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		data = append(data, line...)
+		data = append(data, '\n')
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(filepath.Join(s.dir, tableID+".jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer derrors.Cleanup(&err, f.Close)
+	_, err = f.Write(data)
+	return err
+}
+
+// A MemorySink keeps rows in memory, so tests can check them.
+type MemorySink struct {
+	mu   sync.Mutex
+	rows map[string][]Row // by table ID
+}
+
+// UploadRows records rows for the table.
+func (s *MemorySink) UploadRows(ctx context.Context, tableID string, rows []Row) error {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rows == nil {
+		s.rows = map[string][]Row{}
+	}
+	for _, r := range rows {
+		r.SetUploadTime(now)
+		s.rows[tableID] = append(s.rows[tableID], r)
+	}
+	return nil
+}
+
+// Rows returns the rows stored for the table, in the order they were stored.
+func (s *MemorySink) Rows(tableID string) []Row {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Row(nil), s.rows[tableID]...)
+}
@@ -0,0 +1,90 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bigquery
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewSink(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "rows")
+	s, err := NewSink("file:"+dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs, ok := s.(*FileSink); !ok || fs.dir != dir {
+		t.Errorf("got %#v, want FileSink for %s", s, dir)
+	}
+	c := &Client{}
+	for _, spec := range []string{"", "bigquery"} {
+		s, err := NewSink(spec, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != c {
+			t.Errorf("%q: got %#v, want the client", spec, s)
+		}
+		// No client means no sink, not a nil *Client.
+		s, err = NewSink(spec, nil)
+		if err != nil || s != nil {
+			t.Errorf("%q, nil client: got (%#v, %v), want (nil, nil)", spec, s, err)
+		}
+	}
+	for _, spec := range []string{"file:", "s3:bucket"} {
+		if _, err := NewSink(spec, c); err == nil {
+			t.Errorf("%q: got nil, want error", spec)
+		}
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := NewFileSink(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UploadRows(ctx, "t", []Row{&deadRow{N: 1}, &deadRow{N: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UploadRows(ctx, "t", []Row{&deadRow{N: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "t.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want 3:\n%s", len(lines), data)
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, `{"N":`+string(rune('1'+i))+`,"Uploaded":"`) {
+			t.Errorf("line %d: got %s", i, line)
+		}
+	}
+}
+
+func TestMemorySink(t *testing.T) {
+	var s MemorySink
+	r := &deadRow{N: 1}
+	if err := s.UploadRows(context.Background(), "t", []Row{r}); err != nil {
+		t.Fatal(err)
+	}
+	got := s.Rows("t")
+	if len(got) != 1 || got[0] != r {
+		t.Errorf("got %v, want [%v]", got, r)
+	}
+	if r.Uploaded.IsZero() {
+		t.Error("upload time not set")
+	}
+	if len(s.Rows("other")) != 0 {
+		t.Error("other table has rows")
+	}
+}
@@ -9,14 +9,16 @@ package config
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"os"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/safehtml/template"
 	"golang.org/x/net/context/ctxhttp"
@@ -55,9 +57,26 @@ type Config struct {
 	// BigQueryDataset is the BigQuery dataset to write results to.
 	BigQueryDataset string
 
+	// BigQuerySink is where the worker writes result rows: "bigquery"
+	// (the default) for BigQueryDataset, or "file:DIR" for JSON lines
+	// files in the local directory DIR, one per table.
+	BigQuerySink string
+
+	// QueueKind is the kind of task queue: "cloudtasks" or "pubsub".
+	QueueKind string
+
 	// QueueName is the name of the Cloud Tasks queue.
 	QueueName string
 
+	// PubSubTopic is the name of the Pub/Sub topic that a "pubsub" queue
+	// publishes tasks to.
+	PubSubTopic string
+
+	// PubSubSubscription is the name of the Pub/Sub subscription that
+	// the worker pulls tasks from, when the queue is "pubsub". If empty,
+	// the worker only publishes tasks.
+	PubSubSubscription string
+
 	// QueueURL is the URL that the Cloud Tasks queue should send requests to.
 	// It should be used when the worker is not on AppEngine.
 	QueueURL string
@@ -66,6 +85,10 @@ type Config struct {
 	// when running locally.
 	LocalQueueWorkers int
 
+	// LocalQueue, if true, makes the worker use an in-memory queue whose
+	// tasks are dispatched to the worker's own handlers, even on Cloud Run.
+	LocalQueue bool
+
 	// MonitoredResource represents the resource that is running the current binary.
 	// It might be a Google AppEngine app, a Cloud Run service, or a Kubernetes pod.
 	// See https://cloud.google.com/monitoring/api/resources for more details:
@@ -84,6 +107,18 @@ type Config struct {
 	// BinaryBucket holds binaries for govulncheck scanning.
 	BinaryBucket string
 
+	// ResultsBucket holds results that are too large for a BigQuery row.
+	// If empty, such results are truncated without being saved.
+	ResultsBucket string
+
+	// DeadLetterBucket holds result rows that could not be uploaded to
+	// BigQuery, so they can be uploaded later. If empty, such rows are lost.
+	DeadLetterBucket string
+
+	// ZipCacheBucket holds module zips downloaded from the proxy, so they
+	// are downloaded only once. If empty, zips are not cached.
+	ZipCacheBucket string
+
 	// BinaryDir is the local directory for binaries.
 	BinaryDir string
 
@@ -106,6 +141,131 @@ type Config struct {
 
 	// ProxyURL is the url for the Go module proxy.
 	ProxyURL string
+
+	// ProxyAuthSecret is the name of the secret holding the credentials
+	// for the module proxy, as USER:PASSWORD. If it is set, requests to
+	// the proxy use HTTP basic authentication, and the go command
+	// downloads dependencies from ProxyURL instead of proxy.golang.org.
+	ProxyAuthSecret string
+
+	// GoPrivate, GoNoSumDB and GoFlags are the values of GOPRIVATE,
+	// GONOSUMDB and GOFLAGS for the go commands that download and load
+	// the packages of modules, in the sandbox and out. Module zips whose
+	// paths match GoPrivate or GoNoSumDB are not verified against
+	// ChecksumDB. If GoPrivate is set, the go command downloads
+	// dependencies from ProxyURL instead of proxy.golang.org.
+	GoPrivate string
+	GoNoSumDB string
+	GoFlags   string
+
+	// ChecksumDB is the checksum database that module zips downloaded
+	// from the proxy are verified against, in the form of GOSUMDB:
+	// a verifier key, optionally followed by a URL. If it is "off",
+	// zips are not verified.
+	ChecksumDB string
+
+	// ScanTimeout is the maximum time to spend scanning a single module.
+	ScanTimeout time.Duration
+
+	// AnalysisTimeout is the maximum time an analysis binary may run
+	// on a single module.
+	AnalysisTimeout time.Duration
+
+	// AnalysisMaxOutput is the maximum number of bytes an analysis binary
+	// may write on a single module.
+	AnalysisMaxOutput int
+
+	// ScanMemoryFraction is the fraction of the memory limit that a scan
+	// may use before it is stopped. If zero, memory is not monitored.
+	ScanMemoryFraction float64
+
+	// SandboxMemoryLimit is the number of bytes of memory that each
+	// command run in the sandbox may use. If zero, the default, there is
+	// no limit.
+	SandboxMemoryLimit int64
+
+	// SandboxCPUQuota is the number of CPUs that each command run in the
+	// sandbox may use. If zero, the default, there is no limit.
+	SandboxCPUQuota float64
+
+	// SandboxPidsLimit is the number of processes and threads that each
+	// command run in the sandbox may have. If zero, the default, there
+	// is no limit.
+	SandboxPidsLimit int64
+
+	// ModuleCacheLimit is the number of bytes that extracted modules kept
+	// for reuse by later scans may use. If zero, modules are not kept.
+	ModuleCacheLimit int64
+
+	// ProxyQPS is the maximum number of requests per second that the
+	// worker makes to the module proxy, shared by all its scans.
+	// If zero, there is no limit.
+	ProxyQPS float64
+
+	// ScanDiskLimit is the number of bytes that downloaded modules and
+	// the sandbox's Go caches may use. If they use more before a scan,
+	// the caches are cleaned, and if that isn't enough, the scan fails.
+	// If zero, disk usage is not checked.
+	ScanDiskLimit int64
+
+	// SandboxPoolSize is the number of sandbox containers kept running
+	// between scans, so that scans don't wait for one to start.
+	// If it is 1, each command runs in a new container.
+	SandboxPoolSize int
+
+	// SandboxPoolMaxUses is the number of scans a pooled sandbox
+	// container is used for before it is replaced. If zero, there is
+	// no limit.
+	SandboxPoolMaxUses int
+
+	// MaxActiveScans is the maximum number of scan requests that an
+	// instance handles at once. Requests over the limit are rejected,
+	// so that the task queue delivers them again later. If zero, there
+	// is no limit.
+	MaxActiveScans int
+
+	// EnqueueConcurrency is the number of tasks that enqueue endpoints
+	// add to the queue at once.
+	EnqueueConcurrency int
+
+	// EnqueueRate is the maximum number of tasks per second that enqueue
+	// endpoints add to the queue. If zero, there is no limit.
+	EnqueueRate float64
+
+	// QueueStatsMaxTasks is the maximum number of tasks that queue/stats
+	// examines, to bound its latency.
+	QueueStatsMaxTasks int
+
+	// BigQueryBatchRows is the number of result rows that the worker
+	// collects before uploading them to a table together. If zero, each
+	// request uploads its own rows.
+	BigQueryBatchRows int
+
+	// StrictSchema reports whether the worker should refuse to start
+	// if the schema of a BigQuery table it writes to differs from the
+	// schema of the rows it writes. If false, it only logs the
+	// differences.
+	StrictSchema bool
+
+	// BigQueryBatchInterval is how often the worker uploads the rows it
+	// has collected, however few there are.
+	BigQueryBatchInterval time.Duration
+
+	// ShutdownGracePeriod is the time the worker has to stop after it
+	// receives SIGTERM, before it is killed. Cloud Run allows 10 seconds.
+	ShutdownGracePeriod time.Duration
+
+	// ModeConfig holds overrides of scan settings for individual
+	// govulncheck modes: a YAML or JSON document, or the
+	// gs://BUCKET/OBJECT URL of a GCS object holding one. See
+	// ParseModeConfigs for the format. If empty, all modes use the
+	// global settings. Analysis scans always use the global settings.
+	ModeConfig string
+
+	// ModeConfigRefresh is how often a ModeConfig in GCS is read again,
+	// so that changes take effect without redeploying the worker.
+	// If zero, it is read only at startup.
+	ModeConfigRefresh time.Duration
 }
 
 // Init resolves all configuration values provided by the config package. It
@@ -126,10 +286,17 @@ func Init(ctx context.Context) (_ *Config, err error) {
 		LocationID:            "us-central1",
 		StaticPath:            ts,
 		BigQueryDataset:       GetEnv("GO_ECOSYSTEM_BIGQUERY_DATASET", "disable"),
+		BigQuerySink:          GetEnv("GO_ECOSYSTEM_BIGQUERY_SINK", "bigquery"),
+		QueueKind:             GetEnv("GO_ECOSYSTEM_QUEUE_KIND", "cloudtasks"),
 		QueueName:             os.Getenv("GO_ECOSYSTEM_QUEUE_NAME"),
+		PubSubTopic:           os.Getenv("GO_ECOSYSTEM_PUBSUB_TOPIC"),
+		PubSubSubscription:    os.Getenv("GO_ECOSYSTEM_PUBSUB_SUBSCRIPTION"),
 		QueueURL:              os.Getenv("GO_ECOSYSTEM_QUEUE_URL"),
 		VulnDBBucketProjectID: os.Getenv("GO_ECOSYSTEM_VULNDB_BUCKET_PROJECT"),
 		BinaryBucket:          os.Getenv("GO_ECOSYSTEM_BINARY_BUCKET"),
+		ResultsBucket:         os.Getenv("GO_ECOSYSTEM_RESULTS_BUCKET"),
+		DeadLetterBucket:      os.Getenv("GO_ECOSYSTEM_DEADLETTER_BUCKET"),
+		ZipCacheBucket:        os.Getenv("GO_ECOSYSTEM_ZIP_CACHE_BUCKET"),
 		BinaryDir:             GetEnv("GO_ECOSYSTEM_BINARY_DIR", "/tmp/binaries"),
 		VulnDBDir:             GetEnv("GO_ECOSYSTEM_VULNDB_DIR", "/tmp/go-vulndb"),
 		PkgsiteDBHost:         GetEnv("GO_ECOSYSTEM_PKGSITE_DB_HOST", "localhost"),
@@ -138,6 +305,106 @@ func Init(ctx context.Context) (_ *Config, err error) {
 		PkgsiteDBUser:         GetEnv("GO_ECOSYSTEM_PKGSITE_DB_USER", "postgres"),
 		PkgsiteDBSecret:       os.Getenv("GO_ECOSYSTEM_PKGSITE_DB_SECRET"),
 		ProxyURL:              GetEnv("GO_MODULE_PROXY_URL", "https://proxy.golang.org"),
+		ProxyAuthSecret:       os.Getenv("GO_ECOSYSTEM_PROXY_AUTH_SECRET"),
+		GoPrivate:             os.Getenv("GO_ECOSYSTEM_GOPRIVATE"),
+		GoNoSumDB:             os.Getenv("GO_ECOSYSTEM_GONOSUMDB"),
+		GoFlags:               os.Getenv("GO_ECOSYSTEM_GOFLAGS"),
+		ModeConfig:            os.Getenv("GO_ECOSYSTEM_MODE_CONFIG"),
+		ChecksumDB:            GetEnv("GO_ECOSYSTEM_CHECKSUM_DB", "sum.golang.org+033de0ae+Ac4zctda0e5eza+HJyk9SxEdh+s3Ux18htTTAD8OuAn8"),
+	}
+	if cfg.QueueKind != "cloudtasks" && cfg.QueueKind != "pubsub" {
+		return nil, fmt.Errorf(`GO_ECOSYSTEM_QUEUE_KIND: want "cloudtasks" or "pubsub", got %q`, cfg.QueueKind)
+	}
+	cfg.ScanTimeout, err = time.ParseDuration(GetEnv("GO_ECOSYSTEM_SCAN_TIMEOUT", "15m"))
+	if err != nil {
+		return nil, fmt.Errorf("GO_ECOSYSTEM_SCAN_TIMEOUT: %w", err)
+	}
+	cfg.AnalysisTimeout, err = time.ParseDuration(GetEnv("GO_ECOSYSTEM_ANALYSIS_TIMEOUT", "10m"))
+	if err != nil {
+		return nil, fmt.Errorf("GO_ECOSYSTEM_ANALYSIS_TIMEOUT: %w", err)
+	}
+	cfg.AnalysisMaxOutput, err = strconv.Atoi(GetEnv("GO_ECOSYSTEM_ANALYSIS_MAX_OUTPUT", strconv.Itoa(100<<20)))
+	if err != nil || cfg.AnalysisMaxOutput < 0 {
+		return nil, fmt.Errorf("GO_ECOSYSTEM_ANALYSIS_MAX_OUTPUT: want a non-negative number of bytes, got %q", os.Getenv("GO_ECOSYSTEM_ANALYSIS_MAX_OUTPUT"))
+	}
+	cfg.ScanMemoryFraction, err = strconv.ParseFloat(GetEnv("GO_ECOSYSTEM_SCAN_MEMORY_FRACTION", "0.9"), 64)
+	if err != nil || cfg.ScanMemoryFraction < 0 || cfg.ScanMemoryFraction > 1 {
+		return nil, fmt.Errorf("GO_ECOSYSTEM_SCAN_MEMORY_FRACTION: want a number between 0 and 1, got %q", os.Getenv("GO_ECOSYSTEM_SCAN_MEMORY_FRACTION"))
+	}
+	cfg.MaxActiveScans, err = strconv.Atoi(GetEnv("GO_ECOSYSTEM_MAX_ACTIVE_SCANS", strconv.Itoa(defaultMaxActiveScans())))
+	if err != nil || cfg.MaxActiveScans < 0 {
+		return nil, fmt.Errorf("GO_ECOSYSTEM_MAX_ACTIVE_SCANS: want a non-negative integer, got %q", os.Getenv("GO_ECOSYSTEM_MAX_ACTIVE_SCANS"))
+	}
+	cfg.SandboxMemoryLimit, err = strconv.ParseInt(GetEnv("GO_ECOSYSTEM_SANDBOX_MEMORY_LIMIT", "0"), 10, 64)
+	if err != nil || cfg.SandboxMemoryLimit < 0 {
+		return nil, fmt.Errorf("GO_ECOSYSTEM_SANDBOX_MEMORY_LIMIT: want a non-negative number of bytes, got %q", os.Getenv("GO_ECOSYSTEM_SANDBOX_MEMORY_LIMIT"))
+	}
+	cfg.SandboxCPUQuota, err = strconv.ParseFloat(GetEnv("GO_ECOSYSTEM_SANDBOX_CPU_QUOTA", "0"), 64)
+	if err != nil || cfg.SandboxCPUQuota < 0 {
+		return nil, fmt.Errorf("GO_ECOSYSTEM_SANDBOX_CPU_QUOTA: want a non-negative number of CPUs, got %q", os.Getenv("GO_ECOSYSTEM_SANDBOX_CPU_QUOTA"))
+	}
+	cfg.SandboxPidsLimit, err = strconv.ParseInt(GetEnv("GO_ECOSYSTEM_SANDBOX_PIDS_LIMIT", "0"), 10, 64)
+	if err != nil || cfg.SandboxPidsLimit < 0 {
+		return nil, fmt.Errorf("GO_ECOSYSTEM_SANDBOX_PIDS_LIMIT: want a non-negative integer, got %q", os.Getenv("GO_ECOSYSTEM_SANDBOX_PIDS_LIMIT"))
+	}
+	cfg.ModuleCacheLimit, err = strconv.ParseInt(GetEnv("GO_ECOSYSTEM_MODULE_CACHE_LIMIT", "0"), 10, 64)
+	if err != nil || cfg.ModuleCacheLimit < 0 {
+		return nil, fmt.Errorf("GO_ECOSYSTEM_MODULE_CACHE_LIMIT: want a non-negative number of bytes, got %q", os.Getenv("GO_ECOSYSTEM_MODULE_CACHE_LIMIT"))
+	}
+	cfg.ProxyQPS, err = strconv.ParseFloat(GetEnv("GO_ECOSYSTEM_PROXY_QPS", "0"), 64)
+	if err != nil || cfg.ProxyQPS < 0 {
+		return nil, fmt.Errorf("GO_ECOSYSTEM_PROXY_QPS: want a non-negative number of requests per second, got %q", os.Getenv("GO_ECOSYSTEM_PROXY_QPS"))
+	}
+	cfg.ScanDiskLimit, err = strconv.ParseInt(GetEnv("GO_ECOSYSTEM_SCAN_DISK_LIMIT", "0"), 10, 64)
+	if err != nil || cfg.ScanDiskLimit < 0 {
+		return nil, fmt.Errorf("GO_ECOSYSTEM_SCAN_DISK_LIMIT: want a non-negative number of bytes, got %q", os.Getenv("GO_ECOSYSTEM_SCAN_DISK_LIMIT"))
+	}
+	cfg.SandboxPoolSize, err = strconv.Atoi(GetEnv("GO_ECOSYSTEM_SANDBOX_POOL_SIZE", "1"))
+	if err != nil || cfg.SandboxPoolSize < 1 {
+		return nil, fmt.Errorf("GO_ECOSYSTEM_SANDBOX_POOL_SIZE: want a positive integer, got %q", os.Getenv("GO_ECOSYSTEM_SANDBOX_POOL_SIZE"))
+	}
+	cfg.SandboxPoolMaxUses, err = strconv.Atoi(GetEnv("GO_ECOSYSTEM_SANDBOX_POOL_MAX_USES", "100"))
+	if err != nil || cfg.SandboxPoolMaxUses < 0 {
+		return nil, fmt.Errorf("GO_ECOSYSTEM_SANDBOX_POOL_MAX_USES: want a non-negative integer, got %q", os.Getenv("GO_ECOSYSTEM_SANDBOX_POOL_MAX_USES"))
+	}
+	cfg.EnqueueConcurrency, err = strconv.Atoi(GetEnv("GO_ECOSYSTEM_ENQUEUE_CONCURRENCY", "16"))
+	if err != nil || cfg.EnqueueConcurrency < 1 {
+		return nil, fmt.Errorf("GO_ECOSYSTEM_ENQUEUE_CONCURRENCY: want a positive integer, got %q", os.Getenv("GO_ECOSYSTEM_ENQUEUE_CONCURRENCY"))
+	}
+	cfg.QueueStatsMaxTasks, err = strconv.Atoi(GetEnv("GO_ECOSYSTEM_QUEUE_STATS_MAX_TASKS", "100000"))
+	if err != nil || cfg.QueueStatsMaxTasks < 1 {
+		return nil, fmt.Errorf("GO_ECOSYSTEM_QUEUE_STATS_MAX_TASKS: want a positive integer, got %q", os.Getenv("GO_ECOSYSTEM_QUEUE_STATS_MAX_TASKS"))
+	}
+	cfg.EnqueueRate, err = strconv.ParseFloat(GetEnv("GO_ECOSYSTEM_ENQUEUE_RATE", "100"), 64)
+	if err != nil || cfg.EnqueueRate < 0 {
+		return nil, fmt.Errorf("GO_ECOSYSTEM_ENQUEUE_RATE: want a non-negative number of tasks per second, got %q", os.Getenv("GO_ECOSYSTEM_ENQUEUE_RATE"))
+	}
+	cfg.BigQueryBatchRows, err = strconv.Atoi(GetEnv("GO_ECOSYSTEM_BQ_BATCH_ROWS", "0"))
+	if err != nil || cfg.BigQueryBatchRows < 0 {
+		return nil, fmt.Errorf("GO_ECOSYSTEM_BQ_BATCH_ROWS: want a non-negative integer, got %q", os.Getenv("GO_ECOSYSTEM_BQ_BATCH_ROWS"))
+	}
+	if v := os.Getenv("GO_ECOSYSTEM_STRICT_SCHEMA"); v != "" {
+		cfg.StrictSchema, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("GO_ECOSYSTEM_STRICT_SCHEMA: want a boolean, got %q", v)
+		}
+	}
+	cfg.BigQueryBatchInterval, err = time.ParseDuration(GetEnv("GO_ECOSYSTEM_BQ_BATCH_INTERVAL", "5s"))
+	if err != nil || cfg.BigQueryBatchInterval <= 0 {
+		return nil, fmt.Errorf("GO_ECOSYSTEM_BQ_BATCH_INTERVAL: want a positive duration, got %q", os.Getenv("GO_ECOSYSTEM_BQ_BATCH_INTERVAL"))
+	}
+	if cfg.ModeConfig != "" && !strings.HasPrefix(cfg.ModeConfig, "gs://") {
+		if _, err := ParseModeConfigs([]byte(cfg.ModeConfig)); err != nil {
+			return nil, fmt.Errorf("GO_ECOSYSTEM_MODE_CONFIG: %w", err)
+		}
+	}
+	cfg.ModeConfigRefresh, err = time.ParseDuration(GetEnv("GO_ECOSYSTEM_MODE_CONFIG_REFRESH", "5m"))
+	if err != nil || cfg.ModeConfigRefresh < 0 {
+		return nil, fmt.Errorf("GO_ECOSYSTEM_MODE_CONFIG_REFRESH: want a non-negative duration, got %q", os.Getenv("GO_ECOSYSTEM_MODE_CONFIG_REFRESH"))
+	}
+	cfg.ShutdownGracePeriod, err = time.ParseDuration(GetEnv("GO_ECOSYSTEM_SHUTDOWN_GRACE_PERIOD", "10s"))
+	if err != nil || cfg.ShutdownGracePeriod <= 0 {
+		return nil, fmt.Errorf("GO_ECOSYSTEM_SHUTDOWN_GRACE_PERIOD: want a positive duration, got %q", os.Getenv("GO_ECOSYSTEM_SHUTDOWN_GRACE_PERIOD"))
 	}
 	if OnCloudRun() {
 		sa, err := gceMetadata(ctx, "instance/service-accounts/default/email")
@@ -179,16 +446,6 @@ func OnCloudRun() bool {
 	return true
 }
 
-func (c *Config) Validate() error {
-	if c.ProjectID == "" {
-		return errors.New("missing project")
-	}
-	if c.BigQueryDataset == "" {
-		return errors.New("missing dataset")
-	}
-	return nil
-}
-
 // Dump outputs the current config information to the given Writer.
 func (c *Config) Dump(w io.Writer) error {
 	fmt.Fprint(w, "config: ")
@@ -206,6 +463,19 @@ func GetEnv(key, fallback string) string {
 	return fallback
 }
 
+// scanMemory is the memory that a scan of a large module may need.
+const scanMemory = 4 << 30
+
+// defaultMaxActiveScans returns the number of scans that fit
+// in GOMEMLIMIT, or 0 (no limit) if GOMEMLIMIT is not set.
+func defaultMaxActiveScans() int {
+	limit := debug.SetMemoryLimit(-1)
+	if limit == math.MaxInt64 {
+		return 0
+	}
+	return max(1, int(limit/scanMemory))
+}
+
 // GetEnvInt performs GetEnv(key, fallback) and parses the
 // result as int. If parsing fails, returns errVal.
 func GetEnvInt(key, fallback string, errVal int) int {
@@ -217,6 +487,12 @@ func GetEnvInt(key, fallback string, errVal int) int {
 	return i
 }
 
+// InstanceID returns the ID of the Cloud Run instance running this process,
+// from the metadata server.
+func InstanceID(ctx context.Context) (string, error) {
+	return gceMetadata(ctx, "instance/id")
+}
+
 // gceMetadata reads a metadata value from GCE.
 // For the possible values of name, see
 // https://cloud.google.com/appengine/docs/standard/java/accessing-instance-metadata.
@@ -0,0 +1,38 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"context"
+	"runtime/debug"
+	"testing"
+)
+
+func TestInitSandboxLimits(t *testing.T) {
+	// Limits that earlier defaults were derived from.
+	t.Setenv("CLOUD_RUN_CONCURRENCY", "4")
+	defer debug.SetMemoryLimit(debug.SetMemoryLimit(8 << 30))
+
+	cfg, err := Init(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SandboxMemoryLimit != 0 || cfg.SandboxCPUQuota != 0 || cfg.SandboxPidsLimit != 0 {
+		t.Errorf("got sandbox limits memory=%d, cpu=%g, pids=%d by default, want none",
+			cfg.SandboxMemoryLimit, cfg.SandboxCPUQuota, cfg.SandboxPidsLimit)
+	}
+
+	t.Setenv("GO_ECOSYSTEM_SANDBOX_MEMORY_LIMIT", "1073741824")
+	t.Setenv("GO_ECOSYSTEM_SANDBOX_CPU_QUOTA", "1.5")
+	t.Setenv("GO_ECOSYSTEM_SANDBOX_PIDS_LIMIT", "100")
+	cfg, err = Init(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SandboxMemoryLimit != 1<<30 || cfg.SandboxCPUQuota != 1.5 || cfg.SandboxPidsLimit != 100 {
+		t.Errorf("got sandbox limits memory=%d, cpu=%g, pids=%d, want the configured ones",
+			cfg.SandboxMemoryLimit, cfg.SandboxCPUQuota, cfg.SandboxPidsLimit)
+	}
+}
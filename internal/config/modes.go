@@ -0,0 +1,198 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"gopkg.in/yaml.v3"
+)
+
+// A ModeConfig holds settings for the scans of one govulncheck mode that
+// override the global ones. A zero field means that the global setting
+// is used. Analysis scans are not affected: their limits come from each
+// enqueue request.
+type ModeConfig struct {
+	// ScanTimeout overrides Config.ScanTimeout.
+	ScanTimeout time.Duration
+
+	// ScanMemoryFraction overrides Config.ScanMemoryFraction.
+	ScanMemoryFraction float64
+
+	// MinImporters is the minimum imported-by count of the modules
+	// enqueued for the mode when the enqueue request doesn't give one.
+	MinImporters int
+
+	// DispatchDeadline is the deadline of each task of the mode.
+	DispatchDeadline time.Duration
+}
+
+// modeConfigDoc is the form of a ModeConfig in an override document.
+type modeConfigDoc struct {
+	ScanTimeout        string  `yaml:"scan_timeout"`
+	ScanMemoryFraction float64 `yaml:"scan_memory_fraction"`
+	MinImporters       int     `yaml:"min_importers"`
+	DispatchDeadline   string  `yaml:"dispatch_deadline"`
+}
+
+// ParseModeConfigs parses a document of per-mode overrides: a YAML or JSON
+// object from mode names to objects with the fields scan_timeout,
+// scan_memory_fraction, min_importers and dispatch_deadline. For example:
+//
+//	{"COMPARE": {"scan_timeout": "30m", "min_importers": 100}}
+//
+// or
+//
+//	COMPARE:
+//	  scan_timeout: 30m
+//	  min_importers: 100
+//
+// Durations are in the form accepted by time.ParseDuration. Mode names are
+// case-insensitive. Unknown fields and invalid values are errors. An empty
+// document has no overrides.
+func ParseModeConfigs(data []byte) (_ map[string]ModeConfig, err error) {
+	defer derrors.Wrap(&err, "ParseModeConfigs")
+	var doc map[string]modeConfigDoc
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&doc); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	duration := func(mode, field, s string) (time.Duration, error) {
+		if s == "" {
+			return 0, nil
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return 0, fmt.Errorf("%s: %s: want a non-negative duration, got %q", mode, field, s)
+		}
+		return d, nil
+	}
+	mcs := map[string]ModeConfig{}
+	for mode, j := range doc {
+		var mc ModeConfig
+		if mc.ScanTimeout, err = duration(mode, "scan_timeout", j.ScanTimeout); err != nil {
+			return nil, err
+		}
+		if mc.DispatchDeadline, err = duration(mode, "dispatch_deadline", j.DispatchDeadline); err != nil {
+			return nil, err
+		}
+		if j.ScanMemoryFraction < 0 || j.ScanMemoryFraction > 1 {
+			return nil, fmt.Errorf("%s: scan_memory_fraction: want a number between 0 and 1, got %g", mode, j.ScanMemoryFraction)
+		}
+		mc.ScanMemoryFraction = j.ScanMemoryFraction
+		if j.MinImporters < 0 {
+			return nil, fmt.Errorf("%s: min_importers: want a non-negative integer, got %d", mode, j.MinImporters)
+		}
+		mc.MinImporters = j.MinImporters
+		mcs[strings.ToUpper(mode)] = mc
+	}
+	return mcs, nil
+}
+
+// ModeConfigs holds the ModeConfig of each govulncheck mode, as read from
+// Config.ModeConfig. It can be reloaded while it is in use, and is safe
+// for concurrent use.
+type ModeConfigs struct {
+	read    func(context.Context) ([]byte, error)
+	configs atomic.Pointer[map[string]ModeConfig]
+}
+
+// LoadModeConfigs reads and parses the overrides from source, which is
+// either a YAML or JSON document as described by ParseModeConfigs or the URL
+// of a GCS object holding one, of the form gs://BUCKET/OBJECT. If source
+// is empty, there are no overrides.
+func LoadModeConfigs(ctx context.Context, source string) (_ *ModeConfigs, err error) {
+	defer derrors.Wrap(&err, "LoadModeConfigs")
+	m := &ModeConfigs{}
+	switch {
+	case source == "":
+		m.read = func(context.Context) ([]byte, error) { return []byte("{}"), nil }
+	case strings.HasPrefix(source, "gs://"):
+		bucket, object, ok := strings.Cut(strings.TrimPrefix(source, "gs://"), "/")
+		if bucket == "" || !ok || object == "" {
+			return nil, fmt.Errorf("%q is not of the form gs://BUCKET/OBJECT", source)
+		}
+		m.read = func(ctx context.Context) ([]byte, error) {
+			return readGCSObject(ctx, bucket, object)
+		}
+	default:
+		m.read = func(context.Context) ([]byte, error) { return []byte(source), nil }
+	}
+	if _, err := m.Reload(ctx); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Reload reads the overrides again and reports whether they changed.
+// If they can't be read or parsed, m keeps the overrides it had.
+func (m *ModeConfigs) Reload(ctx context.Context) (changed bool, err error) {
+	data, err := m.read(ctx)
+	if err != nil {
+		return false, err
+	}
+	mcs, err := ParseModeConfigs(data)
+	if err != nil {
+		return false, err
+	}
+	old := m.configs.Swap(&mcs)
+	return old == nil || !maps.Equal(*old, mcs), nil
+}
+
+// Get returns the overrides for mode. It returns the zero ModeConfig,
+// which overrides nothing, if there are none or m is nil.
+func (m *ModeConfigs) Get(mode string) ModeConfig {
+	if m == nil {
+		return ModeConfig{}
+	}
+	mcs := m.configs.Load()
+	if mcs == nil {
+		return ModeConfig{}
+	}
+	return (*mcs)[strings.ToUpper(mode)]
+}
+
+// Modes returns the modes that m has overrides for, sorted.
+func (m *ModeConfigs) Modes() []string {
+	if m == nil {
+		return nil
+	}
+	mcs := m.configs.Load()
+	if mcs == nil {
+		return nil
+	}
+	var modes []string
+	for mode := range *mcs {
+		modes = append(modes, mode)
+	}
+	slices.Sort(modes)
+	return modes
+}
+
+func readGCSObject(ctx context.Context, bucket, object string) ([]byte, error) {
+	c, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	r, err := c.Bucket(bucket).Object(object).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,116 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseModeConfigs(t *testing.T) {
+	got, err := ParseModeConfigs([]byte(`{
+		"compare": {"scan_timeout": "30m", "scan_memory_fraction": 0.5},
+		"GOVULNCHECK": {"min_importers": 100, "dispatch_deadline": "1h"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]ModeConfig{
+		"COMPARE":     {ScanTimeout: 30 * time.Minute, ScanMemoryFraction: 0.5},
+		"GOVULNCHECK": {MinImporters: 100, DispatchDeadline: time.Hour},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+
+	// The same overrides in YAML.
+	got, err = ParseModeConfigs([]byte(`
+compare:
+  scan_timeout: 30m
+  scan_memory_fraction: 0.5
+GOVULNCHECK:
+  min_importers: 100
+  dispatch_deadline: 1h
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("YAML mismatch (-want, +got):\n%s", diff)
+	}
+
+	// An empty document has no overrides.
+	if got, err := ParseModeConfigs(nil); err != nil || len(got) != 0 {
+		t.Errorf("empty document: got (%v, %v), want no overrides", got, err)
+	}
+
+	for _, test := range []struct {
+		doc, want string
+	}{
+		{`{"COMPARE": {"timeout": "1m"}}`, `field timeout not found`},
+		{"COMPARE:\n  timeout: 1m\n", `field timeout not found`},
+		{`{"COMPARE": {"scan_timeout": "1"}}`, `COMPARE: scan_timeout: want a non-negative duration, got "1"`},
+		{`{"COMPARE": {"scan_memory_fraction": 2}}`, `COMPARE: scan_memory_fraction: want a number between 0 and 1, got 2`},
+		{`{"COMPARE": {"min_importers": -1}}`, `COMPARE: min_importers: want a non-negative integer, got -1`},
+		{`["COMPARE"]`, `cannot unmarshal !!seq`},
+	} {
+		_, err := ParseModeConfigs([]byte(test.doc))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want error containing %q", test.doc, err, test.want)
+		}
+	}
+}
+
+func TestModeConfigsReload(t *testing.T) {
+	ctx := context.Background()
+	m, err := LoadModeConfigs(ctx, `{"COMPARE": {"min_importers": 5}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Get("compare").MinImporters; got != 5 {
+		t.Errorf("got %d, want 5", got)
+	}
+	if got := m.Get("GOVULNCHECK"); got != (ModeConfig{}) {
+		t.Errorf("mode without overrides: got %+v", got)
+	}
+
+	doc, readErr := `{"COMPARE": {"min_importers": 7}}`, error(nil)
+	m.read = func(context.Context) ([]byte, error) { return []byte(doc), readErr }
+	if changed, err := m.Reload(ctx); err != nil || !changed {
+		t.Fatalf("got (%t, %v), want (true, nil)", changed, err)
+	}
+	if changed, err := m.Reload(ctx); err != nil || changed {
+		t.Fatalf("reloading the same document: got (%t, %v), want (false, nil)", changed, err)
+	}
+	// A bad document or read error leaves the overrides alone.
+	doc = `{"COMPARE": {"min_importers": "many"}}`
+	if _, err := m.Reload(ctx); err == nil {
+		t.Error("bad document: got no error")
+	}
+	readErr = errors.New("read failed")
+	if _, err := m.Reload(ctx); err == nil {
+		t.Error("read error: got no error")
+	}
+	if got := m.Get("COMPARE").MinImporters; got != 7 {
+		t.Errorf("after failed reloads: got %d, want 7", got)
+	}
+	if got, want := m.Modes(), []string{"COMPARE"}; !slices.Equal(got, want) {
+		t.Errorf("Modes: got %v, want %v", got, want)
+	}
+
+	var nilConfigs *ModeConfigs
+	if got := nilConfigs.Get("COMPARE"); got != (ModeConfig{}) {
+		t.Errorf("nil ModeConfigs: got %+v", got)
+	}
+	if got := nilConfigs.Modes(); got != nil {
+		t.Errorf("nil ModeConfigs: got modes %v", got)
+	}
+}
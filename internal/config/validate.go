@@ -0,0 +1,209 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	cloudtasks "cloud.google.com/go/cloudtasks/apiv2"
+	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	"cloud.google.com/go/storage"
+	"golang.org/x/pkgsite-metrics/internal/log"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A ValidationError lists the problems found by Config.Validate.
+type ValidationError struct {
+	Problems []error
+}
+
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "invalid configuration: %d problem(s)", len(e.Problems))
+	for _, p := range e.Problems {
+		b.WriteString("\n\t")
+		b.WriteString(p.Error())
+	}
+	return b.String()
+}
+
+func (e *ValidationError) Unwrap() []error {
+	return e.Problems
+}
+
+// Validate checks that the fields of c needed by the features it enables
+// are set, and that the GCS buckets, BigQuery dataset and Cloud Tasks queue
+// it names exist and can be used. Without it, such problems show up only
+// when a task first uses the feature, which may be hours into a job.
+//
+// Validate looks for all the problems before returning. If it finds any,
+// it returns a *ValidationError that lists them. A resource that can't be
+// checked because of a transient error, like an unavailable service, is
+// not a problem; Validate logs a warning instead, so that the worker can
+// still start.
+func (c *Config) Validate(ctx context.Context) error {
+	return c.validate(ctx, gcpResources{})
+}
+
+// resources checks that cloud resources exist and are accessible.
+type resources interface {
+	checkBucket(ctx context.Context, bucket string) error
+	checkDataset(ctx context.Context, projectID, dataset string) error
+	checkQueue(ctx context.Context, queueName string) error
+}
+
+func (c *Config) validate(ctx context.Context, res resources) error {
+	var problems []error
+	problem := func(field string, err error) {
+		problems = append(problems, fmt.Errorf("%s: %w", field, err))
+	}
+	// resourceProblem records err, from checking the resource named by
+	// field, unless it is transient.
+	resourceProblem := func(field string, err error) {
+		if isTransient(err) {
+			log.Warnf(ctx, "%s: not checked: %v", field, err)
+			return
+		}
+		problem(field, err)
+	}
+	required := func(field, value, feature string) bool {
+		if value == "" {
+			problem(field, fmt.Errorf("required %s", feature))
+			return false
+		}
+		return true
+	}
+
+	if u, err := url.Parse(c.ProxyURL); err != nil || u.Scheme == "" || u.Host == "" {
+		problem("ProxyURL", fmt.Errorf("want an absolute URL, got %q", c.ProxyURL))
+	}
+	if c.ServiceAccount != "" && !strings.Contains(c.ServiceAccount, "@") {
+		problem("ServiceAccount", fmt.Errorf("want an email address, got %q", c.ServiceAccount))
+	}
+	if OnCloudRun() {
+		required("BinaryBucket", c.BinaryBucket, "on Cloud Run, for binary scans and analysis")
+	}
+
+	if !strings.EqualFold(c.BigQueryDataset, "disable") && required("ProjectID", c.ProjectID, "to write to BigQuery") {
+		if err := res.checkDataset(ctx, c.ProjectID, c.BigQueryDataset); err != nil {
+			resourceProblem("BigQueryDataset", err)
+		}
+	}
+
+	switch {
+	case c.QueueKind == "pubsub":
+		required("ProjectID", c.ProjectID, "for a Pub/Sub queue")
+		required("PubSubTopic", c.PubSubTopic, "for a Pub/Sub queue")
+	case OnCloudRun() && !c.LocalQueue && c.QueueName != "":
+		// The worker uses Cloud Tasks; see queue.New.
+		const feature = "for a Cloud Tasks queue"
+		ok := required("ProjectID", c.ProjectID, feature)
+		ok = required("LocationID", c.LocationID, feature) && ok
+		required("ServiceAccount", c.ServiceAccount, feature)
+		if required("QueueURL", c.QueueURL, feature) {
+			if u, err := url.Parse(c.QueueURL); err != nil || u.Scheme != "https" || u.Host == "" {
+				problem("QueueURL", fmt.Errorf("want an https URL, got %q", c.QueueURL))
+			}
+		}
+		if ok {
+			name := fmt.Sprintf("projects/%s/locations/%s/queues/%s", c.ProjectID, c.LocationID, c.QueueName)
+			if err := res.checkQueue(ctx, name); err != nil {
+				resourceProblem("QueueName", err)
+			}
+		}
+	}
+
+	for _, b := range []struct{ field, bucket string }{
+		{"BinaryBucket", c.BinaryBucket},
+		{"ResultsBucket", c.ResultsBucket},
+		{"DeadLetterBucket", c.DeadLetterBucket},
+		{"ZipCacheBucket", c.ZipCacheBucket},
+	} {
+		if b.bucket == "" {
+			continue
+		}
+		if err := res.checkBucket(ctx, b.bucket); err != nil {
+			resourceProblem(b.field, err)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// gcpResources implements resources with the Google Cloud APIs.
+type gcpResources struct{}
+
+// checkBucket checks that bucket exists and that its objects can be
+// listed. It lists at most one object, rather than reading the bucket's
+// attributes, since the worker's roles may grant access to objects but
+// not to bucket metadata.
+func (gcpResources) checkBucket(ctx context.Context, bucket string) error {
+	c, err := storage.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	it := c.Bucket(bucket).Objects(ctx, nil)
+	it.PageInfo().MaxSize = 1
+	if _, err := it.Next(); err != nil && !errors.Is(err, iterator.Done) {
+		return fmt.Errorf("listing bucket %q: %w", bucket, err)
+	}
+	return nil
+}
+
+func (gcpResources) checkDataset(ctx context.Context, projectID, dataset string) error {
+	c, err := bigquery.NewClient(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, err := c.Dataset(dataset).Metadata(ctx); err != nil {
+		return fmt.Errorf("dataset %s.%s: %w", projectID, dataset, err)
+	}
+	return nil
+}
+
+func (gcpResources) checkQueue(ctx context.Context, queueName string) error {
+	c, err := cloudtasks.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, err := c.GetQueue(ctx, &taskspb.GetQueueRequest{Name: queueName}); err != nil {
+		return fmt.Errorf("queue %s: %w", queueName, err)
+	}
+	return nil
+}
+
+// isTransient reports whether err, from a Google Cloud API, may not
+// happen if the call is retried.
+func isTransient(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return gerr.Code == http.StatusTooManyRequests || gerr.Code >= 500
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Internal, codes.Aborted:
+		return true
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
@@ -0,0 +1,157 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+// fakeResources is a resources whose only existing resources are
+// the ones it holds.
+type fakeResources map[string]bool
+
+func (f fakeResources) check(name string) error {
+	if name == "unavailable" {
+		return &googleapi.Error{Code: http.StatusServiceUnavailable}
+	}
+	if !f[name] {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (f fakeResources) checkBucket(_ context.Context, bucket string) error {
+	return f.check(bucket)
+}
+
+func (f fakeResources) checkDataset(_ context.Context, projectID, dataset string) error {
+	return f.check(projectID + "." + dataset)
+}
+
+func (f fakeResources) checkQueue(_ context.Context, queueName string) error {
+	return f.check(queueName)
+}
+
+func TestValidate(t *testing.T) {
+	ctx := context.Background()
+	res := fakeResources{
+		"binaries":     true,
+		"proj.results": true,
+		"projects/proj/locations/us-central1/queues/q": true,
+	}
+	valid := func() *Config {
+		return &Config{
+			ProjectID:       "proj",
+			LocationID:      "us-central1",
+			ServiceAccount:  "worker@proj.iam.gserviceaccount.com",
+			BigQueryDataset: "results",
+			QueueKind:       "cloudtasks",
+			QueueName:       "q",
+			QueueURL:        "https://worker.example.com",
+			BinaryBucket:    "binaries",
+			ProxyURL:        "https://proxy.golang.org",
+		}
+	}
+	for _, v := range []string{"K_SERVICE", "K_REVISION", "K_CONFIGURATION"} {
+		t.Setenv(v, "worker")
+	}
+
+	if err := valid().validate(ctx, res); err != nil {
+		t.Fatalf("valid config: %v", err)
+	}
+	// Transient errors are not problems.
+	cfg := valid()
+	cfg.ResultsBucket = "unavailable"
+	if err := cfg.validate(ctx, res); err != nil {
+		t.Fatalf("unavailable bucket: %v", err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		modify func(*Config)
+		want   []string
+	}{
+		{
+			name: "missing queue fields",
+			modify: func(c *Config) {
+				c.QueueURL = ""
+				c.ServiceAccount = ""
+			},
+			want: []string{
+				"ServiceAccount: required for a Cloud Tasks queue",
+				"QueueURL: required for a Cloud Tasks queue",
+			},
+		},
+		{
+			name: "bad values",
+			modify: func(c *Config) {
+				c.QueueURL = "http://worker.example.com"
+				c.ServiceAccount = "worker"
+				c.ProxyURL = "proxy.golang.org"
+			},
+			want: []string{
+				`ProxyURL: want an absolute URL, got "proxy.golang.org"`,
+				`ServiceAccount: want an email address, got "worker"`,
+				`QueueURL: want an https URL, got "http://worker.example.com"`,
+			},
+		},
+		{
+			name: "missing resources",
+			modify: func(c *Config) {
+				c.BigQueryDataset = "other"
+				c.QueueName = "other"
+				c.ResultsBucket = "results"
+			},
+			want: []string{
+				"BigQueryDataset: not found",
+				"QueueName: not found",
+				"ResultsBucket: not found",
+			},
+		},
+		{
+			name: "no project",
+			modify: func(c *Config) {
+				c.ProjectID = ""
+				c.BinaryBucket = ""
+			},
+			want: []string{
+				"BinaryBucket: required on Cloud Run, for binary scans and analysis",
+				"ProjectID: required to write to BigQuery",
+				"ProjectID: required for a Cloud Tasks queue",
+			},
+		},
+		{
+			name: "pubsub",
+			modify: func(c *Config) {
+				c.QueueKind = "pubsub"
+				c.QueueURL = ""
+			},
+			want: []string{"PubSubTopic: required for a Pub/Sub queue"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := valid()
+			test.modify(cfg)
+			err := cfg.validate(ctx, res)
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("got %v, want a *ValidationError", err)
+			}
+			var got []string
+			for _, p := range verr.Problems {
+				got = append(got, p.Error())
+			}
+			if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("problems:\ngot  %q\nwant %q", got, test.want)
+			}
+		})
+	}
+}
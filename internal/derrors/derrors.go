@@ -32,6 +32,10 @@ var (
 	// some way (HTTP 400).
 	InvalidArgument = errors.New("invalid argument")
 
+	// NotImplemented indicates that an operation is not supported
+	// (HTTP 501).
+	NotImplemented = errors.New("not implemented")
+
 	// BadModule indicates a problem with a module.
 	BadModule = errors.New("bad module")
 
@@ -41,6 +45,14 @@ var (
 	// ProxyError is used to capture non-actionable server errors returned from the proxy.
 	ProxyError = errors.New("proxy error")
 
+	// ChecksumMismatchError indicates that a module zip from the proxy
+	// doesn't match its hash in the checksum database.
+	ChecksumMismatchError = errors.New("checksum mismatch")
+
+	// ChecksumDBError occurs when the checksum database cannot be
+	// reached, or fails to answer.
+	ChecksumDBError = errors.New("checksum database error")
+
 	// BigQueryError is used to capture server errors returned by BigQuery.
 	BigQueryError = errors.New("BigQuery error")
 
@@ -115,8 +127,63 @@ var (
 	// ScanModuleMemoryLimitExceeded occurs when scanning uses too much memory.
 	ScanModuleMemoryLimitExceeded = errors.New("scan module memory limit exceeded")
 
+	// ScanModuleTimeoutError occurs when scanning takes longer than
+	// the scan timeout.
+	ScanModuleTimeoutError = errors.New("scan module timeout")
+
+	// ScanModuleBuildInfoError occurs when the build information
+	// of a binary cannot be read.
+	ScanModuleBuildInfoError = errors.New("scan module build info error")
+
+	// BinaryNoBuildInfo occurs when a binary has no Go build
+	// information, as when it is not a Go binary. It cannot be scanned.
+	BinaryNoBuildInfo = errors.New("binary has no build info")
+
+	// BinaryStripped occurs when a binary has no symbol table, as when
+	// it was linked with -ldflags=-s. Its vulnerabilities can only be
+	// found at the module level.
+	BinaryStripped = errors.New("binary is stripped")
+
+	// ScanModuleSkipped is used for modules that are not scanned
+	// because they are on the skip list.
+	ScanModuleSkipped = errors.New("skipped")
+
 	// ScanModuleTooManyOpenFiles occurs when there are too many files open while scanning.
 	ScanModuleTooManyOpenFiles = errors.New("scan module too many open files")
+
+	// ScanModuleDiskSpaceError occurs when the disk used by modules and
+	// caches is over the limit, even after cleaning the caches, or when
+	// the disk is full.
+	ScanModuleDiskSpaceError = errors.New("scan module disk space exceeded")
+
+	// ScanModuleSandboxStartError occurs when the sandbox cannot be
+	// started, as when runsc fails to create or start its container.
+	ScanModuleSandboxStartError = errors.New("scan module sandbox start error")
+
+	// ScanModuleModDownloadError occurs when the dependencies of a module
+	// cannot be downloaded because of a network problem. Dependencies
+	// that are missing from the proxy are a LoadPackagesError.
+	ScanModuleModDownloadError = errors.New("scan module go mod download error")
+
+	// GCSReadError occurs when an object, like a binary or a vulnerability
+	// database, cannot be read from GCS.
+	GCSReadError = errors.New("GCS read error")
+
+	// GCSNotFoundError occurs when an object, or its bucket, does not
+	// exist in GCS. Unlike a GCSReadError, it happens again if retried.
+	GCSNotFoundError = errors.New("GCS object not found")
+
+	// AnalysisTimeoutError occurs when an analysis binary runs longer
+	// than its timeout.
+	AnalysisTimeoutError = errors.New("analysis binary timeout")
+
+	// AnalysisOutputTooLarge occurs when an analysis binary writes more
+	// output than allowed.
+	AnalysisOutputTooLarge = errors.New("analysis binary output too large")
+
+	// AnalysisInvalidOutput occurs when the output of an analysis binary
+	// does not have the expected form.
+	AnalysisInvalidOutput = errors.New("analysis binary invalid output")
 )
 
 // Wrap adds context to the error and allows
@@ -224,10 +291,40 @@ func CategorizeError(err error) string {
 		return "PANIC"
 	case errors.Is(err, ScanModuleMemoryLimitExceeded):
 		return "MEM LIMIT EXCEEDED"
+	case errors.Is(err, ScanModuleTimeoutError):
+		return "TIMEOUT"
+	case errors.Is(err, AnalysisTimeoutError):
+		return "ANALYSIS TIMEOUT"
+	case errors.Is(err, AnalysisOutputTooLarge):
+		return "ANALYSIS OUTPUT TOO LARGE"
+	case errors.Is(err, AnalysisInvalidOutput):
+		return "ANALYSIS INVALID OUTPUT"
+	case errors.Is(err, ScanModuleSkipped):
+		return "SKIPPED"
+	case errors.Is(err, BinaryNoBuildInfo):
+		return "BINARY - NO BUILD INFO"
+	case errors.Is(err, BinaryStripped):
+		return "BINARY - STRIPPED"
+	case errors.Is(err, ScanModuleBuildInfoError):
+		return "BUILDINFO"
 	case errors.Is(err, ScanModuleTooManyOpenFiles):
 		return "TOO MANY OPEN FILES"
+	case errors.Is(err, ScanModuleDiskSpaceError):
+		return "DISK SPACE"
+	case errors.Is(err, ScanModuleSandboxStartError):
+		return "SANDBOX START"
+	case errors.Is(err, ScanModuleModDownloadError):
+		return "MOD DOWNLOAD"
+	case errors.Is(err, GCSReadError):
+		return "GCS READ"
+	case errors.Is(err, GCSNotFoundError):
+		return "GCS NOT FOUND"
 	case errors.Is(err, ScanModuleSandboxError):
 		return "SANDBOX MISC"
+	case errors.Is(err, ChecksumMismatchError):
+		return "CHECKSUM MISMATCH"
+	case errors.Is(err, ChecksumDBError):
+		return "CHECKSUM DB"
 	case errors.Is(err, ProxyError):
 		return "PROXY"
 	case errors.Is(err, BigQueryError):
@@ -9,13 +9,20 @@ package govulncheck
 import (
 	"bytes"
 	"context"
+	"debug/buildinfo"
+	"debug/elf"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"net/http"
 	"net/url"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"time"
 
@@ -27,6 +34,7 @@ import (
 	"golang.org/x/pkgsite-metrics/internal/govulncheckapi"
 	"golang.org/x/pkgsite-metrics/internal/log"
 	"golang.org/x/pkgsite-metrics/internal/osv"
+	"golang.org/x/pkgsite-metrics/internal/queue"
 	"golang.org/x/pkgsite-metrics/internal/scan"
 )
 
@@ -42,20 +50,37 @@ const (
 
 	// FlagSource is the flag passed to govulncheck to run in source mode.
 	FlagSource = "source"
+
+	// ScanLevelPackage is the govulncheck scan level that only reports
+	// vulnerable packages that are imported, without call graph analysis.
+	ScanLevelPackage = "package"
 )
 
 // EnqueueQueryParams for govulncheck/enqueue.
 type EnqueueQueryParams struct {
-	Suffix string // appended to task queue IDs to generate unique tasks
-	Mode   string // type of analysis to run
-	Min    int    // minimum import-by count for a module to be included
-	File   string // path to file containing modules; if missing, use DB
+	Suffix   string // appended to task queue IDs to generate unique tasks
+	Mode     string // type of analysis to run
+	Min      int    // minimum import-by count for a module to be included
+	File     string // path to file containing modules; if missing, use DB
+	Batch    int    // if greater than 1, scan this many modules in each task
+	Triage   bool   // passed to each scan request
+	Packages string // passed to each scan request
+	VulnDB   string // passed to each scan request
+	DryRun   bool   // if true, report the tasks instead of enqueuing them
+	// If Sample is between 0 and 1, only that fraction of the modules
+	// is enqueued, as selected by scan.SampleModules with Seed.
+	Sample float64
+	Seed   string
 }
 
 // Request contains information passed to a scan endpoint.
 type Request struct {
 	scan.ModuleURLPath
 	QueryParams
+
+	// Attempt is the Cloud Tasks attempt that delivered the request,
+	// or nil if it was not delivered by Cloud Tasks.
+	Attempt *queue.TaskAttempt
 }
 
 // QueryParams has query parameters for a govulncheck scan request.
@@ -64,6 +89,64 @@ type QueryParams struct {
 	Mode       string // govulncheck mode
 	Insecure   bool   // if true, run outside sandbox
 	Serve      bool   // serve results back to client instead of writing them to BigQuery
+	Timeout    string // maximum duration of the scan; if empty, use the configured default
+	Triage     bool   // if true, skip symbol analysis of modules that import no vulnerable packages
+	Packages   string // comma-separated package patterns to scan; if empty, "./..."
+	VulnDB     string // gs://BUCKET/PATH of a vuln DB snapshot to scan with; if empty, use the worker's DB
+}
+
+// DefaultPackagePattern is the package pattern scanned when a
+// request does not specify one.
+const DefaultPackagePattern = "./..."
+
+// PackagePatterns returns the package patterns to scan.
+func (p *QueryParams) PackagePatterns() []string {
+	if p.Packages == "" {
+		return []string{DefaultPackagePattern}
+	}
+	return strings.Split(p.Packages, ",")
+}
+
+// CheckPackages checks that packages is a valid value
+// for the Packages query param.
+func CheckPackages(packages string) error {
+	if packages == "" {
+		return nil
+	}
+	for _, p := range strings.Split(packages, ",") {
+		if p == "" || strings.HasPrefix(p, "-") || strings.ContainsAny(p, " \t\n") {
+			return fmt.Errorf(`invalid package pattern %q in "packages" query param`, p)
+		}
+	}
+	return nil
+}
+
+// ParseVulnDB parses the VulnDB query param, which has the
+// form gs://BUCKET/PATH, into a bucket and an object prefix.
+// PATH may be empty.
+func ParseVulnDB(vulndb string) (bucket, prefix string, err error) {
+	rest, ok := strings.CutPrefix(vulndb, "gs://")
+	if !ok {
+		return "", "", fmt.Errorf(`"vulndb" query param %q does not start with gs://`, vulndb)
+	}
+	bucket, prefix, _ = strings.Cut(rest, "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf(`"vulndb" query param %q has no bucket`, vulndb)
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return bucket, prefix, nil
+}
+
+// checkVulnDB checks that vulndb is a valid value
+// for the VulnDB query param.
+func checkVulnDB(vulndb string) error {
+	if vulndb == "" {
+		return nil
+	}
+	_, _, err := ParseVulnDB(vulndb)
+	return err
 }
 
 // The below methods implement queue.Task.
@@ -85,6 +168,8 @@ func (r *Request) Params() string {
 //   - <module>/@latest
 //
 // (These are the same forms that the module proxy accepts.)
+// The version may also be a query like "<v1.2.0", which the scan
+// handler resolves to the matching versions.
 func ParseRequest(r *http.Request, prefix string) (*Request, error) {
 	mp, err := scan.ParseModuleURLPath(strings.TrimPrefix(r.URL.Path, prefix))
 	if err != nil {
@@ -98,30 +183,194 @@ func ParseRequest(r *http.Request, prefix string) (*Request, error) {
 	if rp.ImportedBy < 0 {
 		return nil, errors.New(`missing or negative "importedby" query param`)
 	}
+	if rp.Timeout != "" {
+		if d, err := time.ParseDuration(rp.Timeout); err != nil || d <= 0 {
+			return nil, fmt.Errorf(`invalid "timeout" query param %q`, rp.Timeout)
+		}
+	}
+	if err := CheckPackages(rp.Packages); err != nil {
+		return nil, err
+	}
+	if err := checkVulnDB(rp.VulnDB); err != nil {
+		return nil, err
+	}
 	return &Request{
 		ModuleURLPath: mp,
 		QueryParams:   rp,
+		Attempt:       queue.TaskAttemptOf(r),
 	}, nil
 }
 
+// BatchPath is the path, relative to the scan endpoint,
+// of requests to scan a batch of modules.
+const BatchPath = "batch"
+
+// MaxBatchSize is the maximum number of modules in a BatchRequest.
+// It keeps task URLs below the Cloud Tasks limit of 2083 characters.
+const MaxBatchSize = 20
+
+// A BatchRequest is a request to scan several modules sequentially
+// in a single task. The ImportedBy field of QueryParams is ignored;
+// each module has its own.
+type BatchRequest struct {
+	Modules []scan.ModuleSpec
+	QueryParams
+
+	// Attempt is that of each of the batch's Requests.
+	// It is not part of the task.
+	Attempt *queue.TaskAttempt
+}
+
+// The below methods implement queue.Task.
+
+func (r *BatchRequest) Name() string {
+	m := r.Modules[0]
+	return fmt.Sprintf("batch-%s@%s-%d", m.Path, m.Version, len(r.Modules))
+}
+
+func (r *BatchRequest) Path() string { return BatchPath }
+
+func (r *BatchRequest) Params() string {
+	var mods []string
+	for _, m := range r.Modules {
+		mods = append(mods, fmt.Sprintf("%s@%s:%d", m.Path, m.Version, m.ImportedBy))
+	}
+	return "modules=" + url.QueryEscape(strings.Join(mods, ",")) + "&" + scan.FormatParams(r.QueryParams)
+}
+
+// Requests returns a Request for each module in r.
+func (r *BatchRequest) Requests() []*Request {
+	var reqs []*Request
+	for _, m := range r.Modules {
+		qp := r.QueryParams
+		qp.ImportedBy = m.ImportedBy
+		reqs = append(reqs, &Request{
+			ModuleURLPath: scan.ModuleURLPath{Module: m.Path, Version: m.Version},
+			QueryParams:   qp,
+			Attempt:       r.Attempt,
+		})
+	}
+	return reqs
+}
+
+// ParseBatchRequest parses an http request for a batch of modules,
+// whose modules are in the "modules" query param, as encoded by
+// BatchRequest.Params.
+func ParseBatchRequest(r *http.Request) (*BatchRequest, error) {
+	var br BatchRequest
+	if err := scan.ParseParams(r, &br.QueryParams); err != nil {
+		return nil, err
+	}
+	mods := r.FormValue("modules")
+	if mods == "" {
+		return nil, errors.New(`missing "modules" query param`)
+	}
+	for _, s := range strings.Split(mods, ",") {
+		mv, imps, ok1 := strings.Cut(s, ":")
+		path, vers, ok2 := strings.Cut(mv, "@")
+		n, err := strconv.Atoi(imps)
+		if !ok1 || !ok2 || path == "" || vers == "" || err != nil || n < 0 {
+			return nil, fmt.Errorf("bad module %q: want MODULE@VERSION:IMPORTEDBY", s)
+		}
+		br.Modules = append(br.Modules, scan.ModuleSpec{Path: path, Version: vers, ImportedBy: n})
+	}
+	if len(br.Modules) > MaxBatchSize {
+		return nil, fmt.Errorf("%d modules in batch; at most %d allowed", len(br.Modules), MaxBatchSize)
+	}
+	if br.Timeout != "" {
+		if d, err := time.ParseDuration(br.Timeout); err != nil || d <= 0 {
+			return nil, fmt.Errorf(`invalid "timeout" query param %q`, br.Timeout)
+		}
+	}
+	if err := CheckPackages(br.Packages); err != nil {
+		return nil, err
+	}
+	if err := checkVulnDB(br.VulnDB); err != nil {
+		return nil, err
+	}
+	br.Attempt = queue.TaskAttemptOf(r)
+	return &br, nil
+}
+
 // ConvertGovulncheckFinding takes a finding from govulncheck and converts it to
 // a bigquery vuln.
 func ConvertGovulncheckFinding(f *govulncheckapi.Finding, o *osv.Entry) *Vuln {
-	vulnerableFrame := f.Trace[0]
 	reviewed := ""
 	if o != nil && o.DatabaseSpecific != nil { // sanity
 		reviewed = o.DatabaseSpecific.ReviewStatus.String()
 	}
-	return &Vuln{
-		ID:          f.OSV,
-		PackagePath: vulnerableFrame.Package,
-		ModulePath:  vulnerableFrame.Module,
-		Version:     vulnerableFrame.Version,
+	v := &Vuln{
+		ID: f.OSV,
 		ReviewStatus: bq.NullString{
 			StringVal: reviewed,
 			Valid:     reviewed != "",
 		},
 	}
+	if len(f.Trace) == 0 { // sanity
+		return v
+	}
+	vulnerableFrame := f.Trace[0]
+	v.PackagePath = vulnerableFrame.Package
+	v.ModulePath = vulnerableFrame.Module
+	v.Version = vulnerableFrame.Version
+	v.CallStack = convertTrace(f.Trace)
+	setCaller(v, f.Trace)
+	return v
+}
+
+// setCaller sets the Caller fields of v from the frame of trace that
+// calls the vulnerable symbol. In govulncheck traces, the position of
+// that frame is the position of the call. As in convertTrace, the call
+// stack ends at the first frame without a function, so there is no
+// caller unless the first two frames have functions.
+func setCaller(v *Vuln, trace []*govulncheckapi.Frame) {
+	if len(trace) < 2 {
+		return
+	}
+	if trace[0].Function == "" || trace[1].Function == "" {
+		return
+	}
+	caller := trace[1]
+	v.CallerPackage = bq.NullString{StringVal: caller.Package, Valid: true}
+	fn := caller.Function
+	if caller.Receiver != "" {
+		fn = caller.Receiver + "." + fn
+	}
+	v.CallerFunction = bq.NullString{StringVal: fn, Valid: true}
+	if p := caller.Position; p != nil && p.Line > 0 {
+		v.CallerFile = bq.NullString{StringVal: p.Filename, Valid: true}
+		v.CallerLine = bq.NullInt64{Int64: int64(p.Line), Valid: true}
+	}
+}
+
+// MaxCallStackFrames is the maximum number of frames recorded in
+// a Vuln's call stack. It bounds row size, since rows that are too
+// large cannot be uploaded.
+const MaxCallStackFrames = 16
+
+// convertTrace converts the trace of a finding to a call stack,
+// starting from the vulnerable symbol. Only frames of symbol-level
+// findings have functions, so other traces result in a nil stack.
+// The stack is truncated to MaxCallStackFrames.
+func convertTrace(trace []*govulncheckapi.Frame) []*StackFrame {
+	var stack []*StackFrame
+	for _, fr := range trace {
+		if fr.Function == "" {
+			break
+		}
+		if len(stack) == MaxCallStackFrames {
+			break
+		}
+		sf := &StackFrame{Package: fr.Package, Function: fr.Function}
+		if fr.Receiver != "" {
+			sf.Function = fr.Receiver + "." + fr.Function
+		}
+		if p := fr.Position; p != nil && p.Line > 0 {
+			sf.Position = fmt.Sprintf("%s:%d:%d", p.Filename, p.Line, p.Column)
+		}
+		stack = append(stack, sf)
+	}
+	return stack
 }
 
 const TableName = "govulncheck"
@@ -148,10 +397,68 @@ type Result struct {
 	ScanSeconds   float64   `bigquery:"scan_seconds"`
 	// BinaryBuildSeconds is populated only in COMPARE - BINARY mode
 	BinaryBuildSeconds bq.NullFloat64 `bigquery:"build_seconds"`
-	ScanMemory         int64          `bigquery:"scan_memory"`
-	ScanMode           string         `bigquery:"scan_mode"`
-	WorkVersion                       // InferSchema flattens embedded fields
-	Vulns              []*Vuln        `bigquery:"vulns"`
+	// The Binary* fields describe the build of the scanned binary.
+	// They are populated only in COMPARE - BINARY mode. BinaryStripped
+	// is true if the binary has no symbol table; its vulnerabilities
+	// are then found at the module level only.
+	BinaryGoVersion   bq.NullString `bigquery:"binary_go_version"`
+	BinaryMainPath    bq.NullString `bigquery:"binary_main_path"`
+	BinaryMainVersion bq.NullString `bigquery:"binary_main_version"`
+	BinaryVCSRevision bq.NullString `bigquery:"binary_vcs_revision"`
+	BinaryGOOS        bq.NullString `bigquery:"binary_goos"`
+	BinaryGOARCH      bq.NullString `bigquery:"binary_goarch"`
+	BinaryBuildFlags  bq.NullString `bigquery:"binary_build_flags"`
+	BinaryStripped    bq.NullBool   `bigquery:"binary_stripped"`
+	ScanMemory        int64         `bigquery:"scan_memory"`
+	ScanMode          string        `bigquery:"scan_mode"`
+	WorkVersion                     // InferSchema flattens embedded fields
+	Vulns             []*Vuln       `bigquery:"vulns"`
+	// If the row would be too large to upload, Vulns is truncated,
+	// ResultsTruncated is true, and NumVulns is the original number
+	// of vulns. FullResultsPath is the GCS path of the complete row,
+	// if it could be saved.
+	ResultsTruncated bq.NullBool   `bigquery:"results_truncated"`
+	NumVulns         bq.NullInt64  `bigquery:"num_vulns"`
+	FullResultsPath  bq.NullString `bigquery:"full_results_path"`
+	// ImportsOnly is true if symbol analysis was skipped because
+	// the module imports no vulnerable packages. The findings are
+	// the same as those of a full scan, but ScanSeconds and ScanMemory
+	// are those of the cheaper package-level scan.
+	ImportsOnly bq.NullBool `bigquery:"imports_only"`
+	// ProxyRetries is the number of times requests to the module
+	// proxy were retried because of transient errors.
+	ProxyRetries bq.NullInt64 `bigquery:"proxy_retries"`
+	// Packages is the comma-separated list of package patterns that
+	// were scanned, if not the whole module.
+	Packages bq.NullString `bigquery:"packages"`
+	// InstanceID is the ID of the Cloud Run instance that wrote the row.
+	InstanceID bq.NullString `bigquery:"instance_id"`
+	// LoadErrors are the errors loading the packages of the module, if
+	// any. The error of the row is still that of the whole scan.
+	LoadErrors []*LoadError `bigquery:"load_errors"`
+	// PartialLoad is true if some packages of the module could not be
+	// loaded, and only the others were scanned. It is null if all
+	// packages were loaded.
+	PartialLoad bq.NullBool `bigquery:"partial_load"`
+	// PackagesLoaded, ModulesInGraph and VulnDBEntries are the counts
+	// of ScanStats for the scan, to help explain its cost. They are null
+	// if the scan failed or was recorded before they were.
+	PackagesLoaded bq.NullInt64 `bigquery:"packages_loaded"`
+	ModulesInGraph bq.NullInt64 `bigquery:"modules_in_graph"`
+	VulnDBEntries  bq.NullInt64 `bigquery:"vulndb_entries"`
+	// TaskRetryCount and TaskExecutionCount describe the Cloud Tasks
+	// attempt that requested the scan. See queue.TaskAttempt. They are
+	// null if the scan was not requested by Cloud Tasks.
+	TaskRetryCount     bq.NullInt64 `bigquery:"task_retry_count"`
+	TaskExecutionCount bq.NullInt64 `bigquery:"task_execution_count"`
+}
+
+// SetScanCounts sets the columns of r that count the packages, modules
+// and vulndb entries of a source scan from its stats.
+func (r *Result) SetScanCounts(stats ScanStats) {
+	r.PackagesLoaded = bigquery.NullInt(stats.PackagesLoaded)
+	r.ModulesInGraph = bigquery.NullInt(stats.ModulesInGraph)
+	r.VulnDBEntries = bigquery.NullInt(stats.VulnDBEntries)
 }
 
 // WorkState returns a WorkState for the Result.
@@ -176,16 +483,206 @@ type WorkVersion struct {
 	SchemaVersion string ` bigquery:"schema_version"`
 	// When the vuln DB was last modified.
 	VulnDBLastModified time.Time `bigquery:"vulndb_last_modified"`
+	// The version of golang.org/x/vuln that the govulncheck
+	// binary was built from.
+	GovulncheckVersion bq.NullString `bigquery:"govulncheck_version"`
+	// The version of golang.org/x/vuln that govulncheck reports
+	// when run in the sandbox. It should equal GovulncheckVersion.
+	// It is empty when scans are not sandboxed.
+	SandboxGovulncheckVersion bq.NullString `bigquery:"sandbox_govulncheck_version"`
+	// The Go version the worker was built with, from runtime.Version.
+	WorkerGoVersion bq.NullString `bigquery:"worker_go_version"`
+	// The version of the Go toolchain in the sandbox, which loads
+	// the packages of modules. It is empty when scans are not
+	// sandboxed.
+	SandboxGoVersion bq.NullString `bigquery:"sandbox_go_version"`
 }
 
+// Equal reports whether v1 and v2 are the same work version.
+// Work versions recorded before the Go versions of the worker and the
+// sandbox were, which don't have them, are not equal to any other.
 func (v1 *WorkVersion) Equal(v2 *WorkVersion) bool {
 	if v1 == nil || v2 == nil {
 		return false
 	}
+	if !v1.WorkerGoVersion.Valid || !v2.WorkerGoVersion.Valid ||
+		!v1.SandboxGoVersion.Valid || !v2.SandboxGoVersion.Valid {
+		return false
+	}
 	return v1.GoVersion == v2.GoVersion &&
+		v1.WorkerGoVersion == v2.WorkerGoVersion &&
+		v1.SandboxGoVersion == v2.SandboxGoVersion &&
 		v1.WorkerVersion == v2.WorkerVersion &&
 		v1.SchemaVersion == v2.SchemaVersion &&
-		v1.VulnDBLastModified.Equal(v2.VulnDBLastModified)
+		v1.VulnDBLastModified.Equal(v2.VulnDBLastModified) &&
+		v1.GovulncheckVersion == v2.GovulncheckVersion &&
+		v1.SandboxGovulncheckVersion == v2.SandboxGovulncheckVersion
+}
+
+// vulnModulePath is the path of the module containing govulncheck.
+const vulnModulePath = "golang.org/x/vuln"
+
+// BinaryVersion returns the version of golang.org/x/vuln that
+// the govulncheck binary at govulncheckPath was built from.
+func BinaryVersion(govulncheckPath string) (_ string, err error) {
+	defer derrors.Wrap(&err, "BinaryVersion(%q)", govulncheckPath)
+	bi, err := buildinfo.ReadFile(govulncheckPath)
+	if err != nil {
+		return "", err
+	}
+	v := vulnVersion(bi)
+	if v == "" {
+		return "", fmt.Errorf("no version of %s in build info", vulnModulePath)
+	}
+	return v, nil
+}
+
+// ParseScannerVersion returns the version of golang.org/x/vuln from
+// the output of "govulncheck -version", or "" if there is none.
+func ParseScannerVersion(out []byte) string {
+	for _, line := range strings.Split(string(out), "\n") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(line), "Scanner: govulncheck@"); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// vulnVersion returns the version of golang.org/x/vuln in bi, which is
+// either the main module or a dependency, or "" if there is none.
+func vulnVersion(bi *debug.BuildInfo) string {
+	if bi.Main.Path == vulnModulePath {
+		return bi.Main.Version
+	}
+	for _, d := range bi.Deps {
+		if d.Path == vulnModulePath {
+			if d.Replace != nil {
+				d = d.Replace
+			}
+			return d.Version
+		}
+	}
+	return ""
+}
+
+// BinaryMetadata describes how a binary was built.
+type BinaryMetadata struct {
+	GoVersion   string
+	MainPath    string
+	MainVersion string
+	VCSRevision string
+	GOOS        string
+	GOARCH      string
+	// BuildFlags are the flags of the build, like -tags and -ldflags,
+	// as KEY=VALUE separated by spaces, with VALUE quoted if needed.
+	// They include those set in GOFLAGS.
+	BuildFlags string
+	// Stripped reports whether the binary has no symbol table.
+	Stripped bool
+}
+
+// ReadBinaryMetadata reads the build information of the binary at path.
+// If the binary has none, the error wraps derrors.BinaryNoBuildInfo.
+func ReadBinaryMetadata(path string) (_ *BinaryMetadata, err error) {
+	defer derrors.Wrap(&err, "ReadBinaryMetadata(%q)", path)
+	bi, err := buildinfo.ReadFile(path)
+	if err != nil {
+		var perr *fs.PathError
+		if errors.As(err, &perr) {
+			return nil, fmt.Errorf("%w: %v", derrors.ScanModuleBuildInfoError, err)
+		}
+		return nil, fmt.Errorf("%w: %v", derrors.BinaryNoBuildInfo, err)
+	}
+	md := binaryMetadata(bi)
+	md.Stripped = isStripped(path)
+	return md, nil
+}
+
+func binaryMetadata(bi *debug.BuildInfo) *BinaryMetadata {
+	md := &BinaryMetadata{
+		GoVersion:   bi.GoVersion,
+		MainPath:    bi.Main.Path,
+		MainVersion: bi.Main.Version,
+	}
+	var flags []string
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			md.VCSRevision = s.Value
+		case "GOOS":
+			md.GOOS = s.Value
+		case "GOARCH":
+			md.GOARCH = s.Value
+		case "CGO_ENABLED":
+			flags = append(flags, buildFlag(s))
+		default:
+			if strings.HasPrefix(s.Key, "-") {
+				flags = append(flags, buildFlag(s))
+			}
+		}
+	}
+	md.BuildFlags = strings.Join(flags, " ")
+	return md
+}
+
+// buildFlag formats a build setting as KEY=VALUE, quoting VALUE if it
+// is empty or has spaces, as go version -m does.
+func buildFlag(s debug.BuildSetting) string {
+	v := s.Value
+	if v == "" || strings.ContainsAny(v, " \t\"`") {
+		v = strconv.Quote(v)
+	}
+	return s.Key + "=" + v
+}
+
+// isStripped reports whether the binary at path is an ELF binary
+// without a symbol table. The binaries scanned in the sandbox are all ELF.
+func isStripped(path string) bool {
+	f, err := elf.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	_, err = f.Symbols()
+	return errors.Is(err, elf.ErrNoSymbols)
+}
+
+// binaryErrorMessages are parts of the error messages of govulncheck
+// for binaries that can never be scanned, with their errors.
+var binaryErrorMessages = []struct {
+	msg string
+	err error
+}{
+	{"not a Go executable", derrors.BinaryNoBuildInfo},
+	{"unrecognized file format", derrors.BinaryNoBuildInfo},
+	{"unrecognized executable format", derrors.BinaryNoBuildInfo},
+	{"unrecognized binary format", derrors.BinaryNoBuildInfo},
+	{"no symbol section", derrors.BinaryStripped},
+}
+
+// BinaryError returns an error wrapping derrors.BinaryNoBuildInfo or
+// derrors.BinaryStripped if msg, the error message of a scan of a binary,
+// says that the binary has no build information or no symbol table.
+// Otherwise it returns nil.
+func BinaryError(msg string) error {
+	for _, m := range binaryErrorMessages {
+		if strings.Contains(msg, m.msg) {
+			return fmt.Errorf("%w: %s", m.err, msg)
+		}
+	}
+	return nil
+}
+
+// SetBinaryMetadata populates the Binary* fields of vr from md.
+func (vr *Result) SetBinaryMetadata(md *BinaryMetadata) {
+	vr.BinaryGoVersion = bigquery.NullString(md.GoVersion)
+	vr.BinaryMainPath = bigquery.NullString(md.MainPath)
+	vr.BinaryMainVersion = bigquery.NullString(md.MainVersion)
+	vr.BinaryVCSRevision = bigquery.NullString(md.VCSRevision)
+	vr.BinaryGOOS = bigquery.NullString(md.GOOS)
+	vr.BinaryGOARCH = bigquery.NullString(md.GOARCH)
+	vr.BinaryBuildFlags = bigquery.NullString(md.BuildFlags)
+	vr.BinaryStripped = bigquery.NullBool(md.Stripped)
 }
 
 func (vr *Result) SetUploadTime(t time.Time) { vr.CreatedAt = t }
@@ -210,6 +707,39 @@ type Vuln struct {
 	// that do not exist in ecosystem metrics, we
 	// just put the review status here instead.
 	ReviewStatus bq.NullString `bigquery:"review_status"`
+	// CallStack is a call stack from the vulnerable symbol to an
+	// entry point, for symbol-level findings. When there are several,
+	// it is the shortest one, truncated to MaxCallStackFrames.
+	CallStack []*StackFrame `bigquery:"call_stack"`
+	// The Caller fields describe the call of the vulnerable symbol
+	// closest to it: the calling function and the position of the call.
+	// They are null for findings that are not symbol-level.
+	CallerPackage  bq.NullString `bigquery:"caller_package"`
+	CallerFunction bq.NullString `bigquery:"caller_function"`
+	CallerFile     bq.NullString `bigquery:"caller_file"`
+	CallerLine     bq.NullInt64  `bigquery:"caller_line"`
+	// Imported and Called are set only in rows of the COMBINED scan
+	// mode. They say whether a vulnerable package is imported, and
+	// whether a vulnerable symbol is called.
+	Imported bq.NullBool `bigquery:"imported"`
+	Called   bq.NullBool `bigquery:"called"`
+}
+
+// A LoadError is an error loading a package of a module.
+type LoadError struct {
+	// Package is the import path of the package, if it is known.
+	Package string `bigquery:"package"`
+	// Kind is the derrors category of the error, such as
+	// "LOAD NO REQUIRED MODULE".
+	Kind    string `bigquery:"kind"`
+	Message string `bigquery:"message"`
+}
+
+// A StackFrame is a frame of a call stack.
+type StackFrame struct {
+	Package  string `bigquery:"package"`
+	Function string `bigquery:"function"` // prefixed by the receiver for methods
+	Position string `bigquery:"position"` // file:line:column, if known
 }
 
 // SchemaVersion changes whenever the govulncheck schema changes.
@@ -222,6 +752,10 @@ func init() {
 	}
 	SchemaVersion = bigquery.SchemaVersion(s)
 	bigquery.AddTable(TableName, s)
+	bigquery.SetTableLayout(TableName, bigquery.TableLayout{
+		PartitionField: "created_at",
+		ClusterFields:  []string{"module_path", "scan_mode"},
+	})
 }
 
 type WorkState struct {
@@ -239,6 +773,15 @@ type ScanStats struct {
 	// *BEFORE* scanning it with govulncheck.
 	// This is only used in COMPARE - BINARY mode
 	BuildTime time.Duration
+	// PackagesLoaded is the number of dependent packages that govulncheck
+	// loaded, and ModulesInGraph the number of modules it analyzed, as
+	// reported in its progress message. PackagesLoaded is zero at the
+	// module scan level. Both are zero for binaries.
+	PackagesLoaded int
+	ModulesInGraph int
+	// VulnDBEntries is the number of vulnerability database entries
+	// that govulncheck consulted for those modules.
+	VulnDBEntries int
 }
 
 // AnalysisResponse contains the raw govulncheck result
@@ -277,6 +820,10 @@ type ComparePair struct {
 	BinaryResults AnalysisResponse
 	SourceResults AnalysisResponse
 	Error         string
+	// BinaryMetadata is the build information of the binary.
+	// If it could not be read, BinaryMetadataError is the reason.
+	BinaryMetadata      *BinaryMetadata
+	BinaryMetadataError string
 }
 
 func UnmarshalCompareResponse(output []byte) (*CompareResponse, error) {
@@ -294,40 +841,62 @@ func UnmarshalCompareResponse(output []byte) (*CompareResponse, error) {
 	return &res, nil
 }
 
-func RunGovulncheckCmd(govulncheckPath, modeFlag, pattern, moduleDir, vulndbDir string) (*AnalysisResponse, error) {
-	stdOut := bytes.Buffer{}
+// RunGovulncheckCmd runs govulncheck on patterns in moduleDir.
+// If scanLevel is not empty, it is passed as govulncheck's -scan flag.
+// If progress is non-nil, govulncheck's progress messages are written
+// to it, one per line, as they arrive.
+// The govulncheck process is killed if ctx is done before it finishes.
+func RunGovulncheckCmd(ctx context.Context, progress io.Writer, govulncheckPath, modeFlag, scanLevel string, patterns []string, moduleDir, vulndbDir string) (*AnalysisResponse, error) {
 	stdErr := bytes.Buffer{}
 	uri := "file://" + vulndbDir
 	if runtime.GOOS == "windows" {
 		uri = "file:///" + filepath.ToSlash(vulndbDir)
 	}
 	args := []string{"-mode", modeFlag, "-json", "-db", uri}
+	if scanLevel != "" {
+		args = append(args, "-scan", scanLevel)
+	}
 	if moduleDir != "" {
 		args = append(args, "-C", moduleDir)
 	}
-	args = append(args, pattern)
-	govulncheckCmd := exec.Command(govulncheckPath, args...)
+	args = append(args, patterns...)
+	govulncheckCmd := exec.CommandContext(ctx, govulncheckPath, args...)
 
-	govulncheckCmd.Stdout = &stdOut
+	// Handle govulncheck's output as it is written, so progress
+	// messages are reported while it runs.
+	handler := NewMetricsHandler()
+	handler.progress = progress
+	pr, pw := io.Pipe()
+	handled := make(chan error, 1)
+	go func() {
+		err := govulncheckapi.HandleJSON(pr, handler)
+		// Drain any remaining output so govulncheck can finish.
+		io.Copy(io.Discard, pr)
+		handled <- err
+	}()
+	govulncheckCmd.Stdout = pw
 	govulncheckCmd.Stderr = &stdErr
 
 	start := time.Now()
-	if err := govulncheckCmd.Run(); err != nil {
+	err := govulncheckCmd.Run()
+	pw.Close()
+	handleErr := <-handled
+	if err != nil {
 		return nil, errors.New(stdErr.String())
 	}
 	end := time.Now()
-
-	handler := NewMetricsHandler()
-	err := govulncheckapi.HandleJSON(&stdOut, handler)
-	if err != nil {
-		return nil, err
+	if handleErr != nil {
+		return nil, handleErr
 	}
 	return &AnalysisResponse{
 		Findings: handler.Findings(),
 		OSVs:     handler.OSVs(),
 		Stats: ScanStats{
-			ScanSeconds: end.Sub(start).Seconds(),
-			ScanMemory:  getMemoryUsage(govulncheckCmd),
+			ScanSeconds:    end.Sub(start).Seconds(),
+			ScanMemory:     getMemoryUsage(govulncheckCmd),
+			PackagesLoaded: handler.packagesLoaded,
+			ModulesInGraph: handler.modulesInGraph,
+			VulnDBEntries:  len(handler.OSVs()),
 		},
 	}, nil
 }
@@ -339,24 +908,25 @@ var getMemoryUsage = func(c *exec.Cmd) uint64 {
 
 const collName = "GovulncheckWorkStates"
 
-// SetWorkState writes the work state for modulePath@version.
-func SetWorkState(ctx context.Context, ns *fstore.Namespace, modulePath, version string, ws *WorkState) (err error) {
+// SetWorkState writes the work state for modulePath@version in the given
+// ecosystem metrics mode.
+func SetWorkState(ctx context.Context, ns *fstore.Namespace, modulePath, version, mode string, ws *WorkState) (err error) {
 	defer func() {
-		log.Debugf(ctx, "SetWorkState(%s@%s, %+v) => %v", modulePath, version, ws, err)
+		log.Debugf(ctx, "SetWorkState(%s@%s, %s, %+v) => %v", modulePath, version, mode, ws, err)
 	}()
-	dr := ns.Collection(collName).Doc(docName(modulePath, version))
+	dr := ns.Collection(collName).Doc(docName(modulePath, version, mode))
 	return fstore.Set[WorkState](ctx, dr, ws)
 }
 
-// GetWorkState reads the work state for modulePath@version.
-// If there is none, it returns (nil, nil).
-func GetWorkState(ctx context.Context, ns *fstore.Namespace, modulePath, version string) (ws *WorkState, err error) {
+// GetWorkState reads the work state for modulePath@version in the given
+// ecosystem metrics mode. If there is none, it returns (nil, nil).
+func GetWorkState(ctx context.Context, ns *fstore.Namespace, modulePath, version, mode string) (ws *WorkState, err error) {
 	defer func() {
-		log.Debugf(ctx, "GetWorkState(%s@%s) => (%+v, %v)", modulePath, version, ws, err)
+		log.Debugf(ctx, "GetWorkState(%s@%s, %s) => (%+v, %v)", modulePath, version, mode, ws, err)
 	}()
 
-	defer derrors.Wrap(&err, "ReadWorkState(%q, %q)", modulePath, version)
-	dr := ns.Collection(collName).Doc(docName(modulePath, version))
+	defer derrors.Wrap(&err, "ReadWorkState(%q, %q, %q)", modulePath, version, mode)
+	dr := ns.Collection(collName).Doc(docName(modulePath, version, mode))
 	ws, err = fstore.Get[WorkState](ctx, dr)
 	if errors.Is(err, derrors.NotFound) {
 		return nil, nil
@@ -364,8 +934,15 @@ func GetWorkState(ctx context.Context, ns *fstore.Namespace, modulePath, version
 	return ws, err
 }
 
-// docName returns a valid Firestore document name for the given module path and version.
-// It escapes slashes, since Firestore treats them specially.
-func docName(modulePath, version string) string {
-	return url.PathEscape(modulePath + "@" + version)
+// docName returns a valid Firestore document name for the given module path,
+// version and mode. It escapes slashes, since Firestore treats them specially.
+//
+// Work states for the default mode, GOVULNCHECK, have no mode in their name,
+// because they were written before work states depended on the mode.
+func docName(modulePath, version, mode string) string {
+	name := modulePath + "@" + version
+	if mode != "" && mode != ModeGovulncheck {
+		name += "/" + mode
+	}
+	return url.PathEscape(name)
 }
@@ -6,15 +6,28 @@ package govulncheck
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
 	"testing"
 	"time"
 
 	bq "cloud.google.com/go/bigquery"
 	"github.com/google/go-cmp/cmp"
 	"golang.org/x/pkgsite-metrics/internal/bigquery"
+	"golang.org/x/pkgsite-metrics/internal/buildtest"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
 	"golang.org/x/pkgsite-metrics/internal/fstore"
 	"golang.org/x/pkgsite-metrics/internal/govulncheckapi"
+	"golang.org/x/pkgsite-metrics/internal/queue"
+	"golang.org/x/pkgsite-metrics/internal/scan"
 	test "golang.org/x/pkgsite-metrics/internal/testing"
 	"google.golang.org/api/iterator"
 )
@@ -47,6 +60,25 @@ func TestConvertGovulncheckFinding(t *testing.T) {
 				},
 			},
 		}
+
+		vuln3 = &govulncheckapi.Finding{
+			OSV: osvID,
+			Trace: []*govulncheckapi.Frame{
+				{
+					Module:   "example.com/repo/module",
+					Version:  "v0.0.1",
+					Package:  "example.com/repo/module/package",
+					Function: "func",
+				},
+				{
+					Module:   "example.com/main",
+					Package:  "example.com/main/cmd",
+					Function: "Run",
+					Receiver: "*T",
+					Position: &govulncheckapi.Position{Filename: "cmd/run.go", Line: 12, Column: 3},
+				},
+			},
+		}
 	)
 	tests := []struct {
 		name     string
@@ -61,6 +93,27 @@ func TestConvertGovulncheckFinding(t *testing.T) {
 				PackagePath: "example.com/repo/module/package",
 				ModulePath:  "example.com/repo/module",
 				Version:     "v0.0.1",
+				CallStack: []*StackFrame{
+					{Package: "example.com/repo/module/package", Function: "func"},
+				},
+			},
+		},
+		{
+			name: "caller",
+			vuln: vuln3,
+			wantVuln: &Vuln{
+				ID:          "GO-YYYY-XXXX",
+				PackagePath: "example.com/repo/module/package",
+				ModulePath:  "example.com/repo/module",
+				Version:     "v0.0.1",
+				CallStack: []*StackFrame{
+					{Package: "example.com/repo/module/package", Function: "func"},
+					{Package: "example.com/main/cmd", Function: "*T.Run", Position: "cmd/run.go:12:3"},
+				},
+				CallerPackage:  bigquery.NullString("example.com/main/cmd"),
+				CallerFunction: bigquery.NullString("*T.Run"),
+				CallerFile:     bigquery.NullString("cmd/run.go"),
+				CallerLine:     bigquery.NullInt(12),
 			},
 		},
 		{
@@ -73,6 +126,11 @@ func TestConvertGovulncheckFinding(t *testing.T) {
 				Version:     "v1.0.0",
 			},
 		},
+		{
+			name:     "no trace",
+			vuln:     &govulncheckapi.Finding{OSV: osvID},
+			wantVuln: &Vuln{ID: "GO-YYYY-XXXX"},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -116,6 +174,7 @@ func TestIntegration(t *testing.T) {
 	ws := &WorkState{
 		WorkVersion: &WorkVersion{
 			GoVersion:          "go1.19.6",
+			GovulncheckVersion: bigquery.NullString("v1.0.1"),
 			WorkerVersion:      "1",
 			SchemaVersion:      "s",
 			VulnDBLastModified: tm,
@@ -150,15 +209,37 @@ func TestIntegration(t *testing.T) {
 			t.Errorf("mismatch (-want, +got):\n%s", diff)
 		}
 	})
+	t.Run("latest", func(t *testing.T) {
+		// A later row for the same module version, in another mode.
+		row2 := *row
+		row2.ScanMode = ModeBinary
+		must(client.Upload(ctx, TableName, &row2))
+		for _, test := range []struct {
+			mode string
+			want string
+		}{
+			{"", ModeBinary},
+			{ModeBinary, ModeBinary},
+			{row.ScanMode, row.ScanMode},
+		} {
+			gots, err := bigquery.ReadLatestPerModule[Result](ctx, client, TableName, bigquery.Filters{ScanMode: test.mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(gots) != 1 || gots[0].ScanMode != test.want {
+				t.Errorf("mode %q: got %d rows, want one with mode %q", test.mode, len(gots), test.want)
+			}
+		}
+	})
 	t.Run("work states", func(t *testing.T) {
 		ns, err := fstore.OpenNamespace(ctx, projectID, "testing")
 		if err != nil {
 			t.Fatal(err)
 		}
-		if err := SetWorkState(ctx, ns, "example.com/mod", "v1.0.0", ws); err != nil {
+		if err := SetWorkState(ctx, ns, "example.com/mod", "v1.0.0", ModeGovulncheck, ws); err != nil {
 			t.Fatal(err)
 		}
-		got, err := GetWorkState(ctx, ns, "example.com/mod", "v1.0.0")
+		got, err := GetWorkState(ctx, ns, "example.com/mod", "v1.0.0", ModeGovulncheck)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -167,7 +248,7 @@ func TestIntegration(t *testing.T) {
 		}
 
 		// GetWorkState returns nil if the WorkState doesn't exist.
-		got, err = GetWorkState(ctx, ns, "example.com/mod", "v1.2.3")
+		got, err = GetWorkState(ctx, ns, "example.com/mod", "v1.2.3", ModeGovulncheck)
 		if got != nil || err != nil {
 			t.Errorf("got (%v, %v), want (nil, nil)", got, err)
 		}
@@ -193,3 +274,400 @@ func readTable[T any](ctx context.Context, table *bq.Table, newT func() *T) ([]*
 	}
 	return ts, nil
 }
+
+func TestTableMetadata(t *testing.T) {
+	got := bigquery.TableMetadata(TableName)
+	want := &bq.TimePartitioning{Type: bq.DayPartitioningType, Field: "created_at"}
+	if diff := cmp.Diff(want, got.TimePartitioning); diff != "" {
+		t.Errorf("partitioning mismatch (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(&bq.Clustering{Fields: []string{"module_path", "scan_mode"}}, got.Clustering); diff != "" {
+		t.Errorf("clustering mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestConvertTrace(t *testing.T) {
+	trace := []*govulncheckapi.Frame{
+		{Package: "v/p", Function: "F", Receiver: "*T", Position: &govulncheckapi.Position{Filename: "t.go", Line: 3, Column: 7}},
+		{Package: "m/q", Function: "G"},
+	}
+	got := convertTrace(trace)
+	want := []*StackFrame{
+		{Package: "v/p", Function: "*T.F", Position: "t.go:3:7"},
+		{Package: "m/q", Function: "G"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+
+	var long []*govulncheckapi.Frame
+	for i := 0; i < MaxCallStackFrames+5; i++ {
+		long = append(long, &govulncheckapi.Frame{Package: "p", Function: fmt.Sprintf("F%d", i)})
+	}
+	if got := len(convertTrace(long)); got != MaxCallStackFrames {
+		t.Errorf("long trace: got %d frames, want %d", got, MaxCallStackFrames)
+	}
+}
+
+func TestVulnVersion(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		bi   *debug.BuildInfo
+		want string
+	}{
+		{
+			name: "main",
+			bi:   &debug.BuildInfo{Main: debug.Module{Path: "golang.org/x/vuln", Version: "v1.0.1"}},
+			want: "v1.0.1",
+		},
+		{
+			name: "dep",
+			bi: &debug.BuildInfo{
+				Main: debug.Module{Path: "golang.org/x/pkgsite-metrics"},
+				Deps: []*debug.Module{{Path: "golang.org/x/mod", Version: "v0.12.0"}, {Path: "golang.org/x/vuln", Version: "v1.0.0"}},
+			},
+			want: "v1.0.0",
+		},
+		{
+			name: "replaced",
+			bi: &debug.BuildInfo{
+				Deps: []*debug.Module{{Path: "golang.org/x/vuln", Version: "v1.0.0", Replace: &debug.Module{Path: "golang.org/x/vuln", Version: "v1.0.2"}}},
+			},
+			want: "v1.0.2",
+		},
+		{
+			name: "none",
+			bi:   &debug.BuildInfo{Main: debug.Module{Path: "golang.org/x/pkgsite-metrics"}},
+			want: "",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := vulnVersion(test.bi); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWorkVersionEqual(t *testing.T) {
+	tm := time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)
+	wv := &WorkVersion{
+		GoVersion:          "go1.23.0",
+		WorkerVersion:      "1",
+		SchemaVersion:      "s",
+		VulnDBLastModified: tm,
+		GovulncheckVersion: bigquery.NullString("v1.1.3"),
+		WorkerGoVersion:    bigquery.NullString("go1.23.0"),
+		SandboxGoVersion:   bigquery.NullString("go1.23.0"),
+	}
+	with := func(f func(*WorkVersion)) *WorkVersion {
+		v := *wv
+		f(&v)
+		return &v
+	}
+	for _, test := range []struct {
+		name string
+		v    *WorkVersion
+		want bool
+	}{
+		{"same", with(func(*WorkVersion) {}), true},
+		{"nil", nil, false},
+		{"worker go", with(func(v *WorkVersion) { v.WorkerGoVersion = bigquery.NullString("go1.23.1") }), false},
+		{"sandbox go", with(func(v *WorkVersion) { v.SandboxGoVersion = bigquery.NullString("go1.23.1") }), false},
+		{"not sandboxed", with(func(v *WorkVersion) { v.SandboxGoVersion = bigquery.NullString("") }), false},
+		// Work versions stored before the Go versions were recorded are stale.
+		{"no go versions", with(func(v *WorkVersion) {
+			v.WorkerGoVersion = bq.NullString{}
+			v.SandboxGoVersion = bq.NullString{}
+		}), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := wv.Equal(test.v); got != test.want {
+				t.Errorf("got %t, want %t", got, test.want)
+			}
+			if got := test.v.Equal(wv); got != test.want {
+				t.Errorf("reversed: got %t, want %t", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBatchRequestRoundTrip(t *testing.T) {
+	br := &BatchRequest{
+		Modules: []scan.ModuleSpec{
+			{Path: "example.com/a", Version: "v1.0.0", ImportedBy: 3},
+			{Path: "example.com/b", Version: "v0.2.0", ImportedBy: 0},
+		},
+		QueryParams: QueryParams{Mode: "GOVULNCHECK", Insecure: true},
+	}
+	r := httptest.NewRequest(http.MethodPost, "/govulncheck/scan/"+br.Path()+"?"+br.Params(), nil)
+	got, err := ParseBatchRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(br, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+	reqs := got.Requests()
+	if len(reqs) != 2 || reqs[0].ImportedBy != 3 || reqs[1].Module != "example.com/b" || reqs[1].Mode != "GOVULNCHECK" {
+		t.Errorf("Requests: got %+v", reqs)
+	}
+
+	// A retry of the task records its attempt.
+	r.Header.Set("X-CloudTasks-TaskName", "batch-task")
+	r.Header.Set("X-CloudTasks-TaskRetryCount", "2")
+	r.Header.Set("X-CloudTasks-TaskExecutionCount", "1")
+	got, err = ParseBatchRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantAttempt := queue.TaskAttempt{RetryCount: 2, ExecutionCount: 1, TaskName: "batch-task"}
+	if a := got.Requests()[1].Attempt; a == nil || *a != wantAttempt {
+		t.Errorf("Attempt: got %+v, want %+v", a, wantAttempt)
+	}
+
+	for _, mods := range []string{"", "example.com/a@v1.0.0", "example.com/a:1", "example.com/a@v1:x"} {
+		r := httptest.NewRequest(http.MethodPost, "/govulncheck/scan/batch?modules="+url.QueryEscape(mods), nil)
+		if _, err := ParseBatchRequest(r); err == nil {
+			t.Errorf("%q: got nil error, want error", mods)
+		}
+	}
+}
+
+func TestDocName(t *testing.T) {
+	for _, test := range []struct {
+		mode string
+		want string
+	}{
+		{"", "example.com%2Fm@v1.0.0"},
+		{ModeGovulncheck, "example.com%2Fm@v1.0.0"},
+		{"COMPARE", "example.com%2Fm@v1.0.0%2FCOMPARE"},
+	} {
+		if got := docName("example.com/m", "v1.0.0", test.mode); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.mode, got, test.want)
+		}
+	}
+}
+
+func TestBinaryMetadata(t *testing.T) {
+	bi := &debug.BuildInfo{
+		GoVersion: "go1.21.1",
+		Main:      debug.Module{Path: "example.com/m", Version: "v1.2.3"},
+		Settings: []debug.BuildSetting{
+			{Key: "-ldflags", Value: "-s -w"},
+			{Key: "-tags", Value: "netgo"},
+			{Key: "-trimpath", Value: "true"},
+			{Key: "CGO_ENABLED", Value: "0"},
+			{Key: "GOARCH", Value: "amd64"},
+			{Key: "GOOS", Value: "linux"},
+			{Key: "vcs.revision", Value: "abc123"},
+		},
+	}
+	got := binaryMetadata(bi)
+	want := &BinaryMetadata{
+		GoVersion:   "go1.21.1",
+		MainPath:    "example.com/m",
+		MainVersion: "v1.2.3",
+		VCSRevision: "abc123",
+		GOOS:        "linux",
+		GOARCH:      "amd64",
+		BuildFlags:  `-ldflags="-s -w" -tags=netgo -trimpath=true CGO_ENABLED=0`,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+
+	if _, err := ReadBinaryMetadata("govulncheck_test.go"); !errors.Is(err, derrors.BinaryNoBuildInfo) {
+		t.Errorf("got %v, want BinaryNoBuildInfo", err)
+	}
+	if _, err := ReadBinaryMetadata("nonexistent"); !errors.Is(err, derrors.ScanModuleBuildInfoError) {
+		t.Errorf("got %v, want ScanModuleBuildInfoError", err)
+	}
+}
+
+func TestReadBinaryMetadataStripped(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("stripped binaries are only detected for ELF")
+	}
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"go.mod":  "module example.com/m\n",
+		"main.go": "package main\nfunc main() {}\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, test := range []struct {
+		goflags      string
+		wantStripped bool
+	}{
+		{"-trimpath", false},
+		{"-trimpath -ldflags=-s", true},
+	} {
+		md, err := ReadBinaryMetadata(buildtest.GoBuild(t, dir, "", "GOFLAGS", test.goflags))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if md.Stripped != test.wantStripped {
+			t.Errorf("%s: got stripped %t, want %t", test.goflags, md.Stripped, test.wantStripped)
+		}
+		if !strings.Contains(md.BuildFlags, "-trimpath=true") {
+			t.Errorf("%s: got build flags %q, want them to include -trimpath=true", test.goflags, md.BuildFlags)
+		}
+		var row Result
+		row.SetBinaryMetadata(md)
+		if want := bigquery.NullBool(test.wantStripped); row.BinaryStripped != want || row.Error != "" {
+			t.Errorf("%s: got row stripped %v, error %q; want %v, no error", test.goflags, row.BinaryStripped, row.Error, want)
+		}
+	}
+}
+
+func TestBinaryError(t *testing.T) {
+	for _, test := range []struct {
+		msg  string
+		want error
+	}{
+		{"govulncheck: /tmp/bin: not a Go executable", derrors.BinaryNoBuildInfo},
+		{"unrecognized binary format", derrors.BinaryNoBuildInfo},
+		{"reading runtime.text: no symbol section", derrors.BinaryStripped},
+		{"go build failed", nil},
+	} {
+		got := BinaryError(test.msg)
+		if test.want == nil {
+			if got != nil {
+				t.Errorf("%q: got %v, want nil", test.msg, got)
+			}
+		} else if !errors.Is(got, test.want) {
+			t.Errorf("%q: got %v, want %v", test.msg, got, test.want)
+		}
+	}
+}
+
+func TestParseRequestPackages(t *testing.T) {
+	for _, test := range []struct {
+		packages string
+		want     []string
+		wantErr  bool
+	}{
+		{"", []string{"./..."}, false},
+		{"./cmd/...", []string{"./cmd/..."}, false},
+		{"./cmd/...,./pkg/a", []string{"./cmd/...", "./pkg/a"}, false},
+		{"./cmd/...,", nil, true},
+		{"-tags=x", nil, true},
+		{"./a ./b", nil, true},
+	} {
+		u := "/govulncheck/scan/example.com/m@v1.0.0?importedby=1&packages=" + url.QueryEscape(test.packages)
+		r := httptest.NewRequest(http.MethodGet, u, nil)
+		got, err := ParseRequest(r, "/govulncheck/scan")
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q: got nil error, want error", test.packages)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", test.packages, err)
+		}
+		if diff := cmp.Diff(test.want, got.PackagePatterns()); diff != "" {
+			t.Errorf("%q: mismatch (-want, +got):\n%s", test.packages, diff)
+		}
+	}
+}
+
+func TestParseVulnDB(t *testing.T) {
+	for _, test := range []struct {
+		in                     string
+		wantBucket, wantPrefix string
+		wantErr                bool
+	}{
+		{"gs://b", "b", "", false},
+		{"gs://b/snapshots/2023-04-03", "b", "snapshots/2023-04-03/", false},
+		{"gs://b/snapshots/", "b", "snapshots/", false},
+		{"gs:///x", "", "", true},
+		{"https://vuln.go.dev", "", "", true},
+	} {
+		bucket, prefix, err := ParseVulnDB(test.in)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%q: got error %v, want error %t", test.in, err, test.wantErr)
+			continue
+		}
+		if bucket != test.wantBucket || prefix != test.wantPrefix {
+			t.Errorf("%q: got (%q, %q), want (%q, %q)", test.in, bucket, prefix, test.wantBucket, test.wantPrefix)
+		}
+	}
+}
+
+func TestParseScannerVersion(t *testing.T) {
+	out := []byte("Go: go1.22.1\nScanner: govulncheck@v1.1.3\nDB: file:///app/go-vulndb\nDB updated: 2024-05-01 00:00:00 +0000 UTC\n")
+	if got, want := ParseScannerVersion(out), "v1.1.3"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := ParseScannerVersion([]byte("usage: govulncheck\n")); got != "" {
+		t.Errorf("no scanner line: got %q, want empty", got)
+	}
+}
+
+func TestMetricsHandlerCounts(t *testing.T) {
+	for _, test := range []struct {
+		msg                string
+		wantPkgs, wantMods int
+	}{
+		{"Scanning your code and 46 packages across 9 dependent modules for known vulnerabilities...", 46, 9},
+		{"Scanning your code and 1 package across 1 dependent module for known vulnerabilities...", 1, 1},
+		{"Scanning your code across 3 dependent modules for known vulnerabilities...", 0, 3},
+		{"Fetching vulnerabilities from the database...", 0, 0},
+	} {
+		stream := fmt.Sprintf(`{"config": {"protocol_version": "v1.0.0"}}
+{"progress": {"message": %q}}
+{"osv": {"id": "GO-2021-0113"}}
+{"osv": {"id": "GO-2022-0969"}}
+`, test.msg)
+		h := NewMetricsHandler()
+		if err := govulncheckapi.HandleJSON(strings.NewReader(stream), h); err != nil {
+			t.Fatal(err)
+		}
+		if h.packagesLoaded != test.wantPkgs || h.modulesInGraph != test.wantMods {
+			t.Errorf("%q: got %d packages, %d modules; want %d, %d", test.msg, h.packagesLoaded, h.modulesInGraph, test.wantPkgs, test.wantMods)
+		}
+		if got := len(h.OSVs()); got != 2 {
+			t.Errorf("%q: got %d OSVs, want 2", test.msg, got)
+		}
+	}
+}
+
+func TestUnmarshalAnalysisResponse(t *testing.T) {
+	got, err := UnmarshalAnalysisResponse([]byte(`{
+	"Findings": null,
+	"OSVs": {},
+	"Stats": {"ScanSeconds": 1.5, "ScanMemory": 100, "BuildTime": 0, "PackagesLoaded": 46, "ModulesInGraph": 9, "VulnDBEntries": 3}
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ScanStats{ScanSeconds: 1.5, ScanMemory: 100, PackagesLoaded: 46, ModulesInGraph: 9, VulnDBEntries: 3}
+	if diff := cmp.Diff(want, got.Stats); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+
+	// Sandboxes that predate the counts don't write them.
+	got, err = UnmarshalAnalysisResponse([]byte(`{"Stats": {"ScanSeconds": 1.5, "ScanMemory": 100}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(ScanStats{ScanSeconds: 1.5, ScanMemory: 100}, got.Stats); diff != "" {
+		t.Errorf("old response mismatch (-want, +got):\n%s", diff)
+	}
+
+	if _, err := UnmarshalAnalysisResponse([]byte(`{"Error": "boom"}`)); err == nil || err.Error() != "boom" {
+		t.Errorf("got %v, want error boom", err)
+	}
+}
+
+func TestSetScanCounts(t *testing.T) {
+	var r Result
+	r.SetScanCounts(ScanStats{PackagesLoaded: 46, ModulesInGraph: 9, VulnDBEntries: 3})
+	if r.PackagesLoaded != bigquery.NullInt(46) || r.ModulesInGraph != bigquery.NullInt(9) || r.VulnDBEntries != bigquery.NullInt(3) {
+		t.Errorf("got %v, %v, %v", r.PackagesLoaded, r.ModulesInGraph, r.VulnDBEntries)
+	}
+}
@@ -5,6 +5,11 @@
 package govulncheck
 
 import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+
 	"golang.org/x/pkgsite-metrics/internal/govulncheckapi"
 	"golang.org/x/pkgsite-metrics/internal/osv"
 )
@@ -20,6 +25,10 @@ func NewMetricsHandler() *MetricsHandler {
 type MetricsHandler struct {
 	findings []*govulncheckapi.Finding
 	osvs     map[string]*osv.Entry
+	progress io.Writer // if non-nil, progress messages are written here
+
+	// The counts of the scanning progress message.
+	packagesLoaded, modulesInGraph int
 }
 
 func (h *MetricsHandler) Config(c *govulncheckapi.Config) error {
@@ -27,9 +36,24 @@ func (h *MetricsHandler) Config(c *govulncheckapi.Config) error {
 }
 
 func (h *MetricsHandler) Progress(p *govulncheckapi.Progress) error {
+	if h.progress != nil {
+		fmt.Fprintln(h.progress, p.Message)
+	}
+	if m := scanningMessage.FindStringSubmatch(p.Message); m != nil {
+		h.packagesLoaded, _ = strconv.Atoi(m[1]) // empty at the module level
+		h.modulesInGraph, _ = strconv.Atoi(m[2])
+	}
 	return nil
 }
 
+// scanningMessage matches the progress message that govulncheck writes
+// after loading the packages and modules to scan, as in
+//
+//	Scanning your code and 46 packages across 9 dependent modules for known vulnerabilities...
+//
+// At the module scan level, the packages are not mentioned.
+var scanningMessage = regexp.MustCompile(`^Scanning your code(?: and (\d+) packages?)? across (\d+) dependent modules? `)
+
 func (h *MetricsHandler) OSV(e *osv.Entry) error {
 	h.osvs[e.ID] = e
 	return nil
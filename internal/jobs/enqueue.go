@@ -0,0 +1,113 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jobs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// An EnqueueResponse is the response of the analysis/enqueue endpoint.
+type EnqueueResponse struct {
+	// JobID is the ID of the job of the tasks, or empty if no user was
+	// given or the job could not be created.
+	JobID string `json:",omitempty"`
+	// JobError says why the job could not be created, if it couldn't.
+	// The tasks are enqueued anyway.
+	JobError    string `json:",omitempty"`
+	NumTasks    int    // number of tasks to enqueue
+	NumEnqueued int    // number of tasks enqueued; duplicates are not
+	Queue       string // name of the queue of the tasks
+	// ResultsTable is the full name of the BigQuery table that holds the
+	// results, as PROJECT.DATASET.TABLE, or empty if the results are not
+	// written to BigQuery.
+	ResultsTable string `json:",omitempty"`
+	// Error says why some tasks could not be enqueued, if any couldn't.
+	Error string `json:",omitempty"`
+}
+
+// String returns the plain-text form of r, which the endpoint wrote
+// before it wrote JSON.
+func (r *EnqueueResponse) String() string {
+	sj := ""
+	if r.JobError != "" {
+		sj = ", but could not create job: " + r.JobError
+	} else if r.JobID != "" {
+		sj = ", job ID is " + r.JobID
+	}
+	if r.Error != "" {
+		return fmt.Sprintf("enqueued %d of %d analysis tasks%s; %s", r.NumEnqueued, r.NumTasks, sj, r.Error)
+	}
+	return fmt.Sprintf("enqueued %d analysis tasks successfully%s", r.NumEnqueued, sj)
+}
+
+// MaxDryRunTasks is the maximum number of tasks listed in a
+// DryRunResponse.
+const MaxDryRunTasks = 100
+
+// A DryRunResponse is the response of an enqueue endpoint to a request
+// with dryrun=true. It describes the tasks that the request would have
+// enqueued; none are, and no job is created.
+type DryRunResponse struct {
+	// NumTasks is the number of tasks for each mode. Analysis tasks
+	// have the mode "analysis".
+	NumTasks map[string]int
+	// MinImporters is the minimum number of importers of the modules
+	// selected for each mode. Modes whose modules were listed
+	// explicitly, so that no minimum applies, are missing.
+	MinImporters map[string]int `json:",omitempty"`
+	// TaskURLs are the first MaxDryRunTasks tasks, in the order they
+	// would be enqueued, as URLs relative to the worker's URL.
+	TaskURLs []string
+	// MissingBinaries are the analysis binaries that are not in GCS.
+	// Their tasks have no binary version; an enqueue request would
+	// fail until the binaries are uploaded.
+	MissingBinaries []string `json:",omitempty"`
+}
+
+// AddTasks adds the tasks of a mode to r. The tasks are given by their
+// URLs, relative to the worker's URL. If minImporters is non-negative,
+// it is the minimum number of importers of their modules.
+func (r *DryRunResponse) AddTasks(mode string, taskURLs []string, minImporters int) {
+	if r.NumTasks == nil {
+		r.NumTasks = map[string]int{}
+	}
+	r.NumTasks[mode] += len(taskURLs)
+	if minImporters >= 0 {
+		if r.MinImporters == nil {
+			r.MinImporters = map[string]int{}
+		}
+		r.MinImporters[mode] = minImporters
+	}
+	n := min(len(taskURLs), MaxDryRunTasks-len(r.TaskURLs))
+	r.TaskURLs = append(r.TaskURLs, taskURLs[:max(n, 0)]...)
+}
+
+// String returns a plain-text summary of r.
+func (r *DryRunResponse) String() string {
+	var modes []string
+	total := 0
+	for mode, n := range r.NumTasks {
+		modes = append(modes, mode)
+		total += n
+	}
+	sort.Strings(modes)
+	var b strings.Builder
+	fmt.Fprintf(&b, "dry run: would enqueue %d tasks", total)
+	for _, mode := range modes {
+		fmt.Fprintf(&b, "\n%s: %d tasks", mode, r.NumTasks[mode])
+		if m, ok := r.MinImporters[mode]; ok {
+			fmt.Fprintf(&b, " on modules with at least %d importers", m)
+		}
+	}
+	for _, name := range r.MissingBinaries {
+		fmt.Fprintf(&b, "\nbinary %s is not in GCS", name)
+	}
+	for _, u := range r.TaskURLs {
+		fmt.Fprintf(&b, "\n%s", u)
+	}
+	return b.String()
+}
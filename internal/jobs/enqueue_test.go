@@ -0,0 +1,71 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jobs
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestEnqueueResponseString(t *testing.T) {
+	for _, test := range []struct {
+		resp EnqueueResponse
+		want string
+	}{
+		{
+			EnqueueResponse{NumTasks: 3, NumEnqueued: 2},
+			"enqueued 2 analysis tasks successfully",
+		},
+		{
+			EnqueueResponse{JobID: "u-1", NumTasks: 3, NumEnqueued: 3},
+			"enqueued 3 analysis tasks successfully, job ID is u-1",
+		},
+		{
+			EnqueueResponse{JobID: "u-1", JobError: "bad", NumTasks: 3, NumEnqueued: 1, Error: "full"},
+			"enqueued 1 of 3 analysis tasks, but could not create job: bad; full",
+		},
+	} {
+		if got := test.resp.String(); got != test.want {
+			t.Errorf("%+v: got %q, want %q", test.resp, got, test.want)
+		}
+	}
+}
+
+func TestDryRunResponse(t *testing.T) {
+	var r DryRunResponse
+	var urls []string
+	for i := 0; i < MaxDryRunTasks-1; i++ {
+		urls = append(urls, fmt.Sprintf("/govulncheck/scan/m%d@v1.0.0", i))
+	}
+	r.AddTasks("GOVULNCHECK", urls, 10)
+	r.AddTasks("IMPORTS", []string{"/govulncheck/scan/a@v1.0.0?mode=IMPORTS", "/govulncheck/scan/b@v1.0.0?mode=IMPORTS"}, -1)
+
+	if got, want := r.NumTasks, map[string]int{"GOVULNCHECK": MaxDryRunTasks - 1, "IMPORTS": 2}; !maps.Equal(got, want) {
+		t.Errorf("NumTasks: got %v, want %v", got, want)
+	}
+	if got, want := r.MinImporters, map[string]int{"GOVULNCHECK": 10}; !maps.Equal(got, want) {
+		t.Errorf("MinImporters: got %v, want %v", got, want)
+	}
+	if got, want := len(r.TaskURLs), MaxDryRunTasks; got != want {
+		t.Fatalf("got %d task URLs, want %d", got, want)
+	}
+	if got, want := r.TaskURLs[len(r.TaskURLs)-1], "/govulncheck/scan/a@v1.0.0?mode=IMPORTS"; got != want {
+		t.Errorf("last task URL: got %q, want %q", got, want)
+	}
+	if got, want := strings.SplitN(r.String(), "\n", 4)[:3], []string{
+		"dry run: would enqueue 101 tasks",
+		"GOVULNCHECK: 99 tasks on modules with at least 10 importers",
+		"IMPORTS: 2 tasks",
+	}; !slices.Equal(got, want) {
+		t.Errorf("String: got %q, want %q", got, want)
+	}
+	r.MissingBinaries = []string{"printf"}
+	if got, want := strings.Split(r.String(), "\n")[3], "binary printf is not in GCS"; got != want {
+		t.Errorf("String with a missing binary: got %q, want %q", got, want)
+	}
+}
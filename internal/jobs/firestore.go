@@ -83,6 +83,17 @@ func (d *DB) Increment(ctx context.Context, id, name string, n int) (err error)
 	return err
 }
 
+// IncrementErrorCategory increments the count of the error category
+// for the job with the given ID.
+func (d *DB) IncrementErrorCategory(ctx context.Context, id, category string) (err error) {
+	defer derrors.Wrap(&err, "job.DB.IncrementErrorCategory(%s, %q)", id, category)
+	docref := d.jobRef(id)
+	_, err = docref.Update(ctx, []firestore.Update{
+		{FieldPath: firestore.FieldPath{"ErrorCategories", category}, Value: firestore.Increment(1)},
+	})
+	return err
+}
+
 // ListJobs calls f on each job in the DB, most recently started first.
 // f is also passed the time that the job was last updated.
 // If f returns a non-nil error, the iteration stops and returns that error.
@@ -6,6 +6,7 @@
 package jobs
 
 import (
+	"strings"
 	"time"
 )
 
@@ -18,13 +19,93 @@ type Job struct {
 	BinaryVersion string // Hex-encoded hash of binary.
 	BinaryArgs    string // The args to the binary.
 	Canceled      bool   // The job was canceled.
+	ParentID      string // ID of the job whose failures this job retries, if any.
+	Notified      bool   // The notification was sent.
+	Summarized    bool   // The job's summary row was uploaded.
+	// SummaryClaimed is when a worker claimed the job's summary, which
+	// it alone then uploads. It is zero if no worker has.
+	SummaryClaimed time.Time
+	// Request is the enqueue request that created the job. Its Mode is
+	// empty for jobs created before requests were recorded. It is stored
+	// as a single field, so that its Binary is not shadowed by the job's.
+	Request `json:"Request" firestore:"Request"`
 	// Counts of tasks.
 	NumEnqueued  int // Written by enqueue endpoint.
 	NumStarted   int // Incremented at the start of a scan.
 	NumSkipped   int // Previously run, stored in BigQuery.
-	NumFailed    int // The HTTP request failed (status != 200)
+	NumFailed    int // The HTTP request failed (status != 200), or an analysis binary misbehaved
 	NumErrored   int // The HTTP request succeeded, but the scan resulted in an error.
 	NumSucceeded int
+	// Counts of failed and errored tasks, by error category
+	// (see derrors.CategorizeError).
+	ErrorCategories map[string]int
+	// The most recent failed and errored tasks, oldest first.
+	RecentFailures []*Failure
+}
+
+// A Request records the parameters of the enqueue request that created
+// a job, as the endpoint received them, so that the job can be reproduced.
+// Its fields have the names of the query params, ignoring case.
+type Request struct {
+	Mode     string  // Kind of tasks enqueued, such as "analysis".
+	Binary   string  // Comma-separated names of analysis binaries.
+	Args     string  // Args to the binaries.
+	Insecure bool    // Scans run outside the sandbox.
+	Min      int     // Minimum number of importers of the modules.
+	File     string  // File of modules; empty for the pkgsite DB.
+	Suffix   string  // Suffix of the task names.
+	SkipInit bool    // Non-module projects were not initialized.
+	Parent   string  // ID of the job whose failures were retried.
+	Priority string  // Priority of the tasks.
+	Notify   string  // URL to POST the job to when it finishes.
+	Timeout  string  // Maximum duration of each binary run.
+	Sample   float64 // Fraction of the modules sampled.
+	Seed     string  // Seed of the sample.
+}
+
+// Sampled reports whether the modules of the request were sampled.
+func (r *Request) Sampled() bool {
+	return r.Sample > 0 && r.Sample < 1
+}
+
+// A Failure describes a task that failed or resulted in an error.
+type Failure struct {
+	Module   string // module@version
+	Category string // error category (see derrors.CategorizeError)
+	Message  string // first line of the error message
+	Time     time.Time
+}
+
+// maxRecentFailures is the maximum number of failures kept on a Job,
+// to bound the size of its database record.
+const maxRecentFailures = 50
+
+// maxFailureMessageLen is the maximum length of a Failure's Message.
+const maxFailureMessageLen = 200
+
+// NewFailure returns a Failure for the module version with the given error
+// category and message, occurring at time t.
+// The message is shortened to its first line, with a bounded length.
+func NewFailure(modulePath, version, category, message string, t time.Time) *Failure {
+	message, _, _ = strings.Cut(message, "\n")
+	if len(message) > maxFailureMessageLen {
+		message = message[:maxFailureMessageLen] + "..."
+	}
+	return &Failure{
+		Module:   modulePath + "@" + version,
+		Category: category,
+		Message:  message,
+		Time:     t,
+	}
+}
+
+// AddFailure adds f to the job's recent failures, discarding the oldest
+// failure if there are too many.
+func (j *Job) AddFailure(f *Failure) {
+	j.RecentFailures = append(j.RecentFailures, f)
+	if n := len(j.RecentFailures); n > maxRecentFailures {
+		j.RecentFailures = j.RecentFailures[n-maxRecentFailures:]
+	}
 }
 
 // NewJob creates a new Job.
@@ -0,0 +1,66 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jobs
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewFailure(t *testing.T) {
+	tm := time.Date(2023, 3, 11, 1, 2, 3, 0, time.UTC)
+	f := NewFailure("m", "v1.0.0", "LOAD", "first line\nsecond line", tm)
+	want := Failure{Module: "m@v1.0.0", Category: "LOAD", Message: "first line", Time: tm}
+	if *f != want {
+		t.Errorf("got %+v, want %+v", *f, want)
+	}
+
+	f = NewFailure("m", "v1.0.0", "LOAD", strings.Repeat("x", 1000), tm)
+	if got, want := len(f.Message), maxFailureMessageLen+len("..."); got != want {
+		t.Errorf("got message length %d, want %d", got, want)
+	}
+}
+
+func TestAddFailure(t *testing.T) {
+	var j Job
+	for i := 0; i < maxRecentFailures+10; i++ {
+		j.AddFailure(&Failure{Time: time.Unix(int64(i), 0)})
+	}
+	if got, want := len(j.RecentFailures), maxRecentFailures; got != want {
+		t.Fatalf("got %d failures, want %d", got, want)
+	}
+	// The oldest failures should have been discarded.
+	if got, want := j.RecentFailures[0].Time, time.Unix(10, 0); !got.Equal(want) {
+		t.Errorf("oldest failure at %s, want %s", got, want)
+	}
+}
+
+func TestJobRequestJSON(t *testing.T) {
+	j := NewJob("u", time.Unix(0, 0), "url", "a", "hash", "")
+	j.Request = Request{Mode: "analysis", Binary: "a,b", Sample: 0.5}
+	data, err := json.Marshal(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Job
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	// The request's Binary is not shadowed by the job's.
+	if got.Binary != "a" || got.Request.Binary != "a,b" || !got.Sampled() {
+		t.Errorf("got binary %q and request %+v, want a and the original request", got.Binary, got.Request)
+	}
+
+	// Jobs created before requests were recorded have a null Request.
+	var old Job
+	if err := json.Unmarshal([]byte(`{"User":"u","Request":null}`), &old); err != nil {
+		t.Fatal(err)
+	}
+	if old.Mode != "" {
+		t.Errorf("got mode %q for a job without a request, want empty", old.Mode)
+	}
+}
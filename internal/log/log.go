@@ -28,6 +28,18 @@ func FromContext(ctx context.Context) *slog.Logger {
 	return slog.Default()
 }
 
+// labelsKey is the key under which Google Cloud logging
+// expects labels for a log entry.
+const labelsKey = "logging.googleapis.com/labels"
+
+// NewContextWithLabel returns a context whose logger adds a label with the
+// given key and value to each log entry. The label can be used to filter
+// entries in Google Cloud logging.
+func NewContextWithLabel(ctx context.Context, key, value string) context.Context {
+	l := FromContext(ctx).With(slog.Group(labelsKey, slog.String(key, value)))
+	return NewContext(ctx, l)
+}
+
 func Debug(ctx context.Context, msg string, args ...any) { FromContext(ctx).Debug(msg, args...) }
 func Info(ctx context.Context, msg string, args ...any)  { FromContext(ctx).Info(msg, args...) }
 func Warn(ctx context.Context, msg string, args ...any)  { FromContext(ctx).Warn(msg, args...) }
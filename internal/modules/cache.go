@@ -0,0 +1,270 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package modules
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+)
+
+// A Cache keeps the extracted contents of module zips on disk, so that
+// a module that is scanned several times, as in different modes, is
+// downloaded and extracted only once.
+//
+// Each module version has its own directory in the cache, holding the
+// extracted files and the hash of the zip they came from. An entry is
+// built in a temporary directory and renamed into place after the hash
+// is written, so a partial extraction is never reused.
+//
+// A Cache is safe for concurrent use.
+type Cache struct {
+	dir      string
+	maxBytes int64
+
+	// mu is held for reading while entries are added or copied, and
+	// for writing while they are removed by Trim.
+	mu sync.RWMutex
+}
+
+// Names in the directory of a cache entry.
+const (
+	cacheFilesDir = "files"   // the extracted files
+	cacheHashFile = "ziphash" // the hash of the zip, as computed by hashZip
+)
+
+// cacheTempPrefix is the prefix of the directories of entries being built.
+const cacheTempPrefix = "tmp-"
+
+// NewCache returns a cache of extracted modules in dir, creating dir if
+// necessary. Trim keeps the size of the cache under maxBytes.
+func NewCache(dir string, maxBytes int64) (_ *Cache, err error) {
+	defer derrors.Wrap(&err, "NewCache(%q)", dir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &Cache{dir: dir, maxBytes: maxBytes}, nil
+}
+
+// Dir returns the directory of the cache.
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
+// entryDir returns the directory of the entry for modulePath at version.
+// The module path and version are escaped as in proxy URLs, so that
+// paths that differ only in case have different entries.
+func (c *Cache) entryDir(modulePath, version string) (string, error) {
+	escapedPath, err := module.EscapePath(modulePath)
+	if err != nil {
+		return "", err
+	}
+	escapedVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(c.dir, url.PathEscape(escapedPath+"@"+escapedVersion)), nil
+}
+
+// copyTo copies the files of modulePath at version from c to dir, and
+// reports whether c has them. If checksumDB is non-nil, an entry whose
+// zip hash doesn't match the checksum database is removed instead of
+// being used.
+func (c *Cache) copyTo(modulePath, version, dir string, checksumDB *ChecksumDB) (_ bool, err error) {
+	defer derrors.Wrap(&err, "Cache.copyTo(%q, %q)", modulePath, version)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	edir, err := c.entryDir(modulePath, version)
+	if err != nil {
+		return false, err
+	}
+	hash, err := os.ReadFile(filepath.Join(edir, cacheHashFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if checksumDB != nil {
+		if err := checksumDB.verifyHash(modulePath, version, string(hash)); err != nil {
+			if errors.Is(err, derrors.ChecksumMismatchError) {
+				return false, errors.Join(err, os.RemoveAll(edir))
+			}
+			return false, err
+		}
+	}
+	// The modification time of the hash file is the entry's last use.
+	now := time.Now()
+	if err := os.Chtimes(filepath.Join(edir, cacheHashFile), now, now); err != nil {
+		return false, err
+	}
+	if err := copyTree(filepath.Join(edir, cacheFilesDir), dir); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// add extracts zipr, the zip of modulePath at version whose hash is
+// hash, into c. If another goroutine adds the same module version
+// first, add leaves its entry alone.
+func (c *Cache) add(modulePath, version string, zipr *zip.Reader, hash string) (err error) {
+	defer derrors.Wrap(&err, "Cache.add(%q, %q)", modulePath, version)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	edir, err := c.entryDir(modulePath, version)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(c.dir, cacheTempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp) // does nothing once tmp is renamed
+	files := filepath.Join(tmp, cacheFilesDir)
+	if err := os.Mkdir(files, os.ModePerm); err != nil {
+		return err
+	}
+	if err := writeZip(zipr, files, modulePath+"@"+version+"/"); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(tmp, cacheHashFile), []byte(hash), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, edir); err != nil {
+		if _, serr := os.Stat(filepath.Join(edir, cacheHashFile)); serr == nil {
+			return nil // added concurrently
+		}
+		return err
+	}
+	return nil
+}
+
+// Trim removes the least recently used entries of c until the cache
+// takes at most its maximum number of bytes. It also removes what is
+// left of extractions that did not finish.
+func (c *Cache) Trim() error {
+	return c.trim(c.maxBytes)
+}
+
+// Clear removes all the entries of c.
+func (c *Cache) Clear() error {
+	return c.trim(0)
+}
+
+func (c *Cache) trim(maxBytes int64) (err error) {
+	defer derrors.Wrap(&err, "Cache.trim(%d)", maxBytes)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	des, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	type entry struct {
+		dir  string
+		size int64
+		used time.Time
+	}
+	var (
+		entries []entry
+		total   int64
+	)
+	for _, de := range des {
+		dir := filepath.Join(c.dir, de.Name())
+		info, err := os.Stat(filepath.Join(dir, cacheHashFile))
+		if err != nil {
+			// No entry is being built while c.mu is held, so this
+			// is left from one that failed.
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+			continue
+		}
+		size, err := treeSize(dir)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{dir, size, info.ModTime()})
+		total += size
+	}
+	slices.SortFunc(entries, func(a, b entry) int { return a.used.Compare(b.used) })
+	for _, e := range entries {
+		if total <= maxBytes {
+			break
+		}
+		if err := os.RemoveAll(e.dir); err != nil {
+			return err
+		}
+		total -= e.size
+	}
+	return nil
+}
+
+// copyTree copies the directories and regular files in src to dst.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, os.ModePerm)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return copyFile(path, target, info.Mode())
+	})
+}
+
+func copyFile(src, dst string, mode fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// treeSize returns the total size of the regular files in dir.
+func treeSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
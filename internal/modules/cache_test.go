@@ -0,0 +1,145 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package modules
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/proxy/proxytest"
+)
+
+func TestDownloadCache(t *testing.T) {
+	ctx := context.Background()
+	const modulePath, version = "example.com/m", "v1.0.0"
+	client, cleanup := proxytest.SetupTestClient(t, []*proxytest.Module{{
+		ModulePath: modulePath,
+		Version:    version,
+		Files: map[string]string{
+			"go.mod":             "module " + modulePath,
+			"m.go":               "package m",
+			"vendor/modules.txt": "",
+		},
+	}})
+	defer cleanup()
+	// A proxy without the module, to check that it comes from the cache.
+	emptyClient, emptyCleanup := proxytest.SetupTestClient(t, nil)
+	defer emptyCleanup()
+
+	cache, err := NewCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	download := func(t *testing.T, c *Cache) (string, error) {
+		t.Helper()
+		dir := filepath.Join(t.TempDir(), "m")
+		_, err := Download(ctx, modulePath, version, dir, client, nil, c)
+		return dir, err
+	}
+	checkFiles := func(t *testing.T, dir string) {
+		t.Helper()
+		if data, err := os.ReadFile(filepath.Join(dir, "m.go")); err != nil || string(data) != "package m" {
+			t.Errorf("m.go: got %q, %v", data, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "vendor")); err == nil {
+			t.Error("vendor directory was written")
+		}
+	}
+
+	dir, err := download(t, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir)
+	// Changes to the copy, as by "go mod tidy", don't reach the cache.
+	if err := os.WriteFile(filepath.Join(dir, "m.go"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client = emptyClient
+	dir, err = download(t, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, dir)
+
+	// An entry without its zip hash, as left by an extraction that
+	// did not finish, is not used.
+	edir, err := cache.entryDir(modulePath, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(edir, cacheHashFile)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := download(t, cache); !errors.Is(err, derrors.ProxyError) {
+		t.Errorf("partial entry: got %v, want a proxy error", err)
+	}
+	if err := cache.Trim(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(cache.Dir()); len(entries) != 0 {
+		t.Errorf("partial entry not removed by Trim")
+	}
+}
+
+func TestCacheTrim(t *testing.T) {
+	ctx := context.Background()
+	var modules []*proxytest.Module
+	for _, path := range []string{"example.com/a", "example.com/b", "example.com/c"} {
+		modules = append(modules, &proxytest.Module{
+			ModulePath: path,
+			Version:    "v1.0.0",
+			Files:      map[string]string{"go.mod": "module " + path, "data.txt": "0123456789"},
+		})
+	}
+	client, cleanup := proxytest.SetupTestClient(t, modules)
+	defer cleanup()
+
+	cache, err := NewCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(-time.Hour)
+	for i, m := range modules {
+		if _, err := Download(ctx, m.ModulePath, m.Version, t.TempDir(), client, nil, cache); err != nil {
+			t.Fatal(err)
+		}
+		// Make the entries' last uses a, c, b, from oldest to newest.
+		used := start.Add(time.Duration([]int{0, 2, 1}[i]) * time.Minute)
+		edir, _ := cache.entryDir(m.ModulePath, m.Version)
+		if err := os.Chtimes(filepath.Join(edir, cacheHashFile), used, used); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entrySize, err := treeSize(filepath.Join(cache.Dir(), "example.com%2Fa@v1.0.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cached := func(path string) bool {
+		edir, _ := cache.entryDir(path, "v1.0.0")
+		_, err := os.Stat(edir)
+		return err == nil
+	}
+	cache.maxBytes = 2 * entrySize
+	if err := cache.Trim(); err != nil {
+		t.Fatal(err)
+	}
+	if cached("example.com/a") || !cached("example.com/b") || !cached("example.com/c") {
+		t.Error("Trim did not remove only the least recently used entry")
+	}
+	if err := cache.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if cached("example.com/b") || cached("example.com/c") {
+		t.Error("Clear left entries")
+	}
+}
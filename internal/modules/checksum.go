@@ -0,0 +1,221 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package modules
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/dirhash"
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/log"
+)
+
+// A ChecksumDB verifies module zips against a checksum database,
+// like the go command does with GOSUMDB.
+type ChecksumDB struct {
+	client *sumdb.Client
+
+	// Module path prefix patterns, as in GONOSUMDB, of modules that
+	// are not verified.
+	noSumDB string
+}
+
+// NewChecksumDB returns a ChecksumDB for the database described by
+// db, which has the form of GOSUMDB: the database's verifier key,
+// optionally followed by a space and the URL to use to reach it.
+// The default URL is "https://" followed by the database's name.
+func NewChecksumDB(db string) (_ *ChecksumDB, err error) {
+	defer derrors.Wrap(&err, "NewChecksumDB(%q)", db)
+	key, url, _ := strings.Cut(strings.TrimSpace(db), " ")
+	verifier, err := note.NewVerifier(key)
+	if err != nil {
+		return nil, err
+	}
+	if url == "" {
+		url = "https://" + verifier.Name()
+	}
+	ops := &sumdbOps{
+		key:    key,
+		url:    strings.TrimSuffix(strings.TrimSpace(url), "/"),
+		client: &http.Client{Timeout: sumdbTimeout},
+		config: map[string][]byte{},
+		cache:  map[string][]byte{},
+	}
+	return &ChecksumDB{client: sumdb.NewClient(ops)}, nil
+}
+
+// WithNoSumDB returns a ChecksumDB that does not verify the zips of
+// modules whose paths match patterns, a comma-separated list of glob
+// patterns of module path prefixes, like GONOSUMDB and GOPRIVATE.
+func (db *ChecksumDB) WithNoSumDB(patterns string) *ChecksumDB {
+	db2 := *db
+	db2.noSumDB = patterns
+	return &db2
+}
+
+// Verify checks that the hash of the zip of module at version, as
+// downloaded from a proxy, matches the hash in the checksum database.
+// If it doesn't, or the database has no hash for it, the error wraps
+// derrors.ChecksumMismatchError. If the database can't be read, the
+// error wraps derrors.ChecksumDBError.
+func (db *ChecksumDB) Verify(module, version string, zipr *zip.Reader) (err error) {
+	defer derrors.Wrap(&err, "ChecksumDB.Verify(%q, %q)", module, version)
+	hash, err := hashZip(zipr)
+	if err != nil {
+		return err
+	}
+	return db.verifyHash(module, version, hash)
+}
+
+// verifyHash checks that hash, computed by hashZip, is the hash of the
+// zip of module at version in the checksum database.
+func (db *ChecksumDB) verifyHash(module, version, hash string) error {
+	if db.skips(module) {
+		return nil
+	}
+	lines, err := db.client.Lookup(module, version)
+	if err != nil {
+		return lookupError(err)
+	}
+	prefix := module + " " + version + " "
+	for _, line := range lines {
+		if want, ok := strings.CutPrefix(line, prefix); ok {
+			if hash != want {
+				return fmt.Errorf("%w: downloaded zip has hash %s, checksum database has %s",
+					derrors.ChecksumMismatchError, hash, want)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: checksum database has no hash for the zip of %s@%s",
+		derrors.ChecksumMismatchError, module, version)
+}
+
+// errNotInSumDB is returned by sumdbOps.ReadRemote when the checksum
+// database doesn't have what was asked for.
+var errNotInSumDB = errors.New("not in checksum database")
+
+// lookupError categorizes err, from sumdb.Client.Lookup. The client
+// formats the errors of sumdbOps with %v, so they are recognized from
+// their messages. A module version that is not in the database can't
+// be verified; other failures are problems with the database, or with
+// reaching it.
+func lookupError(err error) error {
+	if strings.Contains(err.Error(), errNotInSumDB.Error()) {
+		return fmt.Errorf("%w: %v", derrors.ChecksumMismatchError, err)
+	}
+	return fmt.Errorf("%w: %v", derrors.ChecksumDBError, err)
+}
+
+// skips reports whether db does not verify the zips of modulePath.
+func (db *ChecksumDB) skips(modulePath string) bool {
+	return db.noSumDB != "" && module.MatchPrefixPatterns(db.noSumDB, modulePath)
+}
+
+// hashZip returns the hash of the files in zipr, as the go command
+// computes it for go.sum.
+func hashZip(zipr *zip.Reader) (string, error) {
+	files := map[string]*zip.File{}
+	var names []string
+	for _, f := range zipr.File {
+		files[f.Name] = f
+		names = append(names, f.Name)
+	}
+	return dirhash.Hash1(names, func(name string) (io.ReadCloser, error) {
+		return files[name].Open()
+	})
+}
+
+// sumdbTimeout is the maximum duration of a request to the checksum database.
+const sumdbTimeout = time.Minute
+
+// maxSumdbCacheEntries is the number of cached tiles and lookups above
+// which the cache is emptied.
+const maxSumdbCacheEntries = 10_000
+
+// sumdbOps implements sumdb.ClientOps, keeping the client's
+// configuration and cache in memory.
+type sumdbOps struct {
+	key    string
+	url    string
+	client *http.Client
+
+	mu     sync.Mutex
+	config map[string][]byte
+	cache  map[string][]byte
+}
+
+func (o *sumdbOps) ReadRemote(path string) ([]byte, error) {
+	resp, err := o.client.Get(o.url + path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusGone:
+		return nil, fmt.Errorf("GET %s%s: %s: %w", o.url, path, resp.Status, errNotInSumDB)
+	default:
+		return nil, fmt.Errorf("GET %s%s: %s", o.url, path, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (o *sumdbOps) ReadConfig(file string) ([]byte, error) {
+	if file == "key" {
+		return []byte(o.key), nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	// A missing file is empty: the client starts with an empty tree.
+	return o.config[file], nil
+}
+
+func (o *sumdbOps) WriteConfig(file string, old, new []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if string(o.config[file]) != string(old) {
+		return sumdb.ErrWriteConflict
+	}
+	o.config[file] = new
+	return nil
+}
+
+func (o *sumdbOps) ReadCache(file string) ([]byte, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if data, ok := o.cache[file]; ok {
+		return data, nil
+	}
+	return nil, fmt.Errorf("%s not cached", file)
+}
+
+func (o *sumdbOps) WriteCache(file string, data []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.cache) >= maxSumdbCacheEntries {
+		o.cache = map[string][]byte{}
+	}
+	o.cache[file] = data
+}
+
+func (o *sumdbOps) Log(msg string) {
+	log.Debugf(context.Background(), "checksum database: %s", msg)
+}
+
+func (o *sumdbOps) SecurityError(msg string) {
+	log.Errorf(context.Background(), fmt.Errorf("%s", msg), "checksum database security error")
+}
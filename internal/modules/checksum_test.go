@@ -0,0 +1,127 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package modules
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/proxy"
+	"golang.org/x/pkgsite-metrics/internal/proxy/proxytest"
+)
+
+func TestDownloadVerify(t *testing.T) {
+	ctx := context.Background()
+	const modulePath, version = "example.com/m", "v1.0.0"
+	newProxy := func(code string) *proxy.Client {
+		client, cleanup := proxytest.SetupTestClient(t, []*proxytest.Module{{
+			ModulePath: modulePath,
+			Version:    version,
+			Files: map[string]string{
+				"go.mod": "module " + modulePath,
+				"m.go":   code,
+			},
+		}})
+		t.Cleanup(cleanup)
+		return client
+	}
+	honest := newProxy("package m")
+	corrupt := newProxy("package m // corrupted")
+
+	// The checksum database has the hash of the honest proxy's zip.
+	zipr, err := honest.Zip(ctx, modulePath, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := hashZip(zipr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gosum := func(path, vers string) ([]byte, error) {
+		if path != modulePath || vers != version {
+			return nil, os.ErrNotExist
+		}
+		return []byte(fmt.Sprintf("%[1]s %[2]s %[3]s\n%[1]s %[2]s/go.mod %[3]s\n", path, vers, hash)), nil
+	}
+	skey, vkey, err := note.GenerateKey(rand.Reader, "sumdb.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(sumdb.NewServer(sumdb.NewTestServer(skey, gosum)))
+	defer srv.Close()
+	db, err := NewChecksumDB(vkey + " " + srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		proxy   *proxy.Client
+		db      *ChecksumDB
+		wantErr error
+	}{
+		{"verified", honest, db, nil},
+		{"corrupted", corrupt, db, derrors.ChecksumMismatchError},
+		{"not verified", corrupt, nil, nil},
+		{"private", corrupt, db.WithNoSumDB("example.com/m"), nil},
+		{"not private", corrupt, db.WithNoSumDB("*.corp.example.com,example.com/other"), derrors.ChecksumMismatchError},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			_, err := Download(ctx, modulePath, version, dir, test.proxy, test.db, nil)
+			if test.wantErr == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := os.Stat(filepath.Join(dir, "m.go")); err != nil {
+					t.Error(err)
+				}
+				return
+			}
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+				t.Errorf("module was written after a checksum mismatch")
+			}
+		})
+	}
+
+	// Lookup failures.
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	downDB, err := NewChecksumDB(vkey + " " + down.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name    string
+		db      *ChecksumDB
+		module  string
+		wantErr error
+	}{
+		{"not in database", db, "example.com/other", derrors.ChecksumMismatchError},
+		{"database down", downDB, modulePath, derrors.ChecksumDBError},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.db.verifyHash(test.module, version, hash)
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("got %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
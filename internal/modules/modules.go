@@ -21,18 +21,66 @@ import (
 )
 
 // Download fetches module at version via proxyClient and writes the modules
-// down to disk at dir.
-func Download(ctx context.Context, module, version, dir string, proxyClient *proxy.Client) error {
-	zipr, err := proxyClient.Zip(ctx, module, version)
+// down to disk at dir. Transient proxy errors are retried; Download returns
+// the number of retries. If checksumDB is non-nil, the zip is verified
+// against it before it is written, and Download fails with an error
+// wrapping derrors.ChecksumMismatchError if it doesn't match, or
+// derrors.ChecksumDBError if the database can't be read.
+// If cache is non-nil, the module is copied from it when it is there,
+// and added to it when it is downloaded.
+func Download(ctx context.Context, module, version, dir string, proxyClient *proxy.Client, checksumDB *ChecksumDB, cache *Cache) (retries int, err error) {
+	if cache != nil && copyFromCache(ctx, cache, module, version, dir, checksumDB) {
+		log.Debugf(ctx, "copied module from cache: %s@%s", module, version)
+		return 0, nil
+	}
+	var zipr *zip.Reader
+	retries, err = proxy.Retry(ctx, func() error {
+		var err error
+		zipr, err = proxyClient.Zip(ctx, module, version)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("%v: %w", err, derrors.ProxyError)
+		// Keep err's type, so a proxy.RateLimitError can be recognized.
+		return retries, fmt.Errorf("%w: %w", err, derrors.ProxyError)
+	}
+	var hash string
+	if checksumDB != nil || cache != nil {
+		hash, err = hashZip(zipr)
+		if err != nil {
+			return retries, err
+		}
+	}
+	if checksumDB != nil {
+		if err := checksumDB.verifyHash(module, version, hash); err != nil {
+			return retries, fmt.Errorf("verifying %s@%s: %w", module, version, err)
+		}
+	}
+	if cache != nil {
+		if err := cache.add(module, version, zipr, hash); err != nil {
+			log.Warnf(ctx, "adding %s@%s to the module cache: %v", module, version, err)
+		} else if copyFromCache(ctx, cache, module, version, dir, nil) {
+			return retries, nil
+		}
 	}
 	log.Debugf(ctx, "writing module zip: %s@%s", module, version)
 	stripPrefix := module + "@" + version + "/"
 	if err := writeZip(zipr, dir, stripPrefix); err != nil {
-		return fmt.Errorf("%v: %w", err, derrors.ScanModuleOSError)
+		return retries, fmt.Errorf("%v: %w", err, derrors.ScanModuleOSError)
 	}
-	return nil
+	return retries, nil
+}
+
+// copyFromCache copies module at version from cache to dir, and reports
+// whether it did. Errors are logged, and what was copied is removed,
+// so that the module can be downloaded instead.
+func copyFromCache(ctx context.Context, cache *Cache, module, version, dir string, checksumDB *ChecksumDB) bool {
+	ok, err := cache.copyTo(module, version, dir, checksumDB)
+	if err != nil {
+		log.Warnf(ctx, "module cache: %v", err)
+		os.RemoveAll(dir)
+		return false
+	}
+	return ok
 }
 
 func writeZip(r *zip.Reader, destination, stripPrefix string) error {
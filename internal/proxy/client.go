@@ -22,7 +22,9 @@ import (
 	"golang.org/x/mod/module"
 	"golang.org/x/net/context/ctxhttp"
 	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/log"
 	"golang.org/x/pkgsite-metrics/internal/version"
+	"golang.org/x/time/rate"
 )
 
 // A Client is used by the fetch service to communicate with a module
@@ -38,6 +40,19 @@ type Client struct {
 	disableFetch bool
 
 	cache *cache
+
+	// Holds module zips downloaded from the proxy; nil if there is no zip cache.
+	zipStore zipStore
+
+	// Checks zips before they are cached; nil if they are not checked.
+	verifyZip ZipVerifier
+
+	// Limits the rate of requests to the proxy; nil if there is no limit.
+	limiter *rate.Limiter
+
+	// Credentials for HTTP basic authentication; no authentication if
+	// authUser is empty.
+	authUser, authPassword string
 }
 
 // A VersionInfo contains metadata about a given version of a module.
@@ -75,6 +90,16 @@ func (c *Client) FetchDisabled() bool {
 	return c.disableFetch
 }
 
+// WithBasicAuth returns a new client that authenticates its requests
+// to the proxy with HTTP basic authentication, for proxies of private
+// modules.
+func (c *Client) WithBasicAuth(user, password string) *Client {
+	c2 := *c
+	c2.authUser = user
+	c2.authPassword = password
+	return &c2
+}
+
 // WithCache returns a new client that caches some RPCs.
 func (c *Client) WithCache() *Client {
 	c2 := *c
@@ -132,13 +157,18 @@ func (c *Client) Mod(ctx context.Context, modulePath, resolvedVersion string) (_
 // transforms that data into a *zip.Reader. <resolvedVersion> must have already
 // been resolved by first making a request to
 // $GOPROXY/<modulePath>/@v/<requestedVersion>.info to obtained the valid
-// semantic version.
+// semantic version. If c has a zip cache, the zip is read from the cache
+// when it is there, and written to it when it is downloaded.
 func (c *Client) Zip(ctx context.Context, modulePath, resolvedVersion string) (_ *zip.Reader, err error) {
 	defer derrors.WrapStack(&err, "proxy.Client.Zip(ctx, %q, %q)", modulePath, resolvedVersion)
 
 	if r := c.cache.getZip(modulePath, resolvedVersion); r != nil {
 		return r, nil
 	}
+	if r := c.readCachedZip(ctx, modulePath, resolvedVersion); r != nil {
+		c.cache.putZip(modulePath, resolvedVersion, r)
+		return r, nil
+	}
 	bodyBytes, err := c.readBody(ctx, modulePath, resolvedVersion, "zip")
 	if err != nil {
 		return nil, err
@@ -147,10 +177,67 @@ func (c *Client) Zip(ctx context.Context, modulePath, resolvedVersion string) (_
 	if err != nil {
 		return nil, fmt.Errorf("zip.NewReader: %v: %w", err, derrors.BadModule)
 	}
+	c.writeCachedZip(ctx, modulePath, resolvedVersion, bodyBytes, zipReader)
 	c.cache.putZip(modulePath, resolvedVersion, zipReader)
 	return zipReader, nil
 }
 
+// readCachedZip returns the zip of modulePath at resolvedVersion from
+// c's zip cache, or nil if it is not there. Errors reading the cache
+// are logged, not returned, so that the zip is downloaded instead.
+// A cached zip that fails verification is deleted from the cache.
+func (c *Client) readCachedZip(ctx context.Context, modulePath, resolvedVersion string) *zip.Reader {
+	if c.zipStore == nil {
+		return nil
+	}
+	name, err := zipCacheName(modulePath, resolvedVersion)
+	if err != nil {
+		return nil
+	}
+	data, err := c.zipStore.read(ctx, name)
+	if err != nil {
+		if !errors.Is(err, derrors.NotFound) {
+			log.Warnf(ctx, "reading cached zip %s: %v", name, err)
+		}
+		return nil
+	}
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err == nil && c.verifyZip != nil {
+		err = c.verifyZip(modulePath, resolvedVersion, r)
+	}
+	if err != nil {
+		log.Warnf(ctx, "cached zip %s: %v; deleting it", name, err)
+		if err := c.zipStore.delete(ctx, name); err != nil {
+			log.Warnf(ctx, "deleting cached zip %s: %v", name, err)
+		}
+		return nil
+	}
+	return r
+}
+
+// writeCachedZip writes data, the zip of modulePath at resolvedVersion
+// read by r, to c's zip cache, if it passes verification. Errors are
+// logged, since the zip can be downloaded again; the caller is
+// responsible for rejecting a zip that fails verification.
+func (c *Client) writeCachedZip(ctx context.Context, modulePath, resolvedVersion string, data []byte, r *zip.Reader) {
+	if c.zipStore == nil {
+		return
+	}
+	name, err := zipCacheName(modulePath, resolvedVersion)
+	if err != nil {
+		return
+	}
+	if c.verifyZip != nil {
+		if err := c.verifyZip(modulePath, resolvedVersion, r); err != nil {
+			log.Warnf(ctx, "not caching zip %s: %v", name, err)
+			return
+		}
+	}
+	if err := c.zipStore.write(ctx, name, data); err != nil {
+		log.Warnf(ctx, "writing cached zip %s: %v", name, err)
+	}
+}
+
 // ZipSize gets the size in bytes of the zip from the proxy, without downloading it.
 // The version must be resolved, as by a call to Client.Info.
 func (c *Client) ZipSize(ctx context.Context, modulePath, resolvedVersion string) (_ int64, err error) {
@@ -160,9 +247,16 @@ func (c *Client) ZipSize(ctx context.Context, modulePath, resolvedVersion string
 	if err != nil {
 		return 0, err
 	}
-	res, err := ctxhttp.Head(ctx, c.HTTPClient, url)
+	req, err := c.newRequest("HEAD", url)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.wait(ctx); err != nil {
+		return 0, err
+	}
+	res, err := ctxhttp.Do(ctx, c.HTTPClient, req)
 	if err != nil {
-		return 0, fmt.Errorf("ctxhttp.Head(ctx, client, %q): %v", url, err)
+		return 0, fmt.Errorf("ctxhttp.Do(ctx, client, HEAD %q): %v", url, err)
 	}
 	defer res.Body.Close()
 	if err := responseError(res, false); err != nil {
@@ -249,16 +343,19 @@ func (c *Client) executeRequest(ctx context.Context, u string, bodyFunc func(bod
 		derrors.WrapStack(&err, "executeRequest(ctx, %q)", u)
 	}()
 
-	req, err := http.NewRequest("GET", u, nil)
+	req, err := c.newRequest("GET", u)
 	if err != nil {
 		return err
 	}
 	if c.disableFetch {
 		req.Header.Set(DisableFetchHeader, "true")
 	}
+	if err := c.wait(ctx); err != nil {
+		return err
+	}
 	r, err := ctxhttp.Do(ctx, c.HTTPClient, req)
 	if err != nil {
-		return fmt.Errorf("ctxhttp.Do(ctx, client, %q): %v", u, err)
+		return fmt.Errorf("ctxhttp.Do(ctx, client, %q): %w", u, err)
 	}
 	defer r.Body.Close()
 	if err := responseError(r, c.disableFetch); err != nil {
@@ -267,11 +364,33 @@ func (c *Client) executeRequest(ctx context.Context, u string, bodyFunc func(bod
 	return bodyFunc(r.Body)
 }
 
+// newRequest returns a request to the proxy for u, with c's credentials.
+func (c *Client) newRequest(method, u string) (*http.Request, error) {
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.authUser != "" {
+		req.SetBasicAuth(c.authUser, c.authPassword)
+	}
+	return req, nil
+}
+
+// wait waits until c's rate limit allows a request to the proxy.
+func (c *Client) wait(ctx context.Context) error {
+	if c.limiter == nil {
+		return nil
+	}
+	return c.limiter.Wait(ctx)
+}
+
 // responseError translates the response status code to an appropriate error.
 func responseError(r *http.Response, fetchDisabled bool) error {
 	switch {
 	case 200 <= r.StatusCode && r.StatusCode < 300:
 		return nil
+	case r.StatusCode == http.StatusTooManyRequests:
+		return rateLimitError(r, r.Status)
 	case 500 <= r.StatusCode:
 		return derrors.ProxyError
 	case r.StatusCode == http.StatusNotFound,
@@ -289,6 +408,9 @@ func responseError(r *http.Response, fetchDisabled bool) error {
 			return fmt.Errorf("io.ReadAll: %v", err)
 		}
 		d := string(data)
+		if isRateLimitBody(d) {
+			return rateLimitError(r, d)
+		}
 		switch {
 		case strings.Contains(d, "fetch timed out"):
 			err = derrors.ProxyTimedOut
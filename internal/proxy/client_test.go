@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -386,3 +387,29 @@ func TestCache(t *testing.T) {
 		t.Errorf("got %+v first, then %+v", got, got2)
 	}
 }
+
+func TestBasicAuth(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "u" || password != "p" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"Version": "v1.0.0"}`)
+	}))
+	defer srv.Close()
+	c, err := proxy.New(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Info(ctx, testModulePath, testVersion); err == nil {
+		t.Error("without credentials: got nil, want error")
+	}
+	info, err := c.WithBasicAuth("u", "p").Info(ctx, testModulePath, testVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.Version, testVersion; got != want {
+		t.Errorf("got version %q, want %q", got, want)
+	}
+}
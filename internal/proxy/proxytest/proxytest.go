@@ -35,7 +35,7 @@ func SetupTestClient(t *testing.T, modules []*Module) (*proxy.Client, func()) {
 // server and a function to shut down the server.
 func NewClientForServer(s *Server) (*proxy.Client, func(), error) {
 	// override client.httpClient to skip TLS verification
-	httpClient, prox, serverClose := testhelper.SetupTestClientAndServer(s.mux)
+	httpClient, prox, serverClose := testhelper.SetupTestClientAndServer(s)
 	client, err := proxy.New(prox.URL)
 	if err != nil {
 		return nil, nil, err
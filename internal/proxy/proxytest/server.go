@@ -13,6 +13,7 @@ import (
 	"sync"
 	"time"
 
+	"golang.org/x/mod/module"
 	"golang.org/x/mod/semver"
 	"golang.org/x/pkgsite-metrics/internal/proxy"
 	"golang.org/x/pkgsite-metrics/internal/testing/testhelper"
@@ -25,6 +26,8 @@ type Server struct {
 	modules     map[string][]*Module
 	mux         *http.ServeMux
 	zipRequests int // number of .zip endpoint requests, for testing
+	failures    int // number of requests still to fail
+	failStatus  int // status of failed requests
 }
 
 // NewServer returns a proxy Server that serves the provided modules.
@@ -39,9 +42,26 @@ func NewServer(modules []*Module) *Server {
 	return s
 }
 
+// escapePath escapes modulePath as the proxy client does in URLs,
+// so that paths with upper-case letters are served.
+func escapePath(modulePath string) string {
+	if p, err := module.EscapePath(modulePath); err == nil {
+		return p
+	}
+	return modulePath
+}
+
+// escapeVersion escapes v as the proxy client does in URLs.
+func escapeVersion(v string) string {
+	if ev, err := module.EscapeVersion(v); err == nil {
+		return ev
+	}
+	return v
+}
+
 // handleInfo creates an info endpoint for the specified module version.
 func (s *Server) handleInfo(modulePath, resolvedVersion string, uncached bool) {
-	urlPath := fmt.Sprintf("/%s/@v/%s.info", modulePath, resolvedVersion)
+	urlPath := fmt.Sprintf("/%s/@v/%s.info", escapePath(modulePath), escapeVersion(resolvedVersion))
 	s.mux.HandleFunc(urlPath, func(w http.ResponseWriter, r *http.Request) {
 		if uncached && r.Header.Get(proxy.DisableFetchHeader) == "true" {
 			http.Error(w, "not found: temporarily unavailable", http.StatusGone)
@@ -71,7 +91,7 @@ func (s *Server) handleMod(m *Module) {
 	if goMod == "" {
 		goMod = defaultGoMod(m.ModulePath)
 	}
-	s.mux.HandleFunc(fmt.Sprintf("/%s/@v/%s.mod", m.ModulePath, m.Version),
+	s.mux.HandleFunc(fmt.Sprintf("/%s/@v/%s.mod", escapePath(m.ModulePath), escapeVersion(m.Version)),
 		func(w http.ResponseWriter, r *http.Request) {
 			http.ServeContent(w, r, m.ModulePath, time.Now(), strings.NewReader(goMod))
 		})
@@ -79,7 +99,7 @@ func (s *Server) handleMod(m *Module) {
 
 // handleZip creates a zip endpoint for the specified module version.
 func (s *Server) handleZip(m *Module) {
-	s.mux.HandleFunc(fmt.Sprintf("/%s/@v/%s.zip", m.ModulePath, m.Version),
+	s.mux.HandleFunc(fmt.Sprintf("/%s/@v/%s.zip", escapePath(m.ModulePath), escapeVersion(m.Version)),
 		func(w http.ResponseWriter, r *http.Request) {
 			s.mu.Lock()
 			s.zipRequests++
@@ -90,7 +110,7 @@ func (s *Server) handleZip(m *Module) {
 
 // handleList creates a list endpoint for the specified modulePath.
 func (s *Server) handleList(modulePath string) {
-	s.mux.HandleFunc(fmt.Sprintf("/%s/@v/list", modulePath), func(w http.ResponseWriter, r *http.Request) {
+	s.mux.HandleFunc(fmt.Sprintf("/%s/@v/list", escapePath(modulePath)), func(w http.ResponseWriter, r *http.Request) {
 		s.mu.Lock()
 		defer s.mu.Unlock()
 
@@ -132,20 +152,20 @@ func (s *Server) addModule(m *Module, hasVersions bool) {
 	if _, ok := s.modules[m.ModulePath]; !ok {
 		if hasVersions {
 			s.handleList(m.ModulePath)
-			s.handleLatest(m.ModulePath, fmt.Sprintf("/%s/@latest", m.ModulePath))
+			s.handleLatest(m.ModulePath, fmt.Sprintf("/%s/@latest", escapePath(m.ModulePath)))
 			// TODO(https://golang.org/issue/39985): Add endpoint for handling
 			// master and main versions.
 			if m.Version != "master" {
-				s.handleLatest(m.ModulePath, fmt.Sprintf("/%s/@v/master.info", m.ModulePath))
+				s.handleLatest(m.ModulePath, fmt.Sprintf("/%s/@v/master.info", escapePath(m.ModulePath)))
 			}
 			if m.Version != "main" {
-				s.handleLatest(m.ModulePath, fmt.Sprintf("/%s/@v/main.info", m.ModulePath))
+				s.handleLatest(m.ModulePath, fmt.Sprintf("/%s/@v/main.info", escapePath(m.ModulePath)))
 			}
 		} else {
-			s.mux.HandleFunc(fmt.Sprintf("/%s/@v/list", m.ModulePath), func(w http.ResponseWriter, r *http.Request) {
+			s.mux.HandleFunc(fmt.Sprintf("/%s/@v/list", escapePath(m.ModulePath)), func(w http.ResponseWriter, r *http.Request) {
 				http.ServeContent(w, r, m.ModulePath, time.Now(), strings.NewReader(""))
 			})
-			s.mux.HandleFunc(fmt.Sprintf("/%s/@latest", m.ModulePath), func(w http.ResponseWriter, r *http.Request) {
+			s.mux.HandleFunc(fmt.Sprintf("/%s/@latest", escapePath(m.ModulePath)), func(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, "not found", http.StatusGone)
 			})
 		}
@@ -161,6 +181,32 @@ func (s *Server) addModule(m *Module, hasVersions bool) {
 	})
 }
 
+// FailRequests causes the next n requests to fail with the given
+// HTTP status.
+func (s *Server) FailRequests(n, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = n
+	s.failStatus = status
+}
+
+// ServeHTTP serves the modules of s, after failing any
+// requests requested by FailRequests.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	fail := s.failures > 0
+	if fail {
+		s.failures--
+	}
+	status := s.failStatus
+	s.mu.Unlock()
+	if fail {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
 func (s *Server) ZipRequests() int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -0,0 +1,82 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/time/rate"
+)
+
+// A RateLimitError is returned when the proxy rejects a request because
+// too many requests were made. It wraps derrors.ProxyError.
+type RateLimitError struct {
+	// RetryAfter is how long the proxy asked to wait before retrying,
+	// from its Retry-After header. It is zero if the proxy didn't say.
+	RetryAfter time.Duration
+
+	msg string // the response's status or body
+}
+
+func (e *RateLimitError) Error() string {
+	s := "proxy rate limit exceeded: " + e.msg
+	if e.RetryAfter > 0 {
+		s += fmt.Sprintf(" (retry after %s)", e.RetryAfter)
+	}
+	return s
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return derrors.ProxyError
+}
+
+// isRateLimitBody reports whether the body of a 404 or 410 response
+// says that the proxy refused the request because of too many requests.
+func isRateLimitBody(body string) bool {
+	return strings.Contains(body, "too many requests")
+}
+
+// rateLimitError returns a RateLimitError for r.
+func rateLimitError(r *http.Response, msg string) *RateLimitError {
+	return &RateLimitError{
+		RetryAfter: parseRetryAfter(r.Header.Get("Retry-After"), time.Now()),
+		msg:        msg,
+	}
+}
+
+// parseRetryAfter returns the duration to wait given by the value of
+// a Retry-After header, which is either a number of seconds or a date.
+// It returns zero if the value is empty, invalid or in the past.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(secs)*time.Second, 0)
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(t.Sub(now), 0)
+	}
+	return 0
+}
+
+// WithRateLimit returns a new client that makes at most qps requests
+// per second to the proxy. The limit is shared by the new client and all
+// clients derived from it. If qps is not positive, there is no limit.
+func (c *Client) WithRateLimit(qps float64) *Client {
+	c2 := *c
+	c2.limiter = nil
+	if qps > 0 {
+		burst := max(1, int(math.Ceil(qps)))
+		c2.limiter = rate.NewLimiter(rate.Limit(qps), burst)
+	}
+	return &c2
+}
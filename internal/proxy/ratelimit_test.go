@@ -0,0 +1,92 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"-5", 0},
+		{"Thu, 01 Jun 2023 12:00:30 GMT", 30 * time.Second},
+		{"Thu, 01 Jun 2023 11:00:00 GMT", 0},
+		{"soon", 0},
+	} {
+		if got := parseRetryAfter(test.value, now); got != test.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", test.value, got, test.want)
+		}
+	}
+}
+
+func TestRateLimitError(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/example.com/gone/@v/v1.0.0.info" {
+			http.Error(w, "disabled due to too many requests", http.StatusGone)
+			return
+		}
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+	client, err := New(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		modulePath string
+		want       time.Duration
+	}{
+		{"example.com/m", 30 * time.Second},
+		{"example.com/gone", 0},
+	} {
+		_, err := client.Info(ctx, test.modulePath, "v1.0.0")
+		var rerr *RateLimitError
+		if !errors.As(err, &rerr) {
+			t.Fatalf("%s: got %v, want a RateLimitError", test.modulePath, err)
+		}
+		if rerr.RetryAfter != test.want {
+			t.Errorf("%s: got RetryAfter %s, want %s", test.modulePath, rerr.RetryAfter, test.want)
+		}
+		if IsTransient(err) {
+			t.Errorf("%s: IsTransient = true, want false", test.modulePath)
+		}
+	}
+}
+
+func TestWithRateLimit(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Version": "v1.0.0"}`))
+	}))
+	defer srv.Close()
+	client, err := New(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = client.WithRateLimit(20)
+	start := time.Now()
+	// The first 20 requests use the burst; the next 10 take half a second.
+	for range 30 {
+		if _, err := client.Info(ctx, "example.com/m", "v1.0.0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Errorf("30 requests at 20 QPS took %s, want at least 400ms", d)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+)
+
+// MaxAttempts is the maximum number of times Retry calls its function.
+const MaxAttempts = 3
+
+// RetryBackoff is the time Retry waits after the first failure.
+// It doubles after each subsequent failure.
+var RetryBackoff = time.Second
+
+// Retry calls f until it succeeds, it returns an error that is not
+// transient, or it has been called MaxAttempts times. It returns
+// the number of retries and the last error.
+func Retry(ctx context.Context, f func() error) (retries int, err error) {
+	backoff := RetryBackoff
+	for {
+		err = f()
+		if err == nil || !IsTransient(err) || retries+1 >= MaxAttempts {
+			return retries, err
+		}
+		select {
+		case <-ctx.Done():
+			return retries, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		retries++
+	}
+}
+
+// IsTransient reports whether err is a proxy error that may not happen
+// again: a server error (5xx) or a reset connection. A module that
+// is not found (404 or 410) is never transient. Neither is a
+// RateLimitError: retrying right away would make things worse, so
+// the caller should retry later, after its RetryAfter.
+func IsTransient(err error) bool {
+	var rerr *RateLimitError
+	switch {
+	case errors.As(err, &rerr):
+		return false
+	case errors.Is(err, derrors.NotFound), errors.Is(err, derrors.NotFetched), errors.Is(err, derrors.ProxyTimedOut):
+		return false
+	case errors.Is(err, derrors.ProxyError):
+		// Only returned for 5xx responses.
+		return true
+	case errors.Is(err, syscall.ECONNRESET):
+		return true
+	default:
+		return strings.Contains(err.Error(), "connection reset by peer")
+	}
+}
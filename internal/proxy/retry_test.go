@@ -0,0 +1,71 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/proxy"
+	"golang.org/x/pkgsite-metrics/internal/proxy/proxytest"
+)
+
+func TestRetry(t *testing.T) {
+	defer func(b time.Duration) { proxy.RetryBackoff = b }(proxy.RetryBackoff)
+	proxy.RetryBackoff = time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	proxyServer := proxytest.NewServer([]*proxytest.Module{testModule})
+	client, teardownProxy, err := proxytest.NewClientForServer(proxyServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardownProxy()
+
+	info := func(modulePath string) (int, error) {
+		return proxy.Retry(ctx, func() error {
+			_, err := client.Info(ctx, modulePath, testVersion)
+			return err
+		})
+	}
+
+	for _, test := range []struct {
+		name        string
+		failures    int
+		status      int
+		modulePath  string
+		wantRetries int
+		wantErr     error
+	}{
+		{"ok", 0, 0, testModulePath, 0, nil},
+		{"recovers", 2, http.StatusBadGateway, testModulePath, 2, nil},
+		{"gives up", proxy.MaxAttempts, http.StatusServiceUnavailable, testModulePath, proxy.MaxAttempts - 1, derrors.ProxyError},
+		{"not found", 0, 0, "example.com/missing", 0, derrors.NotFound},
+		{"gone", 1, http.StatusGone, testModulePath, 0, derrors.NotFound},
+		{"rate limited", 1, http.StatusTooManyRequests, testModulePath, 0, derrors.ProxyError},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			proxyServer.FailRequests(test.failures, test.status)
+			defer proxyServer.FailRequests(0, 0)
+			retries, err := info(test.modulePath)
+			if retries != test.wantRetries {
+				t.Errorf("got %d retries, want %d", retries, test.wantRetries)
+			}
+			if test.wantErr == nil {
+				if err != nil {
+					t.Errorf("got %v, want nil", err)
+				}
+			} else if !errors.Is(err, test.wantErr) {
+				t.Errorf("got %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/mod/module"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+)
+
+// zipCacheDir is the directory in the zip cache bucket that holds
+// module zips.
+const zipCacheDir = "zips"
+
+// zipStore is the subset of GCS operations that the zip cache uses.
+type zipStore interface {
+	// read returns the contents of the named object. If there is
+	// no such object, the error wraps derrors.NotFound.
+	read(ctx context.Context, name string) ([]byte, error)
+	write(ctx context.Context, name string, data []byte) error
+	delete(ctx context.Context, name string) error
+}
+
+// A ZipVerifier checks the zip of modulePath at version, as
+// modules.ChecksumDB.Verify does.
+type ZipVerifier func(modulePath, version string, r *zip.Reader) error
+
+// WithZipCache returns a new client that reads module zips from bucket
+// before downloading them from the proxy, and writes the zips it
+// downloads to bucket. Each zip is stored as zips/MODULE@VERSION.zip,
+// where the module path and version are escaped as in proxy URLs.
+// Other RPCs are not affected.
+//
+// If verify is non-nil, only zips that it accepts are written to the
+// cache, and a cached zip that it rejects is deleted and downloaded
+// again.
+func (c *Client) WithZipCache(bucket *storage.BucketHandle, verify ZipVerifier) *Client {
+	c2 := *c
+	c2.zipStore = &gcsZipStore{bucket}
+	c2.verifyZip = verify
+	return &c2
+}
+
+// zipCacheName returns the name of the object that holds the zip of
+// modulePath at resolvedVersion.
+func zipCacheName(modulePath, resolvedVersion string) (string, error) {
+	escapedPath, err := module.EscapePath(modulePath)
+	if err != nil {
+		return "", fmt.Errorf("path: %v: %w", err, derrors.InvalidArgument)
+	}
+	escapedVersion, err := module.EscapeVersion(resolvedVersion)
+	if err != nil {
+		return "", fmt.Errorf("version: %v: %w", err, derrors.InvalidArgument)
+	}
+	return fmt.Sprintf("%s/%s@%s.zip", zipCacheDir, escapedPath, escapedVersion), nil
+}
+
+// gcsZipStore implements zipStore with a GCS bucket.
+type gcsZipStore struct {
+	bucket *storage.BucketHandle
+}
+
+func (s *gcsZipStore) read(ctx context.Context, name string) ([]byte, error) {
+	r, err := s.bucket.Object(name).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, fmt.Errorf("%s: %w", name, derrors.NotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func (s *gcsZipStore) delete(ctx context.Context, name string) error {
+	return s.bucket.Object(name).Delete(ctx)
+}
+
+func (s *gcsZipStore) write(ctx context.Context, name string, data []byte) error {
+	w := s.bucket.Object(name).NewWriter(ctx)
+	w.ContentType = "application/zip"
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
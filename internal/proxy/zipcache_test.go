@@ -0,0 +1,183 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+)
+
+// memZipStore is an in-memory zipStore.
+type memZipStore map[string][]byte
+
+func (m memZipStore) read(_ context.Context, name string) ([]byte, error) {
+	data, ok := m[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, derrors.NotFound)
+	}
+	return data, nil
+}
+
+func (m memZipStore) delete(_ context.Context, name string) error {
+	delete(m, name)
+	return nil
+}
+
+func (m memZipStore) write(_ context.Context, name string, data []byte) error {
+	m[name] = data
+	return nil
+}
+
+func TestZipCache(t *testing.T) {
+	ctx := context.Background()
+	const modulePath, version = "github.com/Azure/m", "v1.0.0"
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create(modulePath + "@" + version + "/go.mod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "module "+modulePath)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.URL.Path)
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/github.com/!azure/m/@v/v1.0.0.zip":
+			w.Write(buf.Bytes())
+		case "/github.com/!azure/m/@v/v1.0.0.info":
+			fmt.Fprintf(w, `{"Version": %q}`, version)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := New(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := memZipStore{}
+	client.zipStore = store
+
+	for range 2 {
+		if _, err := client.Info(ctx, modulePath, version); err != nil {
+			t.Fatal(err)
+		}
+		r, err := client.Zip(ctx, modulePath, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.File) != 1 {
+			t.Errorf("got %d files, want 1", len(r.File))
+		}
+	}
+	// A new client, as on another instance, reads the zip from the cache.
+	client2, err := New(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client2.zipStore = store
+	if _, err := client2.Zip(ctx, modulePath, version); err != nil {
+		t.Fatal(err)
+	}
+
+	const name = "zips/github.com/!azure/m@v1.0.0.zip"
+	if !bytes.Equal(store[name], buf.Bytes()) {
+		t.Errorf("cache does not hold the zip as %s; has %d objects", name, len(store))
+	}
+	// The zip is downloaded once; info requests are not cached.
+	want := []string{
+		"/github.com/!azure/m/@v/v1.0.0.info",
+		"/github.com/!azure/m/@v/v1.0.0.zip",
+		"/github.com/!azure/m/@v/v1.0.0.info",
+	}
+	if !slices.Equal(requests, want) {
+		t.Errorf("proxy requests:\ngot  %q\nwant %q", requests, want)
+	}
+}
+
+func TestZipCacheVerify(t *testing.T) {
+	ctx := context.Background()
+	const modulePath, version = "example.com/m", "v1.0.0"
+	const name = "zips/example.com/m@v1.0.0.zip"
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	if _, err := zw.Create(modulePath + "@" + version + "/go.mod"); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(buf.Bytes())
+	}))
+	defer srv.Close()
+	client, err := New(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := memZipStore{}
+	client.zipStore = store
+	verified := false
+	client.verifyZip = func(string, string, *zip.Reader) error {
+		if !verified {
+			return errors.New("bad zip")
+		}
+		return nil
+	}
+
+	// A zip that fails verification is not cached.
+	if _, err := client.Zip(ctx, modulePath, version); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store[name]; ok {
+		t.Fatal("unverified zip was cached")
+	}
+
+	// A cached zip that fails verification is deleted.
+	store[name] = buf.Bytes()
+	if r := client.readCachedZip(ctx, modulePath, version); r != nil {
+		t.Error("got unverified zip from the cache")
+	}
+	if _, ok := store[name]; ok {
+		t.Error("unverified zip was not deleted from the cache")
+	}
+
+	// A zip that passes verification is cached.
+	verified = true
+	client2, err := New(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client2.zipStore = store
+	client2.verifyZip = client.verifyZip
+	if _, err := client2.Zip(ctx, modulePath, version); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store[name]; !ok {
+		t.Error("verified zip was not cached")
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package queue
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/pkgsite-metrics/internal/config"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/log"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+// PubSub is a Queue implementation backed by a Google Cloud Pub/Sub topic.
+// Each task is published as a message, and workers pull the messages from
+// a subscription to the topic with Subscribe.
+//
+// Unlike Cloud Tasks, Pub/Sub does not deduplicate tasks, has no
+// priorities, and cannot list or delete messages, so ListTasks, DeleteTask
+// and Stats are not supported.
+type PubSub struct {
+	client pubsubClient
+	topic  string // full name of the topic
+}
+
+// pubsubClient is the subset of the Pub/Sub API that PubSub uses.
+type pubsubClient interface {
+	publish(ctx context.Context, topic string, msgs []*pubsub.PubsubMessage) error
+	pull(ctx context.Context, subscription string, max int) ([]*pubsub.ReceivedMessage, error)
+	acknowledge(ctx context.Context, subscription string, ackIDs []string) error
+	modifyAckDeadline(ctx context.Context, subscription string, ackIDs []string, seconds int) error
+}
+
+// A pubsubTask is the data of a Pub/Sub message for a task.
+type pubsubTask struct {
+	Name     string        // ID of the task, as for Cloud Tasks
+	URI      string        // as returned by TaskURI
+	Deadline time.Duration // time the worker has to perform the task
+}
+
+// NewPubSub returns a PubSub queue that publishes to the topic
+// cfg.PubSubTopic in project cfg.ProjectID.
+func NewPubSub(ctx context.Context, cfg *config.Config) (_ *PubSub, err error) {
+	defer derrors.Wrap(&err, "NewPubSub")
+	if cfg.ProjectID == "" {
+		return nil, errors.New("empty ProjectID")
+	}
+	if cfg.PubSubTopic == "" {
+		return nil, errors.New("empty PubSubTopic")
+	}
+	svc, err := pubsub.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	q := newPubSub(&restPubSub{svc}, cfg.ProjectID, cfg.PubSubTopic)
+	log.Infof(ctx, "enqueuing to Pub/Sub topic %s", q.topic)
+	return q, nil
+}
+
+func newPubSub(client pubsubClient, projectID, topic string) *PubSub {
+	return &PubSub{
+		client: client,
+		topic:  fmt.Sprintf("projects/%s/topics/%s", projectID, topic),
+	}
+}
+
+// EnqueueScan publishes a scan task. Since Pub/Sub does not
+// deduplicate, it always reports that the task was added.
+func (q *PubSub) EnqueueScan(ctx context.Context, task Task, opts *Options) (_ bool, err error) {
+	defer derrors.Wrap(&err, "PubSub.EnqueueScan(%s, %s)", task.Path(), task.Params())
+	if opts == nil || opts.Namespace == "" {
+		return false, errors.New("Options.Namespace cannot be empty")
+	}
+	if err := CheckPriority(opts.Priority); err != nil {
+		return false, err
+	}
+	deadline, err := opts.deadline()
+	if err != nil {
+		return false, err
+	}
+	data, err := json.Marshal(&pubsubTask{
+		Name:     newTaskID(opts.Namespace, task),
+		URI:      TaskURI(task, opts),
+		Deadline: deadline,
+	})
+	if err != nil {
+		return false, err
+	}
+	msg := &pubsub.PubsubMessage{Data: base64.StdEncoding.EncodeToString(data)}
+	if err := q.client.publish(ctx, q.topic, []*pubsub.PubsubMessage{msg}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ListTasks is not supported by PubSub, because Pub/Sub messages
+// cannot be listed.
+func (q *PubSub) ListTasks(ctx context.Context, f func(name string) error) error {
+	return fmt.Errorf("%w: PubSub queue does not support listing tasks", derrors.NotImplemented)
+}
+
+// DeleteTask is not supported by PubSub.
+func (q *PubSub) DeleteTask(ctx context.Context, name string) error {
+	return fmt.Errorf("%w: PubSub queue does not support deleting tasks", derrors.NotImplemented)
+}
+
+// Stats is not supported by PubSub.
+func (q *PubSub) Stats(ctx context.Context, maxTasks int) (*Stats, error) {
+	return nil, fmt.Errorf("%w: PubSub queue does not support stats", derrors.NotImplemented)
+}
+
+// Parameters of Subscribe. They are variables for testing.
+var (
+	// pubsubAckExtension is how long Subscribe extends the ack deadline of
+	// a message that is still being processed, and pubsubAckRefresh is how
+	// often it does so.
+	pubsubAckExtension = 2 * time.Minute
+	pubsubAckRefresh   = time.Minute
+
+	// pubsubPullBackoff is how long Subscribe waits after a failed pull.
+	pubsubPullBackoff = 10 * time.Second
+)
+
+// Subscribe pulls tasks from the subscription, which must be to q's topic,
+// and calls processFunc on each, with at most workers running at once.
+// A task is acknowledged when processFunc succeeds or fails permanently,
+// and redelivered later when it fails with a transient error.
+// Subscribe returns when ctx is done.
+func (q *PubSub) Subscribe(ctx context.Context, projectID, subscription string, workers int, processFunc inMemoryProcessFunc) {
+	sub := fmt.Sprintf("projects/%s/subscriptions/%s", projectID, subscription)
+	log.Infof(ctx, "pulling tasks from Pub/Sub subscription %s with %d workers", sub, workers)
+	sem := make(chan struct{}, max(1, workers))
+	for {
+		// Wait for a free worker, then claim any others that are free,
+		// and pull a message for each.
+		select {
+		case <-ctx.Done():
+			return
+		case sem <- struct{}{}:
+		}
+		claimed := 1
+	claim:
+		for claimed < cap(sem) {
+			select {
+			case sem <- struct{}{}:
+				claimed++
+			default:
+				break claim
+			}
+		}
+		msgs, err := q.client.pull(ctx, sub, claimed)
+		if err != nil && ctx.Err() == nil {
+			log.Errorf(ctx, err, "pulling from %s", sub)
+			select {
+			case <-ctx.Done():
+			case <-time.After(pubsubPullBackoff):
+			}
+		}
+		for i := len(msgs); i < claimed; i++ {
+			<-sem
+		}
+		for _, m := range msgs {
+			go func() {
+				defer func() { <-sem }()
+				q.process(ctx, sub, m, processFunc)
+			}()
+		}
+	}
+}
+
+// process performs the task of a received message, then acknowledges the
+// message, or makes it available for redelivery if the task should be retried.
+func (q *PubSub) process(ctx context.Context, sub string, m *pubsub.ReceivedMessage, processFunc inMemoryProcessFunc) {
+	ackIDs := []string{m.AckId}
+	var t pubsubTask
+	data, err := base64.StdEncoding.DecodeString(m.Message.Data)
+	if err == nil {
+		err = json.Unmarshal(data, &t)
+	}
+	if err != nil || t.URI == "" {
+		// Retrying will not help.
+		log.Errorf(ctx, err, "bad Pub/Sub message %s: %q", m.Message.MessageId, data)
+		if err := q.client.acknowledge(ctx, sub, ackIDs); err != nil {
+			log.Errorf(ctx, err, "acknowledging %s", m.Message.MessageId)
+		}
+		return
+	}
+	if t.Deadline <= 0 {
+		t.Deadline = MaxCloudTasksTimeout
+	}
+
+	// Keep the message from being redelivered while the task runs.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(pubsubAckRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := q.client.modifyAckDeadline(ctx, sub, ackIDs, int(pubsubAckExtension.Seconds())); err != nil {
+					log.Errorf(ctx, err, "extending ack deadline of %s", t.Name)
+				}
+			}
+		}
+	}()
+
+	tctx, cancel := context.WithTimeout(ctx, t.Deadline)
+	defer cancel()
+	status, err := processFunc(tctx, t.URI)
+	if err != nil && isTransientStatus(status) {
+		log.Warnf(ctx, "task %s failed with status %d; will retry: %v", t.Name, status, err)
+		// A zero deadline makes the message available for redelivery now.
+		if err := q.client.modifyAckDeadline(ctx, sub, ackIDs, 0); err != nil {
+			log.Errorf(ctx, err, "releasing %s", t.Name)
+		}
+		return
+	}
+	if err != nil {
+		log.Errorf(ctx, err, "task %s failed with status %d; not retrying", t.Name, status)
+	}
+	if err := q.client.acknowledge(ctx, sub, ackIDs); err != nil {
+		log.Errorf(ctx, err, "acknowledging %s", t.Name)
+	}
+}
+
+// isTransientStatus reports whether a task that failed with the given
+// HTTP status may succeed if retried. A zero status means there was
+// no response.
+func isTransientStatus(status int) bool {
+	return status == 0 || status == http.StatusTooManyRequests || status >= 500
+}
+
+// restPubSub implements pubsubClient with the Pub/Sub REST API.
+type restPubSub struct {
+	svc *pubsub.Service
+}
+
+func (c *restPubSub) publish(ctx context.Context, topic string, msgs []*pubsub.PubsubMessage) error {
+	_, err := c.svc.Projects.Topics.Publish(topic, &pubsub.PublishRequest{Messages: msgs}).Context(ctx).Do()
+	return err
+}
+
+func (c *restPubSub) pull(ctx context.Context, subscription string, max int) ([]*pubsub.ReceivedMessage, error) {
+	resp, err := c.svc.Projects.Subscriptions.Pull(subscription, &pubsub.PullRequest{MaxMessages: int64(max)}).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return resp.ReceivedMessages, nil
+}
+
+func (c *restPubSub) acknowledge(ctx context.Context, subscription string, ackIDs []string) error {
+	_, err := c.svc.Projects.Subscriptions.Acknowledge(subscription, &pubsub.AcknowledgeRequest{AckIds: ackIDs}).Context(ctx).Do()
+	return err
+}
+
+func (c *restPubSub) modifyAckDeadline(ctx context.Context, subscription string, ackIDs []string, seconds int) error {
+	req := &pubsub.ModifyAckDeadlineRequest{AckIds: ackIDs, AckDeadlineSeconds: int64(seconds)}
+	if seconds == 0 {
+		// Otherwise the zero value is omitted from the request.
+		req.ForceSendFields = []string{"AckDeadlineSeconds"}
+	}
+	_, err := c.svc.Projects.Subscriptions.ModifyAckDeadline(subscription, req).Context(ctx).Do()
+	return err
+}
@@ -0,0 +1,354 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package queue
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+// fakePubSub is an in-memory pubsubClient with a single subscription.
+type fakePubSub struct {
+	mu      sync.Mutex
+	pending []*pubsub.ReceivedMessage // waiting to be pulled
+	leased  map[string]*pubsub.ReceivedMessage
+	acked   []string // message IDs
+	nextID  int
+	ready   chan struct{} // signaled when pending may be non-empty
+}
+
+func newFakePubSub() *fakePubSub {
+	return &fakePubSub{
+		leased: map[string]*pubsub.ReceivedMessage{},
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+func (f *fakePubSub) signal() {
+	select {
+	case f.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (f *fakePubSub) publish(ctx context.Context, topic string, msgs []*pubsub.PubsubMessage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, m := range msgs {
+		f.nextID++
+		m.MessageId = fmt.Sprint(f.nextID)
+		f.pending = append(f.pending, &pubsub.ReceivedMessage{Message: m})
+	}
+	f.signal()
+	return nil
+}
+
+func (f *fakePubSub) pull(ctx context.Context, subscription string, max int) ([]*pubsub.ReceivedMessage, error) {
+	for {
+		f.mu.Lock()
+		if len(f.pending) > 0 {
+			n := min(max, len(f.pending))
+			msgs := f.pending[:n]
+			f.pending = f.pending[n:]
+			for _, m := range msgs {
+				f.nextID++
+				m.AckId = fmt.Sprintf("ack%d", f.nextID)
+				f.leased[m.AckId] = m
+			}
+			if len(f.pending) > 0 {
+				f.signal()
+			}
+			f.mu.Unlock()
+			return msgs, nil
+		}
+		f.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-f.ready:
+		}
+	}
+}
+
+func (f *fakePubSub) acknowledge(ctx context.Context, subscription string, ackIDs []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, id := range ackIDs {
+		m, ok := f.leased[id]
+		if !ok {
+			return fmt.Errorf("unknown ack ID %s", id)
+		}
+		delete(f.leased, id)
+		f.acked = append(f.acked, m.Message.MessageId)
+	}
+	return nil
+}
+
+func (f *fakePubSub) modifyAckDeadline(ctx context.Context, subscription string, ackIDs []string, seconds int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, id := range ackIDs {
+		m, ok := f.leased[id]
+		if !ok {
+			return fmt.Errorf("unknown ack ID %s", id)
+		}
+		if seconds == 0 {
+			delete(f.leased, id)
+			f.pending = append(f.pending, m)
+		}
+	}
+	f.signal()
+	return nil
+}
+
+func (f *fakePubSub) numAcked() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.acked)
+}
+
+// A recorder is a processFunc that records the URIs of the tasks it
+// performs, and the deadlines of their contexts.
+type recorder struct {
+	mu        sync.Mutex
+	uris      []string
+	deadlines []time.Duration
+	status    func(uri string) int // if nil, all tasks succeed
+}
+
+func (r *recorder) process(ctx context.Context, uri string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.uris = append(r.uris, uri)
+	if d, ok := ctx.Deadline(); ok {
+		// Round, to get back the requested deadline.
+		r.deadlines = append(r.deadlines, time.Until(d).Round(time.Minute))
+	}
+	status := http.StatusOK
+	if r.status != nil {
+		status = r.status(uri)
+	}
+	if status != http.StatusOK {
+		return status, fmt.Errorf("status %d", status)
+	}
+	return status, nil
+}
+
+func (r *recorder) sortedURIs() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	uris := append([]string(nil), r.uris...)
+	sort.Strings(uris)
+	return uris
+}
+
+// queueTest is a Queue under test: a queue that dispatches to a
+// processFunc, and a function that waits until n tasks have been
+// completed.
+type queueTest struct {
+	name string
+	new  func(ctx context.Context, t *testing.T, processFunc inMemoryProcessFunc) (q Queue, wait func(n int))
+}
+
+// Cloud Tasks dispatches over HTTP and has no fake client, so the GCP
+// queue is covered only by the task request tests in queue_test.go.
+var queueTests = []queueTest{
+	{
+		name: "InMemory",
+		new: func(ctx context.Context, t *testing.T, processFunc inMemoryProcessFunc) (Queue, func(int)) {
+			q := NewInMemory(ctx, 2, processFunc)
+			return q, func(int) { q.WaitForTesting(ctx) }
+		},
+	},
+	{
+		name: "PubSub",
+		new: func(ctx context.Context, t *testing.T, processFunc inMemoryProcessFunc) (Queue, func(int)) {
+			f := newFakePubSub()
+			q := newPubSub(f, "proj", "topic")
+			sctx, cancel := context.WithCancel(ctx)
+			done := make(chan struct{})
+			go func() {
+				q.Subscribe(sctx, "proj", "sub", 2, processFunc)
+				close(done)
+			}()
+			return q, func(n int) {
+				waitFor(t, func() bool { return f.numAcked() >= n })
+				cancel()
+				<-done
+			}
+		},
+	},
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for start := time.Now(); !cond(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("timed out")
+		}
+	}
+}
+
+func TestQueueEnqueueScan(t *testing.T) {
+	ctx := context.Background()
+	for _, qt := range queueTests {
+		t.Run(qt.name, func(t *testing.T) {
+			var r recorder
+			q, wait := qt.new(ctx, t, r.process)
+
+			if _, err := q.EnqueueScan(ctx, &testTask{"m@v1", "m@v1", "a=1"}, &Options{}); err == nil {
+				t.Error("no namespace: got nil, want error")
+			}
+			if _, err := q.EnqueueScan(ctx, &testTask{"m@v1", "m@v1", "a=1"}, &Options{Namespace: "ns", Deadline: time.Second}); err == nil {
+				t.Error("short deadline: got nil, want error")
+			}
+
+			opts := &Options{Namespace: "ns", Deadline: 20 * time.Minute}
+			for _, task := range []*testTask{
+				{"m@v1", "m@v1", "a=1"},
+				{"m@v2", "m@v2", "a=2"},
+				{"n@v1", "n@v1", ""},
+			} {
+				added, err := q.EnqueueScan(ctx, task, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !added {
+					t.Errorf("%s: not added", task.name)
+				}
+			}
+			wait(3)
+
+			want := []string{"/ns/scan/m@v1?a=1", "/ns/scan/m@v2?a=2", "/ns/scan/n@v1"}
+			if diff := cmp.Diff(want, r.sortedURIs()); diff != "" {
+				t.Errorf("mismatch (-want, +got):\n%s", diff)
+			}
+			for _, d := range r.deadlines {
+				if d != opts.Deadline {
+					t.Errorf("got deadline %s, want %s", d, opts.Deadline)
+				}
+			}
+		})
+	}
+}
+
+func TestPubSubRetry(t *testing.T) {
+	ctx := context.Background()
+	f := newFakePubSub()
+	q := newPubSub(f, "proj", "topic")
+	opts := &Options{Namespace: "ns"}
+	for _, path := range []string{"ok", "transient", "permanent"} {
+		if _, err := q.EnqueueScan(ctx, &testTask{path, path, ""}, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A message that cannot be decoded.
+	if err := f.publish(ctx, q.topic, []*pubsub.PubsubMessage{{Data: "not base64"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The transient task fails twice before succeeding.
+	transientFailures := 2
+	r := &recorder{status: func(uri string) int {
+		switch uri {
+		case "/ns/scan/transient":
+			if transientFailures > 0 {
+				transientFailures--
+				return http.StatusServiceUnavailable
+			}
+		case "/ns/scan/permanent":
+			return http.StatusBadRequest
+		}
+		return http.StatusOK
+	}}
+	sctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		q.Subscribe(sctx, "proj", "sub", 1, r.process)
+		close(done)
+	}()
+	waitFor(t, func() bool { return f.numAcked() == 4 })
+	cancel()
+	<-done
+
+	want := []string{
+		"/ns/scan/ok",
+		"/ns/scan/permanent",
+		"/ns/scan/transient",
+		"/ns/scan/transient",
+		"/ns/scan/transient",
+	}
+	if diff := cmp.Diff(want, r.sortedURIs()); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+	if len(f.pending) != 0 || len(f.leased) != 0 {
+		t.Errorf("got %d pending and %d leased messages, want none", len(f.pending), len(f.leased))
+	}
+}
+
+func TestPubSubUnsupported(t *testing.T) {
+	ctx := context.Background()
+	q := newPubSub(newFakePubSub(), "proj", "topic")
+	if _, err := q.EnqueueScan(ctx, &testTask{"m", "m", ""}, &Options{Namespace: "ns", Priority: "bad"}); err == nil {
+		t.Error("EnqueueScan with bad priority: got nil, want error")
+	}
+	if err := q.DeleteTask(ctx, "t"); !errors.Is(err, derrors.NotImplemented) {
+		t.Errorf("DeleteTask: got %v, want NotImplemented", err)
+	}
+	if _, err := q.Stats(ctx, 10); !errors.Is(err, derrors.NotImplemented) {
+		t.Errorf("Stats: got %v, want NotImplemented", err)
+	}
+	if err := q.ListTasks(ctx, func(string) error { return errors.New("called") }); !errors.Is(err, derrors.NotImplemented) {
+		t.Errorf("ListTasks: got %v, want NotImplemented", err)
+	}
+}
+
+func TestIsTransientStatus(t *testing.T) {
+	for status, want := range map[int]bool{
+		0:                              true,
+		http.StatusOK:                  false,
+		http.StatusBadRequest:          false,
+		http.StatusNotAcceptable:       false,
+		http.StatusTooManyRequests:     true,
+		http.StatusInternalServerError: true,
+		http.StatusServiceUnavailable:  true,
+	} {
+		if got := isTransientStatus(status); got != want {
+			t.Errorf("%d: got %t, want %t", status, got, want)
+		}
+	}
+}
+
+func TestPubSubMessageData(t *testing.T) {
+	ctx := context.Background()
+	f := newFakePubSub()
+	q := newPubSub(f, "proj", "topic")
+	if q.topic != "projects/proj/topics/topic" {
+		t.Errorf("got topic %q", q.topic)
+	}
+	if _, err := q.EnqueueScan(ctx, &testTask{"m@v1", "m@v1", "a=1"}, &Options{Namespace: "ns"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := base64.StdEncoding.DecodeString(f.pending[0].Message.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf(`{"Name":%q,"URI":"/ns/scan/m@v1?a=1","Deadline":%d}`,
+		newTaskID("ns", &testTask{"m@v1", "m@v1", "a=1"}), int64(MaxCloudTasksTimeout))
+	if string(data) != want {
+		t.Errorf("got %s\nwant %s", data, want)
+	}
+}
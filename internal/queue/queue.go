@@ -13,6 +13,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -21,6 +24,8 @@ import (
 	"golang.org/x/pkgsite-metrics/internal/config"
 	"golang.org/x/pkgsite-metrics/internal/derrors"
 	"golang.org/x/pkgsite-metrics/internal/log"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/iterator"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/durationpb"
@@ -33,17 +38,89 @@ type Task interface {
 	Params() string // URL query params
 }
 
+// A TaskAttempt describes an attempt by Cloud Tasks to deliver a task.
+type TaskAttempt struct {
+	// RetryCount is the number of earlier attempts, including those
+	// that did not reach a handler.
+	RetryCount int
+	// ExecutionCount is the number of earlier attempts that reached
+	// a handler and got a response.
+	ExecutionCount int
+	// TaskName is the name of the task, which is the same for all of
+	// its attempts.
+	TaskName string
+}
+
+// TaskAttemptOf returns the attempt of the Cloud Tasks task that r
+// delivers, from its headers. It returns nil if r is not from Cloud Tasks.
+func TaskAttemptOf(r *http.Request) *TaskAttempt {
+	retries, err1 := strconv.Atoi(r.Header.Get("X-CloudTasks-TaskRetryCount"))
+	executions, err2 := strconv.Atoi(r.Header.Get("X-CloudTasks-TaskExecutionCount"))
+	if err1 != nil || err2 != nil {
+		return nil
+	}
+	return &TaskAttempt{
+		RetryCount:     retries,
+		ExecutionCount: executions,
+		TaskName:       r.Header.Get("X-CloudTasks-TaskName"),
+	}
+}
+
 // A Queue provides an interface for asynchronous scheduling of fetch actions.
 type Queue interface {
 	// EnqueueScan enqueues a scan request.
 	// It reports whether a new task was actually added.
 	EnqueueScan(context.Context, Task, *Options) (bool, error)
+
+	// ListTasks calls f on the name of each task in the queue.
+	// If f returns a non-nil error, the iteration stops and returns that error.
+	ListTasks(ctx context.Context, f func(name string) error) error
+
+	// DeleteTask deletes the task with the given name.
+	DeleteTask(ctx context.Context, name string) error
+
+	// Stats summarizes the tasks in the queue, examining at most
+	// maxTasks of them.
+	Stats(ctx context.Context, maxTasks int) (*Stats, error)
+}
+
+// Stats summarizes the tasks waiting in a queue.
+type Stats struct {
+	NumTasks  int       // number of tasks examined
+	Truncated bool      // there were more than the maximum number of tasks to examine
+	Oldest    time.Time `json:",omitempty"` // creation time of the oldest task examined
+	// Number of tasks by the job ID in their names, as escaped for a
+	// task name. Tasks that do not belong to a job are not counted.
+	ByJob map[string]int
+}
+
+// add adds the task with the given name and creation time to s.
+func (s *Stats) add(name string, created time.Time) {
+	s.NumTasks++
+	if !created.IsZero() && (s.Oldest.IsZero() || created.Before(s.Oldest)) {
+		s.Oldest = created
+	}
+	// The job suffix is last, and the rest of the name, which comes
+	// from a module path, may contain the suffix's prefix too.
+	prefix := jobTaskNameSuffix("")
+	if i := strings.LastIndex(name, prefix); i >= 0 {
+		if s.ByJob == nil {
+			s.ByJob = map[string]int{}
+		}
+		s.ByJob[name[i+len(prefix):]]++
+	}
 }
 
 // New creates a new Queue with name queueName based on the configuration
-// in cfg. When running locally, Queue uses numWorkers concurrent workers.
+// in cfg. If cfg.QueueKind is "pubsub", it returns a PubSub queue.
+// When running locally, when cfg.LocalQueue is set, or when there
+// is no queue name, New returns an InMemory queue that uses
+// cfg.LocalQueueWorkers concurrent workers to call processFunc.
 func New(ctx context.Context, cfg *config.Config, processFunc inMemoryProcessFunc) (Queue, error) {
-	if !config.OnCloudRun() {
+	if cfg.QueueKind == "pubsub" {
+		return NewPubSub(ctx, cfg)
+	}
+	if !config.OnCloudRun() || cfg.LocalQueue || cfg.QueueName == "" {
 		return NewInMemory(ctx, cfg.LocalQueueWorkers, processFunc), nil
 	}
 	client, err := cloudtasks.NewClient(ctx)
@@ -135,6 +212,110 @@ func (q *GCP) EnqueueScan(ctx context.Context, task Task, opts *Options) (enqueu
 	return enqueued, nil
 }
 
+// ListTasks calls f on the full name of each task in the queue,
+// including the queues for each priority.
+func (q *GCP) ListTasks(ctx context.Context, f func(name string) error) (err error) {
+	defer derrors.Wrap(&err, "queue.ListTasks")
+	for _, p := range []string{"", PriorityHigh, PriorityLow} {
+		iter := q.client.ListTasks(ctx, &taskspb.ListTasksRequest{Parent: q.queuePath(p)})
+		for {
+			t, err := iter.Next()
+			if err == iterator.Done {
+				break
+			}
+			if status.Code(err) == codes.NotFound && p != "" {
+				// There is no queue for this priority.
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if err := f(t.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// statsPageSize is the number of tasks Stats requests at a time.
+// It is the largest that Cloud Tasks allows.
+const statsPageSize = 1000
+
+// Stats summarizes the tasks in the queues for each priority,
+// examining at most maxTasks of them.
+func (q *GCP) Stats(ctx context.Context, maxTasks int) (_ *Stats, err error) {
+	defer derrors.Wrap(&err, "queue.Stats")
+	s := &Stats{}
+	for _, p := range []string{"", PriorityHigh, PriorityLow} {
+		// The iterator requests further pages as needed.
+		iter := q.client.ListTasks(ctx, &taskspb.ListTasksRequest{Parent: q.queuePath(p), PageSize: statsPageSize})
+		for {
+			t, err := iter.Next()
+			if err == iterator.Done {
+				break
+			}
+			if status.Code(err) == codes.NotFound && p != "" {
+				// There is no queue for this priority.
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if s.NumTasks >= maxTasks {
+				s.Truncated = true
+				return s, nil
+			}
+			s.add(t.Name, t.CreateTime.AsTime())
+		}
+	}
+	return s, nil
+}
+
+// Task priorities. Each priority has its own queue.
+const (
+	PriorityHigh = "high"
+	PriorityLow  = "low"
+)
+
+// CheckPriority returns an error if p is not a valid priority.
+// The empty string, meaning the default queue, is valid.
+func CheckPriority(p string) error {
+	switch p {
+	case "", PriorityHigh, PriorityLow:
+		return nil
+	default:
+		return fmt.Errorf("invalid priority %q: want %q or %q", p, PriorityHigh, PriorityLow)
+	}
+}
+
+// queuePath returns the full GCP name of the queue for the given priority.
+func (q *GCP) queuePath(priority string) string {
+	return PriorityQueueName(q.queueName, priority)
+}
+
+// PriorityQueueName returns the name of the queue for the given priority,
+// given the name of the default queue. The queue for a priority is named
+// after the default queue, with the priority as a suffix. If priority is
+// empty, it returns the default queue.
+func PriorityQueueName(name, priority string) string {
+	if priority == "" {
+		return name
+	}
+	return name + "-" + priority
+}
+
+// DeleteTask deletes the task with the given full name.
+// It does not return an error if the task doesn't exist.
+func (q *GCP) DeleteTask(ctx context.Context, name string) (err error) {
+	defer derrors.Wrap(&err, "queue.DeleteTask(%q)", name)
+	err = q.client.DeleteTask(ctx, &taskspb.DeleteTaskRequest{Name: name})
+	if status.Code(err) == codes.NotFound {
+		return nil
+	}
+	return err
+}
+
 // Options is used to provide option arguments for a task queue.
 type Options struct {
 	// Namespace prefixes the URL path.
@@ -146,11 +327,46 @@ type Options struct {
 	// TaskNameSuffix is appended to the task name to force reprocessing of
 	// tasks that would normally be de-duplicated.
 	TaskNameSuffix string
+
+	// JobID is the ID of the job the task belongs to, if any.
+	// It is appended to the task name, so the job's tasks can be found.
+	JobID string
+
+	// Priority selects the queue for the task: PriorityHigh, PriorityLow,
+	// or empty for the default queue.
+	Priority string
+
+	// Deadline is how long the queue waits for the worker to handle the
+	// task before retrying it. It must be between MinCloudTasksTimeout
+	// and MaxCloudTasksTimeout. If zero, it is MaxCloudTasksTimeout.
+	Deadline time.Duration
+}
+
+// deadline returns the dispatch deadline of tasks enqueued with o.
+func (o *Options) deadline() (time.Duration, error) {
+	switch {
+	case o.Deadline == 0:
+		return MaxCloudTasksTimeout, nil
+	case o.Deadline < MinCloudTasksTimeout || o.Deadline > MaxCloudTasksTimeout:
+		return 0, fmt.Errorf("deadline %s is not between %s and %s", o.Deadline, MinCloudTasksTimeout, MaxCloudTasksTimeout)
+	default:
+		return o.Deadline, nil
+	}
 }
 
-// maxCloudTasksTimeout is the maximum timeout for HTTP tasks.
+// MinCloudTasksTimeout and MaxCloudTasksTimeout bound the timeout for
+// HTTP tasks. Each task must finish within its timeout.
 // See https://cloud.google.com/tasks/docs/creating-http-target-tasks.
-const maxCloudTasksTimeout = 30 * time.Minute
+const (
+	MinCloudTasksTimeout = 15 * time.Second
+	MaxCloudTasksTimeout = 30 * time.Minute
+)
+
+// ClampDeadline returns d limited to the range of task deadlines
+// that Cloud Tasks allows.
+func ClampDeadline(d time.Duration) time.Duration {
+	return min(max(d, MinCloudTasksTimeout), MaxCloudTasksTimeout)
+}
 
 const disableProxyFetchParam = "proxyfetch=off"
 
@@ -158,23 +374,20 @@ func (q *GCP) newTaskRequest(task Task, opts *Options) (*taskspb.CreateTaskReque
 	if opts.Namespace == "" {
 		return nil, errors.New("Options.Namespace cannot be empty")
 	}
-	relativeURI := fmt.Sprintf("/%s/scan/%s", opts.Namespace, task.Path())
-	params := task.Params()
-	if opts.DisableProxyFetch {
-		if params == "" {
-			params = disableProxyFetchParam
-		} else {
-			params += "&" + disableProxyFetchParam
-		}
+	if err := CheckPriority(opts.Priority); err != nil {
+		return nil, err
 	}
-	if params != "" {
-		relativeURI += "?" + params
+	deadline, err := opts.deadline()
+	if err != nil {
+		return nil, err
 	}
+	queuePath := q.queuePath(opts.Priority)
+	relativeURI := TaskURI(task, opts)
 
 	taskID := newTaskID(opts.Namespace, task)
 	taskpb := &taskspb.Task{
-		Name:             fmt.Sprintf("%s/tasks/%s", q.queueName, taskID),
-		DispatchDeadline: durationpb.New(maxCloudTasksTimeout),
+		Name:             fmt.Sprintf("%s/tasks/%s", queuePath, taskID),
+		DispatchDeadline: durationpb.New(deadline),
 		MessageType: &taskspb.Task_HttpRequest{
 			HttpRequest: &taskspb.HttpRequest{
 				HttpMethod:          taskspb.HttpMethod_POST,
@@ -184,7 +397,7 @@ func (q *GCP) newTaskRequest(task Task, opts *Options) (*taskspb.CreateTaskReque
 		},
 	}
 	req := &taskspb.CreateTaskRequest{
-		Parent: q.queueName,
+		Parent: queuePath,
 		Task:   taskpb,
 	}
 	// If suffix is non-empty, append it to the task name.
@@ -192,9 +405,91 @@ func (q *GCP) newTaskRequest(task Task, opts *Options) (*taskspb.CreateTaskReque
 	if opts.TaskNameSuffix != "" {
 		req.Task.Name += "-" + opts.TaskNameSuffix
 	}
+	if opts.JobID != "" {
+		req.Task.Name += jobTaskNameSuffix(opts.JobID)
+	}
 	return req, nil
 }
 
+// TaskURI returns the path and query of the worker request that
+// performs task, relative to the worker's URL.
+func TaskURI(task Task, opts *Options) string {
+	uri := fmt.Sprintf("/%s/scan/%s", opts.Namespace, task.Path())
+	params := task.Params()
+	if opts.DisableProxyFetch {
+		if params == "" {
+			params = disableProxyFetchParam
+		} else {
+			params += "&" + disableProxyFetchParam
+		}
+	}
+	if params != "" {
+		uri += "?" + params
+	}
+	return uri
+}
+
+// jobTaskNameSuffix returns the suffix of the names of tasks
+// belonging to the job with the given ID.
+func jobTaskNameSuffix(jobID string) string {
+	return "-job-" + escapeTaskID(jobID)
+}
+
+// maxConcurrentDeletes is the maximum number of tasks
+// that Purge deletes concurrently.
+const maxConcurrentDeletes = 20
+
+// DeleteJobTasks deletes the tasks in q that belong to the job with the
+// given ID. It returns the number of tasks deleted.
+func DeleteJobTasks(ctx context.Context, q Queue, jobID string) (n int, err error) {
+	defer derrors.Wrap(&err, "DeleteJobTasks(%q)", jobID)
+	return Purge(ctx, q, "", jobTaskNameSuffix(jobID), false)
+}
+
+// Purge deletes the tasks in q whose names end in suffix and, if namespace
+// is non-empty, that were enqueued in that namespace. It returns the number
+// of matching tasks. If dryRun is true, it deletes nothing.
+// The suffix must not be empty, so that Purge never deletes every task.
+func Purge(ctx context.Context, q Queue, namespace, suffix string, dryRun bool) (n int, err error) {
+	defer derrors.Wrap(&err, "Purge(%q, %q, %t)", namespace, suffix, dryRun)
+	if suffix == "" {
+		return 0, fmt.Errorf("%w: empty suffix", derrors.InvalidArgument)
+	}
+	var nsRE *regexp.Regexp
+	if namespace != "" {
+		nsRE = namespaceRegexp(namespace)
+	}
+	var names []string
+	err = q.ListTasks(ctx, func(name string) error {
+		if strings.HasSuffix(name, suffix) && (nsRE == nil || nsRE.MatchString(name)) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if dryRun {
+		return len(names), nil
+	}
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(maxConcurrentDeletes)
+	for _, name := range names {
+		g.Go(func() error { return q.DeleteTask(ctx, name) })
+	}
+	if err := g.Wait(); err != nil {
+		return 0, err
+	}
+	return len(names), nil
+}
+
+// namespaceRegexp returns a regexp that matches the full names of tasks
+// enqueued in namespace. The ID of such a task, as constructed by
+// newTaskID, contains the escaped namespace followed by a hash.
+func namespaceRegexp(namespace string) *regexp.Regexp {
+	return regexp.MustCompile(`/tasks/.*-` + regexp.QuoteMeta(escapeTaskID(namespace)) + `-[0-9a-f]{8}(-|$)`)
+}
+
 // newTaskID creates a task ID for the given task.
 // Tasks with the same ID that are created within a few hours of each other. will be de-duplicated.
 // See https://cloud.google.com/tasks/docs/reference/rpc/google.cloud.tasks.v2#createtaskrequest
@@ -237,20 +532,27 @@ func escapeTaskID(s string) string {
 // operations. Unlike the GCP task queue, it will not automatically retry tasks
 // on failure.
 //
-// This should only be used for local development.
+// This should only be used for local development and testing.
 type InMemory struct {
-	queue chan Task
+	queue chan inMemoryTask
 	done  chan struct{}
 }
 
-type inMemoryProcessFunc func(context.Context, Task) (int, error)
+type inMemoryTask struct {
+	uri      string // as returned by TaskURI
+	deadline time.Duration
+}
+
+// An inMemoryProcessFunc performs the task whose URI, as returned by
+// TaskURI, is uri. It returns the HTTP status of the request.
+type inMemoryProcessFunc func(ctx context.Context, uri string) (int, error)
 
 // NewInMemory creates a new InMemory that asynchronously fetches
 // from proxyClient and stores in db. It uses workerCount parallelism to
 // execute these fetches.
 func NewInMemory(ctx context.Context, workerCount int, processFunc inMemoryProcessFunc) *InMemory {
 	q := &InMemory{
-		queue: make(chan Task, 1000),
+		queue: make(chan inMemoryTask, 1000),
 		done:  make(chan struct{}),
 	}
 	sem := make(chan struct{}, workerCount)
@@ -264,16 +566,16 @@ func NewInMemory(ctx context.Context, workerCount int, processFunc inMemoryProce
 
 			// If a worker is available, make a request to the fetch service inside a
 			// goroutine and wait for it to finish.
-			go func(t Task) {
+			go func(t inMemoryTask) {
 				defer func() { <-sem }()
 
-				log.Infof(ctx, "Fetch requested: %v (workerCount = %d)", t, cap(sem))
+				log.Infof(ctx, "Fetch requested: %s (workerCount = %d)", t.uri, cap(sem))
 
-				fetchCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+				fetchCtx, cancel := context.WithTimeout(ctx, t.deadline)
 				defer cancel()
 
-				if _, err := processFunc(fetchCtx, t); err != nil {
-					log.Errorf(fetchCtx, err, "processFunc(%v)", t)
+				if _, err := processFunc(fetchCtx, t.uri); err != nil {
+					log.Errorf(fetchCtx, err, "processFunc(%s)", t.uri)
 				}
 			}(v)
 		}
@@ -291,11 +593,35 @@ func NewInMemory(ctx context.Context, workerCount int, processFunc inMemoryProce
 
 // EnqueueScan pushes a scan task into the local queue to be processed
 // asynchronously.
-func (q *InMemory) EnqueueScan(ctx context.Context, task Task, _ *Options) (bool, error) {
-	q.queue <- task
+func (q *InMemory) EnqueueScan(ctx context.Context, task Task, opts *Options) (bool, error) {
+	if opts == nil || opts.Namespace == "" {
+		return false, errors.New("Options.Namespace cannot be empty")
+	}
+	deadline, err := opts.deadline()
+	if err != nil {
+		return false, err
+	}
+	q.queue <- inMemoryTask{uri: TaskURI(task, opts), deadline: deadline}
 	return true, nil
 }
 
+// ListTasks does nothing, because tasks in an InMemory queue are not named.
+func (q *InMemory) ListTasks(ctx context.Context, f func(name string) error) error {
+	return nil
+}
+
+// DeleteTask is not supported by InMemory.
+func (q *InMemory) DeleteTask(ctx context.Context, name string) error {
+	return errors.New("InMemory queue does not support deleting tasks")
+}
+
+// Stats reports the number of tasks that have not been dispatched.
+// The tasks of an InMemory queue have no names or creation times.
+func (q *InMemory) Stats(ctx context.Context, maxTasks int) (*Stats, error) {
+	n := len(q.queue)
+	return &Stats{NumTasks: min(n, maxTasks), Truncated: n > maxTasks}, nil
+}
+
 // WaitForTesting waits for all queued requests to finish. It should only be
 // used by test code.
 func (q *InMemory) WaitForTesting(ctx context.Context) {
@@ -5,11 +5,19 @@
 package queue
 
 import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	taskspb "cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
 	"github.com/google/go-cmp/cmp"
 	"golang.org/x/pkgsite-metrics/internal/config"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
 	"google.golang.org/protobuf/testing/protocmp"
 	"google.golang.org/protobuf/types/known/durationpb"
 )
@@ -46,6 +54,28 @@ func TestNewTaskID(t *testing.T) {
 	}
 }
 
+func TestNewTaskIDParams(t *testing.T) {
+	// Tasks for the same module that differ in any param must have
+	// different IDs, or Cloud Tasks would drop all but one of them.
+	id := func(params string) string {
+		return newTaskID("ns", &testTask{"m@v1.2.3", "m@v1.2.3", params})
+	}
+	base := id("importedby=1&mode=GOVULNCHECK")
+	for _, params := range []string{
+		"importedby=1&mode=COMPARE",
+		"importedby=2&mode=GOVULNCHECK",
+		"importedby=1&mode=GOVULNCHECK&triage=true",
+	} {
+		if id(params) == base {
+			t.Errorf("%s: same ID as base task: %s", params, base)
+		}
+	}
+	// Identical tasks have the same ID, so they are deduplicated.
+	if got := id("importedby=1&mode=GOVULNCHECK"); got != base {
+		t.Errorf("identical task: got %s, want %s", got, base)
+	}
+}
+
 func TestNewTaskRequest(t *testing.T) {
 	cfg := config.Config{
 		ProjectID:      "Project",
@@ -56,7 +86,7 @@ func TestNewTaskRequest(t *testing.T) {
 	want := &taskspb.CreateTaskRequest{
 		Parent: "projects/Project/locations/us-central1/queues/queueID",
 		Task: &taskspb.Task{
-			DispatchDeadline: durationpb.New(maxCloudTasksTimeout),
+			DispatchDeadline: durationpb.New(MaxCloudTasksTimeout),
 			MessageType: &taskspb.Task_HttpRequest{
 				HttpRequest: &taskspb.HttpRequest{
 					HttpMethod: taskspb.HttpMethod_POST,
@@ -102,4 +132,227 @@ func TestNewTaskRequest(t *testing.T) {
 	if diff := cmp.Diff(want, got, protocmp.Transform()); diff != "" {
 		t.Errorf("mismatch (-want, +got):\n%s", diff)
 	}
+	opts.Deadline = 10 * time.Minute
+	want.Task.DispatchDeadline = durationpb.New(10 * time.Minute)
+	got, err = gcp.newTaskRequest(sreq, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want.Task.Name = got.Task.Name
+	if diff := cmp.Diff(want, got, protocmp.Transform()); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+
+	for _, d := range []time.Duration{time.Second, MaxCloudTasksTimeout + time.Second, -time.Minute} {
+		opts.Deadline = d
+		if _, err := gcp.newTaskRequest(sreq, opts); err == nil {
+			t.Errorf("deadline %s: got nil, want error", d)
+		}
+	}
+}
+
+func TestClampDeadline(t *testing.T) {
+	for _, test := range []struct {
+		in, want time.Duration
+	}{
+		{time.Second, MinCloudTasksTimeout},
+		{10 * time.Minute, 10 * time.Minute},
+		{time.Hour, MaxCloudTasksTimeout},
+	} {
+		if got := ClampDeadline(test.in); got != test.want {
+			t.Errorf("ClampDeadline(%s) = %s, want %s", test.in, got, test.want)
+		}
+	}
+}
+
+func TestJobTaskName(t *testing.T) {
+	cfg := config.Config{
+		ProjectID:      "Project",
+		LocationID:     "us-central1",
+		QueueURL:       "http://1.2.3.4:8000",
+		ServiceAccount: "sa",
+	}
+	gcp, err := newGCP(&cfg, nil, "queueID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{Namespace: "test", TaskNameSuffix: "suf", JobID: "user-230311-010203"}
+	got, err := gcp.newTaskRequest(&testTask{"m@v1.2", "path", "params"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "projects/Project/locations/us-central1/queues/queueID/tasks/m_v1_2-test-31026413-suf-job-user-230311-010203"
+	if got.Task.Name != want {
+		t.Errorf("got %s, want %s", got.Task.Name, want)
+	}
+}
+
+func TestDeleteJobTasks(t *testing.T) {
+	q := &testQueue{names: []string{
+		"a-job-user-1",
+		"b-job-user-1",
+		"c-job-user-2",
+		"d",
+	}}
+	n, err := DeleteJobTasks(context.Background(), q, "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("got %d deleted, want 2", n)
+	}
+	sort.Strings(q.deleted)
+	if diff := cmp.Diff([]string{"a-job-user-1", "b-job-user-1"}, q.deleted); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	ctx := context.Background()
+	q := &testQueue{names: []string{
+		"q/tasks/a-ns1-0123abcd-bad",
+		"q/tasks/b-ns2-0123abcd-bad",
+		"q/tasks/ns1-c-ns2-0123abcd-bad", // module name contains the namespace
+		"q/tasks/d-ns1-0123abcd-good",
+		"q/tasks/e-ns1-0123abcd-bad-job-user-1",
+	}}
+	for _, test := range []struct {
+		namespace, suffix string
+		want              []string
+	}{
+		{"", "-bad", []string{"q/tasks/a-ns1-0123abcd-bad", "q/tasks/b-ns2-0123abcd-bad", "q/tasks/ns1-c-ns2-0123abcd-bad"}},
+		{"ns1", "-bad", []string{"q/tasks/a-ns1-0123abcd-bad"}},
+		{"ns2", "-bad", []string{"q/tasks/b-ns2-0123abcd-bad", "q/tasks/ns1-c-ns2-0123abcd-bad"}},
+		{"ns1", "-job-user-1", []string{"q/tasks/e-ns1-0123abcd-bad-job-user-1"}},
+		{"ns3", "-bad", nil},
+	} {
+		// A dry run deletes nothing.
+		q.deleted = nil
+		n, err := Purge(ctx, q, test.namespace, test.suffix, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(test.want) || len(q.deleted) != 0 {
+			t.Errorf("%q, %q, dry run: got %d matching and %d deleted, want %d and 0",
+				test.namespace, test.suffix, n, len(q.deleted), len(test.want))
+		}
+
+		n, err = Purge(ctx, q, test.namespace, test.suffix, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(test.want) {
+			t.Errorf("%q, %q: got %d deleted, want %d", test.namespace, test.suffix, n, len(test.want))
+		}
+		sort.Strings(q.deleted)
+		if diff := cmp.Diff(test.want, q.deleted); diff != "" {
+			t.Errorf("%q, %q: mismatch (-want, +got):\n%s", test.namespace, test.suffix, diff)
+		}
+	}
+
+	if _, err := Purge(ctx, q, "ns1", "", false); !errors.Is(err, derrors.InvalidArgument) {
+		t.Errorf("empty suffix: got %v, want InvalidArgument", err)
+	}
+}
+
+func TestStatsAdd(t *testing.T) {
+	t0 := time.Date(2023, 3, 11, 1, 2, 3, 0, time.UTC)
+	var s Stats
+	s.add("a-job-user-1", t0.Add(time.Hour))
+	s.add("b-job-user-1", t0)
+	s.add("c-job-user-2", t0.Add(2*time.Hour))
+	s.add("d", time.Time{})
+	s.add("github_-com_-x_-my-job-runner_v1_0_0-job-user-2", t0.Add(time.Hour))
+	want := Stats{
+		NumTasks: 5,
+		Oldest:   t0,
+		ByJob:    map[string]int{"user-1": 2, "user-2": 2},
+	}
+	if diff := cmp.Diff(want, s); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+type testQueue struct {
+	names []string
+
+	mu      sync.Mutex
+	deleted []string
+}
+
+func (q *testQueue) EnqueueScan(context.Context, Task, *Options) (bool, error) {
+	return false, nil
+}
+
+func (q *testQueue) ListTasks(ctx context.Context, f func(string) error) error {
+	for _, n := range q.names {
+		if err := f(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *testQueue) Stats(ctx context.Context, maxTasks int) (*Stats, error) {
+	return nil, errors.New("unimplemented")
+}
+
+func (q *testQueue) DeleteTask(ctx context.Context, name string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.deleted = append(q.deleted, name)
+	return nil
+}
+
+func TestTaskPriority(t *testing.T) {
+	cfg := config.Config{
+		ProjectID:      "Project",
+		LocationID:     "us-central1",
+		QueueURL:       "http://1.2.3.4:8000",
+		ServiceAccount: "sa",
+	}
+	gcp, err := newGCP(&cfg, nil, "queueID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const queuePrefix = "projects/Project/locations/us-central1/queues/"
+	for _, test := range []struct {
+		priority string
+		want     string
+	}{
+		{"", queuePrefix + "queueID"},
+		{PriorityHigh, queuePrefix + "queueID-high"},
+		{PriorityLow, queuePrefix + "queueID-low"},
+	} {
+		opts := &Options{Namespace: "test", Priority: test.priority}
+		got, err := gcp.newTaskRequest(&testTask{"m@v1.2", "path", "params"}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Parent != test.want {
+			t.Errorf("%q: got parent %s, want %s", test.priority, got.Parent, test.want)
+		}
+		if !strings.HasPrefix(got.Task.Name, test.want+"/tasks/") {
+			t.Errorf("%q: task name %s is not in queue %s", test.priority, got.Task.Name, test.want)
+		}
+	}
+
+	opts := &Options{Namespace: "test", Priority: "medium"}
+	if _, err := gcp.newTaskRequest(&testTask{"m@v1.2", "path", "params"}, opts); err == nil {
+		t.Error("got nil error for invalid priority")
+	}
+}
+
+func TestTaskAttemptOf(t *testing.T) {
+	r := httptest.NewRequest("GET", "/scan", nil)
+	if got := TaskAttemptOf(r); got != nil {
+		t.Errorf("no headers: got %+v, want nil", got)
+	}
+	r.Header.Set("X-CloudTasks-TaskRetryCount", "3")
+	r.Header.Set("X-CloudTasks-TaskExecutionCount", "1")
+	r.Header.Set("X-CloudTasks-TaskName", "projects/p/locations/l/queues/q/tasks/t")
+	want := &TaskAttempt{RetryCount: 3, ExecutionCount: 1, TaskName: "projects/p/locations/l/queues/q/tasks/t"}
+	if got := TaskAttemptOf(r); got == nil || *got != *want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
 }
@@ -0,0 +1,170 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sandbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Names of the resources whose limits a LimitError reports.
+const (
+	ResourceMemory = "memory"
+	ResourcePids   = "pids"
+)
+
+// A LimitError is returned by Output when the command was stopped
+// because it exceeded one of the sandbox's resource limits.
+type LimitError struct {
+	Resource string // ResourceMemory or ResourcePids
+	Limit    int64
+	Err      error // the error from running the command
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("sandbox %s limit of %d exceeded: %v", e.Resource, e.Limit, e.Err)
+}
+
+func (e *LimitError) Unwrap() error { return e.Err }
+
+// cpuPeriod is the CFS period, in microseconds, of the sandbox's CPU quota.
+const cpuPeriod = 100_000
+
+// hasLimits reports whether any of the sandbox's limits are set.
+func (s *Sandbox) hasLimits() bool {
+	return s.MemoryLimit > 0 || s.CPUQuota > 0 || s.PidsLimit > 0
+}
+
+// limitedBundle creates a bundle directory whose config.json is the
+// sandbox's, with its limits added. The bundle's root filesystem and
+// bind mounts are those of the sandbox's bundle. The caller must
+// remove the directory.
+func (s *Sandbox) limitedBundle() (dir string, err error) {
+	data, err := os.ReadFile(filepath.Join(s.bundleDir, "config.json"))
+	if err != nil {
+		return "", err
+	}
+	bundleDir, err := filepath.Abs(s.bundleDir)
+	if err != nil {
+		return "", err
+	}
+	data, err = s.limitConfig(data, bundleDir)
+	if err != nil {
+		return "", err
+	}
+	dir, err = os.MkdirTemp("", "bundle-")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), data, 0644); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// limitConfig returns the OCI config in data with the sandbox's limits
+// added, and its root path made relative to bundleDir.
+//
+// runsc runs with -ignore-cgroups, so it can't enforce the limits of
+// linux.resources. Instead, memory and process limits are rlimits of
+// the sandboxed process, which gVisor enforces itself. The CPU quota
+// goes in linux.resources, where runsc reads it to decide how many
+// CPUs the sandbox has (see -cpu-num-from-quota).
+func (s *Sandbox) limitConfig(data []byte, bundleDir string) ([]byte, error) {
+	var config map[string]any
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	root, _ := config["root"].(map[string]any)
+	if root == nil {
+		return nil, errors.New("config.json has no root")
+	}
+	if p, _ := root["path"].(string); !filepath.IsAbs(p) {
+		root["path"] = filepath.Join(bundleDir, p)
+	}
+	if s.MemoryLimit > 0 || s.PidsLimit > 0 {
+		process, _ := config["process"].(map[string]any)
+		if process == nil {
+			return nil, errors.New("config.json has no process")
+		}
+		rlimits, _ := process["rlimits"].([]any)
+		if s.MemoryLimit > 0 {
+			rlimits = setRlimit(rlimits, "RLIMIT_AS", s.MemoryLimit)
+		}
+		if s.PidsLimit > 0 {
+			rlimits = setRlimit(rlimits, "RLIMIT_NPROC", s.PidsLimit)
+		}
+		process["rlimits"] = rlimits
+	}
+	if s.CPUQuota > 0 {
+		linux := subobject(config, "linux")
+		resources := subobject(linux, "resources")
+		resources["cpu"] = map[string]any{
+			"quota":  int64(s.CPUQuota * cpuPeriod),
+			"period": cpuPeriod,
+		}
+	}
+	return json.MarshalIndent(config, "", "    ")
+}
+
+// setRlimit sets the hard and soft limits of the rlimit of type typ
+// in rlimits, adding it if it isn't there.
+func setRlimit(rlimits []any, typ string, limit int64) []any {
+	for _, r := range rlimits {
+		if m, ok := r.(map[string]any); ok && m["type"] == typ {
+			m["hard"] = limit
+			m["soft"] = limit
+			return rlimits
+		}
+	}
+	return append(rlimits, map[string]any{"type": typ, "hard": limit, "soft": limit})
+}
+
+// subobject returns the JSON object that is the value of key in m,
+// adding an empty one if there is none.
+func subobject(m map[string]any, key string) map[string]any {
+	sub, _ := m[key].(map[string]any)
+	if sub == nil {
+		sub = map[string]any{}
+		m[key] = sub
+	}
+	return sub
+}
+
+// limitError returns a *LimitError if err, from running a command
+// in s, shows that the command exceeded one of s's limits.
+// Otherwise it returns err.
+//
+// A process that reaches its address space limit fails to allocate
+// memory, and one that reaches its process limit fails to start a
+// thread or process; either usually then exits with a message.
+func (s *Sandbox) limitError(err error) error {
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		return err
+	}
+	switch {
+	case s.MemoryLimit > 0 && containsAny(ee.Stderr, "out of memory", "cannot allocate memory"):
+		return &LimitError{Resource: ResourceMemory, Limit: s.MemoryLimit, Err: err}
+	case s.PidsLimit > 0 && containsAny(ee.Stderr, "resource temporarily unavailable", "pthread_create failed"):
+		return &LimitError{Resource: ResourcePids, Limit: s.PidsLimit, Err: err}
+	}
+	return err
+}
+
+func containsAny(b []byte, subs ...string) bool {
+	for _, s := range subs {
+		if bytes.Contains(b, []byte(s)) {
+			return true
+		}
+	}
+	return false
+}
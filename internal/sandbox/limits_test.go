@@ -0,0 +1,161 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sandbox
+
+import (
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLimitConfig(t *testing.T) {
+	const config = `{
+		"ociVersion": "1.0.0",
+		"process": {
+			"args": ["/runner"],
+			"rlimits": [{"type": "RLIMIT_NOFILE", "hard": 1024, "soft": 1024}]
+		},
+		"root": {"path": "rootfs", "readonly": false},
+		"linux": {"namespaces": [{"type": "pid"}]}
+	}`
+	s := New("/bundle")
+	s.MemoryLimit = 1 << 30
+	s.CPUQuota = 1.5
+	s.PidsLimit = 100
+	data, err := s.limitConfig([]byte(config), "/abs/bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	var want map[string]any
+	if err := json.Unmarshal([]byte(`{
+		"ociVersion": "1.0.0",
+		"process": {
+			"args": ["/runner"],
+			"rlimits": [
+				{"type": "RLIMIT_NOFILE", "hard": 1024, "soft": 1024},
+				{"type": "RLIMIT_AS", "hard": 1073741824, "soft": 1073741824},
+				{"type": "RLIMIT_NPROC", "hard": 100, "soft": 100}
+			]
+		},
+		"root": {"path": "/abs/bundle/rootfs", "readonly": false},
+		"linux": {
+			"namespaces": [{"type": "pid"}],
+			"resources": {"cpu": {"quota": 150000, "period": 100000}}
+		}
+	}`), &want); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+
+	// Existing rlimits are replaced, and with no CPU quota there
+	// are no resources.
+	s = New("/bundle")
+	s.PidsLimit = 7
+	data, err = s.limitConfig([]byte(`{
+		"process": {"rlimits": [{"type": "RLIMIT_NPROC", "hard": 1, "soft": 1}]},
+		"root": {"path": "/r"}
+	}`), "/abs/bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), `{
+    "process": {
+        "rlimits": [
+            {
+                "hard": 7,
+                "soft": 7,
+                "type": "RLIMIT_NPROC"
+            }
+        ]
+    },
+    "root": {
+        "path": "/r"
+    }
+}`; got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	if _, err := s.limitConfig([]byte(`{"process": {}}`), "/b"); err == nil {
+		t.Error("no root: got nil, want error")
+	}
+}
+
+func TestNoLimits(t *testing.T) {
+	// By default a sandbox has no limits, so commands run in its own
+	// bundle, whose config is unchanged.
+	s := New("/bundle")
+	if s.hasLimits() {
+		t.Fatalf("New: got limits memory=%d, cpu=%g, pids=%d, want none", s.MemoryLimit, s.CPUQuota, s.PidsLimit)
+	}
+	// Even if the config were rewritten, no limits would be added.
+	data, err := s.limitConfig([]byte(`{
+		"process": {"rlimits": [{"type": "RLIMIT_NOFILE", "hard": 1024, "soft": 1024}]},
+		"root": {"path": "/r"}
+	}`), "/abs/bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), `{
+    "process": {
+        "rlimits": [
+            {
+                "hard": 1024,
+                "soft": 1024,
+                "type": "RLIMIT_NOFILE"
+            }
+        ]
+    },
+    "root": {
+        "path": "/r"
+    }
+}`; got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestLimitError(t *testing.T) {
+	exitErr := func(stderr string) error {
+		return &exec.ExitError{Stderr: []byte(stderr)}
+	}
+	s := New("/bundle")
+	s.MemoryLimit = 100
+	s.PidsLimit = 10
+	for _, test := range []struct {
+		err  error
+		want string // resource, or "" for no LimitError
+	}{
+		{exitErr("fatal error: runtime: out of memory"), ResourceMemory},
+		{exitErr("runtime: failed to create new OS thread (have 9 already; errno=11)\nruntime: may need to increase max user processes (ulimit -u)\npthread_create failed"), ResourcePids},
+		{exitErr("some other failure"), ""},
+		{errors.New("out of memory, but not an exit error"), ""},
+	} {
+		err := s.limitError(test.err)
+		var le *LimitError
+		got := ""
+		if errors.As(err, &le) {
+			got = le.Resource
+		}
+		if got != test.want {
+			t.Errorf("%v: got resource %q, want %q", test.err, got, test.want)
+		}
+		if !errors.Is(err, test.err) {
+			t.Errorf("%v: result does not wrap the error", test.err)
+		}
+	}
+
+	// Without limits, nothing is a LimitError.
+	if err := New("/bundle").limitError(exitErr("out of memory")); errors.As(err, new(*LimitError)) {
+		t.Errorf("no limits: got %v, want no LimitError", err)
+	}
+}
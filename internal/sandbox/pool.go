@@ -0,0 +1,265 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sandbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+)
+
+// A Pool keeps sandbox containers running between uses, so that
+// commands don't wait for a new container to start.
+//
+// A pooled container runs the runner with its -idle flag, and each
+// command runs the runner in the container with "runsc exec". Before
+// a container is reused, the contents of the pool's ResetDirs are
+// removed. A container is destroyed instead of being reused when it
+// has been used the pool's maximum number of times, or when it fails.
+//
+// A Pool is safe for concurrent use. Get starts a new container when
+// none is idle, so the number of containers in use is not limited;
+// the pool's size limits the number kept idle.
+type Pool struct {
+	sb      *Sandbox // the bundle and limits of the containers
+	size    int
+	maxUses int
+
+	// ResetDirs are directories in the sandbox whose contents are
+	// removed before a container is reused. Mount points in them are
+	// left alone, so a directory shared with the host can hold a
+	// mount point without being cleared.
+	ResetDirs []string
+
+	mu     sync.Mutex
+	idle   []*container
+	closed bool
+}
+
+// A container is a running container of a Pool.
+type container struct {
+	id        string
+	bundleDir string // holds config.json and the process specs
+	uses      int    // number of times returned by Get
+	broken    bool   // killed, so it can't run more commands
+}
+
+// Names of the process specs in a pooled container's bundle.
+const (
+	processFile = "process.json" // runs the runner on a Cmd read from stdin
+	cleanFile   = "clean.json"   // removes the contents of the ResetDirs
+)
+
+// resetTimeout is how long resetting a container may take.
+const resetTimeout = time.Minute
+
+// NewPool returns a pool of containers for the bundle of sb, with the
+// limits of sb. At most size containers are kept idle. A container is
+// used for at most maxUses calls to Get; if maxUses is not positive,
+// there is no limit.
+func NewPool(sb *Sandbox, size, maxUses int) *Pool {
+	return &Pool{sb: sb, size: size, maxUses: maxUses}
+}
+
+// errPoolClosed is returned by Get after Close.
+var errPoolClosed = errors.New("pool is closed")
+
+// Get returns a sandbox whose commands run in one of p's containers,
+// starting one if none is idle. The caller must not run commands in the
+// sandbox concurrently, and must pass it to Put when done with it.
+func (p *Pool) Get(ctx context.Context) (_ *Sandbox, err error) {
+	defer derrors.Wrap(&err, "Pool.Get")
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, errPoolClosed
+	}
+	var ct *container
+	if n := len(p.idle); n > 0 {
+		ct = p.idle[n-1]
+		p.idle = p.idle[:n-1]
+	}
+	p.mu.Unlock()
+	if ct == nil {
+		ct, err = p.start(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sb := *p.sb
+	sb.container = ct
+	return &sb, nil
+}
+
+// Put returns sb, from Get, to p. Commands must not be run in sb
+// afterwards. If failed is true, or the container of sb has been used
+// p's maximum number of times, or it can't be reset, or p has enough
+// idle containers, the container is destroyed instead of being kept
+// for reuse.
+func (p *Pool) Put(sb *Sandbox, failed bool) {
+	ct := sb.container
+	sb.container = nil
+	ct.uses++
+	if failed || ct.broken || (p.maxUses > 0 && ct.uses >= p.maxUses) {
+		p.destroy(ct)
+		return
+	}
+	if err := p.reset(ct); err != nil {
+		p.destroy(ct)
+		return
+	}
+	p.mu.Lock()
+	if p.closed || len(p.idle) >= p.size {
+		p.mu.Unlock()
+		p.destroy(ct)
+		return
+	}
+	p.idle = append(p.idle, ct)
+	p.mu.Unlock()
+}
+
+// Close destroys p's idle containers. Containers in use are destroyed
+// when they are returned with Put.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mu.Unlock()
+	for _, ct := range idle {
+		p.destroy(ct)
+	}
+}
+
+// start starts a new container.
+func (p *Pool) start(ctx context.Context) (_ *container, err error) {
+	if err := p.sb.Validate(); err != nil {
+		return nil, err
+	}
+	dir, err := p.sb.pooledBundle(p.ResetDirs)
+	if err != nil {
+		return nil, err
+	}
+	ct := &container{id: newContainerID(), bundleDir: dir}
+	defer func() {
+		if err != nil {
+			p.destroy(ct)
+		}
+	}()
+	// The container outlives runsc, and holds on to its standard
+	// output and error. Writing them to a file, rather than a pipe,
+	// lets runsc's exit be noticed.
+	logFile, err := os.Create(filepath.Join(dir, "start.log"))
+	if err != nil {
+		return nil, err
+	}
+	defer logFile.Close()
+	args := append(p.sb.runscFlags(), "run", "-detach", "-bundle", dir, ct.id)
+	cmd := exec.CommandContext(ctx, p.sb.Runsc, args...)
+	cmd.Dir = p.sb.bundleDir
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Run(); err != nil {
+		out, _ := os.ReadFile(logFile.Name())
+		return nil, fmt.Errorf("starting container: %w: %s", err, out)
+	}
+	return ct, nil
+}
+
+// reset removes the contents of p's ResetDirs in ct.
+func (p *Pool) reset(ct *container) error {
+	if len(p.ResetDirs) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resetTimeout)
+	defer cancel()
+	args := append(p.sb.runscFlags(), "exec", "-process", filepath.Join(ct.bundleDir, cleanFile), ct.id)
+	cmd := exec.CommandContext(ctx, p.sb.Runsc, args...)
+	cmd.Dir = p.sb.bundleDir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("resetting container: %w: %s", err, out)
+	}
+	return nil
+}
+
+// destroy removes ct.
+func (p *Pool) destroy(ct *container) {
+	p.sb.deleteContainer(ct.id)
+	os.RemoveAll(ct.bundleDir)
+}
+
+// pooledBundle creates a bundle directory for a pooled container.
+// Its config.json is the sandbox's, with the sandbox's limits, and with
+// the runner's -idle flag, so that the container keeps running. It also
+// holds the process specs for running the runner in the container: on a
+// command, or to remove the contents of resetDirs. The caller must remove
+// the directory.
+func (s *Sandbox) pooledBundle(resetDirs []string) (dir string, err error) {
+	data, err := os.ReadFile(filepath.Join(s.bundleDir, "config.json"))
+	if err != nil {
+		return "", err
+	}
+	bundleDir, err := filepath.Abs(s.bundleDir)
+	if err != nil {
+		return "", err
+	}
+	data, err = s.limitConfig(data, bundleDir)
+	if err != nil {
+		return "", err
+	}
+	var config map[string]any
+	if err := json.Unmarshal(data, &config); err != nil {
+		return "", err
+	}
+	process, _ := config["process"].(map[string]any)
+	args, _ := process["args"].([]any)
+	if len(args) == 0 {
+		return "", errors.New("config.json has no process args")
+	}
+	runner := args[0]
+
+	dir, err = os.MkdirTemp("", "bundle-")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	write := func(name string, v any) error {
+		data, err := json.MarshalIndent(v, "", "    ")
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dir, name), data, 0644)
+	}
+	if err := write(processFile, process); err != nil {
+		return "", err
+	}
+	clean := maps.Clone(process)
+	cleanArgs := []any{runner, "-clean"}
+	for _, d := range resetDirs {
+		cleanArgs = append(cleanArgs, d)
+	}
+	clean["args"] = cleanArgs
+	if err := write(cleanFile, clean); err != nil {
+		return "", err
+	}
+	process["args"] = []any{runner, "-idle"}
+	if err := write("config.json", config); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
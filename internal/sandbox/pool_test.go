@@ -0,0 +1,257 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sandbox
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// fakePoolRunsc is a shell script that stands in for runsc in pool
+// tests. Commands "run" by reading the Cmd from standard input, and
+// print the ID of the container they ran in. Starting, resetting and
+// deleting containers are recorded in the calls file.
+const fakePoolRunsc = `#!/bin/sh
+dir=$(dirname "$0")
+for id; do :; done
+case " $* " in
+*" run -detach "*)
+	echo "start $id" >> "$dir/calls"
+	;;
+*" exec "*clean.json*)
+	echo "clean $id" >> "$dir/calls"
+	;;
+*" exec "*|*" run "*)
+	cat > /dev/null
+	echo "ran in $id"
+	;;
+*" delete "*)
+	echo "delete $id" >> "$dir/calls"
+	;;
+esac
+`
+
+const testConfig = `{
+	"ociVersion": "1.0.0",
+	"process": {"args": ["/runner"], "cwd": "/"},
+	"root": {"path": "rootfs"}
+}`
+
+func newTestPool(t *testing.T, size, maxUses int) (*Pool, string) {
+	t.Helper()
+	dir := t.TempDir()
+	runsc := filepath.Join(dir, "runsc")
+	if err := os.WriteFile(runsc, []byte(fakePoolRunsc), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(testConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sb := New(dir)
+	sb.Runsc = runsc
+	p := NewPool(sb, size, maxUses)
+	p.ResetDirs = []string{"/tmp"}
+	return p, dir
+}
+
+func TestPool(t *testing.T) {
+	ctx := context.Background()
+	p, dir := newTestPool(t, 1, 2)
+
+	run := func(sb *Sandbox) string {
+		t.Helper()
+		out, err := sb.Command("printargs").Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, ok := strings.CutPrefix(string(out), "ran in ")
+		if !ok {
+			t.Fatalf("got output %q", out)
+		}
+		return id
+	}
+	get := func() *Sandbox {
+		t.Helper()
+		sb, err := p.Get(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sb
+	}
+
+	sb1 := get()
+	c1 := run(sb1)
+	if got := run(sb1); got != c1 {
+		t.Errorf("second command ran in %s, want %s", got, c1)
+	}
+	p.Put(sb1, false)
+
+	sb2 := get() // reuses c1
+	sb3 := get() // starts c2, since none is idle
+	if got := run(sb2); got != c1 {
+		t.Errorf("reused sandbox ran in %s, want %s", got, c1)
+	}
+	c2 := run(sb3)
+	if c2 == c1 {
+		t.Fatalf("concurrent sandboxes share container %s", c1)
+	}
+	p.Put(sb3, false) // c2 is kept
+	p.Put(sb2, false) // c1 has been used twice
+	p.Put(get(), true)
+	p.Close()
+	if _, err := p.Get(ctx); err == nil {
+		t.Error("Get after Close succeeded")
+	}
+
+	calls, err := os.ReadFile(filepath.Join(dir, "calls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSpace(string(calls)), "\n")
+	want := []string{
+		"start " + c1,
+		"clean " + c1,
+		"start " + c2,
+		"clean " + c2,
+		"delete " + c1,
+		"delete " + c2,
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("runsc calls:\ngot  %q\nwant %q", got, want)
+	}
+}
+
+func TestPoolIdleLimit(t *testing.T) {
+	ctx := context.Background()
+	p, dir := newTestPool(t, 1, 0)
+	sb1, err := p.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb2, err := p.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(sb1, false)
+	p.Put(sb2, false) // over the pool's size
+	p.Close()         // deletes sb1's container
+
+	calls, err := os.ReadFile(filepath.Join(dir, "calls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deletes int
+	for _, line := range strings.Split(string(calls), "\n") {
+		if strings.HasPrefix(line, "delete ") {
+			deletes++
+		}
+	}
+	if deletes != 2 {
+		t.Errorf("got %d containers deleted, want 2:\n%s", deletes, calls)
+	}
+}
+
+func TestPooledBundle(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(testConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sb := New(dir)
+	sb.PidsLimit = 10
+	bdir, err := sb.pooledBundle([]string{"/tmp", "/root/.cache"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bdir)
+
+	readArgs := func(name string, process bool) []string {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(bdir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var spec struct {
+			Args    []string
+			Process struct {
+				Args    []string
+				Rlimits []any
+			}
+		}
+		if err := json.Unmarshal(data, &spec); err != nil {
+			t.Fatal(err)
+		}
+		if process {
+			return spec.Args
+		}
+		if len(spec.Process.Rlimits) == 0 {
+			t.Errorf("%s: no rlimits", name)
+		}
+		return spec.Process.Args
+	}
+	for _, test := range []struct {
+		name    string
+		process bool
+		want    []string
+	}{
+		{"config.json", false, []string{"/runner", "-idle"}},
+		{processFile, true, []string{"/runner"}},
+		{cleanFile, true, []string{"/runner", "-clean", "/tmp", "/root/.cache"}},
+	} {
+		if got := readArgs(test.name, test.process); !slices.Equal(got, test.want) {
+			t.Errorf("%s: got args %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// scanCommands is the number of commands in a simulated scan.
+const scanCommands = 3
+
+// BenchmarkScanCold measures the time to run a scan's commands, each
+// in a new container. Like TestSandbox, it must be run with 'make'.
+func BenchmarkScanCold(b *testing.B) {
+	sb := benchmarkSandbox(b)
+	for range b.N {
+		for range scanCommands {
+			if _, err := sb.Command("printargs", "a").Output(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkScanPooled measures the time to run a scan's commands in
+// a container from a pool. Like TestSandbox, it must be run with 'make'.
+func BenchmarkScanPooled(b *testing.B) {
+	p := NewPool(benchmarkSandbox(b), 1, 0)
+	p.ResetDirs = []string{"/tmp"}
+	defer p.Close()
+	ctx := context.Background()
+	for range b.N {
+		sb, err := p.Get(ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for range scanCommands {
+			if _, err := sb.Command("printargs", "a").Output(); err != nil {
+				b.Fatal(err)
+			}
+		}
+		p.Put(sb, false)
+	}
+}
+
+func benchmarkSandbox(b *testing.B) *Sandbox {
+	if os.Getenv("RUN_FROM_MAKE") != "1" {
+		b.Skip("skipping; must run with 'make'.")
+	}
+	sb := New("testdata/bundle")
+	sb.Runsc = "/usr/local/bin/runsc" // must match path in Makefile
+	return sb
+}
@@ -10,6 +10,10 @@
 //
 // The input is expected to be json content encoding an exec.Cmd
 // structure extended with a boolean AppendToEnv field.
+//
+// In a container of a sandbox.Pool, the runner also runs with a flag:
+// "-idle" keeps the container running until it is killed, and
+// "-clean DIR..." removes the contents of each DIR.
 package main
 
 import (
@@ -17,14 +21,35 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"io/fs"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
 )
 
 func main() {
 	log.SetOutput(os.Stderr)
 	log.SetPrefix("runner: ")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "-idle":
+			for {
+				time.Sleep(time.Hour)
+			}
+		case "-clean":
+			for _, dir := range os.Args[2:] {
+				if err := clean(dir); err != nil {
+					log.Fatal(err)
+				}
+			}
+			return
+		default:
+			log.Fatalf("unknown flag %q", os.Args[1])
+		}
+	}
 	log.Print("starting")
 	in, err := io.ReadAll(os.Stdin)
 	if err != nil {
@@ -56,3 +81,33 @@ func main() {
 	}
 	log.Print("succeeded")
 }
+
+// clean removes the contents of dir, except for mount points.
+// It does nothing if dir doesn't exist.
+func clean(dir string) error {
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		var est syscall.Stat_t
+		if err := syscall.Lstat(path, &est); err != nil {
+			return err
+		}
+		if est.Dev != st.Dev {
+			continue // a mount point
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -7,11 +7,17 @@ package sandbox
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/pkgsite-metrics/internal/derrors"
 )
@@ -22,6 +28,21 @@ import (
 type Sandbox struct {
 	bundleDir string
 	Runsc     string // path to runsc program
+
+	// Limits on the resources each command run in the sandbox may use.
+	// Zero means no limit.
+	MemoryLimit int64   // bytes of address space
+	CPUQuota    float64 // number of CPUs
+	PidsLimit   int64   // number of processes and threads
+
+	// Env holds environment variables, each of the form "key=value",
+	// that are added to the environment of each command run in the
+	// sandbox.
+	Env []string
+
+	// If non-nil, commands run in this container of a Pool,
+	// instead of each in a new container.
+	container *container
 }
 
 // New returns a new Sandbox using the bundle in bundleDir.
@@ -41,7 +62,10 @@ func New(bundleDir string) *Sandbox {
 
 // Cmd describes how to run a binary in a sandbox.
 type Cmd struct {
-	sb *Sandbox
+	sb        *Sandbox
+	ctx       context.Context // if non-nil, kill the sandbox when done
+	maxOutput int             // if positive, maximum bytes of standard output
+	cpuTime   time.Duration   // user and system CPU time of the finished command
 
 	// Path is the path of the command to run.
 	//
@@ -75,30 +99,119 @@ type Cmd struct {
 // Command creates a *Cmd to run path in the sandbox.
 // It behaves like [os/exec.Command].
 func (s *Sandbox) Command(path string, arg ...string) *Cmd {
-	return &Cmd{
+	c := &Cmd{
 		sb:   s,
 		Path: path,
 		Args: append([]string{path}, arg...),
 	}
+	if len(s.Env) > 0 {
+		c.Env = slices.Clone(s.Env)
+		c.AppendToEnv = true
+	}
+	return c
+}
+
+// CommandContext is like Command, but the sandbox is killed
+// if ctx is done before the command finishes.
+// It behaves like [os/exec.CommandContext], except that Output
+// then waits for the container to be removed and returns an error
+// that wraps ctx.Err() and includes the end of the standard error.
+func (s *Sandbox) CommandContext(ctx context.Context, path string, arg ...string) *Cmd {
+	c := s.Command(path, arg...)
+	c.ctx = ctx
+	return c
+}
+
+// ErrOutputTooLarge is returned by Output when the command writes
+// more than the limit set by LimitOutput.
+var ErrOutputTooLarge = errors.New("output too large")
+
+// TruncatedMarker ends the output returned along with ErrOutputTooLarge.
+const TruncatedMarker = "\n... [output truncated]"
+
+// LimitOutput limits the standard output of c to n bytes.
+// If c writes more, Output kills the sandbox and returns the first
+// n bytes followed by TruncatedMarker, and an error wrapping
+// ErrOutputTooLarge.
+func (c *Cmd) LimitOutput(n int) {
+	c.maxOutput = n
 }
 
 // Output runs Cmd in the sandbox used to create it, and returns its standard output.
+// If the command is stopped because it exceeds one of the sandbox's limits,
+// the error wraps a *LimitError.
+// If the command fails, the error holds its standard error, as with
+// [os/exec.Cmd.Output].
 func (c *Cmd) Output() (_ []byte, err error) {
 	defer derrors.Wrap(&err, "Cmd.Output %q", c.Args)
+	stdout, _, err := c.run(nil)
+	return stdout, err
+}
+
+// RunStreaming is like Output, but it also returns the command's
+// standard error, and if stderrLine is non-nil, calls it with each line
+// of standard error as the line is written. Long-running commands can
+// use it to report progress.
+func (c *Cmd) RunStreaming(stderrLine func(line string)) (stdout, stderr []byte, err error) {
+	defer derrors.Wrap(&err, "Cmd.RunStreaming %q", c.Args)
+	return c.run(stderrLine)
+}
+
+func (c *Cmd) run(stderrLine func(string)) (_, _ []byte, err error) {
 	if err := c.sb.Validate(); err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	var id string
+	runArgs := c.sb.runscFlags()
+	if ct := c.sb.container; ct != nil {
+		// Run the runner in the pool's running container.
+		id = ct.id
+		runArgs = append(runArgs, "exec", "-process", filepath.Join(ct.bundleDir, processFile), id)
+	} else {
+		id = newContainerID()
+		runArgs = append(runArgs, "run")
+		if c.sb.hasLimits() {
+			dir, err := c.sb.limitedBundle()
+			if err != nil {
+				return nil, nil, err
+			}
+			defer os.RemoveAll(dir)
+			runArgs = append(runArgs, "-bundle", dir)
+		}
+		runArgs = append(runArgs, id)
+	}
+	ctx := c.ctx
+	stdout := &limitedBuffer{}
+	if c.maxOutput > 0 {
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		stdout = &limitedBuffer{max: c.maxOutput, onExceed: cancel}
+	}
+	var cmd *exec.Cmd
+	if ctx != nil {
+		cmd = exec.CommandContext(ctx, c.sb.Runsc, runArgs...)
+		// Killing runsc alone may leave the container running,
+		// so kill the container first.
+		cmd.Cancel = func() error {
+			_ = exec.Command(c.sb.Runsc, "kill", "-all", id, "KILL").Run()
+			return cmd.Process.Kill()
+		}
+		cmd.WaitDelay = killWaitDelay
+	} else {
+		cmd = exec.Command(c.sb.Runsc, runArgs...)
 	}
-	// -ignore-cgroups is needed to avoid this error from runsc:
-	// cannot set up cgroup for root: configuring cgroup: write /sys/fs/cgroup/cgroup.subtree_control: device or resource busy
-	cmd := exec.Command(c.sb.Runsc, "-ignore-cgroups", "-network=none", "-platform=systrap", "-dcache=500", "run", "sandbox")
 	cmd.Dir = c.sb.bundleDir
 	stdinPipe, err := cmd.StdinPipe()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	stdin, err := json.Marshal(c)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	ch := make(chan error, 1)
 	go func() {
@@ -106,14 +219,186 @@ func (c *Cmd) Output() (_ []byte, err error) {
 		stdinPipe.Close()
 		ch <- err
 	}()
-	out, err := cmd.Output()
+	var stderr bytes.Buffer
+	out, err := runLimited(cmd, stdout, &stderr, stderrLine)
+	c.cpuTime = CPUTime(cmd.ProcessState)
+	if ctx != nil && ctx.Err() != nil {
+		// The container was killed, or never started. Remove
+		// whatever is left of it before returning, so it doesn't
+		// hold on to disk and memory.
+		c.sb.deleteContainer(id)
+		if ct := c.sb.container; ct != nil {
+			ct.broken = true
+		}
+	}
+	if c.ctx != nil && c.ctx.Err() != nil {
+		// Even if runsc exited successfully, the output may be
+		// incomplete.
+		return nil, stderr.Bytes(), canceledError(c.ctx.Err(), err, stderr.Bytes())
+	}
 	if err != nil {
-		return nil, err
+		return out, stderr.Bytes(), c.sb.limitError(err)
 	}
 	if err := <-ch; err != nil {
-		return nil, fmt.Errorf("writing stdin: %w", err)
+		return nil, stderr.Bytes(), fmt.Errorf("writing stdin: %w", err)
+	}
+	return bytes.TrimSpace(out), stderr.Bytes(), nil
+}
+
+// runscFlags returns the flags that precede runsc's subcommand.
+func (s *Sandbox) runscFlags() []string {
+	// -ignore-cgroups is needed to avoid this error from runsc:
+	// cannot set up cgroup for root: configuring cgroup: write /sys/fs/cgroup/cgroup.subtree_control: device or resource busy
+	flags := []string{"-ignore-cgroups", "-network=none", "-platform=systrap", "-dcache=500"}
+	if s.CPUQuota > 0 {
+		flags = append(flags, "-cpu-num-from-quota")
+	}
+	return flags
+}
+
+var containerSeq atomic.Int64
+
+// newContainerID returns an ID for a new container. IDs are unique
+// on the machine, so that containers can run concurrently.
+func newContainerID() string {
+	return fmt.Sprintf("sandbox-%d-%d", os.Getpid(), containerSeq.Add(1))
+}
+
+// killWaitDelay is how long Output waits for the output of a command
+// whose context is done, after killing it.
+const killWaitDelay = 10 * time.Second
+
+// deleteContainer removes the container with the given ID, killing it
+// if it is running. Errors are ignored: there may be nothing to remove.
+func (s *Sandbox) deleteContainer(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), killWaitDelay)
+	defer cancel()
+	_ = exec.CommandContext(ctx, s.Runsc, "delete", "-force", id).Run()
+}
+
+// maxCanceledStderr is the maximum number of bytes of standard error
+// in the error for a canceled command.
+const maxCanceledStderr = 1000
+
+// canceledError returns an error for a command that was stopped
+// because its context was done. It wraps ctxErr, the context's error,
+// and includes the error from running the command and the end of its
+// standard error, if any.
+func canceledError(ctxErr, runErr error, stderr []byte) error {
+	err := ctxErr
+	if runErr != nil {
+		err = fmt.Errorf("%w (%v)", ctxErr, runErr)
+	}
+	if len(stderr) == 0 {
+		return err
+	}
+	if len(stderr) > maxCanceledStderr {
+		stderr = append([]byte("..."), stderr[len(stderr)-maxCanceledStderr:]...)
+	}
+	return fmt.Errorf("%w; stderr: %s", err, bytes.TrimSpace(stderr))
+}
+
+// CPUTime returns the user and system CPU time used by c, once
+// Output has returned. The time is that of runsc and the processes
+// it waited for, which include the sandboxed command.
+func (c *Cmd) CPUTime() time.Duration {
+	return c.cpuTime
+}
+
+// CPUTime returns the user and system CPU time of the exited process
+// described by ps, or zero if ps is nil.
+func CPUTime(ps *os.ProcessState) time.Duration {
+	if ps == nil {
+		return 0
+	}
+	return ps.UserTime() + ps.SystemTime()
+}
+
+// runLimited runs cmd, writing its standard output to stdout and its
+// standard error to stderr. If stderrLine is non-nil, it is also called
+// with each line of standard error.
+// Like exec.Cmd.Output, it records standard error in any *exec.ExitError.
+func runLimited(cmd *exec.Cmd, stdout *limitedBuffer, stderr *bytes.Buffer, stderrLine func(string)) ([]byte, error) {
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if stderrLine != nil {
+		lw := &lineWriter{f: stderrLine}
+		cmd.Stderr = io.MultiWriter(stderr, lw)
+		defer lw.flush()
+	}
+	err := cmd.Run()
+	if stdout.exceeded {
+		out := append(stdout.buf.Bytes(), TruncatedMarker...)
+		return out, fmt.Errorf("%w: more than %d bytes", ErrOutputTooLarge, stdout.max)
+	}
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		ee.Stderr = stderr.Bytes()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stdout.buf.Bytes(), nil
+}
+
+// A limitedBuffer holds at most max bytes, or any number if max is not
+// positive. When more are written, it calls onExceed once and discards
+// the rest.
+type limitedBuffer struct {
+	buf      bytes.Buffer
+	max      int
+	exceeded bool
+	onExceed func()
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.exceeded {
+		return len(p), nil
+	}
+	if n := b.max - b.buf.Len(); b.max > 0 && len(p) > n {
+		b.buf.Write(p[:n])
+		b.exceeded = true
+		b.onExceed()
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+// maxLineLen is the maximum length of a line passed to a lineWriter's
+// function. Longer lines are split.
+const maxLineLen = 4096
+
+// A lineWriter calls a function with each line written to it,
+// without the trailing newline.
+type lineWriter struct {
+	buf []byte // the incomplete last line
+	f   func(string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 && len(w.buf) < maxLineLen {
+			break
+		}
+		if i < 0 || i > maxLineLen {
+			w.f(string(w.buf[:maxLineLen]))
+			w.buf = w.buf[maxLineLen:]
+			continue
+		}
+		w.f(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush calls w's function with the incomplete last line, if any.
+func (w *lineWriter) flush() {
+	if len(w.buf) > 0 {
+		w.f(string(w.buf))
+		w.buf = nil
 	}
-	return bytes.TrimSpace(out), nil
 }
 
 // ociConfig is a subset of the OCI container configuration.
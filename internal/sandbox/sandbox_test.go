@@ -5,11 +5,17 @@
 package sandbox
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/pkgsite-metrics/internal/derrors"
 	test "golang.org/x/pkgsite-metrics/internal/testing"
@@ -77,6 +83,13 @@ func TestSandbox(t *testing.T) {
 		check(t, cmd, `args:
 0: "/"
 1: "17"`)
+	})
+	t.Run("sandbox env", func(t *testing.T) {
+		sb2 := *sb
+		sb2.Env = []string{"FOO=18"}
+		check(t, sb2.Command("printargs", "$HOME", "$FOO"), `args:
+0: "/"
+1: "18"`)
 	})
 	t.Run("no program", func(t *testing.T) {
 		_, err := sb.Command("foo").Output()
@@ -102,3 +115,182 @@ func TestValidate(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestRunLimited(t *testing.T) {
+	for _, test := range []struct {
+		script   string
+		max      int
+		want     string
+		wantErr  error
+		wantKill bool
+	}{
+		{"echo hello", 100, "hello\n", nil, false},
+		{"printf 0123456789; exec sleep 10", 5, "01234" + TruncatedMarker, ErrOutputTooLarge, true},
+	} {
+		cmd := exec.Command("sh", "-c", test.script)
+		killed := false
+		stdout := &limitedBuffer{max: test.max, onExceed: func() {
+			killed = true
+			cmd.Process.Kill()
+		}}
+		out, err := runLimited(cmd, stdout, new(bytes.Buffer), nil)
+		if !errors.Is(err, test.wantErr) {
+			t.Errorf("%q: got error %v, want %v", test.script, err, test.wantErr)
+		}
+		if got := string(out); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.script, got, test.want)
+		}
+		if killed != test.wantKill {
+			t.Errorf("%q: got killed=%t, want %t", test.script, killed, test.wantKill)
+		}
+	}
+
+	// Standard error is recorded, as with exec.Cmd.Output.
+	cmd := exec.Command("sh", "-c", "echo oops >&2; exit 1")
+	_, err := runLimited(cmd, &limitedBuffer{max: 100, onExceed: func() {}}, new(bytes.Buffer), nil)
+	if got := derrors.IncludeStderr(err); !strings.Contains(got, "oops") {
+		t.Errorf("got %q, want it to contain stderr", got)
+	}
+}
+
+func TestRunLimitedStderrLines(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "echo one >&2; echo out; printf 'two\\nthree' >&2")
+	var lines []string
+	var stderr bytes.Buffer
+	out, err := runLimited(cmd, &limitedBuffer{}, &stderr, func(line string) {
+		lines = append(lines, line)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(out), "out\n"; got != want {
+		t.Errorf("stdout: got %q, want %q", got, want)
+	}
+	if got, want := stderr.String(), "one\ntwo\nthree"; got != want {
+		t.Errorf("stderr: got %q, want %q", got, want)
+	}
+	if got, want := strings.Join(lines, "|"), "one|two|three"; got != want {
+		t.Errorf("lines: got %q, want %q", got, want)
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	var lines []string
+	w := &lineWriter{f: func(line string) { lines = append(lines, line) }}
+	long := strings.Repeat("x", maxLineLen+10)
+	for _, s := range []string{"a", "b\nc\n", "\n", long + "\n", "d"} {
+		w.Write([]byte(s))
+	}
+	w.flush()
+	want := []string{"ab", "c", "", long[:maxLineLen], long[maxLineLen:], "d"}
+	if !slices.Equal(lines, want) {
+		t.Errorf("got %q, want %q", lines, want)
+	}
+}
+
+// fakeRunsc is a shell script that stands in for runsc. "run" starts
+// a long sleep in the background, as the sandboxed command, and
+// records its process ID. "kill" kills it. All commands but "run"
+// are recorded in the calls file.
+const fakeRunsc = `#!/bin/sh
+dir=$(dirname "$0")
+case " $* " in
+*" run "*)
+	echo "starting sleep" >&2
+	sleep 100 &
+	echo $! > "$dir/pid.tmp"
+	mv "$dir/pid.tmp" "$dir/pid"
+	wait
+	;;
+*" kill "*)
+	kill -9 $(cat "$dir/pid")
+	echo "$@" >> "$dir/calls"
+	;;
+*)
+	echo "$@" >> "$dir/calls"
+	;;
+esac
+`
+
+func TestCommandContextCancel(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("needs /proc")
+	}
+	dir := t.TempDir()
+	runsc := filepath.Join(dir, "runsc")
+	if err := os.WriteFile(runsc, []byte(fakeRunsc), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"ociVersion": "1.0.0"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sb := New(dir)
+	sb.Runsc = runsc
+
+	ctx, cancel := context.WithCancel(context.Background())
+	// Cancel once the command is running.
+	go func() {
+		for {
+			if _, err := os.Stat(filepath.Join(dir, "pid")); err == nil {
+				cancel()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	start := time.Now()
+	_, err := sb.CommandContext(ctx, "sleep", "100").Output()
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want error wrapping context.Canceled", err)
+	}
+	if !strings.Contains(err.Error(), "starting sleep") {
+		t.Errorf("got %q, want it to contain standard error", err)
+	}
+	if d := time.Since(start); d > killWaitDelay {
+		t.Errorf("took %s to return after cancellation", d)
+	}
+
+	// The sandboxed process is gone, and the container was removed.
+	data, err := os.ReadFile(filepath.Join(dir, "pid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A killed process takes a moment to exit.
+	pid := strings.TrimSpace(string(data))
+	for i := 0; processRunning(pid); i++ {
+		if i == 100 {
+			t.Errorf("process %s still running", pid)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	calls, err := os.ReadFile(filepath.Join(dir, "calls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(calls)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("runsc calls: got\n%s\nwant kill and delete", calls)
+	}
+	id := strings.Fields(lines[0])[2]
+	if !strings.HasPrefix(id, "sandbox-") {
+		t.Errorf("got container ID %q, want a unique one", id)
+	}
+	want := []string{"kill -all " + id + " KILL", "delete -force " + id}
+	if !slices.Equal(lines, want) {
+		t.Errorf("runsc calls: got\n%s\nwant\n%s", calls, strings.Join(want, "\n"))
+	}
+}
+
+// processRunning reports whether the process with the given ID exists
+// and has not exited. A zombie process has exited, but may not yet
+// have been reaped by its parent.
+func processRunning(pid string) bool {
+	data, err := os.ReadFile(filepath.Join("/proc", pid, "stat"))
+	if err != nil {
+		return false
+	}
+	// The state follows the command name, which is in parentheses.
+	_, rest, _ := strings.Cut(string(data), ") ")
+	return !strings.HasPrefix(rest, "Z") && !strings.HasPrefix(rest, "X")
+}
@@ -7,14 +7,23 @@ package scan
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
 	"reflect"
+	"slices"
 	"strconv"
 	"strings"
+	"unicode"
 
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
 	"golang.org/x/pkgsite-metrics/internal/derrors"
 	"golang.org/x/pkgsite-metrics/internal/version"
 )
@@ -32,6 +41,76 @@ type ModuleSpec struct {
 	ImportedBy    int
 }
 
+// CanonicalModulePath returns the canonical form of the module path p, as
+// the proxy expects it before escaping. Surrounding space and trailing
+// slashes are removed, and a path in the proxy's escaped form, with "!x"
+// for each upper-case letter X, is unescaped. It returns an error wrapping
+// derrors.BadModule if the result is not a valid module path.
+// The path "std" of the standard library is valid.
+func CanonicalModulePath(p string) (string, error) {
+	p = strings.TrimRight(strings.TrimSpace(p), "/")
+	if p == "std" {
+		return p, nil
+	}
+	if strings.Contains(p, "!") {
+		up, err := module.UnescapePath(p)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", derrors.BadModule, err)
+		}
+		p = up
+	}
+	if err := module.CheckPath(p); err != nil {
+		return "", fmt.Errorf("%w: %v", derrors.BadModule, err)
+	}
+	return p, nil
+}
+
+// CanonicalModuleSpec returns m with its path in canonical form, as
+// computed by CanonicalModulePath, and an escaped version unescaped.
+// If the version is a semantic version, it must also agree with the
+// major version suffix of the path.
+func CanonicalModuleSpec(m ModuleSpec) (ModuleSpec, error) {
+	p, err := CanonicalModulePath(m.Path)
+	if err != nil {
+		return m, err
+	}
+	m.Path = p
+	m.Version = strings.TrimSpace(m.Version)
+	if strings.Contains(m.Version, "!") {
+		v, err := module.UnescapeVersion(m.Version)
+		if err != nil {
+			return m, fmt.Errorf("%w: %v", derrors.BadModule, err)
+		}
+		m.Version = v
+	}
+	if m.Path != "std" && semver.IsValid(m.Version) {
+		if err := module.Check(m.Path, m.Version); err != nil {
+			return m, fmt.Errorf("%w: %v", derrors.BadModule, err)
+		}
+	}
+	return m, nil
+}
+
+// An InvalidModule is a module that CanonicalModules rejected.
+type InvalidModule struct {
+	ModuleSpec
+	Err error
+}
+
+// CanonicalModules returns the modules of ms in canonical form, in order,
+// and separately those that are not valid.
+func CanonicalModules(ms []ModuleSpec) (valid []ModuleSpec, invalid []InvalidModule) {
+	for _, m := range ms {
+		cm, err := CanonicalModuleSpec(m)
+		if err != nil {
+			invalid = append(invalid, InvalidModule{m, err})
+			continue
+		}
+		valid = append(valid, cm)
+	}
+	return valid, invalid
+}
+
 func ParseCorpusFile(filename string, minImportedByCount int) (ms []ModuleSpec, err error) {
 	defer derrors.Wrap(&err, "parseCorpusFile(%q)", filename)
 	lines, err := ReadFileLines(filename)
@@ -64,6 +143,74 @@ func ParseCorpusFile(filename string, minImportedByCount int) (ms []ModuleSpec,
 	return ms, nil
 }
 
+// SampleModules returns the modules of ms that are in a sample of the
+// given fraction of all module paths, in order. A module is in the sample
+// if the hash of its path and seed falls in the first fraction of the
+// hash values, so the same modules are selected from any list, and across
+// runs with the same seed. A fraction of 0 or 1 selects all the modules.
+func SampleModules(ms []ModuleSpec, fraction float64, seed string) []ModuleSpec {
+	if fraction <= 0 || fraction >= 1 {
+		return ms
+	}
+	limit := uint64(fraction * sampleBuckets)
+	var sample []ModuleSpec
+	for _, m := range ms {
+		h := fnv.New64a()
+		io.WriteString(h, seed)
+		h.Write([]byte{0})
+		io.WriteString(h, m.Path)
+		if h.Sum64()%sampleBuckets < limit {
+			sample = append(sample, m)
+		}
+	}
+	return sample
+}
+
+// sampleBuckets is the number of hash values that SampleModules
+// distinguishes.
+const sampleBuckets = 1_000_000
+
+// ParseModuleList parses a list of modules, one per line.
+// Each line is either MODULE@VERSION, or MODULE@VERSION,IMPORTEDBY
+// as in a CSV file. If the version is omitted, the latest version is used.
+// If the imported-by count is omitted, it is zero.
+// Blank lines and lines beginning with '#' are ignored.
+// Errors identify the offending line by number.
+func ParseModuleList(r io.Reader) (ms []ModuleSpec, err error) {
+	defer derrors.Wrap(&err, "ParseModuleList")
+	s := bufio.NewScanner(r)
+	for lineno := 1; s.Scan(); lineno++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("line %d: %q: too many fields", lineno, line)
+		}
+		path, vers, found := strings.Cut(strings.TrimSpace(fields[0]), "@")
+		if !found {
+			vers = version.Latest
+		}
+		if path == "" || vers == "" {
+			return nil, fmt.Errorf("line %d: %q: want MODULE@VERSION", lineno, line)
+		}
+		m := ModuleSpec{Path: path, Version: vers}
+		if len(fields) == 2 {
+			n, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("line %d: %q: bad imported-by count", lineno, line)
+			}
+			m.ImportedBy = n
+		}
+		ms = append(ms, m)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
 // ReadFileLines reads and returns the lines from a file.
 // Whitespace on each line is trimmed.
 // Blank lines and lines beginning with '#' are ignored.
@@ -105,6 +252,9 @@ type ModuleURLPath struct {
 //   - <module>/@latest
 //
 // The suffix is the part of the path after the version.
+// The version may also be a query, like "latest" or "<v1.2.0"; see
+// version.IsQuery. Queries are returned as is, to be resolved by the
+// caller.
 func ParseModuleURLPath(requestPath string) (_ ModuleURLPath, err error) {
 	defer derrors.Wrap(&err, "ParseModuleURLPath(%q)", requestPath)
 
@@ -119,14 +269,14 @@ func ParseModuleURLPath(requestPath string) (_ ModuleURLPath, err error) {
 	}
 	versionAndSuffix = strings.TrimPrefix(versionAndSuffix, "v/")
 	// Now versionAndSuffix begins with a version.
-	version, suffix, _ := strings.Cut(versionAndSuffix, "/")
-	if version == "" {
+	vers, suffix, _ := strings.Cut(versionAndSuffix, "/")
+	if vers == "" {
 		return ModuleURLPath{}, fmt.Errorf("invalid path %q: missing version", requestPath)
 	}
-	if version[0] != 'v' {
-		version = "v" + version
+	if vers[0] != 'v' && !version.IsQuery(vers) {
+		vers = "v" + vers
 	}
-	return ModuleURLPath{modulePath, version, suffix}, nil
+	return ModuleURLPath{modulePath, vers, suffix}, nil
 }
 
 // Path reconstructs a URL path from m.
@@ -142,25 +292,46 @@ func (m ModuleURLPath) Path() string {
 // with the form and query parameters of r.
 //
 // The fields of pstruct must be exported, and each field must be a string, an
-// int or a bool. If there is a request parameter corresponding to the
+// int, a float64 or a bool. If there is a request parameter corresponding to the
 // lower-cased field name, it is parsed according to the field's type and
 // assigned to the field. If there is no matching parameter (or it is the empty
-// string), the field is not assigned.
+// string), the field is not assigned. A value that cannot be parsed results in
+// a *ParamError.
 //
 // For default values or to detect missing parameters, set the struct field
 // before calling ParseParams; if there is no matching parameter, the field will
 // retain its value.
+//
+// Parameters that don't match a field are ignored; see ParseParamsStrict.
 func ParseParams(r *http.Request, pstruct any) (err error) {
 	defer derrors.Wrap(&err, "ParseParams(%q)", r.URL)
+	return parseParams(r, pstruct, false, nil)
+}
+
+// ParseParamsStrict is like ParseParams, but a parameter of r that doesn't
+// match a field of pstruct results in an *UnknownParamsError. In addition,
+// each value assigned to a field is passed to the check for the field's
+// parameter name in checks, if there is one, and an error from the check
+// results in a *ParamError.
+func ParseParamsStrict(r *http.Request, pstruct any, checks map[string]Check) (err error) {
+	defer derrors.Wrap(&err, "ParseParamsStrict(%q)", r.URL)
+	return parseParams(r, pstruct, true, checks)
+}
 
-	v := reflect.ValueOf(pstruct)
+func parseParams(r *http.Request, pstruct any, strict bool, checks map[string]Check) error {
+	v, err := structPointerElem(pstruct)
+	if err != nil {
+		return err
+	}
 	t := v.Type()
-	if t.Kind() != reflect.Pointer || t.Elem().Kind() != reflect.Struct {
-		return fmt.Errorf("need struct pointer, got %T", pstruct)
+	if strict {
+		if err := r.ParseForm(); err != nil {
+			return fmt.Errorf("%w: %v", derrors.InvalidArgument, err)
+		}
+		if err := unknownParams(t, r.Form); err != nil {
+			return err
+		}
 	}
-	t = t.Elem()
-	v = v.Elem()
-
 	for i := 0; i < t.NumField(); i++ {
 		f := t.Field(i)
 		paramName := strings.ToLower(f.Name)
@@ -171,19 +342,306 @@ func ParseParams(r *http.Request, pstruct any) (err error) {
 		}
 		pval, err := parseParam(paramValue, f.Type.Kind())
 		if err != nil {
-			return fmt.Errorf("param %s: %v", paramName, err)
+			return &ParamError{Param: paramName, Err: err}
+		}
+		if err := runCheck(checks, paramName, pval); err != nil {
+			return err
 		}
 		v.Field(i).Set(reflect.ValueOf(pval))
 	}
 	return nil
 }
 
+// ParseBody populates the fields of pstruct, which must a pointer to a struct,
+// with the JSON object in the body of r.
+//
+// Keys of the object are matched to fields as in ParseParams, and fields have
+// the same restrictions. A key that does not match a field results in an
+// *UnknownParamsError. A missing key, or a value that is null or the empty
+// string, leaves the field unchanged.
+//
+// The value for a string field may also be an array of strings. The elements
+// are joined with spaces, so they must not be empty or contain whitespace.
+// This is meant for fields, like binary args, that are split on whitespace.
+func ParseBody(r *http.Request, pstruct any) (err error) {
+	defer derrors.Wrap(&err, "ParseBody(%q)", r.URL)
+	return parseBody(r, pstruct, nil)
+}
+
+func parseBody(r *http.Request, pstruct any, checks map[string]Check) error {
+	v, err := structPointerElem(pstruct)
+	if err != nil {
+		return err
+	}
+	var obj map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&obj); err != nil {
+		return fmt.Errorf("%w: %v", derrors.InvalidArgument, err)
+	}
+	t := v.Type()
+	if err := unknownParams(t, obj); err != nil {
+		return err
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		paramName := strings.ToLower(f.Name)
+		raw, ok := obj[paramName]
+		if !ok {
+			continue
+		}
+		pval, err := parseJSONParam(raw, f.Type.Kind())
+		if err != nil {
+			return &ParamError{Param: paramName, Err: err}
+		}
+		if pval != nil {
+			if err := runCheck(checks, paramName, pval); err != nil {
+				return err
+			}
+			v.Field(i).Set(reflect.ValueOf(pval))
+		}
+	}
+	return nil
+}
+
+// ParseRequest populates pstruct from r. It uses ParseBody
+// for POST requests and ParseParams for all others.
+func ParseRequest(r *http.Request, pstruct any) error {
+	if r.Method == http.MethodPost {
+		return ParseBody(r, pstruct)
+	}
+	return ParseParams(r, pstruct)
+}
+
+// ParseRequestStrict is like ParseRequest, but rejects unknown parameters
+// and runs checks on the values as ParseParamsStrict does.
+func ParseRequestStrict(r *http.Request, pstruct any, checks map[string]Check) (err error) {
+	if r.Method == http.MethodPost {
+		defer derrors.Wrap(&err, "ParseBody(%q)", r.URL)
+		return parseBody(r, pstruct, checks)
+	}
+	return ParseParamsStrict(r, pstruct, checks)
+}
+
+// A Check validates the parsed value of a request parameter. The value
+// has the type of the field it will be assigned to.
+type Check func(value any) error
+
+// NonNegative is a Check for int parameters that must not be negative.
+func NonNegative(value any) error {
+	if n, ok := value.(int); ok && n < 0 {
+		return fmt.Errorf("must not be negative, got %d", n)
+	}
+	return nil
+}
+
+// Fraction is a Check for float64 parameters that must be in (0, 1].
+// Zero is rejected, so that only a missing parameter, which leaves the
+// field at zero, can mean "all".
+func Fraction(value any) error {
+	if f, ok := value.(float64); ok && !(f > 0 && f <= 1) {
+		return fmt.Errorf("must be greater than 0 and at most 1, got %g", f)
+	}
+	return nil
+}
+
+func runCheck(checks map[string]Check, paramName string, value any) error {
+	check := checks[paramName]
+	if check == nil {
+		return nil
+	}
+	if err := check(value); err != nil {
+		return &ParamError{Param: paramName, Err: err}
+	}
+	return nil
+}
+
+// A ParamError reports a request parameter whose value could not be parsed
+// or was rejected by a Check. It wraps derrors.InvalidArgument and Err.
+type ParamError struct {
+	Param string // the parameter name
+	Err   error
+}
+
+func (e *ParamError) Error() string {
+	return fmt.Sprintf("param %s: %v", e.Param, e.Err)
+}
+
+func (e *ParamError) Unwrap() []error {
+	return []error{derrors.InvalidArgument, e.Err}
+}
+
+// An UnknownParamsError reports request parameters that don't match any
+// field of the struct being populated. It wraps derrors.InvalidArgument.
+type UnknownParamsError struct {
+	Params []string // the unknown names, sorted
+
+	// Suggestions maps some of Params to the known name that is closest
+	// to them, for names that look like misspellings.
+	Suggestions map[string]string
+}
+
+func (e *UnknownParamsError) Error() string {
+	var ps []string
+	for _, p := range e.Params {
+		if s, ok := e.Suggestions[p]; ok {
+			p += fmt.Sprintf(" (did you mean %q?)", s)
+		}
+		ps = append(ps, p)
+	}
+	if len(ps) == 1 {
+		return "unknown param " + ps[0]
+	}
+	return "unknown params " + strings.Join(ps, ", ")
+}
+
+func (e *UnknownParamsError) Unwrap() error {
+	return derrors.InvalidArgument
+}
+
+// unknownParams returns an *UnknownParamsError for the keys of params that
+// don't match a field of the struct type t, or nil if they all match.
+func unknownParams[V any](t reflect.Type, params map[string]V) error {
+	var known []string
+	for i := 0; i < t.NumField(); i++ {
+		known = append(known, strings.ToLower(t.Field(i).Name))
+	}
+	e := &UnknownParamsError{}
+	for name := range params {
+		if slices.Contains(known, name) {
+			continue
+		}
+		e.Params = append(e.Params, name)
+		if s := suggestParam(name, known); s != "" {
+			if e.Suggestions == nil {
+				e.Suggestions = map[string]string{}
+			}
+			e.Suggestions[name] = s
+		}
+	}
+	if len(e.Params) == 0 {
+		return nil
+	}
+	slices.Sort(e.Params)
+	return e
+}
+
+// suggestParam returns the name in known that name is most likely a
+// misspelling of, or "" if there is none. A name is a candidate if it is
+// within two edits of name, ignoring case, or if one of them is a prefix
+// of the other, as with "minimum" for "min".
+func suggestParam(name string, known []string) string {
+	name = strings.ToLower(name)
+	best, bestDist := "", 0
+	for _, k := range known {
+		d := editDistance(name, k)
+		short, long := k, name
+		if len(short) > len(long) {
+			short, long = long, short
+		}
+		if d > 2 && (len(short) < 3 || !strings.HasPrefix(long, short)) {
+			continue
+		}
+		if best == "" || d < bestDist || (d == bestDist && k < best) {
+			best, bestDist = k, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// structPointerElem returns the struct that p points to.
+func structPointerElem(p any) (reflect.Value, error) {
+	v := reflect.ValueOf(p)
+	t := v.Type()
+	if t.Kind() != reflect.Pointer || t.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("need struct pointer, got %T", p)
+	}
+	return v.Elem(), nil
+}
+
+// parseJSONParam parses a JSON value for a field of the given kind.
+// Surrounding whitespace is trimmed from strings and array elements.
+// It returns nil if the field should not be set.
+func parseJSONParam(raw json.RawMessage, kind reflect.Kind) (any, error) {
+	raw = bytes.TrimSpace(raw)
+	if string(raw) == "null" {
+		return nil, nil
+	}
+	switch kind {
+	case reflect.String:
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				return nil, nil
+			}
+			return s, nil
+		}
+		var ss []string
+		if err := json.Unmarshal(raw, &ss); err != nil {
+			return nil, errors.New("want string or array of strings")
+		}
+		for i, s := range ss {
+			s = strings.TrimSpace(s)
+			ss[i] = s
+			if s == "" || strings.IndexFunc(s, unicode.IsSpace) >= 0 {
+				return nil, fmt.Errorf("array element %q is empty or contains whitespace", s)
+			}
+		}
+		if len(ss) == 0 {
+			return nil, nil
+		}
+		return strings.Join(ss, " "), nil
+	case reflect.Int:
+		var n int
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return nil, err
+		}
+		return n, nil
+	case reflect.Float64:
+		var f float64
+		if err := json.Unmarshal(raw, &f); err != nil {
+			return nil, err
+		}
+		return f, nil
+	case reflect.Bool:
+		var b bool
+		if err := json.Unmarshal(raw, &b); err != nil {
+			return nil, err
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("cannot parse kind %s", kind)
+	}
+}
+
 func parseParam(param string, kind reflect.Kind) (any, error) {
 	switch kind {
 	case reflect.String:
 		return param, nil
 	case reflect.Int:
 		return strconv.Atoi(param)
+	case reflect.Float64:
+		return strconv.ParseFloat(param, 64)
 	case reflect.Bool:
 		return strconv.ParseBool(param)
 	default:
@@ -5,12 +5,17 @@
 package scan
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"slices"
 	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
 	"golang.org/x/pkgsite-metrics/internal/version"
 )
 
@@ -39,6 +44,22 @@ func TestParseModuleURLPath(t *testing.T) {
 				Suffix:  "a/b/c",
 			},
 		},
+		{
+			"/github.com/Azure/m/v2/@latest",
+			ModuleURLPath{Module: "github.com/Azure/m/v2", Version: "latest"},
+		},
+		{
+			"/github.com/Azure/m/v2@latest/suffix",
+			ModuleURLPath{Module: "github.com/Azure/m/v2", Version: "latest", Suffix: "suffix"},
+		},
+		{
+			"/module@<=v1.2.0",
+			ModuleURLPath{Module: "module", Version: "<=v1.2.0"},
+		},
+		{
+			"/module/@v/1.2.0",
+			ModuleURLPath{Module: "module", Version: "v1.2.0"},
+		},
 	} {
 		got, err := ParseModuleURLPath(test.path)
 		if err != nil {
@@ -120,6 +141,175 @@ func TestParseCorpusFile(t *testing.T) {
 	}
 }
 
+func TestParseModuleList(t *testing.T) {
+	const input = `
+# comment
+m1@v1.0.0
+m2@v2.3.4, 5
+
+m3
+`
+	got, err := ParseModuleList(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ModuleSpec{
+		{"m1", "v1.0.0", 0},
+		{"m2", "v2.3.4", 5},
+		{"m3", version.Latest, 0},
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("\n got %v\nwant %v", got, want)
+	}
+
+	for _, test := range []struct {
+		input   string
+		wantErr string
+	}{
+		{"m1@v1.0.0\nm2@", "line 2"},
+		{"m1@v1.0.0,x", "line 1"},
+		{"m1@v1.0.0\n\nm2@v1,1,2", "line 3"},
+		{"@v1.0.0", "line 1"},
+	} {
+		_, err := ParseModuleList(strings.NewReader(test.input))
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%q: got error %v, want one containing %q", test.input, err, test.wantErr)
+		}
+	}
+}
+
+func TestCanonicalModuleSpec(t *testing.T) {
+	for _, test := range []struct {
+		in, want ModuleSpec
+	}{
+		{ModuleSpec{"golang.org/x/net", "v0.4.0", 3}, ModuleSpec{"golang.org/x/net", "v0.4.0", 3}},
+		{ModuleSpec{" golang.org/x/net/ ", "v0.4.0", 0}, ModuleSpec{"golang.org/x/net", "v0.4.0", 0}},
+		{ModuleSpec{"github.com/!azure/azure-sdk-for-go", "v1.0.0", 0}, ModuleSpec{"github.com/Azure/azure-sdk-for-go", "v1.0.0", 0}},
+		{ModuleSpec{"github.com/Azure/azure-sdk-for-go", "v1.0.0", 0}, ModuleSpec{"github.com/Azure/azure-sdk-for-go", "v1.0.0", 0}},
+		{ModuleSpec{"github.com/a/b", "v1.0.0-!r!c1", 0}, ModuleSpec{"github.com/a/b", "v1.0.0-RC1", 0}},
+		{ModuleSpec{"github.com/foo_bar/baz_qux", "v1.2.0", 0}, ModuleSpec{"github.com/foo_bar/baz_qux", "v1.2.0", 0}},
+		{ModuleSpec{"github.com/a/b/v2", "v2.3.4", 0}, ModuleSpec{"github.com/a/b/v2", "v2.3.4", 0}},
+		{ModuleSpec{"github.com/a/b/v2//", version.Latest, 0}, ModuleSpec{"github.com/a/b/v2", version.Latest, 0}},
+		{ModuleSpec{"github.com/a/b", "v2.0.0+incompatible", 0}, ModuleSpec{"github.com/a/b", "v2.0.0+incompatible", 0}},
+		{ModuleSpec{"gopkg.in/yaml.v3", "v3.0.1", 0}, ModuleSpec{"gopkg.in/yaml.v3", "v3.0.1", 0}},
+		{ModuleSpec{"std", "v1.21.0", 0}, ModuleSpec{"std", "v1.21.0", 0}},
+	} {
+		got, err := CanonicalModuleSpec(test.in)
+		if err != nil {
+			t.Errorf("%v: %v", test.in, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%v: got %v, want %v", test.in, got, test.want)
+		}
+	}
+
+	for _, in := range []ModuleSpec{
+		{Path: "µπΩ/github.com", Version: "v2.3.4-ß"},
+		{Path: "github.com/µπΩ", Version: "v1.0.0"},
+		{Path: "foo_bar.com/m", Version: "v1.0.0"},
+		{Path: "m", Version: "v1.2.0"},
+		{Path: "", Version: "v1.0.0"},
+		{Path: "github.com/a/b/v1", Version: "v1.0.0"},
+		{Path: "github.com/a/b/v2", Version: "v1.0.0"},
+		{Path: "github.com/a/b", Version: "v2.0.0"},
+		{Path: "github.com/!Azure/x", Version: "v1.0.0"},
+		{Path: "github.com/a/../b", Version: "v1.0.0"},
+	} {
+		_, err := CanonicalModuleSpec(in)
+		if !errors.Is(err, derrors.BadModule) {
+			t.Errorf("%v: got error %v, want BadModule", in, err)
+		}
+	}
+}
+
+func TestCanonicalModules(t *testing.T) {
+	ms := []ModuleSpec{
+		{"github.com/a/b/", "v1.0.0", 1},
+		{"µπΩ/github.com", "v2.3.4", 2},
+		{"github.com/c/d", "v1.0.0", 3},
+	}
+	valid, invalid := CanonicalModules(ms)
+	wantValid := []ModuleSpec{{"github.com/a/b", "v1.0.0", 1}, {"github.com/c/d", "v1.0.0", 3}}
+	if !cmp.Equal(valid, wantValid) {
+		t.Errorf("valid: got %v, want %v", valid, wantValid)
+	}
+	if len(invalid) != 1 || invalid[0].ModuleSpec != ms[1] || invalid[0].Err == nil {
+		t.Errorf("invalid: got %v, want %v with an error", invalid, ms[1])
+	}
+}
+
+func TestSampleModules(t *testing.T) {
+	var ms []ModuleSpec
+	for i := range 10000 {
+		ms = append(ms, ModuleSpec{Path: fmt.Sprintf("example.com/m%d", i), Version: "v1.0.0"})
+	}
+	sample := SampleModules(ms, 0.1, "")
+	if n := len(sample); n < 900 || n > 1100 {
+		t.Errorf("sampled %d of %d modules, want about 1000", n, len(ms))
+	}
+	// The sample is the same across runs, and from any list.
+	if again := SampleModules(ms, 0.1, ""); !cmp.Equal(again, sample) {
+		t.Error("second sample differs")
+	}
+	part := ms[:5000]
+	var want []ModuleSpec
+	for _, m := range sample {
+		if slices.Contains(part, m) {
+			want = append(want, m)
+		}
+	}
+	if got := SampleModules(part, 0.1, ""); !cmp.Equal(got, want) {
+		t.Error("sample of part of the list is not part of the sample")
+	}
+	// A larger fraction includes the modules of a smaller one.
+	larger := map[string]bool{}
+	for _, m := range SampleModules(ms, 0.2, "") {
+		larger[m.Path] = true
+	}
+	for _, m := range sample {
+		if !larger[m.Path] {
+			t.Fatalf("%s is in the 10%% sample but not the 20%% sample", m.Path)
+		}
+	}
+	if other := SampleModules(ms, 0.1, "x"); cmp.Equal(other, sample) {
+		t.Error("samples with different seeds are the same")
+	}
+	for _, f := range []float64{0, 1} {
+		if got := SampleModules(ms, f, ""); len(got) != len(ms) {
+			t.Errorf("fraction %g: got %d modules, want all %d", f, len(got), len(ms))
+		}
+	}
+}
+
+func TestParseFloatParam(t *testing.T) {
+	var p struct{ Sample float64 }
+	r := httptest.NewRequest("GET", "/?sample=0.01", nil)
+	if err := ParseParamsStrict(r, &p, map[string]Check{"sample": Fraction}); err != nil {
+		t.Fatal(err)
+	}
+	if p.Sample != 0.01 {
+		t.Errorf("got %g, want 0.01", p.Sample)
+	}
+	r = httptest.NewRequest("POST", "/", strings.NewReader(`{"sample": 0.5}`))
+	if err := ParseRequestStrict(r, &p, nil); err != nil {
+		t.Fatal(err)
+	}
+	if p.Sample != 0.5 {
+		t.Errorf("body: got %g, want 0.5", p.Sample)
+	}
+	for _, s := range []string{"1.5", "0", "-0.5"} {
+		r = httptest.NewRequest("GET", "/?sample="+s, nil)
+		if err := ParseParamsStrict(r, &p, map[string]Check{"sample": Fraction}); err == nil {
+			t.Errorf("sample=%s: got nil error", s)
+		}
+	}
+	r = httptest.NewRequest("POST", "/", strings.NewReader(`{"sample": 0}`))
+	if err := ParseRequestStrict(r, &p, map[string]Check{"sample": Fraction}); err == nil {
+		t.Error("body sample 0: got nil error")
+	}
+}
+
 type params struct {
 	Str  string
 	Int  int
@@ -167,7 +357,8 @@ func TestParseParams(t *testing.T) {
 			{3, "", "struct pointer"},
 			{&params{}, "int=foo", "invalid syntax"},
 			{&params{}, "bool=foo", "invalid syntax"},
-			{&struct{ F float64 }{}, "f=1.1", "cannot parse kind"},
+			{&struct{ F float32 }{}, "f=1.1", "cannot parse kind"},
+			{&struct{ F float64 }{}, "f=x", "invalid syntax"},
 		} {
 			r, err := http.NewRequest("GET", "https://path?"+test.params, nil)
 			if err != nil {
@@ -185,6 +376,168 @@ func TestParseParams(t *testing.T) {
 	})
 }
 
+func TestParseBody(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		for _, test := range []struct {
+			body string
+			want params
+		}{
+			{
+				`{"str": "foo", "int": 1, "bool": true}`,
+				params{Str: "foo", Int: 1, Bool: true},
+			},
+			{
+				`{}`, // all defaults
+				params{Str: "d", Int: 17, Bool: false},
+			},
+			{
+				`{"int": 3, "bool": true, "str": ""}`, // empty string is same as default
+				params{Str: "d", Int: 3, Bool: true},
+			},
+			{
+				`{"str": null}`,
+				params{Str: "d", Int: 17},
+			},
+			{
+				`{"str": ["-a", "b"]}`,
+				params{Str: "-a b", Int: 17},
+			},
+			{
+				`{"str": " foo\n"}`, // surrounding whitespace is trimmed
+				params{Str: "foo", Int: 17},
+			},
+			{
+				`{"str": "  "}`, // so a blank string is the default
+				params{Str: "d", Int: 17},
+			},
+			{
+				`{"str": [" -a", "b\t"]}`,
+				params{Str: "-a b", Int: 17},
+			},
+		} {
+			r, err := http.NewRequest("POST", "https://path", strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := params{Str: "d", Int: 17} // set defaults
+			if err := ParseBody(r, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s: \ngot  %+v\nwant %+v", test.body, got, test.want)
+			}
+		}
+	})
+	t.Run("errors", func(t *testing.T) {
+		for _, test := range []struct {
+			arg         any
+			body        string
+			errContains string
+		}{
+			{3, "{}", "struct pointer"},
+			{&params{}, `{"int": "foo"}`, "cannot unmarshal"},
+			{&params{}, `{"bool": 1}`, "cannot unmarshal"},
+			{&params{}, `{"str": 1}`, "string or array"},
+			{&params{}, `{"str": ["a b"]}`, "whitespace"},
+			{&params{}, `{"other": 1}`, "unknown param"},
+			{&params{}, `[1]`, "cannot unmarshal"},
+			{&struct{ F float32 }{}, `{"f": 1.1}`, "cannot parse kind"},
+		} {
+			r, err := http.NewRequest("POST", "https://path", strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ParseBody(r, test.arg)
+			got := "<nil>"
+			if err != nil {
+				got = err.Error()
+			}
+			if !strings.Contains(got, test.errContains) {
+				t.Errorf("%v, %s: got %q, want string containing %q", test.arg, test.body, got, test.errContains)
+			}
+		}
+	})
+}
+
+func TestParseRequestStrict(t *testing.T) {
+	checks := map[string]Check{
+		"int": NonNegative,
+		"str": func(v any) error {
+			if v != "a" && v != "b" {
+				return fmt.Errorf("unsupported value %q", v)
+			}
+			return nil
+		},
+	}
+	for _, test := range []struct {
+		method, params string
+		want           string // error message, without the ParseParams/ParseBody prefix
+	}{
+		{"GET", "str=a&int=1&bool=true", ""},
+		{"GET", "strs=a", `unknown param strs (did you mean "str"?)`},
+		{"GET", "Int=1", `unknown param Int (did you mean "int"?)`},
+		{"GET", "boolean=true", `unknown param boolean (did you mean "bool"?)`},
+		{"GET", "xyz=1", `unknown param xyz`},
+		{"GET", "inn=1&xyz=1&st=", `unknown params inn (did you mean "int"?), st (did you mean "str"?), xyz`},
+		{"GET", "int=-1", `param int: must not be negative, got -1`},
+		{"GET", "str=c", `param str: unsupported value "c"`},
+		{"GET", "int=x", `param int: strconv.Atoi: parsing "x": invalid syntax`},
+		{"POST", `{"str": "b", "int": 0}`, ""},
+		{"POST", `{"strr": "b"}`, `unknown param strr (did you mean "str"?)`},
+		{"POST", `{"int": -3}`, `param int: must not be negative, got -3`},
+		{"POST", `{"str": ["c"]}`, `param str: unsupported value "c"`},
+	} {
+		var r *http.Request
+		var err error
+		if test.method == "GET" {
+			r, err = http.NewRequest("GET", "https://path?"+test.params, nil)
+		} else {
+			r, err = http.NewRequest("POST", "https://path", strings.NewReader(test.params))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ParseRequestStrict(r, &params{}, checks)
+		if test.want == "" {
+			if err != nil {
+				t.Errorf("%s %s: %v", test.method, test.params, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s %s: got no error, want %q", test.method, test.params, test.want)
+			continue
+		}
+		if !errors.Is(err, derrors.InvalidArgument) {
+			t.Errorf("%s %s: error %v is not InvalidArgument", test.method, test.params, err)
+		}
+		_, got, _ := strings.Cut(err.Error(), "): ")
+		if got != test.want {
+			t.Errorf("%s %s:\ngot  %s\nwant %s", test.method, test.params, got, test.want)
+		}
+	}
+}
+
+func TestSuggestParam(t *testing.T) {
+	known := []string{"suffix", "mode", "min", "file", "batch"}
+	for _, test := range []struct {
+		name, want string
+	}{
+		{"modes", "mode"},
+		{"minimum", "min"},
+		{"MODE", "mode"},
+		{"bach", "batch"},
+		{"suffixes", "suffix"},
+		{"mi", "min"},
+		{"user", ""},
+		{"xy", ""},
+	} {
+		if got := suggestParam(test.name, known); got != test.want {
+			t.Errorf("suggestParam(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
 func TestFormatParams(t *testing.T) {
 	got := FormatParams(params{Str: "foo bar", Int: 17, Bool: true})
 	want := "str=foo+bar&int=17&bool=true"
@@ -140,6 +140,41 @@ loop:
 	return string(bytes)
 }
 
+// IsQuery reports whether v is a version query rather than a version:
+// Latest, or a comparison with a version, like "<v1.2.0" or ">=v2.0.0".
+// See https://go.dev/ref/mod#version-queries.
+func IsQuery(v string) bool {
+	return v == Latest || strings.HasPrefix(v, "<") || strings.HasPrefix(v, ">")
+}
+
+// ParseComparison parses a comparison query, one of "<V", "<=V", ">V"
+// or ">=V" for a semantic version V, and returns a function that reports
+// whether a version matches it.
+func ParseComparison(query string) (match func(v string) bool, err error) {
+	for _, op := range []struct {
+		prefix string
+		ok     func(cmp int) bool
+	}{
+		// Longer prefixes first, so "<=" isn't taken for "<".
+		{"<=", func(c int) bool { return c <= 0 }},
+		{">=", func(c int) bool { return c >= 0 }},
+		{"<", func(c int) bool { return c < 0 }},
+		{">", func(c int) bool { return c > 0 }},
+	} {
+		bound, found := strings.CutPrefix(query, op.prefix)
+		if !found {
+			continue
+		}
+		if !semver.IsValid(bound) {
+			return nil, fmt.Errorf("version query %q: %q is not a semantic version", query, bound)
+		}
+		return func(v string) bool {
+			return semver.IsValid(v) && op.ok(semver.Compare(v, bound))
+		}, nil
+	}
+	return nil, fmt.Errorf("version query %q: want <, <=, > or >= followed by a version", query)
+}
+
 // appendNumericPrefix appends a string representing n to dst.
 // n is the length of a digit string; the value we append is a prefix for the
 // digit string s such that
@@ -5,6 +5,7 @@
 package version
 
 import (
+	"slices"
 	"testing"
 
 	"golang.org/x/mod/semver"
@@ -256,3 +257,31 @@ func TestLatest(t *testing.T) {
 		})
 	}
 }
+
+func TestParseComparison(t *testing.T) {
+	versions := []string{"v1.0.0", "v1.1.0-pre", "v1.1.0", "v1.2.0", "v2.0.0+incompatible", "bad"}
+	for _, test := range []struct {
+		query string
+		want  []string
+	}{
+		{"<v1.1.0", []string{"v1.0.0", "v1.1.0-pre"}},
+		{"<=v1.1", []string{"v1.0.0", "v1.1.0-pre", "v1.1.0"}},
+		{">v1.1.0", []string{"v1.2.0", "v2.0.0+incompatible"}},
+		{">=v1.2.0", []string{"v1.2.0", "v2.0.0+incompatible"}},
+		{"<v0.1.0", nil},
+	} {
+		match, err := ParseComparison(test.query)
+		if err != nil {
+			t.Fatalf("%s: %v", test.query, err)
+		}
+		got := RemoveIf(versions, func(v string) bool { return !match(v) })
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.query, got, test.want)
+		}
+	}
+	for _, query := range []string{"v1.0.0", "<1.0.0", "=v1.0.0", "<=", "latest"} {
+		if _, err := ParseComparison(query); err == nil {
+			t.Errorf("%s: got nil error, want one", query)
+		}
+	}
+}
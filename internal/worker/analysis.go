@@ -6,6 +6,7 @@ package worker
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
@@ -14,6 +15,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
@@ -25,9 +27,11 @@ import (
 	bq "cloud.google.com/go/bigquery"
 	"cloud.google.com/go/storage"
 	"golang.org/x/pkgsite-metrics/internal/analysis"
+	"golang.org/x/pkgsite-metrics/internal/bigquery"
 	"golang.org/x/pkgsite-metrics/internal/derrors"
 	"golang.org/x/pkgsite-metrics/internal/jobs"
 	"golang.org/x/pkgsite-metrics/internal/log"
+	"golang.org/x/pkgsite-metrics/internal/proxy"
 	"golang.org/x/pkgsite-metrics/internal/queue"
 	"golang.org/x/pkgsite-metrics/internal/sandbox"
 	"golang.org/x/pkgsite-metrics/internal/scan"
@@ -36,7 +40,8 @@ import (
 
 type analysisServer struct {
 	*Server
-	openFile           openFileFunc // Used to open binary files from GCS, except for testing.
+	openFile           openFileFunc          // Used to open binary files from GCS, except for testing.
+	resultsBucket      *storage.BucketHandle // holds rows too large to upload; may be nil
 	storedWorkVersions map[analysis.WorkVersionKey]analysis.WorkVersion
 }
 
@@ -49,9 +54,14 @@ func newAnalysisServer(ctx context.Context, s *Server) (*analysisServer, error)
 		return nil, err
 	}
 	bucket := c.Bucket(s.cfg.BinaryBucket)
+	var resultsBucket *storage.BucketHandle
+	if s.cfg.ResultsBucket != "" {
+		resultsBucket = c.Bucket(s.cfg.ResultsBucket)
+	}
 	return &analysisServer{
 		Server:             s,
 		openFile:           gcsOpenFileFunc(ctx, bucket),
+		resultsBucket:      resultsBucket,
 		storedWorkVersions: make(map[analysis.WorkVersionKey]analysis.WorkVersion),
 	}, nil
 }
@@ -67,6 +77,11 @@ func (s *analysisServer) handleScan(w http.ResponseWriter, r *http.Request) (err
 		return fmt.Errorf("%w: %v", derrors.InvalidArgument, err)
 	}
 
+	// Label log entries with the job ID, so they can be found by job.
+	if req.JobID != "" {
+		ctx = log.NewContextWithLabel(ctx, "jobID", req.JobID)
+	}
+
 	// If there is a job and it's canceled, return immediately.
 	if req.JobID != "" && s.jobDB != nil {
 		job, err := s.jobDB.GetJob(ctx, req.JobID)
@@ -88,69 +103,241 @@ func (s *analysisServer) handleScan(w http.ResponseWriter, r *http.Request) (err
 		}
 	}
 
+	// incrementCategory increments the count of the error category
+	// for the current job, logging any error.
+	incrementCategory := func(category string) {
+		if req.JobID != "" && s.jobDB != nil {
+			if err := s.jobDB.IncrementErrorCategory(ctx, req.JobID, category); err != nil {
+				log.Errorf(ctx, err, "failed to update job for id %q", req.JobID)
+			}
+		}
+	}
+
+	// addFailure records a failure on the current job, logging any error.
+	addFailure := func(category, message string) {
+		if req.JobID != "" && s.jobDB != nil {
+			f := jobs.NewFailure(req.Module, req.Version, category, message, time.Now())
+			err := s.jobDB.UpdateJob(ctx, req.JobID, func(j *jobs.Job) error {
+				j.AddFailure(f)
+				return nil
+			})
+			if err != nil {
+				log.Errorf(ctx, err, "failed to update job for id %q", req.JobID)
+			}
+		}
+	}
+
 	incrementJob("NumStarted")
 
+	// This task may be the last one of the job. Deferred before the
+	// error handling below, so it runs after NumFailed is incremented.
+	if req.JobID != "" && s.jobDB != nil {
+		defer s.finishJobIfDone(ctx, req.JobID)
+	}
+
+	// recorded holds the binaries that have a result row for the
+	// module from this task, or from an earlier one that is reused.
+	recorded := map[string]bool{}
+
 	// Handle errors here.
 	defer func() {
 		if err != nil {
+			category := derrors.CategorizeError(err)
 			incrementJob("NumFailed")
+			incrementCategory(category)
+			addFailure(category, err.Error())
+			if req.JobID != "" && !req.Serve {
+				s.writeFailureRows(ctx, req, recorded, err)
+			}
 		}
 	}()
 
 	if req.Suffix != "" {
 		return fmt.Errorf("%w: analysis: only implemented for whole modules (no suffix)", derrors.InvalidArgument)
 	}
-	if req.Binary == "" {
-		return fmt.Errorf("%w: analysis: missing binary", derrors.InvalidArgument)
-	}
-	if req.Binary != path.Base(req.Binary) {
-		return fmt.Errorf("%w: analysis: binary name contains slashes (must be a basename)", derrors.InvalidArgument)
-	}
-	localBinaryPath := path.Join(s.cfg.BinaryDir, req.Binary)
-	srcPath := path.Join(analysisBinariesBucketDir, req.Binary)
-	const executable = true
-	if err := copyToLocalFile(localBinaryPath, executable, srcPath, s.openFile); err != nil {
+	binaries := analysis.SplitBinaries(req.Binary)
+	if err := checkBinaries(binaries); err != nil {
 		return err
 	}
-	defer derrors.Cleanup(&err, func() error { return os.Remove(localBinaryPath) })
-
-	binaryHash, err := hashFile(localBinaryPath)
+	lim, err := s.analysisLimits(req.Timeout)
 	if err != nil {
 		return err
 	}
-	if binaryHash != req.BinaryVersion {
-		return fmt.Errorf("%w: analysis: for binary %s, hash of download file %s does not match hash in request %s",
-			derrors.InvalidArgument, req.Binary, binaryHash, req.BinaryVersion)
-	}
-	wv := analysis.WorkVersion{
-		BinaryArgs:    req.Args,
-		WorkerVersion: s.cfg.VersionID,
-		SchemaVersion: analysis.SchemaVersion,
-		BinaryVersion: binaryHash,
+	hashes := analysis.SplitBinaries(req.BinaryVersion)
+	if len(hashes) != len(binaries) {
+		return fmt.Errorf("%w: analysis: %d binaries but %d binary versions", derrors.InvalidArgument, len(binaries), len(hashes))
 	}
+	var runs []*analysisRun
+	for i, binary := range binaries {
+		var localBinaryPath, binaryHash string
+		localBinaryPath, binaryHash, err = s.downloadBinary(binary)
+		if err != nil {
+			return err
+		}
+		defer derrors.Cleanup(&err, func() error { return os.Remove(localBinaryPath) })
 
-	if err := s.readWorkVersion(ctx, req.Module, req.Version, req.Binary); err != nil {
-		return err
+		if binaryHash != hashes[i] {
+			return fmt.Errorf("%w: analysis: for binary %s, hash of download file %s does not match hash in request %s",
+				derrors.InvalidArgument, binary, binaryHash, hashes[i])
+		}
+		var metadata string
+		metadata, err = s.readBinaryMetadata(ctx, binary)
+		if err != nil {
+			return err
+		}
+		wv := analysis.WorkVersion{
+			BinaryArgs:    req.Args,
+			WorkerVersion: s.cfg.VersionID,
+			SchemaVersion: analysis.SchemaVersion,
+			BinaryVersion: binaryHash,
+		}
+
+		if s.taskCompleted(ctx, req.Attempt, taskKey(req.Attempt, req.JobID, req.Module, req.Version, binary)) {
+			log.Infof(ctx, "skipping (completed by an earlier attempt of the task): %s on %s@%s", binary, req.Module, req.Version)
+			recorded[binary] = true
+			continue
+		}
+		if err := s.readWorkVersion(ctx, req.Module, req.Version, binary); err != nil {
+			return err
+		}
+		key := analysis.WorkVersionKey{Module: req.Module, Version: req.Version, Binary: binary}
+		if wv == s.storedWorkVersions[key] {
+			log.Infof(ctx, "skipping (work version unchanged): %+v", key)
+			recorded[binary] = true
+			continue
+		}
+		runs = append(runs, &analysisRun{binary: binary, path: localBinaryPath, metadata: metadata, wv: wv})
 	}
-	key := analysis.WorkVersionKey{Module: req.Module, Version: req.Version, Binary: req.Binary}
-	if wv == s.storedWorkVersions[key] {
-		log.Infof(ctx, "skipping (work version unchanged): %+v", key)
+	// The job counters count modules, not binary runs.
+	if len(runs) == 0 {
 		incrementJob("NumSkipped")
 		return nil
 	}
 
-	row := s.scan(ctx, req, localBinaryPath, wv)
-	if err := writeResult(ctx, req.Serve, w, s.bqClient, analysis.TableName, row); err != nil {
-		return err
+	rows := s.scan(ctx, req, runs, lim)
+	var failed *analysis.Result // first row with an error
+	misbehaved := false         // some binary ran too long or wrote too much
+	categories := map[string]bool{}
+	for _, row := range rows {
+		limitAnalysisRowSize(ctx, s.resultsBucket, row, maxRowBytes)
+		if err := writeResult(ctx, req.Serve, w, s.rows, analysis.TableName, row); err != nil {
+			return err
+		}
+		recorded[row.BinaryName] = true
+		if !req.Serve {
+			s.setTaskCompleted(ctx, taskKey(req.Attempt, req.JobID, req.Module, req.Version, row.BinaryName))
+		}
+		if row.Error != "" {
+			if failed == nil {
+				failed = row
+			}
+			if isAnalysisLimitCategory(row.ErrorCategory) {
+				misbehaved = true
+			}
+			if !categories[row.ErrorCategory] {
+				categories[row.ErrorCategory] = true
+				incrementCategory(row.ErrorCategory)
+			}
+		}
 	}
-	if row.Error != "" {
-		incrementJob("NumErrored")
+	if failed != nil {
+		// A binary that exceeds its limits is at fault, not the module,
+		// so count it as a failure rather than a module error.
+		if misbehaved {
+			incrementJob("NumFailed")
+		} else {
+			incrementJob("NumErrored")
+		}
+		msg := failed.Error
+		if len(binaries) > 1 {
+			msg = failed.BinaryName + ": " + msg
+		}
+		addFailure(failed.ErrorCategory, msg)
 	} else {
 		incrementJob("NumSucceeded")
 	}
 	return nil
 }
 
+// downloadBinary copies the analysis binary from GCS to the binary
+// directory. It returns the local path of the binary and its hash.
+func (s *analysisServer) downloadBinary(binary string) (localPath, hash string, err error) {
+	localPath = path.Join(s.cfg.BinaryDir, binary)
+	srcPath := path.Join(analysisBinariesBucketDir, binary)
+	const executable = true
+	if err := copyToLocalFile(localPath, executable, srcPath, s.openFile); err != nil {
+		return "", "", err
+	}
+	hash, err = hashFile(localPath)
+	if err != nil {
+		return "", "", err
+	}
+	return localPath, hash, nil
+}
+
+// binaryMetadataSuffix is the suffix of the name of the optional sidecar
+// object of an analysis binary in the binaries bucket. The sidecar is a
+// JSON object that describes how the binary was built.
+const binaryMetadataSuffix = ".meta.json"
+
+// maxBinaryMetadataSize is the maximum size of a sidecar, in bytes.
+const maxBinaryMetadataSize = 64 * 1024
+
+// readBinaryMetadata returns the sidecar of the analysis binary, as
+// compact JSON, or "" if there is none. A sidecar that is not a JSON
+// object is only logged, since it is optional.
+func (s *analysisServer) readBinaryMetadata(ctx context.Context, binary string) (_ string, err error) {
+	defer derrors.Wrap(&err, "readBinaryMetadata(%q)", binary)
+	rc, err := s.openFile(path.Join(analysisBinariesBucketDir, binary+binaryMetadataSuffix))
+	if errors.Is(err, derrors.GCSNotFoundError) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, maxBinaryMetadataSize+1))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", derrors.GCSReadError, err)
+	}
+	var obj map[string]any
+	if len(data) > maxBinaryMetadataSize {
+		err = fmt.Errorf("more than %d bytes", maxBinaryMetadataSize)
+	} else if err = json.Unmarshal(data, &obj); err == nil && obj == nil {
+		err = errors.New("not a JSON object")
+	}
+	if err != nil {
+		log.Warnf(ctx, "ignoring metadata of binary %s: %v", binary, err)
+		return "", nil
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// checkBinaries checks the names of the analysis binaries of a request.
+func checkBinaries(binaries []string) error {
+	if len(binaries) == 0 {
+		return fmt.Errorf("%w: analysis: missing binary", derrors.InvalidArgument)
+	}
+	seen := map[string]bool{}
+	for _, b := range binaries {
+		if b == "" {
+			return fmt.Errorf("%w: analysis: empty binary name", derrors.InvalidArgument)
+		}
+		if b != path.Base(b) {
+			return fmt.Errorf("%w: analysis: binary name contains slashes (must be a basename)", derrors.InvalidArgument)
+		}
+		if seen[b] {
+			return fmt.Errorf("%w: analysis: binary %s listed twice", derrors.InvalidArgument, b)
+		}
+		seen[b] = true
+	}
+	return nil
+}
+
 func (s *analysisServer) readWorkVersion(ctx context.Context, module_path, version, binary string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -171,86 +358,151 @@ func (s *analysisServer) readWorkVersion(ctx context.Context, module_path, versi
 	return nil
 }
 
-func (s *analysisServer) scan(ctx context.Context, req *analysis.ScanRequest, localBinaryPath string, wv analysis.WorkVersion) *analysis.Result {
-	row := &analysis.Result{
-		ModulePath:  req.Module,
-		Version:     req.Version,
-		BinaryName:  req.Binary,
-		WorkVersion: wv,
+// An analysisRun is a run of an analysis binary on a module.
+type analysisRun struct {
+	binary   string // name of the binary
+	path     string // local path of the binary
+	metadata string // JSON sidecar of the binary, or ""
+	wv       analysis.WorkVersion
+}
+
+// scan downloads the module of req once and runs each of the binaries
+// of runs on it in turn. It returns a row for each run, in order.
+// Errors are recorded in the rows; an error running one binary does
+// not prevent the others from running.
+func (s *analysisServer) scan(ctx context.Context, req *analysis.ScanRequest, runs []*analysisRun, lim analysisLimits) []*analysis.Result {
+	var rows []*analysis.Result
+	id := instanceID(ctx)
+	for _, run := range runs {
+		row := &analysis.Result{
+			ModulePath:  req.Module,
+			Version:     req.Version,
+			BinaryName:  run.binary,
+			WorkVersion: run.wv,
+		}
+		if req.JobID != "" {
+			row.JobID = bq.NullString{StringVal: req.JobID, Valid: true}
+		}
+		if run.metadata != "" {
+			row.BinaryMetadata = bq.NullString{StringVal: run.metadata, Valid: true}
+		}
+		row.InstanceID, row.TaskRetryCount, row.TaskExecutionCount = runColumns(id, req.Attempt)
+		rows = append(rows, row)
 	}
-	hasGoMod := true
-	err := doScan(ctx, req.Module, req.Version, req.Insecure, func() (err error) {
-		// Create a module directory. scanInternal will write the module contents there,
-		// and both the analysis binary and addSource will read them.
+	runErrs := make([]error, len(runs))
+	hasGoMod, err := s.withModule(ctx, req, func(sbox *sandbox.Sandbox, mdir string) error {
+		var info *proxy.VersionInfo
+		for i, run := range runs {
+			row := rows[i]
+			runErrs[i] = func() error {
+				start := time.Now()
+				jsonTree, cpu, err := runAnalysisBinary(ctx, sbox, run.path, req.Args, mdir, lim)
+				row.ScanSeconds = bq.NullFloat64{Float64: time.Since(start).Seconds(), Valid: true}
+				row.ScanCPUSeconds = bq.NullFloat64{Float64: cpu.Seconds(), Valid: true}
+				if err != nil {
+					return err
+				}
+				if info == nil {
+					info, err = s.proxyClient.Info(ctx, req.Module, req.Version)
+					if err != nil {
+						return fmt.Errorf("%w: %v", derrors.ProxyError, err)
+					}
+				}
+				row.Version = info.Version
+				row.CommitTime = info.Time
+				row.Diagnostics = analysis.JSONTreeToDiagnostics(jsonTree)
+				return addSource(ctx, row.Diagnostics, 1)
+			}()
+		}
+		return nil
+	})
+	for i, row := range rows {
+		// An error preparing the module applies to every run.
+		rerr := err
+		if rerr == nil {
+			rerr = runErrs[i]
+		}
+		if rerr != nil {
+			row.AddError(classifyAnalysisError(rerr, hasGoMod))
+		}
+		row.SortVersion = version.ForSorting(row.Version)
+	}
+	return rows
+}
+
+// withModule downloads the module of req to a new directory, and calls f
+// with that directory and the sandbox to run binaries in, which is nil
+// for insecure requests. It reports whether the module has a go.mod file.
+func (s *analysisServer) withModule(ctx context.Context, req *analysis.ScanRequest, f func(sbox *sandbox.Sandbox, mdir string) error) (hasGoMod bool, err error) {
+	hasGoMod = true
+	err = doScan(ctx, req.Module, req.Version, "analysis", req.Insecure, s.cfg.ScanDiskLimit, s.moduleCache, func() (err error) {
+		// Create a module directory. prepareModule will write the module contents there,
+		// and both the analysis binaries and addSource will read them.
 		mdir := moduleDir(req.Module, req.Version)
 		defer derrors.Cleanup(&err, func() error { return os.RemoveAll(mdir) })
 
 		hasGoMod = fileExists(filepath.Join(mdir, "go.mod")) // for precise error breakdown
 
-		jsonTree, err := s.scanInternal(ctx, req, localBinaryPath, mdir)
-		if err != nil {
+		if _, err := prepareModule(ctx, req.Module, req.Version, mdir, s.proxyClient, s.checksumDB, s.moduleCache, s.goEnv, req.Insecure, !req.SkipInit); err != nil {
 			return err
 		}
-		info, err := s.proxyClient.Info(ctx, req.Module, req.Version)
-		if err != nil {
-			return fmt.Errorf("%w: %v", derrors.ProxyError, err)
+		var sbox *sandbox.Sandbox
+		if !req.Insecure {
+			var release func(error)
+			sbox, release, err = s.getSandbox(ctx)
+			if err != nil {
+				return err
+			}
+			defer func() { release(err) }()
 		}
-		row.Version = info.Version
-		row.CommitTime = info.Time
-		row.Diagnostics = analysis.JSONTreeToDiagnostics(jsonTree)
-		return addSource(ctx, row.Diagnostics, 1)
+		return f(sbox, mdir)
 	})
-	if err != nil {
-		// The errors are classified as to explicitly make a distinction
-		// between misc errors for modules and non-modules. The intended
-		// audience for analysis pipeline will directly look at errors.
-		// Without this distinction, experiments where there are a lot of
-		// misc errors might sway users into thinking that something is
-		// wrong with their analysis, while in fact it can be the case
-		// that synthetic (non-modules) are just outdated.
-		switch {
-		case isNoModulesSpecified(err):
-			// We try to turn every non-module project into a module, so this
-			// branch should never be reached. We keep this for sanity and to
-			// catch any regressions.
-			err = fmt.Errorf("%v: %w", err, derrors.LoadPackagesNoGoModError)
-		case isModVendor(err):
-			err = fmt.Errorf("%v: %w", err, derrors.LoadVendorError)
-		case isNoRequiredModule(err):
-			err = fmt.Errorf("%v: %w", err, derrors.LoadPackagesNoRequiredModuleError)
-		case isTooManyFiles(err):
-			err = fmt.Errorf("%v: %w", err, derrors.ScanModuleTooManyOpenFiles)
-		case isMissingGoSumEntry(err):
-			err = fmt.Errorf("%v: %w", err, derrors.LoadPackagesMissingGoSumEntryError)
-		case isReplacingWithLocalPath(err):
-			err = fmt.Errorf("%v: %w", err, derrors.LoadPackagesImportedLocalError)
-		case isProxyCacheMiss(err):
-			err = fmt.Errorf("%v: %w", err, derrors.ProxyError)
-		case isSandboxRelatedIssue(err):
-			err = fmt.Errorf("%v: %w", err, derrors.ScanModuleSandboxError)
-		case isBuildIssue(err):
-			err = fmt.Errorf("%v: %w", err, derrors.LoadPackagesError)
-		case !hasGoMod:
-			// Classify misc errors on synthetic modules separately.
-			err = fmt.Errorf("%v: %w", err, derrors.ScanSyntheticModuleError)
-		default:
-		}
-		row.AddError(err)
-	}
-	row.SortVersion = version.ForSorting(row.Version)
-	return row
+	return hasGoMod, err
 }
 
-func (s *analysisServer) scanInternal(ctx context.Context, req *analysis.ScanRequest, binaryPath, moduleDir string) (jt analysis.JSONTree, err error) {
-	if err := prepareModule(ctx, req.Module, req.Version, moduleDir, s.proxyClient, req.Insecure, !req.SkipInit); err != nil {
-		return nil, err
+// classifyAnalysisError returns err wrapped with its error category.
+// hasGoMod reports whether the module has a go.mod file.
+func classifyAnalysisError(err error, hasGoMod bool) error {
+	// The errors are classified as to explicitly make a distinction
+	// between misc errors for modules and non-modules. The intended
+	// audience for analysis pipeline will directly look at errors.
+	// Without this distinction, experiments where there are a lot of
+	// misc errors might sway users into thinking that something is
+	// wrong with their analysis, while in fact it can be the case
+	// that synthetic (non-modules) are just outdated.
+	switch {
+	case errors.Is(err, derrors.AnalysisTimeoutError), errors.Is(err, derrors.AnalysisOutputTooLarge),
+		errors.Is(err, derrors.AnalysisInvalidOutput), errors.Is(err, derrors.ScanModuleMemoryLimitExceeded):
+		// Already classified by runAnalysisBinary.
+	case errors.Is(err, derrors.ScanModuleDiskSpaceError):
+		// Already classified by doScan.
+	case isNoModulesSpecified(err):
+		// We try to turn every non-module project into a module, so this
+		// branch should never be reached. We keep this for sanity and to
+		// catch any regressions.
+		err = fmt.Errorf("%v: %w", err, derrors.LoadPackagesNoGoModError)
+	case isModVendor(err):
+		err = fmt.Errorf("%v: %w", err, derrors.LoadVendorError)
+	case isNoRequiredModule(err):
+		err = fmt.Errorf("%v: %w", err, derrors.LoadPackagesNoRequiredModuleError)
+	case isTooManyFiles(err):
+		err = fmt.Errorf("%v: %w", err, derrors.ScanModuleTooManyOpenFiles)
+	case isMissingGoSumEntry(err):
+		err = fmt.Errorf("%v: %w", err, derrors.LoadPackagesMissingGoSumEntryError)
+	case isReplacingWithLocalPath(err):
+		err = fmt.Errorf("%v: %w", err, derrors.LoadPackagesImportedLocalError)
+	case isProxyCacheMiss(err):
+		err = fmt.Errorf("%v: %w", err, derrors.ProxyError)
+	case isSandboxRelatedIssue(err):
+		err = fmt.Errorf("%v: %w", err, derrors.ScanModuleSandboxError)
+	case isBuildIssue(err):
+		err = fmt.Errorf("%v: %w", err, derrors.LoadPackagesError)
+	case !hasGoMod:
+		// Classify misc errors on synthetic modules separately.
+		err = fmt.Errorf("%v: %w", err, derrors.ScanSyntheticModuleError)
+	default:
 	}
-	var sbox *sandbox.Sandbox
-	if !req.Insecure {
-		sbox = sandbox.New("/bundle")
-		sbox.Runsc = "/usr/local/bin/runsc"
-	}
-	return runAnalysisBinary(sbox, binaryPath, req.Args, moduleDir)
+	return err
 }
 
 func hashFile(filename string) (_ string, err error) {
@@ -271,31 +523,124 @@ func hashReader(r io.Reader) (string, error) {
 	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-// runAnalysisBinary runs the binary on the module.
-func runAnalysisBinary(sbox *sandbox.Sandbox, binaryPath, reqArgs, moduleDir string) (analysis.JSONTree, error) {
+// analysisLimits bounds a single run of an analysis binary.
+type analysisLimits struct {
+	timeout   time.Duration // if positive, maximum running time
+	maxOutput int           // if positive, maximum bytes of output
+}
+
+// analysisLimits returns the limits for a scan request.
+// timeout, if non-empty, overrides the configured timeout.
+func (s *analysisServer) analysisLimits(timeout string) (analysisLimits, error) {
+	lim := analysisLimits{timeout: s.cfg.AnalysisTimeout, maxOutput: s.cfg.AnalysisMaxOutput}
+	if timeout != "" {
+		d, err := parseAnalysisTimeout(timeout)
+		if err != nil {
+			return lim, err
+		}
+		lim.timeout = d
+	}
+	return lim, nil
+}
+
+// parseAnalysisTimeout parses the timeout parameter of an analysis request.
+func parseAnalysisTimeout(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%w: analysis: timeout must be a positive duration, got %q", derrors.InvalidArgument, s)
+	}
+	return d, nil
+}
+
+// isAnalysisLimitCategory reports whether category is that of an
+// analysis binary that exceeded its limits.
+func isAnalysisLimitCategory(category string) bool {
+	return category == derrors.CategorizeError(derrors.AnalysisTimeoutError) ||
+		category == derrors.CategorizeError(derrors.AnalysisOutputTooLarge)
+}
+
+// runAnalysisBinary runs the binary on the module, within the limits of lim.
+// It also returns the CPU time the binary used.
+func runAnalysisBinary(ctx context.Context, sbox *sandbox.Sandbox, binaryPath, reqArgs, moduleDir string, lim analysisLimits) (analysis.JSONTree, time.Duration, error) {
+	out, cpu, err := runAnalysisBinaryOutput(ctx, sbox, binaryPath, reqArgs, moduleDir, lim)
+	if err != nil {
+		return nil, cpu, err
+	}
+	tree, err := analysis.ParseJSONTree(out)
+	if err != nil {
+		return nil, cpu, fmt.Errorf("analysis binary %s: %v; output begins %q: %w",
+			binaryPath, err, outputPrefix(out, invalidOutputPrefixLen), derrors.AnalysisInvalidOutput)
+	}
+	return tree, cpu, nil
+}
+
+// runAnalysisBinaryOutput runs the binary on the module, within the
+// limits of lim, and returns its raw output and the CPU time it used.
+func runAnalysisBinaryOutput(ctx context.Context, sbox *sandbox.Sandbox, binaryPath, reqArgs, moduleDir string, lim analysisLimits) ([]byte, time.Duration, error) {
 	args := []string{"-json"}
 	args = append(args, strings.Fields(reqArgs)...)
 	args = append(args, "./...")
-	out, err := runBinaryInDir(sbox, binaryPath, args, moduleDir)
-	if err != nil {
-		return nil, fmt.Errorf("running analysis binary %s: %s", binaryPath, derrors.IncludeStderr(err))
+	if lim.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, lim.timeout)
+		defer cancel()
 	}
-	var tree analysis.JSONTree
-	if err := json.Unmarshal(out, &tree); err != nil {
-		return nil, err
+	out, cpu, err := runBinaryInDir(ctx, sbox, binaryPath, args, moduleDir, lim.maxOutput)
+	switch {
+	case errors.Is(err, sandbox.ErrOutputTooLarge):
+		return nil, cpu, fmt.Errorf("running analysis binary %s: %v: %w", binaryPath, err, derrors.AnalysisOutputTooLarge)
+	case isSandboxMemoryLimit(err):
+		return nil, cpu, fmt.Errorf("running analysis binary %s: %v: %w", binaryPath, err, derrors.ScanModuleMemoryLimitExceeded)
+	case err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return nil, cpu, fmt.Errorf("running analysis binary %s: killed after %s: %w", binaryPath, lim.timeout, derrors.AnalysisTimeoutError)
+	case err != nil:
+		return nil, cpu, fmt.Errorf("running analysis binary %s: %s", binaryPath, derrors.IncludeStderr(err))
 	}
-	return tree, nil
+	return out, cpu, nil
+}
+
+// isSandboxMemoryLimit reports whether err shows that a command was
+// stopped for exceeding the memory limit of its sandbox.
+func isSandboxMemoryLimit(err error) bool {
+	var le *sandbox.LimitError
+	return errors.As(err, &le) && le.Resource == sandbox.ResourceMemory
 }
 
-func runBinaryInDir(sbox *sandbox.Sandbox, path string, args []string, dir string) ([]byte, error) {
+// invalidOutputPrefixLen is the number of bytes of invalid analysis
+// output that are recorded in the error.
+const invalidOutputPrefixLen = 300
+
+// outputPrefix returns the first n bytes of out.
+func outputPrefix(out []byte, n int) string {
+	if len(out) > n {
+		return string(out[:n]) + "..."
+	}
+	return string(out)
+}
+
+// runBinaryInDir runs the binary at path in dir, and returns its output
+// and the CPU time it used.
+// The binary is killed when ctx is done. If maxOutput is positive and
+// the binary writes more than that, runBinaryInDir returns an error
+// wrapping sandbox.ErrOutputTooLarge.
+func runBinaryInDir(ctx context.Context, sbox *sandbox.Sandbox, path string, args []string, dir string, maxOutput int) ([]byte, time.Duration, error) {
 	if sbox == nil {
-		cmd := exec.Command(path, args...)
+		cmd := exec.CommandContext(ctx, path, args...)
 		cmd.Dir = dir
-		return cmd.Output()
+		out, err := cmd.Output()
+		cpu := sandbox.CPUTime(cmd.ProcessState)
+		if err == nil && maxOutput > 0 && len(out) > maxOutput {
+			return nil, cpu, fmt.Errorf("%w: more than %d bytes", sandbox.ErrOutputTooLarge, maxOutput)
+		}
+		return out, cpu, err
 	}
-	cmd := sbox.Command(path, args...)
+	cmd := sbox.CommandContext(ctx, path, args...)
 	cmd.Dir = dir
-	return cmd.Output()
+	if maxOutput > 0 {
+		cmd.LimitOutput(maxOutput)
+	}
+	out, err := cmd.Output()
+	return out, cmd.CPUTime(), err
 }
 
 // addSource adds source code lines to the diagnostics.
@@ -401,62 +746,290 @@ func readSource(file string, line int, nContext int) (_ string, err error) {
 	return strings.Join(lines, "\n"), nil
 }
 
+// handleEnqueue enqueues analysis tasks and writes a jobs.EnqueueResponse
+// as JSON, or in plain text if the request accepts only text/plain.
+// With dryrun=true, it selects the modules as usual, but instead of
+// creating a job and enqueuing tasks, it writes a jobs.DryRunResponse
+// describing them.
 func (s *analysisServer) handleEnqueue(w http.ResponseWriter, r *http.Request) (err error) {
 	defer derrors.Wrap(&err, "analysisServer.handleEnqueue")
 	ctx := r.Context()
 	params := &analysis.EnqueueParams{Min: defaultMinImportedByCount}
-	if err := scan.ParseParams(r, params); err != nil {
-		return fmt.Errorf("%w: %v", derrors.InvalidArgument, err)
+	checks := map[string]scan.Check{"min": scan.NonNegative, "sample": scan.Fraction}
+	if err := scan.ParseRequestStrict(r, params, checks); err != nil {
+		return fmt.Errorf("%w: %w", derrors.InvalidArgument, err)
 	}
-	if params.Binary == "" {
-		return fmt.Errorf("%w: analysis: missing binary", derrors.InvalidArgument)
+	binaries := analysis.SplitBinaries(params.Binary)
+	if err := checkBinaries(binaries); err != nil {
+		return err
 	}
-	if params.Binary != path.Base(params.Binary) {
-		return fmt.Errorf("%w: analysis: binary name contains slashes (must be a basename)", derrors.InvalidArgument)
+	if err := queue.CheckPriority(params.Priority); err != nil {
+		return fmt.Errorf("%w: analysis: %v", derrors.InvalidArgument, err)
 	}
-	srcPath := path.Join(analysisBinariesBucketDir, params.Binary)
-	rc, err := s.openFile(srcPath)
+	lim, err := s.analysisLimits(params.Timeout)
 	if err != nil {
 		return err
 	}
-	defer rc.Close()
-	binaryHash, err := hashReader(rc)
+	if params.Notify != "" {
+		if u, err := url.Parse(params.Notify); err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("%w: analysis: notify must be an https URL", derrors.InvalidArgument)
+		}
+		if params.User == "" {
+			return fmt.Errorf("%w: analysis: notify requires a user, to create a job", derrors.InvalidArgument)
+		}
+	}
+	binaryHash, missing, err := s.hashBinaries(binaries, params.DryRun)
 	if err != nil {
 		return err
 	}
-	mods, err := readModules(ctx, s.cfg, params.File, params.Min)
+	var mods []scan.ModuleSpec
+	if params.Parent != "" {
+		mods, err = s.readParentFailures(ctx, params, binaryHash)
+	} else {
+		mods, err = readModules(ctx, s.cfg, params.File, params.Min)
+	}
 	if err != nil {
 		return err
 	}
+	mods, invalid := canonicalModules(ctx, mods)
+	mods = sampleModules(ctx, mods, params.Sample, params.Seed)
+	opts := &queue.Options{
+		Namespace:      "analysis",
+		TaskNameSuffix: params.Suffix,
+		Priority:       params.Priority,
+		Deadline:       analysisDeadline(lim, len(binaries)),
+	}
+	if params.DryRun {
+		min := -1
+		if params.Parent == "" {
+			min = minApplied(params.File, params.Min)
+		}
+		var dryRun jobs.DryRunResponse
+		dryRun.AddTasks("analysis", taskURLs(createAnalysisQueueTasks(params, "", binaryHash, mods), opts), min)
+		dryRun.MissingBinaries = missing
+		if wantsPlainText(r) {
+			_, err := fmt.Fprintln(w, &dryRun)
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return writeJSON(w, &dryRun)
+	}
 
+	resp := &jobs.EnqueueResponse{Queue: queue.PriorityQueueName(s.cfg.QueueName, params.Priority)}
+	if s.bqClient != nil {
+		resp.ResultsTable = s.bqClient.FullTableName(analysis.TableName)
+	}
 	// If a user was provided, create a Job.
 	var jobID string
-	sj := ""
 	if params.User != "" {
 		job := jobs.NewJob(params.User, time.Now(), r.URL.String(), params.Binary, binaryHash, params.Args)
-		jobID = job.ID()
+		job.ParentID = params.Parent
+		job.Request = jobRequest(params)
+		// Without a job, the tasks are enqueued anyway, but they
+		// have no job ID, and the response has none.
 		if err := s.jobDB.CreateJob(ctx, job); err != nil {
-			sj = fmt.Sprintf(", but could not create job: %v", err)
+			resp.JobError = err.Error()
 		} else {
-			sj = ", job ID is " + jobID
+			jobID = job.ID()
+			resp.JobID = jobID
 		}
 	}
 
 	tasks := createAnalysisQueueTasks(params, jobID, binaryHash, mods)
-	err = enqueueTasks(ctx, tasks, s.queue,
-		&queue.Options{Namespace: "analysis", TaskNameSuffix: params.Suffix})
-	if err != nil {
-		if err := s.jobDB.DeleteJob(ctx, jobID); err != nil {
-			log.Errorf(ctx, err, "failed to delete job upon unsuccessful enqueuing")
+	opts.JobID = jobID
+	nEnqueued, err := enqueueTasks(ctx, s.cfg, tasks, s.queue, opts)
+	if err != nil && nEnqueued == 0 {
+		if jobID != "" {
+			if err := s.jobDB.DeleteJob(ctx, jobID); err != nil {
+				log.Errorf(ctx, err, "failed to delete job upon unsuccessful enqueuing")
+			}
 		}
-		return fmt.Errorf("enequeue failed: %w", err)
+		return fmt.Errorf("enqueue failed: %w", err)
 	}
+	s.writeInvalidModules(ctx, jobID, binaries, invalid)
 	if jobID != "" {
-		s.jobDB.Increment(ctx, jobID, "NumEnqueued", len(tasks))
+		// Count only the tasks that were added, so the job can finish.
+		s.jobDB.Increment(ctx, jobID, "NumEnqueued", nEnqueued)
+		// All the tasks may have finished already.
+		s.finishJobIfDone(ctx, jobID)
 	}
 	// Communicate enqueue status for better usability.
-	fmt.Fprintf(w, "enqueued %d analysis tasks successfully%s\n", len(tasks), sj)
-	return nil
+	resp.NumTasks = len(tasks)
+	resp.NumEnqueued = nEnqueued
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	if wantsPlainText(r) {
+		_, err := fmt.Fprintln(w, resp)
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return writeJSON(w, resp)
+}
+
+// writeInvalidModules records each module of invalid as skipped for
+// each of binaries, so that it is accounted for in the results of the
+// job with jobID even though it is not scanned. An upload error is
+// only logged, since the valid modules have been enqueued.
+func (s *analysisServer) writeInvalidModules(ctx context.Context, jobID string, binaries []string, invalid []scan.InvalidModule) {
+	if len(invalid) == 0 {
+		return
+	}
+	var rows []bigquery.Row
+	for _, m := range invalid {
+		for _, b := range binaries {
+			row := &analysis.Result{
+				ModulePath: m.Path,
+				Version:    m.Version,
+				BinaryName: b,
+			}
+			if jobID != "" {
+				row.JobID = bq.NullString{StringVal: jobID, Valid: true}
+			}
+			row.AddError(fmt.Errorf("%w: invalid module: %v", derrors.ScanModuleSkipped, m.Err))
+			rows = append(rows, row)
+		}
+	}
+	if err := s.rows.upload(ctx, analysis.TableName, rows); err != nil {
+		log.Errorf(ctx, err, "recording %d invalid modules", len(invalid))
+	}
+}
+
+// writeFailureRows uploads a row with err for each binary of req that is
+// not in recorded. The task failed before those binaries ran on the
+// module, so without the rows the module would be missing from the
+// failures of req's job (see analysis.ReadJobFailures).
+func (s *analysisServer) writeFailureRows(ctx context.Context, req *analysis.ScanRequest, recorded map[string]bool, err error) {
+	var rows []bigquery.Row
+	id := instanceID(ctx)
+	for _, b := range analysis.SplitBinaries(req.Binary) {
+		if recorded[b] {
+			continue
+		}
+		row := &analysis.Result{
+			ModulePath: req.Module,
+			Version:    req.Version,
+			BinaryName: b,
+			JobID:      bq.NullString{StringVal: req.JobID, Valid: true},
+		}
+		row.InstanceID, row.TaskRetryCount, row.TaskExecutionCount = runColumns(id, req.Attempt)
+		row.AddError(err)
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return
+	}
+	if err := s.rows.upload(ctx, analysis.TableName, rows); err != nil {
+		log.Errorf(ctx, err, "recording the failure of %s@%s", req.Module, req.Version)
+	}
+}
+
+// jobRequest returns the record of an analysis enqueue request with
+// params, for its job.
+func jobRequest(params *analysis.EnqueueParams) jobs.Request {
+	return jobs.Request{
+		Mode:     "analysis",
+		Binary:   params.Binary,
+		Args:     params.Args,
+		Insecure: params.Insecure,
+		Min:      params.Min,
+		File:     params.File,
+		Suffix:   params.Suffix,
+		SkipInit: params.SkipInit,
+		Parent:   params.Parent,
+		Priority: params.Priority,
+		Notify:   params.Notify,
+		Timeout:  params.Timeout,
+		Sample:   params.Sample,
+		Seed:     params.Seed,
+	}
+}
+
+// wantsPlainText reports whether r accepts only plain text, as
+// clients written before responses were JSON ask for.
+func wantsPlainText(r *http.Request) bool {
+	return r.Header.Get("Accept") == "text/plain"
+}
+
+// analysisDeadline returns the dispatch deadline of a task that runs
+// nBinaries analysis binaries, each within lim.
+func analysisDeadline(lim analysisLimits, nBinaries int) time.Duration {
+	if lim.timeout <= 0 {
+		return queue.MaxCloudTasksTimeout
+	}
+	return queue.ClampDeadline(time.Duration(nBinaries)*lim.timeout + taskOverhead)
+}
+
+// hashBinaries returns the comma-separated hashes of the analysis
+// binaries in GCS, in order. If dryRun is true, a binary that is not in
+// GCS has an empty hash and is returned in missing instead of causing
+// an error, so that a job can be previewed before its binary is
+// uploaded.
+func (s *analysisServer) hashBinaries(binaries []string, dryRun bool) (hash string, missing []string, err error) {
+	var hashes []string
+	for _, b := range binaries {
+		rc, err := s.openFile(path.Join(analysisBinariesBucketDir, b))
+		if dryRun && errors.Is(err, derrors.GCSNotFoundError) {
+			missing = append(missing, b)
+			hashes = append(hashes, "")
+			continue
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		h, err := hashReader(rc)
+		rc.Close()
+		if err != nil {
+			return "", nil, err
+		}
+		hashes = append(hashes, h)
+	}
+	return strings.Join(hashes, ","), missing, nil
+}
+
+// estimateSampleSize is the maximum number of module paths
+// returned by analysis/estimate.
+const estimateSampleSize = 10
+
+// handleEstimate reports how many modules analysis/enqueue would select
+// for the given min. It does not enqueue anything.
+func (s *analysisServer) handleEstimate(w http.ResponseWriter, r *http.Request) (err error) {
+	defer derrors.Wrap(&err, "analysisServer.handleEstimate")
+	ctx := r.Context()
+	params := &analysis.EstimateParams{Min: defaultMinImportedByCount}
+	if err := scan.ParseParams(r, params); err != nil {
+		return fmt.Errorf("%w: %v", derrors.InvalidArgument, err)
+	}
+	mods, err := readModules(ctx, s.cfg, params.File, params.Min)
+	if err != nil {
+		return err
+	}
+	est := &analysis.Estimate{NumModules: len(mods), Sample: []string{}}
+	for _, m := range mods[:min(len(mods), estimateSampleSize)] {
+		est.Sample = append(est.Sample, m.Path)
+	}
+	return writeJSON(w, est)
+}
+
+// readParentFailures returns the modules that failed in the job params.Parent.
+// That job must have been run with the same binary and args.
+func (s *analysisServer) readParentFailures(ctx context.Context, params *analysis.EnqueueParams, binaryHash string) ([]scan.ModuleSpec, error) {
+	if s.jobDB == nil {
+		return nil, errors.New("jobs DB not configured")
+	}
+	parent, err := s.jobDB.GetJob(ctx, params.Parent)
+	if err != nil {
+		return nil, err
+	}
+	if parent.Binary != params.Binary || parent.BinaryVersion != binaryHash || parent.BinaryArgs != params.Args {
+		return nil, fmt.Errorf("%w: job %s was run with a different binary or args", derrors.InvalidArgument, params.Parent)
+	}
+	mods, err := jobFailures(ctx, s.bqClient, parent)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof(ctx, "retrying %d failed modules of job %s", len(mods), params.Parent)
+	return mods, nil
 }
 
 func createAnalysisQueueTasks(params *analysis.EnqueueParams, jobID string, binaryVersion string, mods []scan.ModuleSpec) []queue.Task {
@@ -475,8 +1048,117 @@ func createAnalysisQueueTasks(params *analysis.EnqueueParams, jobID string, bina
 				Insecure:      params.Insecure,
 				JobID:         jobID,
 				SkipInit:      params.SkipInit,
+				Timeout:       params.Timeout,
 			},
 		})
 	}
 	return tasks
 }
+
+// The module that analysis/validate runs a binary on by default.
+// It is small, but has enough packages to exercise most analyzers.
+const (
+	validateModule  = "github.com/google/go-cmp"
+	validateVersion = "v0.6.0"
+)
+
+// handleValidate runs an analysis binary on a single module and reports
+// whether its output has the expected form, so that authors can check a
+// binary before enqueuing a job. It does not write to BigQuery.
+func (s *analysisServer) handleValidate(w http.ResponseWriter, r *http.Request) (err error) {
+	defer derrors.Wrap(&err, "analysisServer.handleValidate")
+	ctx := r.Context()
+	params := &analysis.ValidateParams{}
+	if err := scan.ParseParams(r, params); err != nil {
+		return fmt.Errorf("%w: %v", derrors.InvalidArgument, err)
+	}
+	if err := checkBinaries([]string{params.Binary}); err != nil {
+		return err
+	}
+	if params.Module == "" {
+		params.Module, params.Version = validateModule, validateVersion
+	} else if params.Version == "" {
+		return fmt.Errorf("%w: analysis: module requires a version", derrors.InvalidArgument)
+	}
+	lim, err := s.analysisLimits("")
+	if err != nil {
+		return err
+	}
+	localBinaryPath, binaryHash, err := s.downloadBinary(params.Binary)
+	if err != nil {
+		return err
+	}
+	defer derrors.Cleanup(&err, func() error { return os.Remove(localBinaryPath) })
+
+	req := &analysis.ScanRequest{
+		ModuleURLPath: scan.ModuleURLPath{Module: params.Module, Version: params.Version},
+		ScanParams: analysis.ScanParams{
+			Binary:        params.Binary,
+			BinaryVersion: binaryHash,
+			Args:          params.Args,
+			Insecure:      params.Insecure,
+		},
+	}
+	row := s.scan(ctx, req, []*analysisRun{{binary: params.Binary, path: localBinaryPath}}, lim)[0]
+	return writeJSON(w, &analysis.Validation{
+		Module:         row.ModulePath,
+		Version:        row.Version,
+		Binary:         params.Binary,
+		BinaryVersion:  binaryHash,
+		Valid:          row.Error == "",
+		Error:          row.Error,
+		ErrorCategory:  row.ErrorCategory,
+		NumDiagnostics: len(row.Diagnostics),
+	})
+}
+
+// handleTest runs an analysis binary on a single module and writes the
+// raw output of the binary to the response. It is for trying out a
+// binary on one module; it does not write to BigQuery or update jobs.
+// The path is /analysis/test/MODULE@VERSION.
+func (s *analysisServer) handleTest(w http.ResponseWriter, r *http.Request) (err error) {
+	defer derrors.Wrap(&err, "analysisServer.handleTest")
+	ctx := r.Context()
+	mp, err := scan.ParseModuleURLPath(strings.TrimPrefix(r.URL.Path, "/analysis/test"))
+	if err != nil {
+		return fmt.Errorf("%w: %v", derrors.InvalidArgument, err)
+	}
+	params := &analysis.TestParams{}
+	if err := scan.ParseParams(r, params); err != nil {
+		return fmt.Errorf("%w: %v", derrors.InvalidArgument, err)
+	}
+	if err := checkBinaries([]string{params.Binary}); err != nil {
+		return err
+	}
+	lim, err := s.analysisLimits("")
+	if err != nil {
+		return err
+	}
+	localBinaryPath, _, err := s.downloadBinary(params.Binary)
+	if err != nil {
+		return err
+	}
+	defer derrors.Cleanup(&err, func() error { return os.Remove(localBinaryPath) })
+
+	req := &analysis.ScanRequest{
+		ModuleURLPath: mp,
+		ScanParams: analysis.ScanParams{
+			Binary:   params.Binary,
+			Args:     params.Args,
+			Insecure: params.Insecure,
+			SkipInit: params.SkipInit,
+		},
+	}
+	var out []byte
+	hasGoMod, err := s.withModule(ctx, req, func(sbox *sandbox.Sandbox, mdir string) error {
+		var err error
+		out, _, err = runAnalysisBinaryOutput(ctx, sbox, localBinaryPath, params.Args, mdir, lim)
+		return err
+	})
+	if err != nil {
+		return classifyAnalysisError(err, hasGoMod)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(out)
+	return err
+}
@@ -0,0 +1,55 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/pkgsite-metrics/internal/analysis"
+	"golang.org/x/pkgsite-metrics/internal/bigquery"
+	"golang.org/x/pkgsite-metrics/internal/log"
+)
+
+// analysisResultsDir is the directory in the results bucket where
+// analysis rows too large to upload are saved.
+const analysisResultsDir = "analysis"
+
+// limitAnalysisRowSize truncates row.Diagnostics so that row is at most
+// maxBytes as JSON, and marks row as truncated. Before truncating, it
+// saves the complete row to bucket, if bucket is non-nil.
+// Errors saving the row are logged.
+func limitAnalysisRowSize(ctx context.Context, bucket *storage.BucketHandle, row *analysis.Result, maxBytes int) {
+	data, err := json.Marshal(row)
+	if err != nil || len(data) <= maxBytes {
+		return
+	}
+	log.Warnf(ctx, "%s@%s %s: row is %d bytes; truncating diagnostics", row.ModulePath, row.Version, row.BinaryName, len(data))
+	if bucket != nil {
+		obj := bucket.Object(analysisResultsObjectName(row))
+		if err := writeFullResults(ctx, obj, data); err != nil {
+			log.Errorf(ctx, err, "saving full results of %s@%s", row.ModulePath, row.Version)
+		} else {
+			row.FullResultsPath = bigquery.NullString(fmt.Sprintf("gs://%s/%s", obj.BucketName(), obj.ObjectName()))
+		}
+	}
+	diags := row.Diagnostics
+	row.DiagnosticsTruncated = bigquery.NullBool(true)
+	row.NumDiagnostics = bigquery.NullInt(len(diags))
+	row.Diagnostics = nil
+	base, err := json.Marshal(row)
+	if err != nil {
+		return
+	}
+	row.Diagnostics = prefixThatFits(diags, len(base), maxBytes)
+}
+
+// analysisResultsObjectName returns the name of the object that holds
+// the complete row for row.
+func analysisResultsObjectName(row *analysis.Result) string {
+	return fmt.Sprintf("%s/%s/%s@%s.json", analysisResultsDir, row.BinaryName, row.ModulePath, row.Version)
+}
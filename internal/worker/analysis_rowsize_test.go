@@ -0,0 +1,67 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"golang.org/x/pkgsite-metrics/internal/analysis"
+)
+
+func TestLimitAnalysisRowSize(t *testing.T) {
+	ctx := context.Background()
+	newRow := func(n int) *analysis.Result {
+		row := &analysis.Result{ModulePath: "m", Version: "v1.0.0", BinaryName: "bin"}
+		for i := 0; i < n; i++ {
+			row.Diagnostics = append(row.Diagnostics, &analysis.Diagnostic{
+				PackageID:    "m/p",
+				AnalyzerName: "a",
+				Position:     fmt.Sprintf("p.go:%d:1", i),
+				Message:      "message",
+			})
+		}
+		return row
+	}
+	size := func(row *analysis.Result) int {
+		data, err := json.Marshal(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(data)
+	}
+
+	// A row just under the limit is unchanged.
+	row := newRow(50)
+	limit := size(row)
+	limitAnalysisRowSize(ctx, nil, row, limit)
+	if row.DiagnosticsTruncated.Valid || len(row.Diagnostics) != 50 {
+		t.Errorf("row at limit: got truncated=%t, %d diagnostics; want false, 50", row.DiagnosticsTruncated.Bool, len(row.Diagnostics))
+	}
+
+	// A row just over the limit loses some diagnostics.
+	row = newRow(50)
+	limitAnalysisRowSize(ctx, nil, row, limit-1)
+	if !row.DiagnosticsTruncated.Bool || row.NumDiagnostics.Int64 != 50 {
+		t.Errorf("row over limit: got truncated=%t, NumDiagnostics=%d; want true, 50", row.DiagnosticsTruncated.Bool, row.NumDiagnostics.Int64)
+	}
+	if n := len(row.Diagnostics); n == 0 || n >= 50 {
+		t.Errorf("row over limit: got %d diagnostics, want between 0 and 50", n)
+	}
+	if s := size(row); s > limit-1 {
+		t.Errorf("row over limit: got size %d, want at most %d", s, limit-1)
+	}
+}
+
+func TestAnalysisResultsObjectName(t *testing.T) {
+	row := &analysis.Result{ModulePath: "example.com/m", Version: "v1.0.0", BinaryName: "bin"}
+	got := analysisResultsObjectName(row)
+	want := "analysis/bin/example.com/m@v1.0.0.json"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
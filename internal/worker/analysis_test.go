@@ -6,18 +6,30 @@ package worker
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	bq "cloud.google.com/go/bigquery"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"golang.org/x/pkgsite-metrics/internal/analysis"
+	"golang.org/x/pkgsite-metrics/internal/bigquery"
 	"golang.org/x/pkgsite-metrics/internal/buildtest"
 	"golang.org/x/pkgsite-metrics/internal/config"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/jobs"
 	"golang.org/x/pkgsite-metrics/internal/proxy/proxytest"
 	"golang.org/x/pkgsite-metrics/internal/queue"
 	"golang.org/x/pkgsite-metrics/internal/scan"
@@ -26,7 +38,7 @@ import (
 func TestRunAnalysisBinary(t *testing.T) {
 	binPath := buildtest.GoBuild(t, "testdata/analyzer", "")
 
-	got, err := runAnalysisBinary(nil, binPath, "-name Fact", "testdata/module")
+	got, _, err := runAnalysisBinary(context.Background(), nil, binPath, "-name Fact", "testdata/module", analysisLimits{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -64,6 +76,52 @@ func TestRunAnalysisBinary(t *testing.T) {
 	}
 }
 
+func TestRunAnalysisBinaryLimits(t *testing.T) {
+	ctx := context.Background()
+	binPath := buildtest.GoBuild(t, "testdata/analyzer", "")
+	_, _, err := runAnalysisBinary(ctx, nil, binPath, "-name Fact", "testdata/module", analysisLimits{maxOutput: 10})
+	if !errors.Is(err, derrors.AnalysisOutputTooLarge) {
+		t.Errorf("got %v, want AnalysisOutputTooLarge", err)
+	}
+
+	sleeper := filepath.Join(t.TempDir(), "sleeper")
+	if err := os.WriteFile(sleeper, []byte("#!/bin/sh\nexec sleep 10\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = runAnalysisBinary(ctx, nil, sleeper, "", "testdata/module", analysisLimits{timeout: 100 * time.Millisecond})
+	if !errors.Is(err, derrors.AnalysisTimeoutError) {
+		t.Errorf("got %v, want AnalysisTimeoutError", err)
+	}
+	if got, want := derrors.CategorizeError(classifyAnalysisError(err, true)), "ANALYSIS TIMEOUT"; got != want {
+		t.Errorf("got category %q, want %q", got, want)
+	}
+}
+
+func TestRunAnalysisBinaryInvalidOutput(t *testing.T) {
+	bad := filepath.Join(t.TempDir(), "bad")
+	if err := os.WriteFile(bad, []byte("#!/bin/sh\necho 'not JSON'\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := runAnalysisBinary(context.Background(), nil, bad, "", "testdata/module", analysisLimits{})
+	if !errors.Is(err, derrors.AnalysisInvalidOutput) {
+		t.Fatalf("got %v, want AnalysisInvalidOutput", err)
+	}
+	if !strings.Contains(err.Error(), "not JSON") {
+		t.Errorf("error %q does not contain the output", err)
+	}
+}
+
+func TestParseAnalysisTimeout(t *testing.T) {
+	if d, err := parseAnalysisTimeout("90s"); err != nil || d != 90*time.Second {
+		t.Errorf("got (%s, %v), want 90s", d, err)
+	}
+	for _, bad := range []string{"x", "0s", "-1m"} {
+		if _, err := parseAnalysisTimeout(bad); !errors.Is(err, derrors.InvalidArgument) {
+			t.Errorf("%q: got %v, want InvalidArgument", bad, err)
+		}
+	}
+}
+
 func TestCreateAnalysisQueueTasks(t *testing.T) {
 	mods := []scan.ModuleSpec{
 		{Path: "a.com/a", Version: "v1.2.3", ImportedBy: 1},
@@ -104,6 +162,26 @@ func TestCreateAnalysisQueueTasks(t *testing.T) {
 	}
 }
 
+func TestHandleEstimate(t *testing.T) {
+	s := &analysisServer{Server: &Server{cfg: &config.Config{}}}
+	r := httptest.NewRequest("GET", "/analysis/estimate?min=15&file=testdata/modules.txt", nil)
+	w := httptest.NewRecorder()
+	if err := s.handleEstimate(w, r); err != nil {
+		t.Fatal(err)
+	}
+	var got analysis.Estimate
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := analysis.Estimate{
+		NumModules: 2,
+		Sample:     []string{"std", "golang.org/x/net"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
 func TestAnalysisScan(t *testing.T) {
 	const (
 		modulePath = "a.com/m"
@@ -127,8 +205,13 @@ func G() {}
 
 	diff := func(want, got *analysis.Result) {
 		t.Helper()
+		// The times vary, but every run records them.
+		if !got.ScanSeconds.Valid || !got.ScanCPUSeconds.Valid {
+			t.Errorf("%s: scan times not recorded", got.BinaryName)
+		}
 		d := cmp.Diff(want, got,
-			cmpopts.IgnoreFields(analysis.Diagnostic{}, "Position"))
+			cmpopts.IgnoreFields(analysis.Diagnostic{}, "Position"),
+			cmpopts.IgnoreFields(analysis.Result{}, "ScanSeconds", "ScanCPUSeconds"))
 		if d != "" {
 			t.Errorf("mismatch (-want, +got)\n%s", d)
 		}
@@ -153,7 +236,7 @@ func G() {}
 		},
 	}
 	wv := analysis.WorkVersion{BinaryArgs: "-name G", BinaryVersion: "bv", SchemaVersion: "sv"}
-	got := s.scan(context.Background(), req, binaryPath, wv)
+	got := s.scan(context.Background(), req, []*analysisRun{{binary: "analyzer", path: binaryPath, wv: wv}}, analysisLimits{})[0]
 	want := &analysis.Result{
 		ModulePath:    modulePath,
 		Version:       version,
@@ -163,6 +246,7 @@ func G() {}
 		WorkVersion:   wv,
 		Error:         "",
 		ErrorCategory: "",
+		JobID:         bq.NullString{StringVal: "jid", Valid: true},
 		Diagnostics: []*analysis.Diagnostic{
 			{
 				PackageID:    "a.com/m",
@@ -179,21 +263,9 @@ func G() {}
 
 	// Test that errors are put into the Result.
 	req.Binary = "bad"
-	got = s.scan(context.Background(), req, "yyy", wv)
-	// Trim varying part of error. The error is expected to be of the form
-	// "...executable file not found in $PATH: scan synthetic module error."
-	if i := strings.LastIndexByte(got.Error, ':'); i > 0 {
-		got.Error = got.Error[:i]
-		if i := strings.LastIndexByte(got.Error, ':'); i > 0 {
-			got.Error = got.Error[i+2:]
-		}
-	}
-	// And the platform-specific part.
-	if i := strings.LastIndex(got.Error, "not found in"); i > 0 {
-		got.Error = got.Error[:i+len("not found in")]
-	}
-
-	want = &analysis.Result{
+	got = s.scan(context.Background(), req, []*analysisRun{{binary: "bad", path: "yyy", wv: wv}}, analysisLimits{})[0]
+	trimError(got)
+	wantBad := &analysis.Result{
 		ModulePath:    modulePath,
 		Version:       version,
 		SortVersion:   "1,2,3~",
@@ -201,8 +273,100 @@ func G() {}
 		WorkVersion:   wv,
 		ErrorCategory: "SYNTHETIC - MISC",
 		Error:         "executable file not found in",
+		JobID:         bq.NullString{StringVal: "jid", Valid: true},
+	}
+	diff(wantBad, got)
+
+	// Test that several binaries run on the same module, and that
+	// a failure of one does not prevent the others from running.
+	req.Binary = "bad,analyzer"
+	rows := s.scan(context.Background(), req, []*analysisRun{
+		{binary: "bad", path: "yyy", wv: wv},
+		{binary: "analyzer", path: binaryPath, wv: wv},
+	}, analysisLimits{})
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows, want 2", len(rows))
+	}
+	trimError(rows[0])
+	diff(wantBad, rows[0])
+	diff(want, rows[1])
+}
+
+// trimError trims the varying parts of the error of a row for
+// a binary that does not exist.
+func trimError(row *analysis.Result) {
+	// The error is expected to be of the form
+	// "...executable file not found in $PATH: scan synthetic module error."
+	if i := strings.LastIndexByte(row.Error, ':'); i > 0 {
+		row.Error = row.Error[:i]
+		if i := strings.LastIndexByte(row.Error, ':'); i > 0 {
+			row.Error = row.Error[i+2:]
+		}
+	}
+	// And the platform-specific part.
+	if i := strings.LastIndex(row.Error, "not found in"); i > 0 {
+		row.Error = row.Error[:i+len("not found in")]
+	}
+}
+
+func TestCheckBinaries(t *testing.T) {
+	for _, test := range []struct {
+		binaries string
+		wantErr  bool
+	}{
+		{"a", false},
+		{"a,b,c", false},
+		{"", true},
+		{"a,,b", true},
+		{"a,dir/b", true},
+		{"a,b,a", true},
+	} {
+		err := checkBinaries(analysis.SplitBinaries(test.binaries))
+		if (err != nil) != test.wantErr {
+			t.Errorf("%q: got %v, want error %t", test.binaries, err, test.wantErr)
+		}
+	}
+}
+
+func TestReadBinaryMetadata(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		content string
+		openErr error
+		want    string
+		wantErr error
+	}{
+		{"valid", "{\n  \"goflags\": \"-tags=netgo\"\n}\n", nil, `{"goflags":"-tags=netgo"}`, nil},
+		{"missing", "", derrors.GCSNotFoundError, "", nil},
+		{"not an object", "[1, 2]", nil, "", nil},
+		{"null", "null", nil, "", nil},
+		{"not JSON", "\x7fELF", nil, "", nil},
+		{"too large", `{"x":"` + strings.Repeat("x", maxBinaryMetadataSize) + `"}`, nil, "", nil},
+		{"unreadable", "", derrors.GCSReadError, "", derrors.GCSReadError},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var opened string
+			s := &analysisServer{
+				openFile: func(name string) (io.ReadCloser, error) {
+					opened = name
+					if test.openErr != nil {
+						return nil, test.openErr
+					}
+					return io.NopCloser(strings.NewReader(test.content)), nil
+				},
+			}
+			got, err := s.readBinaryMetadata(context.Background(), "nilness")
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got error %v, want %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			if want := "analysis-binaries/nilness.meta.json"; opened != want {
+				t.Errorf("opened %q, want %q", opened, want)
+			}
+		})
 	}
-	diff(want, got)
 }
 
 func TestParsePosition(t *testing.T) {
@@ -259,3 +423,385 @@ func TestReadSource(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleValidate(t *testing.T) {
+	const (
+		modulePath = "a.com/m"
+		version    = "v1.2.3"
+	)
+	binaryPath := buildtest.GoBuild(t, "testdata/analyzer", "")
+	proxyClient, cleanup := proxytest.SetupTestClient(t, []*proxytest.Module{
+		{
+			ModulePath: modulePath,
+			Version:    version,
+			Files: map[string]string{
+				"go.mod": "module " + modulePath,
+				"a.go":   "package p\nfunc F() { G() }\nfunc G() {}\n",
+			},
+		},
+	})
+	defer cleanup()
+
+	s := &analysisServer{
+		Server: &Server{
+			proxyClient: proxyClient,
+			cfg:         &config.Config{BinaryDir: t.TempDir()},
+		},
+		openFile: func(string) (io.ReadCloser, error) { return os.Open(binaryPath) },
+	}
+	r := httptest.NewRequest("GET", "/analysis/validate?binary=analyzer&args=-name+G&insecure=true&module="+modulePath+"&version="+version, nil)
+	w := httptest.NewRecorder()
+	if err := s.handleValidate(w, r); err != nil {
+		t.Fatal(err)
+	}
+	var got analysis.Validation
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := analysis.Validation{
+		Module:         modulePath,
+		Version:        version,
+		Binary:         "analyzer",
+		Valid:          true,
+		NumDiagnostics: 1,
+	}
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreFields(analysis.Validation{}, "BinaryVersion")); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+
+	// A module without a version is an error.
+	r = httptest.NewRequest("GET", "/analysis/validate?binary=analyzer&module="+modulePath, nil)
+	if err := s.handleValidate(httptest.NewRecorder(), r); !errors.Is(err, derrors.InvalidArgument) {
+		t.Errorf("got %v, want InvalidArgument", err)
+	}
+}
+
+func TestHandleTest(t *testing.T) {
+	const (
+		modulePath = "a.com/m"
+		version    = "v1.2.3"
+	)
+	binaryPath := buildtest.GoBuild(t, "testdata/analyzer", "")
+	proxyClient, cleanup := proxytest.SetupTestClient(t, []*proxytest.Module{
+		{
+			ModulePath: modulePath,
+			Version:    version,
+			Files: map[string]string{
+				"go.mod": "module " + modulePath,
+				"a.go":   "package p\nfunc F() { G() }\nfunc G() {}\n",
+			},
+		},
+	})
+	defer cleanup()
+
+	s := &analysisServer{
+		Server: &Server{
+			proxyClient: proxyClient,
+			cfg:         &config.Config{BinaryDir: t.TempDir()},
+		},
+		openFile: func(string) (io.ReadCloser, error) { return os.Open(binaryPath) },
+	}
+	r := httptest.NewRequest("GET", "/analysis/test/"+modulePath+"@"+version+"?binary=analyzer&args=-name+G&insecure=true", nil)
+	w := httptest.NewRecorder()
+	if err := s.handleTest(w, r); err != nil {
+		t.Fatal(err)
+	}
+	tree, err := analysis.ParseJSONTree(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("%v; body:\n%s", err, w.Body)
+	}
+	if got := len(analysis.JSONTreeToDiagnostics(tree)); got != 1 {
+		t.Errorf("got %d diagnostics, want 1; body:\n%s", got, w.Body)
+	}
+}
+
+// TestAnalysisEnqueueLocal tests that tasks enqueued on an in-memory
+// queue are dispatched to the scan handler.
+func TestAnalysisEnqueueLocal(t *testing.T) {
+	ctx := context.Background()
+	const (
+		modulePath = "a.com/m"
+		version    = "v1.2.3"
+	)
+	binaryPath := buildtest.GoBuild(t, "testdata/analyzer", "")
+	proxyClient, cleanup := proxytest.SetupTestClient(t, []*proxytest.Module{
+		{
+			ModulePath: modulePath,
+			Version:    version,
+			Files: map[string]string{
+				"go.mod": "module " + modulePath,
+				"a.go":   "package p\nfunc F() { G() }\nfunc G() {}\n",
+			},
+		},
+	})
+	defer cleanup()
+	modFile := filepath.Join(t.TempDir(), "modules.txt")
+	if err := os.WriteFile(modFile, []byte(modulePath+" "+version+" 20\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &analysisServer{
+		Server: &Server{
+			proxyClient: proxyClient,
+			cfg:         &config.Config{BinaryDir: t.TempDir()},
+		},
+		openFile:           func(string) (io.ReadCloser, error) { return os.Open(binaryPath) },
+		storedWorkVersions: map[analysis.WorkVersionKey]analysis.WorkVersion{},
+	}
+	var (
+		mu      sync.Mutex
+		scanned []string
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/analysis/scan/", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.handleScan(w, r); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		mu.Lock()
+		scanned = append(scanned, r.URL.Path)
+		mu.Unlock()
+	})
+	q := queue.NewInMemory(ctx, 1, dispatchTask(mux))
+	s.queue = q
+
+	r := httptest.NewRequest("GET", "/analysis/enqueue?binary=analyzer&args=-name+G&insecure=true&file="+modFile, nil)
+	w := httptest.NewRecorder()
+	if err := s.handleEnqueue(w, r); err != nil {
+		t.Fatal(err)
+	}
+	var resp jobs.EnqueueResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.NumTasks != 1 || resp.NumEnqueued != 1 || resp.Error != "" {
+		t.Errorf("got response %+v, want 1 task enqueued without error", resp)
+	}
+	q.WaitForTesting(ctx)
+	want := []string{"/analysis/scan/" + modulePath + "@" + version}
+	if diff := cmp.Diff(want, scanned); diff != "" {
+		t.Errorf("scanned mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestAnalysisEnqueueDryRun(t *testing.T) {
+	modFile := filepath.Join(t.TempDir(), "modules.txt")
+	if err := os.WriteFile(modFile, []byte("a.com/m v1.2.3 20\nb.com/m v1.0.0 5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The server has no queue or job DB, so it would fail if it
+	// enqueued tasks or created a job.
+	s := &analysisServer{
+		Server:   &Server{cfg: &config.Config{}},
+		openFile: func(string) (io.ReadCloser, error) { return io.NopCloser(strings.NewReader("binary")), nil },
+	}
+	r := httptest.NewRequest("GET", "/analysis/enqueue?binary=analyzer&user=u&min=10&dryrun=true&file="+modFile, nil)
+	w := httptest.NewRecorder()
+	if err := s.handleEnqueue(w, r); err != nil {
+		t.Fatal(err)
+	}
+	var got jobs.DryRunResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.NumTasks["analysis"] != 1 || got.MinImporters["analysis"] != 10 {
+		t.Errorf("got %+v, want 1 task with a minimum of 10 importers", got)
+	}
+	if len(got.TaskURLs) != 1 || !strings.HasPrefix(got.TaskURLs[0], "/analysis/scan/a.com/m@v1.2.3?binary=analyzer") {
+		t.Errorf("got task URLs %q, want one for a.com/m@v1.2.3", got.TaskURLs)
+	}
+}
+
+func TestAnalysisEnqueueDryRunMissingBinary(t *testing.T) {
+	modFile := filepath.Join(t.TempDir(), "modules.txt")
+	if err := os.WriteFile(modFile, []byte("a.com/m v1.2.3 20\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &analysisServer{
+		Server: &Server{cfg: &config.Config{}},
+		openFile: func(name string) (io.ReadCloser, error) {
+			if strings.HasSuffix(name, "/new") {
+				return nil, fmt.Errorf("%w: %s", derrors.GCSNotFoundError, name)
+			}
+			return io.NopCloser(strings.NewReader("binary")), nil
+		},
+	}
+	r := httptest.NewRequest("GET", "/analysis/enqueue?binary=old,new&min=10&dryrun=true&file="+modFile, nil)
+	w := httptest.NewRecorder()
+	if err := s.handleEnqueue(w, r); err != nil {
+		t.Fatal(err)
+	}
+	var got jobs.DryRunResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"new"}; !slices.Equal(got.MissingBinaries, want) {
+		t.Errorf("got missing binaries %q, want %q", got.MissingBinaries, want)
+	}
+	if got.NumTasks["analysis"] != 1 {
+		t.Errorf("got %+v, want 1 task", got)
+	}
+
+	// Without a dry run, a missing binary is an error.
+	r = httptest.NewRequest("GET", "/analysis/enqueue?binary=old,new&min=10&file="+modFile, nil)
+	if err := s.handleEnqueue(httptest.NewRecorder(), r); !errors.Is(err, derrors.GCSNotFoundError) {
+		t.Errorf("got %v, want a GCS not-found error", err)
+	}
+}
+
+func TestAnalysisEnqueueSample(t *testing.T) {
+	var lines strings.Builder
+	var ms []scan.ModuleSpec
+	for i := range 50 {
+		m := scan.ModuleSpec{Path: fmt.Sprintf("example.com/m%d", i), Version: "v1.0.0", ImportedBy: i}
+		fmt.Fprintf(&lines, "%s %s %d\n", m.Path, m.Version, m.ImportedBy)
+		if i >= 10 {
+			ms = append(ms, m)
+		}
+	}
+	modFile := filepath.Join(t.TempDir(), "modules.txt")
+	if err := os.WriteFile(modFile, []byte(lines.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &analysisServer{
+		Server:   &Server{cfg: &config.Config{}},
+		openFile: func(string) (io.ReadCloser, error) { return io.NopCloser(strings.NewReader("binary")), nil },
+	}
+	// Sampling applies to the modules with at least min importers.
+	r := httptest.NewRequest("GET", "/analysis/enqueue?binary=analyzer&min=10&sample=0.3&seed=s&dryrun=true&file="+modFile, nil)
+	w := httptest.NewRecorder()
+	if err := s.handleEnqueue(w, r); err != nil {
+		t.Fatal(err)
+	}
+	var got jobs.DryRunResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := len(scan.SampleModules(ms, 0.3, "s")); got.NumTasks["analysis"] != want {
+		t.Errorf("got %d tasks, want %d", got.NumTasks["analysis"], want)
+	}
+}
+
+func TestAnalysisWriteInvalidModules(t *testing.T) {
+	sink := &bigquery.MemorySink{}
+	s := &analysisServer{Server: &Server{cfg: &config.Config{}, rows: &rowUploader{sink: sink}}}
+	_, invalid := scan.CanonicalModules([]scan.ModuleSpec{{Path: "µπΩ/github.com", Version: "v2.3.4", ImportedBy: 5}})
+	s.writeInvalidModules(context.Background(), "job", []string{"a", "b"}, invalid)
+	rows := sink.Rows(analysis.TableName)
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows, want 2", len(rows))
+	}
+	for i, r := range rows {
+		got := r.(*analysis.Result)
+		if got.ModulePath != "µπΩ/github.com" || got.BinaryName != []string{"a", "b"}[i] || got.JobID.StringVal != "job" {
+			t.Errorf("got %s@%s for binary %s in job %s", got.ModulePath, got.Version, got.BinaryName, got.JobID)
+		}
+		if want := derrors.CategorizeError(derrors.ScanModuleSkipped); got.ErrorCategory != want {
+			t.Errorf("got category %q, want %q", got.ErrorCategory, want)
+		}
+	}
+}
+
+// TestAnalysisScanFailureRow tests that a scan that fails before running
+// its binary still records the module as a failure of the job.
+func TestAnalysisScanFailureRow(t *testing.T) {
+	sink := &bigquery.MemorySink{}
+	s := &analysisServer{
+		Server: &Server{
+			cfg:  &config.Config{BinaryDir: t.TempDir()},
+			rows: &rowUploader{sink: sink},
+		},
+		openFile: func(string) (io.ReadCloser, error) { return io.NopCloser(strings.NewReader("binary")), nil },
+	}
+	req := &analysis.ScanRequest{
+		ModuleURLPath: scan.ModuleURLPath{Module: "a.com/m", Version: "v1.2.3"},
+		ScanParams:    analysis.ScanParams{Binary: "analyzer", BinaryVersion: "wrong", JobID: "job"},
+	}
+	r := httptest.NewRequest("POST", "/analysis/scan/"+req.Path()+"?"+req.Params(), nil)
+	if err := s.handleScan(httptest.NewRecorder(), r); !errors.Is(err, derrors.InvalidArgument) {
+		t.Fatalf("got %v, want InvalidArgument", err)
+	}
+	rows := sink.Rows(analysis.TableName)
+	if len(rows) != 1 {
+		t.Fatalf("got %d rows, want 1", len(rows))
+	}
+	got := rows[0].(*analysis.Result)
+	if got.ModulePath != "a.com/m" || got.Version != "v1.2.3" || got.BinaryName != "analyzer" || got.JobID.StringVal != "job" {
+		t.Errorf("got %s@%s for binary %s in job %s", got.ModulePath, got.Version, got.BinaryName, got.JobID)
+	}
+	if !strings.Contains(got.Error, "does not match hash") {
+		t.Errorf("got error %q, want a hash mismatch", got.Error)
+	}
+	if want := derrors.CategorizeError(derrors.InvalidArgument); got.ErrorCategory != want {
+		t.Errorf("got category %q, want %q", got.ErrorCategory, want)
+	}
+}
+
+func TestAnalysisDeadline(t *testing.T) {
+	for _, test := range []struct {
+		timeout   time.Duration
+		nBinaries int
+		want      time.Duration
+	}{
+		{0, 1, queue.MaxCloudTasksTimeout},
+		{5 * time.Minute, 1, 10 * time.Minute},
+		{5 * time.Minute, 2, 15 * time.Minute},
+		{20 * time.Minute, 2, queue.MaxCloudTasksTimeout},
+	} {
+		if got := analysisDeadline(analysisLimits{timeout: test.timeout}, test.nBinaries); got != test.want {
+			t.Errorf("%s, %d: got %s, want %s", test.timeout, test.nBinaries, got, test.want)
+		}
+	}
+}
+
+func TestJobRequest(t *testing.T) {
+	params := &analysis.EnqueueParams{
+		Binary:   "a,b",
+		Args:     "-x",
+		Insecure: true,
+		Min:      5,
+		File:     "gs://bucket/modules.txt",
+		Suffix:   "s",
+		User:     "u",
+		SkipInit: true,
+		Parent:   "u-230102-150405",
+		Priority: "low",
+		Notify:   "https://example.com/notify",
+		Timeout:  "5m",
+		DryRun:   true,
+		Sample:   0.5,
+		Seed:     "seed",
+	}
+	got := jobRequest(params)
+	want := jobs.Request{
+		Mode:     "analysis",
+		Binary:   "a,b",
+		Args:     "-x",
+		Insecure: true,
+		Min:      5,
+		File:     "gs://bucket/modules.txt",
+		Suffix:   "s",
+		SkipInit: true,
+		Parent:   "u-230102-150405",
+		Priority: "low",
+		Notify:   "https://example.com/notify",
+		Timeout:  "5m",
+		Sample:   0.5,
+		Seed:     "seed",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+
+	// Every enqueue param is recorded, except those that don't affect
+	// the tasks.
+	rt := reflect.TypeOf(jobs.Request{})
+	for _, f := range reflect.VisibleFields(reflect.TypeOf(analysis.EnqueueParams{})) {
+		if f.Name == "User" || f.Name == "DryRun" {
+			continue
+		}
+		if _, ok := rt.FieldByName(f.Name); !ok {
+			t.Errorf("enqueue param %s is not in jobs.Request", f.Name)
+		}
+	}
+}
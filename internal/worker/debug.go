@@ -0,0 +1,46 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Handlers for debugging.
+//
+// debug/active-scans		list the scans in progress on this instance, and its disk usage
+
+package worker
+
+import (
+	"net/http"
+
+	"golang.org/x/pkgsite-metrics/internal/log"
+)
+
+// activeScansResponse is the response of debug/active-scans.
+type activeScansResponse struct {
+	InstanceID     string // Cloud Run instance ID, if available
+	ActiveScans    int32  // value of the activeScans counter
+	ScanRequests   int32  // govulncheck scan requests being handled
+	MaxActiveScans int32  // limit on ScanRequests; 0 means none
+	DiskUsage      int64  // bytes used by modules and sandbox caches; -1 if unknown
+	DiskLimit      int64  // limit on DiskUsage before a scan; 0 means none
+	Scans          []*activeScan
+}
+
+func (s *Server) handleActiveScans(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	resp := &activeScansResponse{
+		ActiveScans:    activeScans.Load(),
+		ScanRequests:   s.scanLimiter.active.Load(),
+		MaxActiveScans: s.scanLimiter.max,
+		DiskLimit:      s.cfg.ScanDiskLimit,
+		Scans:          listRunningScans(),
+	}
+	if used, err := diskUsage(scanDiskDirs...); err != nil {
+		log.Warnf(ctx, "getting disk usage: %v", err)
+		resp.DiskUsage = -1
+	} else {
+		resp.DiskUsage = used
+	}
+	// The scans are still useful without the ID.
+	resp.InstanceID = instanceID(ctx)
+	return writeJSON(w, resp)
+}
@@ -6,7 +6,15 @@ package worker
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
 
 	"golang.org/x/pkgsite-metrics/internal/config"
 	"golang.org/x/pkgsite-metrics/internal/derrors"
@@ -14,11 +22,24 @@ import (
 	"golang.org/x/pkgsite-metrics/internal/pkgsitedb"
 	"golang.org/x/pkgsite-metrics/internal/queue"
 	"golang.org/x/pkgsite-metrics/internal/scan"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
 )
 
 const defaultMinImportedByCount = 10
 
+// readModules returns the modules to scan with at least minImpCount
+// importers. If file is empty, they are read from the pkgsite DB.
+// If file is of the form gs://BUCKET/OBJECT, it is read from GCS and
+// is in the format of scan.ParseModuleList; since such a list is
+// curated and need not have imported-by counts, minImpCount does not
+// apply. Otherwise file is a local file in the format of
+// scan.ParseCorpusFile.
 func readModules(ctx context.Context, cfg *config.Config, file string, minImpCount int) ([]scan.ModuleSpec, error) {
+	if strings.HasPrefix(file, "gs://") {
+		log.Infof(ctx, "reading modules from %s", file)
+		return readModulesFromGCS(ctx, file)
+	}
 	if file != "" {
 		log.Infof(ctx, "reading modules from file %s", file)
 		return scan.ParseCorpusFile(file, minImpCount)
@@ -27,6 +48,62 @@ func readModules(ctx context.Context, cfg *config.Config, file string, minImpCou
 	return readFromDB(ctx, cfg, minImpCount)
 }
 
+// readModulesFromGCS reads a module list from the GCS object at uri.
+// A malformed list is an InvalidArgument error that identifies the line.
+func readModulesFromGCS(ctx context.Context, uri string) (_ []scan.ModuleSpec, err error) {
+	defer derrors.Wrap(&err, "readModulesFromGCS(%q)", uri)
+	bucket, object, err := parseGCSObject(uri)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", derrors.InvalidArgument, err)
+	}
+	c, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	r, err := c.Bucket(bucket).Object(object).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	ms, err := scan.ParseModuleList(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", derrors.InvalidArgument, err)
+	}
+	if len(ms) == 0 {
+		return nil, fmt.Errorf("%w: empty module list", derrors.InvalidArgument)
+	}
+	return ms, nil
+}
+
+// parseGCSObject splits a URI of the form gs://BUCKET/OBJECT.
+func parseGCSObject(uri string) (bucket, object string, err error) {
+	rest, ok := strings.CutPrefix(uri, "gs://")
+	if !ok {
+		return "", "", fmt.Errorf("%q does not start with gs://", uri)
+	}
+	bucket, object, _ = strings.Cut(rest, "/")
+	if bucket == "" || object == "" || strings.HasSuffix(object, "/") {
+		return "", "", fmt.Errorf("%q is not of the form gs://BUCKET/OBJECT", uri)
+	}
+	return bucket, object, nil
+}
+
+// dispatchTask returns a function for an in-memory queue that performs
+// each task by serving its request with h, as Cloud Tasks would by
+// posting the request to the worker.
+func dispatchTask(h http.Handler) func(context.Context, string) (int, error) {
+	return func(ctx context.Context, uri string) (int, error) {
+		r := httptest.NewRequest(http.MethodPost, uri, nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			return w.Code, fmt.Errorf("%s: %d %s", uri, w.Code, strings.TrimSpace(w.Body.String()))
+		}
+		return w.Code, nil
+	}
+}
+
 func readFromDB(ctx context.Context, cfg *config.Config, minImportedByCount int) ([]scan.ModuleSpec, error) {
 	db, err := pkgsitedb.Open(ctx, cfg)
 	if err != nil {
@@ -36,38 +113,141 @@ func readFromDB(ctx context.Context, cfg *config.Config, minImportedByCount int)
 	return pkgsitedb.ModuleSpecs(ctx, db, minImportedByCount)
 }
 
-func enqueueTasks(ctx context.Context, tasks []queue.Task, q queue.Queue, opts *queue.Options) (err error) {
+// canonicalModules returns the modules of ms in canonical form, as
+// scan.CanonicalModules does, and the invalid ones. It logs a warning
+// for each invalid module, since a task for it would only fail at the
+// proxy.
+func canonicalModules(ctx context.Context, ms []scan.ModuleSpec) ([]scan.ModuleSpec, []scan.InvalidModule) {
+	valid, invalid := scan.CanonicalModules(ms)
+	for _, m := range invalid {
+		log.Warnf(ctx, "not enqueuing %s@%s: %v", m.Path, m.Version, m.Err)
+	}
+	return valid, invalid
+}
+
+// sampleModules returns the modules of ms in the sample described by
+// fraction and seed; see scan.SampleModules. It logs the size of the
+// sample.
+func sampleModules(ctx context.Context, ms []scan.ModuleSpec, fraction float64, seed string) []scan.ModuleSpec {
+	if fraction <= 0 || fraction >= 1 {
+		return ms
+	}
+	sample := scan.SampleModules(ms, fraction, seed)
+	log.Infof(ctx, "sampled %d of %d modules (sample=%g, seed=%q)", len(sample), len(ms), fraction, seed)
+	return sample
+}
+
+// minApplied returns min if readModules applies it to select the modules
+// from file, and -1 otherwise.
+func minApplied(file string, min int) int {
+	if strings.HasPrefix(file, "gs://") {
+		return -1
+	}
+	return min
+}
+
+// taskURLs returns the URLs of the requests that perform tasks when they
+// are enqueued with opts, relative to the worker's URL.
+func taskURLs(tasks []queue.Task, opts *queue.Options) []string {
+	var urls []string
+	for _, t := range tasks {
+		urls = append(urls, queue.TaskURI(t, opts))
+	}
+	return urls
+}
+
+// Parameters of enqueueTasks. They are variables for testing.
+var (
+	// enqueueMaxAttempts is the maximum number of times enqueueTasks
+	// tries to add a task to the queue.
+	enqueueMaxAttempts = 3
+
+	// enqueueBackoff is the time enqueueTasks waits after the first failure
+	// to add a task. It doubles after each subsequent failure.
+	enqueueBackoff = time.Second
+
+	// enqueueProgressInterval is the number of tasks between progress logs.
+	enqueueProgressInterval = 1000
+
+	// maxEnqueueErrors is the maximum number of task errors that
+	// enqueueTasks returns individually.
+	maxEnqueueErrors = 10
+)
+
+// enqueueTasks adds tasks to q, cfg.EnqueueConcurrency at a time and at
+// most cfg.EnqueueRate per second. A task that cannot be added is retried
+// with backoff. enqueueTasks returns the number of tasks added; tasks that
+// were already on the queue are not counted. If some tasks could not be
+// added, it also returns an error describing them.
+func enqueueTasks(ctx context.Context, cfg *config.Config, tasks []queue.Task, q queue.Queue, opts *queue.Options) (_ int, err error) {
 	defer derrors.Wrap(&err, "enqueueTasks")
 
-	// Enqueue concurrently, because sequentially takes a while.
-	const concurrentEnqueues = 20
+	limit := rate.Inf
+	if cfg.EnqueueRate > 0 {
+		limit = rate.Limit(cfg.EnqueueRate)
+	}
+	limiter := rate.NewLimiter(limit, max(1, cfg.EnqueueConcurrency))
 	var (
 		mu                 sync.Mutex
-		nEnqueued, nErrors int
+		nDone, nEnqueued   int
+		nDuplicate, nError int
+		errs               []error
 	)
-	sem := make(chan struct{}, concurrentEnqueues)
-
-	for _, sreq := range tasks {
-		log.Infof(ctx, "enqueuing: %s?%s", sreq.Path(), sreq.Params())
-		sreq := sreq
-		sem <- struct{}{}
-		go func() {
-			defer func() { <-sem }()
-			enqueued, err := q.EnqueueScan(ctx, sreq, opts)
+	var g errgroup.Group
+	g.SetLimit(max(1, cfg.EnqueueConcurrency))
+	for _, task := range tasks {
+		g.Go(func() error {
+			enqueued, err := enqueueWithRetry(ctx, limiter, q, task, opts)
 			mu.Lock()
-			if err != nil {
-				log.Errorf(ctx, err, "enqueuing")
-				nErrors++
-			} else if enqueued {
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				log.Errorf(ctx, err, "enqueuing %s?%s", task.Path(), task.Params())
+				nError++
+				if len(errs) < maxEnqueueErrors {
+					errs = append(errs, fmt.Errorf("%s?%s: %w", task.Path(), task.Params(), err))
+				}
+			case enqueued:
 				nEnqueued++
+			default:
+				nDuplicate++
 			}
-			mu.Unlock()
-		}()
+			nDone++
+			if nDone%enqueueProgressInterval == 0 {
+				log.Infof(ctx, "enqueued %d of %d tasks (%d duplicates, %d errors)", nEnqueued, len(tasks), nDuplicate, nError)
+			}
+			return nil
+		})
+	}
+	g.Wait()
+	log.Infof(ctx, "Successfully scheduled modules to be fetched: %d modules enqueued, %d duplicates, %d errors",
+		nEnqueued, nDuplicate, nError)
+	if nError > len(errs) {
+		errs = append(errs, fmt.Errorf("and %d more", nError-len(errs)))
+	}
+	if nError > 0 {
+		return nEnqueued, fmt.Errorf("%d of %d tasks not enqueued: %w", nError, len(tasks), errors.Join(errs...))
 	}
-	// Wait for goroutines to finish.
-	for i := 0; i < concurrentEnqueues; i++ {
-		sem <- struct{}{}
+	return nEnqueued, nil
+}
+
+// enqueueWithRetry adds task to q, waiting for limiter before each attempt.
+// It tries up to enqueueMaxAttempts times, with exponential backoff.
+func enqueueWithRetry(ctx context.Context, limiter *rate.Limiter, q queue.Queue, task queue.Task, opts *queue.Options) (enqueued bool, err error) {
+	backoff := enqueueBackoff
+	for attempt := 1; ; attempt++ {
+		if err := limiter.Wait(ctx); err != nil {
+			return false, err
+		}
+		enqueued, err = q.EnqueueScan(ctx, task, opts)
+		if err == nil || attempt >= enqueueMaxAttempts {
+			return enqueued, err
+		}
+		select {
+		case <-ctx.Done():
+			return false, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
 	}
-	log.Infof(ctx, "Successfully scheduled modules to be fetched: %d modules enqueued, %d errors", nEnqueued, nErrors)
-	return nil
 }
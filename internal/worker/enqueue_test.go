@@ -0,0 +1,94 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/pkgsite-metrics/internal/analysis"
+	"golang.org/x/pkgsite-metrics/internal/config"
+	"golang.org/x/pkgsite-metrics/internal/queue"
+	"golang.org/x/pkgsite-metrics/internal/scan"
+)
+
+func TestParseGCSObject(t *testing.T) {
+	for _, test := range []struct {
+		in                     string
+		wantBucket, wantObject string
+		wantErr                bool
+	}{
+		{"gs://b/modules.txt", "b", "modules.txt", false},
+		{"gs://b/dir/modules.txt", "b", "dir/modules.txt", false},
+		{"b/modules.txt", "", "", true},
+		{"gs://b", "", "", true},
+		{"gs://b/", "", "", true},
+		{"gs://b/dir/", "", "", true},
+		{"gs:///modules.txt", "", "", true},
+	} {
+		bucket, object, err := parseGCSObject(test.in)
+		if (err != nil) != test.wantErr || bucket != test.wantBucket || object != test.wantObject {
+			t.Errorf("%q: got (%q, %q, %v), want (%q, %q, error: %t)",
+				test.in, bucket, object, err, test.wantBucket, test.wantObject, test.wantErr)
+		}
+	}
+}
+
+// flakyQueue is a queue.Queue whose EnqueueScan fails the number of
+// times in fails for each task, keyed by task name. The task named
+// "_dup@v1.0.0" is reported as already on the queue.
+type flakyQueue struct {
+	queue.Queue
+	mu       sync.Mutex
+	fails    map[string]int
+	attempts map[string]int
+}
+
+func (q *flakyQueue) EnqueueScan(_ context.Context, t queue.Task, _ *queue.Options) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.attempts[t.Name()]++
+	if q.fails[t.Name()] > 0 {
+		q.fails[t.Name()]--
+		return false, errors.New("unavailable")
+	}
+	return t.Name() != "_dup@v1.0.0", nil
+}
+
+func TestEnqueueTasks(t *testing.T) {
+	defer func(b time.Duration) { enqueueBackoff = b }(enqueueBackoff)
+	enqueueBackoff = time.Millisecond
+
+	var tasks []queue.Task
+	for _, name := range []string{"a", "b", "c", "dup", "bad"} {
+		tasks = append(tasks, &analysis.ScanRequest{
+			ModuleURLPath: scan.ModuleURLPath{Module: name, Version: "v1.0.0"},
+		})
+	}
+	// Task names are "_MODULE@VERSION", since there is no binary.
+	q := &flakyQueue{
+		fails: map[string]int{
+			"_b@v1.0.0":   1,
+			"_c@v1.0.0":   enqueueMaxAttempts - 1,
+			"_bad@v1.0.0": enqueueMaxAttempts,
+		},
+		attempts: map[string]int{},
+	}
+	cfg := &config.Config{EnqueueConcurrency: 2}
+	n, err := enqueueTasks(context.Background(), cfg, tasks, q, &queue.Options{Namespace: "analysis"})
+	if n != 3 {
+		t.Errorf("got %d enqueued, want 3", n)
+	}
+	if err == nil || !strings.Contains(err.Error(), "1 of 5 tasks") || !strings.Contains(err.Error(), "bad@v1.0.0") {
+		t.Errorf("got error %v, want one naming the bad task", err)
+	}
+	if got, want := q.attempts["_bad@v1.0.0"], enqueueMaxAttempts; got != want {
+		t.Errorf("bad task: got %d attempts, want %d", got, want)
+	}
+}
@@ -7,11 +7,16 @@ package worker
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"time"
 
+	"cloud.google.com/go/storage"
 	"golang.org/x/pkgsite-metrics/internal"
+	"golang.org/x/pkgsite-metrics/internal/bigquery"
 	"golang.org/x/pkgsite-metrics/internal/derrors"
 	"golang.org/x/pkgsite-metrics/internal/govulncheck"
 	"golang.org/x/pkgsite-metrics/internal/log"
@@ -20,10 +25,24 @@ import (
 type GovulncheckServer struct {
 	*Server
 	workVersion *govulncheck.WorkVersion
+	skipList    *skipList
+	skipObject  *storage.ObjectHandle // holds the skip list; nil if there is no bucket
+
+	vulnDBSnapshots *vulnDBSnapshots
 }
 
-func newGovulncheckServer(s *Server) *GovulncheckServer {
-	return &GovulncheckServer{Server: s}
+func newGovulncheckServer(ctx context.Context, s *Server) (*GovulncheckServer, error) {
+	h := &GovulncheckServer{Server: s, vulnDBSnapshots: newVulnDBSnapshots()}
+	if s.cfg.BinaryBucket != "" {
+		c, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		h.skipObject = c.Bucket(s.cfg.BinaryBucket).Object(skipListObject)
+	}
+	h.skipList = newSkipList(h.skipObject)
+	h.skipList.refreshNow(ctx)
+	return h, nil
 }
 
 func (h *GovulncheckServer) getWorkVersion(ctx context.Context) (_ *govulncheck.WorkVersion, err error) {
@@ -40,17 +59,66 @@ func (h *GovulncheckServer) getWorkVersion(ctx context.Context) (_ *govulncheck.
 		if err != nil {
 			return nil, err
 		}
-		h.workVersion = &govulncheck.WorkVersion{
+		gvv, err := govulncheck.BinaryVersion(filepath.Join(h.cfg.BinaryDir, "govulncheck"))
+		if err != nil {
+			return nil, err
+		}
+		wv := &govulncheck.WorkVersion{
 			GoVersion:          goEnv["GOVERSION"],
 			VulnDBLastModified: lmt,
+			GovulncheckVersion: bigquery.NullString(gvv),
 			WorkerVersion:      h.cfg.VersionID,
 			SchemaVersion:      govulncheck.SchemaVersion,
+			WorkerGoVersion:    bigquery.NullString(runtime.Version()),
+			SandboxGoVersion:   bigquery.NullString(""),
+		}
+		if !h.cfg.Insecure {
+			// Don't cache a work version without the sandbox's
+			// versions: it would differ from that of other instances.
+			sgv, err := h.sandboxGoVersion()
+			if err != nil {
+				return nil, err
+			}
+			wv.SandboxGoVersion = bigquery.NullString(sgv)
+			sv, err := h.sandboxGovulncheckVersion()
+			if err != nil {
+				return nil, err
+			}
+			wv.SandboxGovulncheckVersion = bigquery.NullString(sv)
+			if sv != gvv {
+				log.Errorf(ctx, fmt.Errorf("govulncheck in the sandbox is at %q, want %q", sv, gvv),
+					"mismatched govulncheck versions; results will record both")
+			}
 		}
+		h.workVersion = wv
 		log.Infof(ctx, "govulncheck work version: %+v", h.workVersion)
 	}
 	return h.workVersion, nil
 }
 
+// sandboxGovulncheckVersion returns the version of x/vuln that
+// govulncheck reports when run in the sandbox.
+func (h *GovulncheckServer) sandboxGovulncheckVersion() (string, error) {
+	sbox := newSandbox(h.cfg)
+	// Use the local DB, so govulncheck doesn't need the network.
+	cmd := sbox.Command(filepath.Join(h.cfg.BinaryDir, "govulncheck"), "-db", "file://"+h.cfg.VulnDBDir, "-version")
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("running govulncheck -version in sandbox: %s", derrors.IncludeStderr(err))
+	}
+	return govulncheck.ParseScannerVersion(out), nil
+}
+
+// sandboxGoVersion returns the version of the Go toolchain in the
+// sandbox.
+func (h *GovulncheckServer) sandboxGoVersion() (string, error) {
+	out, err := newSandbox(h.cfg).Command("/usr/local/go/bin/go", "env", "GOVERSION").Output()
+	if err != nil {
+		return "", fmt.Errorf("running go env GOVERSION in sandbox: %s", derrors.IncludeStderr(err))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
 // dbLastModified computes the last modified time stamp of
 // vulnerability database rooted at vulnDB.
 //
@@ -8,48 +8,238 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"mime"
 	"net/http"
 	"sort"
 	"strings"
+	"time"
 
+	"golang.org/x/pkgsite-metrics/internal/bigquery"
 	"golang.org/x/pkgsite-metrics/internal/config"
 	"golang.org/x/pkgsite-metrics/internal/derrors"
 	"golang.org/x/pkgsite-metrics/internal/govulncheck"
+	"golang.org/x/pkgsite-metrics/internal/jobs"
+	"golang.org/x/pkgsite-metrics/internal/log"
 	"golang.org/x/pkgsite-metrics/internal/queue"
 	"golang.org/x/pkgsite-metrics/internal/scan"
 )
 
 // handleEnqueue enqueues multiple modules for a single govulncheck mode.
+//
+// The modules to enqueue can be given explicitly by POSTing a list of them
+// with content type text/plain or text/csv, one per line; see
+// scan.ParseModuleList for the format. The parameters are then taken from the
+// query string. For example:
+//
+//	curl -X POST -H 'Content-Type: text/plain' --data-binary @modules.txt \
+//	    "$WORKER/govulncheck/enqueue?suffix=retry"
+//
+// With dryrun=true, the modules are selected as usual, but instead of
+// enqueuing tasks, it writes a jobs.DryRunResponse describing them.
+//
+// With sample=F, for F between 0 and 1, only that fraction of the selected
+// modules is enqueued, for canary runs. The sample depends only on the
+// module paths and the seed parameter; see scan.SampleModules.
 func (h *GovulncheckServer) handleEnqueue(w http.ResponseWriter, r *http.Request) error {
-	return h.enqueue(r, false)
+	return h.enqueue(w, r, false)
 }
 
 // handleEnqueueAll enqueues multiple modules for all govulncheck modes.
 func (h *GovulncheckServer) handleEnqueueAll(w http.ResponseWriter, r *http.Request) error {
-	return h.enqueue(r, true)
+	return h.enqueue(w, r, true)
 }
 
-func (h *GovulncheckServer) enqueue(r *http.Request, allModes bool) error {
+func (h *GovulncheckServer) enqueue(w http.ResponseWriter, r *http.Request, allModes bool) error {
 	ctx := r.Context()
-	params := &govulncheck.EnqueueQueryParams{Min: defaultMinImportedByCount}
-	if err := scan.ParseParams(r, params); err != nil {
-		return fmt.Errorf("%w: %v", derrors.InvalidArgument, err)
+	params, modspecs, err := parseEnqueueRequest(r)
+	if err != nil {
+		return fmt.Errorf("%w: %w", derrors.InvalidArgument, err)
 	}
 	modes, err := listModes(params.Mode, allModes)
 	if err != nil {
 		return fmt.Errorf("%w: %v", derrors.InvalidArgument, err)
 	}
-	tasks, err := createGovulncheckQueueTasks(ctx, h.cfg, params, modes)
-	if err != nil {
-		return err
+	if err := govulncheck.CheckPackages(params.Packages); err != nil {
+		return fmt.Errorf("%w: %v", derrors.InvalidArgument, err)
+	}
+	if params.Packages != "" && (len(modes) != 1 || modes[0] != ModeGovulncheck) {
+		return fmt.Errorf("%w: packages can only be specified in mode %s", derrors.InvalidArgument, ModeGovulncheck)
+	}
+	if params.VulnDB != "" {
+		if _, _, err := govulncheck.ParseVulnDB(params.VulnDB); err != nil {
+			return fmt.Errorf("%w: %v", derrors.InvalidArgument, err)
+		}
+	}
+	if params.Batch > govulncheck.MaxBatchSize {
+		return fmt.Errorf("%w: batch size %d is greater than %d", derrors.InvalidArgument, params.Batch, govulncheck.MaxBatchSize)
+	}
+	explicit := modspecs != nil
+	var invalid []scan.InvalidModule
+	if explicit {
+		modspecs, invalid = canonicalModules(ctx, modspecs)
+		modspecs = sampleModules(ctx, modspecs, params.Sample, params.Seed)
+	}
+	// Modules read for each minimum imported-by count, since modes
+	// may have different defaults, and the invalid ones among them.
+	modulesByMin := map[int][]scan.ModuleSpec{}
+	invalidByMin := map[int][]scan.InvalidModule{}
+	var dryRun jobs.DryRunResponse
+	// Enqueue each mode separately, since their deadlines differ.
+	for _, mode := range modes {
+		mc := h.modeConfigs.Get(mode)
+		mparams := *params
+		mparams.Min = minImportedBy(params.Min, mc)
+		ms, inv := modspecs, invalid
+		if !explicit {
+			var ok bool
+			if ms, ok = modulesByMin[mparams.Min]; !ok {
+				ms, err = readModules(ctx, h.cfg, mparams.File, mparams.Min)
+				if err != nil {
+					return err
+				}
+				ms, invalidByMin[mparams.Min] = canonicalModules(ctx, ms)
+				ms = sampleModules(ctx, ms, params.Sample, params.Seed)
+				modulesByMin[mparams.Min] = ms
+			}
+			inv = invalidByMin[mparams.Min]
+		}
+		var tasks []queue.Task
+		if len(ms) > 0 { // createGovulncheckQueueTasks would read them again
+			// The modules are canonical already, so none are invalid.
+			tasks, _, err = createGovulncheckQueueTasks(ctx, h.cfg, &mparams, []string{mode}, ms)
+			if err != nil {
+				return err
+			}
+		}
+		opts := &queue.Options{
+			Namespace:      "govulncheck",
+			TaskNameSuffix: params.Suffix,
+			Deadline:       govulncheckDeadline(h.cfg, mc, mode, params.Batch > 1),
+		}
+		if params.DryRun {
+			min := -1
+			if modspecs == nil {
+				min = minApplied(mparams.File, mparams.Min)
+			}
+			dryRun.AddTasks(mode, taskURLs(tasks, opts), min)
+			continue
+		}
+		h.writeInvalidModules(ctx, mode, inv)
+		if _, err := enqueueTasks(ctx, h.cfg, tasks, h.queue, opts); err != nil {
+			return err
+		}
+	}
+	if params.DryRun {
+		w.Header().Set("Content-Type", "application/json")
+		return writeJSON(w, &dryRun)
 	}
-	return enqueueTasks(ctx, tasks, h.queue,
-		&queue.Options{Namespace: "govulncheck", TaskNameSuffix: params.Suffix})
+	return nil
+}
+
+// writeInvalidModules records each module of invalid as skipped in the
+// rows of mode, so that it is accounted for even though it is not
+// scanned. An upload error is only logged, since it should not stop the
+// valid modules from being enqueued.
+func (h *GovulncheckServer) writeInvalidModules(ctx context.Context, mode string, invalid []scan.InvalidModule) {
+	if len(invalid) == 0 {
+		return
+	}
+	var rows []bigquery.Row
+	for _, m := range invalid {
+		rows = append(rows, createRows(mode, func(sm string) *govulncheck.Result {
+			row := &govulncheck.Result{
+				ModulePath: m.Path,
+				Version:    m.Version,
+				ImportedBy: m.ImportedBy,
+				ScanMode:   sm,
+			}
+			row.AddError(fmt.Errorf("%w: invalid module: %v", derrors.ScanModuleSkipped, m.Err))
+			return row
+		})...)
+	}
+	if err := h.rows.upload(ctx, govulncheck.TableName, rows); err != nil {
+		log.Errorf(ctx, err, "recording %d invalid modules", len(invalid))
+	}
+}
+
+// govulncheckDeadline returns the dispatch deadline of govulncheck tasks
+// in mode, whose overrides are mc. A deadline configured for the mode is
+// used as is. Otherwise batches and COMPARE scans, which run several
+// scans, get the longest deadline; a single source scan needs only the
+// scan timeout, so a stuck scan is retried sooner.
+func govulncheckDeadline(cfg *config.Config, mc config.ModeConfig, mode string, batch bool) time.Duration {
+	if mc.DispatchDeadline > 0 {
+		return queue.ClampDeadline(mc.DispatchDeadline)
+	}
+	timeout := cfg.ScanTimeout
+	if mc.ScanTimeout > 0 {
+		timeout = mc.ScanTimeout
+	}
+	if batch || mode == ModeCompare || timeout <= 0 {
+		return queue.MaxCloudTasksTimeout
+	}
+	return queue.ClampDeadline(timeout + taskOverhead)
+}
+
+// minImportedBy returns the minimum imported-by count for modules to
+// enqueue: requested if the request gave one, and otherwise the default for
+// the mode, whose overrides are mc.
+func minImportedBy(requested int, mc config.ModeConfig) int {
+	switch {
+	case requested >= 0:
+		return requested
+	case mc.MinImporters > 0:
+		return mc.MinImporters
+	default:
+		return defaultMinImportedByCount
+	}
+}
+
+// parseEnqueueRequest parses the parameters of an enqueue request.
+// If the request body is a module list, it also returns the modules in it.
+func parseEnqueueRequest(r *http.Request) (*govulncheck.EnqueueQueryParams, []scan.ModuleSpec, error) {
+	// A negative Min means that the request doesn't give one; see minImportedBy.
+	params := &govulncheck.EnqueueQueryParams{Min: -1}
+	if r.Method == http.MethodPost && isModuleListContentType(r.Header.Get("Content-Type")) {
+		if err := scan.ParseParamsStrict(r, params, enqueueChecks); err != nil {
+			return nil, nil, err
+		}
+		modspecs, err := scan.ParseModuleList(r.Body)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(modspecs) == 0 {
+			return nil, nil, errors.New("empty module list")
+		}
+		return params, modspecs, nil
+	}
+	if err := scan.ParseRequestStrict(r, params, enqueueChecks); err != nil {
+		return nil, nil, err
+	}
+	return params, nil, nil
+}
+
+// enqueueChecks validates the parameters of enqueue requests.
+var enqueueChecks = map[string]scan.Check{
+	"min":    scan.NonNegative,
+	"batch":  scan.NonNegative,
+	"sample": scan.Fraction,
+	"mode": func(v any) error {
+		_, err := govulncheckMode(v.(string))
+		return err
+	},
+}
+
+// isModuleListContentType reports whether a request body with
+// the given content type holds a list of modules.
+func isModuleListContentType(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mt == "text/plain" || mt == "text/csv")
 }
 
 // listModes lists all applicable modes depending on who called it. If enqueue did (allModes=false),
 // returns only valid modeParam. If enqueueAll did (allModes=true), returns modes that enqueueAll
-// supports, which are modes/{ModeCompare}.
+// supports, which are modes/{ModeCompare, ModeCombined}.
 func listModes(modeParam string, allModes bool) ([]string, error) {
 	if allModes {
 		if modeParam != "" {
@@ -57,8 +247,8 @@ func listModes(modeParam string, allModes bool) ([]string, error) {
 		}
 		var ms []string
 		for k := range modes {
-			// Don't add ModeCompare to enqueueAll (it's something we only want to run occasionally)
-			if k != ModeCompare {
+			// Don't add ModeCompare or ModeCombined to enqueueAll (they're something we only want to run occasionally)
+			if k != ModeCompare && k != ModeCombined {
 				ms = append(ms, k)
 			}
 		}
@@ -72,27 +262,53 @@ func listModes(modeParam string, allModes bool) ([]string, error) {
 	return []string{mode}, nil
 }
 
-func createGovulncheckQueueTasks(ctx context.Context, cfg *config.Config, params *govulncheck.EnqueueQueryParams, modes []string) (_ []queue.Task, err error) {
+// createGovulncheckQueueTasks creates tasks to scan modules in each of modes.
+// If modspecs is non-nil, those modules are scanned, regardless of params.Min.
+// Otherwise the modules are read from params.File or the DB, and the
+// invalid ones among them are returned, for the caller to record with
+// writeInvalidModules.
+// If params.Batch is greater than 1, each task scans up to that many modules.
+func createGovulncheckQueueTasks(ctx context.Context, cfg *config.Config, params *govulncheck.EnqueueQueryParams, modes []string, modspecs []scan.ModuleSpec) (_ []queue.Task, invalid []scan.InvalidModule, err error) {
 	defer derrors.Wrap(&err, "createGovulncheckQueueTasks(%v)", modes)
-	var (
-		tasks    []queue.Task
-		modspecs []scan.ModuleSpec
-	)
+	var tasks []queue.Task
 	for _, mode := range modes {
 		if modspecs == nil {
 			modspecs, err = readModules(ctx, cfg, params.File, params.Min)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
+			modspecs, invalid = canonicalModules(ctx, modspecs)
+			modspecs = sampleModules(ctx, modspecs, params.Sample, params.Seed)
 		}
 		reqs := moduleSpecsToGovulncheckScanRequests(modspecs, mode)
+		var batch *govulncheck.BatchRequest
 		for _, req := range reqs {
-			if req.Module != "std" { // ignore the standard library
+			if req.Module == "std" { // ignore the standard library
+				continue
+			}
+			req.Triage = params.Triage
+			req.Packages = params.Packages
+			req.VulnDB = params.VulnDB
+			if params.Batch <= 1 {
 				tasks = append(tasks, req)
+				continue
+			}
+			if batch == nil {
+				batch = &govulncheck.BatchRequest{QueryParams: govulncheck.QueryParams{
+					Mode:     mode,
+					Triage:   params.Triage,
+					Packages: params.Packages,
+					VulnDB:   params.VulnDB,
+				}}
+				tasks = append(tasks, batch)
+			}
+			batch.Modules = append(batch.Modules, scan.ModuleSpec{Path: req.Module, Version: req.Version, ImportedBy: req.ImportedBy})
+			if len(batch.Modules) == params.Batch {
+				batch = nil
 			}
 		}
 	}
-	return tasks, nil
+	return tasks, invalid, nil
 }
 
 func moduleSpecsToGovulncheckScanRequests(modspecs []scan.ModuleSpec, mode string) []*govulncheck.Request {
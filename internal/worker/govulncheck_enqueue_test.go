@@ -6,12 +6,23 @@ package worker
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"golang.org/x/pkgsite-metrics/internal/bigquery"
 	"golang.org/x/pkgsite-metrics/internal/config"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
 	"golang.org/x/pkgsite-metrics/internal/govulncheck"
+	"golang.org/x/pkgsite-metrics/internal/jobs"
 	"golang.org/x/pkgsite-metrics/internal/queue"
 	"golang.org/x/pkgsite-metrics/internal/scan"
 )
@@ -25,7 +36,7 @@ func TestCreateQueueTasks(t *testing.T) {
 	}
 
 	params := &govulncheck.EnqueueQueryParams{Min: 8, File: "testdata/modules.txt"}
-	gotTasks, err := createGovulncheckQueueTasks(context.Background(), &config.Config{}, params, []string{ModeGovulncheck})
+	gotTasks, _, err := createGovulncheckQueueTasks(context.Background(), &config.Config{}, params, []string{ModeGovulncheck}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -42,7 +53,7 @@ func TestCreateQueueTasks(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	gotTasks, err = createGovulncheckQueueTasks(context.Background(), &config.Config{}, params, allModes)
+	gotTasks, _, err = createGovulncheckQueueTasks(context.Background(), &config.Config{}, params, allModes, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -57,6 +68,24 @@ func TestCreateQueueTasks(t *testing.T) {
 	}
 }
 
+func TestCreateQueueTasksInvalid(t *testing.T) {
+	modFile := filepath.Join(t.TempDir(), "modules.txt")
+	if err := os.WriteFile(modFile, []byte("example.com/m\tv1.0.0\t10\nµπΩ/github.com\tv2.3.4\t10\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	params := &govulncheck.EnqueueQueryParams{Min: 1, File: modFile}
+	tasks, invalid, err := createGovulncheckQueueTasks(context.Background(), &config.Config{}, params, []string{ModeGovulncheck}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 {
+		t.Errorf("got %d tasks, want 1", len(tasks))
+	}
+	if len(invalid) != 1 || invalid[0].Path != "µπΩ/github.com" {
+		t.Errorf("got invalid modules %v, want µπΩ/github.com", invalid)
+	}
+}
+
 func TestListModes(t *testing.T) {
 	for _, test := range []struct {
 		param   string
@@ -67,6 +96,7 @@ func TestListModes(t *testing.T) {
 		{"", true, []string{ModeGovulncheck}, false},
 		{"", false, []string{ModeGovulncheck}, false},
 		{"imports", true, nil, true},
+		{"combined", false, []string{ModeCombined}, false},
 	} {
 		t.Run(fmt.Sprintf("%q,%t", test.param, test.all), func(t *testing.T) {
 			got, err := listModes(test.param, test.all)
@@ -79,3 +109,240 @@ func TestListModes(t *testing.T) {
 		})
 	}
 }
+
+func TestParseEnqueueRequest(t *testing.T) {
+	newRequest := func(contentType, body string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/govulncheck/enqueue?suffix=x", strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		return r
+	}
+
+	t.Run("module list", func(t *testing.T) {
+		params, modspecs, err := parseEnqueueRequest(newRequest("text/plain; charset=utf-8", "m1@v1.0.0\nm2@v1.2.0,7\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if params.Suffix != "x" {
+			t.Errorf("got suffix %q, want %q", params.Suffix, "x")
+		}
+		want := []scan.ModuleSpec{{Path: "m1", Version: "v1.0.0"}, {Path: "m2", Version: "v1.2.0", ImportedBy: 7}}
+		if !cmp.Equal(modspecs, want) {
+			t.Errorf("got %v, want %v", modspecs, want)
+		}
+		gotTasks, _, err := createGovulncheckQueueTasks(context.Background(), &config.Config{}, params, []string{ModeGovulncheck}, modspecs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(gotTasks) != 2 {
+			t.Errorf("got %d tasks, want 2", len(gotTasks))
+		}
+	})
+	t.Run("bad line", func(t *testing.T) {
+		_, _, err := parseEnqueueRequest(newRequest("text/csv", "m1@v1.0.0\nm2@v1.2.0,many\n"))
+		if err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("got %v, want error naming line 2", err)
+		}
+	})
+	t.Run("JSON params", func(t *testing.T) {
+		params, modspecs, err := parseEnqueueRequest(newRequest("application/json", `{"min": 3}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if params.Min != 3 || modspecs != nil {
+			t.Errorf("got min %d, modspecs %v; want 3, nil", params.Min, modspecs)
+		}
+	})
+}
+
+func TestCreateQueueTasksBatch(t *testing.T) {
+	modspecs := []scan.ModuleSpec{
+		{Path: "a", Version: "v1.0.0", ImportedBy: 1},
+		{Path: "std", Version: "v1.21.0"},
+		{Path: "b", Version: "v1.0.0", ImportedBy: 2},
+		{Path: "c", Version: "v1.0.0", ImportedBy: 3},
+	}
+	params := &govulncheck.EnqueueQueryParams{Batch: 2, Triage: true, Packages: "./cmd/..."}
+	gotTasks, _, err := createGovulncheckQueueTasks(context.Background(), &config.Config{}, params, []string{ModeGovulncheck}, modspecs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := func(mods ...scan.ModuleSpec) *govulncheck.BatchRequest {
+		return &govulncheck.BatchRequest{Modules: mods, QueryParams: govulncheck.QueryParams{Mode: ModeGovulncheck, Triage: true, Packages: "./cmd/..."}}
+	}
+	wantTasks := []queue.Task{
+		batch(modspecs[0], modspecs[2]),
+		batch(modspecs[3]),
+	}
+	if diff := cmp.Diff(wantTasks, gotTasks); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestGovulncheckDeadline(t *testing.T) {
+	cfg := &config.Config{ScanTimeout: 10 * time.Minute}
+	for _, test := range []struct {
+		mode  string
+		batch bool
+		want  time.Duration
+	}{
+		{ModeGovulncheck, false, 15 * time.Minute},
+		{ModeGovulncheck, true, queue.MaxCloudTasksTimeout},
+		{ModeCompare, false, queue.MaxCloudTasksTimeout},
+		{ModeCombined, false, 15 * time.Minute},
+	} {
+		if got := govulncheckDeadline(cfg, config.ModeConfig{}, test.mode, test.batch); got != test.want {
+			t.Errorf("%s, batch=%t: got %s, want %s", test.mode, test.batch, got, test.want)
+		}
+	}
+
+	// Overrides for the mode.
+	mc := config.ModeConfig{ScanTimeout: 20 * time.Minute}
+	if got, want := govulncheckDeadline(cfg, mc, ModeGovulncheck, false), 25*time.Minute; got != want {
+		t.Errorf("mode scan timeout: got %s, want %s", got, want)
+	}
+	mc.DispatchDeadline = 12 * time.Minute
+	if got, want := govulncheckDeadline(cfg, mc, ModeCompare, true), 12*time.Minute; got != want {
+		t.Errorf("mode deadline: got %s, want %s", got, want)
+	}
+}
+
+func TestMinImportedBy(t *testing.T) {
+	for _, test := range []struct {
+		requested, modeMin, want int
+	}{
+		{-1, 0, defaultMinImportedByCount},
+		{-1, 50, 50},
+		{0, 50, 0},
+		{3, 50, 3},
+	} {
+		if got := minImportedBy(test.requested, config.ModeConfig{MinImporters: test.modeMin}); got != test.want {
+			t.Errorf("minImportedBy(%d, %d) = %d, want %d", test.requested, test.modeMin, got, test.want)
+		}
+	}
+}
+
+func TestEnqueueDryRun(t *testing.T) {
+	// The server has no queue, so it would fail if it enqueued tasks.
+	h := &GovulncheckServer{Server: &Server{cfg: &config.Config{}}}
+	r := httptest.NewRequest("GET", "/govulncheck/enqueue?min=8&file=testdata/modules.txt&dryrun=true", nil)
+	w := httptest.NewRecorder()
+	if err := h.handleEnqueue(w, r); err != nil {
+		t.Fatal(err)
+	}
+	var got jobs.DryRunResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	params := func(importedBy int) string {
+		return fmt.Sprintf("importedby=%d&mode=GOVULNCHECK&insecure=false&serve=false&timeout=&triage=false&packages=&vulndb=", importedBy)
+	}
+	want := jobs.DryRunResponse{
+		NumTasks:     map[string]int{ModeGovulncheck: 2},
+		MinImporters: map[string]int{ModeGovulncheck: 8},
+		TaskURLs: []string{
+			"/govulncheck/scan/github.com/pkg/errors@v0.9.1?" + params(10),
+			"/govulncheck/scan/golang.org/x/net@v0.4.0?" + params(20),
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+
+	// Modules listed in the request are not selected by importers.
+	// Invalid ones are dropped.
+	r = httptest.NewRequest(http.MethodPost, "/govulncheck/enqueue?dryrun=true", strings.NewReader("example.com/m1/@v1.0.0\nµπΩ/github.com@v2.3.4\n"))
+	r.Header.Set("Content-Type", "text/plain")
+	w = httptest.NewRecorder()
+	if err := h.handleEnqueue(w, r); err != nil {
+		t.Fatal(err)
+	}
+	got = jobs.DryRunResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.NumTasks[ModeGovulncheck] != 1 || got.MinImporters != nil {
+		t.Errorf("module list: got %+v, want 1 task and no minimum", got)
+	}
+	if len(got.TaskURLs) != 1 || !strings.HasPrefix(got.TaskURLs[0], "/govulncheck/scan/example.com/m1@v1.0.0?") {
+		t.Errorf("module list: got task URLs %v, want one for example.com/m1@v1.0.0", got.TaskURLs)
+	}
+}
+
+func TestEnqueueSample(t *testing.T) {
+	h := &GovulncheckServer{Server: &Server{cfg: &config.Config{}}}
+	var list strings.Builder
+	var ms []scan.ModuleSpec
+	for i := range 50 {
+		m := scan.ModuleSpec{Path: fmt.Sprintf("example.com/m%d", i), Version: "v1.0.0"}
+		ms = append(ms, m)
+		fmt.Fprintf(&list, "%s@%s\n", m.Path, m.Version)
+	}
+	want := len(scan.SampleModules(ms, 0.3, "s"))
+	if want == 0 || want == len(ms) {
+		t.Fatalf("sample of %d modules has %d; choose another seed", len(ms), want)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/govulncheck/enqueue?dryrun=true&sample=0.3&seed=s", strings.NewReader(list.String()))
+	r.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	if err := h.handleEnqueue(w, r); err != nil {
+		t.Fatal(err)
+	}
+	var got jobs.DryRunResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.NumTasks[ModeGovulncheck] != want {
+		t.Errorf("got %d tasks, want %d", got.NumTasks[ModeGovulncheck], want)
+	}
+
+	r = httptest.NewRequest("GET", "/govulncheck/enqueue?dryrun=true&sample=2", nil)
+	if err := h.handleEnqueue(httptest.NewRecorder(), r); !errors.Is(err, derrors.InvalidArgument) {
+		t.Errorf("sample=2: got %v, want InvalidArgument", err)
+	}
+
+	// A module is sampled by its canonical path, however it is spelled.
+	sampleURLs := func(format string) []string {
+		var list strings.Builder
+		for i := range 50 {
+			fmt.Fprintf(&list, format+"@v1.0.0\n", i)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/govulncheck/enqueue?dryrun=true&sample=0.3&seed=s", strings.NewReader(list.String()))
+		r.Header.Set("Content-Type", "text/plain")
+		w := httptest.NewRecorder()
+		if err := h.handleEnqueue(w, r); err != nil {
+			t.Fatal(err)
+		}
+		var got jobs.DryRunResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		return got.TaskURLs
+	}
+	canonical := sampleURLs("example.com/M%d")
+	if len(canonical) == 0 || len(canonical) == 50 {
+		t.Fatalf("sample of 50 modules has %d; choose another seed", len(canonical))
+	}
+	if escaped := sampleURLs("example.com/!m%d/"); !cmp.Equal(escaped, canonical) {
+		t.Errorf("escaped paths: got task URLs %v, want %v", escaped, canonical)
+	}
+}
+
+func TestWriteInvalidModules(t *testing.T) {
+	sink := &bigquery.MemorySink{}
+	h := &GovulncheckServer{Server: &Server{cfg: &config.Config{}, rows: &rowUploader{sink: sink}}}
+	_, invalid := scan.CanonicalModules([]scan.ModuleSpec{{Path: "µπΩ/github.com", Version: "v2.3.4", ImportedBy: 5}})
+	h.writeInvalidModules(context.Background(), ModeGovulncheck, invalid)
+	rows := sink.Rows(govulncheck.TableName)
+	if want := len(scanModes(ModeGovulncheck)); len(rows) != want {
+		t.Fatalf("got %d rows, want %d", len(rows), want)
+	}
+	for i, r := range rows {
+		got := r.(*govulncheck.Result)
+		if got.ModulePath != "µπΩ/github.com" || got.ImportedBy != 5 || got.ScanMode != scanModes(ModeGovulncheck)[i] {
+			t.Errorf("got %s@%s, %d importers, scan mode %s", got.ModulePath, got.Version, got.ImportedBy, got.ScanMode)
+		}
+		if want := derrors.CategorizeError(derrors.ScanModuleSkipped); got.ErrorCategory != want {
+			t.Errorf("got category %q, want %q", got.ErrorCategory, want)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/govulncheck"
+	"golang.org/x/pkgsite-metrics/internal/log"
+)
+
+// loadErrorsHeader precedes the package loading errors in the error
+// message of govulncheck. Each error follows on its own line, as
+// POSITION: MESSAGE, and a blank line ends them.
+const loadErrorsHeader = "There are errors with the provided package patterns:"
+
+// maxLoadErrors is the maximum number of load errors recorded in a row.
+const maxLoadErrors = 100
+
+// parseLoadErrors returns the package loading errors in msg, an error
+// message of govulncheck run on the module modulePath in moduleDir. It
+// also returns the directories of the packages with errors, relative to
+// moduleDir, as slash-separated paths. It returns nil if msg has no
+// loading errors.
+func parseLoadErrors(msg, modulePath, moduleDir string) ([]*govulncheck.LoadError, map[string]bool) {
+	_, rest, ok := strings.Cut(msg, loadErrorsHeader)
+	if !ok {
+		return nil, nil
+	}
+	// Positions are inside the sandbox, unless the scan is insecure.
+	smdir := strings.TrimPrefix(moduleDir, sandboxRoot)
+	var lerrs []*govulncheck.LoadError
+	dirs := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimLeft(rest, "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		le := &govulncheck.LoadError{
+			Kind:    derrors.CategorizeError(loadErrorKind(errors.New(line))),
+			Message: line,
+		}
+		pos, _, _ := strings.Cut(line, ": ")
+		if i := strings.Index(pos, smdir+"/"); i >= 0 {
+			file := pos[i+len(smdir):]
+			file, _, _ = strings.Cut(file, ":") // remove line and column
+			dir := strings.Trim(filepath.ToSlash(file), "/")
+			if strings.HasSuffix(dir, ".go") {
+				dir = path.Dir(dir)
+			}
+			if dir == "" {
+				dir = "."
+			}
+			dirs[dir] = true
+			le.Package = path.Join(modulePath, dir)
+		}
+		lerrs = append(lerrs, le)
+	}
+	return lerrs, dirs
+}
+
+// loadErrorKind returns the derrors sentinel for err, an error loading
+// a package.
+func loadErrorKind(err error) error {
+	switch {
+	case isModVendor(err):
+		return derrors.LoadVendorError
+	case isNoRequiredModule(err):
+		return derrors.LoadPackagesNoRequiredModuleError
+	case isMissingGoSumEntry(err):
+		return derrors.LoadPackagesMissingGoSumEntryError
+	case isReplacingWithLocalPath(err):
+		return derrors.LoadPackagesImportedLocalError
+	case isMissingGoMod(err) || isNoModulesSpecified(err):
+		return derrors.LoadPackagesNoGoModError
+	default:
+		return derrors.LoadPackagesError
+	}
+}
+
+// loadablePatterns returns a package pattern for each package directory
+// of the module in moduleDir, other than those of broken. It returns
+// nil if there are none.
+func loadablePatterns(moduleDir string, broken map[string]bool) ([]string, error) {
+	dirs, err := packageDirs(moduleDir)
+	if err != nil {
+		return nil, err
+	}
+	var patterns []string
+	for _, dir := range dirs {
+		if broken[dir] {
+			continue
+		}
+		if dir == "." {
+			patterns = append(patterns, ".")
+		} else {
+			patterns = append(patterns, "./"+dir)
+		}
+	}
+	return patterns, nil
+}
+
+// packageDirs returns the directories under moduleDir that have Go files
+// and are part of the module, relative to moduleDir, as slash-separated
+// paths. Like the go command, it skips testdata and vendor directories,
+// directories beginning with "." or "_", and nested modules.
+func packageDirs(moduleDir string) ([]string, error) {
+	var dirs []string
+	err := filepath.WalkDir(moduleDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if p != moduleDir {
+			name := d.Name()
+			if name == "testdata" || name == "vendor" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+				return filepath.SkipDir
+			}
+			if _, err := os.Stat(filepath.Join(p, "go.mod")); err == nil {
+				return filepath.SkipDir
+			}
+		}
+		matches, err := filepath.Glob(filepath.Join(p, "*.go"))
+		if err != nil {
+			return err
+		}
+		if len(matches) > 0 {
+			rel, err := filepath.Rel(moduleDir, p)
+			if err != nil {
+				return err
+			}
+			dirs = append(dirs, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return dirs, err
+}
+
+// runGovulncheckLoadable runs govulncheck like runGovulncheck. If some
+// packages of the module fail to load, it records their errors in
+// s.loadErrors, and if patterns are the default, it scans the other
+// packages of the module instead, recording that in s.partialLoad. It
+// returns the patterns of the packages it scanned. If the scan of the
+// other packages fails too, it returns the error of the first scan.
+func (s *scanner) runGovulncheckLoadable(ctx context.Context, modulePath, inputPath, mode, scanLevel string, patterns []string) (*govulncheck.AnalysisResponse, []string, error) {
+	response, err := s.runGovulncheck(ctx, inputPath, mode, scanLevel, patterns)
+	if err == nil {
+		return response, patterns, nil
+	}
+	lerrs, broken := parseLoadErrors(err.Error(), modulePath, inputPath)
+	if len(lerrs) == 0 {
+		return nil, patterns, err
+	}
+	s.loadErrors = lerrs[:min(len(lerrs), maxLoadErrors)]
+	if len(broken) == 0 || !slices.Equal(patterns, []string{govulncheck.DefaultPackagePattern}) {
+		return nil, patterns, err
+	}
+	loadable, lerr := loadablePatterns(inputPath, broken)
+	if lerr != nil {
+		log.Warnf(ctx, "listing the packages of %s: %v", modulePath, lerr)
+		return nil, patterns, err
+	}
+	if len(loadable) == 0 {
+		return nil, patterns, err
+	}
+	log.Infof(ctx, "%s: %d packages failed to load; scanning the other %d", modulePath, len(broken), len(loadable))
+	presponse, perr := s.runGovulncheck(ctx, inputPath, mode, scanLevel, loadable)
+	if perr != nil {
+		log.Infof(ctx, "%s: scanning the loadable packages failed: %v", modulePath, perr)
+		return nil, patterns, err
+	}
+	s.partialLoad = true
+	return presponse, loadable, nil
+}
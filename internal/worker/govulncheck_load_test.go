@@ -0,0 +1,83 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/pkgsite-metrics/internal/govulncheck"
+)
+
+func TestParseLoadErrors(t *testing.T) {
+	const (
+		modulePath = "example.com/m"
+		moduleDir  = sandboxRoot + "/tmp/modules/example.com/m@v1.0.0"
+		smdir      = "/tmp/modules/example.com/m@v1.0.0"
+	)
+	msg := "govulncheck: loading packages: \nThere are errors with the provided package patterns:\n\n" +
+		smdir + "/examples/x.go:3:8: could not import example.com/gone (no required module provides package \"example.com/gone\")\n" +
+		smdir + "/a/b/y.go:10:2: undefined: z\n" +
+		smdir + "/top.go:1:1: expected 'package', found 'EOF'\n" +
+		"-: go: updates to go.mod needed\n" +
+		"\nFor details on package patterns, see https://pkg.go.dev/cmd/go#hdr-Package_lists_and_patterns.\n"
+
+	lerrs, dirs := parseLoadErrors(msg, modulePath, moduleDir)
+	want := []*govulncheck.LoadError{
+		{
+			Package: "example.com/m/examples",
+			Kind:    "LOAD - NO REQUIRED MODULE",
+			Message: smdir + `/examples/x.go:3:8: could not import example.com/gone (no required module provides package "example.com/gone")`,
+		},
+		{Package: "example.com/m/a/b", Kind: "LOAD", Message: smdir + "/a/b/y.go:10:2: undefined: z"},
+		{Package: "example.com/m", Kind: "LOAD", Message: smdir + "/top.go:1:1: expected 'package', found 'EOF'"},
+		{Kind: "LOAD", Message: "-: go: updates to go.mod needed"},
+	}
+	if diff := cmp.Diff(want, lerrs); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+	wantDirs := map[string]bool{"examples": true, "a/b": true, ".": true}
+	if diff := cmp.Diff(wantDirs, dirs); diff != "" {
+		t.Errorf("dirs mismatch (-want, +got):\n%s", diff)
+	}
+
+	if lerrs, _ := parseLoadErrors("govulncheck: some other failure", modulePath, moduleDir); lerrs != nil {
+		t.Errorf("got %v, want nil", lerrs)
+	}
+}
+
+func TestLoadablePatterns(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{
+		"go.mod",
+		"m.go",
+		"a/a.go",
+		"a/b/b.go",
+		"a/c/README",
+		"examples/x.go",
+		"testdata/t.go",
+		"_skip/s.go",
+		"nested/go.mod",
+		"nested/n.go",
+	} {
+		file := filepath.Join(dir, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := loadablePatterns(dir, map[string]bool{"examples": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{".", "./a", "./a/b"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+
+	"golang.org/x/exp/event"
+	"golang.org/x/pkgsite-metrics/internal/bigquery"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/govulncheck"
+	"golang.org/x/pkgsite-metrics/internal/log"
+	"golang.org/x/pkgsite-metrics/internal/scan"
+	"golang.org/x/pkgsite-metrics/internal/version"
+)
+
+// recheckParams are the parameters of govulncheck/recheck.
+type recheckParams struct {
+	Module   string // module path
+	Version  string // module version; not a query
+	Mode     string // govulncheck mode, not COMPARE; if empty, GOVULNCHECK
+	Insecure bool   // if true, run outside the sandbox
+	Record   bool   // if true, upload the rows of the new scan
+}
+
+// A recheckResponse is the result of govulncheck/recheck.
+type recheckResponse struct {
+	Module  string
+	Version string
+	Mode    string
+	// WorkVersion is the work version of the new scan.
+	WorkVersion *govulncheck.WorkVersion
+	// StoredWorkVersion is the work version of the most recent stored
+	// rows, or nil if there are none.
+	StoredWorkVersion *govulncheck.WorkVersion
+	Diffs             []*recheckDiff
+	Recorded          bool // whether the rows of the new scan were uploaded
+}
+
+// A recheckDiff compares the vulns found by a new scan at one scan
+// mode with those of the most recent stored row. Each vuln is written
+// as its ID and the path of its package, or of its module for
+// module-level findings.
+type recheckDiff struct {
+	ScanMode    string
+	NoStoredRow bool     `json:",omitempty"`
+	NewError    string   `json:",omitempty"`
+	StoredError string   `json:",omitempty"`
+	Added       []string // found by the new scan only
+	Removed     []string // found by the stored row only
+	Unchanged   []string // found by both
+}
+
+// handleRecheck scans a module version again and compares the results
+// with the most recent rows stored in BigQuery, to verify them. The scan
+// does not change the work state of the module, so it doesn't affect
+// which scans are skipped, and its rows are uploaded only if record is
+// true. It writes a recheckResponse.
+//
+// govulncheck/recheck?module=M&version=V[&mode=GOVULNCHECK][&insecure=true][&record=true]
+func (h *GovulncheckServer) handleRecheck(w http.ResponseWriter, r *http.Request) (err error) {
+	defer derrors.Wrap(&err, "handleRecheck")
+	ctx := r.Context()
+
+	var params recheckParams
+	if err := scan.ParseParamsStrict(r, &params, nil); err != nil {
+		return fmt.Errorf("%w: %w", derrors.InvalidArgument, err)
+	}
+	if params.Module == "" || params.Version == "" {
+		return fmt.Errorf("%w: need module and version", derrors.InvalidArgument)
+	}
+	if version.IsQuery(params.Version) {
+		return fmt.Errorf("%w: version %q is a query", derrors.InvalidArgument, params.Version)
+	}
+	mode, err := govulncheckMode(params.Mode)
+	if err != nil {
+		return fmt.Errorf("%w: %v", derrors.InvalidArgument, err)
+	}
+	// A COMPARE scan writes a row for each binary, but only the most
+	// recent row of each module version can be read back.
+	if mode == ModeCompare {
+		return fmt.Errorf("%w: recheck does not support mode %s", derrors.InvalidArgument, ModeCompare)
+	}
+	if h.bqClient == nil {
+		return &serverError{err: errors.New("BigQuery is disabled"), status: http.StatusNotImplemented}
+	}
+
+	stored, err := h.readStoredRows(ctx, params.Module, params.Version, mode)
+	if err != nil {
+		return err
+	}
+	sreq := &govulncheck.Request{
+		ModuleURLPath: scan.ModuleURLPath{Module: params.Module, Version: params.Version},
+		QueryParams:   govulncheck.QueryParams{Mode: mode, Insecure: params.Insecure},
+	}
+	if len(stored) > 0 {
+		sreq.ImportedBy = stored[0].ImportedBy
+	}
+	var fresh []*govulncheck.Result
+	err = h.scanLimiter.do(w, func() error {
+		var err error
+		fresh, err = h.recheckScan(ctx, sreq)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	resp := &recheckResponse{
+		Module:  params.Module,
+		Version: params.Version,
+		Mode:    mode,
+		Diffs:   diffRecheck(fresh, stored),
+	}
+	if len(fresh) > 0 {
+		resp.WorkVersion = &fresh[0].WorkVersion
+	}
+	if len(stored) > 0 {
+		resp.StoredWorkVersion = &stored[0].WorkVersion
+	}
+	if params.Record && len(fresh) > 0 {
+		var rows []bigquery.Row
+		for _, r := range fresh {
+			rows = append(rows, r)
+		}
+		if err := h.rows.upload(ctx, govulncheck.TableName, rows); err != nil {
+			return err
+		}
+		resp.Recorded = true
+	}
+	log.Infof(ctx, "rechecked %s@%s in mode %s (recorded: %t)", params.Module, params.Version, mode, resp.Recorded)
+	return writeJSON(w, resp)
+}
+
+// readStoredRows returns the most recent stored row of the module
+// version for each scan mode of mode.
+func (h *GovulncheckServer) readStoredRows(ctx context.Context, modulePath, version, mode string) ([]*govulncheck.Result, error) {
+	var stored []*govulncheck.Result
+	for _, sm := range scanModes(mode) {
+		f := bigquery.Filters{ModulePath: modulePath, Version: version, ScanMode: sm}
+		rows, err := bigquery.ReadLatestPerModule[govulncheck.Result](ctx, h.bqClient, govulncheck.TableName, f)
+		if err != nil {
+			return nil, err
+		}
+		stored = append(stored, rows...)
+	}
+	return stored, nil
+}
+
+// recheckScan scans the module of sreq and returns the rows of the scan,
+// without uploading them or recording a work state.
+func (h *GovulncheckServer) recheckScan(ctx context.Context, sreq *govulncheck.Request) (_ []*govulncheck.Result, err error) {
+	scanner, err := newScanner(ctx, h, sreq.Mode)
+	if err != nil {
+		return nil, err
+	}
+	if sreq.Insecure {
+		scanner.insecure = true
+	}
+	// Collect the rows instead of uploading them.
+	sink := &bigquery.MemorySink{}
+	scanner.rows = &rowUploader{sink: sink}
+	if !scanner.insecure {
+		sbox, release, serr := h.getSandbox(ctx)
+		if serr != nil {
+			return nil, serr
+		}
+		defer func() { release(err) }()
+		scanner.sbox = sbox
+	}
+	ctx = startScan(ctx, sreq.Module, sreq.Version, sreq.Mode)
+	defer event.End(ctx)
+	if _, err := scanner.ScanModule(ctx, nil, sreq); err != nil {
+		return nil, err
+	}
+	var rows []*govulncheck.Result
+	for _, r := range sink.Rows(govulncheck.TableName) {
+		rows = append(rows, r.(*govulncheck.Result))
+	}
+	return rows, nil
+}
+
+// diffRecheck compares the vulns of fresh and stored rows with the same
+// scan mode.
+func diffRecheck(fresh, stored []*govulncheck.Result) []*recheckDiff {
+	storedByMode := map[string]*govulncheck.Result{}
+	for _, r := range stored {
+		storedByMode[r.ScanMode] = r
+	}
+	var diffs []*recheckDiff
+	for _, f := range fresh {
+		d := &recheckDiff{ScanMode: f.ScanMode, NewError: f.Error}
+		s := storedByMode[f.ScanMode]
+		if s == nil {
+			d.NoStoredRow = true
+		} else {
+			d.StoredError = s.Error
+		}
+		newVulns := vulnKeys(f)
+		storedVulns := vulnKeys(s)
+		for _, k := range newVulns {
+			if slices.Contains(storedVulns, k) {
+				d.Unchanged = append(d.Unchanged, k)
+			} else {
+				d.Added = append(d.Added, k)
+			}
+		}
+		for _, k := range storedVulns {
+			if !slices.Contains(newVulns, k) {
+				d.Removed = append(d.Removed, k)
+			}
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs
+}
+
+// vulnKeys returns the sorted, distinct vulns of r, as described
+// in recheckDiff. It returns nil if r is nil.
+func vulnKeys(r *govulncheck.Result) []string {
+	if r == nil {
+		return nil
+	}
+	var keys []string
+	for _, v := range r.Vulns {
+		path := v.PackagePath
+		if path == "" {
+			path = v.ModulePath
+		}
+		keys = append(keys, v.ID+" "+path)
+	}
+	sort.Strings(keys)
+	return slices.Compact(keys)
+}
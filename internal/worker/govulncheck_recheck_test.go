@@ -0,0 +1,77 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/govulncheck"
+)
+
+func TestDiffRecheck(t *testing.T) {
+	vuln := func(id, pkg string) *govulncheck.Vuln {
+		return &govulncheck.Vuln{ID: id, PackagePath: pkg, ModulePath: "example.com/m"}
+	}
+	fresh := []*govulncheck.Result{
+		{ScanMode: scanModeSourceSymbol, Vulns: []*govulncheck.Vuln{vuln("GO-1", "example.com/m/a"), vuln("GO-3", "example.com/m/b")}},
+		{ScanMode: scanModeSourceModule, Vulns: []*govulncheck.Vuln{vuln("GO-1", ""), vuln("GO-1", "")}},
+		{ScanMode: scanModeSourcePackage, Error: "bad"},
+	}
+	stored := []*govulncheck.Result{
+		{ScanMode: scanModeSourceSymbol, Vulns: []*govulncheck.Vuln{vuln("GO-2", "example.com/m/a"), vuln("GO-1", "example.com/m/a")}},
+		{ScanMode: scanModeSourceModule, Error: "old", Vulns: []*govulncheck.Vuln{vuln("GO-1", "")}},
+	}
+	got := diffRecheck(fresh, stored)
+	want := []*recheckDiff{
+		{
+			ScanMode:  scanModeSourceSymbol,
+			Added:     []string{"GO-3 example.com/m/b"},
+			Removed:   []string{"GO-2 example.com/m/a"},
+			Unchanged: []string{"GO-1 example.com/m/a"},
+		},
+		{
+			ScanMode:    scanModeSourceModule,
+			StoredError: "old",
+			Unchanged:   []string{"GO-1 example.com/m"},
+		},
+		{
+			ScanMode:    scanModeSourcePackage,
+			NoStoredRow: true,
+			NewError:    "bad",
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestHandleRecheckParams(t *testing.T) {
+	h := &GovulncheckServer{Server: &Server{}}
+	for _, query := range []string{
+		"",
+		"module=example.com/m",
+		"module=example.com/m&version=latest",
+		"module=example.com/m&version=v1.0.0&mode=compare",
+		"module=example.com/m&version=v1.0.0&mode=bad",
+		"module=example.com/m&version=v1.0.0&bogus=1",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/govulncheck/recheck?"+query, nil)
+		err := h.handleRecheck(httptest.NewRecorder(), r)
+		if !errors.Is(err, derrors.InvalidArgument) {
+			t.Errorf("%q: got %v, want InvalidArgument", query, err)
+		}
+	}
+	// Valid parameters, but no BigQuery.
+	r := httptest.NewRequest(http.MethodGet, "/govulncheck/recheck?module=example.com/m&version=v1.0.0", nil)
+	var serr *serverError
+	if err := h.handleRecheck(httptest.NewRecorder(), r); !errors.As(err, &serr) || serr.status != http.StatusNotImplemented {
+		t.Errorf("no BigQuery: got %v, want a 501", err)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/mod/semver"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/govulncheck"
+	"golang.org/x/pkgsite-metrics/internal/log"
+	"golang.org/x/pkgsite-metrics/internal/proxy"
+	"golang.org/x/pkgsite-metrics/internal/queue"
+	"golang.org/x/pkgsite-metrics/internal/version"
+)
+
+// maxResolvedVersions is the maximum number of versions that a version
+// query in a scan request may match, so that their scans fit in a task.
+const maxResolvedVersions = govulncheck.MaxBatchSize
+
+// scanVersions resolves the version of sreq, which may be a query like
+// "latest" or "<v1.2.0", and scans each version it stands for, oldest
+// first. If maxTimeout is positive, the scans share it; otherwise scans
+// of several versions share the task's time, as in a batch.
+func (h *GovulncheckServer) scanVersions(ctx context.Context, w http.ResponseWriter, sreq *govulncheck.Request, maxTimeout time.Duration) error {
+	versions, err := resolveVersions(ctx, h.proxyClient, sreq.Module, sreq.Version)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 1 {
+		r := *sreq
+		r.Version = versions[0]
+		return h.scanRequest(ctx, w, &r, maxTimeout)
+	}
+	if maxTimeout <= 0 {
+		maxTimeout = queue.MaxCloudTasksTimeout - taskOverhead
+	}
+	maxTimeout /= time.Duration(len(versions))
+	log.Infof(ctx, "scanning %d versions of %s matching %q", len(versions), sreq.Module, sreq.Version)
+	var errs []error
+	for _, v := range versions {
+		r := *sreq
+		r.Version = v
+		if err := h.scanRequest(ctx, w, &r, maxTimeout); err != nil {
+			log.Errorf(ctx, err, "scanning %s@%s", r.Module, r.Version)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// resolveVersions returns the versions of modulePath that vers stands
+// for. A version that is not a query is returned as is. Latest is
+// resolved with the proxy's @latest endpoint, and a comparison like
+// "<v1.2.0" to the versions in the proxy's list that match it, in
+// increasing order.
+func resolveVersions(ctx context.Context, proxyClient *proxy.Client, modulePath, vers string) (_ []string, err error) {
+	defer derrors.Wrap(&err, "resolveVersions(%q, %q)", modulePath, vers)
+	if !version.IsQuery(vers) {
+		return []string{vers}, nil
+	}
+	if vers == version.Latest {
+		var info *proxy.VersionInfo
+		_, err := proxy.Retry(ctx, func() error {
+			var err error
+			info, err = proxyClient.Info(ctx, modulePath, vers)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return []string{info.Version}, nil
+	}
+	match, err := version.ParseComparison(vers)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", derrors.InvalidArgument, err)
+	}
+	var all []string
+	_, err = proxy.Retry(ctx, func() error {
+		var err error
+		all, err = proxyClient.Versions(ctx, modulePath)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	versions := version.RemoveIf(all, func(v string) bool { return !match(v) })
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("%w: no versions of %s match %q", derrors.NotFound, modulePath, vers)
+	}
+	if len(versions) > maxResolvedVersions {
+		return nil, fmt.Errorf("%w: %q matches %d versions of %s; at most %d can be scanned in one request",
+			derrors.InvalidArgument, vers, len(versions), modulePath, maxResolvedVersions)
+	}
+	semver.Sort(versions)
+	return versions, nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/proxy/proxytest"
+)
+
+func TestResolveVersions(t *testing.T) {
+	ctx := context.Background()
+	// A module path with upper-case letters, which the proxy escapes,
+	// and a major version suffix.
+	const azure = "github.com/Azure/m/v2"
+	modules := []*proxytest.Module{
+		{ModulePath: azure, Version: "v2.0.0"},
+		{ModulePath: azure, Version: "v2.1.0"},
+		{ModulePath: azure, Version: "v2.0.1"},
+	}
+	for i := range maxResolvedVersions + 1 {
+		modules = append(modules, &proxytest.Module{ModulePath: "example.com/many", Version: fmt.Sprintf("v1.%d.0", i)})
+	}
+	proxyClient, cleanup := proxytest.SetupTestClient(t, modules)
+	defer cleanup()
+
+	for _, test := range []struct {
+		module, version string
+		want            []string
+		wantErr         error
+	}{
+		{azure, "v2.0.0", []string{"v2.0.0"}, nil},
+		{azure, "latest", []string{"v2.1.0"}, nil},
+		{azure, "<v2.1.0", []string{"v2.0.0", "v2.0.1"}, nil},
+		{azure, ">=v2.0.1", []string{"v2.0.1", "v2.1.0"}, nil},
+		{azure, "<v2.0.0", nil, derrors.NotFound},
+		{azure, "<2.0.0", nil, derrors.InvalidArgument},
+		{"example.com/missing", "latest", nil, derrors.NotFound},
+		{"example.com/many", ">=v1.0.0", nil, derrors.InvalidArgument},
+	} {
+		t.Run(test.module+"@"+test.version, func(t *testing.T) {
+			got, err := resolveVersions(ctx, proxyClient, test.module, test.version)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("got %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/log"
+	"golang.org/x/pkgsite-metrics/internal/proxy"
+)
+
+// retryHeader is the response header of a failed scan request that
+// says whether the scan should be retried.
+const retryHeader = "Ecosystem-Scan-Retry"
+
+// errTransient is wrapped by errors of scans that failed because of
+// a problem in our infrastructure, and that may succeed if retried.
+var errTransient = errors.New("transient failure")
+
+// transientCategory reports whether a row with the given error category
+// is the result of an infrastructure problem, so that the scan should
+// be retried. Other errors are properties of the module, and happen
+// again if it is scanned again.
+func transientCategory(category string) bool {
+	switch category {
+	case derrors.CategorizeError(derrors.ScanModuleSandboxError),
+		derrors.CategorizeError(derrors.ScanModuleGovulncheckDBConnectionError),
+		derrors.CategorizeError(derrors.ScanModuleTooManyOpenFiles),
+		derrors.CategorizeError(derrors.ScanModuleDiskSpaceError),
+		derrors.CategorizeError(derrors.ScanModuleSandboxStartError),
+		derrors.CategorizeError(derrors.ScanModuleModDownloadError),
+		derrors.CategorizeError(derrors.GCSReadError),
+		derrors.CategorizeError(derrors.ChecksumDBError),
+		derrors.CategorizeError(derrors.BigQueryError):
+		return true
+	default:
+		return false
+	}
+}
+
+// shouldRetry reports whether a scan request that failed with err
+// should be retried by Cloud Tasks. Problems with the request or the
+// module are permanent. Everything else, like failing to reach
+// BigQuery, Firestore or the proxy, is assumed to be transient.
+// A joined error, from a batch, is retried if any of its errors is.
+func shouldRetry(err error) bool {
+	if err == nil {
+		return false
+	}
+	if j, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range j.Unwrap() {
+			if shouldRetry(e) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case errors.Is(err, errTransient):
+		return true
+	case errors.Is(err, derrors.InvalidArgument),
+		errors.Is(err, derrors.BadModule),
+		errors.Is(err, derrors.NotFound),
+		errors.Is(err, derrors.GCSNotFoundError),
+		errors.Is(err, derrors.LoadPackagesError):
+		return false
+	default:
+		return true
+	}
+}
+
+// proxyRateLimited returns the proxy.RateLimitError in err's chain,
+// or nil if there is none.
+func proxyRateLimited(err error) *proxy.RateLimitError {
+	var rerr *proxy.RateLimitError
+	if errors.As(err, &rerr) {
+		return rerr
+	}
+	return nil
+}
+
+// finishScan decides how to respond to a scan request that returned
+// err. If the failure is transient, it returns an error that results
+// in a 503, so that Cloud Tasks retries the request. Otherwise it
+// responds with a 200, so that it does not. If the proxy rate limited
+// the scan, the response passes on the proxy's Retry-After.
+func finishScan(ctx context.Context, w http.ResponseWriter, err error) error {
+	retry := shouldRetry(err)
+	log.Infof(ctx, "scan finished: err=%v, retry=%t", err, retry)
+	if err == nil {
+		return nil
+	}
+	w.Header().Set(retryHeader, strconv.FormatBool(retry))
+	if rerr := proxyRateLimited(err); rerr != nil && rerr.RetryAfter > 0 {
+		secs := int64(math.Ceil(rerr.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	}
+	if retry {
+		return &serverError{status: http.StatusServiceUnavailable, err: err}
+	}
+	log.Warnf(ctx, "not retrying scan after permanent error: %v", err)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "permanent error, not retrying: %v\n", err)
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/proxy"
+)
+
+func TestTransientCategory(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{derrors.ScanModuleSandboxError, true},
+		{derrors.ScanModuleGovulncheckDBConnectionError, true},
+		{derrors.ScanModuleTooManyOpenFiles, true},
+		{derrors.ScanModuleDiskSpaceError, true},
+		{derrors.ScanModuleSandboxStartError, true},
+		{derrors.ScanModuleModDownloadError, true},
+		{derrors.GCSReadError, true},
+		{derrors.BigQueryError, true},
+		{derrors.GCSNotFoundError, false},
+		{derrors.LoadPackagesError, false},
+		{derrors.LoadPackagesNoGoModError, false},
+		{derrors.LoadVendorError, false},
+		{derrors.ScanModuleGovulncheckError, false},
+		{derrors.ScanModuleMemoryLimitExceeded, false},
+		{derrors.ScanModuleTimeoutError, false},
+		{derrors.ScanModuleSkipped, false},
+		{derrors.ProxyError, false},
+		{derrors.BinaryNoBuildInfo, false},
+		{derrors.BinaryStripped, false},
+	} {
+		cat := derrors.CategorizeError(test.err)
+		if got := transientCategory(cat); got != test.want {
+			t.Errorf("%s: got %t, want %t", cat, got, test.want)
+		}
+	}
+	if transientCategory("") {
+		t.Error("no error: got true, want false")
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{fmt.Errorf("%w: bad", derrors.InvalidArgument), false},
+		{fmt.Errorf("%w: gone", derrors.GCSNotFoundError), false},
+		{fmt.Errorf("zip: %w", derrors.BadModule), false},
+		{fmt.Errorf("%w: proxy 502", errTransient), true},
+		{errors.New("bigquery unavailable"), true},
+		{errors.Join(fmt.Errorf("%w: x", derrors.InvalidArgument), fmt.Errorf("%w: y", derrors.NotFound)), false},
+		{errors.Join(fmt.Errorf("%w: x", derrors.InvalidArgument), fmt.Errorf("%w: y", errTransient)), true},
+	} {
+		if got := shouldRetry(test.err); got != test.want {
+			t.Errorf("%v: got %t, want %t", test.err, got, test.want)
+		}
+	}
+}
+
+func TestFinishScan(t *testing.T) {
+	ctx := context.Background()
+
+	w := httptest.NewRecorder()
+	if err := finishScan(ctx, w, fmt.Errorf("%w: bad", derrors.InvalidArgument)); err != nil {
+		t.Errorf("permanent: got %v, want nil", err)
+	}
+	if w.Code != http.StatusOK || w.Header().Get(retryHeader) != "false" {
+		t.Errorf("permanent: got status %d, header %q", w.Code, w.Header().Get(retryHeader))
+	}
+
+	w = httptest.NewRecorder()
+	err := finishScan(ctx, w, fmt.Errorf("%w: sandbox", errTransient))
+	var serr *serverError
+	if !errors.As(err, &serr) || serr.status != http.StatusServiceUnavailable {
+		t.Errorf("transient: got %v, want 503 serverError", err)
+	}
+	if w.Header().Get(retryHeader) != "true" {
+		t.Errorf("transient: got header %q", w.Header().Get(retryHeader))
+	}
+	w = httptest.NewRecorder()
+	rerr := &proxy.RateLimitError{RetryAfter: 1500 * time.Millisecond}
+	err = finishScan(ctx, w, fmt.Errorf("%w: %w", errTransient, rerr))
+	if !errors.As(err, &serr) || serr.status != http.StatusServiceUnavailable {
+		t.Errorf("rate limited: got %v, want 503 serverError", err)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("rate limited: got Retry-After %q, want \"2\"", got)
+	}
+}
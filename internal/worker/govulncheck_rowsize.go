@@ -0,0 +1,103 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/pkgsite-metrics/internal/bigquery"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/govulncheck"
+	"golang.org/x/pkgsite-metrics/internal/log"
+)
+
+// maxRowBytes is the maximum size of a row, as JSON.
+// BigQuery rejects larger requests with 413 (Request Entity Too Large);
+// the limit leaves room for encoding overhead.
+const maxRowBytes = 5 << 20
+
+// fullResultsDir is the directory in the binary bucket where
+// rows too large to upload are saved.
+const fullResultsDir = "govulncheck-results"
+
+// limitRowSizes applies limitRowSize to each govulncheck row in rows.
+func (s *scanner) limitRowSizes(ctx context.Context, rows []bigquery.Row) {
+	for _, r := range rows {
+		if row, ok := r.(*govulncheck.Result); ok {
+			limitRowSize(ctx, s.gcsBucket, row, maxRowBytes)
+		}
+	}
+}
+
+// limitRowSize truncates row.Vulns so that row is at most maxBytes
+// as JSON, and marks row as truncated. Before truncating, it saves
+// the complete row to bucket, if bucket is non-nil.
+// Errors saving the row are logged.
+func limitRowSize(ctx context.Context, bucket *storage.BucketHandle, row *govulncheck.Result, maxBytes int) {
+	data, err := json.Marshal(row)
+	if err != nil || len(data) <= maxBytes {
+		return
+	}
+	log.Warnf(ctx, "%s@%s %s: row is %d bytes; truncating vulns", row.ModulePath, row.Version, row.ScanMode, len(data))
+	if bucket != nil {
+		obj := bucket.Object(fullResultsObjectName(row))
+		if err := writeFullResults(ctx, obj, data); err != nil {
+			log.Errorf(ctx, err, "saving full results of %s@%s", row.ModulePath, row.Version)
+		} else {
+			row.FullResultsPath = bigquery.NullString(fmt.Sprintf("gs://%s/%s", obj.BucketName(), obj.ObjectName()))
+		}
+	}
+	vulns := row.Vulns
+	row.ResultsTruncated = bigquery.NullBool(true)
+	row.NumVulns = bigquery.NullInt(len(vulns))
+	row.Vulns = nil
+	base, err := json.Marshal(row)
+	if err != nil {
+		return
+	}
+	row.Vulns = prefixThatFits(vulns, len(base), maxBytes)
+}
+
+// prefixThatFits returns the longest prefix of items that, added as JSON
+// to a row of baseSize bytes, keeps the row at most maxBytes.
+func prefixThatFits[T any](items []T, baseSize, maxBytes int) []T {
+	size := baseSize
+	for i, item := range items {
+		data, err := json.Marshal(item)
+		if err != nil {
+			return items[:i]
+		}
+		size += len(data) + 1 // for the comma
+		if size > maxBytes {
+			return items[:i]
+		}
+	}
+	return items
+}
+
+// fullResultsObjectName returns the name of the object that holds
+// the complete row for row.
+func fullResultsObjectName(row *govulncheck.Result) string {
+	name := fmt.Sprintf("%s/%s@%s/%s", fullResultsDir, row.ModulePath, row.Version, url.PathEscape(row.ScanMode))
+	if row.Suffix != "" {
+		name += "/" + row.Suffix
+	}
+	return name + ".json"
+}
+
+func writeFullResults(ctx context.Context, obj *storage.ObjectHandle, data []byte) (err error) {
+	defer derrors.Wrap(&err, "writeFullResults(%q)", obj.ObjectName())
+	w := obj.NewWriter(ctx)
+	w.ContentType = "application/json"
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,62 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"golang.org/x/pkgsite-metrics/internal/govulncheck"
+)
+
+func TestLimitRowSize(t *testing.T) {
+	ctx := context.Background()
+	newRow := func(n int) *govulncheck.Result {
+		row := &govulncheck.Result{ModulePath: "m", Version: "v1.0.0", ScanMode: scanModeSourceSymbol}
+		for i := 0; i < n; i++ {
+			row.Vulns = append(row.Vulns, &govulncheck.Vuln{ID: fmt.Sprintf("GO-2023-%04d", i), ModulePath: "m", PackagePath: "m/p"})
+		}
+		return row
+	}
+	size := func(row *govulncheck.Result) int {
+		data, err := json.Marshal(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(data)
+	}
+
+	// A small row is unchanged.
+	row := newRow(3)
+	limitRowSize(ctx, nil, row, 1<<20)
+	if row.ResultsTruncated.Bool || len(row.Vulns) != 3 {
+		t.Errorf("small row: got truncated=%t, %d vulns; want false, 3", row.ResultsTruncated.Bool, len(row.Vulns))
+	}
+
+	// A large row is truncated to fit.
+	row = newRow(100)
+	const maxBytes = 4000
+	limitRowSize(ctx, nil, row, maxBytes)
+	if !row.ResultsTruncated.Bool || row.NumVulns.Int64 != 100 {
+		t.Errorf("large row: got truncated=%t, NumVulns=%d; want true, 100", row.ResultsTruncated.Bool, row.NumVulns.Int64)
+	}
+	if len(row.Vulns) == 0 || len(row.Vulns) >= 100 {
+		t.Errorf("large row: got %d vulns, want between 0 and 100", len(row.Vulns))
+	}
+	if s := size(row); s > maxBytes {
+		t.Errorf("large row: got size %d, want at most %d", s, maxBytes)
+	}
+}
+
+func TestFullResultsObjectName(t *testing.T) {
+	row := &govulncheck.Result{ModulePath: "example.com/m", Version: "v1.0.0", ScanMode: scanModeCompareBinary, Suffix: "example.com/m/cmd"}
+	got := fullResultsObjectName(row)
+	want := "govulncheck-results/example.com/m@v1.0.0/COMPARE%20-%20BINARY/example.com/m/cmd.json"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
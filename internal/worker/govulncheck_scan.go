@@ -12,15 +12,17 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"golang.org/x/exp/event"
 	"golang.org/x/pkgsite-metrics/internal/bigquery"
+	"golang.org/x/pkgsite-metrics/internal/config"
 	"golang.org/x/pkgsite-metrics/internal/derrors"
-	"golang.org/x/pkgsite-metrics/internal/fstore"
 	"golang.org/x/pkgsite-metrics/internal/govulncheck"
 	"golang.org/x/pkgsite-metrics/internal/govulncheckapi"
 	"golang.org/x/pkgsite-metrics/internal/log"
+	"golang.org/x/pkgsite-metrics/internal/modules"
 	"golang.org/x/pkgsite-metrics/internal/proxy"
 	"golang.org/x/pkgsite-metrics/internal/sandbox"
 	"golang.org/x/pkgsite-metrics/internal/version"
@@ -34,12 +36,19 @@ const (
 	// ModeCompare is an ecosystem metrics mode that finds compilable binaries
 	// and runs govulncheck in both source and binary mode and reports results.
 	ModeCompare = "COMPARE"
+
+	// ModeCombined is an ecosystem metrics mode that runs the govulncheck
+	// binary in source mode, like ModeGovulncheck, but records the
+	// package-level and symbol-level findings of each vuln together,
+	// in a single row.
+	ModeCombined = "COMBINED"
 )
 
 // modes is a set of supported govulncheck ecosystem metrics modes.
 var modes = map[string]bool{
 	ModeGovulncheck: true,
 	ModeCompare:     true,
+	ModeCombined:    true,
 }
 
 const (
@@ -70,6 +79,11 @@ const (
 	// source (symbol) precision level in compare mode.
 	scanModeCompareSource string = "COMPARE - SOURCE"
 
+	// scanModeCombined is used to designate results of ModeCombined,
+	// whose vulns say whether they are imported and whether they are
+	// called.
+	scanModeCombined string = "COMBINED"
+
 	// sandboxGoCache is the location of the Go cache inside the sandbox. The
 	// user is root and their $HOME directory is /root. The Go cache resides
 	// in its default location, $HOME/.cache/go-build.
@@ -83,32 +97,117 @@ var (
 	gSuccCounter = event.NewCounter("govulncheck-requests-ok", &event.MetricOptions{Namespace: metricNamespace})
 	// gSkipCounter counts skipped requests to govulncheck handleScan
 	gSkipCounter = event.NewCounter("govulncheck-requests-skip", &event.MetricOptions{Namespace: metricNamespace})
+	// gErrCounter counts failed scans, by error category and mode
+	gErrCounter = event.NewCounter("govulncheck-scan-errors", &event.MetricOptions{Namespace: metricNamespace})
+	// gScanDuration records how long scans take, by mode
+	gScanDuration = event.NewDuration("govulncheck-scan-duration", &event.MetricOptions{Namespace: metricNamespace})
+	// gDownloadDuration records how long module downloads take, by mode
+	gDownloadDuration = event.NewDuration("module-download-duration", &event.MetricOptions{Namespace: metricNamespace})
+	// gScanMemory records the peak memory used by govulncheck, by mode
+	gScanMemory = event.NewIntDistribution("govulncheck-scan-memory", &event.MetricOptions{Namespace: metricNamespace, Unit: event.UnitBytes})
 )
 
+// recordScanError counts a failed scan by the category of err and the
+// mode of the scan started in ctx. The module is not a label, so that
+// the metric has few distinct label values.
+func recordScanError(ctx context.Context, err error) {
+	gErrCounter.Record(ctx, 1,
+		event.String("category", derrors.CategorizeError(err)),
+		event.String("mode", scanMode(ctx)))
+}
+
 // handleScan runs a govulncheck scan for a single input module. It is triggered
 // by path /govulncheck/scan/MODULE_VERSION_SUFFIX?params.
 //
 // See internal/govulncheck.ParseRequest for allowed path forms and query params.
+//
+// Permanent failures, like invalid requests or modules that cannot be loaded,
+// result in a 200, so that Cloud Tasks does not retry them. Transient failures
+// result in a 503. See shouldRetry. Requests beyond the configured number
+// of active scans result in a 429.
 func (h *GovulncheckServer) handleScan(w http.ResponseWriter, r *http.Request) (err error) {
 	defer derrors.Wrap(&err, "handleScan")
+	return h.scanLimiter.do(w, func() error {
+		return finishScan(r.Context(), w, h.scan(w, r))
+	})
+}
 
-	// Collect basic metrics.
-	gReqCounter.Record(r.Context(), 1)
-	skip := false // request skipped
-	defer func() {
-		gSuccCounter.Record(r.Context(), 1, event.Bool("success", err == nil))
-		gSkipCounter.Record(r.Context(), 1, event.Bool("skipped", skip))
-	}()
+func (h *GovulncheckServer) scan(w http.ResponseWriter, r *http.Request) error {
+	if r.URL.Path == "/govulncheck/scan/"+govulncheck.BatchPath {
+		return h.handleScanBatch(w, r)
+	}
+	sreq, err := govulncheck.ParseRequest(r, "/govulncheck/scan")
+	if err != nil {
+		return fmt.Errorf("%w: %v", derrors.InvalidArgument, err)
+	}
+	return h.scanVersions(r.Context(), w, sreq, 0)
+}
+
+// taskOverhead is the time reserved in a task for work other than
+// scanning, like fetching modules and writing results.
+const taskOverhead = 5 * time.Minute
 
+// handleScanBatch scans each module of a batch request in turn.
+// It is triggered by path /govulncheck/scan/batch?modules=...&params.
+//
+// See internal/govulncheck.ParseBatchRequest for the query params.
+func (h *GovulncheckServer) handleScanBatch(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
-	sreq, err := govulncheck.ParseRequest(r, "/govulncheck/scan")
+	breq, err := govulncheck.ParseBatchRequest(r)
 	if err != nil {
 		return fmt.Errorf("%w: %v", derrors.InvalidArgument, err)
 	}
+	perModule := h.batchScanTimeout(breq)
+	var errs []error
+	for _, sreq := range breq.Requests() {
+		if err := h.scanVersions(ctx, w, sreq, perModule); err != nil {
+			log.Errorf(ctx, err, "batch: scanning %s@%s", sreq.Module, sreq.Version)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// batchScanTimeout returns how long each scan of breq may take. The
+// whole batch must finish before the deadline of its task, which is
+// computed as when the task was enqueued, so that time is divided among
+// the scans.
+func (h *GovulncheckServer) batchScanTimeout(breq *govulncheck.BatchRequest) time.Duration {
+	mode := breq.Mode
+	if mode == "" {
+		mode = ModeGovulncheck
+	}
+	deadline := govulncheckDeadline(h.cfg, h.modeConfigs.Get(mode), mode, true)
+	budget := deadline - taskOverhead
+	if budget <= 0 {
+		// The deadline is too short for the usual overhead.
+		budget = deadline / 2
+	}
+	return budget / time.Duration(len(breq.Modules))
+}
+
+// scanRequest scans the module of sreq, unless it can be skipped.
+// If maxTimeout is positive, the scan takes at most that long.
+func (h *GovulncheckServer) scanRequest(ctx context.Context, w http.ResponseWriter, sreq *govulncheck.Request, maxTimeout time.Duration) (err error) {
 	if sreq.Mode == "" {
 		sreq.Mode = ModeGovulncheck
 	}
-	scanner, err := newScanner(ctx, h)
+	// Trace the scan and collect basic metrics, with the same labels.
+	ctx = startScan(ctx, sreq.Module, sreq.Version, sreq.Mode)
+	mode := event.String("mode", sreq.Mode)
+	gReqCounter.Record(ctx, 1, mode)
+	skip := false // request skipped
+	defer func() {
+		success := event.Bool("success", err == nil)
+		gSuccCounter.Record(ctx, 1, mode, success)
+		gSkipCounter.Record(ctx, 1, mode, event.Bool("skipped", skip))
+		event.End(ctx, success, event.Bool("skipped", skip))
+	}()
+
+	if sreq.Packages != "" && sreq.Mode == ModeCompare {
+		return fmt.Errorf("%w: packages cannot be specified in mode %s", derrors.InvalidArgument, ModeCompare)
+	}
+	scanner, err := newScanner(ctx, h, sreq.Mode)
 	if err != nil {
 		return err
 	}
@@ -116,33 +215,99 @@ func (h *GovulncheckServer) handleScan(w http.ResponseWriter, r *http.Request) (
 	if sreq.Insecure {
 		scanner.insecure = sreq.Insecure
 	}
-	skip, err = scanner.canSkip(ctx, sreq, h.fsNamespace)
-	if err != nil {
-		return err
+	// So does an explicit "timeout". ParseRequest has validated it.
+	if sreq.Timeout != "" {
+		scanner.timeout, _ = time.ParseDuration(sreq.Timeout)
+	}
+	if maxTimeout > 0 && (scanner.timeout == 0 || scanner.timeout > maxTimeout) {
+		scanner.timeout = maxTimeout
+	}
+	if sreq.VulnDB != "" {
+		if err := scanner.useVulnDBSnapshot(ctx, h.vulnDBSnapshots, sreq.VulnDB); err != nil {
+			return err
+		}
+	}
+	if reason, ok := h.skipList.reason(ctx, sreq.Module); ok {
+		skip = true
+		log.Infof(ctx, "skipping (on skip list: %s): %s@%s", reason, sreq.Module, sreq.Version)
+		return scanner.writeSkipped(ctx, w, sreq, reason)
+	}
+	doneKey := taskKey(sreq.Attempt, "", sreq.Module, sreq.Version, sreq.Mode)
+	if h.taskCompleted(ctx, sreq.Attempt, doneKey) {
+		skip = true
+		log.Infof(ctx, "skipping (completed by an earlier attempt of the task): %s@%s", sreq.Module, sreq.Version)
+		return nil
+	}
+	// A scan of some packages says nothing about the rest of the module,
+	// so it is always done and does not record a work state.
+	partial := sreq.Packages != ""
+	if partial {
+		log.Infof(ctx, "scanning packages %s of %s@%s", sreq.Packages, sreq.Module, sreq.Version)
+	} else {
+		skip, err = scanner.canSkip(ctx, sreq, func(ctx context.Context, modulePath, version, mode string) (*govulncheck.WorkState, error) {
+			return govulncheck.GetWorkState(ctx, h.fsNamespace, modulePath, version, mode)
+		})
+		if err != nil {
+			return err
+		}
 	}
 	if skip {
 		log.Infof(ctx, "skipping (work version unchanged or unrecoverable error): %s@%s", sreq.Module, sreq.Version)
 		return nil
 	}
+	if !scanner.insecure {
+		sbox, release, serr := h.getSandbox(ctx)
+		if serr != nil {
+			return serr
+		}
+		defer func() { release(err) }()
+		scanner.sbox = sbox
+	}
+	start := time.Now()
 	workState, err := scanner.ScanModule(ctx, w, sreq)
+	gScanDuration.Record(ctx, time.Since(start), mode)
 	if err != nil {
 		return err
 	}
+	if ctx.Err() != nil {
+		// The scan was stopped, as when the worker shuts down, so its
+		// results may be incomplete. Don't record the work state, so
+		// the retry isn't skipped.
+		return fmt.Errorf("%w: scan of %s@%s stopped: %w", errTransient, sreq.Module, sreq.Version, ctx.Err())
+	}
 	if workState == nil {
 		return nil
 	}
+	if transientCategory(workState.ErrorCategory) {
+		// Don't record the work state, so the retry isn't skipped.
+		return fmt.Errorf("%w: scan of %s@%s failed with error category %q",
+			errTransient, sreq.Module, sreq.Version, workState.ErrorCategory)
+	}
+	// The rows are uploaded, so a retry of the task need not scan again.
+	if !sreq.Serve {
+		h.setTaskCompleted(ctx, doneKey)
+	}
+	if partial {
+		return nil
+	}
 	// We can't upload the row to bigquery and write the WorkState to Firestore atomically.
 	// But that's OK: if we fail before writing the WorkState, then we'll just re-do the scan
 	// the next time.
-	if err := govulncheck.SetWorkState(ctx, h.fsNamespace, sreq.Module, sreq.Version, workState); err != nil {
+	if err := govulncheck.SetWorkState(ctx, h.fsNamespace, sreq.Module, sreq.Version, sreq.Mode, workState); err != nil {
 		// Don't fail if there's an error, because we'd just re-run the task.
 		log.Errorf(ctx, err, "SetWorkState")
 	}
 	return nil
 }
 
-func (s *scanner) canSkip(ctx context.Context, sreq *govulncheck.Request, fsn *fstore.Namespace) (bool, error) {
-	ws, err := govulncheck.GetWorkState(ctx, fsn, sreq.Module, sreq.Version)
+// A workStateFunc returns the work state of a module version
+// in an ecosystem metrics mode, or nil if there is none.
+type workStateFunc func(ctx context.Context, modulePath, version, mode string) (*govulncheck.WorkState, error)
+
+// canSkip reports whether the scan of sreq can be skipped, based on
+// the work state of the previous scan of the module in the same mode.
+func (s *scanner) canSkip(ctx context.Context, sreq *govulncheck.Request, getWorkState workStateFunc) (bool, error) {
+	ws, err := getWorkState(ctx, sreq.Module, sreq.Version, sreq.Mode)
 	if err != nil {
 		return false, err
 	}
@@ -150,7 +315,7 @@ func (s *scanner) canSkip(ctx context.Context, sreq *govulncheck.Request, fsn *f
 		// Not scanned before.
 		return false, nil
 	}
-	log.Infof(ctx, "read work version for %s@%s", sreq.Module, sreq.Version)
+	log.Infof(ctx, "read work version for %s@%s in mode %s", sreq.Module, sreq.Version, sreq.Mode)
 	if s.workVersion.Equal(ws.WorkVersion) {
 		// If the work version has not changed, skip analyzing the module
 		return true, nil
@@ -175,18 +340,36 @@ func unrecoverableError(errorCategory string) bool {
 // A scanner holds state for scanning modules.
 type scanner struct {
 	proxyClient *proxy.Client
-	bqClient    *bigquery.Client
+	checksumDB  *modules.ChecksumDB
+	moduleCache *modules.Cache
+	rows        *rowUploader
 	workVersion *govulncheck.WorkVersion
 	gcsBucket   *storage.BucketHandle
+	goEnv       []string // environment of go commands run outside the sandbox
 	insecure    bool
 	sbox        *sandbox.Sandbox
 	binaryDir   string
+	timeout     time.Duration // maximum duration of a scan; 0 means none
+	memoryLimit uint64        // maximum memory use during a scan; 0 means none
+	diskLimit   int64         // maximum disk use before a scan; 0 means none
+
+	proxyRetries int // number of retried proxy requests
+
+	// loadErrors are the errors loading the packages of the module, and
+	// partialLoad is true if the packages that loaded were scanned
+	// without the others. See runGovulncheckLoadable.
+	loadErrors  []*govulncheck.LoadError
+	partialLoad bool
+
+	instanceID string // Cloud Run instance ID, if available
 
 	govulncheckPath string
 	vulnDBDir       string
 }
 
-func newScanner(ctx context.Context, h *GovulncheckServer) (*scanner, error) {
+// newScanner returns a scanner for scans in mode. Its limits are those
+// configured for mode, if any, and otherwise the global ones.
+func newScanner(ctx context.Context, h *GovulncheckServer, mode string) (*scanner, error) {
 	workVersion, err := h.getWorkVersion(ctx)
 	if err != nil {
 		return nil, err
@@ -199,16 +382,35 @@ func newScanner(ctx context.Context, h *GovulncheckServer) (*scanner, error) {
 		}
 		bucket = c.Bucket(h.cfg.BinaryBucket)
 	}
-	sbox := sandbox.New("/bundle")
-	sbox.Runsc = "/usr/local/bin/runsc"
+	sbox := newSandbox(h.cfg)
+	mc := h.modeConfigs.Get(mode)
+	timeout := h.cfg.ScanTimeout
+	if mc.ScanTimeout > 0 {
+		timeout = mc.ScanTimeout
+	}
+	var memLimit uint64
+	if config.OnCloudRun() {
+		fraction := h.cfg.ScanMemoryFraction
+		if mc.ScanMemoryFraction > 0 {
+			fraction = mc.ScanMemoryFraction
+		}
+		memLimit = scanMemoryLimit(fraction)
+	}
 	return &scanner{
 		proxyClient:     h.proxyClient,
-		bqClient:        h.bqClient,
+		checksumDB:      h.checksumDB,
+		moduleCache:     h.moduleCache,
+		rows:            h.rows,
 		workVersion:     workVersion,
 		gcsBucket:       bucket,
+		goEnv:           h.goEnv,
 		insecure:        h.cfg.Insecure,
 		sbox:            sbox,
 		binaryDir:       h.cfg.BinaryDir,
+		timeout:         timeout,
+		memoryLimit:     memLimit,
+		diskLimit:       h.cfg.ScanDiskLimit,
+		instanceID:      instanceID(ctx),
 		govulncheckPath: filepath.Join(h.cfg.BinaryDir, "govulncheck"),
 		vulnDBDir:       h.cfg.VulnDBDir,
 	}, nil
@@ -233,12 +435,18 @@ func (s scanError) Unwrap() error {
 // binary within the module.
 func (s *scanner) CompareModule(ctx context.Context, w http.ResponseWriter, sreq *govulncheck.Request, baseRow *govulncheck.Result) (err error) {
 	defer derrors.Wrap(&err, "CompareModule")
-	err = doScan(ctx, baseRow.ModulePath, baseRow.Version, s.insecure, func() (err error) {
+	ctx, stop := s.monitorMemory(ctx)
+	defer stop()
+	err = doScan(ctx, baseRow.ModulePath, baseRow.Version, sreq.Mode, s.insecure, s.diskLimit, s.moduleCache, func() (err error) {
 		inputPath := moduleDir(baseRow.ModulePath, baseRow.Version)
 		defer derrors.Cleanup(&err, func() error { return os.RemoveAll(inputPath) })
 		const init = true
-		if err := prepareModule(ctx, baseRow.ModulePath, baseRow.Version, inputPath, s.proxyClient, s.insecure, init); err != nil {
+		retries, err := prepareModule(ctx, baseRow.ModulePath, baseRow.Version, inputPath, s.proxyClient, s.checksumDB, s.moduleCache, s.goEnv, s.insecure, init)
+		s.proxyRetries += retries
+		baseRow.ProxyRetries = bigquery.NullInt(s.proxyRetries)
+		if err != nil {
 			log.Errorf(ctx, err, "error trying to prepare module %s", baseRow.ModulePath)
+			recordScanError(ctx, err)
 			return nil
 		}
 
@@ -246,15 +454,24 @@ func (s *scanner) CompareModule(ctx context.Context, w http.ResponseWriter, sreq
 		err = s.sbox.Validate()
 		log.Debugf(ctx, "sandbox Validate returned %v", err)
 
-		response, err := s.runGovulncheckCompareSandbox(ctx, smdir)
+		rctx, endRun := startStage(ctx, stageSandboxRun)
+		response, err := s.runGovulncheckCompareSandbox(rctx, smdir)
+		endRun(err)
 		if err != nil {
 			return err
 		}
 		log.Infof(ctx, "scanner.runGovulncheckCompare found %d compilable binaries in %s:", len(response.FindingsForMod), sreq.Path())
 
+		_, endConvert := startStage(ctx, stageConvertResults)
 		var rows []bigquery.Row
 		for pkg, results := range response.FindingsForMod {
 			if results.Error != "" {
+				// A binary that can never be scanned is recorded, so
+				// that it is counted.
+				if berr := govulncheck.BinaryError(results.Error); berr != nil {
+					rows = append(rows, createComparisonErrorRow(pkg, baseRow, berr))
+					continue
+				}
 				// Just log error if binary failed to build or the analysis failed.
 				// TODO: should we save those rows? This would complicate clients, namely the dashboards.
 				log.Errorf(ctx, errors.New(results.Error), "building/analyzing binary failed: %s %s", pkg, sreq.Path())
@@ -262,19 +479,33 @@ func (s *scanner) CompareModule(ctx context.Context, w http.ResponseWriter, sreq
 			}
 
 			binRow := createComparisonRow(pkg, &results.BinaryResults, baseRow, true)
+			if md := results.BinaryMetadata; md != nil {
+				binRow.SetBinaryMetadata(md)
+			} else if msg := results.BinaryMetadataError; msg != "" {
+				merr := govulncheck.BinaryError(msg)
+				if merr == nil {
+					merr = fmt.Errorf("%w: %s", derrors.ScanModuleBuildInfoError, msg)
+				}
+				binRow.AddError(merr)
+			}
 			srcRow := createComparisonRow(pkg, &results.SourceResults, baseRow, false)
 			log.Infof(ctx, "found %d vulns in binary mode and %d vulns in source mode for package %s (module: %s)", len(binRow.Vulns), len(srcRow.Vulns), pkg, sreq.Path())
 			rows = append(rows, binRow, srcRow)
 		}
+		if len(rows) > 0 {
+			s.limitRowSizes(ctx, rows)
+		}
+		endConvert(nil)
 
 		if len(rows) > 0 {
-			return writeResults(ctx, sreq.Serve, w, s.bqClient, govulncheck.TableName, rows)
+			return writeResults(ctx, sreq.Serve, w, s.rows, govulncheck.TableName, rows)
 		}
 		return nil
 	})
 
 	if err != nil {
 		log.Errorf(ctx, err, "CompareModule failed for: %s", baseRow.ModulePath)
+		recordScanError(ctx, err)
 	}
 	return nil
 }
@@ -287,6 +518,7 @@ func createComparisonRow(pkg string, response *govulncheck.AnalysisResponse, bas
 		row.BinaryBuildSeconds = bigquery.NullFloat(response.Stats.BuildTime.Seconds())
 	} else {
 		row.ScanMode = scanModeCompareSource
+		row.SetScanCounts(response.Stats)
 	}
 
 	row.Vulns = vulnsForScanMode(response, scanModeSourceSymbol) // we want vulns at the symbol level, binary or source
@@ -295,6 +527,16 @@ func createComparisonRow(pkg string, response *govulncheck.AnalysisResponse, bas
 	return &row
 }
 
+// createComparisonErrorRow returns the binary row of the comparison for
+// pkg, which failed with err.
+func createComparisonErrorRow(pkg string, baseRow *govulncheck.Result, err error) *govulncheck.Result {
+	row := *baseRow
+	row.Suffix = pkg
+	row.ScanMode = scanModeCompareBinary
+	row.AddError(err)
+	return &row
+}
+
 // ScanModule scans the module in the request. It returns the WorkState for the result.
 func (s *scanner) ScanModule(ctx context.Context, w http.ResponseWriter, sreq *govulncheck.Request) (*govulncheck.WorkState, error) {
 	if sreq.Module == "std" {
@@ -307,19 +549,45 @@ func (s *scanner) ScanModule(ctx context.Context, w http.ResponseWriter, sreq *g
 		WorkVersion: *s.workVersion,
 		ImportedBy:  sreq.ImportedBy,
 	}
+	if sreq.Packages != "" {
+		baseRow.Packages = bigquery.NullString(sreq.Packages)
+	}
+	baseRow.InstanceID, baseRow.TaskRetryCount, baseRow.TaskExecutionCount = runColumns(s.instanceID, sreq.Attempt)
 	baseRow.VulnDBLastModified = s.workVersion.VulnDBLastModified
 
 	log.Debugf(ctx, "fetching proxy info: %s@%s", sreq.Path(), sreq.Version)
-	info, err := s.proxyClient.Info(ctx, sreq.Module, sreq.Version)
+	var info *proxy.VersionInfo
+	ictx, endInfo := startStage(ctx, stageProxyInfo)
+	retries, err := proxy.Retry(ictx, func() error {
+		var err error
+		info, err = s.proxyClient.Info(ictx, sreq.Module, sreq.Version)
+		return err
+	})
+	endInfo(err)
+	s.proxyRetries += retries
+	baseRow.ProxyRetries = bigquery.NullInt(s.proxyRetries)
 	if err != nil {
 		log.Infof(ctx, "proxy error: %s@%s %v", sreq.Path(), sreq.Version, err)
+		if proxyRateLimited(err) != nil {
+			// Not a property of the module: retry later, without
+			// recording a failure.
+			return nil, fmt.Errorf("%w: %w", errTransient, err)
+		}
+		perr := fmt.Errorf("%v: %w", err, derrors.ProxyError)
+		recordScanError(ctx, perr)
 		rows := createRows(sreq.Mode, func(sm string) *govulncheck.Result {
 			row := *baseRow
 			row.ScanMode = sm
-			row.AddError(fmt.Errorf("%v: %w", err, derrors.ProxyError))
+			row.AddError(perr)
 			return &row
 		})
-		return nil, writeResults(ctx, sreq.Serve, w, s.bqClient, govulncheck.TableName, rows)
+		if werr := writeResults(ctx, sreq.Serve, w, s.rows, govulncheck.TableName, rows); werr != nil {
+			return nil, werr
+		}
+		if proxy.IsTransient(err) {
+			return nil, fmt.Errorf("%w: %v", errTransient, err)
+		}
+		return nil, nil
 	}
 	baseRow.Version = info.Version
 	baseRow.SortVersion = version.ForSorting(info.Version)
@@ -328,7 +596,7 @@ func (s *scanner) ScanModule(ctx context.Context, w http.ResponseWriter, sreq *g
 	if sreq.Mode == ModeCompare {
 		// TODO: WorkState for CompareModule requests?
 		return nil, s.CompareModule(ctx, w, sreq, baseRow)
-	} else if sreq.Mode == ModeGovulncheck {
+	} else if sreq.Mode == ModeGovulncheck || sreq.Mode == ModeCombined {
 		return s.CheckModule(ctx, w, sreq, baseRow)
 	}
 	return nil, nil
@@ -338,44 +606,29 @@ func (s *scanner) ScanModule(ctx context.Context, w http.ResponseWriter, sreq *g
 // analysis is conducted. For binary analysis, see CompareModule.
 func (s *scanner) CheckModule(ctx context.Context, w http.ResponseWriter, sreq *govulncheck.Request, baseRow *govulncheck.Result) (*govulncheck.WorkState, error) {
 	log.Infof(ctx, "running scanner.runScanModule: %s@%s", sreq.Path(), sreq.Version)
-	response, err := s.runScanModule(ctx, sreq.Module, baseRow.Version, sreq.Mode)
+	response, importsOnly, err := s.runScanModule(ctx, sreq.Module, baseRow.Version, sreq.Mode, sreq.PackagePatterns(), sreq.Triage)
+	if proxyRateLimited(err) != nil {
+		// As in ScanModule, retry later without writing a row.
+		return nil, fmt.Errorf("%w: %w", errTransient, err)
+	}
 	// classify scan error first
 	if err != nil {
-		switch {
-		case isModVendor(err):
-			err = fmt.Errorf("%v: %w", err, derrors.LoadVendorError)
-		case isGovulncheckLoadError(err) || isBuildIssue(err):
-			err = fmt.Errorf("%v: %w", err, derrors.LoadPackagesError)
-		case isNoRequiredModule(err):
-			// Should be subsumed by LoadPackagesError, kept for sanity
-			// and to catch unexpected changes in govulncheck output.
-			err = fmt.Errorf("%v: %w", err, derrors.LoadPackagesNoRequiredModuleError)
-		case isMissingGoSumEntry(err):
-			// Should be subsumed by LoadPackagesError, kept for sanity.
-			// and to catch unexpected changes in govulncheck output.
-			err = fmt.Errorf("%v: %w", err, derrors.LoadPackagesMissingGoSumEntryError)
-		case isReplacingWithLocalPath(err):
-			// Should be subsumed by LoadPackagesError, kept for sanity.
-			// and to catch unexpected changes in govulncheck output.
-			err = fmt.Errorf("%v: %w", err, derrors.LoadPackagesImportedLocalError)
-		case isMissingGoMod(err) || isNoModulesSpecified(err):
-			// Should be subsumed by LoadPackagesError, kept for sanity
-			// and to catch unexpected changes in govulncheck output.
-			err = fmt.Errorf("%v: %w", err, derrors.LoadPackagesNoGoModError)
-		case isTooManyFiles(err):
-			err = fmt.Errorf("%v: %w", err, derrors.ScanModuleTooManyOpenFiles)
-		case isProxyCacheMiss(err):
-			err = fmt.Errorf("%v: %w", err, derrors.ProxyError)
-		case isSandboxRelatedIssue(err):
-			err = fmt.Errorf("%v: %w", err, derrors.ScanModuleSandboxError)
-		default:
-			err = fmt.Errorf("%v: %w", err, derrors.ScanModuleGovulncheckError)
-		}
+		err = classifyScanError(err)
+		recordScanError(ctx, err)
+	} else if response != nil {
+		gScanMemory.Record(ctx, int64(response.Stats.ScanMemory)*1024, event.String("mode", sreq.Mode))
 	}
 
+	_, endConvert := startStage(ctx, stageConvertResults)
 	rows := createRows(sreq.Mode, func(sm string) *govulncheck.Result {
 		row := *baseRow
 		row.ScanMode = sm
+		row.ImportsOnly = bigquery.NullBool(importsOnly)
+		row.ProxyRetries = bigquery.NullInt(s.proxyRetries)
+		row.LoadErrors = s.loadErrors
+		if s.loadErrors != nil {
+			row.PartialLoad = bigquery.NullBool(err == nil && s.partialLoad)
+		}
 
 		if err != nil {
 			row.AddError(err)
@@ -385,28 +638,84 @@ func (s *scanner) CheckModule(ctx context.Context, w http.ResponseWriter, sreq *
 			// We currently don't have a way of approximating time for measuring time for module and
 			// package level scans. We could run govulncheck with -scan package and -scan module, but
 			// that would put more pressure on the pipeline and use more resources.
-			if sm == ModeGovulncheck {
+			if sm == scanModeSourceSymbol || sm == scanModeCombined {
 				row.ScanSeconds = response.Stats.ScanSeconds
 				row.ScanMemory = int64(response.Stats.ScanMemory)
 			}
-			row.Vulns = vulnsForScanMode(response, sm)
+			row.SetScanCounts(response.Stats)
+			if sm == scanModeCombined {
+				row.Vulns = combinedVulns(response)
+			} else {
+				row.Vulns = vulnsForScanMode(response, sm)
+			}
 			log.Infof(ctx, "scanner.runScanModule returned %d findings for %s with row.Vulns=%d in scan mode=%s", len(response.Findings), sreq.Path(), len(row.Vulns), sm)
 		}
 		return &row
 	})
 
-	if err := writeResults(ctx, sreq.Serve, w, s.bqClient, govulncheck.TableName, rows); err != nil {
+	s.limitRowSizes(ctx, rows)
+	endConvert(nil)
+	if err := writeResults(ctx, sreq.Serve, w, s.rows, govulncheck.TableName, rows); err != nil {
 		return nil, err
 	}
 	// all of the rows share the same work state
 	return baseRow.WorkState(), nil
 }
 
+// classifyScanError returns err, from scanning a module, wrapped in the
+// derrors sentinel for its category.
+func classifyScanError(err error) error {
+	ierr := infraError(err)
+	switch {
+	case errors.Is(err, derrors.ScanModuleTimeoutError),
+		errors.Is(err, derrors.ScanModuleMemoryLimitExceeded):
+		// Already classified by runScanModule.
+	case errors.Is(err, derrors.ScanModuleDiskSpaceError):
+		// Already classified by doScan.
+	case ierr != nil:
+		// Failures of the infrastructure come before the rest, because
+		// they can make the module look broken.
+		err = fmt.Errorf("%v: %w", err, ierr)
+	case isModVendor(err):
+		err = fmt.Errorf("%v: %w", err, derrors.LoadVendorError)
+	case isGovulncheckLoadError(err) || isBuildIssue(err):
+		err = fmt.Errorf("%v: %w", err, derrors.LoadPackagesError)
+	case isNoRequiredModule(err):
+		// Should be subsumed by LoadPackagesError, kept for sanity
+		// and to catch unexpected changes in govulncheck output.
+		err = fmt.Errorf("%v: %w", err, derrors.LoadPackagesNoRequiredModuleError)
+	case isMissingGoSumEntry(err):
+		// Should be subsumed by LoadPackagesError, kept for sanity.
+		// and to catch unexpected changes in govulncheck output.
+		err = fmt.Errorf("%v: %w", err, derrors.LoadPackagesMissingGoSumEntryError)
+	case isReplacingWithLocalPath(err):
+		// Should be subsumed by LoadPackagesError, kept for sanity.
+		// and to catch unexpected changes in govulncheck output.
+		err = fmt.Errorf("%v: %w", err, derrors.LoadPackagesImportedLocalError)
+	case isMissingGoMod(err) || isNoModulesSpecified(err):
+		// Should be subsumed by LoadPackagesError, kept for sanity
+		// and to catch unexpected changes in govulncheck output.
+		err = fmt.Errorf("%v: %w", err, derrors.LoadPackagesNoGoModError)
+	case isTooManyFiles(err):
+		err = fmt.Errorf("%v: %w", err, derrors.ScanModuleTooManyOpenFiles)
+	case isProxyCacheMiss(err):
+		err = fmt.Errorf("%v: %w", err, derrors.ProxyError)
+	case isSandboxRelatedIssue(err):
+		err = fmt.Errorf("%v: %w", err, derrors.ScanModuleSandboxError)
+	default:
+		err = fmt.Errorf("%v: %w", err, derrors.ScanModuleGovulncheckError)
+	}
+	return err
+}
+
 // vulnsForScanMode produces Vulns from findings at the specified
 // govulncheck scan mode.
 func vulnsForScanMode(response *govulncheck.AnalysisResponse, scanMode string) []*govulncheck.Vuln {
 	var modeFindings []*govulncheckapi.Finding
 	for _, f := range response.Findings {
+		if len(f.Trace) == 0 { // sanity
+			continue
+		}
 		fr := f.Trace[0]
 		switch scanMode {
 		case scanModeSourceSymbol:
@@ -424,101 +733,241 @@ func vulnsForScanMode(response *govulncheck.AnalysisResponse, scanMode string) [
 		}
 	}
 
+	// Avoid duplicates. Of the findings for the same vuln, keep the one
+	// with the shortest trace, so the recorded call stack is the shortest.
+	type vulnKey struct {
+		id, pkg, mod, version string
+	}
 	var vulns []*govulncheck.Vuln
-	seen := make(map[govulncheck.Vuln]bool) // avoid duplicates
+	traceLens := make(map[vulnKey]int)
+	index := make(map[vulnKey]int) // index of vuln in vulns
 	for _, f := range modeFindings {
 		v := govulncheck.ConvertGovulncheckFinding(f, response.OSVs[f.OSV])
-		if seen[*v] {
+		k := vulnKey{v.ID, v.PackagePath, v.ModulePath, v.Version}
+		if i, ok := index[k]; ok {
+			if len(f.Trace) < traceLens[k] {
+				vulns[i] = v
+				traceLens[k] = len(f.Trace)
+			}
 			continue
 		}
-		seen[*v] = true
+		index[k] = len(vulns)
+		traceLens[k] = len(f.Trace)
+		vulns = append(vulns, v)
+	}
+	return vulns
+}
+
+// combinedVulns returns the vulns of response for scanModeCombined: one
+// for each vuln and imported vulnerable package, whose Imported is true
+// and whose Called says whether a vulnerable symbol of the package is
+// called. The vuln of a called package is that of the symbol-level
+// finding, with its call stack.
+func combinedVulns(response *govulncheck.AnalysisResponse) []*govulncheck.Vuln {
+	type key struct{ id, pkg string }
+	called := map[key]*govulncheck.Vuln{}
+	symbolVulns := vulnsForScanMode(response, scanModeSourceSymbol)
+	for _, v := range symbolVulns {
+		called[key{v.ID, v.PackagePath}] = v
+	}
+	// Package-level findings are reported for called vulns too, so
+	// iterating over them covers every imported package.
+	var vulns []*govulncheck.Vuln
+	seen := map[key]bool{}
+	for _, v := range vulnsForScanMode(response, scanModeSourcePackage) {
+		k := key{v.ID, v.PackagePath}
+		if cv := called[k]; cv != nil {
+			v = cv
+		}
+		v.Imported = bigquery.NullBool(true)
+		v.Called = bigquery.NullBool(called[k] != nil)
+		seen[k] = true
 		vulns = append(vulns, v)
 	}
+	// In case a called package has no package-level finding.
+	for _, v := range symbolVulns {
+		if k := (key{v.ID, v.PackagePath}); !seen[k] {
+			v.Imported = bigquery.NullBool(true)
+			v.Called = bigquery.NullBool(true)
+			vulns = append(vulns, v)
+		}
+	}
 	return vulns
 }
 
 // createRows creates a row, using f, for each scanMode associated
 // with ecosystem metrics mode.
 func createRows(mode string, f func(string) *govulncheck.Result) []bigquery.Row {
-	var scanModes []string
-	if mode == ModeCompare {
-		scanModes = []string{scanModeCompareBinary, scanModeCompareSource}
-	} else if mode == ModeGovulncheck {
-		scanModes = []string{scanModeSourceSymbol, scanModeSourcePackage, scanModeSourceModule}
-	}
-
 	var rows []bigquery.Row
-	for _, sm := range scanModes {
+	for _, sm := range scanModes(mode) {
 		rows = append(rows, f(sm))
 	}
 	return rows
 }
 
+// scanModes returns the scan modes associated with ecosystem
+// metrics mode.
+func scanModes(mode string) []string {
+	switch mode {
+	case ModeCompare:
+		return []string{scanModeCompareBinary, scanModeCompareSource}
+	case ModeGovulncheck:
+		return []string{scanModeSourceSymbol, scanModeSourcePackage, scanModeSourceModule}
+	case ModeCombined:
+		return []string{scanModeCombined}
+	default:
+		return nil
+	}
+}
+
 // runScanModule fetches the module version from the proxy, and analyzes its source
 // code for vulnerabilities. The analysis of binaries is done in CompareModule.
-func (s *scanner) runScanModule(ctx context.Context, modulePath, version, mode string) (response *govulncheck.AnalysisResponse, err error) {
-	err = doScan(ctx, modulePath, version, s.insecure, func() (err error) {
+//
+// If the scan takes longer than s.timeout, it is stopped and the
+// returned error wraps derrors.ScanModuleTimeoutError. If it uses
+// more than s.memoryLimit, or the sandbox's memory limit, it is stopped
+// and the returned error wraps derrors.ScanModuleMemoryLimitExceeded.
+//
+// Only the packages matching patterns are scanned.
+//
+// If triage is true, the module is first scanned at the package level.
+// If it imports no vulnerable packages, symbol analysis cannot find any
+// more vulnerabilities, so it is skipped and importsOnly is true.
+func (s *scanner) runScanModule(ctx context.Context, modulePath, version, mode string, patterns []string, triage bool) (response *govulncheck.AnalysisResponse, importsOnly bool, err error) {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	ctx, stop := s.monitorMemory(ctx)
+	defer stop()
+	defer func() {
+		if err == nil {
+			return
+		}
+		if cause := context.Cause(ctx); errors.Is(cause, derrors.ScanModuleMemoryLimitExceeded) {
+			err = fmt.Errorf("%w (%s@%s)", cause, modulePath, version)
+		} else if isSandboxMemoryLimit(err) {
+			err = fmt.Errorf("%w: %v (%s@%s)", derrors.ScanModuleMemoryLimitExceeded, err, modulePath, version)
+		} else if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("%w: %s@%s took longer than %s", derrors.ScanModuleTimeoutError, modulePath, version, s.timeout)
+		}
+	}()
+	err = doScan(ctx, modulePath, version, mode, s.insecure, s.diskLimit, s.moduleCache, func() (err error) {
 		// Download the module first.
 		inputPath := moduleDir(modulePath, version)
 		defer derrors.Cleanup(&err, func() error { return os.RemoveAll(inputPath) })
 		const init = true
-		if err := prepareModule(ctx, modulePath, version, inputPath, s.proxyClient, s.insecure, init); err != nil {
+		retries, err := prepareModule(ctx, modulePath, version, inputPath, s.proxyClient, s.checksumDB, s.moduleCache, s.goEnv, s.insecure, init)
+		s.proxyRetries += retries
+		if err != nil {
 			return err
 		}
 
-		if s.insecure {
-			response, err = s.runGovulncheckScanInsecure(inputPath, mode)
-		} else {
-			response, err = s.runGovulncheckScanSandbox(ctx, inputPath, mode)
+		if triage {
+			response, patterns, err = s.runGovulncheckLoadable(ctx, modulePath, inputPath, mode, govulncheck.ScanLevelPackage, patterns)
+			if err != nil {
+				return err
+			}
+			secs := response.Stats.ScanSeconds
+			if !importsVulnerablePackage(response) {
+				importsOnly = true
+				log.Infof(ctx, "%s@%s imports no vulnerable packages; skipped symbol analysis after %.1fs imports scan", modulePath, version, secs)
+				return nil
+			}
+			log.Infof(ctx, "%s@%s imports vulnerable packages; running symbol analysis after %.1fs imports scan", modulePath, version, secs)
 		}
+		response, _, err = s.runGovulncheckLoadable(ctx, modulePath, inputPath, mode, "", patterns)
 		if response != nil {
 			log.Debugf(ctx, "govulncheck stats: %dkb | %vs", response.Stats.ScanMemory, response.Stats.ScanSeconds)
 		}
 		return err
 	})
-	return response, err
+	return response, importsOnly, err
+}
+
+// runGovulncheck runs govulncheck on the packages matching patterns in
+// the module at inputPath at the given scan level, in the sandbox
+// unless s.insecure is true.
+func (s *scanner) runGovulncheck(ctx context.Context, inputPath, mode, scanLevel string, patterns []string) (_ *govulncheck.AnalysisResponse, err error) {
+	ctx, end := startStage(ctx, stageSandboxRun)
+	defer func() { end(err) }()
+	if s.insecure {
+		return s.runGovulncheckScanInsecure(ctx, inputPath, scanLevel, patterns)
+	}
+	return s.runGovulncheckScanSandbox(ctx, inputPath, mode, scanLevel, patterns)
+}
+
+// importsVulnerablePackage reports whether response has a finding
+// at the package or symbol level.
+func importsVulnerablePackage(response *govulncheck.AnalysisResponse) bool {
+	for _, f := range response.Findings {
+		if len(f.Trace) > 0 && f.Trace[0].Package != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// monitorMemory stops commands started with the returned context
+// if the container uses more than s.memoryLimit.
+// The returned function must be called when the scan is done.
+func (s *scanner) monitorMemory(ctx context.Context) (context.Context, func()) {
+	if s.memoryLimit == 0 {
+		return ctx, func() {}
+	}
+	return monitorMemory(ctx, s.memoryLimit, memoryCheckInterval, cgroupMemoryUsage)
 }
 
-func (s *scanner) runGovulncheckScanSandbox(ctx context.Context, inputPath, mode string) (_ *govulncheck.AnalysisResponse, err error) {
+func (s *scanner) runGovulncheckScanSandbox(ctx context.Context, inputPath, mode, scanLevel string, patterns []string) (_ *govulncheck.AnalysisResponse, err error) {
 	smdir := strings.TrimPrefix(inputPath, sandboxRoot)
 	err = s.sbox.Validate()
 	log.Debugf(ctx, "sandbox Validate returned %v", err)
 
-	return s.runGovulncheckSandbox(ctx, mode, smdir)
+	return s.runGovulncheckSandbox(ctx, mode, scanLevel, patterns, smdir)
 }
 
-func (s *scanner) runGovulncheckSandbox(ctx context.Context, mode, arg string) (*govulncheck.AnalysisResponse, error) {
+func (s *scanner) runGovulncheckSandbox(ctx context.Context, mode, scanLevel string, patterns []string, arg string) (*govulncheck.AnalysisResponse, error) {
 	goOut, err := s.sbox.Command("/usr/local/go/bin/go", "version").Output()
 	if err != nil {
 		log.Debugf(ctx, "running go version error: %v", err)
 	} else {
 		log.Debugf(ctx, "Sandbox running %s", goOut)
 	}
-	log.Infof(ctx, "running govulncheck in sandbox: mode %s, arg %q", mode, arg)
+	log.Infof(ctx, "running govulncheck in sandbox: mode %s, scan level %q, patterns %q, arg %q", mode, scanLevel, patterns, arg)
 	// currently, only source analysis is done in govulncheck_sandbox (binary is done elsewhere)
-	cmd := s.sbox.Command(filepath.Join(s.binaryDir, "govulncheck_sandbox"), s.govulncheckPath, govulncheck.FlagSource, arg, s.vulnDBDir)
-	stdout, err := cmd.Output()
+	args := []string{s.govulncheckPath, govulncheck.FlagSource, arg, s.sandboxVulnDBDir(), scanLevel, strings.Join(patterns, ",")}
+	cmd := s.sbox.CommandContext(ctx, filepath.Join(s.binaryDir, "govulncheck_sandbox"), args...)
+	stdout, _, err := cmd.RunStreaming(logStderr(ctx, arg))
 	log.Infof(ctx, "govulncheck in sandbox finished with err=%v", err)
 	if err != nil {
-		return nil, errors.New(derrors.IncludeStderr(err))
+		return nil, sandboxError(err)
 	}
 	return govulncheck.UnmarshalAnalysisResponse(stdout)
 }
 
+// sandboxVulnDBDir returns the directory of the vuln DB inside the sandbox.
+// Snapshots are downloaded under the sandbox root; the worker's own DB
+// is at the same path inside and outside.
+func (s *scanner) sandboxVulnDBDir() string {
+	return strings.TrimPrefix(s.vulnDBDir, sandboxRoot)
+}
+
 func (s *scanner) runGovulncheckCompareSandbox(ctx context.Context, arg string) (*govulncheck.CompareResponse, error) {
-	cmd := s.sbox.Command(filepath.Join(s.binaryDir, "govulncheck_compare"), s.govulncheckPath, arg, s.vulnDBDir)
+	cmd := s.sbox.CommandContext(ctx, filepath.Join(s.binaryDir, "govulncheck_compare"), s.govulncheckPath, arg, s.sandboxVulnDBDir())
 	log.Infof(ctx, "running govulncheck_compare: arg %q", arg)
-	stdout, err := cmd.Output()
+	stdout, _, err := cmd.RunStreaming(logStderr(ctx, arg))
 	log.Infof(ctx, "govulncheck_compare in sandbox finished with err=%v", err)
 	if err != nil {
-		return nil, errors.New(derrors.IncludeStderr(err))
+		return nil, sandboxError(err)
 	}
 	return govulncheck.UnmarshalCompareResponse(stdout)
 }
 
-func (s *scanner) runGovulncheckScanInsecure(inputPath, mode string) (_ *govulncheck.AnalysisResponse, err error) {
+func (s *scanner) runGovulncheckScanInsecure(ctx context.Context, inputPath, scanLevel string, patterns []string) (_ *govulncheck.AnalysisResponse, err error) {
 	// currently, only source analysis is done individually (binary is done in compare mode)
-	return govulncheck.RunGovulncheckCmd(s.govulncheckPath, govulncheck.FlagSource, "./...", inputPath, s.vulnDBDir)
+	progress := logWriter(logStderr(ctx, inputPath))
+	return govulncheck.RunGovulncheckCmd(ctx, progress, s.govulncheckPath, govulncheck.FlagSource, scanLevel, patterns, inputPath, s.vulnDBDir)
 }
 
 func isGovulncheckLoadError(err error) bool {
@@ -5,17 +5,28 @@
 package worker
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"net/http/httptest"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
+	"golang.org/x/exp/event"
+	"golang.org/x/pkgsite-metrics/internal/bigquery"
 	"golang.org/x/pkgsite-metrics/internal/buildtest"
+	"golang.org/x/pkgsite-metrics/internal/config"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
 	"golang.org/x/pkgsite-metrics/internal/govulncheck"
 	"golang.org/x/pkgsite-metrics/internal/govulncheckapi"
+	"golang.org/x/pkgsite-metrics/internal/proxy/proxytest"
+	"golang.org/x/pkgsite-metrics/internal/queue"
+	"golang.org/x/pkgsite-metrics/internal/scan"
 )
 
 func TestAsScanError(t *testing.T) {
@@ -62,6 +73,143 @@ func TestVulnsForMode(t *testing.T) {
 	}
 }
 
+func TestVulnsForModeShortestStack(t *testing.T) {
+	findings := []*govulncheckapi.Finding{
+		{OSV: "V", Trace: []*govulncheckapi.Frame{
+			{Module: "M", Package: "P", Function: "F"},
+			{Module: "A", Package: "A", Function: "G"},
+			{Module: "A", Package: "A", Function: "main"},
+		}},
+		{OSV: "V", Trace: []*govulncheckapi.Frame{
+			{Module: "M", Package: "P", Function: "F"},
+			{Module: "A", Package: "A", Function: "main"},
+		}},
+	}
+	vs := vulnsForScanMode(&govulncheck.AnalysisResponse{Findings: findings}, scanModeSourceSymbol)
+	if len(vs) != 1 {
+		t.Fatalf("got %d vulns, want 1", len(vs))
+	}
+	if got, want := len(vs[0].CallStack), 2; got != want {
+		t.Errorf("got call stack of length %d, want %d", got, want)
+	}
+}
+
+func TestCombinedVulns(t *testing.T) {
+	findings := []*govulncheckapi.Finding{
+		{OSV: "V1", Trace: []*govulncheckapi.Frame{{Module: "M1"}}},
+		{OSV: "V1", Trace: []*govulncheckapi.Frame{{Module: "M1", Package: "P1"}}},
+		{OSV: "V1", Trace: []*govulncheckapi.Frame{{Module: "M1", Package: "P2"}}},
+		{OSV: "V1", Trace: []*govulncheckapi.Frame{
+			{Module: "M1", Package: "P1", Function: "F"},
+			{Module: "A", Package: "A", Function: "main"},
+		}},
+		{OSV: "V2", Trace: []*govulncheckapi.Frame{{Module: "M2"}}},
+	}
+	var got []string
+	for _, v := range combinedVulns(&govulncheck.AnalysisResponse{Findings: findings}) {
+		got = append(got, fmt.Sprintf("%s %s imported=%t called=%t stack=%d",
+			v.ID, v.PackagePath, v.Imported.Bool, v.Called.Bool, len(v.CallStack)))
+	}
+	want := []string{
+		"V1 P1 imported=true called=true stack=2",
+		"V1 P2 imported=true called=false stack=0",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got  %q\nwant %q", got, want)
+	}
+}
+
+func TestImportsVulnerablePackage(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		trace []*govulncheckapi.Frame
+		want  bool
+	}{
+		{"module", []*govulncheckapi.Frame{{Module: "M"}}, false},
+		{"package", []*govulncheckapi.Frame{{Module: "M", Package: "P"}}, true},
+		{"symbol", []*govulncheckapi.Frame{{Module: "M", Package: "P", Function: "F"}}, true},
+	} {
+		resp := &govulncheck.AnalysisResponse{Findings: []*govulncheckapi.Finding{{Trace: tc.trace}}}
+		if got := importsVulnerablePackage(resp); got != tc.want {
+			t.Errorf("%s: got %t, want %t", tc.name, got, tc.want)
+		}
+	}
+	if importsVulnerablePackage(&govulncheck.AnalysisResponse{}) {
+		t.Error("no findings: got true, want false")
+	}
+}
+
+func TestClassifyScanError(t *testing.T) {
+	for _, test := range []struct {
+		err  string
+		want string
+	}{
+		{
+			"running container: creating container: cannot create sandbox: cannot read client sync file: waiting for sandbox to start: EOF",
+			"SANDBOX START",
+		},
+		{
+			"starting container: exit status 128: OCI runtime error",
+			"SANDBOX START",
+		},
+		{
+			"fork/exec /usr/local/bin/runsc: no such file or directory",
+			"SANDBOX START",
+		},
+		{
+			`bad module: 'go mod download' for example.com/m@v1.0.0 returned exit status 1: go: example.com/dep@v1.2.0: Get "https://proxy.golang.org/cached-only/example.com/dep/@v/v1.2.0.mod": dial tcp: lookup proxy.golang.org on 169.254.169.254:53: i/o timeout`,
+			"MOD DOWNLOAD",
+		},
+		{
+			"go: golang.org/x/text@v0.3.0: read tcp 10.0.0.2:45678->142.250.1.141:443: read: connection reset by peer",
+			"MOD DOWNLOAD",
+		},
+		{
+			"write /tmp/modules/example.com/m@v1.0.0/testdata/big.bin: no space left on device",
+			"DISK SPACE",
+		},
+		{
+			`copyToFile("/bundle/rootfs/binaries/govulncheck", "govulncheck"): storage: object doesn't exist`,
+			"GCS NOT FOUND",
+		},
+		{
+			// A dependency on a host that is gone is a problem with the module.
+			`govulncheck: loading packages: go: example.com/dep@v1.0.0: unrecognized import path "gone.example.com/dep": https fetch: Get "https://gone.example.com/dep?go-get=1": dial tcp: lookup gone.example.com: no such host`,
+			"LOAD",
+		},
+		{
+			"govulncheck: loading packages: context deadline exceeded",
+			"TIMEOUT",
+		},
+		{
+			"go: example.com/dep@v1.0.0: reading https://proxy.golang.org/cached-only/example.com/dep/@v/v1.0.0.mod: 404 Not Found\n\tserver response: temporarily unavailable",
+			"PROXY",
+		},
+		{
+			"govulncheck: loading packages: There are errors with the provided package patterns",
+			"LOAD",
+		},
+		{
+			"sandbox: exit status 137",
+			"SANDBOX MISC",
+		},
+		{
+			"govulncheck: unexpected error",
+			"VULNCHECK - MISC",
+		},
+	} {
+		err := classifyScanError(errors.New(test.err))
+		if got := derrors.CategorizeError(err); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.err, got, test.want)
+		}
+	}
+	// Errors already classified keep their category.
+	err := classifyScanError(fmt.Errorf("gcs: %w", derrors.GCSReadError))
+	if got, want := derrors.CategorizeError(err), "GCS READ"; got != want {
+		t.Errorf("wrapped GCSReadError: got %q, want %q", got, want)
+	}
+}
+
 func TestUnrecoverableError(t *testing.T) {
 	for _, e := range []struct {
 		ec   string
@@ -77,6 +225,105 @@ func TestUnrecoverableError(t *testing.T) {
 	}
 }
 
+func TestCanSkipPerMode(t *testing.T) {
+	ctx := context.Background()
+	wv := &govulncheck.WorkVersion{
+		GoVersion:        "go1.21.0",
+		WorkerVersion:    "1",
+		SchemaVersion:    "s",
+		WorkerGoVersion:  bigquery.NullString("go1.21.0"),
+		SandboxGoVersion: bigquery.NullString("go1.21.0"),
+	}
+	s := &scanner{workVersion: wv}
+	// A fake work state store.
+	states := map[string]*govulncheck.WorkState{}
+	key := func(modulePath, version, mode string) string { return modulePath + "@" + version + " " + mode }
+	get := func(_ context.Context, modulePath, version, mode string) (*govulncheck.WorkState, error) {
+		return states[key(modulePath, version, mode)], nil
+	}
+
+	modules := []string{"example.com/a", "example.com/b"}
+	scans := 0
+	// Enqueue every module in every mode, twice.
+	for i := 0; i < 2; i++ {
+		for _, mode := range []string{ModeGovulncheck, ModeCompare} {
+			for _, m := range modules {
+				sreq := &govulncheck.Request{
+					ModuleURLPath: scan.ModuleURLPath{Module: m, Version: "v1.0.0"},
+					QueryParams:   govulncheck.QueryParams{Mode: mode},
+				}
+				skip, err := s.canSkip(ctx, sreq, get)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !skip {
+					scans++
+					states[key(m, "v1.0.0", mode)] = &govulncheck.WorkState{WorkVersion: wv}
+				}
+			}
+		}
+	}
+	// Each module is scanned once per mode.
+	if want := len(modules) * 2; scans != want {
+		t.Errorf("got %d scans, want %d", scans, want)
+	}
+}
+
+func TestBatchScanTimeout(t *testing.T) {
+	mcs, err := config.LoadModeConfigs(context.Background(), `{
+		"COMBINED": {"dispatch_deadline": "10m"},
+		"COMPARE": {"dispatch_deadline": "2m"}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &GovulncheckServer{Server: &Server{cfg: &config.Config{ScanTimeout: 10 * time.Minute}, modeConfigs: mcs}}
+	batch := func(mode string, n int) *govulncheck.BatchRequest {
+		return &govulncheck.BatchRequest{
+			Modules:     make([]scan.ModuleSpec, n),
+			QueryParams: govulncheck.QueryParams{Mode: mode},
+		}
+	}
+	for _, test := range []struct {
+		breq *govulncheck.BatchRequest
+		want time.Duration
+	}{
+		// Without a deadline for the mode, a batch task has the longest one.
+		{batch("", 5), (queue.MaxCloudTasksTimeout - taskOverhead) / 5},
+		{batch(ModeGovulncheck, 5), (queue.MaxCloudTasksTimeout - taskOverhead) / 5},
+		// The scans of a batch fit in the mode's deadline.
+		{batch(ModeCombined, 5), time.Minute},
+		// A deadline shorter than the overhead leaves half of it to the scans.
+		{batch(ModeCompare, 2), 30 * time.Second},
+	} {
+		if got := h.batchScanTimeout(test.breq); got != test.want {
+			t.Errorf("%q, %d modules: got %s, want %s", test.breq.Mode, len(test.breq.Modules), got, test.want)
+		}
+	}
+}
+
+func TestScanErrorMetric(t *testing.T) {
+	// A proxy without the module, so the scan fails with a proxy error.
+	proxyClient, cleanup := proxytest.SetupTestClient(t, nil)
+	defer cleanup()
+	s := &scanner{proxyClient: proxyClient, workVersion: &govulncheck.WorkVersion{}}
+
+	rec := &eventRecorder{}
+	ctx := event.WithExporter(context.Background(), event.NewExporter(rec, nil))
+	ctx = startScan(ctx, "example.com/m", "v1.0.0", ModeGovulncheck)
+	sreq := &govulncheck.Request{
+		ModuleURLPath: scan.ModuleURLPath{Module: "example.com/m", Version: "v1.0.0"},
+		QueryParams:   govulncheck.QueryParams{Mode: ModeGovulncheck, Serve: true},
+	}
+	if _, err := s.ScanModule(ctx, httptest.NewRecorder(), sreq); err != nil {
+		t.Fatal(err)
+	}
+	want := "metric metric=govulncheck-scan-errors category=PROXY mode=GOVULNCHECK"
+	if !slices.Contains(rec.events, want) {
+		t.Errorf("events do not contain %q:\n%s", want, strings.Join(rec.events, "\n"))
+	}
+}
+
 // TODO: can we have a test for sandbox? We do test the sandbox
 // and unmarshalling in cmd/govulncheck_sandbox, so what would be
 // left here is checking that runsc is initiated properly. It is
@@ -98,7 +345,7 @@ func TestRunScanModuleInsecure(t *testing.T) {
 
 	s := &scanner{insecure: true, govulncheckPath: govulncheckPath, vulnDBDir: vulndb}
 
-	response, err := s.runGovulncheckScanInsecure("../testdata/module", ModeGovulncheck)
+	response, err := s.runGovulncheckScanInsecure(context.Background(), "../testdata/module", "", []string{govulncheck.DefaultPackagePattern})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,251 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/govulncheck"
+	"golang.org/x/pkgsite-metrics/internal/log"
+	"golang.org/x/pkgsite-metrics/internal/scan"
+)
+
+// skipListObject is the name of the object in the binary bucket
+// that holds the list of modules that govulncheck should not scan.
+const skipListObject = "govulncheck/skip.json"
+
+// skipListRefresh is how often the skip list is re-read.
+const skipListRefresh = 10 * time.Minute
+
+// A skipEntry describes a module that should not be scanned,
+// typically because scanning it wedges the scanner.
+type skipEntry struct {
+	Module  string
+	Reason  string
+	Expires time.Time // if zero, the entry never expires
+}
+
+func (e *skipEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+// A skipList is a cached list of modules to skip.
+type skipList struct {
+	load func(context.Context) ([]*skipEntry, error) // reads the entries
+
+	// loadMu is held while the entries are read, so that only one
+	// caller reads them at a time. mu is never held while reading,
+	// so callers with fresh entries don't wait for a slow read.
+	loadMu sync.Mutex
+
+	mu       sync.Mutex
+	entries  map[string]*skipEntry // by module path
+	loadedAt time.Time
+}
+
+// newSkipList returns a skipList whose entries are read from obj.
+// If obj is nil, the list is always empty.
+func newSkipList(obj *storage.ObjectHandle) *skipList {
+	return &skipList{load: func(ctx context.Context) ([]*skipEntry, error) {
+		if obj == nil {
+			return nil, nil
+		}
+		entries, _, err := readSkipEntries(ctx, obj)
+		return entries, err
+	}}
+}
+
+// reason returns the reason modulePath should be skipped, and whether
+// it should be. The entries are re-read if they are older than
+// skipListRefresh. If they cannot be read, the old entries are used.
+func (l *skipList) reason(ctx context.Context, modulePath string) (string, bool) {
+	now := time.Now()
+	if l.stale(now) {
+		l.refresh(ctx, false)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[modulePath]
+	if !ok || e.expired(now) {
+		return "", false
+	}
+	return e.Reason, true
+}
+
+// stale reports whether the entries are older than skipListRefresh.
+func (l *skipList) stale(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return now.Sub(l.loadedAt) >= skipListRefresh
+}
+
+// refresh re-reads the entries. Unless force is true, it does nothing
+// if another caller refreshed them while this one waited to.
+func (l *skipList) refresh(ctx context.Context, force bool) {
+	l.loadMu.Lock()
+	defer l.loadMu.Unlock()
+	if !force && !l.stale(time.Now()) {
+		return
+	}
+	entries, err := l.load(ctx)
+	if err != nil {
+		log.Errorf(ctx, err, "reading govulncheck skip list; using previous entries")
+		return
+	}
+	m := map[string]*skipEntry{}
+	for _, e := range entries {
+		m[e.Module] = e
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = m
+	l.loadedAt = time.Now()
+}
+
+// refreshNow re-reads the entries.
+func (l *skipList) refreshNow(ctx context.Context) {
+	l.refresh(ctx, true)
+}
+
+// invalidate causes the entries to be re-read on next use.
+func (l *skipList) invalidate() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.loadedAt = time.Time{}
+}
+
+// readSkipEntries reads the skip list from obj, returning the entries
+// and the generation of the object. If the object does not exist,
+// it returns no entries and a generation of zero.
+func readSkipEntries(ctx context.Context, obj *storage.ObjectHandle) (_ []*skipEntry, gen int64, err error) {
+	defer derrors.Wrap(&err, "readSkipEntries")
+	r, err := obj.NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	var entries []*skipEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, 0, err
+	}
+	return entries, r.Attrs.Generation, nil
+}
+
+// writeSkipped writes results for a module that is on the skip list,
+// so that it is visible that the module was not scanned.
+func (s *scanner) writeSkipped(ctx context.Context, w http.ResponseWriter, sreq *govulncheck.Request, reason string) error {
+	baseRow := &govulncheck.Result{
+		ModulePath:  sreq.Module,
+		Version:     sreq.Version,
+		Suffix:      sreq.Suffix,
+		ImportedBy:  sreq.ImportedBy,
+		WorkVersion: *s.workVersion,
+	}
+	baseRow.InstanceID, baseRow.TaskRetryCount, baseRow.TaskExecutionCount = runColumns(s.instanceID, sreq.Attempt)
+	rows := createRows(sreq.Mode, func(sm string) *govulncheck.Result {
+		row := *baseRow
+		row.ScanMode = sm
+		row.AddError(fmt.Errorf("%w: %s", derrors.ScanModuleSkipped, reason))
+		return &row
+	})
+	return writeResults(ctx, sreq.Serve, w, s.rows, govulncheck.TableName, rows)
+}
+
+// addSkipEntry adds e to the skip list in obj. The write fails
+// if the object was changed after it was read.
+func addSkipEntry(ctx context.Context, obj *storage.ObjectHandle, e *skipEntry) (err error) {
+	defer derrors.Wrap(&err, "addSkipEntry(%q)", e.Module)
+	entries, gen, err := readSkipEntries(ctx, obj)
+	if err != nil {
+		return err
+	}
+	entries = mergeSkipEntry(entries, e, time.Now())
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(entries); err != nil {
+		return err
+	}
+	cond := storage.Conditions{GenerationMatch: gen}
+	if gen == 0 {
+		cond = storage.Conditions{DoesNotExist: true}
+	}
+	w := obj.If(cond).NewWriter(ctx)
+	w.ContentType = "application/json"
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// mergeSkipEntry returns entries with e added, replacing any entry
+// for the same module. Expired entries are removed.
+func mergeSkipEntry(entries []*skipEntry, e *skipEntry, now time.Time) []*skipEntry {
+	var res []*skipEntry
+	for _, old := range entries {
+		if old.Module != e.Module && !old.expired(now) {
+			res = append(res, old)
+		}
+	}
+	return append(res, e)
+}
+
+// skipParams are the parameters of govulncheck/skip.
+type skipParams struct {
+	Module  string // module path to skip
+	Reason  string // why the module is skipped
+	Expires string // duration after which the entry expires; if empty, never
+}
+
+// handleSkip adds a module to the skip list.
+//
+// govulncheck/skip?module=M&reason=R[&expires=720h]
+func (h *GovulncheckServer) handleSkip(w http.ResponseWriter, r *http.Request) (err error) {
+	defer derrors.Wrap(&err, "handleSkip")
+	ctx := r.Context()
+
+	if h.skipObject == nil {
+		return &serverError{err: errors.New("no binary bucket for skip list"), status: http.StatusNotImplemented}
+	}
+	var params skipParams
+	if err := scan.ParseParams(r, &params); err != nil {
+		return fmt.Errorf("%w: %v", derrors.InvalidArgument, err)
+	}
+	if params.Module == "" || params.Reason == "" {
+		return fmt.Errorf("%w: need module and reason", derrors.InvalidArgument)
+	}
+	e := &skipEntry{Module: params.Module, Reason: params.Reason}
+	if params.Expires != "" {
+		d, err := time.ParseDuration(params.Expires)
+		if err != nil {
+			return fmt.Errorf("%w: expires: %v", derrors.InvalidArgument, err)
+		}
+		e.Expires = time.Now().Add(d)
+	}
+	if err := addSkipEntry(ctx, h.skipObject, e); err != nil {
+		return err
+	}
+	h.skipList.invalidate()
+	log.Infof(ctx, "added %s to govulncheck skip list: %s", e.Module, e.Reason)
+	return writeJSON(w, e)
+}
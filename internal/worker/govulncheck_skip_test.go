@@ -0,0 +1,101 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSkipList(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	entries := []*skipEntry{
+		{Module: "m1", Reason: "wedges"},
+		{Module: "m2", Reason: "expired", Expires: now.Add(-time.Hour)},
+		{Module: "m3", Reason: "not yet expired", Expires: now.Add(time.Hour)},
+	}
+	var loadErr error
+	loads := 0
+	l := &skipList{load: func(context.Context) ([]*skipEntry, error) {
+		loads++
+		return entries, loadErr
+	}}
+
+	for _, test := range []struct {
+		module     string
+		wantReason string
+		wantSkip   bool
+	}{
+		{"m1", "wedges", true},
+		{"m2", "", false},
+		{"m3", "not yet expired", true},
+		{"m4", "", false},
+	} {
+		reason, skip := l.reason(ctx, test.module)
+		if reason != test.wantReason || skip != test.wantSkip {
+			t.Errorf("%s: got (%q, %t), want (%q, %t)", test.module, reason, skip, test.wantReason, test.wantSkip)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("got %d loads, want 1", loads)
+	}
+
+	// After invalidation, a failed load keeps the previous entries.
+	l.invalidate()
+	loadErr = errors.New("bad")
+	if _, skip := l.reason(ctx, "m1"); !skip {
+		t.Error("after failed load: m1 not skipped")
+	}
+	if loads != 2 {
+		t.Errorf("got %d loads, want 2", loads)
+	}
+}
+
+func TestSkipListSlowLoad(t *testing.T) {
+	ctx := context.Background()
+	release := make(chan struct{})
+	blocked := false
+	l := &skipList{load: func(context.Context) ([]*skipEntry, error) {
+		if blocked {
+			<-release
+		}
+		return []*skipEntry{{Module: "m1", Reason: "wedges"}}, nil
+	}}
+	l.refreshNow(ctx)
+
+	// While a refresh is stuck reading, lookups use the current entries.
+	blocked = true
+	done := make(chan struct{})
+	go func() {
+		l.refreshNow(ctx)
+		close(done)
+	}()
+	if _, skip := l.reason(ctx, "m1"); !skip {
+		t.Error("during refresh: m1 not skipped")
+	}
+	close(release)
+	<-done
+}
+
+func TestMergeSkipEntry(t *testing.T) {
+	now := time.Now()
+	entries := []*skipEntry{
+		{Module: "m1", Reason: "old"},
+		{Module: "m2", Reason: "expired", Expires: now.Add(-time.Hour)},
+		{Module: "m3", Reason: "keep"},
+	}
+	got := mergeSkipEntry(entries, &skipEntry{Module: "m1", Reason: "new"}, now)
+	var gotStrs []string
+	for _, e := range got {
+		gotStrs = append(gotStrs, e.Module+":"+e.Reason)
+	}
+	want := []string{"m3:keep", "m1:new"}
+	if len(gotStrs) != len(want) || gotStrs[0] != want[0] || gotStrs[1] != want[1] {
+		t.Errorf("got %v, want %v", gotStrs, want)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/govulncheck"
+	"golang.org/x/pkgsite-metrics/internal/log"
+	"google.golang.org/api/iterator"
+)
+
+// vulnDBSnapshotDir is the directory where vuln DB snapshots are
+// downloaded. It is under the sandbox root, so that they are visible
+// inside the sandbox.
+var vulnDBSnapshotDir = filepath.Join(sandboxRoot, "vulndb")
+
+// A vulnDBSnapshot is a local copy of a vuln DB snapshot.
+type vulnDBSnapshot struct {
+	dir          string    // local directory of the DB
+	lastModified time.Time // as computed by dbLastModified
+}
+
+// vulnDBSnapshots downloads vuln DB snapshots, keeping each one
+// for the life of the process, so that every scan in a corpus-wide
+// run that names the same snapshot uses the same DB.
+type vulnDBSnapshots struct {
+	root     string                                           // directory holding the snapshots
+	download func(ctx context.Context, uri, dir string) error // copies the snapshot at uri to dir
+
+	mu    sync.Mutex
+	snaps map[string]*vulnDBSnapshot // by URI
+}
+
+func newVulnDBSnapshots() *vulnDBSnapshots {
+	return &vulnDBSnapshots{root: vulnDBSnapshotDir, download: downloadVulnDB}
+}
+
+// get returns the local copy of the snapshot at uri, downloading it
+// if necessary. Concurrent calls wait for a single download.
+func (v *vulnDBSnapshots) get(ctx context.Context, uri string) (_ *vulnDBSnapshot, err error) {
+	defer derrors.Wrap(&err, "vulnDBSnapshots.get(%q)", uri)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s, ok := v.snaps[uri]; ok {
+		return s, nil
+	}
+	dir := filepath.Join(v.root, fmt.Sprintf("%x", sha256.Sum256([]byte(uri)))[:16])
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	// Download to a temporary directory, so that a failed
+	// download never leaves a partial DB in dir.
+	if err := os.MkdirAll(v.root, 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.MkdirTemp(v.root, "download-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	if err := v.download(ctx, uri, tmp); err != nil {
+		return nil, err
+	}
+	lmt, err := dbLastModified(tmp)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s is not a vuln DB: %v", derrors.InvalidArgument, uri, err)
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return nil, err
+	}
+	s := &vulnDBSnapshot{dir: dir, lastModified: lmt}
+	if v.snaps == nil {
+		v.snaps = map[string]*vulnDBSnapshot{}
+	}
+	v.snaps[uri] = s
+	log.Infof(ctx, "downloaded vuln DB snapshot %s to %s; last modified %s", uri, dir, lmt)
+	return s, nil
+}
+
+// downloadVulnDB copies the objects under the GCS location uri,
+// of the form gs://BUCKET/PATH, to dir.
+func downloadVulnDB(ctx context.Context, uri, dir string) (err error) {
+	defer derrors.Wrap(&err, "downloadVulnDB(%q)", uri)
+	bucketName, prefix, err := govulncheck.ParseVulnDB(uri)
+	if err != nil {
+		return fmt.Errorf("%w: %v", derrors.InvalidArgument, err)
+	}
+	c, err := storage.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	bucket := c.Bucket(bucketName)
+	n := 0
+	it := bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(attrs.Name, prefix)
+		if name == "" || strings.HasSuffix(name, "/") {
+			continue
+		}
+		if err := copyObject(ctx, bucket.Object(attrs.Name), filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			return err
+		}
+		n++
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: no objects", derrors.NotFound)
+	}
+	return nil
+}
+
+// copyObject copies the contents of obj to the file at path.
+func copyObject(ctx context.Context, obj *storage.ObjectHandle, path string) (err error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	r, err := obj.NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer derrors.Cleanup(&err, f.Close)
+	_, err = io.Copy(f, r)
+	return err
+}
+
+// useVulnDBSnapshot makes s scan with the vuln DB snapshot at uri.
+// The work version of s records when the snapshot was last modified,
+// so results are only reused for scans with the same DB.
+func (s *scanner) useVulnDBSnapshot(ctx context.Context, snaps *vulnDBSnapshots, uri string) error {
+	snap, err := snaps.get(ctx, uri)
+	if err != nil {
+		return err
+	}
+	wv := *s.workVersion
+	wv.VulnDBLastModified = snap.lastModified
+	s.workVersion = &wv
+	s.vulnDBDir = snap.dir
+	return nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/pkgsite-metrics/internal/govulncheck"
+)
+
+func TestVulnDBSnapshots(t *testing.T) {
+	ctx := context.Background()
+	downloads := 0
+	var downloadErr error
+	v := &vulnDBSnapshots{
+		root: t.TempDir(),
+		download: func(_ context.Context, uri, dir string) error {
+			downloads++
+			if downloadErr != nil {
+				return downloadErr
+			}
+			if err := os.MkdirAll(filepath.Join(dir, "index"), 0755); err != nil {
+				return err
+			}
+			return os.WriteFile(filepath.Join(dir, "index", "db.json"), []byte(`{"modified":"2023-04-03T00:00:00Z"}`), 0644)
+		},
+	}
+	want := time.Date(2023, 4, 3, 0, 0, 0, 0, time.UTC)
+
+	snap, err := v.get(ctx, "gs://b/snap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !snap.lastModified.Equal(want) {
+		t.Errorf("got last modified %s, want %s", snap.lastModified, want)
+	}
+	if _, err := os.Stat(filepath.Join(snap.dir, "index", "db.json")); err != nil {
+		t.Error(err)
+	}
+	if _, err := v.get(ctx, "gs://b/snap"); err != nil {
+		t.Fatal(err)
+	}
+	if downloads != 1 {
+		t.Errorf("got %d downloads, want 1", downloads)
+	}
+
+	// Failed downloads are not cached.
+	downloadErr = errors.New("bad")
+	if _, err := v.get(ctx, "gs://b/other"); err == nil {
+		t.Error("got nil error, want error")
+	}
+	downloadErr = nil
+	if _, err := v.get(ctx, "gs://b/other"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A scanner using the snapshot records its last modified time.
+	s := &scanner{workVersion: &govulncheck.WorkVersion{GoVersion: "go1.21"}, vulnDBDir: "/app/go-vulndb"}
+	if err := s.useVulnDBSnapshot(ctx, v, "gs://b/snap"); err != nil {
+		t.Fatal(err)
+	}
+	if !s.workVersion.VulnDBLastModified.Equal(want) || s.workVersion.GoVersion != "go1.21" {
+		t.Errorf("got work version %+v", s.workVersion)
+	}
+	if s.vulnDBDir != snap.dir {
+		t.Errorf("got vuln DB dir %q, want %q", s.vulnDBDir, snap.dir)
+	}
+}
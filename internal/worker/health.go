@@ -0,0 +1,126 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Handlers for health checks.
+//
+// healthz		report that the server is running
+// readyz		report whether the server can reach its dependencies
+
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/pkgsite-metrics/internal/log"
+)
+
+// readinessTimeout bounds the time of each check performed by /readyz.
+const readinessTimeout = 5 * time.Second
+
+// Module and version used to check that the proxy is reachable.
+const (
+	readinessModule  = "golang.org/x/mod"
+	readinessVersion = "v0.1.0"
+)
+
+// A readinessCheck checks that a single dependency of the worker is usable.
+type readinessCheck struct {
+	name  string
+	check func(context.Context) error
+}
+
+// handleHealthz reports that the server is alive. It does not check
+// any dependencies.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) error {
+	fmt.Fprintln(w, "ok")
+	return nil
+}
+
+// handleReadyz checks the dependencies of the server and writes a JSON map
+// from each dependency to "ok" or the error of its check.
+// If any check fails, the response status is 503.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) error {
+	results, ok := runReadinessChecks(r.Context(), s.readinessChecks())
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		log.Warnf(r.Context(), "readiness checks failed: %v", results)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return writeJSON(w, results)
+}
+
+// readinessChecks returns the checks performed by /readyz.
+func (s *Server) readinessChecks() []readinessCheck {
+	checks := []readinessCheck{
+		{"proxy", func(ctx context.Context) error {
+			_, err := s.proxyClient.Info(ctx, readinessModule, readinessVersion)
+			return err
+		}},
+		{"vulndb", func(context.Context) error {
+			_, err := dbLastModified(s.cfg.VulnDBDir)
+			return err
+		}},
+	}
+	if s.bqClient != nil {
+		checks = append(checks, readinessCheck{"bigquery", func(ctx context.Context) error {
+			_, err := s.bqClient.Dataset().Metadata(ctx)
+			return err
+		}})
+	}
+	if s.cfg.BinaryBucket != "" {
+		checks = append(checks, readinessCheck{"bucket", func(ctx context.Context) error {
+			c, err := storage.NewClient(ctx)
+			if err != nil {
+				return err
+			}
+			defer c.Close()
+			_, err = c.Bucket(s.cfg.BinaryBucket).Attrs(ctx)
+			return err
+		}})
+	}
+	return checks
+}
+
+// runReadinessChecks runs checks concurrently, each with a timeout of
+// readinessTimeout. It returns a map from check name to "ok" or the
+// check's error, and whether all checks succeeded.
+func runReadinessChecks(ctx context.Context, checks []readinessCheck) (map[string]string, bool) {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = map[string]string{}
+		ok      = true
+	)
+	for _, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+			defer cancel()
+			err := c.check(ctx)
+			if err == nil && ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if errors.Is(err, context.DeadlineExceeded) {
+					err = fmt.Errorf("timed out after %s: %w", readinessTimeout, err)
+				}
+				results[c.name] = err.Error()
+				ok = false
+			} else {
+				results[c.name] = "ok"
+			}
+		}()
+	}
+	wg.Wait()
+	return results, ok
+}
@@ -0,0 +1,35 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRunReadinessChecks(t *testing.T) {
+	ctx := context.Background()
+	succeed := func(context.Context) error { return nil }
+	fail := func(context.Context) error { return errors.New("unreachable") }
+
+	got, ok := runReadinessChecks(ctx, []readinessCheck{{"a", succeed}, {"b", succeed}})
+	if !ok {
+		t.Error("all succeeded: got ok=false")
+	}
+	if want := map[string]string{"a": "ok", "b": "ok"}; !cmp.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	got, ok = runReadinessChecks(ctx, []readinessCheck{{"a", succeed}, {"b", fail}})
+	if ok {
+		t.Error("one failed: got ok=true")
+	}
+	if want := map[string]string{"a": "ok", "b": "unreachable"}; !cmp.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
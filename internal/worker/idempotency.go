@@ -0,0 +1,120 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"time"
+
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/fstore"
+	"golang.org/x/pkgsite-metrics/internal/log"
+	"golang.org/x/pkgsite-metrics/internal/queue"
+)
+
+// Cloud Tasks delivers a task at least once, and retries it if the
+// handler fails or takes too long, even after the handler uploaded some
+// of its rows. To avoid duplicate rows, a task records each scan whose
+// rows it uploaded, and its retries skip the scans recorded by earlier
+// attempts.
+
+// completedTasksCollection is the Firestore collection of the records
+// of completed scans.
+const completedTasksCollection = "CompletedTasks"
+
+// completedTaskTTL is how long a completed scan is remembered. It is
+// much longer than Cloud Tasks keeps retrying a task. The Expires field
+// of a record should have a Firestore TTL policy, so that old records
+// are deleted.
+const completedTaskTTL = 7 * 24 * time.Hour
+
+// A completedTask is the Firestore record of a completed scan.
+type completedTask struct {
+	Completed time.Time
+	Expires   time.Time
+}
+
+// A completedTaskStore records which scans of tasks have completed.
+type completedTaskStore interface {
+	// isCompleted reports whether the scan with the key has completed.
+	isCompleted(ctx context.Context, key string) (bool, error)
+	// setCompleted records that the scan with the key has completed.
+	setCompleted(ctx context.Context, key string) error
+}
+
+// fsCompletedTasks is a completedTaskStore in a Firestore namespace.
+type fsCompletedTasks struct {
+	ns *fstore.Namespace
+}
+
+func (s *fsCompletedTasks) isCompleted(ctx context.Context, key string) (_ bool, err error) {
+	defer derrors.Wrap(&err, "isCompleted(%q)", key)
+	dr := s.ns.Collection(completedTasksCollection).Doc(url.PathEscape(key))
+	_, err = fstore.Get[completedTask](ctx, dr)
+	if errors.Is(err, derrors.NotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *fsCompletedTasks) setCompleted(ctx context.Context, key string) (err error) {
+	defer derrors.Wrap(&err, "setCompleted(%q)", key)
+	now := time.Now()
+	dr := s.ns.Collection(completedTasksCollection).Doc(url.PathEscape(key))
+	return fstore.Set(ctx, dr, &completedTask{Completed: now, Expires: now.Add(completedTaskTTL)})
+}
+
+// taskKey returns the key of the scan of module@version in mode, which
+// is a scan mode or an analysis binary, by the task of attempt. The scan
+// is identified by the ID of the task's job or, if there is none, by the
+// name of the task. taskKey returns "" if the scan is not by a Cloud
+// Tasks task, or cannot be identified.
+func taskKey(attempt *queue.TaskAttempt, jobID, module, version, mode string) string {
+	if attempt == nil {
+		return ""
+	}
+	id := jobID
+	if id == "" {
+		id = attempt.TaskName
+	}
+	if id == "" {
+		return ""
+	}
+	return id + "/" + module + "@" + version + "/" + mode
+}
+
+// isRetry reports whether attempt is a retry of a task.
+func isRetry(attempt *queue.TaskAttempt) bool {
+	return attempt != nil && (attempt.RetryCount > 0 || attempt.ExecutionCount > 0)
+}
+
+// taskCompleted reports whether an earlier attempt of the task of
+// attempt completed the scan with the key. It only reads the store for
+// retries. If it can't read the store, it logs the error and reports
+// false: a duplicate row is better than a missing one.
+func (s *Server) taskCompleted(ctx context.Context, attempt *queue.TaskAttempt, key string) bool {
+	if s.completedTasks == nil || key == "" || !isRetry(attempt) {
+		return false
+	}
+	done, err := s.completedTasks.isCompleted(ctx, key)
+	if err != nil {
+		log.Warnf(ctx, "reading completed task: %v", err)
+		return false
+	}
+	return done
+}
+
+// setTaskCompleted records that the scan with the key completed, after
+// its rows were uploaded. If it fails, it logs the error.
+func (s *Server) setTaskCompleted(ctx context.Context, key string) {
+	if s.completedTasks == nil || key == "" {
+		return
+	}
+	if err := s.completedTasks.setCompleted(ctx, key); err != nil {
+		log.Warnf(ctx, "recording completed task: %v", err)
+	}
+}
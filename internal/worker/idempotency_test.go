@@ -0,0 +1,161 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"golang.org/x/pkgsite-metrics/internal/analysis"
+	"golang.org/x/pkgsite-metrics/internal/bigquery"
+	"golang.org/x/pkgsite-metrics/internal/buildtest"
+	"golang.org/x/pkgsite-metrics/internal/config"
+	"golang.org/x/pkgsite-metrics/internal/proxy/proxytest"
+	"golang.org/x/pkgsite-metrics/internal/queue"
+)
+
+// memCompletedTasks is a completedTaskStore in memory.
+type memCompletedTasks struct {
+	mu   sync.Mutex
+	keys map[string]bool
+	err  error // if non-nil, returned by isCompleted
+}
+
+func (s *memCompletedTasks) isCompleted(_ context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys[key], s.err
+}
+
+func (s *memCompletedTasks) setCompleted(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keys == nil {
+		s.keys = map[string]bool{}
+	}
+	s.keys[key] = true
+	return nil
+}
+
+func TestTaskKey(t *testing.T) {
+	attempt := &queue.TaskAttempt{TaskName: "task"}
+	for _, test := range []struct {
+		attempt *queue.TaskAttempt
+		jobID   string
+		want    string
+	}{
+		{nil, "job", ""},
+		{&queue.TaskAttempt{}, "", ""},
+		{attempt, "", "task/a.com/m@v1.0.0/GOVULNCHECK"},
+		{attempt, "job", "job/a.com/m@v1.0.0/GOVULNCHECK"},
+	} {
+		got := taskKey(test.attempt, test.jobID, "a.com/m", "v1.0.0", ModeGovulncheck)
+		if got != test.want {
+			t.Errorf("%+v, %q: got %q, want %q", test.attempt, test.jobID, got, test.want)
+		}
+	}
+}
+
+func TestTaskCompleted(t *testing.T) {
+	ctx := context.Background()
+	const key = "task/a.com/m@v1.0.0/GOVULNCHECK"
+	first := &queue.TaskAttempt{TaskName: "task"}
+	retry := &queue.TaskAttempt{RetryCount: 1, ExecutionCount: 1, TaskName: "task"}
+
+	// Without a store, nothing is recorded or skipped.
+	s := &Server{}
+	s.setTaskCompleted(ctx, key)
+	if s.taskCompleted(ctx, retry, key) {
+		t.Error("no store: got true, want false")
+	}
+
+	store := &memCompletedTasks{}
+	s.completedTasks = store
+	if s.taskCompleted(ctx, retry, key) {
+		t.Error("before completion: got true, want false")
+	}
+	s.setTaskCompleted(ctx, key)
+	if !s.taskCompleted(ctx, retry, key) {
+		t.Error("retry after completion: got false, want true")
+	}
+	// The first attempt of a task doesn't read the store.
+	if s.taskCompleted(ctx, first, key) {
+		t.Error("first attempt: got true, want false")
+	}
+	if s.taskCompleted(ctx, nil, key) {
+		t.Error("not from Cloud Tasks: got true, want false")
+	}
+	// A failure to read the store doesn't prevent the scan.
+	store.err = errors.New("unavailable")
+	if s.taskCompleted(ctx, retry, key) {
+		t.Error("read error: got true, want false")
+	}
+}
+
+// TestAnalysisScanRetry tests that a retry of an analysis task does
+// not upload the rows of the earlier attempt again.
+func TestAnalysisScanRetry(t *testing.T) {
+	const (
+		modulePath = "a.com/m"
+		version    = "v1.2.3"
+	)
+	binaryPath := buildtest.GoBuild(t, "testdata/analyzer", "")
+	hash, err := hashFile(binaryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyClient, cleanup := proxytest.SetupTestClient(t, []*proxytest.Module{
+		{
+			ModulePath: modulePath,
+			Version:    version,
+			Files: map[string]string{
+				"go.mod": "module " + modulePath,
+				"a.go":   "package p\nfunc F() { G() }\nfunc G() {}\n",
+			},
+		},
+	})
+	defer cleanup()
+
+	sink := &bigquery.MemorySink{}
+	store := &memCompletedTasks{}
+	s := &analysisServer{
+		Server: &Server{
+			proxyClient:    proxyClient,
+			cfg:            &config.Config{BinaryDir: t.TempDir()},
+			rows:           &rowUploader{sink: sink},
+			completedTasks: store,
+		},
+		openFile:           func(string) (io.ReadCloser, error) { return os.Open(binaryPath) },
+		storedWorkVersions: map[analysis.WorkVersionKey]analysis.WorkVersion{},
+	}
+	scanTask := func(retries int) {
+		t.Helper()
+		r := httptest.NewRequest("POST", fmt.Sprintf("/analysis/scan/%s@%s?binary=analyzer&binaryversion=%s&args=-name+G&insecure=true",
+			modulePath, version, hash), nil)
+		r.Header.Set("X-CloudTasks-TaskName", "task")
+		r.Header.Set("X-CloudTasks-TaskRetryCount", fmt.Sprint(retries))
+		r.Header.Set("X-CloudTasks-TaskExecutionCount", fmt.Sprint(retries))
+		if err := s.handleScan(httptest.NewRecorder(), r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scanTask(0)
+	if n := len(sink.Rows(analysis.TableName)); n != 1 {
+		t.Fatalf("first attempt: got %d rows, want 1", n)
+	}
+	if !store.keys["task/"+modulePath+"@"+version+"/analyzer"] {
+		t.Errorf("first attempt: scan not recorded as completed; recorded %v", store.keys)
+	}
+	scanTask(1)
+	if n := len(sink.Rows(analysis.TableName)); n != 1 {
+		t.Errorf("retry: got %d rows, want 1", n)
+	}
+}
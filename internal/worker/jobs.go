@@ -5,6 +5,9 @@
 // Handlers for jobs.
 //
 // jobs/describe?jobid=xxx		describe a job
+// jobs/failures?jobid=xxx		list the modules that failed in a job
+// jobs/cleanup?olderthan=720h	delete old finished jobs (also &dryrun=true),
+//								after retrying the summaries of finished jobs
 
 // TODO:
 // jobs/list					list all jobs
@@ -24,8 +27,12 @@ import (
 	"time"
 
 	"golang.org/x/pkgsite-metrics/internal/analysis"
+	"golang.org/x/pkgsite-metrics/internal/bigquery"
 	"golang.org/x/pkgsite-metrics/internal/derrors"
 	"golang.org/x/pkgsite-metrics/internal/jobs"
+	"golang.org/x/pkgsite-metrics/internal/log"
+	"golang.org/x/pkgsite-metrics/internal/queue"
+	"golang.org/x/pkgsite-metrics/internal/scan"
 )
 
 func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) (err error) {
@@ -36,12 +43,84 @@ func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) (err error)
 		return &serverError{err: errors.New("jobs DB not configured"), status: http.StatusNotImplemented}
 	}
 
+	if r.URL.Path == "/jobs/cleanup" {
+		params := &cleanupParams{OlderThan: defaultJobRetention.String()}
+		if err := scan.ParseParams(r, params); err != nil {
+			return fmt.Errorf("%w: %v", derrors.InvalidArgument, err)
+		}
+		olderThan, err := time.ParseDuration(params.OlderThan)
+		if err != nil {
+			return fmt.Errorf("%w: olderthan: %v", derrors.InvalidArgument, err)
+		}
+		res := &cleanupResult{DryRun: params.DryRun}
+		if !params.DryRun {
+			// Summarize finished jobs before they can be deleted.
+			res.Summarized, err = summarizeFinishedJobs(ctx, s.jobDB, s.jobSummarizer(), s.rows)
+			if err != nil {
+				return err
+			}
+		}
+		res.Deleted, err = cleanupJobs(ctx, s.jobDB, time.Now().Add(-olderThan), params.DryRun)
+		if err != nil {
+			return err
+		}
+		res.NumDeleted = len(res.Deleted)
+		return writeJSON(w, res)
+	}
+
 	jobID := r.FormValue("jobid")
 	return s.processJobRequest(ctx, w, r.URL.Path, jobID, s.jobDB)
 }
 
+// defaultJobRetention is how long jobs are kept by jobs/cleanup
+// if no duration is given.
+const defaultJobRetention = 30 * 24 * time.Hour
+
+// cleanupParams are the parameters of jobs/cleanup.
+type cleanupParams struct {
+	OlderThan string // delete jobs started longer ago than this duration
+	DryRun    bool   // report the jobs that would be deleted, but don't delete them
+}
+
+// cleanupResult is the response of jobs/cleanup.
+type cleanupResult struct {
+	DryRun     bool
+	NumDeleted int
+	Deleted    []string // IDs of jobs deleted, or that would be deleted on a dry run
+	// IDs of finished jobs whose summary was retried; none on a dry run.
+	Summarized []string `json:",omitempty"`
+}
+
+// cleanupJobs deletes the jobs in db that started before cutoff and are
+// finished or canceled. Unfinished jobs are never deleted.
+// If dryRun is true, nothing is deleted.
+// It returns the IDs of the jobs that were (or would be) deleted.
+func cleanupJobs(ctx context.Context, db jobDB, cutoff time.Time, dryRun bool) (_ []string, err error) {
+	defer derrors.Wrap(&err, "cleanupJobs(%s, %t)", cutoff, dryRun)
+	ids := []string{}
+	err = db.ListJobs(ctx, func(j *jobs.Job, _ time.Time) error {
+		if j.StartedAt.Before(cutoff) && (j.Canceled || j.NumFinished() >= j.NumEnqueued) {
+			ids = append(ids, j.ID())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return ids, nil
+	}
+	for _, id := range ids {
+		if err := db.DeleteJob(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
 type jobDB interface {
 	CreateJob(ctx context.Context, j *jobs.Job) error
+	DeleteJob(ctx context.Context, id string) error
 	GetJob(ctx context.Context, id string) (*jobs.Job, error)
 	UpdateJob(ctx context.Context, id string, f func(*jobs.Job) error) error
 	ListJobs(context.Context, func(*jobs.Job, time.Time) error) error
@@ -64,10 +143,29 @@ func (s *Server) processJobRequest(ctx context.Context, w io.Writer, path, jobID
 		if jobID == "" {
 			return fmt.Errorf("missing jobid: %w", derrors.InvalidArgument)
 		}
-		return db.UpdateJob(ctx, jobID, func(j *jobs.Job) error {
+		err := db.UpdateJob(ctx, jobID, func(j *jobs.Job) error {
 			j.Canceled = true
 			return nil
 		})
+		if err != nil {
+			return err
+		}
+		// Delete the job's pending tasks. Any that have already started
+		// will stop when they see that the job is canceled. If the
+		// queue cannot delete tasks, all of them will.
+		n := 0
+		if s.queue != nil {
+			n, err = queue.DeleteJobTasks(ctx, s.queue, jobID)
+			if errors.Is(err, derrors.NotImplemented) {
+				fmt.Fprintf(w, "canceled job %s; its pending tasks will stop when they run\n", jobID)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(w, "canceled job %s; deleted %d pending tasks\n", jobID, n)
+		return nil
 
 	case "list":
 		var joblist []*jobs.Job
@@ -84,24 +182,290 @@ func (s *Server) processJobRequest(ctx context.Context, w io.Writer, path, jobID
 		if jobID == "" {
 			return fmt.Errorf("missing jobid: %w", derrors.InvalidArgument)
 		}
-		job, err := db.GetJob(ctx, jobID)
-		if err != nil {
+		if _, err := db.GetJob(ctx, jobID); err != nil {
 			return err
 		}
 		if s.bqClient == nil {
 			return errors.New("bq client is nil")
 		}
-		results, err := analysis.ReadResults(ctx, s.bqClient, job.Binary, job.BinaryVersion, job.BinaryArgs)
+		results, err := analysis.ReadJobResults(ctx, s.bqClient, jobID)
 		if err != nil {
 			return err
 		}
 		return writeJSON(w, results)
 
+	case "failures":
+		if jobID == "" {
+			return fmt.Errorf("missing jobid: %w", derrors.InvalidArgument)
+		}
+		job, err := db.GetJob(ctx, jobID)
+		if err != nil {
+			return err
+		}
+		mods, err := jobFailures(ctx, s.bqClient, job)
+		if err != nil {
+			return err
+		}
+		failures := []string{}
+		for _, m := range mods {
+			failures = append(failures, m.Path+"@"+m.Version)
+		}
+		return writeJSON(w, failures)
+
 	default:
 		return fmt.Errorf("unknown path %q: %w", path, derrors.InvalidArgument)
 	}
 }
 
+// jobFailures returns the modules of job whose most recent
+// analysis result in the job has an error.
+func jobFailures(ctx context.Context, c *bigquery.Client, job *jobs.Job) ([]scan.ModuleSpec, error) {
+	if c == nil {
+		return nil, errors.New("bq client is nil")
+	}
+	results, err := analysis.ReadJobFailures(ctx, c, job.ID())
+	if err != nil {
+		return nil, err
+	}
+	var mods []scan.ModuleSpec
+	for _, r := range results {
+		mods = append(mods, scan.ModuleSpec{Path: r.ModulePath, Version: r.Version})
+	}
+	return mods, nil
+}
+
+// errNotReady is returned from a job update when the job
+// should not be notified or summarized.
+var errNotReady = errors.New("job not ready for notification")
+
+// notifyIfDone sends a notification for the job with the given ID if the job
+// is finished and has a notification URL. The notification is sent at most
+// once: the job is marked as notified in a transaction before sending, so
+// only one of several concurrent callers will send it.
+// Errors are logged.
+func notifyIfDone(ctx context.Context, db jobDB, jobID string) {
+	job, err := db.GetJob(ctx, jobID)
+	if err != nil {
+		log.Errorf(ctx, err, "notifyIfDone: getting job %q", jobID)
+		return
+	}
+	// Check outside the transaction first, to avoid contention.
+	if !readyToNotify(job) {
+		return
+	}
+	err = db.UpdateJob(ctx, jobID, func(j *jobs.Job) error {
+		if !readyToNotify(j) {
+			return errNotReady
+		}
+		j.Notified = true
+		job = j
+		return nil
+	})
+	if errors.Is(err, errNotReady) {
+		return
+	}
+	if err != nil {
+		log.Errorf(ctx, err, "notifyIfDone: updating job %q", jobID)
+		return
+	}
+	if err := postNotification(ctx, job.Notify, job); err != nil {
+		log.Errorf(ctx, err, "notifyIfDone: notifying %s for job %q", job.Notify, jobID)
+		return
+	}
+	log.Infof(ctx, "notified %s that job %q finished", job.Notify, jobID)
+}
+
+// A jobSummarizer aggregates the results of the job with the given ID.
+type jobSummarizer func(ctx context.Context, jobID string) (*analysis.JobSummary, error)
+
+// jobSummarizer returns a function that reads job summaries from
+// BigQuery, or nil if BigQuery is disabled.
+func (s *Server) jobSummarizer() jobSummarizer {
+	if s.bqClient == nil {
+		return nil
+	}
+	return func(ctx context.Context, jobID string) (*analysis.JobSummary, error) {
+		return analysis.ReadJobSummary(ctx, s.bqClient, jobID)
+	}
+}
+
+// finishJobIfDone summarizes and then notifies the job with the
+// given ID, if it is finished. Summarizing first means the summary
+// is available to whoever is notified.
+func (s *Server) finishJobIfDone(ctx context.Context, jobID string) {
+	summarizeIfDone(ctx, s.jobDB, jobID, s.jobSummarizer(), s.rows)
+	notifyIfDone(ctx, s.jobDB, jobID)
+}
+
+// summaryClaimTimeout is how long a claim on a job's summary lasts.
+// A worker that claimed the summary but neither uploaded it nor gave up
+// the claim in that time is assumed to have died.
+const summaryClaimTimeout = 15 * time.Minute
+
+// summarizeIfDone uploads a summary row for the job with the given ID
+// if the job is finished and has not been summarized. It first claims
+// the summary in a transaction, so that only one of several concurrent
+// callers uploads it. It marks the job as summarized after the summary
+// is uploaded. If the summary fails, it gives up the claim, so a later
+// call can retry it; summarizeFinishedJobs makes those calls for jobs
+// whose last task has finished.
+// If summarize is nil, summarizeIfDone does nothing.
+// Errors are logged.
+func summarizeIfDone(ctx context.Context, db jobDB, jobID string, summarize jobSummarizer, u *rowUploader) {
+	if summarize == nil {
+		return
+	}
+	job, err := db.GetJob(ctx, jobID)
+	if err != nil {
+		log.Errorf(ctx, err, "summarizeIfDone: getting job %q", jobID)
+		return
+	}
+	// Check outside the transaction first, to avoid contention.
+	claimed := time.Now()
+	if !readyToSummarize(job, claimed) {
+		return
+	}
+	err = db.UpdateJob(ctx, jobID, func(j *jobs.Job) error {
+		if !readyToSummarize(j, claimed) {
+			return errNotReady
+		}
+		j.SummaryClaimed = claimed
+		job = j
+		return nil
+	})
+	if errors.Is(err, errNotReady) {
+		return
+	}
+	if err != nil {
+		log.Errorf(ctx, err, "summarizeIfDone: claiming summary of job %q", jobID)
+		return
+	}
+	if err := uploadSummary(ctx, job, summarize, u); err != nil {
+		log.Errorf(ctx, err, "summarizeIfDone: summarizing job %q", jobID)
+		err = db.UpdateJob(ctx, jobID, func(j *jobs.Job) error {
+			if !j.SummaryClaimed.Equal(claimed) {
+				return errNotReady
+			}
+			j.SummaryClaimed = time.Time{}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errNotReady) {
+			log.Errorf(ctx, err, "summarizeIfDone: releasing summary of job %q", jobID)
+		}
+		return
+	}
+	log.Infof(ctx, "uploaded summary of job %q", jobID)
+	err = db.UpdateJob(ctx, jobID, func(j *jobs.Job) error {
+		j.Summarized = true
+		return nil
+	})
+	if err != nil {
+		log.Errorf(ctx, err, "summarizeIfDone: marking job %q as summarized", jobID)
+	}
+}
+
+// uploadSummary summarizes job and uploads the summary row.
+func uploadSummary(ctx context.Context, job *jobs.Job, summarize jobSummarizer, u *rowUploader) error {
+	sum, err := summarize(ctx, job.ID())
+	if err != nil {
+		return err
+	}
+	sum.JobID = job.ID()
+	sum.StartedAt = job.StartedAt
+	sum.NumTasks = job.NumEnqueued
+	sum.NumFailedTasks = job.NumFailed
+	return u.upload(ctx, analysis.JobSummaryTableName, []bigquery.Row{sum})
+}
+
+// summarizeFinishedJobs summarizes and then notifies the jobs in db
+// that are finished but not summarized, as when summarizing failed after
+// their last task. It returns the IDs of the jobs it tried to summarize.
+// If summarize is nil, it does nothing.
+func summarizeFinishedJobs(ctx context.Context, db jobDB, summarize jobSummarizer, u *rowUploader) (_ []string, err error) {
+	defer derrors.Wrap(&err, "summarizeFinishedJobs")
+	if summarize == nil {
+		return nil, nil
+	}
+	var ids []string
+	now := time.Now()
+	err = db.ListJobs(ctx, func(j *jobs.Job, _ time.Time) error {
+		if readyToSummarize(j, now) {
+			ids = append(ids, j.ID())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		summarizeIfDone(ctx, db, id, summarize, u)
+		notifyIfDone(ctx, db, id)
+	}
+	return ids, nil
+}
+
+// readyToSummarize reports whether j is finished but has not been
+// summarized, and no other worker has claimed its summary at now.
+func readyToSummarize(j *jobs.Job, now time.Time) bool {
+	if j.Summarized || j.Canceled || !isFinished(j) {
+		return false
+	}
+	return j.SummaryClaimed.IsZero() || now.Sub(j.SummaryClaimed) > summaryClaimTimeout
+}
+
+// isFinished reports whether every task of j has finished.
+func isFinished(j *jobs.Job) bool {
+	return j.NumEnqueued > 0 && j.NumFinished() >= j.NumEnqueued
+}
+
+// readyToNotify reports whether j is finished but has not been notified.
+func readyToNotify(j *jobs.Job) bool {
+	return j.Notify != "" && !j.Notified && !j.Canceled && isFinished(j)
+}
+
+// maxNotifyAttempts is the number of times postNotification tries to
+// send a notification.
+const maxNotifyAttempts = 3
+
+// postNotification POSTs job as JSON to url, retrying on failure.
+func postNotification(ctx context.Context, url string, job *jobs.Job) (err error) {
+	defer derrors.Wrap(&err, "postNotification(%q)", url)
+	body, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err = postJSON(ctx, url, body)
+		if err == nil || attempt == maxNotifyAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func postJSON(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("%s", res.Status)
+	}
+	return nil
+}
+
 // writeJSON JSON-marshals v and writes it to w.
 // Marshal failures do not result in partial writes.
 func writeJSON(w io.Writer, v any) error {
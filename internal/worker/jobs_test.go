@@ -8,14 +8,20 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
+	"golang.org/x/pkgsite-metrics/internal/analysis"
+	"golang.org/x/pkgsite-metrics/internal/bigquery"
 	"golang.org/x/pkgsite-metrics/internal/derrors"
 	"golang.org/x/pkgsite-metrics/internal/jobs"
 )
@@ -66,6 +72,258 @@ func TestJobs(t *testing.T) {
 	}
 }
 
+func TestNotifyIfDone(t *testing.T) {
+	ctx := context.Background()
+	var (
+		mu    sync.Mutex
+		posts []jobs.Job
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var j jobs.Job
+		if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		posts = append(posts, j)
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	db := &testJobDB{map[string]*jobs.Job{}}
+	tm := time.Date(2023, 3, 11, 1, 2, 3, 0, time.UTC)
+	job := jobs.NewJob("user", tm, "url", "bin", "<hash>", "args")
+	job.Notify = ts.URL
+	job.NumEnqueued = 2
+	job.NumSucceeded = 1
+	if err := db.CreateJob(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+
+	// Not finished: no notification.
+	notifyIfDone(ctx, db, job.ID())
+	if len(posts) != 0 {
+		t.Fatalf("got %d notifications for unfinished job, want 0", len(posts))
+	}
+
+	// Finished: exactly one notification, however many times it's called.
+	db.jobs[job.ID()].NumErrored = 1
+	notifyIfDone(ctx, db, job.ID())
+	notifyIfDone(ctx, db, job.ID())
+	if len(posts) != 1 {
+		t.Fatalf("got %d notifications, want 1", len(posts))
+	}
+	if got := posts[0].ID(); got != job.ID() {
+		t.Errorf("notified for job %q, want %q", got, job.ID())
+	}
+	if !db.jobs[job.ID()].Notified {
+		t.Error("job not marked as notified")
+	}
+}
+
+func TestSummarizeIfDone(t *testing.T) {
+	ctx := context.Background()
+	db := &testJobDB{map[string]*jobs.Job{}}
+	tm := time.Date(2023, 3, 11, 1, 2, 3, 0, time.UTC)
+	job := jobs.NewJob("user", tm, "url", "bin", "<hash>", "args")
+	job.NumEnqueued = 3
+	job.NumSucceeded = 1
+	if err := db.CreateJob(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	var sink bigquery.MemorySink
+	u := &rowUploader{sink: &sink}
+	nSummarized := 0
+	summarize := func(_ context.Context, jobID string) (*analysis.JobSummary, error) {
+		nSummarized++
+		return &analysis.JobSummary{
+			NumResults:      2,
+			NumErrors:       1,
+			ErrorCategories: []*analysis.CategoryCount{{Category: "MISC", Count: 1}},
+			NumDiagnostics:  5,
+		}, nil
+	}
+
+	// Not finished: no summary.
+	summarizeIfDone(ctx, db, job.ID(), summarize, u)
+	if n := len(sink.Rows(analysis.JobSummaryTableName)); n != 0 {
+		t.Fatalf("got %d summaries for unfinished job, want 0", n)
+	}
+
+	// Finished: exactly one summary, however many times it's called.
+	db.jobs[job.ID()].NumErrored = 1
+	db.jobs[job.ID()].NumFailed = 1
+	summarizeIfDone(ctx, db, job.ID(), summarize, u)
+	summarizeIfDone(ctx, db, job.ID(), summarize, u)
+	rows := sink.Rows(analysis.JobSummaryTableName)
+	if len(rows) != 1 || nSummarized != 1 {
+		t.Fatalf("got %d summaries from %d calls, want 1 from 1", len(rows), nSummarized)
+	}
+	got := rows[0].(*analysis.JobSummary)
+	want := &analysis.JobSummary{
+		CreatedAt:       got.CreatedAt,
+		JobID:           job.ID(),
+		StartedAt:       tm,
+		NumTasks:        3,
+		NumFailedTasks:  1,
+		NumResults:      2,
+		NumErrors:       1,
+		ErrorCategories: []*analysis.CategoryCount{{Category: "MISC", Count: 1}},
+		NumDiagnostics:  5,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+	if got.CreatedAt.IsZero() {
+		t.Error("upload time not set")
+	}
+	if !db.jobs[job.ID()].Summarized {
+		t.Error("job not marked as summarized")
+	}
+
+	// A failed summary is retried on the next call.
+	job3 := jobs.NewJob("user3", tm, "url", "bin", "<hash>", "args")
+	job3.NumEnqueued = 1
+	job3.NumSucceeded = 1
+	if err := db.CreateJob(ctx, job3); err != nil {
+		t.Fatal(err)
+	}
+	summarizeIfDone(ctx, db, job3.ID(), func(context.Context, string) (*analysis.JobSummary, error) {
+		return nil, errors.New("bad")
+	}, u)
+	if db.jobs[job3.ID()].Summarized {
+		t.Error("failed summary: job marked as summarized")
+	}
+	summarizeIfDone(ctx, db, job3.ID(), summarize, u)
+	if !db.jobs[job3.ID()].Summarized {
+		t.Error("retried summary: job not marked as summarized")
+	}
+
+	// A summary claimed by another worker is left to it, unless the
+	// claim is too old.
+	job4 := jobs.NewJob("user4", tm, "url", "bin", "<hash>", "args")
+	job4.NumEnqueued = 1
+	job4.NumSucceeded = 1
+	job4.SummaryClaimed = time.Now()
+	if err := db.CreateJob(ctx, job4); err != nil {
+		t.Fatal(err)
+	}
+	summarizeIfDone(ctx, db, job4.ID(), summarize, u)
+	if db.jobs[job4.ID()].Summarized {
+		t.Error("claimed summary: job marked as summarized")
+	}
+	db.jobs[job4.ID()].SummaryClaimed = time.Now().Add(-2 * summaryClaimTimeout)
+	summarizeIfDone(ctx, db, job4.ID(), summarize, u)
+	if !db.jobs[job4.ID()].Summarized {
+		t.Error("stale claim: job not marked as summarized")
+	}
+
+	// A nil summarizer does nothing.
+	job2 := jobs.NewJob("user2", tm, "url", "bin", "<hash>", "args")
+	job2.NumEnqueued = 1
+	job2.NumSucceeded = 1
+	if err := db.CreateJob(ctx, job2); err != nil {
+		t.Fatal(err)
+	}
+	summarizeIfDone(ctx, db, job2.ID(), nil, u)
+	if db.jobs[job2.ID()].Summarized {
+		t.Error("nil summarizer: job marked as summarized")
+	}
+}
+
+func TestSummarizeFinishedJobs(t *testing.T) {
+	ctx := context.Background()
+	db := &testJobDB{map[string]*jobs.Job{}}
+	tm := time.Date(2023, 3, 11, 1, 2, 3, 0, time.UTC)
+	var ids []string
+	for i, finished := range []bool{true, false, true} {
+		j := jobs.NewJob(fmt.Sprintf("user%d", i), tm, "url", "bin", "<hash>", "args")
+		j.NumEnqueued = 2
+		j.NumSucceeded = 1
+		if finished {
+			j.NumSucceeded = 2
+		}
+		if err := db.CreateJob(ctx, j); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, j.ID())
+	}
+	// The first job was summarized when its last task finished.
+	db.jobs[ids[0]].Summarized = true
+
+	var sink bigquery.MemorySink
+	u := &rowUploader{sink: &sink}
+	summarize := func(context.Context, string) (*analysis.JobSummary, error) {
+		return &analysis.JobSummary{}, nil
+	}
+	got, err := summarizeFinishedJobs(ctx, db, summarize, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ids[2:]; !cmp.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !db.jobs[ids[2]].Summarized {
+		t.Error("finished job not summarized")
+	}
+	if n := len(sink.Rows(analysis.JobSummaryTableName)); n != 1 {
+		t.Errorf("got %d summaries, want 1", n)
+	}
+}
+
+func TestCleanupJobs(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	old := now.Add(-60 * 24 * time.Hour)
+	newJob := func(user string, start time.Time, enqueued, succeeded int, canceled bool) *jobs.Job {
+		j := jobs.NewJob(user, start, "url", "bin", "<hash>", "args")
+		j.NumEnqueued = enqueued
+		j.NumSucceeded = succeeded
+		j.Canceled = canceled
+		return j
+	}
+	oldFinished := newJob("a", old, 2, 2, false)
+	oldCanceled := newJob("b", old, 2, 1, true)
+	oldUnfinished := newJob("c", old, 2, 1, false)
+	recentFinished := newJob("d", now, 2, 2, false)
+
+	db := &testJobDB{map[string]*jobs.Job{}}
+	for _, j := range []*jobs.Job{oldFinished, oldCanceled, oldUnfinished, recentFinished} {
+		if err := db.CreateJob(ctx, j); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cutoff := now.Add(-30 * 24 * time.Hour)
+	want := []string{oldFinished.ID(), oldCanceled.ID()}
+
+	// A dry run deletes nothing.
+	got, err := cleanupJobs(ctx, db, cutoff, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(got)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("dry run mismatch (-want, +got):\n%s", diff)
+	}
+	if len(db.jobs) != 4 {
+		t.Errorf("dry run: got %d jobs, want 4", len(db.jobs))
+	}
+
+	got, err = cleanupJobs(ctx, db, cutoff, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(got)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+	gotIDs := maps.Keys(db.jobs)
+	slices.Sort(gotIDs)
+	wantIDs := []string{oldUnfinished.ID(), recentFinished.ID()}
+	if diff := cmp.Diff(wantIDs, gotIDs); diff != "" {
+		t.Errorf("remaining jobs mismatch (-want, +got):\n%s", diff)
+	}
+}
+
 type testJobDB struct {
 	jobs map[string]*jobs.Job
 }
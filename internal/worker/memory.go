@@ -0,0 +1,99 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/log"
+)
+
+const (
+	// Memory use and limit of the container's cgroup, which includes
+	// the sandbox.
+	memoryUsageFile = "/sys/fs/cgroup/memory/memory.usage_in_bytes"
+	memoryLimitFile = "/sys/fs/cgroup/memory/memory.limit_in_bytes"
+
+	// memoryCheckInterval is how often memory use is checked during a scan.
+	memoryCheckInterval = time.Second
+)
+
+func readIntFile(filename string) (int, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// cgroupMemoryUsage returns the memory used by the container,
+// including any running sandbox.
+func cgroupMemoryUsage() (uint64, error) {
+	n, err := readIntFile(memoryUsageFile)
+	return uint64(n), err
+}
+
+// scanMemoryLimit returns the number of bytes that a scan may cause
+// the container to use: fraction of GOMEMLIMIT, or of the cgroup limit
+// if GOMEMLIMIT is not set. It returns 0 if there is no limit.
+func scanMemoryLimit(fraction float64) uint64 {
+	if fraction <= 0 {
+		return 0
+	}
+	limit := debug.SetMemoryLimit(-1)
+	if limit == math.MaxInt64 {
+		n, err := readIntFile(memoryLimitFile)
+		if err != nil {
+			return 0
+		}
+		limit = int64(n)
+	}
+	return uint64(float64(limit) * fraction)
+}
+
+// monitorMemory returns a context that is canceled when usage reports
+// more than limit bytes, checking every interval. The cause of the
+// cancellation wraps derrors.ScanModuleMemoryLimitExceeded. Commands
+// started with the context, in particular the sandbox, are then killed.
+// The returned function stops the monitoring and must be called.
+func monitorMemory(ctx context.Context, limit uint64, interval time.Duration, usage func() (uint64, error)) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				u, err := usage()
+				if err != nil {
+					log.Errorf(ctx, err, "reading memory usage; no longer monitoring")
+					return
+				}
+				if u > limit {
+					log.Warnf(ctx, "memory usage %d exceeds limit %d; stopping scan", u, limit)
+					cancel(fmt.Errorf("%w: using %d bytes, limit is %d", derrors.ScanModuleMemoryLimitExceeded, u, limit))
+					return
+				}
+			}
+		}
+	}()
+	return ctx, func() {
+		close(done)
+		cancel(nil)
+	}
+}
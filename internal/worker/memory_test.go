@@ -0,0 +1,62 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/sandbox"
+)
+
+func TestMonitorMemory(t *testing.T) {
+	var used atomic.Uint64
+	used.Store(10)
+	usage := func() (uint64, error) { return used.Load(), nil }
+
+	ctx, stop := monitorMemory(context.Background(), 100, time.Millisecond, usage)
+	defer stop()
+	time.Sleep(10 * time.Millisecond)
+	if err := ctx.Err(); err != nil {
+		t.Fatalf("under limit: got %v, want nil", err)
+	}
+	used.Store(200)
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("over limit: context not canceled")
+	}
+	if cause := context.Cause(ctx); !errors.Is(cause, derrors.ScanModuleMemoryLimitExceeded) {
+		t.Errorf("got cause %v, want ScanModuleMemoryLimitExceeded", cause)
+	}
+
+	// Stopping the monitor does not report a memory error.
+	ctx, stop = monitorMemory(context.Background(), 100, time.Millisecond, func() (uint64, error) { return 0, nil })
+	stop()
+	if cause := context.Cause(ctx); errors.Is(cause, derrors.ScanModuleMemoryLimitExceeded) {
+		t.Errorf("after stop: got cause %v", cause)
+	}
+}
+
+func TestIsSandboxMemoryLimit(t *testing.T) {
+	runErr := errors.New("exit status 2")
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("Cmd.Output: %w", &sandbox.LimitError{Resource: sandbox.ResourceMemory, Limit: 1, Err: runErr}), true},
+		{&sandbox.LimitError{Resource: sandbox.ResourcePids, Limit: 1, Err: runErr}, false},
+		{runErr, false},
+	} {
+		if got := isSandboxMemoryLimit(test.err); got != test.want {
+			t.Errorf("%v: got %t, want %t", test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/pkgsite-metrics/internal/config"
+	"golang.org/x/pkgsite-metrics/internal/log"
+)
+
+// refreshModeConfigs reloads the per-mode overrides of scan settings
+// every interval. If they can't be loaded, the previous overrides stay
+// in effect. The error is logged once, not on every attempt, until
+// a load succeeds again.
+func (s *Server) refreshModeConfigs(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var lastErr string
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		changed, err := s.modeConfigs.Reload(ctx)
+		if err != nil {
+			if err.Error() != lastErr {
+				log.Errorf(ctx, err, "reloading mode config %s; keeping the previous one", s.cfg.ModeConfig)
+				lastErr = err.Error()
+			}
+			continue
+		}
+		if lastErr != "" || changed {
+			log.Infof(ctx, "loaded mode config %s", s.cfg.ModeConfig)
+			warnUnknownModes(ctx, s.modeConfigs)
+		}
+		lastErr = ""
+	}
+}
+
+// warnUnknownModes logs a warning for each mode in mcs that is not a
+// govulncheck mode. Only govulncheck scans use the overrides, so
+// overrides for other modes, like analysis, have no effect.
+func warnUnknownModes(ctx context.Context, mcs *config.ModeConfigs) {
+	for _, mode := range mcs.Modes() {
+		if !modes[mode] {
+			log.Warnf(ctx, "mode config: %q is not a govulncheck mode; its overrides are ignored", mode)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/pkgsite-metrics/internal"
+	"golang.org/x/pkgsite-metrics/internal/config"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/proxy"
+)
+
+// The worker can scan private modules, served by a proxy that requires
+// authentication. The configuration for them is empty for the public
+// deployment, and then none of this has any effect.
+
+// privateGoEnv returns the environment variables that cfg sets for the
+// go commands that download and load the packages of private modules,
+// in the sandbox and out.
+func privateGoEnv(cfg *config.Config) []string {
+	var env []string
+	for _, v := range []struct{ name, value string }{
+		{"GOPRIVATE", cfg.GoPrivate},
+		{"GONOSUMDB", cfg.GoNoSumDB},
+		{"GOFLAGS", cfg.GoFlags},
+	} {
+		if v.value != "" {
+			env = append(env, v.name+"="+v.value)
+		}
+	}
+	return env
+}
+
+// hostGoEnv returns the environment variables for the go commands that
+// the worker runs outside the sandbox to download the dependencies of
+// modules. If cfg configures a private proxy, they download from it,
+// including the modules matching GOPRIVATE, which the go command
+// would otherwise fetch from their repositories; netrcFile, if not
+// empty, holds the proxy's credentials.
+func hostGoEnv(cfg *config.Config, netrcFile string) []string {
+	env := privateGoEnv(cfg)
+	if cfg.ProxyAuthSecret != "" || cfg.GoPrivate != "" {
+		env = append(env, "GOPROXY="+cfg.ProxyURL, "GONOPROXY=none")
+	}
+	if netrcFile != "" {
+		env = append(env, "NETRC="+netrcFile)
+	}
+	return env
+}
+
+// noSumDBPatterns returns the patterns of the module paths whose zips
+// are not verified against the checksum database, as the go command
+// determines them from GONOSUMDB and GOPRIVATE.
+func noSumDBPatterns(cfg *config.Config) string {
+	var patterns []string
+	for _, p := range []string{cfg.GoNoSumDB, cfg.GoPrivate} {
+		if p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return strings.Join(patterns, ",")
+}
+
+// withProxyAuth reads the credentials of the module proxy from the
+// secret cfg.ProxyAuthSecret. It returns proxyClient using them, and
+// the name of a netrc file that holds them for the go command, which
+// authenticates to proxies only with the credentials in netrc files.
+func withProxyAuth(ctx context.Context, proxyClient *proxy.Client, cfg *config.Config) (_ *proxy.Client, netrcFile string, err error) {
+	defer derrors.Wrap(&err, "withProxyAuth(%q)", cfg.ProxyAuthSecret)
+	creds, err := internal.GetSecret(ctx, cfg.ProxyAuthSecret)
+	if err != nil {
+		return nil, "", err
+	}
+	user, password, ok := strings.Cut(strings.TrimSpace(creds), ":")
+	if !ok || user == "" {
+		return nil, "", errors.New("secret does not have the form USER:PASSWORD")
+	}
+	data, err := netrc(cfg.ProxyURL, user, password)
+	if err != nil {
+		return nil, "", err
+	}
+	f, err := os.CreateTemp("", "proxy-netrc")
+	if err != nil {
+		return nil, "", err
+	}
+	if err := copyAndClose(f, strings.NewReader(data)); err != nil {
+		return nil, "", err
+	}
+	return proxyClient.WithBasicAuth(user, password), f.Name(), nil
+}
+
+// netrc returns the contents of a netrc file with the credentials
+// user and password for the host of proxyURL.
+func netrc(proxyURL, user, password string) (string, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return "", err
+	}
+	if strings.ContainsAny(user+password, " \t\n") {
+		return "", errors.New("credentials have spaces, which netrc files don't allow")
+	}
+	return fmt.Sprintf("machine %s login %s password %s\n", u.Hostname(), user, password), nil
+}
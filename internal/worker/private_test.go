@@ -0,0 +1,85 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/pkgsite-metrics/internal/config"
+)
+
+func TestHostGoEnv(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		cfg   config.Config
+		netrc string
+		want  []string
+	}{
+		{
+			name: "public",
+			cfg:  config.Config{ProxyURL: "https://proxy.golang.org"},
+			want: nil,
+		},
+		{
+			name: "nosumdb only",
+			cfg:  config.Config{ProxyURL: "https://proxy.golang.org", GoNoSumDB: "example.com/x"},
+			want: []string{"GONOSUMDB=example.com/x"},
+		},
+		{
+			name: "private",
+			cfg: config.Config{
+				ProxyURL:        "https://athens.corp.example.com",
+				ProxyAuthSecret: "proxy-creds",
+				GoPrivate:       "*.corp.example.com",
+				GoFlags:         "-mod=mod",
+			},
+			netrc: "/tmp/netrc",
+			want: []string{
+				"GOPRIVATE=*.corp.example.com",
+				"GOFLAGS=-mod=mod",
+				"GOPROXY=https://athens.corp.example.com",
+				"GONOPROXY=none",
+				"NETRC=/tmp/netrc",
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := hostGoEnv(&test.cfg, test.netrc)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("mismatch (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNoSumDBPatterns(t *testing.T) {
+	for _, test := range []struct {
+		private, nosumdb string
+		want             string
+	}{
+		{"", "", ""},
+		{"*.corp.example.com", "", "*.corp.example.com"},
+		{"*.corp.example.com", "example.com/x,example.com/y", "example.com/x,example.com/y,*.corp.example.com"},
+	} {
+		cfg := &config.Config{GoPrivate: test.private, GoNoSumDB: test.nosumdb}
+		if got := noSumDBPatterns(cfg); got != test.want {
+			t.Errorf("noSumDBPatterns(GOPRIVATE=%q, GONOSUMDB=%q) = %q, want %q", test.private, test.nosumdb, got, test.want)
+		}
+	}
+}
+
+func TestNetrc(t *testing.T) {
+	got, err := netrc("https://athens.corp.example.com:8443/proxy", "bot", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "machine athens.corp.example.com login bot password s3cret\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := netrc("https://athens.corp.example.com", "bot", "two words"); err == nil {
+		t.Error("password with a space: got nil, want error")
+	}
+}
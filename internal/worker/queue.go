@@ -0,0 +1,59 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"net/http"
+
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/log"
+	"golang.org/x/pkgsite-metrics/internal/queue"
+	"golang.org/x/pkgsite-metrics/internal/scan"
+)
+
+// handleQueueStats writes a JSON summary of the tasks waiting in the
+// task queue, as a queue.Stats. It examines at most
+// cfg.QueueStatsMaxTasks tasks.
+func (s *Server) handleQueueStats(w http.ResponseWriter, r *http.Request) (err error) {
+	defer derrors.Wrap(&err, "handleQueueStats")
+	stats, err := s.queue.Stats(r.Context(), s.cfg.QueueStatsMaxTasks)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, stats)
+}
+
+type purgeParams struct {
+	Suffix    string // required
+	Namespace string // if empty, all namespaces
+	DryRun    bool   // only count the matching tasks
+}
+
+// handlePurge deletes the queued tasks whose names end in a suffix,
+// for cleaning up after a bad enqueue. Like every worker endpoint,
+// it is only reachable by authenticated callers.
+//
+// queue/purge?suffix=S[&namespace=NS][&dryrun=true]
+func (s *Server) handlePurge(w http.ResponseWriter, r *http.Request) (err error) {
+	defer derrors.Wrap(&err, "handlePurge")
+	ctx := r.Context()
+
+	var params purgeParams
+	if err := scan.ParseParams(r, &params); err != nil {
+		return fmt.Errorf("%w: %v", derrors.InvalidArgument, err)
+	}
+	n, err := queue.Purge(ctx, s.queue, params.Namespace, params.Suffix, params.DryRun)
+	if err != nil {
+		return err
+	}
+	if params.DryRun {
+		fmt.Fprintf(w, "%d tasks match\n", n)
+		return nil
+	}
+	log.Infof(ctx, "purged %d tasks with suffix %q in namespace %q", n, params.Suffix, params.Namespace)
+	fmt.Fprintf(w, "deleted %d tasks\n", n)
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/pkgsite-metrics/internal/config"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/queue"
+)
+
+func TestHandleQueueStats(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// With no workers, at most one task leaves the queue, and it is
+	// never processed.
+	q := queue.NewInMemory(ctx, 0, nil)
+	for _, m := range []string{"a.com/a", "b.com/b", "c.com/c"} {
+		if _, err := q.EnqueueScan(ctx, &testTask{m}, &queue.Options{Namespace: "test"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Server{queue: q, cfg: &config.Config{QueueStatsMaxTasks: 1}}
+	w := httptest.NewRecorder()
+	if err := s.handleQueueStats(w, httptest.NewRequest("GET", "/queue/stats", nil)); err != nil {
+		t.Fatal(err)
+	}
+	var got queue.Stats
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.NumTasks != 1 || !got.Truncated {
+		t.Errorf("got %+v, want 1 task, truncated", got)
+	}
+}
+
+func TestHandlePurge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := &Server{queue: queue.NewInMemory(ctx, 0, nil)}
+
+	w := httptest.NewRecorder()
+	if err := s.handlePurge(w, httptest.NewRequest("GET", "/queue/purge?suffix=x&dryrun=true", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := w.Body.String(), "0 tasks match\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	err := s.handlePurge(httptest.NewRecorder(), httptest.NewRequest("GET", "/queue/purge", nil))
+	if !errors.Is(err, derrors.InvalidArgument) {
+		t.Errorf("no suffix: got %v, want InvalidArgument", err)
+	}
+}
+
+type testTask struct{ path string }
+
+func (t *testTask) Name() string   { return t.path }
+func (t *testTask) Path() string   { return t.path }
+func (t *testTask) Params() string { return "" }
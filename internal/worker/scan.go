@@ -5,6 +5,7 @@
 package worker
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -16,17 +17,23 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime/debug"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"cloud.google.com/go/storage"
+	"golang.org/x/exp/event"
 	"golang.org/x/pkgsite-metrics/internal/bigquery"
 	"golang.org/x/pkgsite-metrics/internal/config"
 	"golang.org/x/pkgsite-metrics/internal/derrors"
 	"golang.org/x/pkgsite-metrics/internal/log"
 	"golang.org/x/pkgsite-metrics/internal/modules"
 	"golang.org/x/pkgsite-metrics/internal/proxy"
+	"golang.org/x/pkgsite-metrics/internal/sandbox"
 )
 
 const (
@@ -40,11 +47,173 @@ const (
 	// this directory to the same path internally, so this path works for both
 	// secure and insecure modes.
 	modulesDir = "/tmp/modules"
+
+	// moduleCacheDir holds extracted modules kept for later scans. It is
+	// not mounted in the sandbox; modules are copied to modulesDir.
+	moduleCacheDir = "/tmp/module-cache"
 )
 
+// newSandbox returns a sandbox for running scans, with the resource
+// limits of cfg.
+func newSandbox(cfg *config.Config) *sandbox.Sandbox {
+	sbox := sandbox.New("/bundle")
+	sbox.Runsc = "/usr/local/bin/runsc"
+	sbox.MemoryLimit = cfg.SandboxMemoryLimit
+	sbox.CPUQuota = cfg.SandboxCPUQuota
+	sbox.PidsLimit = cfg.SandboxPidsLimit
+	sbox.Env = privateGoEnv(cfg)
+	return sbox
+}
+
+// newSandboxPool returns a pool of sandbox containers for scans, with
+// the size and limits of cfg.
+func newSandboxPool(cfg *config.Config) *sandbox.Pool {
+	p := sandbox.NewPool(newSandbox(cfg), cfg.SandboxPoolSize, cfg.SandboxPoolMaxUses)
+	// Module directories are removed by the scans that create them,
+	// from outside the sandbox; modulesDir is a mount point, so it
+	// isn't touched here.
+	p.ResetDirs = []string{"/tmp"}
+	return p
+}
+
+// getSandbox returns a sandbox for a scan, from the server's pool if
+// it has one. The returned function must be called with the scan's
+// error when the scan is done.
+func (s *Server) getSandbox(ctx context.Context) (*sandbox.Sandbox, func(error), error) {
+	if s.sandboxPool == nil {
+		return newSandbox(s.cfg), func(error) {}, nil
+	}
+	sbox, err := s.sandboxPool.Get(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			err = fmt.Errorf("%w: %w", derrors.ScanModuleSandboxStartError, err)
+		}
+		return nil, nil, err
+	}
+	return sbox, func(err error) {
+		// A scan that failed, for whatever reason, may have left
+		// processes or files behind, so don't reuse its container.
+		s.sandboxPool.Put(sbox, err != nil)
+	}, nil
+}
+
+// sandboxError returns err, from running a command in the sandbox,
+// with the command's standard error added to its message. The result
+// wraps err, so that causes like a *sandbox.LimitError can be found.
+// If the sandbox could not be started, it also wraps
+// derrors.ScanModuleSandboxStartError.
+func sandboxError(err error) error {
+	var ee *exec.ExitError
+	if errors.As(err, &ee) && len(ee.Stderr) > 0 {
+		err = fmt.Errorf("%w: %s", err, bytes.TrimSpace(ee.Stderr))
+	}
+	if isSandboxStartFailure(err) {
+		return fmt.Errorf("%w: %w", derrors.ScanModuleSandboxStartError, err)
+	}
+	return err
+}
+
+// logStderr returns a function that logs a line of standard error
+// from scanning the module in dir, prefixed by the module's
+// path and version.
+func logStderr(ctx context.Context, dir string) func(string) {
+	prefix := strings.TrimPrefix(dir, sandboxRoot)
+	prefix = strings.TrimPrefix(prefix, modulesDir+"/")
+	return func(line string) {
+		log.Infof(ctx, "%s: %s", prefix, line)
+	}
+}
+
+// A logWriter is an io.Writer that calls its function with each
+// write, without a trailing newline. Each write should be one line.
+type logWriter func(string)
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
 var activeScans atomic.Int32
 
-func doScan(ctx context.Context, modulePath, version string, insecure bool, f func() error) (err error) {
+// cleanMu keeps scans from starting while the caches are cleaned.
+// A scan holds it for reading while it increments activeScans, and
+// cleaning holds it for writing.
+var cleanMu sync.RWMutex
+
+// A scanLimiter limits the number of scan requests handled at once.
+type scanLimiter struct {
+	max    int32 // if zero, there is no limit
+	active atomic.Int32
+}
+
+func newScanLimiter(max int) *scanLimiter {
+	return &scanLimiter{max: int32(max)}
+}
+
+// do calls f, unless l.max requests are already active. In that case
+// it returns a 429, so that the task queue delivers the request again
+// later instead of it waiting on this instance.
+func (l *scanLimiter) do(w http.ResponseWriter, f func() error) error {
+	if n := l.active.Add(1); l.max > 0 && n > l.max {
+		l.active.Add(-1)
+		w.Header().Set(retryHeader, "true")
+		return &serverError{
+			status: http.StatusTooManyRequests,
+			err:    fmt.Errorf("%d scans already active on this instance", l.max),
+		}
+	}
+	defer l.active.Add(-1)
+	return f()
+}
+
+// An activeScan describes a scan in progress on this instance.
+type activeScan struct {
+	Module    string
+	Version   string
+	Mode      string
+	Start     time.Time
+	Sandboxed bool
+}
+
+// runningScans holds the scans in progress, for debugging.
+var runningScans = struct {
+	mu    sync.Mutex
+	scans map[*activeScan]bool
+}{scans: map[*activeScan]bool{}}
+
+// addRunningScan records a as running and returns a function
+// that removes it.
+func addRunningScan(a *activeScan) func() {
+	runningScans.mu.Lock()
+	defer runningScans.mu.Unlock()
+	runningScans.scans[a] = true
+	return func() {
+		runningScans.mu.Lock()
+		defer runningScans.mu.Unlock()
+		delete(runningScans.scans, a)
+	}
+}
+
+// listRunningScans returns the scans in progress, oldest first.
+func listRunningScans() []*activeScan {
+	runningScans.mu.Lock()
+	defer runningScans.mu.Unlock()
+	scans := []*activeScan{}
+	for a := range runningScans.scans {
+		c := *a
+		scans = append(scans, &c)
+	}
+	sort.Slice(scans, func(i, j int) bool { return scans[i].Start.Before(scans[j].Start) })
+	return scans
+}
+
+// doScan calls f to scan a module version, recording the scan as
+// running while it does. Unless the scan is insecure, it first checks
+// that the disk used by modules and the sandbox's caches is at most
+// diskLimit bytes; see checkDiskUsage. The caches are only cleaned
+// when no other scan is using them. The module cache, if non-nil, is
+// trimmed along with the Go caches, and counts towards diskLimit.
+func doScan(ctx context.Context, modulePath, version, mode string, insecure bool, diskLimit int64, moduleCache *modules.Cache, f func() error) (err error) {
 	defer derrors.Wrap(&err, "doScan(%q, %q)", modulePath, version)
 
 	defer func() {
@@ -56,17 +225,98 @@ func doScan(ctx context.Context, modulePath, version string, insecure bool, f fu
 	logMemory(ctx, fmt.Sprintf("before scanning %s@%s", modulePath, version))
 	defer logMemory(ctx, fmt.Sprintf("after scanning %s@%s", modulePath, version))
 
+	// This is deferred after the recover above, so it also runs on panic.
+	defer addRunningScan(&activeScan{
+		Module:    modulePath,
+		Version:   version,
+		Mode:      mode,
+		Start:     time.Now(),
+		Sandboxed: !insecure,
+	})()
+
+	cleanMu.RLock()
 	activeScans.Add(1)
+	cleanMu.RUnlock()
 	defer func() {
+		cleanMu.Lock()
+		defer cleanMu.Unlock()
 		if activeScans.Add(-1) == 0 {
 			logMemory(ctx, fmt.Sprintf("before 'go clean' for %s@%s", modulePath, version))
 			cleanGoCaches(ctx, insecure)
 			logMemory(ctx, "after 'go clean'")
+			if moduleCache != nil {
+				if err := moduleCache.Trim(); err != nil {
+					log.Errorf(ctx, err, "trimming module cache")
+				}
+			}
 		}
 	}()
+	if !insecure {
+		dirs := scanDiskDirs
+		if moduleCache != nil {
+			dirs = append(slices.Clip(dirs), moduleCache.Dir())
+		}
+		clean := func() bool {
+			cleanMu.Lock()
+			defer cleanMu.Unlock()
+			if activeScans.Load() > 1 {
+				// Other scans are using the caches.
+				return false
+			}
+			cleanGoCaches(ctx, insecure)
+			if moduleCache != nil {
+				if err := moduleCache.Clear(); err != nil {
+					log.Errorf(ctx, err, "clearing module cache")
+				}
+			}
+			return true
+		}
+		if err := checkDiskUsage(ctx, diskLimit, clean, dirs...); err != nil {
+			return err
+		}
+	}
 	return f()
 }
 
+// scanDiskDirs are the directories whose disk usage is limited:
+// the sandbox's Go caches, and the downloaded modules.
+var scanDiskDirs = []string{filepath.Join(sandboxRoot, "root"), modulesDir}
+
+// checkDiskUsage checks that dirs use at most limit bytes of disk.
+// If they use more, it calls clean, which reports whether it could
+// clean. If it couldn't, or dirs still use more, checkDiskUsage returns
+// an error wrapping derrors.ScanModuleDiskSpaceError.
+// If limit is zero, there is nothing to check.
+func checkDiskUsage(ctx context.Context, limit int64, clean func() bool, dirs ...string) error {
+	if limit <= 0 {
+		return nil
+	}
+	used, err := diskUsage(dirs...)
+	if err != nil {
+		// Let the scan run, rather than fail it because du failed.
+		log.Errorf(ctx, err, "checking disk usage")
+		return nil
+	}
+	if used <= limit {
+		return nil
+	}
+	log.Infof(ctx, "disk usage of %d bytes is over the limit of %d; cleaning caches", used, limit)
+	if !clean() {
+		return fmt.Errorf("%w: %d bytes used, limit is %d; not cleaning caches in use by other scans",
+			derrors.ScanModuleDiskSpaceError, used, limit)
+	}
+	used, err = diskUsage(dirs...)
+	if err != nil {
+		log.Errorf(ctx, err, "checking disk usage")
+		return nil
+	}
+	if used > limit {
+		return fmt.Errorf("%w: %d bytes used after cleaning caches, limit is %d",
+			derrors.ScanModuleDiskSpaceError, used, limit)
+	}
+	return nil
+}
+
 func cleanGoCaches(ctx context.Context, insecure bool) {
 	var (
 		out []byte
@@ -74,8 +324,12 @@ func cleanGoCaches(ctx context.Context, insecure bool) {
 	)
 
 	logDiskUsage := func(msg string) {
-		log.Debugf(ctx, "sandbox disk usage %s clean:\n%s",
-			msg, diskUsage(filepath.Join(sandboxRoot, "root"), modulesDir))
+		used, err := diskUsage(scanDiskDirs...)
+		if err != nil {
+			log.Debugf(ctx, "sandbox disk usage %s clean: %v", msg, err)
+			return
+		}
+		log.Debugf(ctx, "sandbox disk usage %s clean: %.1fM", msg, float64(used)/(1<<20))
 	}
 
 	if insecure {
@@ -116,26 +370,13 @@ func logMemory(ctx context.Context, prefix string) {
 		return
 	}
 
-	readIntFile := func(filename string) (int, error) {
-		data, err := os.ReadFile(filename)
-		if err != nil {
-			return 0, err
-		}
-		return strconv.Atoi(strings.TrimSpace(string(data)))
-	}
-
-	const (
-		curFilename = "/sys/fs/cgroup/memory/memory.usage_in_bytes"
-		maxFilename = "/sys/fs/cgroup/memory/memory.limit_in_bytes"
-	)
-
-	cur, err := readIntFile(curFilename)
+	cur, err := readIntFile(memoryUsageFile)
 	if err != nil {
-		log.Errorf(ctx, err, "reading %s", curFilename)
+		log.Errorf(ctx, err, "reading %s", memoryUsageFile)
 	}
-	max, err := readIntFile(maxFilename)
+	max, err := readIntFile(memoryLimitFile)
 	if err != nil {
-		log.Errorf(ctx, err, "reading %s", maxFilename)
+		log.Errorf(ctx, err, "reading %s", memoryLimitFile)
 	}
 
 	const G float64 = 1024 * 1024 * 1024
@@ -143,45 +384,59 @@ func logMemory(ctx context.Context, prefix string) {
 	log.Infof(ctx, "%s: using %.1fG out of %.1fG", prefix, float64(cur)/G, float64(max)/G)
 }
 
-// diskUsage runs the du command to determine how much disk space the given
-// directories occupy.
-func diskUsage(dirs ...string) string {
-	out, err := exec.Command("du", append([]string{"-h", "-s"}, dirs...)...).Output()
+// diskUsage runs the du command to determine how many bytes of disk
+// the given directories occupy in total. Directories that don't exist
+// occupy none.
+func diskUsage(dirs ...string) (int64, error) {
+	var existing []string
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir); err == nil {
+			existing = append(existing, dir)
+		}
+	}
+	if len(existing) == 0 {
+		return 0, nil
+	}
+	out, err := exec.Command("du", append([]string{"-s", "-k", "-c"}, existing...)...).Output()
+	if err != nil {
+		return 0, errors.New(derrors.IncludeStderr(err))
+	}
+	// The last line is the total, in kilobytes.
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("du: unexpected output %q", out)
+	}
+	kb, err := strconv.ParseInt(fields[0], 10, 64)
 	if err != nil {
-		return fmt.Sprintf("ERROR: %s", derrors.IncludeStderr(err))
+		return 0, fmt.Errorf("du: unexpected output %q", out)
 	}
-	return strings.TrimSpace(string(out))
+	return kb * 1024, nil
 }
 
-func writeResult(ctx context.Context, serve bool, w http.ResponseWriter, client *bigquery.Client, table string, row bigquery.Row) (err error) {
+// writeResult writes row to w if serve is true, and otherwise uploads it
+// to table with u.
+func writeResult(ctx context.Context, serve bool, w http.ResponseWriter, u *rowUploader, table string, row bigquery.Row) (err error) {
 	defer derrors.Wrap(&err, "writeResult")
 
 	if serve {
 		// Write the result to the client instead of uploading to BigQuery.
 		return serveJSON(ctx, row, w)
 	}
-	// Upload to BigQuery.
-	if client == nil {
-		log.Infof(ctx, "bigquery disabled, not uploading")
-		return nil
-	}
-	return client.Upload(ctx, table, row)
+	return u.upload(ctx, table, []bigquery.Row{row})
 }
 
 // writeResults is like writeResult but stores multiple rows in a single transaction.
-func writeResults(ctx context.Context, serve bool, w http.ResponseWriter, client *bigquery.Client, table string, rows []bigquery.Row) (err error) {
+func writeResults(ctx context.Context, serve bool, w http.ResponseWriter, u *rowUploader, table string, rows []bigquery.Row) (err error) {
 	defer derrors.Wrap(&err, "writeResults")
 
+	ctx, end := startStage(ctx, stageUpload)
+	defer func() { end(err) }()
 	if serve {
 		// Write the results to the client instead of uploading to BigQuery.
 		return serveJSON(ctx, rows, w)
 	}
-	// Upload to BigQuery.
-	if client == nil {
-		log.Infof(ctx, "bigquery disabled, not uploading")
-		return nil
-	}
-	return bigquery.UploadMany(ctx, client, table, rows, 0)
+	return u.upload(ctx, table, rows)
 }
 
 func serveJSON(ctx context.Context, content interface{}, w http.ResponseWriter) error {
@@ -234,36 +489,56 @@ func copyAndClose(wc io.WriteCloser, r io.Reader) error {
 
 func gcsOpenFileFunc(ctx context.Context, bucket *storage.BucketHandle) openFileFunc {
 	return func(name string) (io.ReadCloser, error) {
-		return bucket.Object(name).NewReader(ctx)
+		r, err := bucket.Object(name).NewReader(ctx)
+		if err != nil {
+			kind := derrors.GCSReadError
+			if isGCSNotFound(err) {
+				kind = derrors.GCSNotFoundError
+			}
+			return nil, fmt.Errorf("%w: %w", kind, err)
+		}
+		return r, nil
 	}
 }
 
 // prepareModule prepares a module for scanning. It downloads the module to the given
 // directory and takes other actions that increase the chance that package loading will succeed.
 // If init is true, those other actions include calling `go mod init` and `go mod tidy` on modules
-// that don't have go.mod files.
-func prepareModule(ctx context.Context, modulePath, version, dir string, proxyClient *proxy.Client, insecure, init bool) error {
+// that don't have go.mod files. It returns the number of times requests
+// to the proxy were retried. If checksumDB is non-nil, the module's zip
+// is verified against it. If moduleCache is non-nil, the module is
+// copied from it when it was extracted for an earlier scan. goEnv is
+// added to the environment of the go commands it runs.
+func prepareModule(ctx context.Context, modulePath, version, dir string, proxyClient *proxy.Client, checksumDB *modules.ChecksumDB, moduleCache *modules.Cache, goEnv []string, insecure, init bool) (proxyRetries int, err error) {
 	log.Debugf(ctx, "downloading %s@%s to %s", modulePath, version, dir)
-	if err := modules.Download(ctx, modulePath, version, dir, proxyClient); err != nil {
+	start := time.Now()
+	dctx, endDownload := startStage(ctx, stageModuleDownload)
+	proxyRetries, err = modules.Download(dctx, modulePath, version, dir, proxyClient, checksumDB, moduleCache)
+	endDownload(err)
+	gDownloadDuration.Record(ctx, time.Since(start), event.String("mode", scanMode(ctx)))
+	if err != nil {
 		log.Debugf(ctx, "download error: %v (%[1]T)", err)
-		return err
+		return proxyRetries, err
 	}
 
+	ctx, end := startStage(ctx, stageGoModDownload)
+	defer func() { end(err) }()
 	hasGoMod := fileExists(filepath.Join(dir, "go.mod"))
+	opts := &goCommandOptions{
+		dir:      dir,
+		insecure: insecure,
+		env:      goEnv,
+	}
 	if !init || hasGoMod {
 		// Download all dependencies, using the given directory for the Go module cache
 		// if it is non-empty.
-		opts := &goCommandOptions{
-			dir:      dir,
-			insecure: insecure,
-		}
-		return runGoCommand(ctx, modulePath, version, opts, "mod", "download")
+		return proxyRetries, runGoCommand(ctx, modulePath, version, opts, "mod", "download")
 	}
 	// Run `go mod init` and `go mod tidy`.
-	if err := goModInit(ctx, modulePath, version, dir, modulePath, insecure); err != nil {
-		return err
+	if err := goModInit(ctx, modulePath, version, modulePath, opts); err != nil {
+		return proxyRetries, err
 	}
-	return goModTidy(ctx, modulePath, version, dir, insecure)
+	return proxyRetries, goModTidy(ctx, modulePath, version, opts)
 }
 
 // moduleDir returns a the path of a directory where the module can be downloaded.
@@ -271,22 +546,19 @@ func moduleDir(modulePath, version string) string {
 	return filepath.Join(modulesDir, modulePath+"@"+version)
 }
 
-func goModInit(ctx context.Context, modulePath, version, dir, name string, insecure bool) error {
-	return runGoCommand(ctx, modulePath, version, &goCommandOptions{dir: dir, insecure: insecure}, "mod", "init", name)
+func goModInit(ctx context.Context, modulePath, version, name string, opts *goCommandOptions) error {
+	return runGoCommand(ctx, modulePath, version, opts, "mod", "init", name)
 }
 
-// goModTidy runs "go mod tidy" on a module in dir.
-func goModTidy(ctx context.Context, modulePath, version, dir string, insecure bool) error {
-	opts := &goCommandOptions{
-		dir:      dir,
-		insecure: insecure,
-	}
+// goModTidy runs "go mod tidy" on a module in opts.dir.
+func goModTidy(ctx context.Context, modulePath, version string, opts *goCommandOptions) error {
 	return runGoCommand(ctx, modulePath, version, opts, "mod", "tidy")
 }
 
 type goCommandOptions struct {
 	dir      string
 	insecure bool
+	env      []string // added to the environment, overriding the defaults
 }
 
 // runGoModCommand runs the command `go args...`.
@@ -307,9 +579,16 @@ func runGoCommand(ctx context.Context, modulePath, version string, opts *goComma
 		// Use sandbox mod cache.
 		cmd.Env = append(cmd.Env, "GOMODCACHE="+filepath.Join(sandboxRoot, sandboxGoModCache))
 	}
+	cmd.Env = append(cmd.Env, opts.env...)
 	if _, err := cmd.Output(); err != nil {
-		return fmt.Errorf("%w: 'go %s' for %s@%s returned %s",
-			derrors.BadModule, argstring, modulePath, version, derrors.IncludeStderr(err))
+		err = fmt.Errorf("'go %s' for %s@%s returned %s", argstring, modulePath, version, derrors.IncludeStderr(err))
+		// Failures of our infrastructure, like the network, are not
+		// problems with the module.
+		kind := derrors.BadModule
+		if ierr := infraError(err); ierr != nil {
+			kind = ierr
+		}
+		return fmt.Errorf("%w: %v", kind, err)
 	}
 	log.Infof(ctx, "'go %s' succeeded", argstring)
 	return nil
@@ -371,3 +650,101 @@ func isBuildIssue(err error) bool {
 func isSandboxRelatedIssue(err error) bool {
 	return strings.Contains(err.Error(), "exit status 137")
 }
+
+// infraErrors are the derrors sentinels for failures of the scanning
+// infrastructure, as opposed to problems with the module being scanned.
+var infraErrors = []error{
+	derrors.ScanModuleSandboxStartError,
+	derrors.ScanModuleModDownloadError,
+	derrors.GCSReadError,
+	derrors.GCSNotFoundError,
+	derrors.ChecksumDBError,
+	derrors.ScanModuleDiskSpaceError,
+	derrors.ScanModuleTimeoutError,
+}
+
+// infraError returns the sentinel in infraErrors for the failure that
+// err describes, or nil if it describes none. The failure is found from
+// the errors that err wraps, or from patterns in its message, which has
+// the standard error of failed commands.
+func infraError(err error) error {
+	for _, sentinel := range infraErrors {
+		if errors.Is(err, sentinel) {
+			return sentinel
+		}
+	}
+	switch {
+	case isDiskFull(err):
+		return derrors.ScanModuleDiskSpaceError
+	case isDeadlineExceeded(err):
+		return derrors.ScanModuleTimeoutError
+	case isSandboxStartFailure(err):
+		return derrors.ScanModuleSandboxStartError
+	case isGCSNotFound(err):
+		return derrors.GCSNotFoundError
+	case isNetworkFailure(err):
+		return derrors.ScanModuleModDownloadError
+	}
+	return nil
+}
+
+func isDiskFull(err error) bool {
+	return strings.Contains(err.Error(), "no space left on device")
+}
+
+func isDeadlineExceeded(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) ||
+		strings.Contains(err.Error(), "context deadline exceeded")
+}
+
+// isSandboxStartFailure recognizes errors from runsc when it cannot
+// create or start the sandbox's container, and failures to run runsc
+// itself.
+func isSandboxStartFailure(err error) bool {
+	errStr := err.Error()
+	return strings.Contains(errStr, "cannot create sandbox") ||
+		strings.Contains(errStr, "creating container") ||
+		strings.Contains(errStr, "starting container") ||
+		strings.Contains(errStr, "starting sandbox") ||
+		strings.Contains(errStr, "runsc: no such file or directory") ||
+		strings.Contains(errStr, "runsc: permission denied")
+}
+
+// isGCSNotFound recognizes errors for GCS objects or buckets that
+// don't exist.
+func isGCSNotFound(err error) bool {
+	return errors.Is(err, storage.ErrObjectNotExist) ||
+		errors.Is(err, storage.ErrBucketNotExist) ||
+		strings.Contains(err.Error(), "storage: object doesn't exist") ||
+		strings.Contains(err.Error(), "storage: bucket doesn't exist")
+}
+
+// infraHosts are the hosts of the services that scans use: the proxy,
+// the checksum and vulnerability databases, and Google Cloud.
+var infraHosts = []string{
+	"proxy.golang.org",
+	"sum.golang.org",
+	"vuln.go.dev",
+	"googleapis.com",
+}
+
+// isNetworkFailure recognizes errors from failed connections, as when
+// the go command cannot reach the proxy to download dependencies.
+// Failures to connect, or to look up a host, are only recognized for
+// the hosts of infraHosts: a dependency of a module may well be on
+// a host that no longer exists.
+func isNetworkFailure(err error) bool {
+	errStr := err.Error()
+	if strings.Contains(errStr, "dial tcp") || strings.Contains(errStr, "no such host") {
+		for _, h := range infraHosts {
+			if strings.Contains(errStr, h) {
+				return true
+			}
+		}
+		return false
+	}
+	return strings.Contains(errStr, "i/o timeout") ||
+		strings.Contains(errStr, "connection reset by peer") ||
+		strings.Contains(errStr, "connection refused") ||
+		strings.Contains(errStr, "TLS handshake timeout")
+}
@@ -8,13 +8,20 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
 	"golang.org/x/exp/slog"
 	"golang.org/x/pkgsite-metrics/internal/derrors"
 	"golang.org/x/pkgsite-metrics/internal/log"
 	"golang.org/x/pkgsite-metrics/internal/proxy"
+	"golang.org/x/pkgsite-metrics/internal/sandbox"
 	test "golang.org/x/pkgsite-metrics/internal/testing"
 )
 
@@ -49,10 +56,166 @@ func TestPrepareModule(t *testing.T) {
 	} {
 		t.Run(fmt.Sprintf("%s@%s,%t", test.modulePath, test.version, test.init), func(t *testing.T) {
 			dir := t.TempDir()
-			err := prepareModule(ctx, test.modulePath, test.version, dir, proxyClient, insecure, test.init)
+			_, err := prepareModule(ctx, test.modulePath, test.version, dir, proxyClient, nil, nil, nil, insecure, test.init)
 			if !errors.Is(err, test.want) {
 				t.Errorf("got %v, want %v", err, test.want)
 			}
 		})
 	}
 }
+
+func TestRunningScans(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- doScan(context.Background(), "m", "v1.0.0", "IMPORTS", true, 0, nil, func() error {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+	scans := listRunningScans()
+	if len(scans) != 1 || scans[0].Module != "m" || scans[0].Mode != "IMPORTS" || scans[0].Sandboxed {
+		t.Errorf("during scan: got %+v, want one unsandboxed IMPORTS scan of m", scans)
+	}
+	close(release)
+	if err := <-done; !errors.Is(err, derrors.ScanModulePanicError) {
+		t.Errorf("got %v, want ScanModulePanicError", err)
+	}
+	if scans := listRunningScans(); len(scans) != 0 {
+		t.Errorf("after scan: got %+v, want none", scans)
+	}
+}
+
+func TestScanLimiter(t *testing.T) {
+	const max = 2
+	l := newScanLimiter(max)
+	release := make(chan struct{})
+	var started, done sync.WaitGroup
+	for i := 0; i < max; i++ {
+		started.Add(1)
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			l.do(httptest.NewRecorder(), func() error {
+				started.Done()
+				<-release
+				return nil
+			})
+		}()
+	}
+	started.Wait()
+
+	// The limit is reached, so another request is rejected without running.
+	w := httptest.NewRecorder()
+	ran := false
+	err := l.do(w, func() error { ran = true; return nil })
+	var serr *serverError
+	if !errors.As(err, &serr) || serr.status != http.StatusTooManyRequests {
+		t.Errorf("got %v, want 429", err)
+	}
+	if ran {
+		t.Error("request over the limit ran")
+	}
+	if got := w.Header().Get(retryHeader); got != "true" {
+		t.Errorf("got %s header %q, want true", retryHeader, got)
+	}
+
+	close(release)
+	done.Wait()
+	if got := l.active.Load(); got != 0 {
+		t.Errorf("got %d active after all finished, want 0", got)
+	}
+	if err := l.do(httptest.NewRecorder(), func() error { ran = true; return nil }); err != nil || !ran {
+		t.Errorf("after release: got (%v, ran=%t), want (nil, true)", err, ran)
+	}
+
+	// With no limit, requests always run.
+	unlimited := newScanLimiter(0)
+	for i := 0; i < 3; i++ {
+		unlimited.active.Add(1)
+	}
+	if err := unlimited.do(httptest.NewRecorder(), func() error { return nil }); err != nil {
+		t.Errorf("no limit: got %v", err)
+	}
+}
+
+func TestSandboxError(t *testing.T) {
+	ee := &exec.ExitError{Stderr: []byte("out of memory\n")}
+	le := &sandbox.LimitError{Resource: sandbox.ResourceMemory, Limit: 1, Err: ee}
+	err := sandboxError(fmt.Errorf("Cmd.Output: %w", le))
+	if !isSandboxMemoryLimit(err) {
+		t.Errorf("got %v, want a memory LimitError", err)
+	}
+	if got, want := err.Error(), ": out of memory"; !strings.HasSuffix(got, want) {
+		t.Errorf("got %q, want it to end with %q", got, want)
+	}
+	plain := errors.New("bad")
+	if got := sandboxError(plain); got != plain {
+		t.Errorf("got %v, want %v", got, plain)
+	}
+	start := &exec.ExitError{Stderr: []byte("creating container: cannot create sandbox: EOF")}
+	if err := sandboxError(start); !errors.Is(err, derrors.ScanModuleSandboxStartError) {
+		t.Errorf("got %v, want a sandbox start error", err)
+	}
+}
+
+func TestCheckDiskUsage(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "cache")
+	if err := os.WriteFile(file, make([]byte, 100<<10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	used, err := diskUsage(dir, filepath.Join(dir, "missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used < 100<<10 {
+		t.Fatalf("got %d bytes used, want at least %d", used, 100<<10)
+	}
+
+	ctx := context.Background()
+	cleaned := false
+	noClean := func() bool {
+		cleaned = true
+		return true
+	}
+	removeFile := func() bool {
+		cleaned = true
+		os.Remove(file)
+		return true
+	}
+	inUse := func() bool { return false }
+	for _, test := range []struct {
+		name        string
+		limit       int64
+		clean       func() bool
+		wantCleaned bool
+		wantErr     error
+	}{
+		{"no limit", 0, noClean, false, nil},
+		{"under", used + 1<<20, noClean, false, nil},
+		{"still over", 10 << 10, noClean, true, derrors.ScanModuleDiskSpaceError},
+		{"in use", 10 << 10, inUse, false, derrors.ScanModuleDiskSpaceError},
+		{"cleaned", 10 << 10, removeFile, true, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cleaned = false
+			err := checkDiskUsage(ctx, test.limit, test.clean, dir)
+			if !errors.Is(err, test.wantErr) || (err != nil) != (test.wantErr != nil) {
+				t.Errorf("got error %v, want %v", err, test.wantErr)
+			}
+			if cleaned != test.wantCleaned {
+				t.Errorf("got cleaned=%t, want %t", cleaned, test.wantCleaned)
+			}
+			if err != nil {
+				// The error isn't attributed to the module.
+				if got, want := derrors.CategorizeError(classifyAnalysisError(err, false)), "DISK SPACE"; got != want {
+					t.Errorf("got category %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
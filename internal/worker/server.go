@@ -16,7 +16,9 @@ import (
 	"sync/atomic"
 	"time"
 
+	bq "cloud.google.com/go/bigquery"
 	"cloud.google.com/go/errorreporting"
+	"cloud.google.com/go/storage"
 	"golang.org/x/pkgsite-metrics/internal/analysis"
 	"golang.org/x/pkgsite-metrics/internal/bigquery"
 	"golang.org/x/pkgsite-metrics/internal/config"
@@ -25,29 +27,69 @@ import (
 	"golang.org/x/pkgsite-metrics/internal/govulncheck"
 	"golang.org/x/pkgsite-metrics/internal/jobs"
 	"golang.org/x/pkgsite-metrics/internal/log"
+	"golang.org/x/pkgsite-metrics/internal/modules"
 	"golang.org/x/pkgsite-metrics/internal/observe"
 	"golang.org/x/pkgsite-metrics/internal/proxy"
 	"golang.org/x/pkgsite-metrics/internal/queue"
+	"golang.org/x/pkgsite-metrics/internal/sandbox"
+	"golang.org/x/pkgsite-metrics/internal/vulndb"
 )
 
 type Server struct {
 	cfg         *config.Config
 	observer    *observe.Observer
 	bqClient    *bigquery.Client
+	rows        *rowUploader // uploads result rows to bqClient
 	proxyClient *proxy.Client
+	checksumDB  *modules.ChecksumDB // nil if module zips aren't verified
+	moduleCache *modules.Cache      // nil if extracted modules aren't kept
+	goEnv       []string            // environment of go commands run outside the sandbox
+	modeConfigs *config.ModeConfigs // per-mode overrides of scan settings
 	queue       queue.Queue
 	jobDB       *jobs.DB
 	// Firestore namespace for storing work versions.
 	fsNamespace *fstore.Namespace
+	// completedTasks records the scans whose rows were uploaded, so
+	// that retries of their tasks skip them. If it is nil, they don't.
+	completedTasks completedTaskStore
 
 	// reqs is the number of incoming scan requests, both analysis and
 	// govulncheck. Used for monitoring, debugging, and server restart.
 	reqs atomic.Uint64
 
+	// scanLimiter limits the govulncheck scan requests handled at once.
+	scanLimiter *scanLimiter
+
+	// sandboxPool holds running sandbox containers for scans.
+	// It is nil if each command runs in a new container.
+	sandboxPool *sandbox.Pool
+
+	// requestCtx is the base context of incoming requests.
+	// Shutdown cancels it to stop the scans that don't finish in time.
+	requestCtx     context.Context
+	cancelRequests context.CancelFunc
+
 	devMode bool
 	mu      sync.Mutex
 }
 
+// CloseSandboxes removes the server's idle sandbox containers.
+// It should be called before the server exits.
+func (s *Server) CloseSandboxes() {
+	if s.sandboxPool != nil {
+		s.sandboxPool.Close()
+	}
+}
+
+// Flush uploads any rows that are waiting to be uploaded in a batch.
+// It should be called before the server exits.
+func (s *Server) Flush(ctx context.Context) error {
+	if s.rows == nil || s.rows.batch == nil {
+		return nil
+	}
+	return s.rows.batch.Flush(ctx)
+}
+
 // Info summarizes Server execution as text.
 func (s *Server) Info() string {
 	return fmt.Sprintf("total requests: %d", s.reqs.Load())
@@ -66,19 +108,22 @@ func NewServer(ctx context.Context, cfg *config.Config) (_ *Server, err error) {
 		}
 	}
 
+	sink, err := bigquery.NewSink(cfg.BigQuerySink, bq)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := sink.(*bigquery.FileSink); ok {
+		log.Infof(ctx, "writing rows to %s", cfg.BigQuerySink)
+	}
+
 	// Use the same name for the namespace as the BQ dataset.
 	ns, err := fstore.OpenNamespace(ctx, cfg.ProjectID, cfg.BigQueryDataset)
 	if err != nil {
 		return nil, err
 	}
 
-	q, err := queue.New(ctx, cfg,
-		func(ctx context.Context, t queue.Task) (int, error) {
-			// When running locally, only the module path and version are
-			// printed for now.
-			log.Infof(ctx, "enqueuing %s?%s", t.Path(), t.Params())
-			return 0, nil
-		})
+	// The handlers are registered on the default mux below.
+	q, err := queue.New(ctx, cfg, dispatchTask(http.DefaultServeMux))
 	log.Debugf(ctx, "queue.New returned err %v", err)
 	if err != nil {
 		return nil, err
@@ -91,6 +136,16 @@ func NewServer(ctx context.Context, cfg *config.Config) (_ *Server, err error) {
 	if err != nil {
 		return nil, err
 	}
+	var netrcFile string
+	if cfg.ProxyAuthSecret != "" {
+		proxyClient, netrcFile, err = withProxyAuth(ctx, proxyClient, cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.ProxyQPS > 0 {
+		proxyClient = proxyClient.WithRateLimit(cfg.ProxyQPS)
+	}
 
 	var jdb *jobs.DB
 	if cfg.ProjectID != "" {
@@ -101,13 +156,67 @@ func NewServer(ctx context.Context, cfg *config.Config) (_ *Server, err error) {
 		}
 	}
 	s := &Server{
-		cfg:         cfg,
-		bqClient:    bq,
-		queue:       q,
-		proxyClient: proxyClient,
-		devMode:     cfg.DevMode,
-		jobDB:       jdb,
-		fsNamespace: ns,
+		cfg:            cfg,
+		bqClient:       bq,
+		queue:          q,
+		proxyClient:    proxyClient,
+		goEnv:          hostGoEnv(cfg, netrcFile),
+		devMode:        cfg.DevMode,
+		jobDB:          jdb,
+		fsNamespace:    ns,
+		completedTasks: &fsCompletedTasks{ns: ns},
+		scanLimiter:    newScanLimiter(cfg.MaxActiveScans),
+		rows:           &rowUploader{sink: sink},
+	}
+	s.requestCtx, s.cancelRequests = context.WithCancel(context.WithoutCancel(ctx))
+	if cfg.ChecksumDB != "off" {
+		s.checksumDB, err = modules.NewChecksumDB(cfg.ChecksumDB)
+		if err != nil {
+			return nil, err
+		}
+		if noSumDB := noSumDBPatterns(cfg); noSumDB != "" {
+			s.checksumDB = s.checksumDB.WithNoSumDB(noSumDB)
+		}
+	}
+	if cfg.ZipCacheBucket != "" {
+		c, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		// Cache only zips that match the checksum database, so that a
+		// bad download can't poison the cache.
+		var verify proxy.ZipVerifier
+		if s.checksumDB != nil {
+			verify = s.checksumDB.Verify
+		}
+		s.proxyClient = s.proxyClient.WithZipCache(c.Bucket(cfg.ZipCacheBucket), verify)
+	}
+	if cfg.ModuleCacheLimit > 0 {
+		s.moduleCache, err = modules.NewCache(moduleCacheDir, cfg.ModuleCacheLimit)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.modeConfigs, err = config.LoadModeConfigs(ctx, cfg.ModeConfig)
+	if err != nil {
+		return nil, err
+	}
+	warnUnknownModes(ctx, s.modeConfigs)
+	if strings.HasPrefix(cfg.ModeConfig, "gs://") && cfg.ModeConfigRefresh > 0 {
+		go s.refreshModeConfigs(ctx, cfg.ModeConfigRefresh)
+	}
+	if cfg.SandboxPoolSize > 1 && !cfg.Insecure {
+		s.sandboxPool = newSandboxPool(cfg)
+	}
+	if sink != nil && cfg.BigQueryBatchRows > 0 {
+		s.rows.batch = bigquery.NewBatchUploader(ctx, sink, cfg.BigQueryBatchRows, cfg.BigQueryBatchInterval)
+	}
+	if cfg.DeadLetterBucket != "" {
+		c, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.rows.deadLetter = bigquery.NewDeadLetter(c.Bucket(cfg.DeadLetterBucket))
 	}
 
 	if cfg.ProjectID != "" && cfg.ServiceID != "" {
@@ -132,30 +241,66 @@ func NewServer(ctx context.Context, cfg *config.Config) (_ *Server, err error) {
 		derrors.SetReportingClient(reportingClient)
 	}
 
-	if err := ensureTable(ctx, bq, govulncheck.TableName); err != nil {
+	if err := ensureTable(ctx, cfg, bq, govulncheck.TableName, govulncheck.Result{}); err != nil {
 		return nil, err
 	}
-	s.registerGovulncheckHandlers()
-	if err := ensureTable(ctx, bq, analysis.TableName); err != nil {
+	if err := s.registerGovulncheckHandlers(ctx); err != nil {
+		return nil, err
+	}
+	if err := ensureTable(ctx, cfg, bq, analysis.TableName, analysis.Result{}); err != nil {
+		return nil, err
+	}
+	if err := ensureTable(ctx, cfg, bq, analysis.JobSummaryTableName, analysis.JobSummary{}); err != nil {
 		return nil, err
 	}
 	if err := s.registerAnalysisHandlers(ctx); err != nil {
 		return nil, err
 	}
+	if bq != nil {
+		if err := ensureVulnDBTable(ctx, cfg); err != nil {
+			return nil, err
+		}
+	}
 
 	// compute vulndb entries
 	s.handle("/vulndb", s.handleVulnDB)
 	// compute missing vuln.go.dev request counts
 	s.handle("/compute-requests", s.handleComputeRequests)
 	s.handle("/jobs/", s.handleJobs)
+	s.handle("/queue/stats", s.handleQueueStats)
+	s.handle("/queue/purge", s.handlePurge)
+	s.handle("/bigquery/replay-deadletter", s.handleReplayDeadLetter)
+	s.handle("/healthz", s.handleHealthz)
+	s.handle("/readyz", s.handleReadyz)
+	s.handle("/debug/active-scans", s.handleActiveScans)
+
+	// With a Pub/Sub queue, the worker pulls its own tasks instead of
+	// having them pushed to it. Start pulling now that the handlers
+	// are registered.
+	if ps, ok := q.(*queue.PubSub); ok && cfg.PubSubSubscription != "" {
+		go ps.Subscribe(ctx, cfg.ProjectID, cfg.PubSubSubscription, cfg.LocalQueueWorkers, dispatchTask(http.DefaultServeMux))
+	}
 	return s, nil
 }
 
-func ensureTable(ctx context.Context, bq *bigquery.Client, name string) error {
+// ensureTable creates or updates the table with the given name, whose
+// rows are of the same type as row. If the table should be partitioned
+// but isn't, ensureTable logs a warning and keeps using it: the table
+// must be migrated with the bqmigrate command, while no worker is
+// writing to it.
+//
+// An existing table's schema may still differ from row's in ways that
+// can't be fixed automatically. ensureTable logs the differences, and
+// fails if cfg.StrictSchema is true.
+func ensureTable(ctx context.Context, cfg *config.Config, bq *bigquery.Client, name string, row any) error {
 	if bq == nil {
 		return nil
 	}
 	created, err := bq.CreateOrUpdateTable(ctx, name)
+	if errors.Is(err, bigquery.ErrNotPartitioned) {
+		log.Warnf(ctx, "table %s is not partitioned; migrate it with cmd/bqmigrate", name)
+		err = nil
+	}
 	if err != nil {
 		return err
 	}
@@ -164,9 +309,34 @@ func ensureTable(ctx context.Context, bq *bigquery.Client, name string) error {
 		verb = "created"
 	}
 	log.Infof(ctx, "%s table %s\n", verb, name)
+	if created {
+		return nil
+	}
+	diff, err := bq.CheckSchema(ctx, name, row)
+	if err != nil {
+		return err
+	}
+	if !diff.Empty() {
+		err := fmt.Errorf("schema of table %s does not match %T: %s", name, row, diff)
+		if cfg.StrictSchema {
+			return err
+		}
+		log.Errorf(ctx, err, "checking schema")
+	}
 	return nil
 }
 
+// ensureVulnDBTable is ensureTable for the vulndb table, which lives
+// in its own dataset.
+func ensureVulnDBTable(ctx context.Context, cfg *config.Config) error {
+	c, err := bigquery.NewClientCreate(ctx, cfg.ProjectID, vulndb.DatasetName)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return ensureTable(ctx, cfg, c, vulndb.TableName, vulndb.Entry{})
+}
+
 const metricNamespace = "ecosystem/worker"
 
 type handlerFunc func(w http.ResponseWriter, r *http.Request) error
@@ -201,11 +371,17 @@ func (s *Server) handle(pattern string, handler handlerFunc) {
 	http.Handle(pattern, s.observer.Observe(h))
 }
 
-func (s *Server) registerGovulncheckHandlers() {
-	h := newGovulncheckServer(s)
+func (s *Server) registerGovulncheckHandlers(ctx context.Context) error {
+	h, err := newGovulncheckServer(ctx, s)
+	if err != nil {
+		return err
+	}
 	s.handle("/govulncheck/enqueueall", h.handleEnqueueAll)
 	s.handle("/govulncheck/enqueue", h.handleEnqueue)
 	s.handle("/govulncheck/scan/", reqMonitorHandler(s, h.handleScan))
+	s.handle("/govulncheck/skip", h.handleSkip)
+	s.handle("/govulncheck/recheck", h.handleRecheck)
+	return nil
 }
 
 func (s *Server) registerAnalysisHandlers(ctx context.Context) error {
@@ -215,6 +391,9 @@ func (s *Server) registerAnalysisHandlers(ctx context.Context) error {
 	}
 	s.handle("/analysis/scan/", reqMonitorHandler(s, h.handleScan))
 	s.handle("/analysis/enqueue", h.handleEnqueue)
+	s.handle("/analysis/estimate", h.handleEstimate)
+	s.handle("/analysis/validate", h.handleValidate)
+	s.handle("/analysis/test/", h.handleTest)
 	return nil
 }
 
@@ -255,8 +434,11 @@ func (s *Server) serveError(ctx context.Context, w http.ResponseWriter, _ *http.
 	if errors.Is(err, derrors.BadModule) {
 		err = &serverError{err: err, status: http.StatusNotAcceptable}
 	}
-	serr, ok := err.(*serverError)
-	if !ok {
+	if errors.Is(err, derrors.NotImplemented) {
+		err = &serverError{err: err, status: http.StatusNotImplemented}
+	}
+	var serr *serverError
+	if !errors.As(err, &serr) {
 		serr = &serverError{status: http.StatusInternalServerError, err: err}
 	}
 	if serr.status == http.StatusInternalServerError {
@@ -301,3 +483,45 @@ func FormatTime(t time.Time) string {
 	}
 	return t.In(locNewYork).Format("2006-01-02 15:04:05")
 }
+
+var (
+	instanceIDMu     sync.Mutex
+	cachedInstanceID string
+)
+
+// instanceID returns the ID of the Cloud Run instance running this
+// process, or the empty string if it isn't running on Cloud Run or the
+// ID can't be read. The ID is read from the metadata server until a
+// read succeeds.
+func instanceID(ctx context.Context) string {
+	if !config.OnCloudRun() {
+		return ""
+	}
+	instanceIDMu.Lock()
+	defer instanceIDMu.Unlock()
+	if cachedInstanceID == "" {
+		mctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		id, err := config.InstanceID(mctx)
+		if err != nil {
+			log.Warnf(ctx, "getting instance ID: %v", err)
+			return ""
+		}
+		cachedInstanceID = id
+	}
+	return cachedInstanceID
+}
+
+// runColumns returns the values of the instance_id, task_retry_count and
+// task_execution_count columns of a row written by instance id for a
+// request delivered by attempt, which may be nil.
+func runColumns(id string, attempt *queue.TaskAttempt) (instance bq.NullString, retries, executions bq.NullInt64) {
+	if id != "" {
+		instance = bigquery.NullString(id)
+	}
+	if attempt != nil {
+		retries = bigquery.NullInt(attempt.RetryCount)
+		executions = bigquery.NullInt(attempt.ExecutionCount)
+	}
+	return instance, retries, executions
+}
@@ -0,0 +1,87 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/pkgsite-metrics/internal/log"
+)
+
+// BaseContext returns the base context of the server's requests.
+// It should be used as the BaseContext of the http.Server that serves
+// the worker's handlers, so that Shutdown can stop the scans in progress.
+func (s *Server) BaseContext(net.Listener) context.Context {
+	return s.requestCtx
+}
+
+// A ShutdownSummary describes a shutdown of the server.
+type ShutdownSummary struct {
+	Duration    time.Duration // how long the shutdown took
+	Requests    uint64        // requests handled since the server started
+	ActiveScans int32         // scans in progress when the shutdown began
+	Canceled    int32         // scans canceled because they didn't finish in time
+	Unfinished  int32         // scans still in progress when the server stopped waiting
+	FlushError  error         // error uploading the rows waiting in a batch
+}
+
+func (s ShutdownSummary) String() string {
+	flush := "ok"
+	if s.FlushError != nil {
+		flush = s.FlushError.Error()
+	}
+	return fmt.Sprintf("shutdown took %s: %d requests handled, %d scans active, %d canceled, %d unfinished; flushing rows: %s",
+		s.Duration.Round(time.Millisecond), s.Requests, s.ActiveScans, s.Canceled, s.Unfinished, flush)
+}
+
+// Shutdown stops the server within grace, the time it has before the
+// process is killed. It stops hs from accepting requests and waits for
+// the requests in progress to finish. Scans still running after half of
+// grace are canceled, which kills their sandboxed commands. Requests are
+// waited for until three quarters of grace have passed, and the rest of
+// grace is left for uploading the rows waiting in a batch.
+//
+// The tasks of scans that don't finish are retried by the task queue.
+// Rows written by the retries have a non-zero task_retry_count, so that
+// any they duplicate can be recognized.
+func (s *Server) Shutdown(ctx context.Context, hs *http.Server, grace time.Duration) ShutdownSummary {
+	start := time.Now()
+	sum := ShutdownSummary{Requests: s.reqs.Load(), ActiveScans: activeScans.Load()}
+	log.Infof(ctx, "shutting down with %d scans active", sum.ActiveScans)
+
+	drainCtx, cancel := context.WithDeadline(ctx, start.Add(grace*3/4))
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- hs.Shutdown(drainCtx) }()
+	kill := time.NewTimer(grace / 2)
+	defer kill.Stop()
+	var err error
+	select {
+	case err = <-done:
+	case <-kill.C:
+		sum.Canceled = activeScans.Load()
+		if sum.Canceled > 0 {
+			log.Warnf(ctx, "canceling %d scans that did not finish in %s", sum.Canceled, grace/2)
+		}
+		s.cancelRequests()
+		err = <-done
+	}
+	if err != nil {
+		log.Errorf(ctx, err, "waiting for requests to finish")
+	}
+	sum.Unfinished = activeScans.Load()
+	s.cancelRequests()
+
+	flushCtx, cancel := context.WithDeadline(context.WithoutCancel(ctx), start.Add(grace))
+	defer cancel()
+	sum.FlushError = s.Flush(flushCtx)
+	s.CloseSandboxes()
+	sum.Duration = time.Since(start)
+	return sum
+}
@@ -0,0 +1,51 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	ctx := context.Background()
+	s := &Server{rows: &rowUploader{}}
+	s.requestCtx, s.cancelRequests = context.WithCancel(ctx)
+
+	// A scan that runs until it is canceled.
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/scan", func(w http.ResponseWriter, r *http.Request) {
+		doScan(r.Context(), "example.com/m", "v1.0.0", ModeGovulncheck, true, 0, nil, func() error {
+			close(started)
+			<-r.Context().Done()
+			return r.Context().Err()
+		})
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := &http.Server{Handler: mux, BaseContext: s.BaseContext}
+	go hs.Serve(ln)
+	url := "http://" + ln.Addr().String() + "/scan"
+	go http.Get(url)
+	<-started
+
+	sum := s.Shutdown(ctx, hs, 400*time.Millisecond)
+	if sum.ActiveScans != 1 || sum.Canceled != 1 || sum.Unfinished != 0 || sum.FlushError != nil {
+		t.Errorf("got %s, want 1 scan active and canceled, none unfinished", sum)
+	}
+	if sum.Duration >= 400*time.Millisecond {
+		t.Errorf("shutdown took %s, longer than the grace period", sum.Duration)
+	}
+	if resp, err := http.Get(url); err == nil {
+		resp.Body.Close()
+		t.Error("request after shutdown succeeded")
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/exp/event"
+)
+
+// The stages of a scan, each traced in its own span.
+const (
+	stageProxyInfo      = "proxy-info"      // resolving the version with the proxy
+	stageModuleDownload = "module-download" // downloading and extracting the module zip
+	stageGoModDownload  = "go-mod-download" // "go mod download", or "go mod init" and "go mod tidy"
+	stageSandboxRun     = "sandbox-run"     // running govulncheck, in the sandbox unless insecure
+	stageConvertResults = "convert-results" // converting govulncheck output to rows
+	stageUpload         = "bigquery-upload" // writing the rows to BigQuery, or serving them
+)
+
+// scanStageLatency records how long each stage of a scan takes.
+var scanStageLatency = event.NewDuration("govulncheck-scan-stage-latency", &event.MetricOptions{Namespace: metricNamespace})
+
+// scanLabelsKey is the context key for the labels of a scan.
+type scanLabelsKey struct{}
+
+// startScan starts the span of the scan of modulePath at version in mode,
+// and returns a context that holds it. The spans of the stages of the scan,
+// started by startStage with that context, are its children and have the
+// same labels. The caller must call event.End with the returned context.
+func startScan(ctx context.Context, modulePath, version, mode string) context.Context {
+	labels := []event.Label{
+		event.String("module", modulePath),
+		event.String("version", version),
+		event.String("mode", mode),
+	}
+	ctx = context.WithValue(ctx, scanLabelsKey{}, labels)
+	return event.Start(ctx, "govulncheck-scan", labels...)
+}
+
+// scanLabels returns the labels of the scan started in ctx, if any.
+func scanLabels(ctx context.Context) []event.Label {
+	labels, _ := ctx.Value(scanLabelsKey{}).([]event.Label)
+	return labels
+}
+
+// scanMode returns the mode of the scan started in ctx, or the empty
+// string if there is none.
+func scanMode(ctx context.Context) string {
+	for _, l := range scanLabels(ctx) {
+		if l.Name == "mode" {
+			return l.String()
+		}
+	}
+	return ""
+}
+
+// startStage starts the span of a stage of the scan in ctx, and returns
+// a context that holds it and a function to call with the stage's error
+// when it is done. That function ends the span and records the stage's
+// latency, labeled with the stage and the mode of the scan.
+func startStage(ctx context.Context, stage string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx = event.Start(ctx, "govulncheck-scan/"+stage, append(scanLabels(ctx), event.String("stage", stage))...)
+	return ctx, func(err error) {
+		success := event.Bool("success", err == nil)
+		scanStageLatency.Record(ctx, time.Since(start),
+			event.String("stage", stage), event.String("mode", scanMode(ctx)), success)
+		event.End(ctx, success)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/exp/event"
+)
+
+// eventRecorder is an event.Handler that records each event as a string.
+type eventRecorder struct {
+	events []string
+}
+
+func (r *eventRecorder) Event(ctx context.Context, ev *event.Event) context.Context {
+	var labels []string
+	for _, l := range ev.Labels {
+		switch v := l.Interface().(type) {
+		case event.Metric:
+			labels = append(labels, fmt.Sprintf("%s=%s", l.Name, v.Name()))
+		case string, bool:
+			labels = append(labels, fmt.Sprintf("%s=%v", l.Name, v))
+		}
+	}
+	r.events = append(r.events, fmt.Sprintf("%s %s", ev.Kind, strings.Join(labels, " ")))
+	return ctx
+}
+
+func TestTraceStages(t *testing.T) {
+	rec := &eventRecorder{}
+	ctx := event.WithExporter(context.Background(), event.NewExporter(rec, nil))
+
+	ctx = startScan(ctx, "example.com/m", "v1.0.0", ModeGovulncheck)
+	_, end := startStage(ctx, stageProxyInfo)
+	end(nil)
+	_, end = startStage(ctx, stageUpload)
+	end(errors.New("bad"))
+	event.End(ctx)
+
+	const labels = "module=example.com/m version=v1.0.0 mode=GOVULNCHECK"
+	want := []string{
+		"start name=govulncheck-scan " + labels,
+		"start name=govulncheck-scan/proxy-info " + labels + " stage=proxy-info",
+		"metric metric=govulncheck-scan-stage-latency stage=proxy-info mode=GOVULNCHECK success=true",
+		"end success=true",
+		"start name=govulncheck-scan/bigquery-upload " + labels + " stage=bigquery-upload",
+		"metric metric=govulncheck-scan-stage-latency stage=bigquery-upload mode=GOVULNCHECK success=false",
+		"end success=false",
+		"end ",
+	}
+	if !slices.Equal(rec.events, want) {
+		t.Errorf("events:\ngot  %q\nwant %q", rec.events, want)
+	}
+}
+
+func TestTraceStagesWithoutScan(t *testing.T) {
+	// Stages outside a scan, as in the analysis server, have no scan labels.
+	rec := &eventRecorder{}
+	ctx := event.WithExporter(context.Background(), event.NewExporter(rec, nil))
+	_, end := startStage(ctx, stageModuleDownload)
+	end(nil)
+	want := "start name=govulncheck-scan/module-download stage=module-download"
+	if len(rec.events) == 0 || rec.events[0] != want {
+		t.Errorf("got %q, want first event %q", rec.events, want)
+	}
+}
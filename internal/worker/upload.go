@@ -0,0 +1,141 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/pkgsite-metrics/internal/analysis"
+	"golang.org/x/pkgsite-metrics/internal/bigquery"
+	"golang.org/x/pkgsite-metrics/internal/derrors"
+	"golang.org/x/pkgsite-metrics/internal/govulncheck"
+	"golang.org/x/pkgsite-metrics/internal/log"
+	"golang.org/x/pkgsite-metrics/internal/scan"
+	"golang.org/x/pkgsite-metrics/internal/vulndb"
+)
+
+// A rowUploader uploads result rows to BigQuery, or another sink.
+// A nil rowUploader uploads nothing.
+type rowUploader struct {
+	sink       bigquery.Sink           // nil if uploading is disabled
+	batch      *bigquery.BatchUploader // if non-nil, rows are uploaded in batches with other requests' rows
+	deadLetter *bigquery.DeadLetter    // if non-nil, rows that can't be uploaded are saved here
+}
+
+// upload uploads rows to table. If the upload fails and u has a dead
+// letter, it saves the rows that were not uploaded there instead, so
+// the work that produced them isn't lost, and reports success.
+func (u *rowUploader) upload(ctx context.Context, table string, rows []bigquery.Row) error {
+	if u == nil || u.sink == nil {
+		log.Infof(ctx, "bigquery disabled, not uploading")
+		return nil
+	}
+	var err error
+	if u.batch != nil {
+		err = u.uploadBatched(ctx, table, rows)
+	} else {
+		err = u.sink.UploadRows(ctx, table, rows)
+	}
+	if err == nil || u.deadLetter == nil || ctx.Err() != nil {
+		return err
+	}
+	// Don't save rows that were stored.
+	var perr *bigquery.PartialUploadError
+	if errors.As(err, &perr) {
+		var failed []bigquery.Row
+		for _, i := range perr.Failed {
+			failed = append(failed, rows[i])
+		}
+		rows = failed
+	}
+	names, derr := u.deadLetter.Save(ctx, table, rows)
+	if derr != nil {
+		return errors.Join(err, derr)
+	}
+	log.Warnf(ctx, "upload to %s failed; saved %d rows to dead letter: %v", table, len(names), err)
+	return nil
+}
+
+// uploadBatched adds rows to the next batch for table and waits
+// for the batch to be uploaded. If some of the rows were not uploaded,
+// it uploads them one at a time, so that a bad row from another request
+// doesn't keep these from being stored. Rows that were stored are not
+// uploaded again.
+func (u *rowUploader) uploadBatched(ctx context.Context, table string, rows []bigquery.Row) error {
+	err := u.batch.Add(table, rows...).Wait(ctx)
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	var failed []int
+	var perr *bigquery.PartialUploadError
+	if errors.As(err, &perr) {
+		failed = perr.Failed
+	} else {
+		for i := range rows {
+			failed = append(failed, i)
+		}
+	}
+	log.Warnf(ctx, "batch upload to %s failed; uploading %d of %d rows individually: %v", table, len(failed), len(rows), err)
+	for k, i := range failed {
+		if err := u.sink.UploadRows(ctx, table, []bigquery.Row{rows[i]}); err != nil {
+			return &bigquery.PartialUploadError{Failed: failed[k:], Err: err}
+		}
+	}
+	return nil
+}
+
+// newDeadLetterRow returns a pointer to a row of the type stored
+// in table, or nil if there is no such table.
+func newDeadLetterRow(table string) bigquery.Row {
+	switch table {
+	case govulncheck.TableName:
+		return &govulncheck.Result{}
+	case analysis.TableName:
+		return &analysis.Result{}
+	case analysis.JobSummaryTableName:
+		return &analysis.JobSummary{}
+	case vulndb.TableName:
+		return &vulndb.Entry{}
+	default:
+		return nil
+	}
+}
+
+type replayParams struct {
+	Table string // if empty, all tables
+}
+
+// handleReplayDeadLetter uploads the rows saved in the dead letter
+// because they couldn't be uploaded before, and writes a
+// bigquery.ReplayStats.
+//
+// bigquery/replay-deadletter[?table=T]
+func (s *Server) handleReplayDeadLetter(w http.ResponseWriter, r *http.Request) (err error) {
+	defer derrors.Wrap(&err, "handleReplayDeadLetter")
+	ctx := r.Context()
+
+	if s.rows == nil || s.rows.deadLetter == nil {
+		return &serverError{err: errors.New("no dead-letter bucket (define GO_ECOSYSTEM_DEADLETTER_BUCKET)"), status: http.StatusNotImplemented}
+	}
+	if s.rows.sink == nil {
+		return &serverError{err: errors.New("BigQuery is disabled"), status: http.StatusNotImplemented}
+	}
+	var params replayParams
+	if err := scan.ParseParams(r, &params); err != nil {
+		return fmt.Errorf("%w: %v", derrors.InvalidArgument, err)
+	}
+	if params.Table != "" && newDeadLetterRow(params.Table) == nil {
+		return fmt.Errorf("%w: unknown table %q", derrors.InvalidArgument, params.Table)
+	}
+	stats, err := s.rows.deadLetter.Replay(ctx, s.rows.sink, params.Table, newDeadLetterRow)
+	if err != nil {
+		return err
+	}
+	log.Infof(ctx, "replayed dead letter: %d uploaded, %d failed", stats.NumUploaded, stats.NumFailed)
+	return writeJSON(w, stats)
+}
@@ -0,0 +1,127 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/pkgsite-metrics/internal/analysis"
+	"golang.org/x/pkgsite-metrics/internal/bigquery"
+	"golang.org/x/pkgsite-metrics/internal/govulncheck"
+	"golang.org/x/pkgsite-metrics/internal/vulndb"
+)
+
+func TestNewDeadLetterRow(t *testing.T) {
+	// Every table the worker writes results to must have a row type,
+	// or its dead letters can't be replayed.
+	for _, table := range []string{govulncheck.TableName, analysis.TableName, analysis.JobSummaryTableName, vulndb.TableName} {
+		if newDeadLetterRow(table) == nil {
+			t.Errorf("%s: no row type", table)
+		}
+	}
+	if newDeadLetterRow("nope") != nil {
+		t.Error("nope: got a row type, want nil")
+	}
+}
+
+func TestRowUploaderDisabled(t *testing.T) {
+	// With BigQuery disabled, rows are dropped without error.
+	var u *rowUploader
+	if err := u.upload(context.Background(), "t", []bigquery.Row{&analysis.Result{}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteResults(t *testing.T) {
+	ctx := context.Background()
+	var sink bigquery.MemorySink
+	u := &rowUploader{sink: &sink}
+	rows := []bigquery.Row{
+		&govulncheck.Result{ModulePath: "m", ScanMode: govulncheck.ModeGovulncheck},
+		&govulncheck.Result{ModulePath: "m", ScanMode: govulncheck.ModeBinary},
+	}
+	if err := writeResults(ctx, false, nil, u, govulncheck.TableName, rows); err != nil {
+		t.Fatal(err)
+	}
+	got := sink.Rows(govulncheck.TableName)
+	if len(got) != 2 || got[0] != rows[0] || got[1] != rows[1] {
+		t.Errorf("got %v, want %v", got, rows)
+	}
+
+	// Serving writes to the response instead.
+	w := httptest.NewRecorder()
+	if err := writeResult(ctx, true, w, u, analysis.TableName, &analysis.Result{ModulePath: "m"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.Rows(analysis.TableName)) != 0 || w.Body.Len() == 0 {
+		t.Errorf("serve: got %d rows uploaded and %d bytes served, want 0 and some",
+			len(sink.Rows(analysis.TableName)), w.Body.Len())
+	}
+}
+
+func TestHandleReplayDeadLetterNoBucket(t *testing.T) {
+	s := &Server{rows: &rowUploader{}}
+	err := s.handleReplayDeadLetter(httptest.NewRecorder(), httptest.NewRequest("GET", "/bigquery/replay-deadletter", nil))
+	var serr *serverError
+	if !errors.As(err, &serr) || serr.status != http.StatusNotImplemented {
+		t.Errorf("got %v, want status %d", err, http.StatusNotImplemented)
+	}
+}
+
+// flakySink stores rows like a MemorySink, but rejects each row for
+// module "flaky" the first time it is uploaded.
+type flakySink struct {
+	bigquery.MemorySink
+	rejected bool
+}
+
+func (s *flakySink) UploadRows(ctx context.Context, table string, rows []bigquery.Row) error {
+	var ok []bigquery.Row
+	var failed []int
+	for i, r := range rows {
+		if r.(*analysis.Result).ModulePath == "flaky" && !s.rejected {
+			s.rejected = true
+			failed = append(failed, i)
+			continue
+		}
+		ok = append(ok, r)
+	}
+	if err := s.MemorySink.UploadRows(ctx, table, ok); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return &bigquery.PartialUploadError{Failed: failed, Err: errors.New("rejected")}
+	}
+	return nil
+}
+
+func TestUploadBatchedPartialFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sink := &flakySink{}
+	u := &rowUploader{sink: sink, batch: bigquery.NewBatchUploader(ctx, sink, 3, time.Hour)}
+	rows := []bigquery.Row{
+		&analysis.Result{ModulePath: "a"},
+		&analysis.Result{ModulePath: "flaky"},
+		&analysis.Result{ModulePath: "b"},
+	}
+	if err := u.upload(ctx, analysis.TableName, rows); err != nil {
+		t.Fatal(err)
+	}
+	// Only the rejected row is uploaded again, so no row is duplicated.
+	var got []string
+	for _, r := range sink.Rows(analysis.TableName) {
+		got = append(got, r.(*analysis.Result).ModulePath)
+	}
+	if want := []string{"a", "b", "flaky"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
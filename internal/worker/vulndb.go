@@ -85,7 +85,7 @@ func (s *Server) handleVulnDB(w http.ResponseWriter, r *http.Request) (err error
 			log.Infof(ctx, "skipping entry %s, it has not been modified", e.ID)
 			continue
 		}
-		if err = writeResult(ctx, false, w, dbClient, vulndb.TableName, e); err != nil {
+		if err = writeResult(ctx, false, w, &rowUploader{sink: dbClient}, vulndb.TableName, e); err != nil {
 			return err
 		}
 	}
@@ -159,6 +159,10 @@ resource "google_cloud_run_service" "worker" {
           name  = "GO_ECOSYSTEM_BINARY_BUCKET"
           value = "go-ecosystem"
         }
+        env {
+          name  = "GO_ECOSYSTEM_RESULTS_BUCKET"
+          value = "go-ecosystem"
+        }
         env {
           name  = "GO_ECOSYSTEM_VULNDB_BUCKET_PROJECT"
           value = var.vulndb_bucket_project